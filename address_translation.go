@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A and AAAA records translated when reflected, exposed on /debug/vars
+var translatedAddresses = expvar.NewInt("translated_addresses")
+
+// addressTranslation maps the addresses of a prefix to the same host addresses in another prefix of the same length
+type addressTranslation struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// translate returns the address ip is translated to, or false when ip is outside of the translated prefix
+func (translation addressTranslation) translate(ip net.IP) (net.IP, bool) {
+	if ip4 := ip.To4(); ip4 != nil && len(translation.from.IP) == net.IPv4len {
+		ip = ip4
+	}
+	if len(ip) != len(translation.from.IP) || !translation.from.Contains(ip) {
+		return nil, false
+	}
+	translated := make(net.IP, len(ip))
+	for i := range ip {
+		translated[i] = translation.to.IP[i] | ip[i]&^translation.to.Mask[i]
+	}
+	return translated, true
+}
+
+// parseTranslatedPrefix parses a prefix of the address_translation section, a single address being a full-length prefix
+func parseTranslatedPrefix(prefix string) (*net.IPNet, error) {
+	if ip := net.ParseIP(prefix); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	return network, err
+}
+
+// parseAddressTranslation checks the address_translation section, mapping for each target VLAN the prefixes
+// advertised in the reflected answers to the prefixes the clients of the VLAN reach them through
+func (cfg *brconfig) parseAddressTranslation() error {
+	cfg.translations = make(map[uint16][]addressTranslation)
+	for key, mapping := range cfg.AddressTranslation {
+		tag, err := strconv.ParseUint(key, 10, 12)
+		if err != nil {
+			return fmt.Errorf("invalid VLAN tag %q in address_translation section", key)
+		}
+		for from, to := range mapping {
+			var translation addressTranslation
+			if translation.from, err = parseTranslatedPrefix(from); err != nil {
+				return fmt.Errorf("invalid prefix %q in address_translation for VLAN %v", from, tag)
+			}
+			if translation.to, err = parseTranslatedPrefix(to); err != nil {
+				return fmt.Errorf("invalid prefix %q in address_translation for VLAN %v", to, tag)
+			}
+			if !bytes.Equal(translation.from.Mask, translation.to.Mask) {
+				return fmt.Errorf("prefixes %v and %v of VLAN %v must have the same length and address family", from, to, tag)
+			}
+			cfg.translations[uint16(tag)] = append(cfg.translations[uint16(tag)], translation)
+		}
+	}
+	return nil
+}
+
+// translateRecord replaces the address of an A or AAAA record according to translations, and tells whether it did
+func translateRecord(record *layers.DNSResourceRecord, translations []addressTranslation) bool {
+	if record.Type != layers.DNSTypeA && record.Type != layers.DNSTypeAAAA {
+		return false
+	}
+	for _, translation := range translations {
+		if ip, ok := translation.translate(record.IP); ok {
+			record.IP = ip
+			translatedAddresses.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// translateAddresses replaces the A and AAAA records of bonjourPacket according to the address translations
+// of the VLAN tag, until the returned function is called. Like the source address, the records are shared
+// by the frames reflected on every VLAN.
+func translateAddresses(bonjourPacket *bonjourPacket, translations []addressTranslation) (restore func()) {
+	if bonjourPacket.dns == nil || len(translations) == 0 {
+		return func() {}
+	}
+	type replacement struct {
+		record *layers.DNSResourceRecord
+		ip     net.IP
+	}
+	var replaced []replacement
+	for _, records := range [][]layers.DNSResourceRecord{bonjourPacket.dns.Answers, bonjourPacket.dns.Authorities, bonjourPacket.dns.Additionals} {
+		for i := range records {
+			ip := records[i].IP
+			if translateRecord(&records[i], translations) {
+				replaced = append(replaced, replacement{&records[i], ip})
+			}
+		}
+	}
+	if len(replaced) == 0 {
+		return func() {}
+	}
+	rewritten := bonjourPacket.dnsRewritten
+	bonjourPacket.dnsRewritten = true
+	return func() {
+		for _, r := range replaced {
+			r.record.IP = r.ip
+		}
+		bonjourPacket.dnsRewritten = rewritten
+	}
+}
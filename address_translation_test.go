@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestAddressTranslation(t *testing.T) {
+	cfg, err := parseConfig(`
+[address_translation."40"]
+"192.168.30.0/24" = "10.30.0.0/24"
+"fd00::10" = "fd00:99::10"
+`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"192.168.30.7", "10.30.0.7"},
+		{"fd00::10", "fd00:99::10"},
+		{"192.168.31.7", ""},
+		{"fd00::11", ""},
+	}
+	for _, test := range tests {
+		record := layers.DNSResourceRecord{Type: layers.DNSTypeA, IP: net.ParseIP(test.ip)}
+		if record.IP.To4() == nil {
+			record.Type = layers.DNSTypeAAAA
+		}
+		translated := translateRecord(&record, cfg.translations[40])
+		if translated != (test.expected != "") || (translated && !record.IP.Equal(net.ParseIP(test.expected))) {
+			t.Errorf("Error in translateRecord() for %v: got %v, expected %q", test.ip, record.IP, test.expected)
+		}
+	}
+
+	for _, content := range []string{
+		"[address_translation.\"40\"]\n\"192.168.30.0/24\" = \"10.30.0.0/16\"",
+		"[address_translation.\"40\"]\n\"192.168.30.7\" = \"fd00::7\"",
+		"[address_translation.\"40\"]\n\"192.168.30.0/24\" = \"printer\"",
+		"[address_translation.\"4096\"]\n\"192.168.30.7\" = \"10.30.0.7\"",
+	} {
+		if _, err := parseConfig(content); err == nil {
+			t.Errorf("Error in parseConfig(): expected an error for %q", content)
+		}
+	}
+
+	// The records are translated on the VLANs with a translation only, and restored once reflected
+	r, writer := createMockReflector(cfg)
+	packet := createMockLegacyPacket(vlanIdentifierTest, net.IP{192, 168, 30, 7}, net.IP{224, 0, 0, 251}, 5353, 5353,
+		createMockAddressAnswer("192.168.30.7", "fd00::10"))
+	r.send(&packet, []uint16{40, 50})
+	if len(writer.frames) != 2 {
+		t.Fatalf("Error in send(): expected 2 reflected frames, got %d", len(writer.frames))
+	}
+	for i, expected := range [][]string{{"10.30.0.7", "fd00:99::10"}, {"192.168.30.7", "fd00::10"}} {
+		_, payload := parseUDPLayer(gopacket.NewPacket(writer.frames[i], layers.LayerTypeEthernet, gopacket.Default))
+		_, dns := parseDNSPayload(payload)
+		if dns == nil || len(dns.Additionals) != 2 || !dns.Additionals[0].IP.Equal(net.ParseIP(expected[0])) || !dns.Additionals[1].IP.Equal(net.ParseIP(expected[1])) {
+			t.Errorf("Error in send(): expected the addresses %v on VLAN %v, got %+v", expected, writer.vlanTags()[i], dns)
+		}
+	}
+	if packet.dnsRewritten || !packet.dns.Additionals[0].IP.Equal(net.IP{192, 168, 30, 7}) {
+		t.Errorf("Error in send(): the records of the reflected packet were not restored, got %v", packet.dns.Additionals)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// addressValidationMode defines what happens to the A and AAAA records of an answer
+// whose address is outside of the subnets of its source VLAN
+type addressValidationMode string
+
+const (
+	addressValidationOff  addressValidationMode = "off"
+	addressValidationFlag addressValidationMode = "flag"
+	addressValidationDrop addressValidationMode = "drop"
+)
+
+// Maximal number of (device, address) pairs remembered to log each invalid address only once
+const maxFlaggedAddresses = 4096
+
+// Records outside of the subnets of their source VLAN, exposed on /debug/vars
+var addressValidationStats = expvar.NewMap("address_validation")
+
+func (mode addressValidationMode) isValid() bool {
+	switch mode {
+	case addressValidationOff, addressValidationFlag, addressValidationDrop:
+		return true
+	}
+	return false
+}
+
+// addressValidation returns the validation mode of the answers sent on a VLAN, and the subnets they are checked against:
+// the configured ones, and the learned prefixes. Per-VLAN settings take precedence over the global one, and VLANs
+// without subnets are never checked.
+func (cfg *brconfig) addressValidation(tag uint16, learned []*net.IPNet) (addressValidationMode, []*net.IPNet) {
+	vlan := cfg.vlans[tag]
+	mode := cfg.AddressValidation
+	if vlan.AddressValidation != "" {
+		mode = vlan.AddressValidation
+	}
+	subnets := append(vlan.subnets[:len(vlan.subnets):len(vlan.subnets)], learned...)
+	if len(subnets) == 0 {
+		return addressValidationOff, nil
+	}
+	return mode, subnets
+}
+
+// addressValidator checks the addresses advertised by the answers against the subnets of their source VLAN,
+// catching devices which advertise VPN or container addresses that cannot be reached from other VLANs
+type addressValidator struct {
+	// flagged remembers the invalid addresses already logged
+	flagged map[string]bool
+	// prefixes learns the IPv6 prefixes of the VLANs, when enabled
+	prefixes *prefixLearner
+}
+
+func newAddressValidator(prefixes *prefixLearner) *addressValidator {
+	return &addressValidator{flagged: make(map[string]bool), prefixes: prefixes}
+}
+
+// validate applies the validation mode of the source VLAN to the answer of bonjourPacket,
+// and returns tags, or nothing when the answer must not be reflected anymore
+func (validator *addressValidator) validate(cfg *brconfig, bonjourPacket *bonjourPacket, tags []uint16) []uint16 {
+	if bonjourPacket.dns == nil || len(tags) == 0 {
+		return tags
+	}
+	mode, subnets := cfg.addressValidation(*bonjourPacket.vlanTag, validator.prefixes.subnets(*bonjourPacket.vlanTag, time.Now()))
+	if mode == addressValidationOff {
+		return tags
+	}
+	dns := bonjourPacket.dns
+	answers, invalid := filterAddressRecords(dns.Answers, subnets, nil)
+	authorities, invalid := filterAddressRecords(dns.Authorities, subnets, invalid)
+	additionals, invalid := filterAddressRecords(dns.Additionals, subnets, invalid)
+	if len(invalid) == 0 {
+		return tags
+	}
+	addressValidationStats.Add("flagged", int64(len(invalid)))
+	validator.log(bonjourPacket, invalid)
+	if mode == addressValidationFlag {
+		return tags
+	}
+	dns.Answers, dns.Authorities, dns.Additionals = answers, authorities, additionals
+	addressValidationStats.Add("dropped", int64(len(invalid)))
+	bonjourPacket.dnsRewritten = true
+	if len(dns.Answers)+len(dns.Additionals) == 0 {
+		addressValidationStats.Add("dropped_answers", 1)
+		return nil
+	}
+	return tags
+}
+
+// filterAddressRecords returns the records except the A and AAAA ones outside of subnets, which are appended to invalid.
+// IPv6 link-local addresses (fe80::/10), which every IPv6 host advertises, are not checked.
+func filterAddressRecords(records []layers.DNSResourceRecord, subnets []*net.IPNet, invalid []net.IP) ([]layers.DNSResourceRecord, []net.IP) {
+	valid := records[:0:0]
+	for _, record := range records {
+		linkLocal := record.IP.To4() == nil && record.IP.IsLinkLocalUnicast()
+		if (record.Type == layers.DNSTypeA || record.Type == layers.DNSTypeAAAA) && !linkLocal && !withinSubnets(subnets, record.IP) {
+			invalid = append(invalid, record.IP)
+			continue
+		}
+		valid = append(valid, record)
+	}
+	return valid, invalid
+}
+
+// log logs the invalid addresses of a device the first time they are seen
+func (validator *addressValidator) log(bonjourPacket *bonjourPacket, invalid []net.IP) {
+	for _, ip := range invalid {
+		key := fmt.Sprintf("%v/%v", bonjourPacket.srcMAC, ip)
+		if validator.flagged[key] {
+			continue
+		}
+		if len(validator.flagged) >= maxFlaggedAddresses {
+			validator.flagged = make(map[string]bool)
+		}
+		validator.flagged[key] = true
+		logger.warnf("Device %v on VLAN %v advertises %v, outside of the subnets of its VLAN", bonjourPacket.srcMAC, *bonjourPacket.vlanTag, ip)
+	}
+}
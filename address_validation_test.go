@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func createMockAddressAnswer(ips ...string) *layers.DNS {
+	dns := createMockPTRAnswer("_ipp._tcp.local", "Printer._ipp._tcp.local", 120)
+	for _, ip := range ips {
+		record := layers.DNSResourceRecord{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 120, IP: net.ParseIP(ip)}
+		if record.IP.To4() == nil {
+			record.Type = layers.DNSTypeAAAA
+		}
+		dns.Additionals = append(dns.Additionals, record)
+	}
+	return dns
+}
+
+func TestAddressValidation(t *testing.T) {
+	cfg, err := parseConfig(`
+address_validation = "drop"
+[vlans."1547"]
+subnets = ["192.168.47.0/24"]
+[vlans."1548"]
+subnets = ["192.168.48.0/24"]
+address_validation = "flag"
+`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	tests := []struct {
+		vlan        uint16
+		ips         []string
+		reflected   bool
+		additionals int
+	}{
+		{1547, []string{"192.168.47.10"}, true, 1},
+		// IPv6 addresses are not checked when the VLAN lists no IPv6 subnet
+		{1547, []string{"192.168.47.10", "172.17.0.2", "fd00::10"}, true, 2},
+		{1548, []string{"192.168.48.10", "10.8.0.3"}, true, 2},
+		// VLANs without subnets are not checked
+		{1549, []string{"10.8.0.3"}, true, 1},
+	}
+	validator := newAddressValidator(nil)
+	for _, test := range tests {
+		vlan := test.vlan
+		packet := bonjourPacket{dns: createMockAddressAnswer(test.ips...), vlanTag: &vlan, srcMAC: &srcMACTest}
+		tags := validator.validate(&cfg, &packet, []uint16{1234})
+		if (len(tags) > 0) != test.reflected || len(packet.dns.Additionals) != test.additionals {
+			t.Errorf("Error in validate() for %v on VLAN %v: got %v and %v", test.ips, test.vlan, tags, packet.dns.Additionals)
+		}
+	}
+
+	// Answers left without any record are not reflected
+	vlan := uint16(1547)
+	dns := createMockAddressAnswer("172.17.0.2")
+	dns.Answers = dns.Additionals
+	dns.Additionals = nil
+	packet := bonjourPacket{dns: dns, vlanTag: &vlan, srcMAC: &srcMACTest}
+	if tags := validator.validate(&cfg, &packet, []uint16{1234}); tags != nil || !packet.dnsRewritten {
+		t.Errorf("Error in validate(): an empty answer should not be reflected, got %v", tags)
+	}
+
+	if _, err := parseConfig(`address_validation = "reject"`); err == nil {
+		t.Error("Error in parseConfig(): an invalid address_validation should be rejected")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// vlanAddresses holds the IP addresses owned by the reflector on a VLAN
+type vlanAddresses struct {
+	ipv4, ipv6 net.IP
+}
+
+// parseAddresses checks the static addresses of the [addresses] section: at most one IPv4 and one IPv6
+// address per VLAN, within the subnets of the VLAN when they are configured
+func (cfg *brconfig) parseAddresses() error {
+	cfg.addresses = make(map[uint16]vlanAddresses)
+	for key, list := range cfg.Addresses {
+		tag, err := strconv.ParseUint(key, 10, 12)
+		if err != nil {
+			return fmt.Errorf("invalid VLAN tag %q in addresses section", key)
+		}
+		var addresses vlanAddresses
+		for _, address := range list {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q for VLAN %v", address, tag)
+			}
+			if ip.To4() != nil {
+				if addresses.ipv4 != nil {
+					return fmt.Errorf("several IPv4 addresses for VLAN %v", tag)
+				}
+				addresses.ipv4 = ip.To4()
+			} else {
+				if addresses.ipv6 != nil {
+					return fmt.Errorf("several IPv6 addresses for VLAN %v", tag)
+				}
+				addresses.ipv6 = ip
+			}
+			if !withinSubnets(cfg.vlans[uint16(tag)].subnets, ip) {
+				return fmt.Errorf("address %v is outside of the subnets of VLAN %v", ip, tag)
+			}
+		}
+		cfg.addresses[uint16(tag)] = addresses
+	}
+	return nil
+}
+
+// withinSubnets tells whether ip belongs to one of the subnets of its address family, if there are any
+func withinSubnets(subnets []*net.IPNet, ip net.IP) bool {
+	sameFamily := false
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+		sameFamily = sameFamily || (subnet.IP.To4() != nil) == (ip.To4() != nil)
+	}
+	return !sameFamily
+}
+
+// sourceIPv4 returns the IPv4 address owned by the reflector on a VLAN, or fallback when none is configured
+func (cfg *brconfig) sourceIPv4(tag uint16, fallback net.IP) net.IP {
+	if ip := cfg.addresses[tag].ipv4; ip != nil {
+		return ip
+	}
+	return fallback
+}
+
+// sourceIPv6 returns the IPv6 address owned by the reflector on a VLAN, or fallback when none is configured
+func (cfg *brconfig) sourceIPv6(tag uint16, fallback net.IP) net.IP {
+	if ip := cfg.addresses[tag].ipv6; ip != nil {
+		return ip
+	}
+	return fallback
+}
+
+// reflectedSource returns the source address of the frames reflecting bonjourPacket on the VLAN tag, or nil to keep
+// the address of the sender. The address of the reflector on tag replaces the link-local IPv6 addresses, which receivers
+// ignore as off-link, and the address of the legacy queriers expecting their unicast responses to be relayed.
+func (cfg *brconfig) reflectedSource(bonjourPacket *bonjourPacket, tag uint16) net.IP {
+	switch {
+	case bonjourPacket.isIPv6 && (bonjourPacket.srcIP.IsLinkLocalUnicast() || cfg.relaysLegacyQuery(bonjourPacket)):
+		return cfg.addresses[tag].ipv6
+	case !bonjourPacket.isIPv6 && cfg.relaysLegacyQuery(bonjourPacket):
+		return cfg.addresses[tag].ipv4
+	}
+	return nil
+}
+
+// reflectedSource returns the source address of the frames reflecting bonjourPacket on the VLAN tag, like
+// cfg.reflectedSource. Without a configured address, link-local IPv6 addresses are replaced by the address
+// the reflector would autoconfigure in the prefix learned on tag.
+func (r *reflector) reflectedSource(bonjourPacket *bonjourPacket, tag uint16) net.IP {
+	if srcIP := r.cfg.reflectedSource(bonjourPacket, tag); srcIP != nil {
+		return srcIP
+	}
+	if bonjourPacket.isIPv6 && bonjourPacket.srcIP.IsLinkLocalUnicast() {
+		return r.prefixes.sourceAddress(tag, r.brMACAddress, time.Now())
+	}
+	return nil
+}
+
+// setSourceIP replaces the source address of the IP layer of bonjourPacket until the returned function is called.
+// The layers are shared by the frames reflected on every VLAN, so the address of the sender has to be restored,
+// along with the UDP checksum computed for the replaced address.
+func setSourceIP(bonjourPacket *bonjourPacket, srcIP net.IP) (restore func()) {
+	var source *net.IP
+	if ipv4, ok := bonjourPacket.packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		source, srcIP = &ipv4.SrcIP, srcIP.To4()
+	} else if ipv6, ok := bonjourPacket.packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		source = &ipv6.SrcIP
+	}
+	if source == nil || srcIP == nil {
+		return func() {}
+	}
+	udp, _ := bonjourPacket.packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	var checksum uint16
+	if udp != nil {
+		checksum = udp.Checksum
+	}
+	sender := *source
+	*source = srcIP
+	bonjourPacket.sourceRewritten = true
+	return func() {
+		*source = sender
+		bonjourPacket.sourceRewritten = false
+		if udp != nil {
+			udp.Checksum = checksum
+		}
+	}
+}
+
+// checkAddresses warns about the configured addresses which are not assigned to the VLAN subinterface of intf.
+// Nothing can be checked for the VLANs without subinterface, which is the usual setup of a trunk.
+func checkAddresses(cfg *brconfig, intf string) {
+	if len(cfg.addresses) == 0 {
+		return
+	}
+	file, err := os.Open(linuxVLANConfigPath)
+	if err != nil {
+		return
+	}
+	subinterfaces := parseVLANConfig(file)[intf]
+	file.Close()
+	for _, warning := range verifyAddresses(cfg.addresses, subinterfaces, interfaceIPs) {
+		logger.warnf("%v", warning)
+	}
+}
+
+func interfaceIPs(name string) ([]net.IP, error) {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := intf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// verifyAddresses compares the configured addresses with the addresses of the VLAN subinterfaces
+func verifyAddresses(addresses map[uint16]vlanAddresses, subinterfaces []vlanSubinterface, addrsOf func(string) ([]net.IP, error)) (warnings []string) {
+	for _, sub := range subinterfaces {
+		configured, ok := addresses[sub.VLAN]
+		if !ok {
+			continue
+		}
+		assigned, err := addrsOf(sub.Name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range []net.IP{configured.ipv4, configured.ipv6} {
+			if ip != nil && !containsAddress(assigned, ip) {
+				warnings = append(warnings, fmt.Sprintf("address %v of VLAN %v is not assigned to %v", ip, sub.VLAN, sub.Name))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return
+}
+
+func containsAddress(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
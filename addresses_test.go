@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseAddresses(t *testing.T) {
+	cfg, err := parseConfig(`
+		[vlans."10"]
+		subnets = ["192.168.10.0/24"]
+		[addresses]
+		"10" = ["192.168.10.2", "fd00:10::2"]
+	`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	if ip := cfg.sourceIPv4(10, net.IPv4zero); !ip.Equal(net.ParseIP("192.168.10.2")) {
+		t.Errorf("Error in sourceIPv4(): expected the configured address, got %v", ip)
+	}
+	if ip := cfg.addresses[10].ipv6; !ip.Equal(net.ParseIP("fd00:10::2")) {
+		t.Errorf("Error in parseAddresses(): expected the configured IPv6 address, got %v", ip)
+	}
+	if ip := cfg.sourceIPv4(20, net.IPv4zero); !ip.Equal(net.IPv4zero) {
+		t.Errorf("Error in sourceIPv4(): expected the fallback address, got %v", ip)
+	}
+
+	invalid := map[string]string{
+		`"10" = ["192.168.10.300"]`:               "invalid address",
+		`"4096" = ["192.168.10.2"]`:               "invalid VLAN tag",
+		`"10" = ["192.168.10.2", "192.168.10.3"]`: "several IPv4",
+		`"10" = ["fd00::2", "fd00::3"]`:           "several IPv6",
+		`"10" = ["192.168.20.2"]`:                 "outside of the subnets",
+		`"10" = ["fd00::2", "10.0.0.1"]`:          "outside of the subnets",
+	}
+	for section, expected := range invalid {
+		_, err := parseConfig("[vlans.\"10\"]\nsubnets = [\"192.168.10.0/24\"]\n[addresses]\n" + section)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error in parseAddresses(): expected %q for %v, got %v", expected, section, err)
+		}
+	}
+}
+
+func TestVerifyAddresses(t *testing.T) {
+	addresses := map[uint16]vlanAddresses{
+		10: {ipv4: net.ParseIP("192.168.10.2").To4(), ipv6: net.ParseIP("fd00:10::2")},
+		20: {ipv4: net.ParseIP("192.168.20.2").To4()},
+		30: {ipv4: net.ParseIP("192.168.30.2").To4()},
+	}
+	subinterfaces := []vlanSubinterface{{Name: "eth0.10", VLAN: 10}, {Name: "eth0.20", VLAN: 20}, {Name: "eth0.40", VLAN: 40}}
+	assigned := map[string][]net.IP{
+		"eth0.10": {net.ParseIP("192.168.10.2"), net.ParseIP("fe80::1")},
+	}
+	addrsOf := func(name string) ([]net.IP, error) {
+		if name == "eth0.20" {
+			return nil, errors.New("no such interface")
+		}
+		return assigned[name], nil
+	}
+
+	warnings := verifyAddresses(addresses, subinterfaces, addrsOf)
+	expected := []string{"address fd00:10::2 of VLAN 10 is not assigned to eth0.10"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("Error in verifyAddresses(): expected %v, got %v", expected, warnings)
+	}
+}
+
+func TestReflectedIPv6Source(t *testing.T) {
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42, 43}},
+		},
+		addresses: map[uint16]vlanAddresses{42: {ipv6: net.ParseIP("fd00:42::2")}},
+	}
+	r, writer := createMockReflector(cfg)
+
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("fe80::1"), DstIP: dstIPv6Test}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: mDNSMulticastMACv6, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: vlanIdentifierTest, Type: layers.EthernetTypeIPv6},
+		ip, udp, createMockPTRAnswer("_ipp._tcp.local", "Printer._ipp._tcp.local", 120))
+	answer, _ := parseBonjourPacket(gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true}), brMACTest)
+
+	r.processBonjourPacket(answer)
+	if len(writer.frames) != 2 {
+		t.Fatalf("Error in processBonjourPacket(): expected 2 reflected frames, got %d", len(writer.frames))
+	}
+	// The link-local source is replaced on the VLANs where the reflector has an address, and kept on the others
+	for i, expected := range []string{"fd00:42::2", "fe80::1"} {
+		reflected := gopacket.NewPacket(writer.frames[i], layers.LayerTypeEthernet, gopacket.Default)
+		ipv6 := reflected.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		if !ipv6.SrcIP.Equal(net.ParseIP(expected)) {
+			t.Errorf("Error in processBonjourPacket(): frame reflected from %v, expected %v", ipv6.SrcIP, expected)
+		}
+		reflectedUDP := reflected.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		checked := &layers.UDP{SrcPort: reflectedUDP.SrcPort, DstPort: reflectedUDP.DstPort}
+		checked.SetNetworkLayerForChecksum(ipv6)
+		gopacket.SerializeLayers(gopacket.NewSerializeBuffer(), gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			checked, gopacket.Payload(reflectedUDP.Payload))
+		if checked.Checksum != reflectedUDP.Checksum {
+			t.Errorf("Error in processBonjourPacket(): invalid UDP checksum %#x from %v, expected %#x", reflectedUDP.Checksum, ipv6.SrcIP, checked.Checksum)
+		}
+	}
+	if !answer.srcIP.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("Error in processBonjourPacket(): the source of the answer was modified to %v", answer.srcIP)
+	}
+}
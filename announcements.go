@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Default TTL of announced records, the one recommended by RFC 6762 for records containing host names
+const defaultAnnouncementTTL = 120
+
+var (
+	mDNSMulticastMAC   = net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}
+	mDNSMulticastMACv6 = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}
+)
+
+// announcement is a service published by the reflector on behalf of a host whose own mDNS traffic
+// cannot reach the physical network, e.g. a container or a VM
+type announcement struct {
+	ID         string   `json:"id"`
+	Instance   string   `json:"instance"`
+	Service    string   `json:"service"`
+	Host       string   `json:"host"`
+	IP         net.IP   `json:"ip"`
+	Port       uint16   `json:"port"`
+	TXT        []string `json:"txt,omitempty"`
+	VLANs      []uint16 `json:"vlans"`
+	TTL        uint32   `json:"ttl"`
+	Persistent bool     `json:"persistent"`
+
+	lastSent time.Time
+}
+
+func (ann *announcement) validate() error {
+	switch {
+	case ann.Instance == "" || ann.Service == "" || ann.Host == "":
+		return errors.New("instance, service and host are required")
+	case ann.IP.To4() == nil:
+		return errors.New("ip must be an IPv4 address")
+	case ann.Port == 0:
+		return errors.New("port is required")
+	case len(ann.VLANs) == 0:
+		return errors.New("at least one VLAN is required")
+	}
+	if ann.TTL == 0 {
+		ann.TTL = defaultAnnouncementTTL
+	}
+	return nil
+}
+
+// records returns the PTR, SRV, TXT and A records describing the announced service
+func (ann *announcement) records(ttl uint32) []layers.DNSResourceRecord {
+	service := fullServiceName(ann.Service)
+	instance := ann.Instance + "." + service
+	host := strings.TrimSuffix(ann.Host, ".")
+	if !strings.HasSuffix(strings.ToLower(host), ".local") {
+		host += ".local"
+	}
+	txt := make([][]byte, 0, len(ann.TXT))
+	for _, entry := range ann.TXT {
+		txt = append(txt, []byte(entry))
+	}
+	if len(txt) == 0 {
+		// RFC 6763 requires a TXT record, even empty
+		txt = append(txt, []byte{})
+	}
+	return []layers.DNSResourceRecord{
+		{Name: []byte(service), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl, PTR: []byte(instance)},
+		{Name: []byte(instance), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: ttl,
+			SRV: layers.DNSSRV{Port: ann.Port, Name: []byte(host)}},
+		{Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: ttl, TXTs: txt},
+		{Name: []byte(host), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: ann.IP.To4()},
+	}
+}
+
+// serializeAnnouncement builds the unsolicited mDNS response announcing ann on a VLAN.
+// A TTL of 0 withdraws the service.
+func serializeAnnouncement(ann *announcement, tag uint16, brMACAddress net.HardwareAddr, ttl uint32) ([]byte, error) {
+	return serializeMDNSResponse(ann.records(ttl), ann.IP, tag, brMACAddress)
+}
+
+// serializeMDNSResponse builds an unsolicited mDNS response sent from srcIP to the mDNS group of a VLAN
+func serializeMDNSResponse(records []layers.DNSResourceRecord, srcIP net.IP, tag uint16, brMACAddress net.HardwareAddr) ([]byte, error) {
+	ethernet := &layers.Ethernet{SrcMAC: brMACAddress, DstMAC: mDNSMulticastMAC, EthernetType: layers.EthernetTypeDot1Q}
+	dot1q := &layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4}
+	var ip gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+	if srcIP.To4() != nil {
+		ipv4 := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.To4(), DstIP: net.IP{224, 0, 0, 251}}
+		ip, ipLayer = ipv4, ipv4
+	} else {
+		ethernet.DstMAC = mDNSMulticastMACv6
+		dot1q.Type = layers.EthernetTypeIPv6
+		ipv6 := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: net.ParseIP("ff02::fb")}
+		ip, ipLayer = ipv6, ipv6
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(ip)
+	payload, err := serializeDNS(&layers.DNS{QR: true, AA: true, Answers: records})
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ethernet, dot1q, ipLayer, udp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// announcer publishes the announcements submitted through the API.
+// One-off announcements are sent once, persistent ones are sent again before their records expire.
+type announcer struct {
+	mutex         sync.Mutex
+	write         func([]byte)
+	brMACAddress  net.HardwareAddr
+	nextID        int
+	announcements map[string]*announcement
+}
+
+func newAnnouncer(write func([]byte), brMACAddress net.HardwareAddr) *announcer {
+	return &announcer{
+		write:         write,
+		brMACAddress:  brMACAddress,
+		nextID:        1,
+		announcements: make(map[string]*announcement),
+	}
+}
+
+func (a *announcer) send(ann *announcement, ttl uint32) error {
+	for _, tag := range ann.VLANs {
+		data, err := serializeAnnouncement(ann, tag, a.brMACAddress, ttl)
+		if err != nil {
+			return err
+		}
+		a.write(data)
+	}
+	return nil
+}
+
+// publish validates and sends ann, and keeps it for later refreshes when it is persistent
+func (a *announcer) publish(ann *announcement, now time.Time) error {
+	if err := ann.validate(); err != nil {
+		return err
+	}
+	if err := a.send(ann, ann.TTL); err != nil {
+		return fmt.Errorf("could not serialize announcement: %v", err)
+	}
+	ann.lastSent = now
+	if ann.Persistent {
+		a.mutex.Lock()
+		ann.ID = strconv.Itoa(a.nextID)
+		a.nextID++
+		a.announcements[ann.ID] = ann
+		a.mutex.Unlock()
+	}
+	return nil
+}
+
+// withdraw removes a persistent announcement, and sends a goodbye packet so that caches flush its records
+func (a *announcer) withdraw(id string) bool {
+	a.mutex.Lock()
+	ann, ok := a.announcements[id]
+	delete(a.announcements, id)
+	a.mutex.Unlock()
+	if ok {
+		a.send(ann, 0)
+	}
+	return ok
+}
+
+// refresh sends again the persistent announcements whose records reached half of their TTL
+func (a *announcer) refresh(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, ann := range a.announcements {
+		if now.Sub(ann.lastSent) >= time.Duration(ann.TTL)*time.Second/2 {
+			ann.lastSent = now
+			a.send(ann, ann.TTL)
+		}
+	}
+}
+
+func (a *announcer) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		a.refresh(now)
+	}
+}
+
+func (a *announcer) list() []announcement {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	list := make([]announcement, 0, len(a.announcements))
+	for _, ann := range a.announcements {
+		list = append(list, *ann)
+	}
+	// IDs are sequence numbers, "10" coming after "9"
+	sort.Slice(list, func(i, j int) bool {
+		first, _ := strconv.Atoi(list[i].ID)
+		second, _ := strconv.Atoi(list[j].ID)
+		return first < second
+	})
+	return list
+}
+
+// ServeHTTP lists (GET) and publishes (POST) announcements on /api/announcements,
+// and withdraws them (DELETE) on /api/announcements/<id>
+func (a *announcer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/announcements"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.list())
+	case r.Method == http.MethodPost && id == "":
+		var ann announcement
+		if err := json.NewDecoder(r.Body).Decode(&ann); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid announcement: %v", err))
+			return
+		}
+		if err := a.publish(&ann, time.Now()); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ann)
+	case r.Method == http.MethodDelete && id != "":
+		if !a.withdraw(id) {
+			writeAPIError(w, http.StatusNotFound, "unknown announcement")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
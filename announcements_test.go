@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockAnnouncement(persistent bool) *announcement {
+	return &announcement{
+		Instance:   "Build Server",
+		Service:    "_ssh._tcp",
+		Host:       "build",
+		IP:         net.IP{10, 0, 0, 5},
+		Port:       22,
+		TXT:        []string{"version=1"},
+		VLANs:      []uint16{42, 43},
+		Persistent: persistent,
+	}
+}
+
+func TestSerializeAnnouncement(t *testing.T) {
+	ann := createMockAnnouncement(false)
+	if err := ann.validate(); err != nil {
+		t.Fatalf("Error in validate(): %v", err)
+	}
+	data, err := serializeAnnouncement(ann, 42, brMACTest, ann.TTL)
+	if err != nil {
+		t.Fatalf("Error in serializeAnnouncement(): %v", err)
+	}
+
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	_, payload := parseUDPLayer(packet)
+	isDNSQuery, dns := parseDNSPayload(payload)
+	if *parseVLANTag(packet) != 42 || isDNSQuery || dns == nil || len(dns.Answers) != 4 {
+		t.Fatal("Error in serializeAnnouncement(): invalid mDNS response")
+	}
+	ptr, srv := dns.Answers[0], dns.Answers[1]
+	if string(ptr.Name) != "_ssh._tcp.local" || string(ptr.PTR) != "Build Server._ssh._tcp.local" || ptr.TTL != defaultAnnouncementTTL {
+		t.Errorf("Error in serializeAnnouncement(): invalid PTR record %+v", ptr)
+	}
+	if srv.SRV.Port != 22 || string(srv.SRV.Name) != "build.local" {
+		t.Errorf("Error in serializeAnnouncement(): invalid SRV record %+v", srv.SRV)
+	}
+
+	if err := (&announcement{Instance: "a", Service: "_ssh._tcp", Host: "b", Port: 22, VLANs: []uint16{42}}).validate(); err == nil {
+		t.Error("Error in validate(): announcement without IP should be rejected")
+	}
+}
+
+func TestAnnouncerListOrder(t *testing.T) {
+	announcer := newAnnouncer(func(data []byte) {}, brMACTest)
+	for i := 0; i < 10; i++ {
+		ann := &announcement{Instance: "Build Server", Service: "_ssh._tcp", Host: "build", IP: net.ParseIP("10.0.0.5"), Port: 22, VLANs: []uint16{42}, Persistent: true}
+		if err := announcer.publish(ann, time.Now()); err != nil {
+			t.Fatalf("Error in publish(): %v", err)
+		}
+	}
+	list := announcer.list()
+	if len(list) != 10 || list[1].ID != "2" || list[9].ID != "10" {
+		t.Errorf("Error in list(): expected the announcements in the order of their IDs, got %+v", list)
+	}
+}
+
+func TestAnnouncerAPI(t *testing.T) {
+	writer := &mockWriter{}
+	announcer := newAnnouncer(func(data []byte) { writer.WritePacketData(data) }, brMACTest)
+
+	body := `{"instance": "Build Server", "service": "_ssh._tcp", "host": "build", "ip": "10.0.0.5", "port": 22, "vlans": [42], "persistent": true}`
+	recorder := httptest.NewRecorder()
+	announcer.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/announcements", strings.NewReader(body)))
+	if recorder.Code != http.StatusCreated || len(writer.vlanTags()) != 1 {
+		t.Fatalf("Error in ServeHTTP(): announcement not published, got %v %v", recorder.Code, recorder.Body)
+	}
+	list := announcer.list()
+	if len(list) != 1 || list[0].ID != "1" {
+		t.Fatalf("Error in ServeHTTP(): persistent announcement not kept, got %+v", list)
+	}
+
+	// Persistent announcements are sent again at half of their TTL
+	announcer.refresh(time.Now())
+	announcer.refresh(time.Now().Add(time.Minute))
+	if len(writer.vlanTags()) != 2 {
+		t.Errorf("Error in refresh(): %v announcements sent", len(writer.vlanTags()))
+	}
+
+	recorder = httptest.NewRecorder()
+	announcer.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/announcements/1", nil))
+	if recorder.Code != http.StatusNoContent || len(announcer.list()) != 0 || len(writer.vlanTags()) != 3 {
+		t.Error("Error in ServeHTTP(): announcement not withdrawn")
+	}
+
+	recorder = httptest.NewRecorder()
+	announcer.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/announcements", strings.NewReader(`{"instance": "x"}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Error in ServeHTTP(): invalid announcement should be rejected, got %v", recorder.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiAuth only lets through the requests presenting the API token as a bearer token
+type apiAuth struct {
+	token   string
+	handler http.Handler
+}
+
+func (auth apiAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	expected := "Bearer " + auth.token
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "missing or invalid API token")
+		return
+	}
+	auth.handler.ServeHTTP(w, r)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// apiServer serves the management API, which, unlike the debug server, may listen on a public address.
+// Reflection goes on when it cannot be served, the failure being reported by status.
+// It returns once listening, the API being served in the background.
+func apiServer(cfg *brconfig, handler http.Handler, status *subsystemStatus) {
+	listeners, err := listenAPI(cfg)
+	if err != nil {
+		logger.errorf("Could not start the API server: %v", err)
+		status.set(healthFailed, err.Error())
+		return
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := http.Serve(listener, handler)
+			logger.errorf("Could not serve the API on %v: %v", listener.Addr(), err)
+			status.set(healthFailed, err.Error())
+		}(listener)
+	}
+}
+
+// callAPI sends a request to the management API or to the debug server of a running reflector, and decodes its JSON
+// answer into result. addr is either host:port, or unix:<path> for the Unix socket of the API. The debug server takes
+// no token.
+func callAPI(addr, token, method, path string, body interface{}, result interface{}) error {
+	var content io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(encoded)
+	}
+	host, client := addr, http.DefaultClient
+	if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		host = "localhost"
+		client = &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}}}
+	}
+	request, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", host, path), content)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not reach the reflector on %v: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// The debug server answers errors in plain text
+		var apiError struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&apiError) != nil || apiError.Error == "" {
+			apiError.Error = resp.Status
+		}
+		return fmt.Errorf("request rejected by the reflector: %v", apiError.Error)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("could not read the answer of the reflector: %v", err)
+	}
+	return nil
+}
+
+// deviceRequest is the body of the requests adding or updating a device entry
+type deviceRequest struct {
+	Description string `json:"description"`
+	bonjourDevice
+}
+
+// errUnknownDevice is returned when removing a device entry which is not in the configuration file
+var errUnknownDevice = errors.New("unknown device")
+
+// apiDevice is a device entry of the running configuration, along with its match counters
+type apiDevice struct {
+	MAC macAddress `json:"mac"`
+	bonjourDevice
+	Matches   uint64    `json:"matches"`
+	LastMatch time.Time `json:"last_match"`
+}
+
+// deviceAPI lists the device entries of the running configuration on GET /api/devices[/<mac>], and persists the
+// device entries submitted on /api/devices/<mac> to the configuration file. When the reflector watches its
+// configuration, the file is then reloaded, so that changes take effect right away.
+type deviceAPI struct {
+	mutex      sync.Mutex
+	configPath string
+	// format of the configuration file, the device entries only being edited in TOML files
+	format string
+	// profile applied to the configuration file, and prefix of the tables of its devices
+	profile       string
+	devicesPrefix string
+	reflector     *reflector
+	reloader      *configReloader
+}
+
+func (api *deviceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	param := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices"), "/")
+	if r.Method == http.MethodGet && api.reflector != nil {
+		api.list(w, param)
+		return
+	}
+	mac, err := net.ParseMAC(param)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid MAC address")
+		return
+	}
+	if api.format != "" && api.format != formatTOML {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("device entries can only be edited in TOML configuration files, edit the %v file instead", strings.ToUpper(api.format)))
+		return
+	}
+	var edit func(file *configFile, table string) error
+	switch r.Method {
+	case http.MethodPut:
+		var device deviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid device: %v", err))
+			return
+		}
+		edit = device.write
+	case http.MethodDelete:
+		edit = func(file *configFile, table string) error {
+			if !file.removeTable(table) {
+				return errUnknownDevice
+			}
+			return nil
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	err = api.update(mac, edit)
+	if err == errUnknownDevice {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if api.reloader != nil {
+		if err := api.reloader.reload(); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("device saved, but the configuration could not be reloaded: %v", err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list writes the device entries of the running configuration, or only the one of mac when it is set
+func (api *deviceAPI) list(w http.ResponseWriter, mac string) {
+	hits := make(map[macAddress]ruleHit)
+	for _, hit := range api.reflector.ruleHits.snapshot() {
+		hits[hit.MAC] = hit
+	}
+	devices := []apiDevice{}
+	api.reflector.configMutex.RLock()
+	configured := api.reflector.cfg.Devices
+	api.reflector.configMutex.RUnlock()
+	for known, device := range configured {
+		// Device entries are in lowercase, while MAC prefixes keep the case of the configuration file
+		if mac == "" || strings.EqualFold(string(known), mac) {
+			devices = append(devices, apiDevice{known, device, hits[known].Matches, hits[known].LastMatch})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+	w.Header().Set("Content-Type", "application/json")
+	if mac == "" {
+		json.NewEncoder(w).Encode(devices)
+		return
+	}
+	if len(devices) == 0 {
+		writeAPIError(w, http.StatusNotFound, errUnknownDevice.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(devices[0])
+}
+
+// update applies edit to the table of the device entry in the configuration file, and saves the file
+func (api *deviceAPI) update(mac net.HardwareAddr, edit func(file *configFile, table string) error) error {
+	// New device entries are written as the reflector looks them up, in lowercase
+	table := fmt.Sprintf("%vdevices.%q", api.devicesPrefix, mac.String())
+
+	if api.format != "" && api.format != formatTOML {
+		return fmt.Errorf("device entries can only be edited in TOML configuration files, edit the %v file instead", strings.ToUpper(api.format))
+	}
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	file, err := loadConfigFile(api.configPath)
+	if err != nil {
+		return fmt.Errorf("could not read configuration: %v", err)
+	}
+	// An entry written in uppercase, as in the sample configuration, is edited in place
+	upper := fmt.Sprintf("%vdevices.%q", api.devicesPrefix, strings.ToUpper(mac.String()))
+	if _, _, ok := file.findTable(table); !ok {
+		if _, _, ok := file.findTable(upper); ok {
+			table = upper
+		}
+	}
+	if err := edit(file, table); err != nil {
+		if err == errUnknownDevice {
+			return err
+		}
+		return fmt.Errorf("could not update configuration: %v", err)
+	}
+	// Never persist a change which would prevent the reflector from starting again
+	if _, err := parseProfile(file.String(), api.profile); err != nil {
+		return fmt.Errorf("could not update configuration: %v", err)
+	}
+	if err := file.save(); err != nil {
+		return fmt.Errorf("could not update configuration: %v", err)
+	}
+	return nil
+}
+
+func (device *deviceRequest) write(file *configFile, table string) error {
+	if device.Description != "" {
+		if err := file.set(table, "description", device.Description); err != nil {
+			return err
+		}
+	}
+	if err := file.set(table, "origin_pool", device.OriginPool); err != nil {
+		return err
+	}
+	if err := file.set(table, "shared_pools", device.SharedPools); err != nil {
+		return err
+	}
+	if device.Domain == "" {
+		file.unset(table, "domain")
+	} else if err := file.set(table, "domain", device.Domain); err != nil {
+		return err
+	}
+	if len(device.AllowedServices) == 0 {
+		file.unset(table, "allowed_services")
+	} else if err := file.set(table, "allowed_services", device.AllowedServices); err != nil {
+		return err
+	}
+	if len(device.AllowedQueriers) == 0 {
+		file.unset(table, "allowed_queriers")
+		return nil
+	}
+	return file.set(table, "allowed_queriers", device.AllowedQueriers)
+}
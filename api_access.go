@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// parseAllowedClients parses the networks of api_allowed_clients, a bare address allowing that address only
+func parseAllowedClients(clients []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, client := range clients {
+		if !strings.Contains(client, "/") {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q in api_allowed_clients", client)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in api_allowed_clients", client)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// listenAPI opens the listeners of the management API: api_listen, on the addresses of api_interface only when
+// it is set, and the Unix socket api_socket. Either may be unset, e.g. to only serve the API on the Unix socket.
+func listenAPI(cfg *brconfig) (listeners []net.Listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}
+	}()
+	addrs, err := apiListenAddresses(cfg.APIListen, cfg.APIInterface)
+	if err != nil {
+		return listeners, err
+	}
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if cfg.APISocket != "" {
+		// A socket left behind by a previous run would prevent listening
+		if info, err := os.Lstat(cfg.APISocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.APISocket)
+		}
+		listener, err := net.Listen("unix", cfg.APISocket)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, listener)
+		// Only the owner and the group of the process may connect
+		if err := os.Chmod(cfg.APISocket, 0660); err != nil {
+			return listeners, err
+		}
+	}
+	return listeners, nil
+}
+
+// apiListenAddresses returns the addresses to listen on for api_listen, which are, when intf is set,
+// its port on each address of the interface
+func apiListenAddresses(listen, intf string) ([]string, error) {
+	if listen == "" || intf == "" {
+		if listen == "" {
+			return nil, nil
+		}
+		return []string{listen}, nil
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(intf)
+	if err != nil {
+		return nil, fmt.Errorf("could not find network interface %v: %v", intf, err)
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, addr := range ifaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			host += "%" + intf
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("network interface %v has no address", intf)
+	}
+	return addrs, nil
+}
+
+// apiGuard rejects the requests of the clients outside of api_allowed_clients, and logs every mutating request
+// along with its client. The clients of the Unix socket are only restricted by the permissions of the socket.
+type apiGuard struct {
+	allowed []*net.IPNet
+	handler http.Handler
+}
+
+func (guard apiGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ip := apiClient(r)
+	if ip != nil && len(guard.allowed) > 0 && !containsIP(guard.allowed, ip) {
+		logger.log(levelWarn, "API request from a client not allowed", "client", client, "method", r.Method, "path", r.URL.Path)
+		writeAPIError(w, http.StatusForbidden, "client not allowed")
+		return
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		guard.handler.ServeHTTP(w, r)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	guard.handler.ServeHTTP(recorder, r)
+	logger.log(levelInfo, "API request", "client", client, "method", r.Method, "path", r.URL.RequestURI(),
+		"status", recorder.status, "user_agent", r.UserAgent())
+}
+
+// apiClient identifies the client of r by its address, or by the Unix socket it connected to, in which case ip is nil
+func apiClient(r *http.Request) (client string, ip net.IP) {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		return "unix:" + local.String(), nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip = net.ParseIP(host)
+	if ip == nil {
+		// An address which cannot be parsed is matched by no network
+		ip = net.IP{}
+	}
+	return host, ip
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder records the status of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
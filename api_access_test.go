@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedClients(t *testing.T) {
+	networks, err := parseAllowedClients([]string{"10.0.0.0/8", "192.0.2.1", "fd00::1"})
+	if err != nil || len(networks) != 3 || networks[1].String() != "192.0.2.1/32" || networks[2].String() != "fd00::1/128" {
+		t.Errorf("Error in parseAllowedClients(): got %v (%v)", networks, err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := parseAllowedClients([]string{invalid}); err == nil {
+			t.Errorf("Error in parseAllowedClients(): %q should be rejected", invalid)
+		}
+	}
+}
+
+func TestAPIGuard(t *testing.T) {
+	allowed, _ := parseAllowedClients([]string{"10.0.0.0/8"})
+	guard := apiGuard{allowed: allowed, handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	logs, restore := captureLogs("info")
+	defer restore()
+
+	tests := []struct {
+		method, remoteAddr string
+		expected           int
+		logged             string
+	}{
+		{http.MethodGet, "10.1.2.3:4567", http.StatusNoContent, ""},
+		{http.MethodDelete, "10.1.2.3:4567", http.StatusNoContent, `API request client=10.1.2.3 method=DELETE path=/api/drains/42 status=204`},
+		{http.MethodGet, "192.0.2.1:4567", http.StatusForbidden, `API request from a client not allowed client=192.0.2.1`},
+	}
+	for _, test := range tests {
+		logs.Reset()
+		request := httptest.NewRequest(test.method, "/api/drains/42", nil)
+		request.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		guard.ServeHTTP(recorder, request)
+		if recorder.Code != test.expected {
+			t.Errorf("Error in ServeHTTP(): %v from %v got %v", test.method, test.remoteAddr, recorder.Code)
+		}
+		if (test.logged == "") != (logs.Len() == 0) || !strings.Contains(logs.String(), test.logged) {
+			t.Errorf("Error in ServeHTTP(): %v from %v logged %q", test.method, test.remoteAddr, logs.String())
+		}
+	}
+}
+
+func TestAPISocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := brconfig{APISocket: filepath.Join(dir, "api.sock")}
+	listeners, err := listenAPI(&cfg)
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("Error in listenAPI(): %v", err)
+	}
+	defer listeners[0].Close()
+	if info, err := os.Stat(cfg.APISocket); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Error in listenAPI(): expected the socket to be restricted to its owner and group, got %v", info.Mode())
+	}
+	// The clients of the socket are not restricted by the allowed networks
+	allowed, _ := parseAllowedClients([]string{"192.0.2.1"})
+	clients := make(chan string, 1)
+	go http.Serve(listeners[0], apiGuard{allowed: allowed, handler: apiAuth{token: "secret", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _ := apiClient(r)
+		clients <- client
+		w.Write([]byte(`{"active": false}`))
+	})}})
+
+	var trace packetTrace
+	if err := callAPI("unix:"+cfg.APISocket, "secret", http.MethodGet, "/api/trace", nil, &trace); err != nil {
+		t.Fatalf("Error in callAPI(): %v", err)
+	}
+	if client := <-clients; client != "unix:"+cfg.APISocket {
+		t.Errorf("Error in apiClient(): expected the client to be identified by the socket, got %q", client)
+	}
+}
+
+func TestAPIListenConfig(t *testing.T) {
+	for _, content := range []string{
+		`api_interface = "eth0"
+		api_token = "secret"`,
+		`api_listen = "127.0.0.1:8053"
+		api_interface = "eth0"
+		api_token = "secret"`,
+		`api_socket = "/run/bonjour-reflector.sock"`,
+		`api_listen = ":8053"
+		api_token = "secret"
+		api_allowed_clients = ["10.0.0.0/33"]`,
+	} {
+		if _, err := parseConfig(content); err == nil {
+			t.Errorf("Error in parseConfig(): %q should be rejected", content)
+		}
+	}
+	cfg, err := parseConfig(`api_listen = ":8053"
+	api_interface = "eth0"
+	api_token = "secret"
+	api_allowed_clients = ["10.0.0.0/8"]`)
+	if err != nil || len(cfg.apiClients) != 1 || !cfg.servesAPI() {
+		t.Errorf("Error in parseConfig(): got %+v (%v)", cfg, err)
+	}
+}
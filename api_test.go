@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	auth := apiAuth{token: "secret", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+
+	tests := []struct {
+		header   string
+		expected int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/api/announcements", nil)
+		if test.header != "" {
+			request.Header.Set("Authorization", test.header)
+		}
+		recorder := httptest.NewRecorder()
+		auth.ServeHTTP(recorder, request)
+		if recorder.Code != test.expected {
+			t.Errorf("Error in ServeHTTP() with header %q: got %v", test.header, recorder.Code)
+		}
+	}
+}
+
+func TestCallAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/rules" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"mac": "aa:bb:cc:dd:ee:ff", "matches": 3}]`))
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	var hits []ruleHit
+	if err := callAPI(addr, "", http.MethodGet, "/debug/rules", nil, &hits); err != nil || len(hits) != 1 || hits[0].Matches != 3 {
+		t.Errorf("Error in callAPI(): expected the rule hits, got %v (%v)", hits, err)
+	}
+	// The debug server answers errors in plain text, which must not be mistaken for an empty answer
+	if err := callAPI(addr, "", http.MethodGet, "/debug/missing", nil, &hits); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Error in callAPI(): expected the status of the rejected request, got %v", err)
+	}
+}
+
+func TestDeviceAPI(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(configFileTest)
+	file.Close()
+	api := &deviceAPI{configPath: file.Name()}
+
+	body := `{"description": "Office Printer", "origin_pool": 42, "shared_pools": [1234]}`
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/api/devices/aa:55:cc:55:ee:55", strings.NewReader(body)))
+	recorder2 := httptest.NewRecorder()
+	api.ServeHTTP(recorder2, httptest.NewRequest(http.MethodDelete, "/api/devices/AA:00:CC:00:EE:00", nil))
+	if recorder.Code != http.StatusNoContent || recorder2.Code != http.StatusNoContent {
+		t.Fatalf("Error in ServeHTTP(): got %v %v and %v %v", recorder.Code, recorder.Body, recorder2.Code, recorder2.Body)
+	}
+
+	cfg, err := readConfig(file.Name())
+	if err != nil {
+		t.Fatalf("Error in ServeHTTP(): invalid configuration written: %v", err)
+	}
+	device, ok := cfg.Devices["aa:55:cc:55:ee:55"]
+	if !ok || device.OriginPool != 42 || len(cfg.Devices) != 2 {
+		t.Errorf("Error in ServeHTTP(): devices not persisted, got %+v", cfg.Devices)
+	}
+	if content, _ := ioutil.ReadFile(file.Name()); !strings.Contains(string(content), "origin_pool = 1078               # Tag of the VLAN the device is in") {
+		t.Error("Error in ServeHTTP(): comments of the configuration file not preserved")
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/devices/AA:00:CC:00:EE:00", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Error in ServeHTTP(): removing an unknown device should fail, got %v", recorder.Code)
+	}
+}
+
+func TestDeviceAPIRuntime(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(configFileTest)
+	file.Close()
+	cfg, err := readConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createMockReflector(cfg)
+	api := &deviceAPI{configPath: file.Name(), reflector: r, reloader: newConfigReloader(cfg)}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/devices", nil))
+	var devices []apiDevice
+	if err := json.NewDecoder(recorder.Body).Decode(&devices); err != nil || len(devices) != len(cfg.Devices) {
+		t.Errorf("Error in ServeHTTP(): got devices %v, %v", devices, err)
+	}
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/devices/aa:bb:cc:dd:ee:ff", nil))
+	var device apiDevice
+	if err := json.NewDecoder(recorder.Body).Decode(&device); err != nil || device.MAC != "aa:bb:cc:dd:ee:ff" || device.OriginPool != 1078 {
+		t.Errorf("Error in ServeHTTP(): got device %+v, %v", device, err)
+	}
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/devices/aa:55:cc:55:ee:55", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Error in ServeHTTP(): got %v for an unknown device", recorder.Code)
+	}
+
+	// Changes are reloaded right away
+	body := `{"origin_pool": 42, "shared_pools": [1234]}`
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/api/devices/aa:55:cc:55:ee:55", strings.NewReader(body)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Error in ServeHTTP(): got %v %v", recorder.Code, recorder.Body)
+	}
+	r.reloader = api.reloader
+	r.applyConfigReload()
+	if _, ok := r.cfg.Devices["aa:55:cc:55:ee:55"]; !ok {
+		t.Errorf("Error in ServeHTTP(): device not reloaded, got %v", r.cfg.Devices)
+	}
+}
+
+func TestReloadAPI(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(configFileTest)
+	file.Close()
+	cfg, err := readConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := reloadAPI{newConfigReloader(cfg)}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if recorder.Code != http.StatusNoContent || api.reloader.take() == nil {
+		t.Errorf("Error in ServeHTTP(): got %v %v", recorder.Code, recorder.Body)
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(`unknown_device_mode = "reflect-everywhere"`), 0644)
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/reload", nil))
+	if recorder.Code != http.StatusUnprocessableEntity || api.reloader.take() != nil {
+		t.Errorf("Error in ServeHTTP(): an invalid configuration should be rejected, got %v", recorder.Code)
+	}
+}
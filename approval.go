@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// vendorTable maps the OUI of MAC addresses, as 6 uppercase hex digits, to the name of their vendor
+type vendorTable map[string]string
+
+// loadVendors reads an IEEE OUI registry in its text format (https://standards-oui.ieee.org/oui/oui.txt),
+// whose assignments are listed as "00-00-0C   (hex)		Cisco Systems, Inc"
+func loadVendors(path string) (vendorTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vendors := make(vendorTable)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "(hex)", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		oui := strings.Replace(strings.TrimSpace(fields[0]), "-", "", -1)
+		if len(oui) == 6 {
+			vendors[strings.ToUpper(oui)] = strings.TrimSpace(fields[1])
+		}
+	}
+	return vendors, scanner.Err()
+}
+
+// lookup returns the vendor of mac, or an empty string when it is unknown
+func (vendors vendorTable) lookup(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	return vendors[fmt.Sprintf("%02X%02X%02X", mac[0], mac[1], mac[2])]
+}
+
+// announcedServices returns the service types announced by the PTR records of an answer
+func announcedServices(dns *layers.DNS) (services []string) {
+	if dns == nil {
+		return
+	}
+	records := append(append([]layers.DNSResourceRecord{}, dns.Answers...), dns.Additionals...)
+	for _, record := range records {
+		name := strings.ToLower(string(record.Name))
+		if record.Type != layers.DNSTypePTR || !strings.HasPrefix(name, "_") || strings.HasPrefix(name, "_services._dns-sd.") {
+			continue
+		}
+		if !containsString(services, name) {
+			services = append(services, name)
+		}
+	}
+	return
+}
+
+// deviceUpdates holds the devices approved through the API, until the reflector applies them between two packets
+type deviceUpdates struct {
+	mutex   sync.Mutex
+	pending map[macAddress]bonjourDevice
+}
+
+func newDeviceUpdates() *deviceUpdates {
+	return &deviceUpdates{pending: make(map[macAddress]bonjourDevice)}
+}
+
+func (updates *deviceUpdates) queue(mac macAddress, device bonjourDevice) {
+	updates.mutex.Lock()
+	defer updates.mutex.Unlock()
+	updates.pending[mac] = device
+}
+
+// take returns the pending updates, and forgets them
+func (updates *deviceUpdates) take() map[macAddress]bonjourDevice {
+	updates.mutex.Lock()
+	defer updates.mutex.Unlock()
+	if len(updates.pending) == 0 {
+		return nil
+	}
+	pending := updates.pending
+	updates.pending = make(map[macAddress]bonjourDevice)
+	return pending
+}
+
+// applyDeviceUpdates adds the devices approved since the last packet to the configuration of the reflector
+func (r *reflector) applyDeviceUpdates() {
+	updates := r.deviceUpdates.take()
+	if len(updates) == 0 {
+		return
+	}
+	r.configMutex.Lock()
+	defer r.configMutex.Unlock()
+	for mac, device := range updates {
+		// The maps read by the API and the debug endpoints are replaced rather than modified
+		devices := make(map[macAddress]bonjourDevice, len(r.cfg.Devices)+1)
+		for known, knownDevice := range r.cfg.Devices {
+			devices[known] = knownDevice
+		}
+		devices[mac] = device
+		r.cfg.Devices = devices
+		r.poolsMap = mapByPool(devices)
+		r.querierRestrictions = mapQuerierRestrictions(devices)
+		for _, querier := range device.AllowedQueriers {
+			r.solicitations.queriers[querier] = true
+		}
+		r.ruleHits.add(mac)
+	}
+}
+
+// approvalRequest is the body of the requests approving a quarantined device
+type approvalRequest struct {
+	Description string   `json:"description"`
+	SharedPools []uint16 `json:"shared_pools"`
+}
+
+// inventoryAPI lists the quarantined devices on /api/inventory, and approves them on /api/inventory/<mac>/approve.
+// Approved devices are added to the configuration file, and reflected right away.
+type inventoryAPI struct {
+	inventory *inventory
+	devices   *deviceAPI
+	updates   *deviceUpdates
+}
+
+func (api inventoryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/inventory" {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.inventory.list())
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/inventory/")
+	if !strings.HasSuffix(path, "/approve") {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	mac, err := net.ParseMAC(strings.TrimSuffix(path, "/approve"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid MAC address")
+		return
+	}
+	var approval approvalRequest
+	if err := json.NewDecoder(r.Body).Decode(&approval); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid approval: %v", err))
+		return
+	}
+	device, err := api.approve(mac, approval)
+	if err == errUnknownDevice {
+		writeAPIError(w, http.StatusNotFound, "device not in the inventory")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// approve persists a device entry for a quarantined device, in the pool of the VLAN it was seen on,
+// queues it for the reflector, and removes it from the inventory
+func (api inventoryAPI) approve(mac net.HardwareAddr, approval approvalRequest) (deviceRequest, error) {
+	entry, ok := api.inventory.lookup(macAddress(mac.String()))
+	if !ok {
+		return deviceRequest{}, errUnknownDevice
+	}
+	if len(approval.SharedPools) == 0 {
+		return deviceRequest{}, errors.New("shared_pools is required")
+	}
+	device := deviceRequest{
+		Description:   approval.Description,
+		bonjourDevice: bonjourDevice{OriginPool: entry.VLAN, SharedPools: approval.SharedPools},
+	}
+	if device.Description == "" {
+		device.Description = entry.Vendor
+	}
+	if err := api.devices.update(mac, device.write); err != nil {
+		return deviceRequest{}, err
+	}
+	api.updates.queue(entry.MAC, device.bonjourDevice)
+	if err := api.inventory.remove(entry.MAC); err != nil {
+		return deviceRequest{}, fmt.Errorf("device approved, but the inventory file could not be written: %v", err)
+	}
+	return device, nil
+}
+
+var approveCommand = &command{
+	name:    "approve",
+	summary: "List the quarantined devices of a running reflector, or approve one of them",
+	setup:   setupApproveCommand,
+}
+
+// setupApproveCommand approves the device given as argument through the API, or lists the quarantined devices without argument.
+// With -config, the inventory and configuration files are read and edited directly, without a running reflector.
+func setupApproveCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:8053", "Address of the API of the running reflector, or unix:<path> of its socket")
+	token := flags.String("token", os.Getenv(envAPIToken), "API token (default from "+envAPIToken+")")
+	pools := flags.String("pools", "", "Comma-separated tags of the VLANs which can use the device")
+	description := flags.String("description", "", "Description of the device entry (default: its vendor)")
+	configPath := flags.String("config", "", "Approve into this config file in TOML format, instead of calling the API")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+	inventoryPath := flags.String("inventory", "", "Inventory file, inventory_file of the configuration by default")
+
+	return func(out *commandOutput, args []string) error {
+		var offline inventoryAPI
+		if *configPath != "" {
+			var err error
+			if offline, err = openInventoryFiles(*configPath, *profile, *inventoryPath); err != nil {
+				return err
+			}
+		}
+		switch len(args) {
+		case 0:
+			var entries []inventoryEntry
+			if offline.inventory != nil {
+				entries = offline.inventory.list()
+			} else if err := callAPI(*addr, *token, http.MethodGet, "/api/inventory", nil, &entries); err != nil {
+				return err
+			}
+			return out.print(entries, func(w io.Writer) {
+				printInventory(w, entries)
+			})
+		case 1:
+			sharedPools, err := parsePoolsFlag(*pools)
+			if err != nil {
+				return err
+			}
+			if len(sharedPools) == 0 {
+				return errors.New("-pools is required to approve a device")
+			}
+			var device deviceRequest
+			approval := approvalRequest{Description: *description, SharedPools: sharedPools}
+			if offline.inventory != nil {
+				mac, err := net.ParseMAC(args[0])
+				if err != nil {
+					return fmt.Errorf("invalid MAC address %q", args[0])
+				}
+				if device, err = offline.approve(mac, approval); err == errUnknownDevice {
+					return fmt.Errorf("device %v is not in the inventory", args[0])
+				} else if err != nil {
+					return err
+				}
+			} else if err := callAPI(*addr, *token, http.MethodPost, "/api/inventory/"+args[0]+"/approve", approval, &device); err != nil {
+				return err
+			}
+			return out.print(device, func(w io.Writer) {
+				fmt.Fprintf(w, "Device %v approved: VLAN %d shared with VLANs %v\n", args[0], device.OriginPool, formatVLANList(device.SharedPools))
+			})
+		}
+		return errors.New("only one device can be approved at a time")
+	}
+}
+
+// openInventoryFiles returns an inventoryAPI approving the devices of the inventory file straight into
+// the configuration file at configPath. A running reflector applies the approvals once reloaded, and then removes
+// the approved devices from its own inventory.
+func openInventoryFiles(configPath, profile, inventoryPath string) (inventoryAPI, error) {
+	cfg, err := readProfile(configPath, profile)
+	if err != nil {
+		return inventoryAPI{}, configError(fmt.Errorf("could not read configuration: %v", err))
+	}
+	if inventoryPath == "" {
+		if inventoryPath = cfg.InventoryFile; inventoryPath == "" {
+			return inventoryAPI{}, errors.New("inventory_file is not set, pass the inventory file with -inventory")
+		}
+	}
+	inv, err := loadInventory(inventoryPath, cfg.InventorySize)
+	if err != nil {
+		return inventoryAPI{}, fmt.Errorf("could not read inventory file: %v", err)
+	}
+	devices := &deviceAPI{configPath: cfg.path, format: cfg.format, profile: cfg.profile, devicesPrefix: cfg.devicesPrefix}
+	return inventoryAPI{inventory: inv, devices: devices, updates: newDeviceUpdates()}, nil
+}
+
+// parsePoolsFlag parses a comma-separated list of VLAN tags, rejecting invalid ones
+func parsePoolsFlag(list string) ([]uint16, error) {
+	var tags []uint16
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		tag, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VLAN tag %q", field)
+		}
+		tags = append(tags, uint16(tag))
+	}
+	return tags, nil
+}
+
+func printInventory(w io.Writer, entries []inventoryEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No quarantined device")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAC\tVLAN\tVENDOR\tSERVICES\tFIRST SEEN\tPACKETS")
+	for _, entry := range entries {
+		vendor := entry.Vendor
+		if vendor == "" {
+			vendor = "-"
+		}
+		services := strings.Join(entry.Services, ",")
+		if services == "" {
+			services = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%s\t%s\t%s\t%d\n", entry.MAC, entry.VLAN, vendor, services, entry.FirstSeen.Format(time.RFC3339), entry.Packets)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadVendors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oui.txt")
+	content := "OUI/MA-L                                                    Organization\n" +
+		"00-00-0C   (hex)\t\tCisco Systems, Inc\n" +
+		"00000C     (base 16)\t\tCisco Systems, Inc\n" +
+		"f4-f5-d8   (hex)\t\tGoogle, Inc.\n"
+	ioutil.WriteFile(path, []byte(content), 0644)
+
+	vendors, err := loadVendors(path)
+	if err != nil {
+		t.Fatalf("Error in loadVendors(): %v", err)
+	}
+	mac, _ := net.ParseMAC("f4:f5:d8:01:02:03")
+	if vendor := vendors.lookup(mac); vendor != "Google, Inc." {
+		t.Errorf("Error in lookup(): got %q", vendor)
+	}
+	mac, _ = net.ParseMAC("aa:bb:cc:01:02:03")
+	if vendor := vendors.lookup(mac); vendor != "" || len(vendors) != 2 {
+		t.Errorf("Error in loadVendors(): got %q and %v", vendor, vendors)
+	}
+	if vendors, err := loadVendors(""); err != nil || vendors.lookup(mac) != "" {
+		t.Error("Error in loadVendors(): an empty path should disable the lookups")
+	}
+}
+
+func TestAnnouncedServices(t *testing.T) {
+	dns := createMockPTRAnswer("_googlecast._tcp.local", "Kitchen._googlecast._tcp.local", 120)
+	dns.Additionals = append(createMockPTRAnswer("_services._dns-sd._udp.local", "_googlecast._tcp.local", 120).Answers,
+		createMockPTRAnswer("4.3.2.1.in-addr.arpa", "kitchen.local", 120).Answers...)
+	dns.Additionals = append(dns.Additionals, createMockPTRAnswer("_Spotify-Connect._tcp.local", "Kitchen._spotify-connect._tcp.local", 120).Answers...)
+
+	services := announcedServices(dns)
+	if !reflect.DeepEqual(services, []string{"_googlecast._tcp.local", "_spotify-connect._tcp.local"}) {
+		t.Errorf("Error in announcedServices(): got %v", services)
+	}
+}
+
+func TestInventoryAPIApprove(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(configFileTest)
+	file.Close()
+
+	r, writer := createMockReflector(brconfig{Devices: map[macAddress]bonjourDevice{}})
+	r.inventory.record("00:14:22:01:23:45", 42, time.Now())
+	r.inventory.annotate("00:14:22:01:23:45", "Dell Inc.", []string{"_ipp._tcp.local"})
+	api := inventoryAPI{inventory: r.inventory, devices: &deviceAPI{configPath: file.Name()}, updates: r.deviceUpdates}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/inventory", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"vendor":"Dell Inc."`) {
+		t.Errorf("Error in ServeHTTP(): unexpected inventory %v %v", recorder.Code, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/inventory/00:14:22:01:23:99/approve", strings.NewReader(`{"shared_pools": [1234]}`)))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Error in ServeHTTP(): a device missing from the inventory should not be approved, got %v", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/inventory/00:14:22:01:23:45/approve", strings.NewReader(`{}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Error in ServeHTTP(): an approval without shared pools should be rejected, got %v", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/inventory/00:14:22:01:23:45/approve", strings.NewReader(`{"shared_pools": [1234]}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Error in ServeHTTP(): got %v %v", recorder.Code, recorder.Body)
+	}
+	if _, ok := r.inventory.lookup("00:14:22:01:23:45"); ok {
+		t.Error("Error in approve(): the device should be removed from the inventory")
+	}
+	cfg, err := readConfig(file.Name())
+	if err != nil {
+		t.Fatalf("Error in approve(): invalid configuration written: %v", err)
+	}
+	device, ok := cfg.Devices["00:14:22:01:23:45"]
+	if !ok || device.OriginPool != 42 || !reflect.DeepEqual(device.SharedPools, []uint16{1234}) {
+		t.Errorf("Error in approve(): unexpected device entry %+v in %v", device, cfg.Devices)
+	}
+	if content, _ := ioutil.ReadFile(file.Name()); !strings.Contains(string(content), `description = "Dell Inc."`) {
+		t.Errorf("Error in approve(): the vendor should be the default description:\n%s", content)
+	}
+
+	// The approved device is reflected from the next packet on
+	r.applyDeviceUpdates()
+	if tags := r.poolsMap[1234]; !reflect.DeepEqual(tags, []uint16{42}) {
+		t.Errorf("Error in applyDeviceUpdates(): unexpected pools %v", r.poolsMap)
+	}
+	if _, ok := r.cfg.Devices["00:14:22:01:23:45"]; !ok || len(writer.frames) != 0 {
+		t.Errorf("Error in applyDeviceUpdates(): unexpected devices %v", r.cfg.Devices)
+	}
+}
+
+func TestApproveCommandOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath, inventoryPath := filepath.Join(dir, "config.toml"), filepath.Join(dir, "inventory.json")
+	ioutil.WriteFile(configPath, []byte(configFileTest), 0644)
+	inv, _ := loadInventory(inventoryPath, defaultInventorySize)
+	inv.record("00:14:22:01:23:45", 42, time.Now())
+	if err := inv.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reflector running meanwhile holds the quarantined device in its own inventory
+	running, _ := loadInventory(inventoryPath, defaultInventorySize)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createMockReflector(cfg)
+	r.inventory = running
+
+	var stdout, stderr strings.Builder
+	if code := runCommandLine([]string{"approve", "-config", configPath}, &stdout, &stderr); code == 0 {
+		t.Error("Error in approve: the inventory file should be required without inventory_file")
+	}
+	stdout.Reset()
+	if code := runCommandLine([]string{"approve", "-config", configPath, "-inventory", inventoryPath}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "00:14:22:01:23:45") {
+		t.Errorf("Error in approve: expected the quarantined device to be listed, got %v %q %q", code, stdout.String(), stderr.String())
+	}
+	stdout.Reset()
+	if code := runCommandLine([]string{"approve", "-config", configPath, "-inventory", inventoryPath, "-pools", "1234", "00:14:22:01:23:99"}, &stdout, &stderr); code == 0 {
+		t.Error("Error in approve: a device missing from the inventory should not be approved")
+	}
+	if code := runCommandLine([]string{"approve", "-config", configPath, "-inventory", inventoryPath, "-pools", "1234", "00:14:22:01:23:45"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in approve: got %v %q", code, stderr.String())
+	}
+	cfg, err = readConfig(configPath)
+	if err != nil {
+		t.Fatalf("Error in approve: invalid configuration written: %v", err)
+	}
+	if device, ok := cfg.Devices["00:14:22:01:23:45"]; !ok || device.OriginPool != 42 || !reflect.DeepEqual(device.SharedPools, []uint16{1234}) {
+		t.Errorf("Error in approve: unexpected device entry %+v in %v", device, cfg.Devices)
+	}
+	if inv, _ := loadInventory(inventoryPath, defaultInventorySize); len(inv.list()) != 0 {
+		t.Errorf("Error in approve: the device should be removed from the inventory file, got %+v", inv.list())
+	}
+
+	// Once reloaded, the running reflector does not write the approved device back
+	r.reloader = newConfigReloader(cfg)
+	r.reloader.pending = &cfg
+	r.applyConfigReload()
+	if err := running.saveIfNeeded(true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if inv, _ := loadInventory(inventoryPath, defaultInventorySize); len(inv.list()) != 0 {
+		t.Errorf("Error in applyConfigReload(): the approved device was written back to the inventory file, got %+v", inv.list())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bytes reflected into each VLAN, exposed on /debug/vars
+var reflectedBytes = expvar.NewMap("reflected_bytes")
+
+// Maximum number of devices and VLANs accounted, the least recently reflected ones being forgotten beyond it
+const maxBandwidthEntries = 4096
+
+type bandwidthKey struct {
+	device macAddress
+	vlan   uint16
+}
+
+// bandwidthUsage is the traffic reflected from a device into a VLAN
+type bandwidthUsage struct {
+	Device         macAddress `json:"device"`
+	VLAN           uint16     `json:"vlan"`
+	Frames         uint64     `json:"frames"`
+	Bytes          uint64     `json:"bytes"`
+	LastReflection time.Time  `json:"last_reflection"`
+}
+
+// bandwidthAccounting counts the frames and bytes reflected per source device and target VLAN,
+// to show who uses the reflector, and to spot devices reflecting unexpectedly large amounts of data
+type bandwidthAccounting struct {
+	mutex sync.Mutex
+	usage map[bandwidthKey]*list.Element
+	// order holds the usage, least recently reflected first
+	order *list.List
+}
+
+func newBandwidthAccounting() *bandwidthAccounting {
+	return &bandwidthAccounting{usage: make(map[bandwidthKey]*list.Element), order: list.New()}
+}
+
+// record accounts a frame of size bytes reflected from device into vlan
+func (accounting *bandwidthAccounting) record(device macAddress, vlan uint16, size int, now time.Time) {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	key := bandwidthKey{device: device, vlan: vlan}
+	element, ok := accounting.usage[key]
+	if ok {
+		accounting.order.MoveToBack(element)
+	} else {
+		element = accounting.order.PushBack(&bandwidthUsage{Device: device, VLAN: vlan})
+		accounting.usage[key] = element
+		if accounting.order.Len() > maxBandwidthEntries {
+			oldest := accounting.order.Remove(accounting.order.Front()).(*bandwidthUsage)
+			delete(accounting.usage, bandwidthKey{device: oldest.Device, vlan: oldest.VLAN})
+		}
+	}
+	usage := element.Value.(*bandwidthUsage)
+	usage.Frames++
+	usage.Bytes += uint64(size)
+	usage.LastReflection = now
+	reflectedBytes.Add(strconv.Itoa(int(vlan)), int64(size))
+}
+
+// snapshot returns a copy of the usage matching device and vlan (any when empty or 0), heaviest first
+func (accounting *bandwidthAccounting) snapshot(device macAddress, vlan uint16) []bandwidthUsage {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	list := make([]bandwidthUsage, 0, len(accounting.usage))
+	for key, element := range accounting.usage {
+		if (device == "" || key.device == device) && (vlan == 0 || key.vlan == vlan) {
+			list = append(list, *element.Value.(*bandwidthUsage))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		if list[i].Device != list[j].Device {
+			return list[i].Device < list[j].Device
+		}
+		return list[i].VLAN < list[j].VLAN
+	})
+	return list
+}
+
+// ServeHTTP lists the usage, filtered by ?device=<mac> and ?vlan=<tag>
+func (accounting *bandwidthAccounting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var vlan uint64
+	if value := r.URL.Query().Get("vlan"); value != "" {
+		var err error
+		if vlan, err = strconv.ParseUint(value, 10, 12); err != nil {
+			http.Error(w, "invalid VLAN tag", http.StatusBadRequest)
+			return
+		}
+	}
+	var device macAddress
+	if value := r.URL.Query().Get("device"); value != "" {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+		device = macAddress(mac.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounting.snapshot(device, uint16(vlan)))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthAccounting(t *testing.T) {
+	accounting := newBandwidthAccounting()
+	now := time.Now()
+	accounting.record("aa:00:cc:00:ee:00", 1234, 100, now)
+	accounting.record("aa:00:cc:00:ee:00", 1234, 150, now.Add(time.Second))
+	accounting.record("aa:00:cc:00:ee:00", 2483, 100, now)
+	accounting.record("aa:bb:cc:dd:ee:ff", 1234, 1000, now)
+
+	usage := accounting.snapshot("", 0)
+	if len(usage) != 3 || usage[0].Device != "aa:bb:cc:dd:ee:ff" || usage[1].Bytes != 250 || usage[1].Frames != 2 || !usage[1].LastReflection.Equal(now.Add(time.Second)) {
+		t.Errorf("Error in snapshot(): unexpected usage %+v", usage)
+	}
+	if usage := accounting.snapshot("aa:00:cc:00:ee:00", 2483); len(usage) != 1 || usage[0].Bytes != 100 {
+		t.Errorf("Error in snapshot(): unexpected filtered usage %+v", usage)
+	}
+
+	recorder := httptest.NewRecorder()
+	accounting.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/bandwidth?device=AA:00:CC:00:EE:00", nil))
+	var served []bandwidthUsage
+	if err := json.NewDecoder(recorder.Body).Decode(&served); err != nil || len(served) != 2 {
+		t.Errorf("Error in ServeHTTP(): got %v %v", served, err)
+	}
+	recorder = httptest.NewRecorder()
+	accounting.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/bandwidth?vlan=abc", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Error in ServeHTTP(): an invalid VLAN should be rejected, got %v", recorder.Code)
+	}
+}
+
+func TestBandwidthAccountingLimit(t *testing.T) {
+	accounting := newBandwidthAccounting()
+	now := time.Now()
+	accounting.record("aa:00:cc:00:ee:00", 1, 100, now)
+	for vlan := 2; vlan <= maxBandwidthEntries; vlan++ {
+		accounting.record("aa:bb:cc:dd:ee:ff", uint16(vlan), 10, now)
+	}
+	// The first entry is the most recently reflected when the table overflows
+	accounting.record("aa:00:cc:00:ee:00", 1, 100, now)
+	accounting.record("aa:00:cc:00:ee:01", 1, 100, now)
+	if usage := accounting.snapshot("", 0); len(usage) != maxBandwidthEntries {
+		t.Errorf("Error in record(): expected %v entries, got %v", maxBandwidthEntries, len(usage))
+	}
+	if usage := accounting.snapshot("aa:00:cc:00:ee:00", 1); len(usage) != 1 || usage[0].Bytes != 200 {
+		t.Errorf("Error in record(): the recently reflected entry should be kept, got %+v", usage)
+	}
+	if usage := accounting.snapshot("aa:bb:cc:dd:ee:ff", 2); len(usage) != 0 {
+		t.Errorf("Error in record(): the least recently reflected entry should be forgotten, got %+v", usage)
+	}
+}
+
+func TestReflectorBandwidthAccounting(t *testing.T) {
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{1234, 2483}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+	r.drain(2483, false, time.Now())
+	r.processBonjourPacket(createMockBonjourPacket(false))
+
+	usage := r.bandwidth.snapshot("", 0)
+	if len(usage) != 1 || usage[0].VLAN != 1234 || usage[0].Bytes != uint64(len(writer.frames[0])) {
+		t.Errorf("Error in processBonjourPacket(): unexpected bandwidth usage %+v", usage)
+	}
+}
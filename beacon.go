@@ -0,0 +1,138 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Default delay between two beacons, their records expiring after three delays without beacon
+const defaultBeaconInterval = time.Minute
+
+// Version of the reflector, set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// Beacons sent, exposed on /debug/vars
+var beaconsSent = expvar.NewInt("beacons_sent")
+
+// beaconConfig advertises the reflector as a service on VLANs, with its version and health in its TXT record,
+// so that clients and monitoring of these VLANs can tell that it is alive without reaching the management network
+type beaconConfig struct {
+	VLANs    []uint16 `toml:"vlans"`
+	Name     string   `toml:"name"`
+	Port     uint16   `toml:"port"`
+	Interval duration `toml:"interval"`
+}
+
+func (cfg *beaconConfig) validate() error {
+	for _, vlan := range cfg.VLANs {
+		if vlan == 0 || vlan > 4094 {
+			return fmt.Errorf("invalid VLAN %v in beacon section", vlan)
+		}
+	}
+	if len(cfg.Name) > 63 {
+		return fmt.Errorf("beacon name %q is longer than 63 bytes", cfg.Name)
+	}
+	if cfg.Interval.Duration < 0 {
+		return fmt.Errorf("invalid beacon interval %v", cfg.Interval.Duration)
+	}
+	if cfg.Interval.Duration == 0 {
+		cfg.Interval.Duration = defaultBeaconInterval
+	}
+	return nil
+}
+
+// beacon builds the records of the service advertising the reflector
+type beacon struct {
+	instance string
+	host     string
+	port     uint16
+	ttl      uint32
+	start    time.Time
+	// report returns the health of the reflector, replaced in tests
+	report func() healthReport
+}
+
+// newBeacon names the service after the host running the reflector, unless a name is configured,
+// and its host after the instance ID, which does not collide with the name of the host itself
+func newBeacon(cfg beaconConfig, instanceID string, start time.Time) *beacon {
+	name := cfg.Name
+	if name == "" {
+		hostname, _ := os.Hostname()
+		name = strings.TrimSpace("Bonjour Reflector " + strings.Split(hostname, ".")[0])
+	}
+	if len(instanceID) > 8 {
+		instanceID = instanceID[:8]
+	}
+	return &beacon{
+		instance: strings.Replace(name, ".", "-", -1) + "." + peerService,
+		host:     "bonjour-reflector-" + instanceID + ".local",
+		port:     cfg.Port,
+		ttl:      uint32(3 * cfg.Interval.Duration / time.Second),
+		start:    start,
+		report:   health.report,
+	}
+}
+
+// txt returns the TXT entries of the beacon: the version, the health of the reflector, the subsystems
+// which are not ok, and the uptime in seconds. Unlike the advertisements of peer_discovery, they hold no ID,
+// so that the peers do not take the beacon for an advertisement.
+func (b *beacon) txt(now time.Time) [][]byte {
+	report := b.report()
+	var issues []string
+	for name, subsystem := range report.Subsystems {
+		if subsystem.State != healthOK {
+			issues = append(issues, name)
+		}
+	}
+	sort.Strings(issues)
+	txt := [][]byte{
+		[]byte("txtvers=1"),
+		[]byte("version=" + version),
+		[]byte("health=" + report.Status),
+	}
+	if len(issues) > 0 {
+		txt = append(txt, []byte("issues="+strings.Join(issues, ",")))
+	}
+	return append(txt, []byte("uptime="+strconv.FormatInt(int64(now.Sub(b.start)/time.Second), 10)))
+}
+
+// records returns the PTR, SRV, TXT and A records of the beacon, ip being the address of the reflector on the VLAN
+func (b *beacon) records(ip net.IP, now time.Time) []layers.DNSResourceRecord {
+	return []layers.DNSResourceRecord{
+		{Name: []byte(peerService), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: b.ttl, PTR: []byte(b.instance)},
+		{Name: []byte(b.instance), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: b.ttl,
+			SRV: layers.DNSSRV{Port: b.port, Name: []byte(b.host)}},
+		{Name: []byte(b.instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: b.ttl, TXTs: b.txt(now)},
+		{Name: []byte(b.host), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: b.ttl, IP: ip},
+	}
+}
+
+// sendBeacon sends the beacon on each of its VLANs, from the address of the reflector on the VLAN, or else srcIP
+func (r *reflector) sendBeacon(b *beacon, srcIP net.IP, now time.Time) {
+	for _, tag := range r.cfg.Beacon.VLANs {
+		ip := r.cfg.sourceIPv4(tag, srcIP)
+		data, err := serializeMDNSResponse(b.records(ip, now), ip, tag, r.brMACAddress)
+		if err != nil {
+			logger.errorf("Could not serialize beacon: %v", err)
+			return
+		}
+		r.write(data)
+		beaconsSent.Add(1)
+	}
+}
+
+// runBeacon sends the beacon every interval
+func (r *reflector) runBeacon(b *beacon, srcIP net.IP) {
+	r.sendBeacon(b, srcIP, time.Now())
+	for now := range time.Tick(r.cfg.Beacon.Interval.Duration) {
+		r.sendBeacon(b, srcIP, now)
+	}
+}
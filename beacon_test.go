@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestBeacon(t *testing.T) {
+	cfg, err := parseConfig("[addresses]\n\"30\" = [\"192.168.30.1\"]\n[beacon]\nvlans = [30, 40]\nname = \"Lab\"\nport = 8053")
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	if cfg.Beacon.Interval.Duration != defaultBeaconInterval {
+		t.Errorf("Error in parseConfig(): expected the default beacon interval, got %v", cfg.Beacon.Interval.Duration)
+	}
+	start := time.Now()
+	b := newBeacon(cfg.Beacon, "0123456789abcdef", start)
+	b.report = func() healthReport {
+		return healthReport{Status: healthDegraded, Subsystems: map[string]subsystemHealth{
+			"capture":     {State: healthOK},
+			"replication": {State: healthDegraded},
+		}}
+	}
+	if b.instance != "Lab._bonjour-reflector._tcp.local" || b.host != "bonjour-reflector-01234567.local" || b.ttl != 180 {
+		t.Errorf("Error in newBeacon(), got %+v", b)
+	}
+
+	r, writer := createMockReflector(cfg)
+	r.sendBeacon(b, net.IPv4(10, 0, 0, 1), start.Add(90*time.Second))
+	if len(writer.frames) != 2 || !equalVLANs(writer.vlanTags(), []uint16{30, 40}) {
+		t.Fatalf("Error in sendBeacon(): expected a beacon on VLANs 30 and 40, got %v", writer.vlanTags())
+	}
+	for i, expected := range []string{"192.168.30.1", "10.0.0.1"} {
+		frame := gopacket.NewPacket(writer.frames[i], layers.LayerTypeEthernet, gopacket.Default)
+		_, payload := parseUDPLayer(frame)
+		_, dns := parseDNSPayload(payload)
+		if dns == nil || len(dns.Answers) != 4 || !dns.Answers[3].IP.Equal(net.ParseIP(expected)) || dns.Answers[1].SRV.Port != 8053 {
+			t.Errorf("Error in sendBeacon(): expected the records of %v, got %+v", expected, dns.Answers)
+			continue
+		}
+		var txt []string
+		for _, entry := range dns.Answers[2].TXTs {
+			txt = append(txt, string(entry))
+		}
+		expectedTXT := "txtvers=1 version=" + version + " health=degraded issues=replication uptime=90"
+		if strings.Join(txt, " ") != expectedTXT {
+			t.Errorf("Error in sendBeacon(): expected TXT %q, got %q", expectedTXT, strings.Join(txt, " "))
+		}
+
+		// The beacon is not an advertisement of the peer discovery
+		tracker := newPeerTracker("02:00:00:00:00:01", []uint16{30}, false, nil)
+		srcMAC := srcMACTest
+		tracker.observe(&bonjourPacket{srcMAC: &srcMAC, dns: dns}, start)
+		if len(tracker.peers) != 0 {
+			t.Errorf("Error in observe(): the beacon was taken for a peer, got %+v", tracker.peers)
+		}
+	}
+
+	if _, err := parseConfig("[beacon]\nvlans = [4095]"); err == nil {
+		t.Error("Error in parseConfig(): expected an invalid beacon VLAN to be rejected")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Frames identical to one received less than this delay before are considered duplicated by the bond
+const bondDuplicateWindow = 50 * time.Millisecond
+
+var duplicateFrames = expvar.NewInt("bond_duplicate_frames")
+
+// bondInfo describes a bonding (or LACP teaming) master interface
+type bondInfo struct {
+	mode   string
+	slaves []string
+}
+
+// detectBond inspects the network interface in sysfs. Capturing on a slave of a bond only sees the frames
+// hashed to this slave, and injecting through it bypasses the bond, so slaves are reported as an error.
+// The bond is returned when intf is a bond master, nil otherwise.
+func detectBond(sysfsRoot string, intf string) (*bondInfo, error) {
+	dir := filepath.Join(sysfsRoot, intf)
+	if _, err := os.Stat(filepath.Join(dir, "bonding_slave")); err == nil {
+		master, _ := os.Readlink(filepath.Join(dir, "master"))
+		return nil, fmt.Errorf("network interface %v is a slave of bond %v: set net_interface to the bond master instead", intf, filepath.Base(master))
+	}
+	slaves, err := ioutil.ReadFile(filepath.Join(dir, "bonding", "slaves"))
+	if err != nil {
+		return nil, nil
+	}
+	mode, _ := ioutil.ReadFile(filepath.Join(dir, "bonding", "mode"))
+	return &bondInfo{
+		mode:   strings.TrimSpace(string(mode)),
+		slaves: strings.Fields(string(slaves)),
+	}, nil
+}
+
+// duplicateFilter drops the copies of a frame received through several slaves of a bond,
+// e.g. while a switch floods multicast traffic on all the links of a misconfigured aggregate
+type duplicateFilter struct {
+	window    time.Duration
+	seen      map[uint64]time.Time
+	lastPurge time.Time
+}
+
+func newDuplicateFilter(window time.Duration) *duplicateFilter {
+	return &duplicateFilter{window: window, seen: make(map[uint64]time.Time)}
+}
+
+// isDuplicate tells whether data was already received during the window, and counts duplicates
+func (filter *duplicateFilter) isDuplicate(data []byte, now time.Time) bool {
+	if now.Sub(filter.lastPurge) > filter.window {
+		for hash, seen := range filter.seen {
+			if now.Sub(seen) > filter.window {
+				delete(filter.seen, hash)
+			}
+		}
+		filter.lastPurge = now
+	}
+
+	hasher := fnv.New64a()
+	hasher.Write(data)
+	hash := hasher.Sum64()
+	if seen, ok := filter.seen[hash]; ok && now.Sub(seen) <= filter.window {
+		duplicateFrames.Add(1)
+		return true
+	}
+	filter.seen[hash] = now
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDetectBond(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "bond0", "bonding"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "bond0", "bonding", "slaves"), []byte("eth0 eth1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "bond0", "bonding", "mode"), []byte("802.3ad 4\n"), 0644)
+	os.MkdirAll(filepath.Join(root, "eth0", "bonding_slave"), 0755)
+	os.Symlink("../bond0", filepath.Join(root, "eth0", "master"))
+	os.MkdirAll(filepath.Join(root, "eth2"), 0755)
+
+	bond, err := detectBond(root, "bond0")
+	if err != nil || bond == nil || bond.mode != "802.3ad 4" || len(bond.slaves) != 2 {
+		t.Errorf("Error in detectBond() for a bond master: %+v %v", bond, err)
+	}
+	if _, err := detectBond(root, "eth0"); err == nil {
+		t.Error("Error in detectBond(): bond slaves should be reported")
+	}
+	if bond, err := detectBond(root, "eth2"); bond != nil || err != nil {
+		t.Errorf("Error in detectBond() for a regular interface: %+v %v", bond, err)
+	}
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	filter := newDuplicateFilter(50 * time.Millisecond)
+	now := time.Now()
+	frame := []byte{1, 2, 3}
+
+	if filter.isDuplicate(frame, now) {
+		t.Error("Error in isDuplicate(): first copy should be accepted")
+	}
+	if !filter.isDuplicate(frame, now.Add(10*time.Millisecond)) {
+		t.Error("Error in isDuplicate(): second copy should be dropped")
+	}
+	if filter.isDuplicate([]byte{1, 2, 4}, now.Add(10*time.Millisecond)) {
+		t.Error("Error in isDuplicate(): different frames should be accepted")
+	}
+	// mDNS retransmissions are spaced by at least one second, and must go through
+	if filter.isDuplicate(frame, now.Add(time.Second)) {
+		t.Error("Error in isDuplicate(): copies outside the window should be accepted")
+	}
+}
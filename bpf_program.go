@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/L3Nerd/bonjour-reflector/transport"
+)
+
+// Classes, sizes, modes and operations of the classic BPF instructions of linux/filter.h
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfST   = 0x02
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfMISC = 0x07
+
+	bpfW = 0x00
+	bpfH = 0x08
+	bpfB = 0x10
+
+	bpfIMM = 0x00
+	bpfABS = 0x20
+	bpfIND = 0x40
+	bpfMEM = 0x60
+
+	bpfADD  = 0x00
+	bpfLSH  = 0x60
+	bpfAND  = 0x50
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJSET = 0x40
+	bpfK    = 0x00
+	bpfX    = 0x08
+	bpfTAX  = 0x00
+)
+
+// Offsets of the ancillary data loaded by the kernel filters, reporting the VLAN tags stripped by the NIC
+const (
+	skfAdVLANTag        = 0xfffff000 + 44
+	skfAdVLANTagPresent = 0xfffff000 + 48
+)
+
+// Length of the frames accepted by the generated programs, like the snapshot length of libpcap
+const bpfAcceptLength = 262144
+
+// Cells of the scratch memory of the generated programs
+const (
+	bpfMemVLAN = iota
+	bpfMemEtherType
+	bpfMemIPv4Dst
+	bpfMemDstPort
+	bpfMemSrcPort
+)
+
+// Above this number of VLANs, the generated programs capture every VLAN, as their conditional jumps cannot reach further
+const maxBPFProgramVLANs = 200
+
+// bpfInstruction is an instruction of a classic BPF program, installed by the afpacket handles of the transport package
+type bpfInstruction = transport.Instruction
+
+// bpfAssembler builds a BPF program whose jumps target labels, an empty label targeting the next instruction
+type bpfAssembler struct {
+	program []bpfInstruction
+	labels  map[string]int
+	targets map[int][2]string
+}
+
+func newBPFAssembler() *bpfAssembler {
+	return &bpfAssembler{labels: make(map[string]int), targets: make(map[int][2]string)}
+}
+
+func (asm *bpfAssembler) op(code uint16, k uint32) {
+	asm.program = append(asm.program, bpfInstruction{Code: code, K: k})
+}
+
+func (asm *bpfAssembler) jump(code uint16, k uint32, jt, jf string) {
+	asm.targets[len(asm.program)] = [2]string{jt, jf}
+	asm.op(code, k)
+}
+
+func (asm *bpfAssembler) label(name string) {
+	asm.labels[name] = len(asm.program)
+}
+
+// offset returns the offset of the jump at i to label
+func (asm *bpfAssembler) offset(i int, label string) uint32 {
+	if label == "" {
+		return 0
+	}
+	target, ok := asm.labels[label]
+	if !ok || target <= i {
+		panic(fmt.Sprintf("invalid BPF jump to %q", label))
+	}
+	return uint32(target - i - 1)
+}
+
+// assemble resolves the jumps of the program. Conditional jumps are limited to 255 instructions,
+// which the generated programs never exceed.
+func (asm *bpfAssembler) assemble() []bpfInstruction {
+	for i, labels := range asm.targets {
+		if asm.program[i].Code == bpfJMP|bpfJA {
+			asm.program[i].K = asm.offset(i, labels[0])
+			continue
+		}
+		jt, jf := asm.offset(i, labels[0]), asm.offset(i, labels[1])
+		if jt > 255 || jf > 255 {
+			panic(fmt.Sprintf("BPF jump of instruction %d out of range", i))
+		}
+		asm.program[i].Jt, asm.program[i].Jf = uint8(jt), uint8(jf)
+	}
+	return asm.program
+}
+
+// program returns the rules as a classic BPF program for AF_PACKET sockets. Unlike the "vlan" primitive of a filter
+// compiled by libpcap for a capture file, it matches the frames whose VLAN tag was stripped by the NIC, reported
+// by the ancillary data of the kernel, as well as the frames still holding their 802.1Q header.
+func (rules captureRules) program() []bpfInstruction {
+	asm := newBPFAssembler()
+
+	// The VLAN ID and the EtherType are stored, and X is set to the offset of the IP header
+	asm.op(bpfLD|bpfW|bpfABS, skfAdVLANTagPresent)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 0, "tagged", "")
+	asm.op(bpfLD|bpfW|bpfABS, skfAdVLANTag)
+	asm.op(bpfALU|bpfAND|bpfK, 0x0fff)
+	asm.op(bpfST, bpfMemVLAN)
+	asm.op(bpfLD|bpfH|bpfABS, 12)
+	asm.op(bpfST, bpfMemEtherType)
+	asm.op(bpfLDX|bpfW|bpfIMM, 14)
+	asm.jump(bpfJMP|bpfJA, 0, "vlan", "")
+	asm.label("tagged")
+	asm.op(bpfLD|bpfH|bpfABS, 12)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 0x8100, "dot1q", "")
+	asm.op(bpfRET|bpfK, 0)
+	asm.label("dot1q")
+	asm.op(bpfLD|bpfH|bpfABS, 14)
+	asm.op(bpfALU|bpfAND|bpfK, 0x0fff)
+	asm.op(bpfST, bpfMemVLAN)
+	asm.op(bpfLD|bpfH|bpfABS, 16)
+	asm.op(bpfST, bpfMemEtherType)
+	asm.op(bpfLDX|bpfW|bpfIMM, 18)
+
+	asm.label("vlan")
+	if len(rules.vlans) > 0 && len(rules.vlans) <= maxBPFProgramVLANs {
+		asm.op(bpfLD|bpfMEM, bpfMemVLAN)
+		for _, vlan := range rules.vlans {
+			asm.jump(bpfJMP|bpfJEQ|bpfK, uint32(vlan), "network", "")
+		}
+		asm.op(bpfRET|bpfK, 0)
+	}
+	asm.label("network")
+	asm.op(bpfLD|bpfMEM, bpfMemEtherType)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 0x0800, "ipv4", "")
+	asm.jump(bpfJMP|bpfJA, 0, "ipv6", "")
+
+	// UDP over IPv4, the fragments following the first one having no UDP header
+	asm.label("ipv4")
+	asm.op(bpfLD|bpfB|bpfIND, 9)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 17, "udp4", "")
+	asm.op(bpfRET|bpfK, 0)
+	asm.label("udp4")
+	asm.op(bpfLD|bpfH|bpfIND, 6)
+	asm.jump(bpfJMP|bpfJSET|bpfK, 0x1fff, "", "unfragmented")
+	asm.op(bpfRET|bpfK, 0)
+	asm.label("unfragmented")
+	asm.op(bpfLD|bpfW|bpfIND, 16)
+	asm.op(bpfST, bpfMemIPv4Dst)
+	asm.op(bpfLD|bpfB|bpfIND, 0)
+	asm.op(bpfALU|bpfAND|bpfK, 0x0f)
+	asm.op(bpfALU|bpfLSH|bpfK, 2)
+	asm.op(bpfALU|bpfADD|bpfX, 0)
+	asm.op(bpfMISC|bpfTAX, 0)
+	asm.op(bpfLD|bpfH|bpfIND, 0)
+	asm.op(bpfST, bpfMemSrcPort)
+	asm.op(bpfLD|bpfH|bpfIND, 2)
+	asm.op(bpfST, bpfMemDstPort)
+	for i, group := range rules.groups {
+		ip := group.ip.To4()
+		if ip == nil {
+			continue
+		}
+		next := fmt.Sprintf("ipv4-group-%d", i)
+		asm.op(bpfLD|bpfMEM, bpfMemIPv4Dst)
+		asm.jump(bpfJMP|bpfJEQ|bpfK, binary.BigEndian.Uint32(ip), "", next)
+		matchGroupPort(asm, group, next)
+	}
+	if rules.unicastResponses {
+		asm.op(bpfLD|bpfMEM, bpfMemSrcPort)
+		asm.jump(bpfJMP|bpfJEQ|bpfK, 5353, "", "ipv4-rejected")
+		asm.op(bpfLD|bpfMEM, bpfMemIPv4Dst)
+		asm.op(bpfALU|bpfAND|bpfK, 0xf0000000)
+		asm.jump(bpfJMP|bpfJEQ|bpfK, 0xe0000000, "ipv4-rejected", "")
+		asm.op(bpfRET|bpfK, bpfAcceptLength)
+		asm.label("ipv4-rejected")
+	}
+	asm.op(bpfRET|bpfK, 0)
+
+	// UDP over IPv6, without extension headers like the mDNS packets
+	asm.label("ipv6")
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 0x86dd, "ip6", "")
+	asm.op(bpfRET|bpfK, 0)
+	asm.label("ip6")
+	asm.op(bpfLD|bpfB|bpfIND, 6)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, 17, "udp6", "")
+	asm.op(bpfRET|bpfK, 0)
+	asm.label("udp6")
+	asm.op(bpfLD|bpfH|bpfIND, 40)
+	asm.op(bpfST, bpfMemSrcPort)
+	asm.op(bpfLD|bpfH|bpfIND, 42)
+	asm.op(bpfST, bpfMemDstPort)
+	for i, group := range rules.groups {
+		if group.ip.To4() != nil {
+			continue
+		}
+		next := fmt.Sprintf("ipv6-group-%d", i)
+		ip := group.ip.To16()
+		for word := 0; word < 4; word++ {
+			asm.op(bpfLD|bpfW|bpfIND, uint32(24+4*word))
+			asm.jump(bpfJMP|bpfJEQ|bpfK, binary.BigEndian.Uint32(ip[4*word:]), "", next)
+		}
+		matchGroupPort(asm, group, next)
+	}
+	if rules.unicastResponses {
+		asm.op(bpfLD|bpfMEM, bpfMemSrcPort)
+		asm.jump(bpfJMP|bpfJEQ|bpfK, 5353, "", "ipv6-rejected")
+		asm.op(bpfLD|bpfB|bpfIND, 24)
+		asm.jump(bpfJMP|bpfJEQ|bpfK, 0xff, "ipv6-rejected", "")
+		asm.op(bpfRET|bpfK, bpfAcceptLength)
+		asm.label("ipv6-rejected")
+	}
+	asm.op(bpfRET|bpfK, 0)
+	return asm.assemble()
+}
+
+// matchGroupPort accepts the frame when its destination port is the one of group, or else jumps to next
+func matchGroupPort(asm *bpfAssembler, group passthroughGroup, next string) {
+	asm.op(bpfLD|bpfMEM, bpfMemDstPort)
+	asm.jump(bpfJMP|bpfJEQ|bpfK, uint32(group.port), "", next)
+	asm.op(bpfRET|bpfK, bpfAcceptLength)
+	asm.label(next)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// bpfMachine interprets the instructions used by the generated programs on frame, whose VLAN tag
+// was stripped by the NIC unless tci is negative
+type bpfMachine struct {
+	t     *testing.T
+	frame []byte
+	tci   int
+	a, x  uint32
+	mem   [16]uint32
+}
+
+// runBPFProgram runs program on frame, and returns the accepted length
+func runBPFProgram(t *testing.T, program []bpfInstruction, frame []byte, tci int) uint32 {
+	m := &bpfMachine{t: t, frame: frame, tci: tci}
+	for pc := 0; pc < len(program); pc++ {
+		ins := program[pc]
+		switch ins.Code & 0x07 {
+		case bpfLD:
+			if !m.loadA(ins) {
+				// Loads out of the frame reject it
+				return 0
+			}
+		case bpfLDX:
+			m.x = ins.K
+		case bpfST:
+			m.mem[ins.K] = m.a
+		case bpfALU:
+			m.alu(ins)
+		case bpfJMP:
+			pc += m.jump(ins)
+		case bpfRET:
+			return ins.K
+		case bpfMISC:
+			m.x = m.a
+		}
+	}
+	t.Fatal("BPF program without return")
+	return 0
+}
+
+// load reads size bytes of the frame at offset, or the ancillary VLAN data
+func (m *bpfMachine) load(offset uint32, size uint16) (uint32, bool) {
+	switch offset {
+	case skfAdVLANTagPresent:
+		if m.tci >= 0 {
+			return 1, true
+		}
+		return 0, true
+	case skfAdVLANTag:
+		return uint32(m.tci), true
+	}
+	length := map[uint16]uint32{bpfW: 4, bpfH: 2, bpfB: 1}[size]
+	if offset+length > uint32(len(m.frame)) {
+		return 0, false
+	}
+	switch size {
+	case bpfW:
+		return binary.BigEndian.Uint32(m.frame[offset:]), true
+	case bpfH:
+		return uint32(binary.BigEndian.Uint16(m.frame[offset:])), true
+	}
+	return uint32(m.frame[offset]), true
+}
+
+// loadA runs a load into the accumulator, and tells whether it stayed within the frame
+func (m *bpfMachine) loadA(ins bpfInstruction) (ok bool) {
+	ok = true
+	switch ins.Code & 0xe0 {
+	case bpfABS:
+		m.a, ok = m.load(ins.K, ins.Code&0x18)
+	case bpfIND:
+		m.a, ok = m.load(m.x+ins.K, ins.Code&0x18)
+	case bpfMEM:
+		m.a = m.mem[ins.K]
+	default:
+		m.t.Fatalf("unexpected load %#x", ins.Code)
+	}
+	return ok
+}
+
+func (m *bpfMachine) alu(ins bpfInstruction) {
+	operand := ins.K
+	if ins.Code&bpfX != 0 {
+		operand = m.x
+	}
+	switch ins.Code & 0xf0 {
+	case bpfADD:
+		m.a += operand
+	case bpfAND:
+		m.a &= operand
+	case bpfLSH:
+		m.a <<= operand
+	default:
+		m.t.Fatalf("unexpected operation %#x", ins.Code)
+	}
+}
+
+// jump returns the number of instructions a jump skips
+func (m *bpfMachine) jump(ins bpfInstruction) int {
+	var taken bool
+	switch ins.Code & 0xf0 {
+	case bpfJA:
+		return int(ins.K)
+	case bpfJEQ:
+		taken = m.a == ins.K
+	case bpfJSET:
+		taken = m.a&ins.K != 0
+	}
+	if taken {
+		return int(ins.Jt)
+	}
+	return int(ins.Jf)
+}
+
+func createMockUDPFrame(tag uint16, srcIP, dstIP string, srcPort, dstPort layers.UDPPort) []byte {
+	var ip gopacket.NetworkLayer
+	etherType := layers.EthernetTypeIPv4
+	if src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP); src.To4() != nil {
+		ip = &layers.IPv4{Version: 4, IHL: 6, Options: []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	} else {
+		etherType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	}
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: dstMACTest, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: etherType},
+		ip.(gopacket.SerializableLayer), udp, gopacket.Payload("mdns"))
+	return buffer.Bytes()
+}
+
+func TestCaptureRulesProgram(t *testing.T) {
+	cfg, err := parseConfig(`
+		passthrough = ["239.255.250.250:9131", "[ff02::c]:3702"]
+		[devices."aa:bb:cc:dd:ee:ff"]
+		origin_pool = 30
+		shared_pools = [40]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := newCaptureRules(&cfg).program()
+
+	tests := []struct {
+		frame    []byte
+		accepted bool
+	}{
+		{createMockUDPFrame(30, "192.168.30.7", "224.0.0.251", 5353, 5353), true},
+		{createMockUDPFrame(40, "fd00::7", "ff02::fb", 5353, 5353), true},
+		{createMockUDPFrame(50, "192.168.50.7", "224.0.0.251", 5353, 5353), false},
+		{createMockUDPFrame(30, "192.168.30.7", "224.0.0.252", 5353, 5353), false},
+		{createMockUDPFrame(30, "fd00::7", "ff02::fc", 5353, 5353), false},
+		{createMockUDPFrame(30, "192.168.30.7", "224.0.0.251", 5353, 5354), false},
+		{createMockUDPFrame(30, "192.168.30.7", "239.255.250.250", 49152, 9131), true},
+		{createMockUDPFrame(30, "fd00::7", "ff02::c", 49152, 3702), true},
+		{createMockUDPFrame(30, "192.168.30.7", "239.255.250.250", 49152, 3702), false},
+		// Unicast responses to QU questions and legacy queries
+		{createMockUDPFrame(30, "192.168.30.7", "192.168.40.8", 5353, 5353), true},
+		{createMockUDPFrame(30, "fd00::7", "fd00::8", 5353, 49152), true},
+		{createMockUDPFrame(30, "192.168.30.7", "224.0.0.252", 5353, 49152), false},
+		{createMockUDPFrame(30, "192.168.30.7", "192.168.40.8", 49152, 5353), false},
+	}
+	for i, test := range tests {
+		if accepted := runBPFProgram(t, program, test.frame, -1) > 0; accepted != test.accepted {
+			t.Errorf("Error in program(): frame %d accepted %v, expected %v", i, accepted, test.accepted)
+		}
+		// The same frame, once its tag is stripped by the NIC
+		untagged := append(append([]byte{}, test.frame[:12]...), test.frame[16:]...)
+		tci := int(binary.BigEndian.Uint16(test.frame[14:]))
+		if accepted := runBPFProgram(t, program, untagged, tci) > 0; accepted != test.accepted {
+			t.Errorf("Error in program(): stripped frame %d accepted %v, expected %v", i, accepted, test.accepted)
+		}
+	}
+
+	untagged := createMockUDPFrame(30, "192.168.30.7", "224.0.0.251", 5353, 5353)
+	untagged = append(append([]byte{}, untagged[:12]...), untagged[16:]...)
+	if runBPFProgram(t, program, untagged, -1) != 0 {
+		t.Error("Error in program(): expected the untagged frames to be rejected")
+	}
+	fragment := createMockUDPFrame(30, "192.168.30.7", "224.0.0.251", 5353, 5353)
+	binary.BigEndian.PutUint16(fragment[18+6:], 0x0010)
+	if runBPFProgram(t, program, fragment, -1) != 0 {
+		t.Error("Error in program(): expected the IPv4 fragments to be rejected")
+	}
+
+	// Every VLAN is captured when unknown devices are reflected
+	cfg.UnknownDeviceMode = unknownLogAndDrop
+	if runBPFProgram(t, newCaptureRules(&cfg).program(), createMockUDPFrame(50, "192.168.50.7", "224.0.0.251", 5353, 5353), -1) == 0 {
+		t.Error("Error in program(): expected every VLAN to be captured")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// BPF filter capturing the Bonjour traffic of the trunk, tagged or not
+const browseFilter = "udp dst port 5353 or (vlan and udp dst port 5353)"
+
+// browsedInstance is a service instance announced by a device, as seen on the trunk by the browse command
+type browsedInstance struct {
+	Service  string     `json:"service"`
+	Instance string     `json:"instance"`
+	Device   macAddress `json:"device"`
+	// VLAN the device announced the instance on, 0 when untagged
+	VLAN     uint16    `json:"vlan"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// serviceBrowser gathers the service instances announced by the devices, from the PTR records of their answers
+type serviceBrowser struct {
+	instances map[string]*browsedInstance
+}
+
+func newServiceBrowser() *serviceBrowser {
+	return &serviceBrowser{instances: make(map[string]*browsedInstance)}
+}
+
+// observe records the instances announced by bonjourPacket, forgetting the ones withdrawn by goodbye packets
+func (browser *serviceBrowser) observe(bonjourPacket bonjourPacket, now time.Time) {
+	if bonjourPacket.dns == nil || bonjourPacket.isDNSQuery {
+		return
+	}
+	var vlan uint16
+	if bonjourPacket.vlanTag != nil {
+		vlan = *bonjourPacket.vlanTag
+	}
+	device := macAddress(bonjourPacket.srcMAC.String())
+	for _, records := range [][]layers.DNSResourceRecord{bonjourPacket.dns.Answers, bonjourPacket.dns.Additionals} {
+		for _, record := range records {
+			if record.Type != layers.DNSTypePTR || len(record.PTR) == 0 || serviceTypeOf(string(record.Name)) == "" {
+				continue
+			}
+			key := fmt.Sprintf("%v|%v|%v", strings.ToLower(string(record.PTR)), device, vlan)
+			if record.TTL == 0 {
+				delete(browser.instances, key)
+				continue
+			}
+			browser.instances[key] = &browsedInstance{
+				Service:  serviceTypeOf(string(record.Name)),
+				Instance: strings.TrimSuffix(string(record.PTR), "."),
+				Device:   device,
+				VLAN:     vlan,
+				Address:  bonjourPacket.srcIP.String(),
+				LastSeen: now,
+			}
+		}
+	}
+}
+
+// list returns the instances sorted by service type, instance name and VLAN
+func (browser *serviceBrowser) list() []browsedInstance {
+	list := make([]browsedInstance, 0, len(browser.instances))
+	for _, instance := range browser.instances {
+		list = append(list, *instance)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Service != list[j].Service {
+			return list[i].Service < list[j].Service
+		}
+		if list[i].Instance != list[j].Instance {
+			return list[i].Instance < list[j].Instance
+		}
+		return list[i].VLAN < list[j].VLAN
+	})
+	return list
+}
+
+var browseCommand = &command{
+	name:    "browse",
+	summary: "Listen to the Bonjour traffic of the trunk for a while, and list the services announced on each VLAN",
+	setup:   setupBrowseCommand,
+}
+
+// setupBrowseCommand passively listens on the trunk, without sending any query, so that browsing
+// does not disturb the network. Devices only announcing their services rarely may not be seen.
+func setupBrowseCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	intf := flags.String("interface", "", "Network interface carrying the VLAN trunk")
+	configPath := flags.String("config", "", "Config file in TOML format, providing the interface when -interface is not set")
+	duration := flags.Duration("for", 30*time.Second, "Duration of the listening")
+	devices := flags.Bool("devices", false, "Print the devices section of a configuration for the devices seen")
+
+	return func(out *commandOutput, args []string) error {
+		if *intf == "" && *configPath != "" {
+			cfg, err := readConfig(*configPath)
+			if err != nil {
+				return configError(fmt.Errorf("could not read configuration: %v", err))
+			}
+			*intf = cfg.NetInterface
+		}
+		if *intf == "" {
+			return fmt.Errorf("usage: browse -interface <name> [-for 30s] [-devices]")
+		}
+		instances, err := browse(*intf, *duration)
+		if err != nil {
+			return err
+		}
+		return out.print(instances, func(w io.Writer) {
+			if *devices {
+				printBrowsedDevices(w, instances)
+			} else {
+				printBrowsedInstances(w, instances)
+			}
+		})
+	}
+}
+
+// browse captures the Bonjour traffic of intf for duration, and returns the service instances announced
+func browse(intf string, duration time.Duration) ([]browsedInstance, error) {
+	handle, err := pcap.OpenLive(intf, 65536, true, time.Second)
+	if err != nil {
+		return nil, captureError(intf, fmt.Errorf("could not capture on network interface %v: %v", intf, err))
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(browseFilter); err != nil {
+		return nil, captureError(intf, fmt.Errorf("could not apply filter on network interface: %v", err))
+	}
+
+	browser := newServiceBrowser()
+	for deadline := time.Now().Add(duration); time.Now().Before(deadline); {
+		data, _, err := handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not capture on network interface %v: %v", intf, err)
+		}
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true})
+		// Nothing is sent, so there is no own traffic to filter out
+		if bonjourPacket, ok := parseBonjourPacket(packet, net.HardwareAddr{}); ok {
+			browser.observe(bonjourPacket, time.Now())
+		}
+	}
+	return browser.list(), nil
+}
+
+func printBrowsedInstances(w io.Writer, instances []browsedInstance) {
+	if len(instances) == 0 {
+		fmt.Fprintln(w, "No service announced")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tINSTANCE\tDEVICE\tVLAN\tADDRESS")
+	for _, instance := range instances {
+		vlan := "untagged"
+		if instance.VLAN != 0 {
+			vlan = fmt.Sprint(instance.VLAN)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", instance.Service, instance.Instance, instance.Device, vlan, instance.Address)
+	}
+	tw.Flush()
+}
+
+// printBrowsedDevices prints a devices entry for each tagged device seen, to be completed with its shared pools
+func printBrowsedDevices(w io.Writer, instances []browsedInstance) {
+	type deviceKey struct {
+		device macAddress
+		vlan   uint16
+	}
+	var keys []deviceKey
+	names := make(map[deviceKey][]string)
+	for _, instance := range instances {
+		if instance.VLAN == 0 {
+			continue
+		}
+		key := deviceKey{device: instance.Device, vlan: instance.VLAN}
+		if _, ok := names[key]; !ok {
+			keys = append(keys, key)
+		}
+		name := instance.Instance
+		if strings.HasSuffix(strings.ToLower(name), "."+instance.Service) {
+			name = name[:len(name)-len(instance.Service)-1]
+		}
+		if !containsString(names[key], name) {
+			names[key] = append(names[key], name)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].vlan != keys[j].vlan {
+			return keys[i].vlan < keys[j].vlan
+		}
+		return keys[i].device < keys[j].device
+	})
+
+	fmt.Fprintln(w, "[devices]")
+	for _, key := range keys {
+		fmt.Fprintf(w, "\n    [devices.%q]\n", key.device)
+		fmt.Fprintf(w, "    description = %q\n", strings.Join(names[key], ", "))
+		fmt.Fprintf(w, "    origin_pool = %d\n", key.vlan)
+		fmt.Fprintln(w, "    shared_pools = []               # Tags of the VLANs which can use this device")
+	}
+}
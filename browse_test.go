@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceBrowser(t *testing.T) {
+	browser := newServiceBrowser()
+	now := time.Now()
+	announce := func(service, instance string, ttl uint32) {
+		browser.observe(bonjourPacket{
+			dns:     createMockPTRAnswer(service, instance, ttl),
+			vlanTag: &vlanIdentifierTest,
+			srcMAC:  &srcMACTest,
+			srcIP:   srcIPv4Test,
+		}, now)
+	}
+	announce("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120)
+	announce("_googlecast._tcp.local.", "TV._googlecast._tcp.local.", 120)
+	announce("_airplay._tcp.local", "TV._airplay._tcp.local", 120)
+	announce("_airplay._tcp.local", "TV._airplay._tcp.local", 0)
+	browser.observe(bonjourPacket{dns: createMockPTRAnswer("_ipp._tcp.local", "Other._ipp._tcp.local", 120), isDNSQuery: true}, now)
+
+	instances := browser.list()
+	if len(instances) != 2 {
+		t.Fatalf("Error in observe(): expected 2 instances, got %+v", instances)
+	}
+	cast := instances[0]
+	if cast.Service != "_googlecast._tcp.local" || cast.Instance != "TV._googlecast._tcp.local" || cast.VLAN != vlanIdentifierTest ||
+		cast.Device != macAddress(srcMACTest.String()) || cast.Address != srcIPv4Test.String() {
+		t.Errorf("Error in observe(): unexpected instance %+v", cast)
+	}
+	if instances[1].Service != "_ipp._tcp.local" {
+		t.Errorf("Error in list(): expected the instances sorted by service, got %+v", instances)
+	}
+
+	var buf bytes.Buffer
+	printBrowsedDevices(&buf, instances)
+	cfg, err := parseConfig(buf.String())
+	if err != nil {
+		t.Fatalf("Error in printBrowsedDevices(): invalid configuration %q: %v", buf.String(), err)
+	}
+	device, ok := cfg.Devices[macAddress(srcMACTest.String())]
+	if !ok || device.OriginPool != vlanIdentifierTest || !strings.Contains(buf.String(), `description = "TV, Office Printer"`) {
+		t.Errorf("Error in printBrowsedDevices(): unexpected devices %q", buf.String())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Protocols sharing the injection budget
+const (
+	protocolMDNS        = "mdns"
+	protocolSSDP        = "ssdp"
+	protocolWSD         = "wsd"
+	protocolNATPMP      = "natpmp"
+	protocolPassthrough = "passthrough"
+)
+
+// Duration of traffic at the configured rates a VLAN may inject at once
+const defaultBudgetBurst = time.Second
+
+// Frames dropped by the injection budget, per protocol, exposed on /debug/vars
+var injectionBudgetStats = expvar.NewMap("injection_budget")
+
+type injectionBudgetConfig struct {
+	PacketsPerSecond int            `toml:"packets_per_second"`
+	BytesPerSecond   int            `toml:"bytes_per_second"`
+	Burst            duration       `toml:"burst"`
+	Weights          map[string]int `toml:"weights"`
+}
+
+func (cfg *injectionBudgetConfig) validate() error {
+	if cfg.PacketsPerSecond < 0 || cfg.BytesPerSecond < 0 {
+		return fmt.Errorf("invalid injection_budget, rates cannot be negative")
+	}
+	if cfg.Burst.Duration == 0 {
+		cfg.Burst.Duration = defaultBudgetBurst
+	}
+	for protocol, weight := range cfg.Weights {
+		if protocol != protocolMDNS && protocol != protocolSSDP && protocol != protocolWSD && protocol != protocolNATPMP && protocol != protocolPassthrough {
+			return fmt.Errorf("invalid protocol %q in injection_budget weights, expected %q, %q, %q, %q or %q", protocol, protocolMDNS, protocolSSDP, protocolWSD, protocolNATPMP, protocolPassthrough)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("invalid weight %v of %v in injection_budget, expected a positive number", weight, protocol)
+		}
+	}
+	return nil
+}
+
+// tokenBucket holds up to capacity tokens, refilled at rate tokens per second
+type tokenBucket struct {
+	tokens, capacity, rate float64
+	last                   time.Time
+}
+
+func newTokenBucket(rate float64, burst time.Duration, now time.Time) tokenBucket {
+	capacity := rate * burst.Seconds()
+	return tokenBucket{tokens: capacity, capacity: capacity, rate: rate, last: now}
+}
+
+// refill adds the tokens earned since the last refill, and tells whether cost tokens are available.
+// A full bucket affords any cost, going into debt for the costs larger than its capacity, which would
+// otherwise never be affordable. A bucket without rate is unlimited.
+func (bucket *tokenBucket) refill(cost float64, now time.Time) bool {
+	if bucket.rate == 0 {
+		return true
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.last = now
+	return bucket.tokens >= cost || bucket.tokens >= bucket.capacity
+}
+
+// vlanBudget is the budget of a target VLAN, in frames and in bytes
+type vlanBudget struct {
+	packets, bytes tokenBucket
+}
+
+// injectionBudget caps the frames and bytes injected into each VLAN, all protocols together. A frame of a protocol
+// costs the highest weight divided by the weight of its protocol, so that under pressure the protocols with the
+// highest weight get the largest part of the budget, while the sum of the injected traffic never exceeds it.
+type injectionBudget struct {
+	mutex   sync.Mutex
+	cfg     injectionBudgetConfig
+	costs   map[string]float64
+	budgets map[uint16]*vlanBudget
+}
+
+// newInjectionBudget returns the budget of the configuration, or nil when it is unlimited
+func newInjectionBudget(cfg injectionBudgetConfig) *injectionBudget {
+	if cfg.PacketsPerSecond == 0 && cfg.BytesPerSecond == 0 {
+		return nil
+	}
+	weights := map[string]int{protocolMDNS: 1, protocolSSDP: 1, protocolWSD: 1, protocolNATPMP: 1, protocolPassthrough: 1}
+	maxWeight := 0
+	for protocol := range weights {
+		if weight, ok := cfg.Weights[protocol]; ok {
+			weights[protocol] = weight
+		}
+		if weights[protocol] > maxWeight {
+			maxWeight = weights[protocol]
+		}
+	}
+	budget := &injectionBudget{cfg: cfg, costs: make(map[string]float64), budgets: make(map[uint16]*vlanBudget)}
+	for protocol, weight := range weights {
+		budget.costs[protocol] = float64(maxWeight) / float64(weight)
+	}
+	return budget
+}
+
+// allow tells whether a frame of size bytes of the protocol may be injected into the VLAN tag, and spends its cost
+func (budget *injectionBudget) allow(protocol string, tag uint16, size int, now time.Time) bool {
+	if budget == nil {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	vlan, ok := budget.budgets[tag]
+	if !ok {
+		vlan = &vlanBudget{
+			packets: newTokenBucket(float64(budget.cfg.PacketsPerSecond), budget.cfg.Burst.Duration, now),
+			bytes:   newTokenBucket(float64(budget.cfg.BytesPerSecond), budget.cfg.Burst.Duration, now),
+		}
+		budget.budgets[tag] = vlan
+	}
+	cost := budget.costs[protocol]
+	// Both buckets are refilled before any of them is spent
+	packetsOK := vlan.packets.refill(cost, now)
+	bytesOK := vlan.bytes.refill(cost*float64(size), now)
+	if !packetsOK || !bytesOK {
+		injectionBudgetStats.Add(protocol+"_dropped", 1)
+		return false
+	}
+	vlan.packets.tokens -= cost
+	vlan.bytes.tokens -= cost * float64(size)
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInjectionBudget(t *testing.T) {
+	if newInjectionBudget(injectionBudgetConfig{}).allow(protocolMDNS, 42, 1500, time.Now()) != true {
+		t.Error("Error in allow(): a budget without rates should be unlimited")
+	}
+
+	cfg := injectionBudgetConfig{PacketsPerSecond: 4, BytesPerSecond: 1000, Weights: map[string]int{protocolMDNS: 2}}
+	if err := cfg.validate(); err != nil || cfg.Burst.Duration != time.Second {
+		t.Fatalf("Error in validate(): %v", err)
+	}
+	budget := newInjectionBudget(cfg)
+	now := time.Now()
+
+	// mDNS frames cost 1, SSDP frames 2, out of 4 per second
+	if !budget.allow(protocolSSDP, 42, 100, now) || !budget.allow(protocolMDNS, 42, 100, now) || !budget.allow(protocolMDNS, 42, 100, now) {
+		t.Error("Error in allow(): frames within the budget should be allowed")
+	}
+	if budget.allow(protocolMDNS, 42, 100, now) {
+		t.Error("Error in allow(): frames over the packet budget should be dropped")
+	}
+	if !budget.allow(protocolMDNS, 43, 100, now) {
+		t.Error("Error in allow(): each VLAN should have its own budget")
+	}
+	if budget.allow(protocolSSDP, 42, 100, now.Add(250*time.Millisecond)) || !budget.allow(protocolMDNS, 42, 100, now.Add(250*time.Millisecond)) {
+		t.Error("Error in allow(): the budget should be refilled over time, by the cost of the frames")
+	}
+	if !budget.allow(protocolMDNS, 44, 600, now) || budget.allow(protocolMDNS, 44, 500, now) {
+		t.Error("Error in allow(): frames over the byte budget should be dropped")
+	}
+
+	// Frames costing more than the capacity of a bucket are allowed when it is full, and their debt is paid back
+	if !budget.allow(protocolMDNS, 45, 1500, now) {
+		t.Error("Error in allow(): frames larger than the byte budget should be allowed by a full bucket")
+	}
+	if budget.allow(protocolMDNS, 45, 100, now.Add(400*time.Millisecond)) || !budget.allow(protocolMDNS, 45, 1500, now.Add(2*time.Second)) {
+		t.Error("Error in allow(): the debt of large frames should be paid back before any other frame is allowed")
+	}
+
+	for _, weights := range []map[string]int{{"llmnr": 1}, {protocolSSDP: 0}} {
+		cfg := injectionBudgetConfig{PacketsPerSecond: 4, Weights: weights}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Error in validate(): expected an error for %v", weights)
+		}
+	}
+}
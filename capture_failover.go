@@ -0,0 +1,217 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/L3Nerd/bonjour-reflector/transport"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// Consecutive read errors after which the active capture interface is considered dead
+const captureFailoverErrors = 10
+
+// Delay between two rounds of attempts when none of the capture interfaces can be opened
+const captureRetryDelay = 5 * time.Second
+
+var (
+	captureInterface = expvar.NewString("capture_interface")
+	captureFailovers = expvar.NewInt("capture_failovers")
+)
+
+// captureInterfaces returns the ordered list of interfaces the reflector may capture on
+func (cfg *brconfig) captureInterfaces() []string {
+	if len(cfg.NetInterfaces) > 0 {
+		return cfg.NetInterfaces
+	}
+	return []string{cfg.NetInterface}
+}
+
+// failoverCapture captures on the first interface of a list which can be opened,
+// and fails over to the next ones when the active interface dies
+type failoverCapture struct {
+	mutex      sync.RWMutex
+	interfaces []string
+	open       func(intf string) (captureHandle, error)
+	active     int
+	handle     captureHandle
+	// errors counts the consecutive read errors of the active interface, and is only used by the reading goroutine
+	errors int
+	// status fails while no interface can be captured on
+	status *subsystemStatus
+	// shared is set for the trunks of a multiCapture, whose interfaces are reported together
+	shared bool
+	// stopped is set on shutdown, the reads then returning io.EOF
+	stopped bool
+}
+
+func newFailoverCapture(interfaces []string, open func(intf string) (captureHandle, error)) (*failoverCapture, error) {
+	capture := &failoverCapture{interfaces: interfaces, open: open, active: -1, status: newSubsystemStatus()}
+	if err := capture.failover(); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// activeInterface returns the name of the interface currently captured on
+func (capture *failoverCapture) activeInterface() string {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	return capture.interfaces[capture.active]
+}
+
+// failover opens the interfaces following the active one, in order, until one of them can be opened.
+// The active interface itself is tried last, so that a lone interface is reopened.
+func (capture *failoverCapture) failover() error {
+	var failures []string
+	var errs []error
+	for i := 1; i <= len(capture.interfaces); i++ {
+		next := (capture.active + i) % len(capture.interfaces)
+		name := capture.interfaces[next]
+		handle, err := capture.open(name)
+		if err != nil {
+			logger.warnf("Could not capture on %v: %v", name, err)
+			failures = append(failures, err.Error())
+			errs = append(errs, err)
+			continue
+		}
+		capture.mutex.Lock()
+		previous := capture.handle
+		capture.handle, capture.active = handle, next
+		capture.mutex.Unlock()
+		if closer, ok := previous.(interface{ Close() }); ok {
+			closer.Close()
+		}
+		if !capture.shared {
+			captureInterface.Set(name)
+		}
+		logger.infof("Capturing on %v", name)
+		return nil
+	}
+	return commonKind(errs, fmt.Errorf("could not open any capture interface: %v", strings.Join(failures, "; ")))
+}
+
+// restart reopens the active interface, such as when its capture stalls without reporting errors. A read blocked
+// on the previous handle is interrupted when possible, the handle being closed once it returns.
+func (capture *failoverCapture) restart() error {
+	name := capture.activeInterface()
+	handle, err := capture.open(name)
+	if err != nil {
+		return err
+	}
+	capture.mutex.Lock()
+	previous := capture.handle
+	capture.handle = handle
+	capture.mutex.Unlock()
+	if stopper, ok := previous.(transport.Stopper); ok {
+		stopper.Stop()
+	}
+	if closer, ok := previous.(interface{ Close() }); ok {
+		go closer.Close()
+	}
+	logger.infof("Capturing on %v again", name)
+	return nil
+}
+
+// ReadPacketData reads from the active interface, and fails over to the next ones when it keeps failing
+func (capture *failoverCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	capture.mutex.RLock()
+	handle, stopped := capture.handle, capture.stopped
+	capture.mutex.RUnlock()
+	if stopped {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data, info, err := handle.ReadPacketData()
+	if err == nil || err == pcap.NextErrorTimeoutExpired {
+		capture.errors = 0
+		return data, info, err
+	}
+	capture.mutex.RLock()
+	replaced, stopped := capture.handle != handle, capture.stopped
+	capture.mutex.RUnlock()
+	if stopped {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	if replaced {
+		// The handle was interrupted by a restart, the next read uses the new one
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	}
+	if capture.errors++; capture.errors < captureFailoverErrors {
+		return data, info, err
+	}
+	logger.warnf("Capture on %v failed: %v", capture.activeInterface(), err)
+	capture.errors = 0
+	captureFailovers.Add(1)
+	for err := capture.failover(); err != nil; err = capture.failover() {
+		if capture.isStopped() {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		logger.warnf("%v, retrying in %v", err, captureRetryDelay)
+		capture.status.set(healthFailed, err.Error())
+		time.Sleep(captureRetryDelay)
+	}
+	capture.status.set(healthOK, "")
+	return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+}
+
+// SetBPFFilter installs filter on the active handle, the handles opened by a failover getting it from the configuration
+func (capture *failoverCapture) SetBPFFilter(filter string) error {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	if setter, ok := capture.handle.(bpfSetter); ok {
+		return setter.SetBPFFilter(filter)
+	}
+	return nil
+}
+
+// setBPFProgram installs program on the active handle of an afpacket capture
+func (capture *failoverCapture) setBPFProgram(program []bpfInstruction) error {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	if setter, ok := capture.handle.(transport.ProgramSetter); ok {
+		return setter.SetBPFProgram(program)
+	}
+	return nil
+}
+
+// WritePacketData injects data through the active interface
+func (capture *failoverCapture) WritePacketData(data []byte) error {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	return capture.handle.WritePacketData(data)
+}
+
+func (capture *failoverCapture) isStopped() bool {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	return capture.stopped
+}
+
+// stop makes the reads return io.EOF once the read in progress returns, the handle being kept open for the
+// frames still to be injected
+func (capture *failoverCapture) stop() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if capture.stopped {
+		return
+	}
+	capture.stopped = true
+	// Reads which would block until the next frame, such as the ones of sockets, are interrupted
+	if stopper, ok := capture.handle.(transport.Stopper); ok {
+		stopper.Stop()
+	}
+}
+
+// Close closes the active handle, which leaves the promiscuous mode of its interface
+func (capture *failoverCapture) Close() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if closer, ok := capture.handle.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
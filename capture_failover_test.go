@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// mockCapture returns err on every read, and records the injected frames
+type mockCapture struct {
+	err    error
+	frames [][]byte
+	closed bool
+}
+
+func (capture *mockCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return []byte{1}, gopacket.CaptureInfo{}, capture.err
+}
+
+func (capture *mockCapture) WritePacketData(data []byte) error {
+	capture.frames = append(capture.frames, data)
+	return nil
+}
+
+func (capture *mockCapture) Close() {
+	capture.closed = true
+}
+
+func TestFailoverCapture(t *testing.T) {
+	handles := map[string]*mockCapture{
+		"eth1": &mockCapture{err: errors.New("the interface went down")},
+		"eth2": &mockCapture{},
+	}
+	var opened []string
+	open := func(intf string) (captureHandle, error) {
+		opened = append(opened, intf)
+		if handle, ok := handles[intf]; ok {
+			return handle, nil
+		}
+		return nil, errors.New("no such device")
+	}
+
+	capture, err := newFailoverCapture([]string{"br-lan", "eth1", "eth2"}, open)
+	if err != nil || capture.activeInterface() != "eth1" || captureInterface.Value() != "eth1" {
+		t.Fatalf("Error in newFailoverCapture(): the first interface which can be opened should be active, got %v", err)
+	}
+	for i := 1; i < captureFailoverErrors; i++ {
+		if _, _, err := capture.ReadPacketData(); err == nil || capture.activeInterface() != "eth1" {
+			t.Fatalf("Error in ReadPacketData(): failed over after %v errors", i)
+		}
+	}
+	if _, _, err := capture.ReadPacketData(); err != pcap.NextErrorTimeoutExpired || capture.activeInterface() != "eth2" || !handles["eth1"].closed {
+		t.Errorf("Error in ReadPacketData(): should fail over to the next interface, got %v on %v", err, capture.activeInterface())
+	}
+	if data, _, err := capture.ReadPacketData(); err != nil || len(data) != 1 {
+		t.Errorf("Error in ReadPacketData(): got %v %v", data, err)
+	}
+	capture.WritePacketData([]byte{2})
+	if len(handles["eth2"].frames) != 1 {
+		t.Error("Error in WritePacketData(): frames should be injected through the active interface")
+	}
+	if expected := []string{"br-lan", "eth1", "eth2"}; !reflect.DeepEqual(opened, expected) {
+		t.Errorf("Error in failover(): unexpected attempts %v", opened)
+	}
+
+	if _, err := newFailoverCapture([]string{"br-lan"}, open); err == nil {
+		t.Error("Error in newFailoverCapture(): should fail when no interface can be opened")
+	}
+}
+
+// blockingCapture blocks its reads until stopped, which then return io.EOF like the reads of a closed socket
+type blockingCapture struct {
+	mockCapture
+	reading chan struct{}
+	stopped chan struct{}
+}
+
+func (capture *blockingCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	close(capture.reading)
+	<-capture.stopped
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (capture *blockingCapture) Stop() {
+	close(capture.stopped)
+}
+
+func TestFailoverCaptureRestart(t *testing.T) {
+	first := &blockingCapture{reading: make(chan struct{}), stopped: make(chan struct{})}
+	handles := []captureHandle{first, &mockCapture{}}
+	open := func(intf string) (captureHandle, error) {
+		handle := handles[0]
+		handles = handles[1:]
+		return handle, nil
+	}
+	capture, err := newFailoverCapture([]string{"eth1"}, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart interrupts the read blocked on the previous handle, which must not end the capture
+	errs := make(chan error)
+	go func() {
+		_, _, err := capture.ReadPacketData()
+		errs <- err
+	}()
+	<-first.reading
+	if err := capture.restart(); err != nil {
+		t.Fatalf("Error in restart(): %v", err)
+	}
+	if err := <-errs; err != pcap.NextErrorTimeoutExpired {
+		t.Errorf("Error in ReadPacketData(): expected a timeout after a restart, got %v", err)
+	}
+	if data, _, err := capture.ReadPacketData(); err != nil || len(data) != 1 || capture.errors != 0 {
+		t.Errorf("Error in ReadPacketData(): expected to read from the new handle, got %v %v", data, err)
+	}
+}
+
+func TestCaptureInterfaces(t *testing.T) {
+	cfg, err := parseConfig(`net_interfaces = ["br-lan", "eth1"]`)
+	if err != nil || cfg.NetInterface != "br-lan" || len(cfg.captureInterfaces()) != 2 {
+		t.Errorf("Error in parseConfig(): got %v %v", cfg.captureInterfaces(), err)
+	}
+	if _, err := parseConfig("net_interface = \"eth0\"\nnet_interfaces = [\"eth1\"]"); err == nil {
+		t.Error("Error in parseConfig(): net_interface and net_interfaces should be exclusive")
+	}
+	cfg, _ = parseConfig(`net_interface = "eth0"`)
+	if interfaces := cfg.captureInterfaces(); len(interfaces) != 1 || interfaces[0] != "eth0" {
+		t.Errorf("Error in captureInterfaces(): got %v", interfaces)
+	}
+}
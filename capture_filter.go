@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Multicast groups of mDNS (RFC 6762, section 3)
+var mdnsGroups = []passthroughGroup{
+	{ip: net.ParseIP("224.0.0.251"), port: 5353},
+	{ip: net.ParseIP("ff02::fb"), port: 5353},
+}
+
+// captureRules describe the traffic relevant to the configuration, from which the kernel filters of the capture
+// modes are generated: the frames of the VLANs sent to one of the groups, or the unicast responses sent from port 5353
+type captureRules struct {
+	groups           []passthroughGroup
+	unicastResponses bool
+	// vlans lists the VLANs captured, every VLAN being captured when empty
+	vlans []uint16
+}
+
+func newCaptureRules(cfg *brconfig) captureRules {
+	rules := captureRules{groups: append(mdnsGroups[:len(mdnsGroups):len(mdnsGroups)], cfg.passthrough...)}
+	if cfg.SSDPReflection {
+		rules.groups = append(rules.groups, ssdpGroups...)
+	}
+	if cfg.WSDReflection {
+		rules.groups = append(rules.groups, wsdGroups...)
+	}
+	if cfg.NATPMPReflection {
+		rules.groups = append(rules.groups, natpmpGroups...)
+	}
+	// The unicast responses to legacy queries are sent to the port of the querier, and the ones to QU questions to 5353
+	rules.unicastResponses = cfg.relaysLegacyResponses() || cfg.conformance.unicastResponses
+	// Unknown devices of any VLAN have to be seen
+	if _, ok := cfg.emptyDevicesOverride(); cfg.UnknownDeviceMode == unknownDrop && !ok {
+		rules.vlans = cfg.configuredVLANs()
+	}
+	return rules
+}
+
+// expression returns the rules as a pcap filter expression
+func (rules captureRules) expression() string {
+	clauses := strings.TrimPrefix(passthroughFilter(rules.groups), " or ")
+	if rules.unicastResponses {
+		clauses += " or (udp src port 5353 and not dst net 224.0.0.0/4 and not dst net ff00::/8)"
+	}
+	filter := fmt.Sprintf("vlan and (%s)", clauses)
+	if len(rules.vlans) == 0 {
+		return filter
+	}
+	// ether[14:2] is the tag control information of the 802.1Q header. Unlike the "vlan <id>" primitive,
+	// it can be combined with "or" without shifting the offsets of the following primitives.
+	conditions := make([]string, len(rules.vlans))
+	for i, vlan := range rules.vlans {
+		conditions[i] = fmt.Sprintf("ether[14:2] & 0x0fff = %d", vlan)
+	}
+	return fmt.Sprintf("%s and (%s)", filter, strings.Join(conditions, " or "))
+}
+
+// buildCaptureFilter returns the pcap filter capturing the traffic relevant to the configuration, so that the
+// traffic of the other VLANs, protocols and destinations is dropped by the kernel rather than parsed in userspace
+func buildCaptureFilter(cfg *brconfig) string {
+	return newCaptureRules(cfg).expression()
+}
+
+type bpfSetter interface {
+	SetBPFFilter(filter string) error
+}
+
+// bpfProgramSetter is implemented by the afpacket captures, filtered by a BPF program generated from the rules
+// rather than compiled by libpcap, which ignores the VLAN tags stripped by the NIC
+type bpfProgramSetter interface {
+	setBPFProgram(program []bpfInstruction) error
+}
+
+// captureFilter keeps the kernel filter of the capture handle in line with the configuration.
+// Installing a filter on a live handle is atomic, so no packet is lost while the filter changes.
+type captureFilter struct {
+	mutex   sync.Mutex
+	handle  bpfSetter
+	current string
+}
+
+// update installs the filter built from cfg, unless it is already installed
+func (filter *captureFilter) update(cfg *brconfig) error {
+	rules := newCaptureRules(cfg)
+	expression := rules.expression()
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	if expression == filter.current {
+		return nil
+	}
+	var err error
+	if setter, ok := filter.handle.(bpfProgramSetter); ok && cfg.CaptureMode == captureAFPacket {
+		err = setter.setBPFProgram(rules.program())
+	} else {
+		err = filter.handle.SetBPFFilter(expression)
+	}
+	if err != nil {
+		return err
+	}
+	filter.current = expression
+	logger.infof("Capture filter installed: %v", expression)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+// mockBPFSetter records the filters installed on a capture handle
+type mockBPFSetter struct {
+	filters []string
+}
+
+func (setter *mockBPFSetter) SetBPFFilter(filter string) error {
+	setter.filters = append(setter.filters, filter)
+	return nil
+}
+
+func TestBuildCaptureFilter(t *testing.T) {
+	cfg, _ := parseConfig(`
+		[conformance]
+		unicast_responses = false
+		[devices."AA:BB:CC:DD:EE:FF"]
+		origin_pool = 1078
+		shared_pools = [1234]
+	`)
+	mdns := "(dst host 224.0.0.251 and udp dst port 5353) or (dst host ff02::fb and udp dst port 5353)"
+	expected := "vlan and (" + mdns + ") and (ether[14:2] & 0x0fff = 1078 or ether[14:2] & 0x0fff = 1234)"
+	if filter := buildCaptureFilter(&cfg); filter != expected {
+		t.Errorf("Error in buildCaptureFilter(): got %q", filter)
+	}
+
+	cfg.UnknownDeviceMode = unknownLogAndDrop
+	if filter := buildCaptureFilter(&cfg); filter != "vlan and ("+mdns+")" {
+		t.Errorf("Error in buildCaptureFilter(): unknown devices of every VLAN should be captured, got %q", filter)
+	}
+
+	cfg.LegacyQueries = legacyRelay
+	expected = "vlan and (" + mdns + " or (udp src port 5353 and not dst net 224.0.0.0/4 and not dst net ff00::/8))"
+	if filter := buildCaptureFilter(&cfg); filter != expected {
+		t.Errorf("Error in buildCaptureFilter(): unicast responses to legacy queries should be captured, got %q", filter)
+	}
+}
+
+func TestCaptureFilterUpdate(t *testing.T) {
+	setter := &mockBPFSetter{}
+	filter := &captureFilter{handle: setter}
+	cfg, _ := parseConfig(`
+		[devices."AA:BB:CC:DD:EE:FF"]
+		origin_pool = 1078
+		shared_pools = [1234]
+	`)
+
+	filter.update(&cfg)
+	filter.update(&cfg)
+	if len(setter.filters) != 1 {
+		t.Errorf("Error in update(): unchanged filter installed %v times", len(setter.filters))
+	}
+	cfg.Devices["AA:00:CC:00:EE:00"] = bonjourDevice{OriginPool: 2483, SharedPools: []uint16{1234}}
+	filter.update(&cfg)
+	if len(setter.filters) != 2 || filter.current != setter.filters[1] {
+		t.Error("Error in update(): changed filter not installed")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Range of the VLAN IDs usable on a trunk, 0 and 4095 being reserved by 802.1Q
+const (
+	minVLANID = 1
+	maxVLANID = 4094
+)
+
+var checkCommand = &command{
+	name:    "check",
+	summary: "Validate a configuration file, e.g. in CI before deploying it",
+	setup:   setupCheckCommand,
+}
+
+// configReport lists the problems found in a configuration file: errors make the check fail, warnings do not
+type configReport struct {
+	Path     string   `json:"path"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (report *configReport) errorf(format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+func (report *configReport) warnf(format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+}
+
+// setupCheckCommand checks a configuration file, exiting with the code of configuration errors when it has any
+func setupCheckCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+	format := flags.String("format", "", "Format of the config file: toml, yaml or json (default from its extension)")
+	skipInterfaces := flags.Bool("skip-interfaces", false, "Do not check that the network interfaces exist, e.g. when checking on another host than the reflector")
+
+	return func(out *commandOutput, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: check [-profile name] [-format toml|yaml|json] [-skip-interfaces] <config.toml>")
+		}
+		exists := interfaceExists
+		if *skipInterfaces {
+			exists = nil
+		}
+		report := checkConfigFile(args[0], *profile, *format, exists)
+		if err := out.print(report, func(w io.Writer) { printConfigReport(w, report) }); err != nil {
+			return err
+		}
+		if len(report.Errors) > 0 {
+			return configError(fmt.Errorf("%v has %d error(s)", args[0], len(report.Errors)))
+		}
+		return nil
+	}
+}
+
+// checkConfigFile validates the configuration file at path, with profile unless empty and in format unless empty, like the reflector does when it
+// starts, which rejects the invalid MAC addresses of the devices, then checks the VLAN IDs and, unless exists is nil, the network interfaces
+func checkConfigFile(path, profile, format string, exists func(intf string) bool) configReport {
+	report := configReport{Path: path, Errors: []string{}, Warnings: []string{}}
+	cfg, err := readProfileAs(path, profile, format)
+	if err != nil {
+		report.errorf("%v", err)
+		return report
+	}
+	if cfg.NATPMPReflection {
+		report.warnf("%v", natpmpWarning)
+	}
+	if warning := cfg.emptyDevicesWarning(); warning != "" {
+		report.warnf("%v", warning)
+	}
+	for _, tag := range cfg.configuredVLANs() {
+		if tag < minVLANID || tag > maxVLANID {
+			report.warnf("VLAN %v is outside of the range of VLAN IDs (%v-%v)", tag, minVLANID, maxVLANID)
+		}
+	}
+	if exists != nil {
+		checkInterfaces(&cfg, &report, exists)
+	}
+	return report
+}
+
+// checkInterfaces reports the capture and egress interfaces which do not exist on this host
+func checkInterfaces(cfg *brconfig, report *configReport, exists func(intf string) bool) {
+	interfaces := append(append([]string(nil), cfg.NetInterfaces...), cfg.TrunkInterfaces...)
+	if len(interfaces) == 0 {
+		interfaces = []string{cfg.NetInterface}
+	}
+	sort.Strings(interfaces)
+	for _, intf := range interfaces {
+		if intf == "" {
+			report.errorf("net_interface is not set")
+		} else if !exists(intf) {
+			report.errorf("network interface %q does not exist", intf)
+		}
+	}
+	var egress []string
+	for tag, vlan := range cfg.egress {
+		if vlan.Interface != "" && !exists(vlan.Interface) {
+			egress = append(egress, fmt.Sprintf("egress interface %q of VLAN %v does not exist", vlan.Interface, tag))
+		}
+	}
+	sort.Strings(egress)
+	for _, message := range egress {
+		report.errorf("%v", message)
+	}
+}
+
+func printConfigReport(w io.Writer, report configReport) {
+	for _, message := range report.Errors {
+		fmt.Fprintf(w, "error: %v\n", message)
+	}
+	for _, message := range report.Warnings {
+		fmt.Fprintf(w, "warning: %v\n", message)
+	}
+	if len(report.Errors) == 0 {
+		fmt.Fprintf(w, "%v is valid (%d warning(s))\n", report.Path, len(report.Warnings))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTempConfig(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	path := writeTempConfig(t, `
+		net_interfaces = ["eth0", "eth9"]
+		[devices."aa:bb:cc:dd:ee:ff"]
+		origin_pool = 10
+		shared_pools = [20, 4095]
+		allowed_queriers = ["11:22:33:44:55:66"]
+		[devices."00:11:22:33:44:AA"]
+		origin_pool = 10
+	`)
+	defer os.Remove(path)
+
+	report := checkConfigFile(path, "", "", func(intf string) bool { return intf == "eth0" })
+	expected := configReport{
+		Path:     path,
+		Errors:   []string{`network interface "eth9" does not exist`},
+		Warnings: []string{"VLAN 4095 is outside of the range of VLAN IDs (1-4094)"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Error in checkConfigFile(): expected %+v, got %+v", expected, report)
+	}
+
+	if report := checkConfigFile(path, "", "", nil); len(report.Errors) != 0 {
+		t.Errorf("Error in checkConfigFile(): interfaces should not be checked without exists, got %v", report.Errors)
+	}
+	if report := checkConfigFile("/nonexistent.toml", "", "", nil); len(report.Errors) != 1 {
+		t.Errorf("Error in checkConfigFile(): expected an error for a missing file, got %+v", report)
+	}
+
+	invalid := writeTempConfig(t, `
+		[devices."aa:bb:cc:dd:ee:ff"]
+		origin_pool = 10
+		[devices."AA-BB-CC-DD-EE-FF"]
+		origin_pool = 10
+	`)
+	defer os.Remove(invalid)
+	expected = configReport{
+		Path:     invalid,
+		Errors:   []string{`devices "AA-BB-CC-DD-EE-FF" and "aa:bb:cc:dd:ee:ff" are the same device`},
+		Warnings: []string{},
+	}
+	if report := checkConfigFile(invalid, "", "", nil); !reflect.DeepEqual(report, expected) {
+		t.Errorf("Error in checkConfigFile(): expected %+v, got %+v", expected, report)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	valid := writeTempConfig(t, `
+		[devices."aa:bb:cc:dd:ee:ff"]
+		origin_pool = 10
+		shared_pools = [20]
+	`)
+	defer os.Remove(valid)
+	var stdout, stderr bytes.Buffer
+	if code := runCommandLine([]string{"check", "-skip-interfaces", valid}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "is valid") {
+		t.Errorf("Error in runCommandLine(): check of a valid configuration exited with code %v (%q)", code, stdout.String())
+	}
+
+	invalid := writeTempConfig(t, `unknown_device_mode = "maybe"`)
+	defer os.Remove(invalid)
+	stdout.Reset()
+	if code := runCommandLine([]string{"check", "-skip-interfaces", invalid}, &stdout, &stderr); code != exitConfigError || !strings.Contains(stdout.String(), "error: invalid unknown_device_mode") {
+		t.Errorf("Error in runCommandLine(): check of an invalid configuration exited with code %v (%q)", code, stdout.String())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+const (
+	// Delay between two comparisons of the wall and monotonic clocks
+	clockCheckInterval = 10 * time.Second
+	// Difference between the time elapsed on the wall and monotonic clocks above which the wall clock jumped
+	clockJumpThreshold = 2 * time.Second
+)
+
+// Steps of the wall clock, exposed on /debug/vars: their count, and the size of the last one in seconds
+var clockStats = expvar.NewMap("clock")
+
+// clockMonitor detects the steps of the wall clock, such as NTP corrections on routers without a battery-backed
+// clock. The expiries of the records are measured with the monotonic clock, and are not affected, but the times
+// reported by the API and the debug endpoints are shifted.
+type clockMonitor struct {
+	last time.Time
+}
+
+// observe compares the time elapsed since the previous observation on both clocks, and returns the jump of the
+// wall clock, if any
+func (monitor *clockMonitor) observe(now time.Time) time.Duration {
+	if monitor.last.IsZero() {
+		monitor.last = now
+		return 0
+	}
+	// Round(0) strips the monotonic clock reading, leaving the wall clock
+	wall, monotonic := now.Round(0).Sub(monitor.last.Round(0)), now.Sub(monitor.last)
+	monitor.last = now
+	return monitor.record(wall, monotonic)
+}
+
+func (monitor *clockMonitor) record(wall, monotonic time.Duration) time.Duration {
+	jump := wall - monotonic
+	if jump > -clockJumpThreshold && jump < clockJumpThreshold {
+		return 0
+	}
+	clockStats.Add("jumps", 1)
+	lastJump := new(expvar.Float)
+	lastJump.Set(jump.Seconds())
+	clockStats.Set("last_jump_seconds", lastJump)
+	logger.warnf("The wall clock jumped by %v, the records expire on time but the reported times moved", jump)
+	return jump
+}
+
+// watchClock observes the clocks every interval
+func watchClock(interval time.Duration) {
+	var monitor clockMonitor
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		monitor.observe(now)
+	}
+}
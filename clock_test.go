@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockMonitor(t *testing.T) {
+	var monitor clockMonitor
+	now := time.Now()
+	if monitor.observe(now) != 0 || monitor.observe(now.Add(clockCheckInterval)) != 0 {
+		t.Error("Error in observe(): no jump expected while both clocks advance together")
+	}
+	// NTP stepped the wall clock a minute forward during the interval
+	if jump := monitor.record(clockCheckInterval+time.Minute, clockCheckInterval); jump != time.Minute {
+		t.Errorf("Error in record(): expected a jump of a minute, got %v", jump)
+	}
+	if jump := monitor.record(clockCheckInterval-time.Hour, clockCheckInterval); jump != -time.Hour {
+		t.Errorf("Error in record(): expected a jump of an hour back, got %v", jump)
+	}
+	if jump := monitor.record(clockCheckInterval+time.Second, clockCheckInterval); jump != 0 {
+		t.Errorf("Error in record(): expected drifts below the threshold to be ignored, got %v", jump)
+	}
+	if clockStats.Get("jumps").String() == "0" {
+		t.Error("Error in record(): jumps not counted")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// command is a subcommand of the bonjour-reflector binary
+type command struct {
+	name    string
+	summary string
+	// setup registers the flags of the command, and returns the function running it
+	setup func(flags *flag.FlagSet) func(out *commandOutput, args []string) error
+}
+
+// commandOutput writes the result of a command, either for humans or as JSON (with the --json flag)
+type commandOutput struct {
+	json bool
+	w    io.Writer
+}
+
+// print writes v as JSON, or calls text to format it for humans
+func (out *commandOutput) print(v interface{}, text func(w io.Writer)) error {
+	if out.json {
+		encoder := json.NewEncoder(out.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	text(out.w)
+	return nil
+}
+
+// Name of the command run when the binary is called without any subcommand
+const defaultCommand = "run"
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		runCommand,
+		containerCommand,
+		rulesCommand,
+		statsCommand,
+		drainCommand,
+		traceCommand,
+		explainCommand,
+		approveCommand,
+		interfacesCommand,
+		browseCommand,
+		telemetryCommand,
+		replayCommand,
+		countersCommand,
+		suggestCommand,
+		noiseCommand,
+		diffCommand,
+		checkCommand,
+		&command{
+			name:    "completion",
+			summary: "Generate a shell completion script (bash or zsh)",
+			setup:   setupCompletionCommand,
+		},
+		&command{
+			name:    "help",
+			summary: "List the available commands",
+			setup:   setupHelpCommand,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns the flags of cmd, including the --json flag shared by every command
+func (cmd *command) newFlagSet(out *commandOutput) (*flag.FlagSet, func(*commandOutput, []string) error) {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.BoolVar(&out.json, "json", false, "Write machine-readable JSON output")
+	run := cmd.setup(flags)
+	return flags, run
+}
+
+// runCommandLine parses args (without the program name), and runs the selected command
+func runCommandLine(args []string, stdout, stderr io.Writer) int {
+	// Calling the binary with flags only runs the reflector, as before subcommands existed
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n", name)
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	out := &commandOutput{w: stdout}
+	flags, run := cmd.newFlagSet(out)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return exitUsage
+	}
+	if err := run(out, flags.Args()); err != nil {
+		if out.json {
+			json.NewEncoder(stderr).Encode(map[string]string{"error": err.Error(), "kind": errorKind(err)})
+		} else {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+		}
+		return exitCode(err)
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: bonjour-reflector <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun 'bonjour-reflector <command> -h' for the flags of a command.\n")
+}
+
+func setupHelpCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	return func(out *commandOutput, args []string) error {
+		type commandSummary struct {
+			Name    string `json:"name"`
+			Summary string `json:"summary"`
+		}
+		var summaries []commandSummary
+		for _, cmd := range commands {
+			summaries = append(summaries, commandSummary{cmd.name, cmd.summary})
+		}
+		return out.print(summaries, printUsage)
+	}
+}
+
+// commandFlags returns the flags of every command, keyed by command name
+func commandFlags() map[string][]string {
+	result := make(map[string][]string)
+	for _, cmd := range commands {
+		flags, _ := cmd.newFlagSet(&commandOutput{})
+		flags.VisitAll(func(f *flag.Flag) {
+			result[cmd.name] = append(result[cmd.name], "--"+f.Name)
+		})
+		sort.Strings(result[cmd.name])
+	}
+	return result
+}
+
+var completionTemplate = template.Must(template.New("completion").Parse(`{{if .Zsh}}autoload -U +X bashcompinit && bashcompinit
+{{end}}_bonjour_reflector() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "{{.Commands}}" -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+{{- range $name, $flags := .Flags}}
+        {{$name}}) COMPREPLY=($(compgen -W "{{$flags}}" -- "$cur")) ;;
+{{- end}}
+    esac
+}
+complete -o default -F _bonjour_reflector bonjour-reflector
+`))
+
+func setupCompletionCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	return func(out *commandOutput, args []string) error {
+		if len(args) != 1 || (args[0] != "bash" && args[0] != "zsh") {
+			return fmt.Errorf("expected the shell to generate a completion script for: bash or zsh")
+		}
+		var names []string
+		for _, cmd := range commands {
+			names = append(names, cmd.name)
+		}
+		joinedFlags := make(map[string]string)
+		for name, cmdFlags := range commandFlags() {
+			joinedFlags[name] = strings.Join(cmdFlags, " ")
+		}
+		return completionTemplate.Execute(out.w, map[string]interface{}{
+			"Zsh":      args[0] == "zsh",
+			"Commands": strings.Join(names, " "),
+			"Flags":    joinedFlags,
+		})
+	}
+}
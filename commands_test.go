@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunCommandLineHelp(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommandLine([]string{"help"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in runCommandLine(): help exited with code %v", code)
+	}
+	for _, cmd := range commands {
+		if !strings.Contains(stdout.String(), cmd.name) {
+			t.Errorf("Error in runCommandLine(): help does not list command %v", cmd.name)
+		}
+	}
+
+	stdout.Reset()
+	if code := runCommandLine([]string{"help", "--json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in runCommandLine(): help --json exited with code %v", code)
+	}
+	var summaries []map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &summaries); err != nil || len(summaries) != len(commands) {
+		t.Errorf("Error in runCommandLine(): help --json should print the commands as JSON, got %q", stdout.String())
+	}
+}
+
+func TestRunCommandLineErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommandLine([]string{"unknown"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Error in runCommandLine(): unknown command exited with code %v", code)
+	}
+
+	// Flags without a command run the reflector, which fails on a missing configuration file
+	stderr.Reset()
+	if code := runCommandLine([]string{"-config", "/nonexistent.toml", "--json"}, &stdout, &stderr); code != exitConfigError {
+		t.Errorf("Error in runCommandLine(): missing configuration exited with code %v", code)
+	}
+	var result map[string]string
+	if err := json.Unmarshal(stderr.Bytes(), &result); err != nil || result["error"] == "" || result["kind"] != "config" {
+		t.Errorf("Error in runCommandLine(): errors should be written as JSON, got %q", stderr.String())
+	}
+}
+
+func TestCompletionCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommandLine([]string{"completion", "bash"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in runCommandLine(): completion exited with code %v", code)
+	}
+	script := stdout.String()
+	for _, expected := range []string{"complete -o default -F _bonjour_reflector", "rules) COMPREPLY", "--unused-for", "--json"} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Error in completion: script does not contain %q", expected)
+		}
+	}
+
+	if code := runCommandLine([]string{"completion", "fish"}, &stdout, &stderr); code != 1 {
+		t.Errorf("Error in runCommandLine(): unsupported shell exited with code %v", code)
+	}
+}
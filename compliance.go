@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Maximal number of refused (device, VLAN) pairs remembered to log each of them only once
+const maxRefusedFlows = 4096
+
+// Reflections refused between incompatible compliance domains, per "from -> to" flow, exposed on /debug/vars
+var complianceRefused = expvar.NewMap("compliance_refused")
+
+type complianceConfig struct {
+	// AllowedFlows lists the flows allowed between different domains, such as "corporate -> guest" or "* -> guest"
+	AllowedFlows []string `toml:"allowed_flows"`
+}
+
+// domainFlow is the reflection of traffic from a compliance domain into another one
+type domainFlow struct {
+	from, to string
+}
+
+func (flow domainFlow) String() string {
+	return fmt.Sprintf("%v -> %v", domainName(flow.from), domainName(flow.to))
+}
+
+// domainName returns the name of a domain in the logs, unlabelled VLANs and devices being in no domain
+func domainName(domain string) string {
+	if domain == "" {
+		return "(none)"
+	}
+	return domain
+}
+
+func parseDomainFlows(entries []string) (map[domainFlow]bool, error) {
+	flows := make(map[domainFlow]bool)
+	for _, entry := range entries {
+		parts := strings.Split(entry, "->")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid allowed flow %q in compliance section, expected \"from -> to\"", entry)
+		}
+		flows[domainFlow{from: strings.TrimSpace(parts[0]), to: strings.TrimSpace(parts[1])}] = true
+	}
+	return flows, nil
+}
+
+// vlanDomain returns the compliance domain of a VLAN
+func (cfg *brconfig) vlanDomain(tag uint16) string {
+	return cfg.vlans[tag].Domain
+}
+
+// sourceDomain returns the compliance domain of the traffic of a host: the domain of its device entry, or else of its VLAN
+func (cfg *brconfig) sourceDomain(mac macAddress, tag uint16) string {
+	if _, device, ok := cfg.device(mac); ok && device.Domain != "" {
+		return device.Domain
+	}
+	return cfg.vlanDomain(tag)
+}
+
+// allowsFlow tells whether traffic of the domain from may be reflected into the domain to.
+// Traffic stays within its domain, unless the flow is explicitly allowed: unlabelled VLANs and devices
+// form a domain of their own, only matched by "*", so that labelled traffic never leaks to them by omission.
+func (cfg *brconfig) allowsFlow(from, to string) bool {
+	return from == to || cfg.flows[domainFlow{from: from, to: to}] ||
+		cfg.flows[domainFlow{from: "*", to: to}] || cfg.flows[domainFlow{from: from, to: "*"}]
+}
+
+// checkDomains refuses the device entries and default pools reflecting traffic between incompatible domains
+func (cfg *brconfig) checkDomains() error {
+	for mac, device := range cfg.Devices {
+		from := cfg.sourceDomain(mac, device.OriginPool)
+		for _, pool := range device.SharedPools {
+			if to := cfg.vlanDomain(pool); !cfg.allowsFlow(from, to) {
+				return fmt.Errorf("device %v cannot be shared with VLAN %v: flow %v is not allowed", mac, pool, domainFlow{from: from, to: to})
+			}
+		}
+	}
+	for tag, vlan := range cfg.vlans {
+		for _, pool := range vlan.DefaultPool {
+			if !cfg.allowsFlow(vlan.Domain, cfg.vlanDomain(pool)) {
+				return fmt.Errorf("invalid default_pool of VLAN %v: flow %v is not allowed", tag, domainFlow{from: vlan.Domain, to: cfg.vlanDomain(pool)})
+			}
+		}
+	}
+	return nil
+}
+
+// complianceGuard refuses at runtime the reflections between incompatible domains which the configuration cannot rule out,
+// such as those of unknown devices or of queriers, and logs them
+type complianceGuard struct {
+	mutex   sync.Mutex
+	refused map[string]bool
+}
+
+func newComplianceGuard() *complianceGuard {
+	return &complianceGuard{refused: make(map[string]bool)}
+}
+
+// filter returns the tags into which the traffic of bonjourPacket may be reflected.
+// Queries only ask for the answers flowing back, so they are allowed by the flows of either direction.
+func (guard *complianceGuard) filter(cfg *brconfig, bonjourPacket *bonjourPacket, tags []uint16) []uint16 {
+	srcMAC := macAddress(bonjourPacket.srcMAC.String())
+	from := cfg.sourceDomain(srcMAC, *bonjourPacket.vlanTag)
+	isQuery := bonjourPacket.isDNSQuery || (bonjourPacket.ssdp != nil && bonjourPacket.ssdp.isSearch()) ||
+		(bonjourPacket.wsd != nil && bonjourPacket.wsd.isSearch())
+	var allowed []uint16
+	for _, tag := range tags {
+		flow := domainFlow{from: from, to: cfg.vlanDomain(tag)}
+		if cfg.allowsFlow(flow.from, flow.to) || (isQuery && cfg.allowsFlow(flow.to, flow.from)) {
+			allowed = append(allowed, tag)
+			continue
+		}
+		complianceRefused.Add(flow.String(), 1)
+		guard.log(srcMAC, *bonjourPacket.vlanTag, tag, flow)
+	}
+	return allowed
+}
+
+// log logs the refused reflections of a host into a VLAN the first time they happen
+func (guard *complianceGuard) log(mac macAddress, srcVLAN, tag uint16, flow domainFlow) {
+	key := fmt.Sprintf("%v/%v", mac, tag)
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	if guard.refused[key] {
+		return
+	}
+	if len(guard.refused) >= maxRefusedFlows {
+		guard.refused = make(map[string]bool)
+	}
+	guard.refused[key] = true
+	logger.warnf("Refused reflection of %v on VLAN %v into VLAN %v: flow %v is not allowed", mac, srcVLAN, tag, flow)
+}
+
+// compliancePolicy is the declared data-flow policy, served on /debug/compliance for audits
+type compliancePolicy struct {
+	VLANs        map[uint16]string     `json:"vlans"`
+	Devices      map[macAddress]string `json:"devices"`
+	AllowedFlows []string              `json:"allowed_flows"`
+}
+
+type complianceHandler struct {
+	reflector *reflector
+}
+
+func (handler complianceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.reflector.configMutex.RLock()
+	cfg := &handler.reflector.cfg
+	policy := compliancePolicy{VLANs: make(map[uint16]string), Devices: make(map[macAddress]string), AllowedFlows: []string{}}
+	for tag, vlan := range cfg.vlans {
+		if vlan.Domain != "" {
+			policy.VLANs[tag] = vlan.Domain
+		}
+	}
+	for mac, device := range cfg.Devices {
+		if device.Domain != "" {
+			policy.Devices[mac] = device.Domain
+		}
+	}
+	for flow := range cfg.flows {
+		policy.AllowedFlows = append(policy.AllowedFlows, flow.String())
+	}
+	handler.reflector.configMutex.RUnlock()
+	sort.Strings(policy.AllowedFlows)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	// Keep the flows readable, as "corporate -> guest" rather than "corporate -\u003e guest"
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(policy)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckDomains(t *testing.T) {
+	devices := `
+		[vlans."42"]
+		domain = "corporate"
+		[vlans."43"]
+		domain = "guest"
+		[devices."00:14:22:01:23:45"]
+		origin_pool = 42
+		shared_pools = [43]`
+	if _, err := parseConfig(devices); err == nil || !strings.Contains(err.Error(), "corporate -> guest") {
+		t.Errorf("Error in checkDomains(): expected the flow to be refused, got %v", err)
+	}
+	if _, err := parseConfig("[compliance]\nallowed_flows = [\"corporate -> guest\"]\n" + devices); err != nil {
+		t.Errorf("Error in checkDomains(): expected the flow to be allowed, got %v", err)
+	}
+	if _, err := parseConfig("[compliance]\nallowed_flows = [\"* -> guest\"]\n" + devices + "\ndomain = \"pci\""); err != nil {
+		t.Errorf("Error in checkDomains(): expected the wildcard to allow the flow of the device domain, got %v", err)
+	}
+	if _, err := parseConfig("[compliance]\nallowed_flows = [\"corporate guest\"]"); err == nil {
+		t.Error("Error in parseDomainFlows(): expected an error for an invalid flow")
+	}
+	if _, err := parseConfig(`
+		[vlans."42"]
+		domain = "pci"
+		default_pool = [43]`); err == nil {
+		t.Error("Error in checkDomains(): expected the default pool of a labelled VLAN to be refused into an unlabelled one")
+	}
+}
+
+func TestComplianceGuard(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`
+		unknown_device_mode = "reflect-to-default-pool"
+		default_pool = [42, 43]
+		[compliance]
+		allowed_flows = ["corporate -> guest"]
+		[vlans."42"]
+		domain = "corporate"
+		[vlans."43"]
+		domain = "guest"
+		[vlans."%v"]
+		domain = "pci"`, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer := createMockReflector(cfg)
+
+	// Answers of an unknown device of the pci VLAN are refused everywhere
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if len(writer.frames) != 0 {
+		t.Errorf("Error in processBonjourPacket(): expected the answer to be refused, got %v", writer.vlanTags())
+	}
+
+	answer := createMockBonjourPacket(false)
+	tag := uint16(42)
+	answer.vlanTag = &tag
+	if tags := r.compliance.filter(&r.cfg, &answer, []uint16{42, 43, vlanIdentifierTest}); !reflect.DeepEqual(tags, []uint16{42, 43}) {
+		t.Errorf("Error in filter(): expected the answer to stay within the allowed flows, got %v", tags)
+	}
+	query := createMockBonjourPacket(true)
+	tag = 43
+	query.vlanTag = &tag
+	if tags := r.compliance.filter(&r.cfg, &query, []uint16{42, vlanIdentifierTest}); !reflect.DeepEqual(tags, []uint16{42}) {
+		t.Errorf("Error in filter(): expected queries to follow the flows in reverse, got %v", tags)
+	}
+
+	recorder := httptest.NewRecorder()
+	complianceHandler{r}.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/compliance", nil))
+	if !strings.Contains(recorder.Body.String(), `"allowed_flows":["corporate -> guest"]`) || !strings.Contains(recorder.Body.String(), `"43":"guest"`) {
+		t.Errorf("Error in ServeHTTP(): unexpected policy %v", recorder.Body)
+	}
+}
@@ -1,32 +1,561 @@
 package main
 
 import (
-	"io/ioutil"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type macAddress string
 
+// Default delay during which a device may answer the query of an allowed querier
+const defaultSolicitationWindow = 3 * time.Second
+
+// duration wraps time.Duration so that it can be written as "3s" or "250ms" in the configuration file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// unknownDeviceMode defines what happens to mDNS responses sent by a device
+// which is not listed in the configuration file.
+type unknownDeviceMode string
+
+const (
+	unknownDrop          unknownDeviceMode = "drop"
+	unknownLogAndDrop    unknownDeviceMode = "log-and-drop"
+	unknownReflectToPool unknownDeviceMode = "reflect-to-default-pool"
+	unknownQuarantine    unknownDeviceMode = "quarantine"
+)
+
 type brconfig struct {
-	NetInterface string                       `toml:"net_interface"`
-	Devices      map[macAddress]bonjourDevice `toml:"devices"`
+	NetInterface       string                       `toml:"net_interface"`
+	NetInterfaces      []string                     `toml:"net_interfaces"`
+	TrunkInterfaces    []string                     `toml:"trunk_interfaces"`
+	CaptureMode        string                       `toml:"capture_mode"`
+	UnknownDeviceMode  unknownDeviceMode            `toml:"unknown_device_mode"`
+	DefaultPool        []uint16                     `toml:"default_pool"`
+	EmptyDevicesMode   emptyDevicesMode             `toml:"empty_devices_mode"`
+	InventoryFile      string                       `toml:"inventory_file"`
+	InventorySize      int                          `toml:"inventory_size"`
+	OUIFile            string                       `toml:"oui_file"`
+	SolicitationWindow duration                     `toml:"solicitation_window"`
+	SubscriptionWindow duration                     `toml:"subscription_window"`
+	PanicCaptureFile   string                       `toml:"panic_capture_file"`
+	RuleHitsFile       string                       `toml:"rule_hits_file"`
+	StatsFile          string                       `toml:"stats_file"`
+	ReflectionJitter   duration                     `toml:"reflection_jitter"`
+	Passthrough        []string                     `toml:"passthrough"`
+	SSDPReflection     bool                         `toml:"ssdp_reflection"`
+	WSDReflection      bool                         `toml:"wsd_reflection"`
+	NATPMPReflection   bool                         `toml:"natpmp_reflection"`
+	AddressValidation  addressValidationMode        `toml:"address_validation"`
+	LegacyQueries      legacyQueryMode              `toml:"legacy_queries"`
+	WarmUp             duration                     `toml:"warm_up"`
+	UnicastTimeout     duration                     `toml:"unicast_timeout"`
+	UnicastTableSize   int                          `toml:"unicast_table_size"`
+	UnicastRelay       unicastRelayConfig           `toml:"unicast_relay"`
+	LoopCacheSize      int                          `toml:"loop_cache_size"`
+	LoopWindow         duration                     `toml:"loop_window"`
+	LLDPDiagnostics    bool                         `toml:"lldp_diagnostics"`
+	LearnPrefixes      bool                         `toml:"learn_prefixes"`
+	ExpectedServices   []serviceExpectation         `toml:"expected_services"`
+	Hooks              []hookConfig                 `toml:"hooks"`
+	SLOCheckInterval   duration                     `toml:"slo_check_interval"`
+	NoiseReport        duration                     `toml:"noise_report_interval"`
+	MulticastToUnicast multicastToUnicastConfig     `toml:"multicast_to_unicast"`
+	Wireless           wirelessConfig               `toml:"wireless"`
+	TTLFloors          map[string]uint32            `toml:"ttl_floors"`
+	MaxTTL             uint32                       `toml:"max_ttl"`
+	TTLCeilings        map[string]uint32            `toml:"ttl_ceilings"`
+	PriorityQueue      priorityQueueConfig          `toml:"priority_queue"`
+	Pipelines          pipelinesConfig              `toml:"pipelines"`
+	Watchdog           watchdogConfig               `toml:"watchdog"`
+	InjectionBudget    injectionBudgetConfig        `toml:"injection_budget"`
+	SourceRateLimit    sourceRateLimitConfig        `toml:"source_rate_limit"`
+	Logging            loggingConfig                `toml:"logging"`
+	Proxy              proxyConfig                  `toml:"proxy"`
+	KnownAnswers       knownAnswersConfig           `toml:"known_answers"`
+	AFPacket           afpacketConfig               `toml:"afpacket"`
+	Conformance        conformanceConfig            `toml:"conformance"`
+	Quirks             quirksConfig                 `toml:"quirks"`
+	PeerDiscovery      bool                         `toml:"peer_discovery"`
+	PeerPartitioning   bool                         `toml:"peer_partitioning"`
+	PeerMACs           []string                     `toml:"peer_macs"`
+	PolicyModule       string                       `toml:"policy_module"`
+	PolicyTimeout      duration                     `toml:"policy_timeout"`
+	APIListen          string                       `toml:"api_listen"`
+	APIInterface       string                       `toml:"api_interface"`
+	APISocket          string                       `toml:"api_socket"`
+	APIAllowedClients  []string                     `toml:"api_allowed_clients"`
+	APIToken           string                       `toml:"api_token"`
+	InstanceIDFile     string                       `toml:"instance_id_file"`
+	Telemetry          telemetryConfig              `toml:"telemetry"`
+	Compliance         complianceConfig             `toml:"compliance"`
+	Replication        replicationConfig            `toml:"replication"`
+	Privileges         privilegesConfig             `toml:"privileges"`
+	Beacon             beaconConfig                 `toml:"beacon"`
+	Egress             map[string]egressConfig      `toml:"egress"`
+	VLANs              map[string]vlanConfig        `toml:"vlans"`
+	Addresses          map[string][]string          `toml:"addresses"`
+	AddressTranslation map[string]map[string]string `toml:"address_translation"`
+	Devices            map[macAddress]bonjourDevice `toml:"devices"`
+	Profiles           map[string]toml.Primitive    `toml:"profiles"`
+
+	// vlans holds the per-VLAN settings, keyed by their parsed VLAN tag
+	vlans map[uint16]vlanConfig
+	// egress holds the egress settings, keyed by their parsed destination VLAN tag
+	egress map[uint16]egressConfig
+	// devicePrefixes holds the compiled device entries written as MAC prefixes, nil without any
+	devicePrefixes *devicePrefixes
+	// addresses holds the parsed static addresses of the reflector, keyed by VLAN tag
+	addresses map[uint16]vlanAddresses
+	// translations holds the parsed address translations, keyed by target VLAN tag
+	translations map[uint16][]addressTranslation
+	// passthrough holds the parsed groups of Passthrough
+	passthrough []passthroughGroup
+	// conformance holds the resolved protocol conformance settings
+	conformance conformance
+	// flows holds the parsed allowed flows of Compliance
+	flows map[domainFlow]bool
+	// apiClients holds the parsed networks of APIAllowedClients
+	apiClients []*net.IPNet
+	// peerMACs holds the parsed addresses of PeerMACs
+	peerMACs map[macAddress]bool
+	// path of the configuration file, where the changes made through the API are persisted
+	path string
+	// format of the configuration file, one of formatTOML, formatYAML and formatJSON
+	format string
+	// profile is the name of the profile applied over the common settings, if any
+	profile string
+	// devicesPrefix prefixes the tables of the devices in the file when they are defined by the profile
+	devicesPrefix string
+	// dryRun is set by the -dry-run flag: the reflections are logged, and no frame is injected
+	dryRun bool
+}
+
+type vlanConfig struct {
+	UnknownDeviceMode unknownDeviceMode     `toml:"unknown_device_mode"`
+	DefaultPool       []uint16              `toml:"default_pool"`
+	Subnets           []string              `toml:"subnets"`
+	AddressValidation addressValidationMode `toml:"address_validation"`
+	LegacyQueries     legacyQueryMode       `toml:"legacy_queries"`
+	Domain            string                `toml:"domain"`
+	Wireless          bool                  `toml:"wireless"`
+	Preset            string                `toml:"preset"`
+
+	// subnets holds the parsed prefixes of Subnets
+	subnets []*net.IPNet
 }
 
 type bonjourDevice struct {
-	OriginPool  uint16   `toml:"origin_pool"`
-	SharedPools []uint16 `toml:"shared_pools"`
+	OriginPool      uint16       `toml:"origin_pool" json:"origin_pool"`
+	SharedPools     []uint16     `toml:"shared_pools" json:"shared_pools"`
+	AllowedQueriers []macAddress `toml:"allowed_queriers" json:"allowed_queriers,omitempty"`
+	Domain          string       `toml:"domain" json:"domain,omitempty"`
+	AllowedServices []string     `toml:"allowed_services" json:"allowed_services,omitempty"`
 }
 
-func readConfig(path string) (cfg brconfig, err error) {
-	content, err := ioutil.ReadFile(path)
+// poolPair identifies queries sent from one VLAN to the devices of another VLAN
+type poolPair struct {
+	from, to uint16
+}
+
+// servesAPI tells whether the management API is served, on api_listen or on api_socket
+func (cfg *brconfig) servesAPI() bool {
+	return cfg.APIListen != "" || cfg.APISocket != ""
+}
+
+func readConfig(path string) (brconfig, error) {
+	return readProfile(path, "")
+}
+
+// readProfile reads the configuration at path with the settings of profile, unless empty, applied over the common ones.
+// Its format is detected from the extension of path.
+func readProfile(path, profile string) (brconfig, error) {
+	return readProfileAs(path, profile, "")
+}
+
+func parseConfig(content string) (brconfig, error) {
+	return parseProfile(content, "")
+}
+
+func parseProfile(content, profile string) (cfg brconfig, err error) {
+	md, err := toml.Decode(content, &cfg)
 	if err != nil {
 		return brconfig{}, err
 	}
-	_, err = toml.Decode(string(content), &cfg)
+	if err = cfg.applyProfile(md, profile); err != nil {
+		return brconfig{}, err
+	}
+	// Each step validates a part of the configuration, and fills in its defaults and parsed fields
+	steps := []func() error{
+		cfg.parseInterfaces,
+		cfg.setDefaults,
+		cfg.parseCapture,
+		cfg.parsePassthrough,
+		cfg.validateSections,
+		cfg.parseAPI,
+		cfg.parseDevices,
+	}
+	for _, step := range steps {
+		if err = step(); err != nil {
+			return brconfig{}, err
+		}
+	}
+	if err = cfg.parseAddresses(); err != nil {
+		return cfg, err
+	}
+	err = cfg.parseAddressTranslation()
 	return cfg, err
 }
 
+// parseInterfaces sets the interface the reflector starts on
+func (cfg *brconfig) parseInterfaces() error {
+	if len(cfg.NetInterfaces) > 0 {
+		if cfg.NetInterface != "" {
+			return fmt.Errorf("net_interface and net_interfaces cannot be both set")
+		}
+		// The first interface is the preferred one, used until it fails
+		cfg.NetInterface = cfg.NetInterfaces[0]
+	}
+	if len(cfg.TrunkInterfaces) > 0 {
+		if cfg.NetInterface != "" {
+			return fmt.Errorf("trunk_interfaces cannot be set along with net_interface or net_interfaces")
+		}
+		// The first trunk provides the MAC address of the reflector
+		cfg.NetInterface = cfg.TrunkInterfaces[0]
+	}
+	return nil
+}
+
+// setDefaults sets the durations and sizes left unset
+func (cfg *brconfig) setDefaults() error {
+	if cfg.SolicitationWindow.Duration == 0 {
+		cfg.SolicitationWindow.Duration = defaultSolicitationWindow
+	}
+	if cfg.UnicastTimeout.Duration == 0 {
+		cfg.UnicastTimeout.Duration = defaultUnicastTimeout
+	}
+	if cfg.SLOCheckInterval.Duration == 0 {
+		cfg.SLOCheckInterval.Duration = defaultSLOCheckInterval
+	}
+	if cfg.NoiseReport.Duration < 0 {
+		return fmt.Errorf("invalid noise_report_interval %v, expected a positive duration", cfg.NoiseReport.Duration)
+	}
+	if cfg.PolicyTimeout.Duration == 0 {
+		cfg.PolicyTimeout.Duration = defaultPolicyTimeout
+	}
+	if cfg.Telemetry.Interval.Duration == 0 {
+		cfg.Telemetry.Interval.Duration = defaultTelemetryInterval
+	}
+	if cfg.UnicastTableSize <= 0 {
+		cfg.UnicastTableSize = defaultUnicastTableSize
+	}
+	if cfg.InventorySize <= 0 {
+		cfg.InventorySize = defaultInventorySize
+	}
+	if cfg.Replication.Active != "" && cfg.Replication.Token == "" {
+		return fmt.Errorf("replication requires the token of the API of the active reflector")
+	}
+	if cfg.Replication.Interval.Duration <= 0 {
+		cfg.Replication.Interval.Duration = defaultReplicationInterval
+	}
+	if cfg.LoopCacheSize <= 0 {
+		cfg.LoopCacheSize = defaultLoopCacheSize
+	}
+	if cfg.LoopWindow.Duration == 0 {
+		cfg.LoopWindow.Duration = defaultLoopWindow
+	}
+	if cfg.Proxy.MaxRecords <= 0 {
+		cfg.Proxy.MaxRecords = defaultProxyMaxRecords
+	}
+	if cfg.Proxy.Backfill.Duration < 0 {
+		return fmt.Errorf("invalid backfill %v in proxy, expected a positive duration", cfg.Proxy.Backfill.Duration)
+	}
+	cfg.PriorityQueue.setDefaults()
+	cfg.Pipelines.setDefaults()
+	return nil
+}
+
+// parseCapture checks the capture mode supports the features which are enabled
+func (cfg *brconfig) parseCapture() error {
+	if cfg.CaptureMode == "" {
+		cfg.CaptureMode = capturePcap
+	}
+	if cfg.CaptureMode != capturePcap && cfg.CaptureMode != captureSocket && cfg.CaptureMode != captureAFPacket {
+		return fmt.Errorf("invalid capture_mode %q, expected %q, %q or %q", cfg.CaptureMode, capturePcap, captureSocket, captureAFPacket)
+	}
+	if err := cfg.AFPacket.validate(); err != nil {
+		return err
+	}
+	if cfg.AFPacket.RingBlocks > 0 && cfg.CaptureMode != captureAFPacket {
+		return fmt.Errorf("ring_blocks of the afpacket section requires the %q capture mode", captureAFPacket)
+	}
+	if cfg.CaptureMode == captureSocket && len(cfg.TrunkInterfaces) > 0 {
+		return fmt.Errorf("trunk_interfaces require the %q or %q capture mode", capturePcap, captureAFPacket)
+	}
+	if cfg.CaptureMode == captureSocket && (cfg.LLDPDiagnostics || cfg.LearnPrefixes || len(cfg.Passthrough) > 0 || cfg.SSDPReflection || cfg.WSDReflection || cfg.NATPMPReflection) {
+		return fmt.Errorf("lldp_diagnostics, learn_prefixes, passthrough, ssdp_reflection, wsd_reflection and natpmp_reflection require the %q capture mode", capturePcap)
+	}
+	return nil
+}
+
+// parsePassthrough parses the passthrough groups, which may not be reflected by another protocol already
+func (cfg *brconfig) parsePassthrough() (err error) {
+	if cfg.passthrough, err = parsePassthroughGroups(cfg.Passthrough); err != nil {
+		return err
+	}
+	for _, group := range cfg.passthrough {
+		if cfg.SSDPReflection && isSSDPGroup(group) {
+			return fmt.Errorf("passthrough group %v:%d is already reflected by ssdp_reflection", group.ip, group.port)
+		}
+		if cfg.WSDReflection && isWSDGroup(group) {
+			return fmt.Errorf("passthrough group %v:%d is already reflected by wsd_reflection", group.ip, group.port)
+		}
+		if cfg.NATPMPReflection && isNATPMPGroup(group) {
+			return fmt.Errorf("passthrough group %v:%d is already reflected by natpmp_reflection", group.ip, group.port)
+		}
+	}
+	return nil
+}
+
+// validateSections validates the sections which check themselves
+func (cfg *brconfig) validateSections() (err error) {
+	if !isValidDropPolicy(cfg.PriorityQueue.QueryDrop) || !isValidDropPolicy(cfg.PriorityQueue.AnswerDrop) {
+		return fmt.Errorf("invalid drop policy in priority_queue, expected %q or %q", dropNewest, dropOldest)
+	}
+	if err = validateTTLLimits(cfg.TTLFloors, cfg.MaxTTL, cfg.TTLCeilings); err != nil {
+		return err
+	}
+	if cfg.conformance, err = cfg.Conformance.resolve(); err != nil {
+		return err
+	}
+	if _, err = newHookRunner(cfg.Hooks); err != nil {
+		return err
+	}
+	if cfg.Telemetry.Enabled && cfg.Telemetry.Endpoint == "" {
+		return fmt.Errorf("endpoint is required when telemetry is enabled")
+	}
+	validators := []func() error{
+		cfg.Wireless.validate,
+		cfg.InjectionBudget.validate,
+		cfg.Logging.validate,
+		cfg.SourceRateLimit.validate,
+		cfg.Privileges.validate,
+		cfg.Beacon.validate,
+		cfg.UnicastRelay.validate,
+		cfg.Watchdog.validate,
+		cfg.Quirks.validate,
+	}
+	for _, validate := range validators {
+		if err = validate(); err != nil {
+			return err
+		}
+	}
+	// Once the privileges are dropped, the capture cannot be reopened
+	if cfg.Watchdog.CaptureTimeout.Duration > 0 && cfg.Privileges.enabled() {
+		return fmt.Errorf("capture_timeout of the watchdog section cannot be set along with the privileges section, reopening the capture requires CAP_NET_RAW")
+	}
+	return nil
+}
+
+// parseAPI checks the management API is protected, and parses its allowed clients and the peers
+func (cfg *brconfig) parseAPI() (err error) {
+	if cfg.servesAPI() && cfg.APIToken == "" {
+		return fmt.Errorf("api_token is required when api_listen or api_socket is set")
+	}
+	if cfg.APIInterface != "" && cfg.APIListen == "" {
+		return fmt.Errorf("api_interface requires api_listen")
+	}
+	if host, _, err := net.SplitHostPort(cfg.APIListen); cfg.APIInterface != "" && (err != nil || host != "") {
+		return fmt.Errorf("api_listen must only set a port, such as \":8053\", when api_interface is set")
+	}
+	if cfg.apiClients, err = parseAllowedClients(cfg.APIAllowedClients); err != nil {
+		return err
+	}
+	cfg.peerMACs, err = parsePeerMACs(cfg.PeerMACs, cfg.PeerPartitioning)
+	return err
+}
+
+// parseDevices parses the devices and the VLANs they are shared with
+func (cfg *brconfig) parseDevices() (err error) {
+	if cfg.Devices, err = normalizeDevices(cfg.Devices); err != nil {
+		return err
+	}
+	if cfg.devicePrefixes, err = newDevicePrefixes(cfg.Devices); err != nil {
+		return err
+	}
+	if err = cfg.parseVLANs(); err != nil {
+		return err
+	}
+	if err = cfg.parseEgress(); err != nil {
+		return err
+	}
+	if cfg.flows, err = parseDomainFlows(cfg.Compliance.AllowedFlows); err != nil {
+		return err
+	}
+	if err = cfg.checkDomains(); err != nil {
+		return err
+	}
+	if err = cfg.checkGuestVLANs(); err != nil {
+		return err
+	}
+	return cfg.checkEmptyDevices()
+}
+
+// normalizeDevices writes the MAC addresses of the device entries and of their allowed queriers as packets are matched with,
+// in lowercase with colons, and rejects the invalid ones and the entries naming the same device. MAC prefixes match whatever their case.
+func normalizeDevices(devices map[macAddress]bonjourDevice) (map[macAddress]bonjourDevice, error) {
+	if devices == nil {
+		return nil, nil
+	}
+	var macs []macAddress
+	for mac := range devices {
+		macs = append(macs, mac)
+	}
+	sortMACs(macs)
+	normalized := make(map[macAddress]bonjourDevice, len(devices))
+	entries := make(map[macAddress]macAddress, len(devices))
+	for _, mac := range macs {
+		device := devices[mac]
+		entry := mac
+		if _, isPrefix, _ := parseDevicePrefix(mac); !isPrefix {
+			hw, err := net.ParseMAC(string(mac))
+			if err != nil {
+				return nil, fmt.Errorf("invalid MAC address %q in devices", mac)
+			}
+			entry = macAddress(hw.String())
+		}
+		if other, ok := entries[entry]; ok {
+			return nil, fmt.Errorf("devices %q and %q are the same device", other, mac)
+		}
+		entries[entry] = mac
+		if device.AllowedQueriers != nil {
+			queriers := make([]macAddress, len(device.AllowedQueriers))
+			for i, querier := range device.AllowedQueriers {
+				hw, err := net.ParseMAC(string(querier))
+				if err != nil {
+					return nil, fmt.Errorf("invalid MAC address %q in the allowed_queriers of device %q", querier, mac)
+				}
+				queriers[i] = macAddress(hw.String())
+			}
+			device.AllowedQueriers = queriers
+		}
+		normalized[entry] = device
+	}
+	return normalized, nil
+}
+
+func (cfg *brconfig) parseVLANs() error {
+	if cfg.UnknownDeviceMode == "" {
+		cfg.UnknownDeviceMode = unknownDrop
+	}
+	if !cfg.UnknownDeviceMode.isValid() {
+		return fmt.Errorf("invalid unknown_device_mode %q", cfg.UnknownDeviceMode)
+	}
+	if cfg.AddressValidation == "" {
+		cfg.AddressValidation = addressValidationOff
+	}
+	if !cfg.AddressValidation.isValid() {
+		return fmt.Errorf("invalid address_validation %q", cfg.AddressValidation)
+	}
+	if cfg.LegacyQueries == "" {
+		cfg.LegacyQueries = legacyReflect
+	}
+	if !cfg.LegacyQueries.isValid() {
+		return fmt.Errorf("invalid legacy_queries %q", cfg.LegacyQueries)
+	}
+	cfg.vlans = make(map[uint16]vlanConfig)
+	for key, vlan := range cfg.VLANs {
+		tag, err := strconv.ParseUint(key, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid VLAN tag %q in vlans section", key)
+		}
+		if vlan.UnknownDeviceMode != "" && !vlan.UnknownDeviceMode.isValid() {
+			return fmt.Errorf("invalid unknown_device_mode %q for VLAN %v", vlan.UnknownDeviceMode, tag)
+		}
+		if vlan.AddressValidation != "" && !vlan.AddressValidation.isValid() {
+			return fmt.Errorf("invalid address_validation %q for VLAN %v", vlan.AddressValidation, tag)
+		}
+		if vlan.LegacyQueries != "" && !vlan.LegacyQueries.isValid() {
+			return fmt.Errorf("invalid legacy_queries %q for VLAN %v", vlan.LegacyQueries, tag)
+		}
+		if vlan.Preset != "" && vlan.Preset != vlanPresetGuest {
+			return fmt.Errorf("invalid preset %q for VLAN %v, expected %q", vlan.Preset, tag, vlanPresetGuest)
+		}
+		for _, subnet := range vlan.Subnets {
+			_, prefix, err := net.ParseCIDR(subnet)
+			if err != nil {
+				return fmt.Errorf("invalid subnet %q for VLAN %v", subnet, tag)
+			}
+			vlan.subnets = append(vlan.subnets, prefix)
+		}
+		cfg.vlans[uint16(tag)] = vlan
+	}
+	return nil
+}
+
+func (mode unknownDeviceMode) isValid() bool {
+	switch mode {
+	case unknownDrop, unknownLogAndDrop, unknownReflectToPool, unknownQuarantine:
+		return true
+	}
+	return false
+}
+
+// unknownDevicePolicy returns the mode and default pool applying to unknown devices on a VLAN.
+// Per-VLAN settings take precedence over the global ones, and empty_devices_mode over both while no devices are configured.
+func (cfg *brconfig) unknownDevicePolicy(tag uint16) (mode unknownDeviceMode, defaultPool []uint16) {
+	mode, defaultPool = cfg.UnknownDeviceMode, cfg.DefaultPool
+	if vlan, ok := cfg.vlans[tag]; ok {
+		if vlan.UnknownDeviceMode != "" {
+			mode = vlan.UnknownDeviceMode
+		}
+		if vlan.DefaultPool != nil {
+			defaultPool = vlan.DefaultPool
+		}
+	}
+	if override, ok := cfg.emptyDevicesOverride(); ok {
+		mode = override
+	}
+	return
+}
+
+// configuredVLANs returns the sorted list of every VLAN referenced by the configuration
+func (cfg *brconfig) configuredVLANs() []uint16 {
+	seen := make(map[uint16]bool)
+	for _, tag := range cfg.DefaultPool {
+		seen[tag] = true
+	}
+	for tag, vlan := range cfg.vlans {
+		seen[tag] = true
+		for _, pool := range vlan.DefaultPool {
+			seen[pool] = true
+		}
+	}
+	for _, device := range cfg.Devices {
+		seen[device.OriginPool] = true
+		for _, pool := range device.SharedPools {
+			seen[pool] = true
+		}
+	}
+	vlans := make([]uint16, 0, len(seen))
+	for tag := range seen {
+		vlans = append(vlans, tag)
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return vlans
+}
+
 func mapByPool(devices map[macAddress]bonjourDevice) map[uint16]([]uint16) {
 	seen := make(map[uint16]map[uint16]bool)
 	poolsMap := make(map[uint16]([]uint16))
@@ -43,3 +572,35 @@ func mapByPool(devices map[macAddress]bonjourDevice) map[uint16]([]uint16) {
 	}
 	return poolsMap
 }
+
+// mapQuerierRestrictions lists, for each pair of VLANs, the only queriers allowed to reach the devices of the
+// destination VLAN. Pairs containing at least one device which accepts any querier are not restricted, and not listed.
+func mapQuerierRestrictions(devices map[macAddress]bonjourDevice) map[poolPair]map[macAddress]bool {
+	open := make(map[poolPair]bool)
+	restrictions := make(map[poolPair]map[macAddress]bool)
+	for _, device := range devices {
+		for _, pool := range device.SharedPools {
+			pair := poolPair{from: pool, to: device.OriginPool}
+			if len(device.AllowedQueriers) == 0 {
+				open[pair] = true
+				continue
+			}
+			if _, ok := restrictions[pair]; !ok {
+				restrictions[pair] = make(map[macAddress]bool)
+			}
+			for _, querier := range device.AllowedQueriers {
+				restrictions[pair][querier] = true
+			}
+		}
+	}
+	for pair := range open {
+		delete(restrictions, pair)
+	}
+	return restrictions
+}
+
+// isQueryAllowed tells whether a query sent by querier on the first VLAN of pair can be reflected to the second VLAN
+func isQueryAllowed(restrictions map[poolPair]map[macAddress]bool, pair poolPair, querier macAddress) bool {
+	allowed, ok := restrictions[pair]
+	return !ok || allowed[querier]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Formats of the configuration files
+const (
+	formatTOML = "toml"
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+// configFormat returns the format of the configuration file at path: format when set, or else the one of its extension,
+// files without a known extension being read as TOML
+func configFormat(path, format string) (string, error) {
+	switch format {
+	case formatTOML, formatYAML, formatJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid configuration format %q, expected %q, %q or %q", format, formatTOML, formatYAML, formatJSON)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML, nil
+	case ".json":
+		return formatJSON, nil
+	}
+	return formatTOML, nil
+}
+
+// readProfileAs reads the configuration at path in the given format, detected from the extension of path when empty
+func readProfileAs(path, profile, format string) (cfg brconfig, err error) {
+	if format, err = configFormat(path, format); err != nil {
+		return brconfig{}, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return brconfig{}, err
+	}
+	cfg, err = parseProfileAs(string(content), profile, format)
+	cfg.path, cfg.format = path, format
+	return cfg, err
+}
+
+// parseProfileAs parses a configuration in the given format. YAML and JSON documents are translated to TOML,
+// so that every format shares the settings, defaults and checks of the TOML configuration, profiles included.
+func parseProfileAs(content, profile, format string) (brconfig, error) {
+	var document interface{}
+	var err error
+	switch format {
+	case formatTOML:
+		return parseProfile(content, profile)
+	case formatYAML:
+		err = yaml.Unmarshal([]byte(content), &document)
+	case formatJSON:
+		decoder := json.NewDecoder(strings.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&document)
+	default:
+		return brconfig{}, fmt.Errorf("invalid configuration format %q", format)
+	}
+	if err != nil {
+		return brconfig{}, fmt.Errorf("invalid %v: %v", strings.ToUpper(format), err)
+	}
+	if document == nil {
+		return parseProfile("", profile)
+	}
+	table, ok := tomlValue(document).(map[string]interface{})
+	if !ok {
+		return brconfig{}, fmt.Errorf("invalid %v: the configuration must be a mapping of settings", strings.ToUpper(format))
+	}
+	var translated bytes.Buffer
+	if err := toml.NewEncoder(&translated).Encode(table); err != nil {
+		return brconfig{}, fmt.Errorf("invalid %v: %v", strings.ToUpper(format), err)
+	}
+	return parseProfile(translated.String(), profile)
+}
+
+// tomlValue converts a value decoded from YAML or JSON to the types of the TOML encoder: mappings are keyed
+// by strings, such as the VLAN tags of the vlans section, JSON numbers become integers or floats, and null
+// values are left out like unset TOML keys
+func tomlValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		table := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			if v != nil {
+				table[fmt.Sprint(key)] = tomlValue(v)
+			}
+		}
+		return table
+	case map[string]interface{}:
+		table := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			if v != nil {
+				table[key] = tomlValue(v)
+			}
+		}
+		return table
+	case []interface{}:
+		array := make([]interface{}, 0, len(value))
+		for _, v := range value {
+			if v != nil {
+				array = append(array, tomlValue(v))
+			}
+		}
+		return array
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return value
+}
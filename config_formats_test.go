@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestConfigFormat(t *testing.T) {
+	tests := []struct {
+		path, format, expected string
+	}{
+		{"/etc/bonjour-reflector/config.toml", "", formatTOML},
+		{"/etc/bonjour-reflector/config", "", formatTOML},
+		{"config.YML", "", formatYAML},
+		{"config.yaml", "", formatYAML},
+		{"config.json", "", formatJSON},
+		{"config.conf", formatYAML, formatYAML},
+		{"config.json", formatTOML, formatTOML},
+	}
+	for _, test := range tests {
+		if format, err := configFormat(test.path, test.format); err != nil || format != test.expected {
+			t.Errorf("Error in configFormat(%q, %q): expected %v, got %v (%v)", test.path, test.format, test.expected, format, err)
+		}
+	}
+	if _, err := configFormat("config.toml", "ini"); err == nil {
+		t.Error("Error in configFormat(): expected an error for an unknown format")
+	}
+}
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	content, err := ioutil.ReadFile("config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := parseConfig(string(content))
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	var document map[string]interface{}
+	if _, err := toml.Decode(string(content), &document); err != nil {
+		t.Fatal(err)
+	}
+	yamlContent, err := yaml.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonContent, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for format, content := range map[string][]byte{formatYAML: yamlContent, formatJSON: jsonContent} {
+		cfg, err := parseProfileAs(string(content), "", format)
+		if err != nil {
+			t.Errorf("Error in parseProfileAs() for %v: %v", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Error in parseProfileAs(): the %v configuration differs from the TOML one, got %+v, expected %+v", format, cfg, expected)
+		}
+	}
+}
+
+func TestReadProfileAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	yamlConfig := `
+net_interface: eth0
+solicitation_window: 5s
+vlans:
+  30:
+    preset: guest
+devices:
+  "aa:bb:cc:dd:ee:ff":
+    origin_pool: 10
+    shared_pools: [20, 30]
+profiles:
+  lab:
+    net_interface: eth1
+`
+	path := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(path, []byte(yamlConfig), 0644)
+	cfg, err := readProfileAs(path, "lab", "")
+	if err != nil {
+		t.Fatalf("Error in readProfileAs(): %v", err)
+	}
+	device := cfg.Devices["aa:bb:cc:dd:ee:ff"]
+	if cfg.format != formatYAML || cfg.NetInterface != "eth1" || cfg.SolicitationWindow.Duration.Seconds() != 5 ||
+		!cfg.isGuestVLAN(30) || device.OriginPool != 10 || !equalVLANs(device.SharedPools, []uint16{20, 30}) {
+		t.Errorf("Error in readProfileAs(): unexpected configuration %+v", cfg)
+	}
+
+	// The format flag overrides the extension
+	path = filepath.Join(dir, "config.conf")
+	ioutil.WriteFile(path, []byte(`{"net_interface": "eth0", "vlans": {"30": {"preset": "media"}}}`), 0644)
+	if _, err := readProfileAs(path, "", formatJSON); err == nil || !strings.Contains(err.Error(), "invalid preset") {
+		t.Errorf("Error in readProfileAs(): expected the JSON configuration to be checked, got %v", err)
+	}
+	if _, err := readProfileAs(path, "", ""); err == nil {
+		t.Error("Error in readProfileAs(): expected JSON to be invalid TOML")
+	}
+	for format, content := range map[string]string{formatYAML: "- eth0", formatJSON: `{"net_interface": `} {
+		if _, err := parseProfileAs(content, "", format); err == nil {
+			t.Errorf("Error in parseProfileAs(): expected an error for %v %q", format, content)
+		}
+	}
+
+	// Device entries are not edited in a YAML file
+	api := &deviceAPI{configPath: path, format: formatYAML}
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/devices/aa:bb:cc:dd:ee:ff", nil))
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Error in deviceAPI: expected a conflict for a YAML configuration, got %v", recorder.Code)
+	}
+}
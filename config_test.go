@@ -32,3 +32,101 @@ func TestMapByPool(t *testing.T) {
 		t.Error("Error in mapByPool()")
 	}
 }
+
+func TestUnknownDevicePolicy(t *testing.T) {
+	cfg := brconfig{
+		DefaultPool: []uint16{10},
+		VLANs: map[string]vlanConfig{
+			"20": vlanConfig{UnknownDeviceMode: unknownQuarantine},
+			"30": vlanConfig{UnknownDeviceMode: unknownReflectToPool, DefaultPool: []uint16{31, 32}},
+		},
+	}
+	if err := cfg.parseVLANs(); err != nil {
+		t.Fatalf("Error in parseVLANs(): %v", err)
+	}
+
+	tests := []struct {
+		tag          uint16
+		expectedMode unknownDeviceMode
+		expectedPool []uint16
+	}{
+		{1, unknownDrop, []uint16{10}},
+		{20, unknownQuarantine, []uint16{10}},
+		{30, unknownReflectToPool, []uint16{31, 32}},
+	}
+	for _, test := range tests {
+		mode, pool := cfg.unknownDevicePolicy(test.tag)
+		if mode != test.expectedMode || !reflect.DeepEqual(pool, test.expectedPool) {
+			t.Errorf("Error in unknownDevicePolicy() for VLAN %v", test.tag)
+		}
+	}
+}
+
+func TestParseVLANsInvalid(t *testing.T) {
+	invalidConfigs := []brconfig{
+		brconfig{UnknownDeviceMode: "reflect"},
+		brconfig{VLANs: map[string]vlanConfig{"guest": vlanConfig{}}},
+		brconfig{VLANs: map[string]vlanConfig{"70000": vlanConfig{}}},
+		brconfig{VLANs: map[string]vlanConfig{"20": vlanConfig{UnknownDeviceMode: "log"}}},
+	}
+	for _, cfg := range invalidConfigs {
+		if err := cfg.parseVLANs(); err == nil {
+			t.Errorf("parseVLANs() should fail for %+v", cfg)
+		}
+	}
+}
+
+func TestMapQuerierRestrictions(t *testing.T) {
+	restrictedDevices := map[macAddress]bonjourDevice{
+		"00:14:22:01:23:45": bonjourDevice{OriginPool: 45, SharedPools: []uint16{42, 46}, AllowedQueriers: []macAddress{"aa:aa:aa:aa:aa:aa"}},
+		"00:14:22:01:23:46": bonjourDevice{OriginPool: 45, SharedPools: []uint16{46}},
+		"00:14:22:01:23:47": bonjourDevice{OriginPool: 47, SharedPools: []uint16{42}, AllowedQueriers: []macAddress{"bb:bb:bb:bb:bb:bb"}},
+	}
+	restrictions := mapQuerierRestrictions(restrictedDevices)
+
+	tests := []struct {
+		pair     poolPair
+		querier  macAddress
+		expected bool
+	}{
+		{poolPair{from: 42, to: 45}, "aa:aa:aa:aa:aa:aa", true},
+		{poolPair{from: 42, to: 45}, "bb:bb:bb:bb:bb:bb", false},
+		{poolPair{from: 42, to: 47}, "bb:bb:bb:bb:bb:bb", true},
+		// Another device of VLAN 45 is shared with VLAN 46 without restriction
+		{poolPair{from: 46, to: 45}, "bb:bb:bb:bb:bb:bb", true},
+		{poolPair{from: 13, to: 45}, "bb:bb:bb:bb:bb:bb", true},
+	}
+	for _, test := range tests {
+		if isQueryAllowed(restrictions, test.pair, test.querier) != test.expected {
+			t.Errorf("Error in isQueryAllowed() for %+v and querier %v", test.pair, test.querier)
+		}
+	}
+}
+
+func TestNormalizeDevices(t *testing.T) {
+	devices, err := normalizeDevices(map[macAddress]bonjourDevice{
+		"AA:33:CC:33:EE:33": bonjourDevice{OriginPool: 45, AllowedQueriers: []macAddress{"AA-44-CC-44-EE-44"}},
+		"B8:27:EB:*":        bonjourDevice{OriginPool: 46},
+	})
+	if err != nil {
+		t.Fatalf("Error in normalizeDevices(): %v", err)
+	}
+	device, ok := devices["aa:33:cc:33:ee:33"]
+	if !ok || len(devices) != 2 || !reflect.DeepEqual(device.AllowedQueriers, []macAddress{"aa:44:cc:44:ee:44"}) {
+		t.Errorf("Error in normalizeDevices(): MAC addresses should be written as packets are matched with, got %+v", devices)
+	}
+	if _, ok := devices["B8:27:EB:*"]; !ok {
+		t.Errorf("Error in normalizeDevices(): MAC prefixes should be kept, got %+v", devices)
+	}
+
+	invalidDevices := []map[macAddress]bonjourDevice{
+		{"00:11:22:33:44:55:66": bonjourDevice{}},
+		{"aa:bb:cc:dd:ee:ff": bonjourDevice{}, "AA-BB-CC-DD-EE-FF": bonjourDevice{}},
+		{"aa:bb:cc:dd:ee:ff": bonjourDevice{AllowedQueriers: []macAddress{"11:22:33:44:55"}}},
+	}
+	for _, devices := range invalidDevices {
+		if _, err := normalizeDevices(devices); err == nil {
+			t.Errorf("normalizeDevices() should fail for %+v", devices)
+		}
+	}
+}
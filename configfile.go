@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// configFile edits a TOML configuration file line by line, so that the comments, the order of the keys
+// and the formatting written by humans survive the changes made through the API
+type configFile struct {
+	path  string
+	lines []string
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &configFile{path: path, lines: splitLines(string(content))}, nil
+}
+
+func splitLines(content string) []string {
+	return strings.Split(content, "\n")
+}
+
+// tableHeader returns the name of the table declared on line, e.g. `devices."AA:BB:CC:DD:EE:FF"`
+func tableHeader(line string) (name string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") || strings.HasPrefix(line, "[[") {
+		return "", false
+	}
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(line[1:end]), true
+}
+
+func isHeader(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "[")
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentation(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// findTable returns the lines spanned by a table: its header, and the end of its own keys.
+// The root table, named "", starts before the first line.
+func (f *configFile) findTable(table string) (header, end int, ok bool) {
+	header = -1
+	if table != "" {
+		for i, line := range f.lines {
+			if name, isTable := tableHeader(line); isTable && name == table {
+				header = i
+				break
+			}
+		}
+		if header < 0 {
+			return 0, 0, false
+		}
+	}
+	end = len(f.lines)
+	for i := header + 1; i < len(f.lines); i++ {
+		if isHeader(f.lines[i]) {
+			end = i
+			break
+		}
+	}
+	return header, end, true
+}
+
+// findKey returns the first and last lines of the value of key in table
+func (f *configFile) findKey(table, key string) (first, last int, ok bool) {
+	header, end, ok := f.findTable(table)
+	if !ok {
+		return 0, 0, false
+	}
+	for i := header + 1; i < end; i++ {
+		line := strings.TrimSpace(f.lines[i])
+		if !strings.HasPrefix(line, key) || !strings.HasPrefix(strings.TrimSpace(line[len(key):]), "=") {
+			continue
+		}
+		// Arrays may span several lines
+		last, depth := i, 0
+		for last < end {
+			value, _ := splitComment(f.lines[last])
+			depth += strings.Count(value, "[") - strings.Count(value, "]")
+			if depth <= 0 {
+				break
+			}
+			last++
+		}
+		return i, last, true
+	}
+	return 0, 0, false
+}
+
+// splitComment separates a line from its trailing comment, ignoring the # characters of strings
+func splitComment(line string) (content, comment string) {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i], line[i:]
+			}
+		}
+	}
+	return line, ""
+}
+
+// set assigns value to key in table. Existing keys keep their indentation and trailing comment,
+// new keys are appended to the table, and missing tables are added after their parent table.
+func (f *configFile) set(table, key string, value interface{}) error {
+	formatted, err := formatTOMLValue(value)
+	if err != nil {
+		return err
+	}
+	if first, last, ok := f.findKey(table, key); ok {
+		content, comment := splitComment(f.lines[last])
+		newLine := indentation(f.lines[first]) + key + " = " + formatted
+		if comment != "" {
+			// Keep the comment in its column when possible
+			column := len(content)
+			if first != last || len(newLine) >= column {
+				column = len(newLine) + 1
+			}
+			newLine += strings.Repeat(" ", column-len(newLine)) + comment
+		}
+		f.lines = append(f.lines[:first], append([]string{newLine}, f.lines[last+1:]...)...)
+		return nil
+	}
+
+	header, end, ok := f.findTable(table)
+	if !ok {
+		header, end = f.addTable(table)
+	}
+	insert := end
+	for insert > header+1 && isBlank(f.lines[insert-1]) {
+		insert--
+	}
+	indent := ""
+	if header >= 0 {
+		indent = indentation(f.lines[header])
+	}
+	newLine := indent + key + " = " + formatted
+	f.lines = append(f.lines[:insert], append([]string{newLine}, f.lines[insert:]...)...)
+	return nil
+}
+
+// addTable appends an empty table after the last subtable of its parent, indented like its siblings
+func (f *configFile) addTable(table string) (header, end int) {
+	parent := ""
+	if dot := strings.Index(table, "."); dot > 0 {
+		parent = table[:dot]
+	}
+	insert, indent := len(f.lines), ""
+	for insert > 0 && isBlank(f.lines[insert-1]) {
+		insert--
+	}
+	if parent != "" {
+		for _, line := range f.lines {
+			name, ok := tableHeader(line)
+			if !ok || (name != parent && !strings.HasPrefix(name, parent+".")) {
+				continue
+			}
+			if name != parent {
+				indent = indentation(line)
+			}
+			header, end, _ := f.findTable(name)
+			for insert = end; insert > header+1 && isBlank(f.lines[insert-1]); insert-- {
+			}
+		}
+	}
+	newLines := []string{"", indent + "[" + table + "]"}
+	f.lines = append(f.lines[:insert], append(newLines, f.lines[insert:]...)...)
+	return insert + 1, insert + 2
+}
+
+// unset removes key from table
+func (f *configFile) unset(table, key string) {
+	if first, last, ok := f.findKey(table, key); ok {
+		f.lines = append(f.lines[:first], f.lines[last+1:]...)
+	}
+}
+
+// removeTable removes a table, its keys and the blank lines which preceded it
+func (f *configFile) removeTable(table string) bool {
+	header, end, ok := f.findTable(table)
+	if !ok || header < 0 {
+		return false
+	}
+	start := header
+	for start > 0 && isBlank(f.lines[start-1]) {
+		start--
+	}
+	for end > header+1 && isBlank(f.lines[end-1]) {
+		end--
+	}
+	f.lines = append(f.lines[:start], f.lines[end:]...)
+	return true
+}
+
+func (f *configFile) String() string {
+	return strings.Join(f.lines, "\n")
+}
+
+func (f *configFile) save() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash never leaves a truncated configuration behind
+	tmpPath := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(f.String()), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.path)
+}
+
+// formatTOMLValue formats strings, integers, booleans and arrays of them as TOML values
+func formatTOMLValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string, macAddress:
+		// JSON escape sequences are valid in TOML basic strings
+		quoted, err := json.Marshal(v)
+		return string(quoted), err
+	case bool, int, uint16, uint32, int64:
+		return fmt.Sprint(v), nil
+	case []uint16:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case []macAddress:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i], _ = formatTOMLValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case []string:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i], _ = formatTOMLValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+	return "", fmt.Errorf("unsupported configuration value %v", value)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+const configFileTest = `net_interface = "eth0" # Trunk interface
+
+[devices]
+
+    [devices."AA:BB:CC:DD:EE:FF"]    # A shared bonjour device
+    description = "Test Chromecast"
+    origin_pool = 1078               # Tag of the VLAN the device is in
+    shared_pools = [
+        1234,
+        3597,
+    ]
+
+    [devices."AA:00:CC:00:EE:00"]
+    description = "Test Spotify Air"
+    origin_pool = 1078
+    shared_pools = [1234]
+`
+
+func TestConfigFileSet(t *testing.T) {
+	file := &configFile{}
+	file.lines = splitLines(configFileTest)
+
+	file.set("", "net_interface", "eth1")
+	file.set(`devices."AA:BB:CC:DD:EE:FF"`, "origin_pool", uint16(42))
+	file.set(`devices."AA:BB:CC:DD:EE:FF"`, "shared_pools", []uint16{1, 2})
+	file.set(`devices."AA:00:CC:00:EE:00"`, "allowed_queriers", []macAddress{"AA:33:CC:33:EE:33"})
+	file.set(`devices."AA:11:CC:11:EE:11"`, "origin_pool", uint16(1547))
+	file.set("", "inventory_file", "./inventory.json")
+
+	expected := `net_interface = "eth1" # Trunk interface
+inventory_file = "./inventory.json"
+
+[devices]
+
+    [devices."AA:BB:CC:DD:EE:FF"]    # A shared bonjour device
+    description = "Test Chromecast"
+    origin_pool = 42                 # Tag of the VLAN the device is in
+    shared_pools = [1, 2]
+
+    [devices."AA:00:CC:00:EE:00"]
+    description = "Test Spotify Air"
+    origin_pool = 1078
+    shared_pools = [1234]
+    allowed_queriers = ["AA:33:CC:33:EE:33"]
+
+    [devices."AA:11:CC:11:EE:11"]
+    origin_pool = 1547
+`
+	if file.String() != expected {
+		t.Errorf("Error in set(), got:\n%v", file.String())
+	}
+	if _, err := parseConfig(file.String()); err != nil {
+		t.Errorf("Error in set(): invalid configuration written: %v", err)
+	}
+}
+
+func TestConfigFileRemoveTable(t *testing.T) {
+	file := &configFile{}
+	file.lines = splitLines(configFileTest)
+
+	if !file.removeTable(`devices."AA:BB:CC:DD:EE:FF"`) || file.removeTable(`devices."AA:11:CC:11:EE:11"`) {
+		t.Fatal("Error in removeTable()")
+	}
+	file.unset(`devices."AA:00:CC:00:EE:00"`, "description")
+
+	expected := `net_interface = "eth0" # Trunk interface
+
+[devices]
+
+    [devices."AA:00:CC:00:EE:00"]
+    origin_pool = 1078
+    shared_pools = [1234]
+`
+	if file.String() != expected {
+		t.Errorf("Error in removeTable(), got:\n%v", file.String())
+	}
+}
+
+func TestSplitComment(t *testing.T) {
+	content, comment := splitComment(`description = "Room #1 \"TV\"" # Living room`)
+	if content != `description = "Room #1 \"TV\"" ` || comment != "# Living room" {
+		t.Errorf("Error in splitComment(): got %q and %q", content, comment)
+	}
+}
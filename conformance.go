@@ -0,0 +1,118 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Presets of the protocol conformance checks
+const (
+	conformanceStrict  = "strict"
+	conformanceLenient = "lenient"
+)
+
+// Top bit of the class of a record, asking receivers to flush their previous records of this name (RFC 6762, section 10.2)
+const cacheFlushBit = 0x8000
+
+// conformanceStats counts the packets dropped by each check, and the rewritten records
+var conformanceStats = expvar.NewMap("conformance")
+
+// conformanceConfig selects how strictly the reflector follows RFC 6762. Each setting left unset follows the preset.
+type conformanceConfig struct {
+	Preset           string `toml:"preset"`
+	CheckIPTTL       *bool  `toml:"check_ip_ttl"`
+	CheckSourcePort  *bool  `toml:"check_source_port"`
+	UnicastResponses *bool  `toml:"unicast_responses"`
+	ClearCacheFlush  *bool  `toml:"clear_cache_flush"`
+}
+
+// conformance holds the resolved conformance settings
+type conformance struct {
+	// checkIPTTL drops packets whose IP TTL or hop limit is not 255, i.e. which were routed (section 11)
+	checkIPTTL bool
+	// checkSourcePort drops answers not sent from port 5353 (section 6)
+	checkSourcePort bool
+	// unicastResponses honors the QU bit of questions, relaying the unicast answers (section 5.4)
+	unicastResponses bool
+	// clearCacheFlush clears the cache-flush bit of reflected records, for hosts mixing records of several VLANs
+	clearCacheFlush bool
+}
+
+// resolve returns the settings of the preset, overridden by the individual settings
+func (cfg conformanceConfig) resolve() (conformance, error) {
+	var resolved conformance
+	switch cfg.Preset {
+	case "", conformanceLenient:
+		resolved = conformance{unicastResponses: true}
+	case conformanceStrict:
+		resolved = conformance{checkIPTTL: true, checkSourcePort: true, unicastResponses: true}
+	default:
+		return conformance{}, fmt.Errorf("invalid conformance preset %q, expected %q or %q", cfg.Preset, conformanceStrict, conformanceLenient)
+	}
+	for _, setting := range []struct {
+		value  *bool
+		target *bool
+	}{
+		{cfg.CheckIPTTL, &resolved.checkIPTTL},
+		{cfg.CheckSourcePort, &resolved.checkSourcePort},
+		{cfg.UnicastResponses, &resolved.unicastResponses},
+		{cfg.ClearCacheFlush, &resolved.clearCacheFlush},
+	} {
+		if setting.value != nil {
+			*setting.target = *setting.value
+		}
+	}
+	return resolved, nil
+}
+
+// accepts tells whether bonjourPacket passes the enabled checks, counting the dropped packets
+func (c conformance) accepts(bonjourPacket *bonjourPacket) bool {
+	if c.checkIPTTL && ipTTL(bonjourPacket.packet) != 255 {
+		conformanceStats.Add("ip_ttl_drops", 1)
+		return false
+	}
+	if c.checkSourcePort && !bonjourPacket.isDNSQuery && bonjourPacket.srcPort != 5353 {
+		conformanceStats.Add("source_port_drops", 1)
+		return false
+	}
+	return true
+}
+
+func ipTTL(packet gopacket.Packet) uint8 {
+	if ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		return ipv4.TTL
+	}
+	if ipv6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		return ipv6.HopLimit
+	}
+	return 0
+}
+
+// rewrite applies the enabled rewrites to the records of an answer, and tells whether dns was modified
+func (c conformance) rewrite(dns *layers.DNS) bool {
+	if !c.clearCacheFlush || dns == nil {
+		return false
+	}
+	cleared := clearCacheFlushBits(dns)
+	if cleared == 0 {
+		return false
+	}
+	conformanceStats.Add("cache_flush_rewrites", int64(cleared))
+	return true
+}
+
+// clearCacheFlushBits clears the cache-flush bit of the records of dns, and returns the number of records modified
+func clearCacheFlushBits(dns *layers.DNS) (cleared int) {
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for i := range records {
+			if uint16(records[i].Class)&cacheFlushBit != 0 {
+				records[i].Class = layers.DNSClass(uint16(records[i].Class) &^ cacheFlushBit)
+				cleared++
+			}
+		}
+	}
+	return cleared
+}
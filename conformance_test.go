@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestConformanceResolve(t *testing.T) {
+	tests := map[string]conformance{
+		``:                   {unicastResponses: true},
+		`preset = "lenient"`: {unicastResponses: true},
+		`preset = "strict"`:  {checkIPTTL: true, checkSourcePort: true, unicastResponses: true},
+		"preset = \"strict\"\ncheck_ip_ttl = false":           {checkSourcePort: true, unicastResponses: true},
+		"unicast_responses = false\nclear_cache_flush = true": {clearCacheFlush: true},
+	}
+	for section, expected := range tests {
+		cfg, err := parseConfig("[conformance]\n" + section)
+		if err != nil || cfg.conformance != expected {
+			t.Errorf("Error in resolve(): expected %+v for %q, got %+v (%v)", expected, section, cfg.conformance, err)
+		}
+	}
+	if _, err := parseConfig("[conformance]\npreset = \"pedantic\""); err == nil {
+		t.Error("Error in resolve(): expected an error for an invalid preset")
+	}
+}
+
+func TestConformanceAccepts(t *testing.T) {
+	packet := gopacket.NewPacket(createMockmDNSPacket(true, false), layers.LayerTypeEthernet, gopacket.Default)
+	bonjourPacket := bonjourPacket{packet: packet, srcPort: 5353}
+	strict := conformance{checkIPTTL: true, checkSourcePort: true}
+
+	if strict.accepts(&bonjourPacket) {
+		t.Error("Error in accepts(): expected a routed packet to be dropped")
+	}
+	packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL = 255
+	if !strict.accepts(&bonjourPacket) {
+		t.Error("Error in accepts(): expected a link-local answer from port 5353 to be accepted")
+	}
+	bonjourPacket.srcPort = 49152
+	if strict.accepts(&bonjourPacket) {
+		t.Error("Error in accepts(): expected an answer from another port to be dropped")
+	}
+	bonjourPacket.isDNSQuery = true
+	if !strict.accepts(&bonjourPacket) {
+		t.Error("Error in accepts(): expected a legacy query from another port to be accepted")
+	}
+	if !(conformance{}).accepts(&bonjourPacket) {
+		t.Error("Error in accepts(): expected no check without conformance settings")
+	}
+}
+
+func TestConformanceRewrite(t *testing.T) {
+	dns := &layers.DNS{Answers: []layers.DNSResourceRecord{
+		{Name: []byte("host.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN | cacheFlushBit},
+		{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN},
+	}}
+	if (conformance{}).rewrite(dns) {
+		t.Error("Error in rewrite(): expected cache-flush bits to be kept by default")
+	}
+	if !(conformance{clearCacheFlush: true}).rewrite(dns) || dns.Answers[0].Class != layers.DNSClassIN {
+		t.Errorf("Error in rewrite(): expected the cache-flush bit to be cleared, got class %v", dns.Answers[0].Class)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment variables configuring the container entrypoint
+const (
+	envConfigPath   = "BONJOUR_REFLECTOR_CONFIG"
+	envConfigTOML   = "BONJOUR_REFLECTOR_CONFIG_TOML"
+	envNetInterface = "BONJOUR_REFLECTOR_NET_INTERFACE"
+	envDebug        = "BONJOUR_REFLECTOR_DEBUG"
+	envProfile      = "BONJOUR_REFLECTOR_PROFILE"
+
+	defaultContainerConfigPath = "/etc/bonjour-reflector/config.toml"
+)
+
+// Linux capabilities needed to capture and inject packets, see capability.h
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+var containerCommand = &command{
+	name:    "container",
+	summary: "Check the container setup, then reflect Bonjour traffic (container entrypoint)",
+	setup:   setupContainerCommand,
+}
+
+func setupContainerCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	checkOnly := flags.Bool("check", false, "Only check the container setup, without reflecting traffic")
+
+	return func(out *commandOutput, args []string) error {
+		setupLogging(loggingConfig{Level: "info"}, out.json)
+		cfg, err := loadContainerConfig(os.Getenv)
+		if err != nil {
+			return configError(err)
+		}
+		setupLogging(cfg.Logging, out.json)
+		if err := checkContainerCapabilities("/proc/self/status"); err != nil {
+			return permissionError(err)
+		}
+		mode, err := detectNetworkMode("/sys/class/net", cfg.NetInterface)
+		if err != nil {
+			return err
+		}
+		logger.infof("Capturing on %v (%v)", cfg.NetInterface, mode)
+		if *checkOnly {
+			return nil
+		}
+		if os.Getenv(envDebug) != "" {
+			go debugServer(6060)
+		}
+		return runReflector(cfg, true)
+	}
+}
+
+// loadContainerConfig reads the configuration from the TOML content of an environment variable,
+// or else from a mounted file. The network interface can be overridden by another environment variable.
+func loadContainerConfig(getenv func(string) string) (cfg brconfig, err error) {
+	if content := getenv(envConfigTOML); content != "" {
+		cfg, err = parseProfile(content, getenv(envProfile))
+		if err != nil {
+			return brconfig{}, fmt.Errorf("invalid configuration in %v: %v", envConfigTOML, err)
+		}
+	} else {
+		path := getenv(envConfigPath)
+		if path == "" {
+			path = defaultContainerConfigPath
+		}
+		cfg, err = readProfile(path, getenv(envProfile))
+		if os.IsNotExist(err) {
+			return brconfig{}, fmt.Errorf("no configuration found: mount a config file at %v, or set %v or %v", path, envConfigPath, envConfigTOML)
+		}
+		if err != nil {
+			return brconfig{}, fmt.Errorf("invalid configuration in %v: %v", path, err)
+		}
+	}
+	if intf := getenv(envNetInterface); intf != "" {
+		cfg.NetInterface, cfg.NetInterfaces, cfg.TrunkInterfaces = intf, nil, nil
+	}
+	if cfg.NetInterface == "" {
+		return brconfig{}, fmt.Errorf("no network interface configured: set net_interface in the configuration, or %v", envNetInterface)
+	}
+	return cfg, nil
+}
+
+// checkContainerCapabilities verifies that the process holds the capabilities needed by pcap,
+// which are dropped by default in containers
+func checkContainerCapabilities(statusPath string) error {
+	file, err := os.Open(statusPath)
+	if err != nil {
+		// Not running on Linux, capabilities cannot be checked
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		effective, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return fmt.Errorf("could not parse capabilities in %v: %v", statusPath, err)
+		}
+		var missing []string
+		if effective&(1<<capNetRaw) == 0 {
+			missing = append(missing, "NET_RAW")
+		}
+		if effective&(1<<capNetAdmin) == 0 {
+			missing = append(missing, "NET_ADMIN")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing capabilities %v: run the container with --cap-add=NET_RAW --cap-add=NET_ADMIN", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+	return scanner.Err()
+}
+
+// detectNetworkMode tells how the container is attached to the network interface, using sysfs.
+// Bridge networking hides the VLAN trunk from the container, so it is reported as an error.
+func detectNetworkMode(sysfsRoot string, intf string) (string, error) {
+	dir := filepath.Join(sysfsRoot, intf)
+	if _, err := os.Stat(dir); err != nil {
+		available, _ := ioutil.ReadDir(sysfsRoot)
+		var names []string
+		for _, info := range available {
+			names = append(names, info.Name())
+		}
+		return "", interfaceMissingError(fmt.Errorf("network interface %v not found in the container (available: %v): run the container with --network host, or attach it to a macvlan network on the trunk", intf, strings.Join(names, ", ")))
+	}
+
+	uevent, _ := ioutil.ReadFile(filepath.Join(dir, "uevent"))
+	if strings.Contains(string(uevent), "DEVTYPE=macvlan") {
+		return "macvlan network", nil
+	}
+	ifindex, _ := ioutil.ReadFile(filepath.Join(dir, "ifindex"))
+	iflink, _ := ioutil.ReadFile(filepath.Join(dir, "iflink"))
+	if len(ifindex) > 0 && string(ifindex) != string(iflink) {
+		return "", fmt.Errorf("network interface %v is a virtual ethernet pair, which only carries untagged container traffic: run the container with --network host", intf)
+	}
+	return "host network", nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadContainerConfig(t *testing.T) {
+	env := map[string]string{
+		envConfigTOML:   "net_interface = \"eth0\"\n[devices.\"00:14:22:01:23:45\"]\norigin_pool = 45\nshared_pools = [42]\n",
+		envNetInterface: "eth1",
+	}
+	cfg, err := loadContainerConfig(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Error in loadContainerConfig(): %v", err)
+	}
+	if cfg.NetInterface != "eth1" || len(cfg.Devices) != 1 {
+		t.Errorf("Error in loadContainerConfig(): unexpected configuration %+v", cfg)
+	}
+
+	env = map[string]string{envConfigPath: "/nonexistent.toml"}
+	if _, err := loadContainerConfig(func(key string) string { return env[key] }); err == nil {
+		t.Error("Error in loadContainerConfig(): a missing configuration file should be reported")
+	}
+}
+
+func TestCheckContainerCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status")
+
+	tests := map[string]bool{
+		"Name:\tbonjour-reflector\nCapEff:\t0000000000003000\n": true,
+		"Name:\tbonjour-reflector\nCapEff:\t0000000000002000\n": false,
+		"Name:\tbonjour-reflector\nCapEff:\t00000000a80425fb\n": false,
+		"Name:\tbonjour-reflector\nCapEff:\t000001ffffffffff\n": true,
+	}
+	for status, expected := range tests {
+		ioutil.WriteFile(path, []byte(status), 0644)
+		if err := checkContainerCapabilities(path); (err == nil) != expected {
+			t.Errorf("Error in checkContainerCapabilities() for %q: %v", status, err)
+		}
+	}
+}
+
+func TestDetectNetworkMode(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	interfaces := map[string]map[string]string{
+		"eth0":  {"ifindex": "2\n", "iflink": "2\n", "uevent": "INTERFACE=eth0\nIFINDEX=2\n"},
+		"mv0":   {"ifindex": "3\n", "iflink": "2\n", "uevent": "DEVTYPE=macvlan\nINTERFACE=mv0\n"},
+		"veth0": {"ifindex": "4\n", "iflink": "12\n", "uevent": "INTERFACE=veth0\n"},
+	}
+	for name, files := range interfaces {
+		os.MkdirAll(filepath.Join(root, name), 0755)
+		for file, content := range files {
+			ioutil.WriteFile(filepath.Join(root, name, file), []byte(content), 0644)
+		}
+	}
+
+	if mode, err := detectNetworkMode(root, "eth0"); err != nil || mode != "host network" {
+		t.Errorf("Error in detectNetworkMode() for a physical interface: %v %v", mode, err)
+	}
+	if mode, err := detectNetworkMode(root, "mv0"); err != nil || mode != "macvlan network" {
+		t.Errorf("Error in detectNetworkMode() for a macvlan interface: %v %v", mode, err)
+	}
+	if _, err := detectNetworkMode(root, "veth0"); err == nil {
+		t.Error("Error in detectNetworkMode(): veth interfaces should be reported")
+	}
+	if _, err := detectNetworkMode(root, "eth9"); err == nil {
+		t.Error("Error in detectNetworkMode(): missing interfaces should be reported")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Delay between two snapshots of the counters kept to compute deltas
+	counterSnapshotInterval = 10 * time.Second
+	// Number of snapshots kept, i.e. the longest window deltas can be computed over
+	counterSnapshotsKept = 360
+)
+
+// counterSnapshot holds the values of the numeric counters of /debug/vars at a given time.
+// Counters of maps are named after the map and their key, such as "priority_queue.query_dropped".
+type counterSnapshot struct {
+	Time     time.Time          `json:"time"`
+	Counters map[string]float64 `json:"counters"`
+}
+
+// counterDelta is the change of a counter over a window
+type counterDelta struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Delta float64 `json:"delta"`
+	Rate  float64 `json:"rate"`
+}
+
+// counterWindow lists the changes of the counters between two snapshots
+type counterWindow struct {
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Counters []counterDelta `json:"counters"`
+}
+
+// takeCounterSnapshot reads the integer and float counters published with expvar, at the top level or in maps
+func takeCounterSnapshot(now time.Time) counterSnapshot {
+	snapshot := counterSnapshot{Time: now, Counters: make(map[string]float64)}
+	expvar.Do(func(kv expvar.KeyValue) {
+		addCounter(snapshot.Counters, kv.Key, kv.Value)
+	})
+	return snapshot
+}
+
+func addCounter(counters map[string]float64, name string, v expvar.Var) {
+	switch v := v.(type) {
+	case *expvar.Int:
+		counters[name] = float64(v.Value())
+	case *expvar.Float:
+		counters[name] = v.Value()
+	case *expvar.Map:
+		v.Do(func(kv expvar.KeyValue) {
+			addCounter(counters, name+"."+kv.Key, kv.Value)
+		})
+	}
+}
+
+// expvarInt returns the value of an expvar.Int, or 0 for a missing or another kind of variable
+func expvarInt(v expvar.Var) int64 {
+	if counter, ok := v.(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+// computeDeltas returns the changes of the counters from the snapshot from to the snapshot to.
+// Counters created in between start from 0.
+func computeDeltas(from, to counterSnapshot) counterWindow {
+	window := counterWindow{From: from.Time, To: to.Time, Counters: []counterDelta{}}
+	seconds := to.Time.Sub(from.Time).Seconds()
+	for name, value := range to.Counters {
+		delta := counterDelta{Name: name, Value: value, Delta: value - from.Counters[name]}
+		if seconds > 0 {
+			delta.Rate = delta.Delta / seconds
+		}
+		window.Counters = append(window.Counters, delta)
+	}
+	sort.Slice(window.Counters, func(i, j int) bool { return window.Counters[i].Name < window.Counters[j].Name })
+	return window
+}
+
+// counterHistory keeps the recent snapshots of the counters, to serve their deltas over a window
+type counterHistory struct {
+	mutex     sync.Mutex
+	snapshots []counterSnapshot
+	take      func(now time.Time) counterSnapshot
+}
+
+func newCounterHistory() *counterHistory {
+	return &counterHistory{take: takeCounterSnapshot}
+}
+
+func (history *counterHistory) record(now time.Time) {
+	snapshot := history.take(now)
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.snapshots = append(history.snapshots, snapshot)
+	if len(history.snapshots) > counterSnapshotsKept {
+		history.snapshots = history.snapshots[1:]
+	}
+}
+
+func (history *counterHistory) run() {
+	history.record(time.Now())
+	for now := range time.Tick(counterSnapshotInterval) {
+		history.record(now)
+	}
+}
+
+// since returns the oldest snapshot taken within window before now or, when they are all older than window,
+// the newest one, the closest to the start of the window
+func (history *counterHistory) since(window time.Duration, now time.Time) (counterSnapshot, bool) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	for _, snapshot := range history.snapshots {
+		if now.Sub(snapshot.Time) <= window {
+			return snapshot, true
+		}
+	}
+	if len(history.snapshots) == 0 {
+		return counterSnapshot{}, false
+	}
+	return history.snapshots[len(history.snapshots)-1], true
+}
+
+// ServeHTTP returns the current counters, or with ?window=1m their deltas and rates over the last minute
+func (history *counterHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	now := time.Now()
+	current := history.take(now)
+	param := r.URL.Query().Get("window")
+	if param == "" {
+		json.NewEncoder(w).Encode(current)
+		return
+	}
+	window, err := time.ParseDuration(param)
+	if err != nil || window <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid window"})
+		return
+	}
+	from, ok := history.since(window, now)
+	if !ok {
+		from = current
+	}
+	json.NewEncoder(w).Encode(computeDeltas(from, current))
+}
+
+var countersCommand = &command{
+	name:    "counters",
+	summary: "Show the counters of a running reflector, with their deltas and rates over a window",
+	setup:   setupCountersCommand,
+}
+
+func setupCountersCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:6060", "Address of the debug server of the running reflector")
+	window := flags.Duration("window", time.Minute, "Window of the deltas and rates")
+	all := flags.Bool("all", false, "Also show the counters which did not change")
+
+	return func(out *commandOutput, args []string) error {
+		var counters counterWindow
+		if err := callAPI(*addr, "", http.MethodGet, fmt.Sprintf("/debug/counters?window=%v", *window), nil, &counters); err != nil {
+			return fmt.Errorf("could not read counters, was the reflector started with -debug? %v", err)
+		}
+		counters.Counters = filterCounters(counters.Counters, args, *all)
+		return out.print(counters, func(w io.Writer) {
+			printCounters(w, counters)
+		})
+	}
+}
+
+// filterCounters keeps the counters starting with one of prefixes, if any, and unless all is set the changed ones
+func filterCounters(counters []counterDelta, prefixes []string, all bool) []counterDelta {
+	filtered := []counterDelta{}
+	for _, counter := range counters {
+		matches := len(prefixes) == 0
+		for _, prefix := range prefixes {
+			matches = matches || strings.HasPrefix(counter.Name, prefix)
+		}
+		if matches && (all || counter.Delta != 0) {
+			filtered = append(filtered, counter)
+		}
+	}
+	return filtered
+}
+
+func printCounters(w io.Writer, counters counterWindow) {
+	fmt.Fprintf(w, "Over %v:\n", counters.To.Sub(counters.From).Round(time.Second))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "COUNTER\tVALUE\tDELTA\tRATE/S")
+	for _, counter := range counters.Counters {
+		fmt.Fprintf(tw, "%v\t%v\t%+v\t%.2f\n", counter.Name, counter.Value, counter.Delta, counter.Rate)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testCounters = expvar.NewMap("test_counters")
+
+func TestTakeCounterSnapshot(t *testing.T) {
+	testCounters.Add("packets", 3)
+	testCounters.AddFloat("seconds", 1.5)
+	snapshot := takeCounterSnapshot(time.Now())
+	if snapshot.Counters["test_counters.packets"] != 3 || snapshot.Counters["test_counters.seconds"] != 1.5 {
+		t.Errorf("Error in takeCounterSnapshot(): expected the counters of maps, got %v", snapshot.Counters)
+	}
+	if _, ok := snapshot.Counters["memstats"]; ok {
+		t.Error("Error in takeCounterSnapshot(): expected non-numeric variables to be skipped")
+	}
+}
+
+func TestCounterHistory(t *testing.T) {
+	start := time.Now()
+	values := []float64{10, 40, 100, 100}
+	history := newCounterHistory()
+	history.take = func(now time.Time) counterSnapshot {
+		value := values[0]
+		values = values[1:]
+		return counterSnapshot{Time: now, Counters: map[string]float64{"frames": value}}
+	}
+	history.record(start.Add(-2 * time.Minute))
+	history.record(start.Add(-time.Minute))
+
+	recorder := httptest.NewRecorder()
+	history.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/counters?window=1m", nil))
+	var window counterWindow
+	if err := json.NewDecoder(recorder.Body).Decode(&window); err != nil {
+		t.Fatal(err)
+	}
+	if len(window.Counters) != 1 || window.Counters[0].Value != 100 || window.Counters[0].Delta != 60 ||
+		window.Counters[0].Rate < 0.99 || window.Counters[0].Rate > 1.01 {
+		t.Errorf("Error in ServeHTTP(): expected a delta of 60 over a minute, got %+v", window.Counters)
+	}
+
+	recorder = httptest.NewRecorder()
+	history.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/counters?window=-1m", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Error in ServeHTTP(): expected 400 for an invalid window, got %v", recorder.Code)
+	}
+}
+
+func TestFilterCounters(t *testing.T) {
+	counters := []counterDelta{
+		{Name: "conformance.ip_ttl_drops", Value: 4, Delta: 0},
+		{Name: "priority_queue.query_dropped", Value: 7, Delta: 2},
+		{Name: "ttl_floor_rewrites", Value: 3, Delta: 1},
+	}
+	if filtered := filterCounters(counters, nil, false); !reflect.DeepEqual(filtered, counters[1:]) {
+		t.Errorf("Error in filterCounters(): expected the changed counters, got %v", filtered)
+	}
+	if filtered := filterCounters(counters, []string{"conformance.", "priority_queue."}, true); !reflect.DeepEqual(filtered, counters[:2]) {
+		t.Errorf("Error in filterCounters(): expected the counters matching the prefixes, got %v", filtered)
+	}
+}
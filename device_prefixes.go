@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Suffix of the device entries matching every MAC address starting with a prefix, such as the OUI "b8:27:eb:*"
+const devicePrefixWildcard = ":*"
+
+// parseDevicePrefix returns the bytes of a device entry written as a MAC prefix, and whether the entry is one
+func parseDevicePrefix(mac macAddress) (prefix []byte, isPrefix bool, err error) {
+	if !strings.HasSuffix(string(mac), devicePrefixWildcard) {
+		return nil, false, nil
+	}
+	parts := strings.Split(strings.TrimSuffix(string(mac), devicePrefixWildcard), ":")
+	if len(parts) > 5 {
+		return nil, true, fmt.Errorf("invalid MAC prefix %q in devices, expected 1 to 5 bytes followed by %q", mac, devicePrefixWildcard)
+	}
+	for _, part := range parts {
+		b, err := hex.DecodeString(part)
+		if err != nil || len(b) != 1 {
+			return nil, true, fmt.Errorf("invalid MAC prefix %q in devices, expected 1 to 5 bytes followed by %q", mac, devicePrefixWildcard)
+		}
+		prefix = append(prefix, b[0])
+	}
+	return prefix, true, nil
+}
+
+// prefixNode is a node of the trie of the device prefixes, one byte of MAC address per level
+type prefixNode struct {
+	children map[byte]*prefixNode
+	// entry is the device entry of the prefix ending at this node, if any
+	entry macAddress
+}
+
+// devicePrefixes matches MAC addresses with the device entries written as MAC prefixes, the longest prefix winning
+type devicePrefixes struct {
+	root prefixNode
+}
+
+// newDevicePrefixes compiles the prefix entries of devices, and returns nil when there are none
+func newDevicePrefixes(devices map[macAddress]bonjourDevice) (*devicePrefixes, error) {
+	var trie *devicePrefixes
+	for mac := range devices {
+		prefix, isPrefix, err := parseDevicePrefix(mac)
+		if err != nil {
+			return nil, err
+		}
+		if !isPrefix {
+			continue
+		}
+		if trie == nil {
+			trie = &devicePrefixes{}
+		}
+		node := &trie.root
+		for _, b := range prefix {
+			if node.children == nil {
+				node.children = make(map[byte]*prefixNode)
+			}
+			child, ok := node.children[b]
+			if !ok {
+				child = &prefixNode{}
+				node.children[b] = child
+			}
+			node = child
+		}
+		if node.entry != "" {
+			return nil, fmt.Errorf("devices %q and %q are the same MAC prefix", node.entry, mac)
+		}
+		node.entry = mac
+	}
+	return trie, nil
+}
+
+// match returns the entry of the longest prefix of mac
+func (trie *devicePrefixes) match(mac net.HardwareAddr) (entry macAddress, ok bool) {
+	if trie == nil {
+		return "", false
+	}
+	node := &trie.root
+	for _, b := range mac {
+		if node = node.children[b]; node == nil {
+			break
+		}
+		if node.entry != "" {
+			entry, ok = node.entry, true
+		}
+	}
+	return entry, ok
+}
+
+// device returns the device entry of the address mac, and its key: the entry of the address itself,
+// or else the entry of the longest MAC prefix it starts with
+func (cfg *brconfig) device(mac macAddress) (macAddress, bonjourDevice, bool) {
+	if device, ok := cfg.Devices[mac]; ok {
+		return mac, device, true
+	}
+	if cfg.devicePrefixes == nil {
+		return "", bonjourDevice{}, false
+	}
+	hw, err := net.ParseMAC(string(mac))
+	if err != nil {
+		return "", bonjourDevice{}, false
+	}
+	if entry, ok := cfg.devicePrefixes.match(hw); ok {
+		// The prefixes compiled with the configuration may outlive entries removed since
+		device, ok := cfg.Devices[entry]
+		return entry, device, ok
+	}
+	return "", bonjourDevice{}, false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseDevicePrefix(t *testing.T) {
+	tests := map[macAddress]struct {
+		prefix   []byte
+		isPrefix bool
+		valid    bool
+	}{
+		"b8:27:eb:*":        {[]byte{0xb8, 0x27, 0xeb}, true, true},
+		"B8:27:EB:A1:*":     {[]byte{0xb8, 0x27, 0xeb, 0xa1}, true, true},
+		"b8:*":              {[]byte{0xb8}, true, true},
+		"b8:27:eb:01:02:03": {nil, false, true},
+		"b8:27:e:*":         {nil, true, false},
+		"b8:27:eb:*:01":     {nil, false, true},
+		"b8:27:eb:01:02:*":  {[]byte{0xb8, 0x27, 0xeb, 0x01, 0x02}, true, true},
+		"b8:27:eb:1:2:3:*":  {nil, true, false},
+	}
+	for mac, expected := range tests {
+		prefix, isPrefix, err := parseDevicePrefix(mac)
+		if isPrefix != expected.isPrefix || (err == nil) != expected.valid || string(prefix) != string(expected.prefix) {
+			t.Errorf("Error in parseDevicePrefix(%q): got %v, %v, %v", mac, prefix, isPrefix, err)
+		}
+	}
+	if _, err := parseConfig("[devices.\"b8:27:xx:*\"]\norigin_pool = 10"); err == nil || !strings.Contains(err.Error(), "invalid MAC prefix") {
+		t.Errorf("Error in parseConfig(): expected an invalid MAC prefix to be refused, got %v", err)
+	}
+	if _, err := parseConfig("[devices.\"b8:27:eb:*\"]\norigin_pool = 10\n[devices.\"B8:27:EB:*\"]\norigin_pool = 20"); err == nil {
+		t.Error("Error in parseConfig(): expected the same MAC prefix written twice to be refused")
+	}
+}
+
+func TestDevicePrefixes(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`[devices."ff:aa:*"]
+		origin_pool = %v
+		shared_pools = [42]
+		[devices."FF:AA:FA:*"]
+		origin_pool = %v
+		shared_pools = [42, 43]
+		[devices."02:00:00:00:00:01"]
+		origin_pool = 10`, vlanIdentifierTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]macAddress{
+		srcMACTest.String():  "FF:AA:FA:*",
+		"ff:aa:00:00:00:01":  "ff:aa:*",
+		"02:00:00:00:00:01":  "02:00:00:00:00:01",
+		"02:00:00:00:00:02":  "",
+		"not a mac address":  "",
+		"ff:ab:fa:aa:ff:aa":  "",
+		"ff:aa:fa:00:00:00":  "FF:AA:FA:*",
+		"FF:AA:FA:00:00:00":  "FF:AA:FA:*",
+		"ff:aa:fb:00:00:00":  "ff:aa:*",
+		"ff:aa:fa:aa:ff:a0":  "FF:AA:FA:*",
+		"ff:aa:fa:aa:ff:aa:": "",
+	}
+	for mac, expected := range tests {
+		if entry, _, _ := cfg.device(macAddress(mac)); entry != expected {
+			t.Errorf("Error in device(%q): expected entry %q, got %q", mac, expected, entry)
+		}
+	}
+
+	// The answers of the devices matching a prefix are reflected to its shared pools
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); !equalVLANs(tags, []uint16{42, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected the answer to be reflected to the pools of the longest prefix, got %v", tags)
+	}
+	for _, hit := range r.ruleHits.snapshot() {
+		if (hit.MAC == "FF:AA:FA:*") != (hit.Matches == 1) {
+			t.Errorf("Error in processBonjourPacket(): expected the match to be counted for the prefix entry, got %+v", hit)
+		}
+	}
+
+	if entry, ok := (*devicePrefixes)(nil).match(net.HardwareAddr(srcMACTest)); ok {
+		t.Errorf("Error in match(): no prefix should match without prefixes, got %q", entry)
+	}
+}
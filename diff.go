@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// settingChange is a setting whose value differs between two configurations, named by its TOML path
+type settingChange struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+// vlanPair identifies the reflection of the traffic of one VLAN into another
+type vlanPair struct {
+	From uint16 `json:"from"`
+	To   uint16 `json:"to"`
+}
+
+// configDiff holds the semantic differences between two configurations, and the VLAN pairs gaining or losing reflection
+type configDiff struct {
+	AddedDevices   []macAddress    `json:"added_devices"`
+	RemovedDevices []macAddress    `json:"removed_devices"`
+	Changes        []settingChange `json:"changes"`
+	GainedPairs    []vlanPair      `json:"gained_pairs"`
+	LostPairs      []vlanPair      `json:"lost_pairs"`
+}
+
+func (diff *configDiff) isEmpty() bool {
+	return len(diff.AddedDevices)+len(diff.RemovedDevices)+len(diff.Changes)+len(diff.GainedPairs)+len(diff.LostPairs) == 0
+}
+
+// diffConfigs compares two parsed configurations
+func diffConfigs(old, new *brconfig) configDiff {
+	diff := configDiff{
+		AddedDevices:   []macAddress{},
+		RemovedDevices: []macAddress{},
+		Changes:        diffSettings("", reflect.ValueOf(*old), reflect.ValueOf(*new)),
+	}
+	for mac := range new.Devices {
+		if _, ok := old.Devices[mac]; !ok {
+			diff.AddedDevices = append(diff.AddedDevices, mac)
+		}
+	}
+	for mac, device := range old.Devices {
+		if newDevice, ok := new.Devices[mac]; !ok {
+			diff.RemovedDevices = append(diff.RemovedDevices, mac)
+		} else {
+			prefix := fmt.Sprintf("devices.%q.", mac)
+			diff.Changes = append(diff.Changes, diffSettings(prefix, reflect.ValueOf(device), reflect.ValueOf(newDevice))...)
+		}
+	}
+	for _, tag := range unionVLANs(old.vlans, new.vlans) {
+		prefix := fmt.Sprintf("vlans.%v.", tag)
+		diff.Changes = append(diff.Changes, diffSettings(prefix, reflect.ValueOf(old.vlans[tag]), reflect.ValueOf(new.vlans[tag]))...)
+	}
+	sortMACs(diff.AddedDevices)
+	sortMACs(diff.RemovedDevices)
+	sort.Slice(diff.Changes, func(i, j int) bool { return diff.Changes[i].Setting < diff.Changes[j].Setting })
+
+	oldPairs, newPairs := reflectionPairs(old), reflectionPairs(new)
+	diff.GainedPairs = subtractPairs(newPairs, oldPairs)
+	diff.LostPairs = subtractPairs(oldPairs, newPairs)
+	return diff
+}
+
+// diffSettings compares the TOML settings of two structs, recursing into sections.
+// Devices and VLANs are compared entry by entry by diffConfigs.
+func diffSettings(prefix string, old, new reflect.Value) []settingChange {
+	changes := []settingChange{}
+	for i := 0; i < old.NumField(); i++ {
+		key := old.Type().Field(i).Tag.Get("toml")
+		if key == "" || key == "devices" || key == "vlans" {
+			continue
+		}
+		oldField, newField := old.Field(i), new.Field(i)
+		if _, ok := oldField.Interface().(fmt.Stringer); !ok && oldField.Kind() == reflect.Struct {
+			changes = append(changes, diffSettings(prefix+key+".", oldField, newField)...)
+			continue
+		}
+		if !reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			changes = append(changes, settingChange{prefix + key, formatSetting(oldField), formatSetting(newField)})
+		}
+	}
+	return changes
+}
+
+func formatSetting(value reflect.Value) string {
+	if reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface()) {
+		return "(unset)"
+	}
+	return fmt.Sprintf("%v", value.Interface())
+}
+
+func unionVLANs(old, new map[uint16]vlanConfig) []uint16 {
+	seen := make(map[uint16]bool)
+	for tag := range old {
+		seen[tag] = true
+	}
+	for tag := range new {
+		seen[tag] = true
+	}
+	tags := make([]uint16, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+func sortMACs(macs []macAddress) {
+	sort.Slice(macs, func(i, j int) bool { return macs[i] < macs[j] })
+}
+
+// reflectionPairs returns the VLAN pairs whose answers are reflected by a configuration: from the origin pool of
+// each device to its shared pools, and from the VLANs reflecting unknown devices to their default pool
+func reflectionPairs(cfg *brconfig) map[vlanPair]bool {
+	pairs := make(map[vlanPair]bool)
+	for _, device := range cfg.Devices {
+		for _, pool := range device.SharedPools {
+			if pool != device.OriginPool {
+				pairs[vlanPair{device.OriginPool, pool}] = true
+			}
+		}
+	}
+	for _, tag := range cfg.configuredVLANs() {
+		mode, defaultPool := cfg.unknownDevicePolicy(tag)
+		if mode != unknownReflectToPool {
+			continue
+		}
+		for _, pool := range defaultPool {
+			if pool != tag {
+				pairs[vlanPair{tag, pool}] = true
+			}
+		}
+	}
+	return pairs
+}
+
+// subtractPairs returns the sorted pairs of a which are not in b
+func subtractPairs(a, b map[vlanPair]bool) []vlanPair {
+	pairs := []vlanPair{}
+	for pair := range a {
+		if !b[pair] {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].From != pairs[j].From {
+			return pairs[i].From < pairs[j].From
+		}
+		return pairs[i].To < pairs[j].To
+	})
+	return pairs
+}
+
+var diffCommand = &command{
+	name:    "diff",
+	summary: "Compare two configuration files, and predict which VLAN pairs gain or lose reflection",
+	setup:   setupDiffCommand,
+}
+
+func setupDiffCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	return func(out *commandOutput, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: diff <old config> <new config>")
+		}
+		old, err := readConfig(args[0])
+		if err != nil {
+			return fmt.Errorf("could not read %v: %v", args[0], err)
+		}
+		new, err := readConfig(args[1])
+		if err != nil {
+			return fmt.Errorf("could not read %v: %v", args[1], err)
+		}
+		diff := diffConfigs(&old, &new)
+		return out.print(diff, func(w io.Writer) { printConfigDiff(w, &old, &new, diff) })
+	}
+}
+
+func printConfigDiff(w io.Writer, old, new *brconfig, diff configDiff) {
+	if diff.isEmpty() {
+		fmt.Fprintln(w, "The configurations are equivalent.")
+		return
+	}
+	for _, mac := range diff.AddedDevices {
+		device := new.Devices[mac]
+		fmt.Fprintf(w, "+ device %v: origin pool %v, shared pools %v\n", mac, device.OriginPool, device.SharedPools)
+	}
+	for _, mac := range diff.RemovedDevices {
+		device := old.Devices[mac]
+		fmt.Fprintf(w, "- device %v: origin pool %v, shared pools %v\n", mac, device.OriginPool, device.SharedPools)
+	}
+	for _, change := range diff.Changes {
+		fmt.Fprintf(w, "~ %v: %v -> %v\n", change.Setting, change.Old, change.New)
+	}
+	if len(diff.GainedPairs)+len(diff.LostPairs) == 0 {
+		fmt.Fprintln(w, "\nNo VLAN pair gains or loses reflection.")
+		return
+	}
+	fmt.Fprintln(w, "\nImpact:")
+	for _, pair := range diff.GainedPairs {
+		fmt.Fprintf(w, "  VLAN %v -> %v gains reflection\n", pair.From, pair.To)
+	}
+	for _, pair := range diff.LostPairs {
+		fmt.Fprintf(w, "  VLAN %v -> %v loses reflection\n", pair.From, pair.To)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	old, err := parseConfig(`
+net_interface = "eth0"
+[devices."AA:BB:CC:DD:EE:FF"]
+origin_pool = 10
+shared_pools = [20, 30]
+[devices."AA:00:CC:00:EE:00"]
+origin_pool = 10
+shared_pools = [20]
+`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	new, err := parseConfig(`
+net_interface = "eth0"
+unknown_device_mode = "reflect-to-default-pool"
+default_pool = [40]
+[vlans.30]
+unknown_device_mode = "drop"
+[devices."AA:BB:CC:DD:EE:FF"]
+origin_pool = 10
+shared_pools = [20]
+allowed_services = ["_airplay._tcp"]
+[devices."AA:11:CC:11:EE:11"]
+origin_pool = 40
+shared_pools = [10]
+`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+
+	diff := diffConfigs(&old, &new)
+	if len(diff.AddedDevices) != 1 || diff.AddedDevices[0] != "aa:11:cc:11:ee:11" {
+		t.Errorf("Error in diffConfigs(): unexpected added devices %v", diff.AddedDevices)
+	}
+	if len(diff.RemovedDevices) != 1 || diff.RemovedDevices[0] != "aa:00:cc:00:ee:00" {
+		t.Errorf("Error in diffConfigs(): unexpected removed devices %v", diff.RemovedDevices)
+	}
+	expectedChanges := []settingChange{
+		{"default_pool", "(unset)", "[40]"},
+		{`devices."aa:bb:cc:dd:ee:ff".allowed_services`, "(unset)", "[_airplay._tcp]"},
+		{`devices."aa:bb:cc:dd:ee:ff".shared_pools`, "[20 30]", "[20]"},
+		{"unknown_device_mode", "drop", "reflect-to-default-pool"},
+		{"vlans.30.unknown_device_mode", "(unset)", "drop"},
+	}
+	if len(diff.Changes) != len(expectedChanges) {
+		t.Fatalf("Error in diffConfigs(): got changes %v, expected %v", diff.Changes, expectedChanges)
+	}
+	for i, change := range diff.Changes {
+		if change != expectedChanges[i] {
+			t.Errorf("Error in diffConfigs(): got change %v, expected %v", change, expectedChanges[i])
+		}
+	}
+
+	// VLAN 30 does not reflect unknown devices, and only lost the answers of AA:BB:CC:DD:EE:FF
+	expectedGained := []vlanPair{{10, 40}, {20, 40}, {40, 10}}
+	if len(diff.GainedPairs) != len(expectedGained) {
+		t.Fatalf("Error in diffConfigs(): got gained pairs %v, expected %v", diff.GainedPairs, expectedGained)
+	}
+	for i, pair := range diff.GainedPairs {
+		if pair != expectedGained[i] {
+			t.Errorf("Error in diffConfigs(): got gained pair %v, expected %v", pair, expectedGained[i])
+		}
+	}
+	if len(diff.LostPairs) != 1 || diff.LostPairs[0] != (vlanPair{10, 30}) {
+		t.Errorf("Error in diffConfigs(): unexpected lost pairs %v", diff.LostPairs)
+	}
+
+	if diff := diffConfigs(&old, &old); !diff.isEmpty() {
+		t.Errorf("Error in diffConfigs(): a configuration differs from itself: %+v", diff)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Environment variable holding the API token used by the commands talking to a running reflector
+const envAPIToken = "BONJOUR_REFLECTOR_API_TOKEN"
+
+var drainedFrames = expvar.NewInt("drained_frames")
+
+type vlanDrain struct {
+	VLAN     uint16    `json:"vlan"`
+	Since    time.Time `json:"since"`
+	Goodbyes int       `json:"goodbyes"`
+}
+
+// drainedVLANs lists the VLANs nothing is injected into, e.g. during a maintenance window on their segment
+type drainedVLANs struct {
+	mutex  sync.RWMutex
+	drains map[uint16]vlanDrain
+}
+
+func newDrainedVLANs() *drainedVLANs {
+	return &drainedVLANs{drains: make(map[uint16]vlanDrain)}
+}
+
+func (drained *drainedVLANs) isDrained(tag uint16) bool {
+	drained.mutex.RLock()
+	defer drained.mutex.RUnlock()
+	_, ok := drained.drains[tag]
+	return ok
+}
+
+func (drained *drainedVLANs) list() []vlanDrain {
+	drained.mutex.RLock()
+	defer drained.mutex.RUnlock()
+	list := make([]vlanDrain, 0, len(drained.drains))
+	for _, drain := range drained.drains {
+		list = append(list, drain)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VLAN < list[j].VLAN })
+	return list
+}
+
+// frameVLAN returns the VLAN tag of an 802.1Q frame
+func frameVLAN(data []byte) (uint16, bool) {
+	if len(data) < 16 || layers.EthernetType(uint16(data[12])<<8|uint16(data[13])) != layers.EthernetTypeDot1Q {
+		return 0, false
+	}
+	return (uint16(data[14])<<8 | uint16(data[15])) & 0x0FFF, true
+}
+
+// drain stops injecting into a VLAN. With goodbyes, the services reflected to the VLAN are withdrawn first,
+// so that the hosts of the VLAN do not keep showing devices they cannot reach anymore.
+func (r *reflector) drain(tag uint16, goodbyes bool, now time.Time) vlanDrain {
+	drain := vlanDrain{VLAN: tag, Since: now}
+	if goodbyes {
+		for _, instance := range r.services.withdraw(tag, now) {
+			record := layers.DNSResourceRecord{
+				Name:  []byte(instance.Service),
+				Type:  layers.DNSTypePTR,
+				Class: layers.DNSClassIN,
+				TTL:   0,
+				PTR:   []byte(instance.Instance),
+			}
+			data, err := serializeMDNSResponse([]layers.DNSResourceRecord{record}, instance.srcIP, tag, r.brMACAddress)
+			if err != nil {
+				logger.errorf("Could not serialize goodbye for %v: %v", instance.Instance, err)
+				continue
+			}
+			r.write(data)
+			drain.Goodbyes++
+		}
+	}
+	r.drained.mutex.Lock()
+	r.drained.drains[tag] = drain
+	r.drained.mutex.Unlock()
+	logger.infof("VLAN %v drained, %v goodbyes sent", tag, drain.Goodbyes)
+	return drain
+}
+
+// resume injects into a drained VLAN again
+func (r *reflector) resume(tag uint16) bool {
+	r.drained.mutex.Lock()
+	defer r.drained.mutex.Unlock()
+	_, ok := r.drained.drains[tag]
+	delete(r.drained.drains, tag)
+	if ok {
+		logger.infof("VLAN %v resumed", tag)
+	}
+	return ok
+}
+
+// drainAPI lists the drained VLANs on /api/drains, drains a VLAN on PUT /api/drains/<vlan>[?goodbyes=true],
+// and resumes it on DELETE /api/drains/<vlan>
+type drainAPI struct {
+	reflector *reflector
+}
+
+func (api drainAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	param := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/drains"), "/")
+	if param == "" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.reflector.drained.list())
+		return
+	}
+	tag, err := strconv.ParseUint(param, 10, 12)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid VLAN tag")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		drain := api.reflector.drain(uint16(tag), r.URL.Query().Get("goodbyes") == "true", time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drain)
+	case http.MethodDelete:
+		if !api.reflector.resume(uint16(tag)) {
+			writeAPIError(w, http.StatusNotFound, "VLAN not drained")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+var drainCommand = &command{
+	name:    "drain",
+	summary: "Stop injecting into a VLAN of a running reflector, or resume it",
+	setup:   setupDrainCommand,
+}
+
+// setupDrainCommand drains the VLAN given as argument through the API, or lists the drained VLANs without argument
+func setupDrainCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:8053", "Address of the API of the running reflector, or unix:<path> of its socket")
+	token := flags.String("token", os.Getenv(envAPIToken), "API token (default from "+envAPIToken+")")
+	goodbyes := flags.Bool("goodbyes", false, "Withdraw the services reflected to the VLAN before draining it")
+	resume := flags.Bool("resume", false, "Resume injecting into the VLAN")
+
+	return func(out *commandOutput, args []string) error {
+		var drains []vlanDrain
+		var err error
+		switch {
+		case len(args) > 1:
+			return errors.New("only one VLAN can be drained at a time")
+		case len(args) == 1 && *resume:
+			drains = []vlanDrain{}
+			err = callAPI(*addr, *token, http.MethodDelete, "/api/drains/"+args[0], nil, nil)
+		case len(args) == 1:
+			var drain vlanDrain
+			err = callAPI(*addr, *token, http.MethodPut, fmt.Sprintf("/api/drains/%s?goodbyes=%v", args[0], *goodbyes), nil, &drain)
+			drains = []vlanDrain{drain}
+		default:
+			err = callAPI(*addr, *token, http.MethodGet, "/api/drains", nil, &drains)
+		}
+		if err != nil {
+			return err
+		}
+		return out.print(drains, func(w io.Writer) {
+			printDrains(w, drains)
+		})
+	}
+}
+
+func printDrains(w io.Writer, drains []vlanDrain) {
+	if len(drains) == 0 {
+		fmt.Fprintln(w, "No drained VLAN")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VLAN\tDRAINED SINCE\tGOODBYES")
+	for _, drain := range drains {
+		fmt.Fprintf(tw, "%d\t%s\t%d\n", drain.VLAN, drain.Since.Format(time.RFC3339), drain.Goodbyes)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDrainVLAN(t *testing.T) {
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42, 43}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+	now := time.Now()
+	r.services.observe(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, []uint16{vlanIdentifierTest, 42, 43}, now)
+
+	// Draining the origin VLAN of a device never withdraws its services
+	if drain := r.drain(vlanIdentifierTest, true, now); drain.Goodbyes != 0 {
+		t.Errorf("Error in drain(): %v goodbyes sent on the origin VLAN", drain.Goodbyes)
+	}
+	r.resume(vlanIdentifierTest)
+
+	if drain := r.drain(42, true, now); drain.Goodbyes != 1 {
+		t.Fatalf("Error in drain(): %v goodbyes sent, expected 1", drain.Goodbyes)
+	}
+	goodbye := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	_, payload := parseUDPLayer(goodbye)
+	_, dns := parseDNSPayload(payload)
+	if *parseVLANTag(goodbye) != 42 || dns == nil || dns.Answers[0].TTL != 0 || string(dns.Answers[0].PTR) != "Office Printer._ipp._tcp.local" {
+		t.Error("Error in drain(): invalid goodbye packet")
+	}
+	if r.services.isVisible("_ipp._tcp", "Office Printer", 42, now) {
+		t.Error("Error in drain(): withdrawn instance still visible")
+	}
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[1] != 43 {
+		t.Errorf("Error in write(): drained VLAN should not be injected into, got %v", tags)
+	}
+	if !r.resume(42) || r.resume(42) {
+		t.Error("Error in resume()")
+	}
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); len(tags) != 4 {
+		t.Errorf("Error in resume(): VLAN should be injected into again, got %v", tags)
+	}
+}
+
+func TestDrainAPI(t *testing.T) {
+	r, _ := createMockReflector(brconfig{})
+	api := drainAPI{r}
+
+	tests := []struct {
+		method, path string
+		expected     int
+	}{
+		{http.MethodPut, "/api/drains/42", http.StatusOK},
+		{http.MethodPut, "/api/drains/4096", http.StatusBadRequest},
+		{http.MethodGet, "/api/drains", http.StatusOK},
+		{http.MethodDelete, "/api/drains/42", http.StatusNoContent},
+		{http.MethodDelete, "/api/drains/42", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+		if recorder.Code != test.expected {
+			t.Errorf("Error in ServeHTTP() for %v %v: got %v, expected %v", test.method, test.path, recorder.Code, test.expected)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "expvar"
+
+// Frames which a dry run did not inject, exposed on /debug/vars
+var dryRunFrames = expvar.NewInt("dry_run_frames")
+
+// dryRunWriter is a packetWriter discarding the frames, in place of the trunk and of the egress interfaces
+type dryRunWriter struct{}
+
+func (dryRunWriter) WritePacketData(data []byte) error {
+	dryRunFrames.Add(1)
+	tag, _ := frameVLAN(data)
+	logger.log(levelDebug, "Dry run: not injecting frame", "vlan", tag, "bytes", len(data))
+	return nil
+}
+
+// logDryRun logs a packet, described by what, which would have been reflected to tags
+func (r *reflector) logDryRun(bonjourPacket *bonjourPacket, what string, services []string, tags []uint16) {
+	if !r.cfg.dryRun || len(tags) == 0 {
+		return
+	}
+	logger.log(levelInfo, "Dry run: would reflect "+what,
+		"src_mac", macAddress(bonjourPacket.srcMAC.String()),
+		"src_ip", bonjourPacket.srcIP.String(),
+		"vlan", *bonjourPacket.vlanTag,
+		"services", append([]string{}, services...),
+		"targets", append([]uint16{}, tags...),
+	)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`passthrough = ["239.255.250.250:9131"]
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.dryRun = true
+	inv, _ := loadInventory("", defaultInventorySize)
+	hits, _ := loadRuleHits("", cfg.Devices)
+	r := newReflector(cfg, inv, hits, dryRunWriter{}, brMACTest)
+	logs, restore := captureLogs("info")
+	defer restore()
+	frames := dryRunFrames.Value()
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	passthrough, _ := parsePassthroughPacket(createMockPassthroughPacket(vlanIdentifierTest, 9131), brMACTest, cfg.passthrough)
+	r.processBonjourPacket(passthrough)
+	if dryRunFrames.Value()-frames != 4 {
+		t.Errorf("Error in processBonjourPacket(): expected 4 frames not to be injected, got %v", dryRunFrames.Value()-frames)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("Dry run: would reflect mDNS answer src_mac=%v", srcMACTest),
+		"Dry run: would reflect passthrough packet",
+		"targets=42,43",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Error in processBonjourPacket(): expected %q to be logged, got %q", expected, logs.String())
+		}
+	}
+	// Frames are only logged at debug level
+	if strings.Contains(logs.String(), "not injecting frame") {
+		t.Errorf("Error in WritePacketData(): unexpected log %q", logs.String())
+	}
+}
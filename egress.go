@@ -0,0 +1,142 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Frames injected through an egress of the egress section, by destination VLAN, exposed on /debug/vars
+var egressFrames = expvar.NewMap("egress_frames")
+
+// egressConfig sends the frames reflected into a VLAN through another interface than the trunk, such as an uplink
+// whose switch port carries the VLAN untagged, and strips their VLAN tag when untagged is set
+type egressConfig struct {
+	Interface string `toml:"interface"`
+	Untagged  bool   `toml:"untagged"`
+}
+
+// parseEgress parses the egress section, keyed by destination VLAN tag
+func (cfg *brconfig) parseEgress() error {
+	cfg.egress = make(map[uint16]egressConfig)
+	for key, egress := range cfg.Egress {
+		tag, err := strconv.ParseUint(key, 10, 16)
+		if err != nil || tag == 0 || tag > 4094 {
+			return fmt.Errorf("invalid VLAN tag %q in egress section", key)
+		}
+		if egress.Interface == "" && !egress.Untagged {
+			return fmt.Errorf("egress of VLAN %v sets neither an interface nor untagged", tag)
+		}
+		cfg.egress[uint16(tag)] = egress
+	}
+	return nil
+}
+
+// egressRoute is the writer and tagging of the frames reflected into a VLAN of the egress section
+type egressRoute struct {
+	writer   packetWriter
+	untagged bool
+}
+
+// egressWriter injects the frames reflected into the VLANs of the egress section through their own interface,
+// or untagged, and the other frames through the trunk
+type egressWriter struct {
+	trunk  packetWriter
+	routes map[uint16]egressRoute
+}
+
+func (writer *egressWriter) WritePacketData(data []byte) error {
+	tag, ok := frameVLAN(data)
+	route, mapped := writer.routes[tag]
+	if !ok || !mapped {
+		return writer.trunk.WritePacketData(data)
+	}
+	if route.untagged {
+		data = stripVLANTag(data)
+	}
+	egressFrames.Add(strconv.Itoa(int(tag)), 1)
+	return route.writer.WritePacketData(data)
+}
+
+// openEgress returns the writer injecting the reflected frames, through trunk unless the egress section routes
+// their VLAN elsewhere. The interfaces of the section are opened once each with open.
+func openEgress(cfg *brconfig, trunk packetWriter, open func(intf string) (packetWriter, error)) (packetWriter, error) {
+	if len(cfg.egress) == 0 {
+		return trunk, nil
+	}
+	writer := &egressWriter{trunk: trunk, routes: make(map[uint16]egressRoute)}
+	tags := make([]uint16, 0, len(cfg.egress))
+	for tag := range cfg.egress {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	handles := make(map[string]packetWriter)
+	for _, tag := range tags {
+		egress := cfg.egress[tag]
+		route := egressRoute{writer: trunk, untagged: egress.Untagged}
+		if egress.Interface != "" && egress.Interface != cfg.NetInterface {
+			handle, ok := handles[egress.Interface]
+			if !ok {
+				var err error
+				if handle, err = open(egress.Interface); err != nil {
+					return nil, err
+				}
+				handles[egress.Interface] = handle
+			}
+			route.writer = handle
+		}
+		writer.routes[tag] = route
+		logger.infof("Frames reflected into VLAN %v are injected %v", tag, describeEgress(egress))
+	}
+	return writer, nil
+}
+
+// Close closes the handles of the egress interfaces, the trunk being closed with the capture
+func (writer *egressWriter) Close() {
+	closed := make(map[packetWriter]bool)
+	for _, route := range writer.routes {
+		if route.writer == writer.trunk || closed[route.writer] {
+			continue
+		}
+		if closer, ok := route.writer.(interface{ Close() }); ok {
+			closer.Close()
+		}
+		closed[route.writer] = true
+	}
+}
+
+func describeEgress(egress egressConfig) string {
+	intf := "through the trunk"
+	if egress.Interface != "" {
+		intf = "through " + egress.Interface
+	}
+	if egress.Untagged {
+		return "untagged " + intf
+	}
+	return intf
+}
+
+// openEgressInterface opens a pcap handle on intf for injection only
+func openEgressInterface(intf string) (packetWriter, error) {
+	handle, err := pcap.OpenLive(intf, 65536, false, time.Second)
+	if err != nil {
+		return nil, captureError(intf, fmt.Errorf("could not open egress interface %v: %v", intf, err))
+	}
+	// Nothing is read from the handle, so its filter matches no frame
+	if err := handle.SetBPFFilter("less 1"); err != nil {
+		return nil, captureError(intf, fmt.Errorf("could not apply filter on egress interface %v: %v", intf, err))
+	}
+	return handle, nil
+}
+
+// stripVLANTag returns a copy of the tagged frame, without its 802.1Q header
+func stripVLANTag(frame []byte) []byte {
+	untagged := make([]byte, len(frame)-4)
+	copy(untagged, frame[:12])
+	copy(untagged[12:], frame[16:])
+	return untagged
+}
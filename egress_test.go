@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestParseEgress(t *testing.T) {
+	cfg, err := parseConfig("[egress.1]\nuntagged = true\n\n[egress.20]\ninterface = \"eth2\"")
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	if !cfg.egress[1].Untagged || cfg.egress[20].Interface != "eth2" || cfg.egress[20].Untagged {
+		t.Errorf("Error in parseConfig(): unexpected egress settings %+v", cfg.egress)
+	}
+
+	for _, content := range []string{"[egress.abc]\nuntagged = true", "[egress.4095]\nuntagged = true", "[egress.20]\n"} {
+		if _, err := parseConfig(content); err == nil {
+			t.Errorf("Error in parseConfig(): expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestEgressWriter(t *testing.T) {
+	cfg, err := parseConfig("net_interface = \"eth0\"\n\n[egress.1]\nuntagged = true\n\n[egress.20]\ninterface = \"eth2\"\n\n[egress.30]\ninterface = \"eth2\"\nuntagged = true")
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	trunk := &mockWriter{}
+	opened := make(map[string]*mockWriter)
+	writer, err := openEgress(&cfg, trunk, func(intf string) (packetWriter, error) {
+		if opened[intf] != nil {
+			return nil, fmt.Errorf("%v opened twice", intf)
+		}
+		opened[intf] = &mockWriter{}
+		return opened[intf], nil
+	})
+	if err != nil {
+		t.Fatalf("Error in openEgress(): %v", err)
+	}
+
+	for _, tag := range []uint16{1, 10, 20, 30} {
+		writer.WritePacketData(createMockTaggedFrame(tag))
+	}
+	// VLAN 10 is not mapped, and VLAN 1 leaves untagged through the trunk
+	if len(trunk.frames) != 2 || !bytes.Equal(trunk.frames[0], stripVLANTag(createMockTaggedFrame(1))) || !bytes.Equal(trunk.frames[1], createMockTaggedFrame(10)) {
+		t.Errorf("Error in WritePacketData(): unexpected frames on the trunk %x", trunk.frames)
+	}
+	eth2 := opened["eth2"]
+	if eth2 == nil || len(eth2.frames) != 2 || !bytes.Equal(eth2.frames[0], createMockTaggedFrame(20)) ||
+		!bytes.Equal(eth2.frames[1], stripVLANTag(createMockTaggedFrame(30))) {
+		t.Errorf("Error in WritePacketData(): unexpected frames on the egress interface")
+	}
+	if _, ok := frameVLAN(stripVLANTag(createMockTaggedFrame(30))); ok {
+		t.Error("Error in stripVLANTag(): frame still tagged")
+	}
+
+	// Without egress section, frames go straight to the trunk
+	cfg, _ = parseConfig("")
+	if writer, _ := openEgress(&cfg, trunk, nil); writer != packetWriter(trunk) {
+		t.Error("Error in openEgress(): expected the trunk without egress section")
+	}
+}
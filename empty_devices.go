@@ -0,0 +1,69 @@
+package main
+
+import "fmt"
+
+// emptyDevicesMode defines how the reflector runs when the configuration lists no devices
+type emptyDevicesMode string
+
+const (
+	emptyDevicesRun         emptyDevicesMode = "run"
+	emptyDevicesFail        emptyDevicesMode = "fail"
+	emptyDevicesObserve     emptyDevicesMode = "observe"
+	emptyDevicesDefaultPool emptyDevicesMode = "reflect-to-default-pool"
+)
+
+func (mode emptyDevicesMode) isValid() bool {
+	switch mode {
+	case emptyDevicesRun, emptyDevicesFail, emptyDevicesObserve, emptyDevicesDefaultPool:
+		return true
+	}
+	return false
+}
+
+// checkEmptyDevices validates empty_devices_mode, and refuses a configuration without devices in the "fail" mode
+func (cfg *brconfig) checkEmptyDevices() error {
+	if cfg.EmptyDevicesMode == "" {
+		cfg.EmptyDevicesMode = emptyDevicesRun
+	}
+	if !cfg.EmptyDevicesMode.isValid() {
+		return fmt.Errorf("invalid empty_devices_mode %q", cfg.EmptyDevicesMode)
+	}
+	if cfg.EmptyDevicesMode == emptyDevicesDefaultPool && len(cfg.DefaultPool) == 0 {
+		return fmt.Errorf("empty_devices_mode %q requires default_pool", emptyDevicesDefaultPool)
+	}
+	if cfg.EmptyDevicesMode == emptyDevicesFail && len(cfg.Devices) == 0 {
+		return fmt.Errorf("no devices are configured, and empty_devices_mode is %q", emptyDevicesFail)
+	}
+	return nil
+}
+
+// emptyDevicesOverride returns the mode handling every device while the device table is empty, if any.
+// It takes precedence over unknown_device_mode, globally and on every VLAN.
+func (cfg *brconfig) emptyDevicesOverride() (unknownDeviceMode, bool) {
+	if len(cfg.Devices) > 0 {
+		return "", false
+	}
+	switch cfg.EmptyDevicesMode {
+	case emptyDevicesObserve:
+		return unknownQuarantine, true
+	case emptyDevicesDefaultPool:
+		return unknownReflectToPool, true
+	}
+	return "", false
+}
+
+// emptyDevicesWarning tells what the reflector does without devices, or returns an empty string when devices are configured
+func (cfg *brconfig) emptyDevicesWarning() string {
+	if len(cfg.Devices) > 0 {
+		return ""
+	}
+	switch cfg.EmptyDevicesMode {
+	case emptyDevicesObserve:
+		return "no devices are configured: observation mode, every device is quarantined in the inventory and nothing is reflected until devices are added"
+	case emptyDevicesDefaultPool:
+		return fmt.Sprintf("no devices are configured: the answers of every device are reflected to the default pool %v", cfg.DefaultPool)
+	}
+	return fmt.Sprintf("no devices are configured: only unknown devices are handled, following unknown_device_mode %q, "+
+		"set empty_devices_mode to %q, %q or %q to choose how an empty device table is handled",
+		cfg.UnknownDeviceMode, emptyDevicesFail, emptyDevicesObserve, emptyDevicesDefaultPool)
+}
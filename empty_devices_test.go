@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckEmptyDevices(t *testing.T) {
+	tests := map[string]string{
+		``:                            "",
+		`empty_devices_mode = "run"`:  "",
+		`empty_devices_mode = "fail"`: "no devices are configured",
+		`empty_devices_mode = "fail"
+		[devices."00:14:22:01:23:45"]
+		origin_pool = 30`: "",
+		`empty_devices_mode = "observe"`:                 "",
+		`empty_devices_mode = "reflect-to-default-pool"`: "requires default_pool",
+		`empty_devices_mode = "reflect-to-default-pool"
+		default_pool = [42]`: "",
+		`empty_devices_mode = "learn"`: "invalid empty_devices_mode",
+	}
+	for content, expected := range tests {
+		_, err := parseConfig(content)
+		if expected == "" && err != nil {
+			t.Errorf("Error in parseConfig(%q): unexpected error %v", content, err)
+		}
+		if expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Errorf("Error in parseConfig(%q): expected error %q, got %v", content, expected, err)
+		}
+	}
+}
+
+func TestEmptyDevicesReflection(t *testing.T) {
+	cfg, err := parseConfig(`empty_devices_mode = "reflect-to-default-pool"
+		default_pool = [42, 43]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := newCaptureRules(&cfg); len(rules.vlans) != 0 {
+		t.Errorf("Error in newCaptureRules(): every VLAN should be captured without devices, got %v", rules.vlans)
+	}
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); !equalVLANs(tags, []uint16{42, 43}) {
+		t.Errorf("Error in processBonjourPacket(): answer reflected to %v, expected the default pool", tags)
+	}
+
+	// The mode only applies while the device table is empty
+	cfg, err = parseConfig(`empty_devices_mode = "observe"
+		[devices."02:00:00:00:00:01"]
+		origin_pool = 10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer = createMockReflector(cfg)
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if len(r.inventory.list()) != 0 || cfg.emptyDevicesWarning() != "" {
+		t.Error("Error in processBonjourPacket(): unknown devices should not be quarantined when devices are configured")
+	}
+
+	// Observing quarantines every device, and reflects nothing
+	r.cfg.Devices = nil
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if entries := r.inventory.list(); len(entries) != 1 || entries[0].MAC != macAddress(srcMACTest.String()) || len(writer.frames) != 0 {
+		t.Errorf("Error in processBonjourPacket(): expected the device to be quarantined, got %+v and %v frames", entries, len(writer.frames))
+	}
+	if !strings.Contains(r.cfg.emptyDevicesWarning(), "observation mode") {
+		t.Errorf("Error in emptyDevicesWarning(): unexpected warning %q", r.cfg.emptyDevicesWarning())
+	}
+}
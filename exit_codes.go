@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Exit codes of the commands, so that supervisors and scripts can react to the common failures
+// without parsing the logs
+const (
+	exitFailure          = 1
+	exitUsage            = 2
+	exitConfigError      = 3
+	exitInterfaceMissing = 4
+	exitPermissionDenied = 5
+	exitCaptureFailure   = 6
+)
+
+// typedError is an error of a known kind, which the process exits with its own code for
+type typedError struct {
+	kind string
+	code int
+	err  error
+}
+
+func (e *typedError) Error() string {
+	return e.err.Error()
+}
+
+// configError reports a configuration which could not be read or is invalid
+func configError(err error) error {
+	return &typedError{"config", exitConfigError, err}
+}
+
+// interfaceMissingError reports a network interface which does not exist
+func interfaceMissingError(err error) error {
+	return &typedError{"interface_missing", exitInterfaceMissing, err}
+}
+
+// permissionError reports a lack of the privileges needed to capture or inject frames
+func permissionError(err error) error {
+	return &typedError{"permission_denied", exitPermissionDenied, err}
+}
+
+// captureError classifies the failure to open a capture on intf: the interface may not exist,
+// the process may not be allowed to capture on it, or the capture failed for another reason
+func captureError(intf string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*typedError); ok {
+		return err
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case os.IsPermission(err) || strings.Contains(message, "permission") || strings.Contains(message, "not permitted"):
+		return permissionError(err)
+	case !interfaceExists(intf):
+		return interfaceMissingError(err)
+	}
+	return &typedError{"capture", exitCaptureFailure, err}
+}
+
+func interfaceExists(intf string) bool {
+	_, err := net.InterfaceByName(intf)
+	return err == nil
+}
+
+// commonKind returns err with the kind shared by all the failures, such as every capture interface missing,
+// or err itself when they differ
+func commonKind(failures []error, err error) error {
+	var kind *typedError
+	for _, failure := range failures {
+		typed, ok := failure.(*typedError)
+		if !ok || (kind != nil && typed.code != kind.code) {
+			return err
+		}
+		kind = typed
+	}
+	if kind == nil {
+		return err
+	}
+	return &typedError{kind.kind, kind.code, err}
+}
+
+// exitCode returns the code the process exits with after err
+func exitCode(err error) int {
+	if typed, ok := err.(*typedError); ok {
+		return typed.code
+	}
+	return exitFailure
+}
+
+// errorKind returns the kind of err reported in the JSON output, or "error" when it is not a typed error
+func errorKind(err error) string {
+	if typed, ok := err.(*typedError); ok {
+		return typed.kind
+	}
+	return "error"
+}
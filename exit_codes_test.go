@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestCaptureError(t *testing.T) {
+	tests := []struct {
+		intf string
+		err  error
+		code int
+	}{
+		{"lo", errors.New("lo: You don't have permission to capture on that device (socket: Operation not permitted)"), exitPermissionDenied},
+		{"lo", syscall.EPERM, exitPermissionDenied},
+		{"br-missing0", errors.New("br-missing0: No such device exists (SIOCGIFHWADDR: No such device)"), exitInterfaceMissing},
+		{"lo", errors.New("lo: buffer size too small"), exitCaptureFailure},
+	}
+	for _, test := range tests {
+		if code := exitCode(captureError(test.intf, test.err)); code != test.code {
+			t.Errorf("Error in captureError(): expected code %v for %q on %v, got %v", test.code, test.err, test.intf, code)
+		}
+	}
+	if captureError("lo", nil) != nil {
+		t.Error("Error in captureError(): no error should stay nil")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(errors.New("unexpected")); code != exitFailure {
+		t.Errorf("Error in exitCode(): expected %v for an untyped error, got %v", exitFailure, code)
+	}
+	if code, kind := exitCode(configError(errors.New("invalid"))), errorKind(configError(errors.New("invalid"))); code != exitConfigError || kind != "config" {
+		t.Errorf("Error in exitCode(): expected %v (config) for a configuration error, got %v (%v)", exitConfigError, code, kind)
+	}
+
+	missing := []error{interfaceMissingError(errors.New("eth1")), interfaceMissingError(errors.New("eth2"))}
+	if code := exitCode(commonKind(missing, fmt.Errorf("could not open any capture interface"))); code != exitInterfaceMissing {
+		t.Errorf("Error in commonKind(): expected %v when every interface is missing, got %v", exitInterfaceMissing, code)
+	}
+	mixed := append(missing, permissionError(errors.New("eth3")))
+	if code := exitCode(commonKind(mixed, fmt.Errorf("could not open any capture interface"))); code != exitFailure {
+		t.Errorf("Error in commonKind(): expected %v for failures of different kinds, got %v", exitFailure, code)
+	}
+}
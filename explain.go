@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of hypothetical packets
+const (
+	explainQuery  = "query"
+	explainAnswer = "answer"
+)
+
+// Outcomes of the steps of a decision
+const (
+	stepPass     = "pass"
+	stepRestrict = "restrict"
+	stepDrop     = "drop"
+	stepNote     = "note"
+)
+
+// hypotheticalPacket describes an mDNS packet by its sender, its VLAN, the service type it is about,
+// and whether it is a query or an answer
+type hypotheticalPacket struct {
+	Device  macAddress `json:"device"`
+	VLAN    uint16     `json:"vlan"`
+	Service string     `json:"service"`
+	Kind    string     `json:"kind"`
+}
+
+// decisionStep is a step of the decision: the VLANs left after it, and why
+type decisionStep struct {
+	Step    string   `json:"step"`
+	Outcome string   `json:"outcome"`
+	Detail  string   `json:"detail"`
+	VLANs   []uint16 `json:"vlans"`
+}
+
+// packetDecision is the decision the reflector would make for a hypothetical packet, step by step
+type packetDecision struct {
+	Packet  hypotheticalPacket `json:"packet"`
+	Steps   []decisionStep     `json:"steps"`
+	Targets []uint16           `json:"targets"`
+}
+
+func (decision *packetDecision) step(step, outcome string, vlans []uint16, format string, args ...interface{}) {
+	decision.Steps = append(decision.Steps, decisionStep{Step: step, Outcome: outcome, Detail: fmt.Sprintf(format, args...), VLANs: append([]uint16{}, vlans...)})
+	decision.Targets = append([]uint16{}, vlans...)
+}
+
+func parseHypotheticalPacket(query url.Values) (hypotheticalPacket, error) {
+	var packet hypotheticalPacket
+	mac, err := net.ParseMAC(query.Get("device"))
+	if err != nil {
+		return packet, errors.New("invalid device MAC address")
+	}
+	tag, err := strconv.ParseUint(query.Get("vlan"), 10, 12)
+	if err != nil || tag < minVLANID || tag > maxVLANID {
+		return packet, errors.New("invalid VLAN tag")
+	}
+	if query.Get("service") == "" {
+		return packet, errors.New("service is required, such as _airplay._tcp")
+	}
+	packet = hypotheticalPacket{Device: macAddress(mac.String()), VLAN: uint16(tag), Service: fullServiceName(query.Get("service")), Kind: query.Get("kind")}
+	if packet.Kind == "" {
+		packet.Kind = explainAnswer
+	}
+	if packet.Kind != explainQuery && packet.Kind != explainAnswer {
+		return packet, fmt.Errorf("kind must be %q or %q", explainQuery, explainAnswer)
+	}
+	return packet, nil
+}
+
+// explain returns the decision the reflector would make for packet with its current configuration and state,
+// without recording anything. The policy module and the checks of the records themselves, such as the addresses
+// and TTLs of the answers, are not evaluated.
+func (r *reflector) explain(packet hypotheticalPacket, now time.Time) packetDecision {
+	decision := packetDecision{Packet: packet, Steps: []decisionStep{}, Targets: []uint16{}}
+	var tags []uint16
+	if packet.Kind == explainQuery {
+		tags = r.explainQueryTargets(&decision)
+	} else {
+		tags = r.explainAnswerTargets(&decision)
+	}
+	if len(tags) == 0 {
+		return decision
+	}
+
+	from := r.cfg.sourceDomain(packet.Device, packet.VLAN)
+	var allowed, refused []uint16
+	for _, tag := range tags {
+		to := r.cfg.vlanDomain(tag)
+		if r.cfg.allowsFlow(from, to) || (packet.Kind == explainQuery && r.cfg.allowsFlow(to, from)) {
+			allowed = append(allowed, tag)
+		} else {
+			refused = append(refused, tag)
+		}
+	}
+	if len(refused) > 0 {
+		decision.step("compliance", restrictionOutcome(allowed), allowed, "the flows from domain %q into VLANs %v are not allowed", domainName(from), refused)
+		if tags = allowed; len(tags) == 0 {
+			return decision
+		}
+	}
+	if tags = r.explainGuestPreset(&decision, tags, now); len(tags) == 0 {
+		return decision
+	}
+	if r.policy != nil {
+		decision.step("policy", stepNote, tags, "the policy module may narrow down the VLANs, it is not evaluated for hypothetical packets")
+	}
+
+	var injected, drained, yielded []uint16
+	for _, tag := range tags {
+		switch {
+		case r.drained.isDrained(tag):
+			drained = append(drained, tag)
+		case r.peers.yields(tag, now):
+			yielded = append(yielded, tag)
+		default:
+			injected = append(injected, tag)
+		}
+	}
+	if len(drained) > 0 {
+		decision.step("drain", restrictionOutcome(injected), injected, "VLANs %v are drained", drained)
+	}
+	if len(yielded) > 0 {
+		decision.step("peer_partitioning", restrictionOutcome(injected), injected, "VLANs %v are served by a peer with a lower ID", yielded)
+	}
+	if len(injected) > 0 && now.Before(r.warmUpUntil) {
+		decision.step("warm_up", stepDrop, nil, "the reflector is warming up until %v", r.warmUpUntil.Format(time.RFC3339))
+	}
+	return decision
+}
+
+// explainQueryTargets explains the VLANs a query is reflected to, like queryTargets
+func (r *reflector) explainQueryTargets(decision *packetDecision) []uint16 {
+	packet := decision.Packet
+	tags := r.poolsMap[packet.VLAN]
+	if len(tags) == 0 {
+		decision.step("pools", stepDrop, nil, "no device of VLAN %v is shared with other VLANs", packet.VLAN)
+		return nil
+	}
+	decision.step("pools", stepPass, tags, "devices of VLANs %v are shared with VLAN %v", tags, packet.VLAN)
+	var allowed, restricted []uint16
+	for _, tag := range tags {
+		if isQueryAllowed(r.querierRestrictions, poolPair{from: packet.VLAN, to: tag}, packet.Device) {
+			allowed = append(allowed, tag)
+		} else {
+			restricted = append(restricted, tag)
+		}
+	}
+	if len(restricted) > 0 {
+		decision.step("allowed_queriers", restrictionOutcome(allowed), allowed, "the devices of VLANs %v only answer their allowed queriers", restricted)
+	}
+	return allowed
+}
+
+// explainAnswerTargets explains the VLANs an answer is reflected to, like answerTargets
+func (r *reflector) explainAnswerTargets(decision *packetDecision) []uint16 {
+	packet := decision.Packet
+	_, device, ok := r.cfg.device(packet.Device)
+	if !ok {
+		mode, defaultPool := r.cfg.unknownDevicePolicy(packet.VLAN)
+		if mode == unknownReflectToPool && len(defaultPool) > 0 {
+			decision.step("unknown_device", stepPass, defaultPool, "unknown devices of VLAN %v are reflected to the default pool", packet.VLAN)
+			return defaultPool
+		}
+		decision.step("unknown_device", stepDrop, nil, "%v is not configured, and the unknown devices of VLAN %v are handled with mode %q", packet.Device, packet.VLAN, mode)
+		return nil
+	}
+	if !device.allowsService(packet.Service) {
+		decision.step("allowed_services", stepDrop, nil, "%v may only advertise %v", packet.Device, device.AllowedServices)
+		return nil
+	}
+	if len(device.SharedPools) == 0 {
+		decision.step("shared_pools", stepDrop, nil, "%v is not shared with any VLAN", packet.Device)
+		return nil
+	}
+	decision.step("shared_pools", stepPass, device.SharedPools, "%v is shared with VLANs %v", packet.Device, device.SharedPools)
+	if len(device.AllowedQueriers) > 0 {
+		decision.step("allowed_queriers", stepNote, device.SharedPools, "answers only reach the VLANs where one of %v recently asked", device.AllowedQueriers)
+	}
+	return device.SharedPools
+}
+
+// explainGuestPreset explains the VLANs left by the guest preset, like filterQuery and filterAnswer
+func (r *reflector) explainGuestPreset(decision *packetDecision, tags []uint16, now time.Time) []uint16 {
+	packet := decision.Packet
+	if packet.Kind == explainAnswer && r.cfg.isGuestVLAN(packet.VLAN) {
+		decision.step("guest_preset", stepDrop, nil, "VLAN %v uses the %q preset, the answers of its clients are not reflected", packet.VLAN, vlanPresetGuest)
+		return nil
+	}
+	var allowed, guests []uint16
+	for _, tag := range tags {
+		if r.cfg.isGuestVLAN(tag) && (packet.Kind == explainQuery || !r.guests.isSolicited(tag, []string{packet.Service}, now)) {
+			guests = append(guests, tag)
+		} else {
+			allowed = append(allowed, tag)
+		}
+	}
+	if len(guests) > 0 {
+		detail := "the clients of guest VLANs %v are not queried"
+		if packet.Kind == explainAnswer {
+			detail = "no client of guest VLANs %v recently asked for this service"
+		}
+		decision.step("guest_preset", restrictionOutcome(allowed), allowed, detail, guests)
+	}
+	return allowed
+}
+
+// restrictionOutcome returns the outcome of a step leaving tags
+func restrictionOutcome(tags []uint16) string {
+	if len(tags) == 0 {
+		return stepDrop
+	}
+	return stepRestrict
+}
+
+// explainAPI explains the decision for a hypothetical packet on GET /api/explain?device=<mac>&vlan=<tag>&service=<type>[&kind=query]
+type explainAPI struct {
+	reflector *reflector
+}
+
+func (api explainAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	packet, err := parseHypotheticalPacket(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	api.reflector.configMutex.RLock()
+	decision := api.reflector.explain(packet, time.Now())
+	api.reflector.configMutex.RUnlock()
+	json.NewEncoder(w).Encode(decision)
+}
+
+var explainCommand = &command{
+	name:    "explain",
+	summary: "Explain how a hypothetical packet would be reflected",
+	setup:   setupExplainCommand,
+}
+
+// setupExplainCommand explains the decision of a running reflector through the API, or of a configuration file
+// with -config, e.g. to validate a change before deploying it
+func setupExplainCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:8053", "Address of the API of the running reflector, or unix:<path> of its socket")
+	token := flags.String("token", os.Getenv(envAPIToken), "API token (default from "+envAPIToken+")")
+	configPath := flags.String("config", "", "Explain the decision of this config file rather than of the running reflector")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+	device := flags.String("device", "", "MAC address of the sender")
+	vlan := flags.Uint("vlan", 0, "VLAN the packet is received on")
+	service := flags.String("service", "", "Service type asked for or advertised, such as _airplay._tcp")
+	query := flags.Bool("query", false, "Explain a query rather than an answer")
+
+	return func(out *commandOutput, args []string) error {
+		values := url.Values{"device": {*device}, "vlan": {fmt.Sprint(*vlan)}, "service": {*service}, "kind": {explainAnswer}}
+		if *query {
+			values.Set("kind", explainQuery)
+		}
+		packet, err := parseHypotheticalPacket(values)
+		if err != nil {
+			return err
+		}
+		var decision packetDecision
+		if *configPath == "" {
+			err = callAPI(*addr, *token, http.MethodGet, "/api/explain?"+values.Encode(), nil, &decision)
+		} else {
+			decision, err = explainConfig(*configPath, *profile, packet)
+		}
+		if err != nil {
+			return err
+		}
+		return out.print(decision, func(w io.Writer) { printDecision(w, decision) })
+	}
+}
+
+// explainConfig explains the decision of a reflector freshly started with the configuration at path
+func explainConfig(path, profile string, packet hypotheticalPacket) (packetDecision, error) {
+	cfg, err := readProfile(path, profile)
+	if err != nil {
+		return packetDecision{}, configError(fmt.Errorf("could not read configuration: %v", err))
+	}
+	cfg.WarmUp.Duration = 0
+	inv, err := loadInventory("", defaultInventorySize)
+	if err != nil {
+		return packetDecision{}, err
+	}
+	hits, err := loadRuleHits("", cfg.Devices)
+	if err != nil {
+		return packetDecision{}, err
+	}
+	return newReflector(cfg, inv, hits, nil, nil).explain(packet, time.Now()), nil
+}
+
+func printDecision(w io.Writer, decision packetDecision) {
+	packet := decision.Packet
+	fmt.Fprintf(w, "mDNS %v about %v from %v on VLAN %v:\n\n", packet.Kind, packet.Service, packet.Device, packet.VLAN)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tOUTCOME\tVLANS\tDETAIL")
+	for _, step := range decision.Steps {
+		vlans := formatVLANList(step.VLANs)
+		if vlans == "" {
+			vlans = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", step.Step, step.Outcome, vlans, step.Detail)
+	}
+	tw.Flush()
+	if len(decision.Targets) == 0 {
+		fmt.Fprintln(w, "\nNot reflected")
+		return
+	}
+	fmt.Fprintf(w, "\nReflected into VLANs %v\n", formatVLANList(decision.Targets))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const explainConfigTest = `
+unknown_device_mode = "drop"
+[compliance]
+allowed_flows = ["corporate -> guest"]
+[vlans.30]
+domain = "guest"
+[vlans.50]
+unknown_device_mode = "reflect-to-default-pool"
+default_pool = [60]
+[devices."aa:bb:cc:dd:ee:ff"]
+origin_pool = 10
+shared_pools = [30]
+domain = "corporate"
+allowed_services = ["_airplay._tcp"]
+[devices."aa:00:cc:00:ee:00"]
+origin_pool = 40
+shared_pools = [20]
+allowed_queriers = ["11:22:33:44:55:66"]
+`
+
+func TestExplain(t *testing.T) {
+	cfg, err := parseConfig(explainConfigTest)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	r, writer := createMockReflector(cfg)
+	r.drain(20, false, time.Now())
+
+	tests := []struct {
+		packet  hypotheticalPacket
+		steps   []string
+		targets []uint16
+	}{
+		{hypotheticalPacket{"aa:bb:cc:dd:ee:ff", 10, "_airplay._tcp.local", explainAnswer}, []string{"shared_pools"}, []uint16{30}},
+		{hypotheticalPacket{"aa:bb:cc:dd:ee:ff", 10, "_ipp._tcp.local", explainAnswer}, []string{"allowed_services"}, nil},
+		{hypotheticalPacket{"aa:00:cc:00:ee:00", 40, "_ipp._tcp.local", explainAnswer}, []string{"shared_pools", "allowed_queriers", "drain"}, nil},
+		{hypotheticalPacket{"02:00:00:00:00:01", 10, "_ipp._tcp.local", explainAnswer}, []string{"unknown_device"}, nil},
+		{hypotheticalPacket{"02:00:00:00:00:01", 50, "_ipp._tcp.local", explainAnswer}, []string{"unknown_device"}, []uint16{60}},
+		{hypotheticalPacket{"02:00:00:00:00:01", 20, "_ipp._tcp.local", explainQuery}, []string{"pools", "allowed_queriers"}, nil},
+		{hypotheticalPacket{"11:22:33:44:55:66", 20, "_ipp._tcp.local", explainQuery}, []string{"pools"}, []uint16{40}},
+		{hypotheticalPacket{"02:00:00:00:00:01", 30, "_ipp._tcp.local", explainQuery}, []string{"pools", "compliance"}, nil},
+		{hypotheticalPacket{"02:00:00:00:00:01", 60, "_ipp._tcp.local", explainQuery}, []string{"pools"}, nil},
+	}
+	for _, test := range tests {
+		decision := r.explain(test.packet, time.Now())
+		var steps []string
+		for _, step := range decision.Steps {
+			steps = append(steps, step.Step)
+		}
+		if !reflect.DeepEqual(steps, test.steps) || !equalVLANs(decision.Targets, test.targets) {
+			t.Errorf("Error in explain() for %+v: got steps %v and targets %v, expected %v and %v", test.packet, steps, decision.Targets, test.steps, test.targets)
+		}
+	}
+	// Explaining records nothing
+	if len(writer.frames) != 0 || len(r.inventory.list()) != 0 {
+		t.Error("Error in explain(): hypothetical packets should not be reflected nor recorded")
+	}
+
+	api := explainAPI{r}
+	for query, status := range map[string]int{
+		"device=aa:bb:cc:dd:ee:ff&vlan=10&service=_airplay._tcp":            http.StatusOK,
+		"device=aa:bb:cc:dd:ee:ff&vlan=10&service=_airplay._tcp&kind=query": http.StatusOK,
+		"device=aa:bb:cc:dd:ee:ff&vlan=4095&service=_airplay._tcp":          http.StatusBadRequest,
+		"device=aa:bb:cc:dd:ee:ff&vlan=10":                                  http.StatusBadRequest,
+		"device=aa:bb:cc:dd:ee:ff&vlan=10&service=_airplay._tcp&kind=probe": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/explain?"+query, nil))
+		if w.Code != status {
+			t.Errorf("Error in explainAPI: %v answered %v, expected %v", query, w.Code, status)
+		}
+	}
+}
+
+func TestExplainCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	ioutil.WriteFile(path, []byte(explainConfigTest), 0644)
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"explain", "-config", path, "-device", "AA:00:CC:00:EE:00", "-vlan", "40", "-service", "_ipp._tcp"}
+	if code := runCommandLine(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in explain command: exit code %v, %v", code, stderr.String())
+	}
+	// The drains of the running reflector do not apply to a configuration file
+	if !strings.Contains(stdout.String(), "allowed_queriers") || !strings.Contains(stdout.String(), "Reflected into VLANs 20") {
+		t.Errorf("Error in explain command: unexpected output %v", stdout.String())
+	}
+	stdout.Reset()
+	args = []string{"explain", "-config", path, "-device", "aa:bb:cc:dd:ee:ff", "-vlan", "10", "-service", "_ipp._tcp"}
+	if code := runCommandLine(args, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "Not reflected") {
+		t.Errorf("Error in explain command: expected the service to be filtered, got %v", stdout.String())
+	}
+}
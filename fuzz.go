@@ -0,0 +1,64 @@
+//go:build gofuzz
+// +build gofuzz
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The fuzz targets, of go-fuzz (gofuzz.go) and of go test -fuzz (fuzz_go118_test.go), check the following invariants
+// on arbitrary input, starting from the corpus of testdata/gofuzz. TestFuzzCorpus checks them on the corpus.
+// They are only built with the gofuzz tag, which go-fuzz-build sets, so that they stay out of the reflector.
+
+// Address of the reflector and VLAN the fuzzed frames are reflected to
+var (
+	fuzzMACAddress = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	fuzzVLAN       = uint16(4000)
+)
+
+// checkDNSPayload parses data as a DNS payload, and reports whether it is one. A message which gopacket can
+// serialize must then be parsed back.
+func checkDNSPayload(data []byte) (bool, error) {
+	_, dns := parseDNSPayload(data)
+	if dns == nil {
+		return false, nil
+	}
+	message, err := serializeDNS(dns)
+	if err != nil {
+		// The reflector injects the original payload of the messages it cannot serialize
+		return true, nil
+	}
+	if _, reparsed := parseDNSPayload(message); reparsed == nil {
+		return true, fmt.Errorf("serialized message cannot be parsed back: %x", message)
+	}
+	return true, nil
+}
+
+// checkReflection parses data as a captured frame, and reports whether it is an mDNS packet. Its reflection,
+// with the original payload and with the serialized DNS layer, must be a frame of the reflector into fuzzVLAN.
+func checkReflection(data []byte) (bool, error) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	bonjourPacket, ok := parseBonjourPacket(packet, fuzzMACAddress)
+	if !ok || bonjourPacket.vlanTag == nil {
+		return false, nil
+	}
+	for _, rewritten := range []bool{false, bonjourPacket.dns != nil} {
+		bonjourPacket.dnsRewritten = rewritten
+		frame := serializeBonjourPacket(&bonjourPacket, fuzzVLAN, fuzzMACAddress)
+		if frame == nil && rewritten {
+			// Rewritten messages which cannot be serialized back are not reflected
+			continue
+		}
+		reflected := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		ethernet, ok := reflected.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if tag := parseVLANTag(reflected); !ok || tag == nil || *tag != fuzzVLAN || ethernet.SrcMAC.String() != fuzzMACAddress.String() {
+			return true, fmt.Errorf("reflected frame is not sent by the reflector into VLAN %v: %x", fuzzVLAN, frame)
+		}
+	}
+	return true, nil
+}
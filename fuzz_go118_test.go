@@ -0,0 +1,30 @@
+//go:build go1.18 && gofuzz
+// +build go1.18,gofuzz
+
+package main
+
+import "testing"
+
+// Run with go test -fuzz=FuzzParseDNSPayload, the inputs breaking an invariant being saved in testdata/fuzz
+func FuzzParseDNSPayload(f *testing.F) {
+	for _, data := range readFuzzCorpus(f, "dns") {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := checkDNSPayload(data); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// Run with go test -fuzz=FuzzReflection
+func FuzzReflection(f *testing.F) {
+	for _, data := range readFuzzCorpus(f, "frame") {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := checkReflection(data); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+//go:build gofuzz
+// +build gofuzz
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// readFuzzCorpus returns the inputs of the go-fuzz corpus of target in testdata/gofuzz
+func readFuzzCorpus(t testing.TB, target string) [][]byte {
+	paths, err := filepath.Glob(filepath.Join("testdata", "gofuzz", target, "corpus", "*"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Error in readFuzzCorpus(): no %v corpus found (%v)", target, err)
+	}
+	inputs := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, data)
+	}
+	return inputs
+}
+
+func TestFuzzCorpus(t *testing.T) {
+	for _, data := range readFuzzCorpus(t, "dns") {
+		if parsed, err := checkDNSPayload(data); !parsed || err != nil {
+			t.Errorf("Error in checkDNSPayload(): expected %x to be parsed (%v)", data, err)
+		}
+	}
+	for _, data := range readFuzzCorpus(t, "frame") {
+		if parsed, err := checkReflection(data); !parsed || err != nil {
+			t.Errorf("Error in checkReflection(): expected %x to be reflected (%v)", data, err)
+		}
+	}
+	// Truncated frames must not break the parser
+	for _, data := range readFuzzCorpus(t, "frame") {
+		for size := 0; size < len(data); size += 7 {
+			if _, err := checkReflection(data[:size]); err != nil {
+				t.Errorf("Error in checkReflection(): %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build gofuzz
+// +build gofuzz
+
+package main
+
+// FuzzDNS is the go-fuzz target of the DNS payload parser, run with the corpus of testdata/gofuzz/dns
+func FuzzDNS(data []byte) int {
+	return fuzzResult(checkDNSPayload(data))
+}
+
+// FuzzFrame is the go-fuzz target of the parsing and reflection of captured frames, run with the corpus
+// of testdata/gofuzz/frame
+func FuzzFrame(data []byte) int {
+	return fuzzResult(checkReflection(data))
+}
+
+// fuzzResult crashes on a broken invariant, and gives priority to the inputs which could be parsed
+func fuzzResult(parsed bool, err error) int {
+	if err != nil {
+		panic(err)
+	}
+	if parsed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Each directory of testdata/golden holds a configuration, the frames captured on the trunk (input.pcap),
+// and the frames the reflector must inject when they are replayed (expected.pcap)
+var updateGolden = flag.Bool("update-golden", false, "Write the injected frames to the expected.pcap files of testdata/golden")
+
+func TestGoldenOutputs(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("Error in TestGoldenOutputs(): no test case found (%v)", err)
+	}
+	for _, dir := range dirs {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "config.toml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := parseConfig(string(content))
+		if err != nil {
+			t.Errorf("Error in parseConfig() for %v: %v", dir, err)
+			continue
+		}
+		input, err := readCaptureFile(filepath.Join(dir, "input.pcap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		injected, err := replayFrames(cfg, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The order of the frames reflected to several VLANs depends on the iteration order of maps
+		sort.Slice(injected, func(i, j int) bool { return bytes.Compare(injected[i], injected[j]) < 0 })
+
+		expectedPath := filepath.Join(dir, "expected.pcap")
+		if *updateGolden {
+			if err := writeCaptureFile(expectedPath, injected); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := readCaptureFile(expectedPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := diffFrames(injected, expected); diff != "" {
+			t.Errorf("Error in replayFrames() for %v, run go test -update-golden if the change is intended:\n%s", dir, diff)
+		}
+	}
+}
+
+// diffFrames describes the differences between the injected and the expected frames, or returns an empty string
+func diffFrames(injected, expected [][]byte) string {
+	if len(injected) != len(expected) {
+		return fmt.Sprintf("%v frames injected, %v expected", len(injected), len(expected))
+	}
+	for i := range injected {
+		if !bytes.Equal(injected[i], expected[i]) {
+			return fmt.Sprintf("frame %v differs:\ngot %v\nexpected %v", i,
+				gopacket.NewPacket(injected[i], layers.LayerTypeEthernet, gopacket.Default).Dump(),
+				gopacket.NewPacket(expected[i], layers.LayerTypeEthernet, gopacket.Default).Dump())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Preset of the VLANs whose clients discover the shared devices without being discoverable themselves
+const vlanPresetGuest = "guest"
+
+// Reflections suppressed by the guest preset, per reason, exposed on /debug/vars
+var guestSuppressed = expvar.NewMap("guest_suppressed")
+
+// isGuestVLAN tells whether the VLAN tag uses the guest preset
+func (cfg *brconfig) isGuestVLAN(tag uint16) bool {
+	return cfg.vlans[tag].Preset == vlanPresetGuest
+}
+
+// checkGuestVLANs refuses the devices of guest VLANs shared with other VLANs, since nothing is discovered on guest VLANs
+func (cfg *brconfig) checkGuestVLANs() error {
+	for mac, device := range cfg.Devices {
+		if cfg.isGuestVLAN(device.OriginPool) && len(device.SharedPools) > 0 {
+			return fmt.Errorf("device %v cannot be shared: VLAN %v uses the %q preset", mac, device.OriginPool, vlanPresetGuest)
+		}
+	}
+	return nil
+}
+
+// Maximal number of questions remembered for the guest VLANs, the expired ones being forgotten beyond
+const maxGuestQuestions = 4096
+
+// guestQuestion is a name asked for on a guest VLAN
+type guestQuestion struct {
+	vlan uint16
+	name string
+}
+
+// guestQueries remembers the names last asked for on each guest VLAN. Guest VLANs only receive the answers
+// about a name for solicitation_window after one of their clients asked for it, so that the announcements
+// of the shared devices are not reflected into them unsolicited.
+type guestQueries struct {
+	mutex  sync.Mutex
+	window time.Duration
+	asked  map[guestQuestion]time.Time
+}
+
+func newGuestQueries(window time.Duration) *guestQueries {
+	return &guestQueries{window: window, asked: make(map[guestQuestion]time.Time)}
+}
+
+// isSolicited tells whether a client of the guest VLAN tag recently asked for one of names
+func (guests *guestQueries) isSolicited(tag uint16, names []string, now time.Time) bool {
+	guests.mutex.Lock()
+	defer guests.mutex.Unlock()
+	for _, name := range names {
+		asked, ok := guests.asked[guestQuestion{tag, strings.ToLower(name)}]
+		if ok && now.Sub(asked) <= guests.window {
+			return true
+		}
+	}
+	return false
+}
+
+// record remembers the questions of a query sent on the guest VLAN tag
+func (guests *guestQueries) record(tag uint16, dns *layers.DNS, now time.Time) {
+	guests.mutex.Lock()
+	defer guests.mutex.Unlock()
+	if len(guests.asked) >= maxGuestQuestions {
+		for question, asked := range guests.asked {
+			if now.Sub(asked) > guests.window {
+				delete(guests.asked, question)
+			}
+		}
+	}
+	for _, question := range dns.Questions {
+		key := guestQuestion{tag, strings.ToLower(string(question.Name))}
+		if _, ok := guests.asked[key]; ok || len(guests.asked) < maxGuestQuestions {
+			guests.asked[key] = now
+		}
+	}
+}
+
+// filterQuery records the queries of guest VLANs, and removes the guest VLANs from the targets of a query
+// received on the VLAN srcVLAN, so that the clients of guest VLANs are never asked about their services
+func (guests *guestQueries) filterQuery(cfg *brconfig, srcVLAN uint16, dns *layers.DNS, tags []uint16, now time.Time) []uint16 {
+	if cfg.isGuestVLAN(srcVLAN) && dns != nil {
+		guests.record(srcVLAN, dns, now)
+	}
+	var allowed []uint16
+	for _, tag := range tags {
+		if cfg.isGuestVLAN(tag) {
+			guestSuppressed.Add("queries", 1)
+			continue
+		}
+		allowed = append(allowed, tag)
+	}
+	return allowed
+}
+
+// filterAnswer drops the answers sent on guest VLANs, and removes from the targets of an answer
+// the guest VLANs where no client recently asked for one of its records
+func (guests *guestQueries) filterAnswer(cfg *brconfig, srcVLAN uint16, dns *layers.DNS, tags []uint16, now time.Time) []uint16 {
+	if cfg.isGuestVLAN(srcVLAN) {
+		if len(tags) > 0 {
+			guestSuppressed.Add("guest_answers", 1)
+		}
+		return nil
+	}
+	var names []string
+	if dns != nil {
+		for _, answer := range dns.Answers {
+			names = append(names, string(answer.Name))
+		}
+	}
+	var allowed []uint16
+	for _, tag := range tags {
+		if cfg.isGuestVLAN(tag) && !guests.isSolicited(tag, names, now) {
+			guestSuppressed.Add("unsolicited_answers", 1)
+			continue
+		}
+		allowed = append(allowed, tag)
+	}
+	return allowed
+}
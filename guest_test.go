@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestGuestPreset(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`
+		[vlans."42"]
+		preset = "guest"
+		[devices."%v"]
+		origin_pool = %v
+		shared_pools = [42, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer := createMockReflector(cfg)
+
+	// Announcements are not reflected into the guest VLAN before a guest asks
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if !equalVLANs(writer.vlanTags(), []uint16{43}) {
+		t.Errorf("Error in processBonjourPacket(): expected the unsolicited answer to skip the guest VLAN, got %v", writer.vlanTags())
+	}
+	query := createMockBonjourPacket(true)
+	tag := uint16(42)
+	query.vlanTag = &tag
+	r.processBonjourPacket(query)
+	if !equalVLANs(writer.vlanTags(), []uint16{43, vlanIdentifierTest}) {
+		t.Errorf("Error in processBonjourPacket(): expected the guest query to be reflected, got %v", writer.vlanTags())
+	}
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if !equalVLANs(writer.vlanTags(), []uint16{43, vlanIdentifierTest, 42, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected the solicited answer to reach the guest VLAN, got %v", writer.vlanTags())
+	}
+	answer := createMockBonjourPacket(false)
+	later := time.Now().Add(cfg.SolicitationWindow.Duration + time.Second)
+	if tags := r.guests.filterAnswer(&r.cfg, vlanIdentifierTest, answer.dns, []uint16{42, 43}, later); !reflect.DeepEqual(tags, []uint16{43}) {
+		t.Errorf("Error in filterAnswer(): expected the solicitation to expire, got %v", tags)
+	}
+	// The query only solicits the answers about the names it asked for
+	other := &layers.DNS{QR: true, Answers: []layers.DNSResourceRecord{{Name: []byte("_airplay._tcp.local"), Type: layers.DNSTypePTR}}}
+	if tags := r.guests.filterAnswer(&r.cfg, vlanIdentifierTest, other, []uint16{42, 43}, time.Now()); !reflect.DeepEqual(tags, []uint16{43}) {
+		t.Errorf("Error in filterAnswer(): expected the answer about another name to skip the guest VLAN, got %v", tags)
+	}
+
+	// Nothing is discovered on the guest VLAN
+	if tags := r.guests.filterAnswer(&r.cfg, 42, answer.dns, []uint16{43}, time.Now()); len(tags) != 0 {
+		t.Errorf("Error in filterAnswer(): expected the answers of guests to be dropped, got %v", tags)
+	}
+	if tags := r.guests.filterQuery(&r.cfg, 43, query.dns, []uint16{42, vlanIdentifierTest}, time.Now()); !reflect.DeepEqual(tags, []uint16{vlanIdentifierTest}) {
+		t.Errorf("Error in filterQuery(): expected the guest VLAN not to be queried, got %v", tags)
+	}
+
+	for _, content := range []string{
+		"[vlans.\"42\"]\npreset = \"media\"",
+		"[vlans.\"42\"]\npreset = \"guest\"\n[devices.\"00:14:22:01:23:45\"]\norigin_pool = 42\nshared_pools = [43]",
+	} {
+		if _, err := parseConfig(content); err == nil {
+			t.Errorf("Error in parseConfig(): expected an error for %q", content)
+		}
+	}
+}
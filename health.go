@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// States of the subsystems, and of the reflector as a whole, reported on /healthz
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "failed"
+)
+
+// subsystemHealth is the state of a subsystem, along with its metrics
+type subsystemHealth struct {
+	State    string                 `json:"state"`
+	Detail   string                 `json:"detail,omitempty"`
+	Critical bool                   `json:"critical"`
+	Metrics  map[string]interface{} `json:"metrics,omitempty"`
+}
+
+// healthCheck returns the current state and metrics of a subsystem
+type healthCheck func() subsystemHealth
+
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Subsystems map[string]subsystemHealth `json:"subsystems"`
+}
+
+// healthRegistry aggregates the health of the subsystems registered at startup. The failure of a critical subsystem
+// fails the reflector as a whole, while the failures of the others only degrade it, as the reflection goes on without them.
+type healthRegistry struct {
+	mutex    sync.Mutex
+	checks   map[string]healthCheck
+	critical map[string]bool
+}
+
+// health is the registry of the subsystems of the process, served on /healthz
+var health = newHealthRegistry()
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{checks: make(map[string]healthCheck), critical: make(map[string]bool)}
+}
+
+// register adds a subsystem to the registry, replacing any previous subsystem of the same name
+func (registry *healthRegistry) register(name string, critical bool, check healthCheck) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.checks[name] = check
+	registry.critical[name] = critical
+}
+
+// report runs the checks of the subsystems, and aggregates their states
+func (registry *healthRegistry) report() healthReport {
+	registry.mutex.Lock()
+	checks, critical := make(map[string]healthCheck), make(map[string]bool)
+	for name, check := range registry.checks {
+		checks[name], critical[name] = check, registry.critical[name]
+	}
+	registry.mutex.Unlock()
+
+	// Checks run without the lock, as they may lock their subsystem
+	report := healthReport{Status: healthOK, Subsystems: make(map[string]subsystemHealth)}
+	for name, check := range checks {
+		subsystem := check()
+		subsystem.Critical = critical[name]
+		report.Subsystems[name] = subsystem
+		switch {
+		case subsystem.State == healthFailed && subsystem.Critical:
+			report.Status = healthFailed
+		case subsystem.State != healthOK && report.Status == healthOK:
+			report.Status = healthDegraded
+		}
+	}
+	return report
+}
+
+// ServeHTTP serves the aggregated health, with a 503 status when the reflector failed
+func (registry *healthRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := registry.report()
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == healthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// subsystemStatus holds the state reported by a subsystem running in its own goroutine
+type subsystemStatus struct {
+	mutex  sync.Mutex
+	state  string
+	detail string
+}
+
+func newSubsystemStatus() *subsystemStatus {
+	return &subsystemStatus{state: healthOK}
+}
+
+// set records the state of the subsystem, and the reason why it is not ok
+func (status *subsystemStatus) set(state, detail string) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.state, status.detail = state, detail
+}
+
+// check returns the check reporting the recorded state, along with the current values of metrics
+func (status *subsystemStatus) check(metrics map[string]expvar.Var) healthCheck {
+	return func() subsystemHealth {
+		status.mutex.Lock()
+		defer status.mutex.Unlock()
+		return subsystemHealth{State: status.state, Detail: status.detail, Metrics: expvarMetrics(metrics)}
+	}
+}
+
+// expvarMetrics returns the current values of the variables exposed on /debug/vars
+func expvarMetrics(metrics map[string]expvar.Var) map[string]interface{} {
+	if len(metrics) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(metrics))
+	for name, metric := range metrics {
+		values[name] = json.RawMessage(metric.String())
+	}
+	return values
+}
+
+// errorCheck returns the check of a subsystem without a state of its own, degraded when the errors it counts
+// increased since the previous check, along with the current values of metrics
+func errorCheck(metrics map[string]expvar.Var, kind string, errors func() int64) healthCheck {
+	var mutex sync.Mutex
+	var last int64
+	return func() subsystemHealth {
+		mutex.Lock()
+		defer mutex.Unlock()
+		current := errors()
+		subsystem := subsystemHealth{State: healthOK, Metrics: expvarMetrics(metrics)}
+		if current > last {
+			subsystem.State = healthDegraded
+			subsystem.Detail = fmt.Sprintf("%d %v since the previous check", current-last, kind)
+		}
+		last = current
+		return subsystem
+	}
+}
+
+// droppedCount returns the sum of the counters of m whose name ends with "_dropped"
+func droppedCount(m *expvar.Map) int64 {
+	var dropped int64
+	m.Do(func(kv expvar.KeyValue) {
+		if strings.HasSuffix(kv.Key, "_dropped") {
+			dropped += expvarInt(kv.Value)
+		}
+	})
+	return dropped
+}
+
+// registerHealthChecks registers the subsystems started by runReflector, the optional ones only when they are enabled.
+// The API and telemetry register themselves when they start.
+func registerHealthChecks(cfg *brconfig, capture trunkCapture) {
+	health.register("capture", true, capture.healthCheck())
+	// mDNS is degraded while reflections are dropped by the queues, or cannot be injected
+	health.register("mdns", true, errorCheck(map[string]expvar.Var{
+		"priority_queue":   priorityQueueStats,
+		"pipelines":        pipelineStats,
+		"conformance":      conformanceStats,
+		"injection_errors": injectionErrors,
+	}, "dropped or failed reflections", func() int64 {
+		return droppedCount(priorityQueueStats) + droppedCount(pipelineStats) + injectionErrors.Value()
+	}))
+	if cfg.Proxy.Enabled || cfg.Proxy.Backfill.Duration > 0 {
+		health.register("proxy_cache", false, errorCheck(map[string]expvar.Var{"proxy": proxyStats, "cache": proxyCacheStats}, "records refused by the full cache", func() int64 {
+			return expvarInt(proxyStats.Get("cache_full"))
+		}))
+	}
+	if cfg.PolicyModule != "" {
+		health.register("policy", false, errorCheck(map[string]expvar.Var{"errors": policyErrors}, "policy errors", policyErrors.Value))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthRegistry(t *testing.T) {
+	registry := newHealthRegistry()
+	capture, api := newSubsystemStatus(), newSubsystemStatus()
+	counter := new(expvar.Int)
+	counter.Add(3)
+	registry.register("capture", true, capture.check(map[string]expvar.Var{"failovers": counter}))
+	registry.register("api", false, api.check(nil))
+
+	tests := []struct {
+		capture, api string
+		status       string
+		code         int
+	}{
+		{healthOK, healthOK, healthOK, http.StatusOK},
+		// Failures of non-critical subsystems are visible, but do not fail the reflector
+		{healthOK, healthFailed, healthDegraded, http.StatusOK},
+		{healthDegraded, healthOK, healthDegraded, http.StatusOK},
+		{healthFailed, healthFailed, healthFailed, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		capture.set(test.capture, "")
+		api.set(test.api, "listen tcp: address already in use")
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		var report struct {
+			Status     string `json:"status"`
+			Subsystems map[string]struct {
+				State    string         `json:"state"`
+				Detail   string         `json:"detail"`
+				Critical bool           `json:"critical"`
+				Metrics  map[string]int `json:"metrics"`
+			} `json:"subsystems"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+			t.Fatalf("Error in ServeHTTP(): %v", err)
+		}
+		if recorder.Code != test.code || report.Status != test.status {
+			t.Errorf("Error in ServeHTTP() with capture %v and api %v: got %v (%d), expected %v (%d)", test.capture, test.api, report.Status, recorder.Code, test.status, test.code)
+		}
+		if api := report.Subsystems["api"]; api.State != test.api || api.Critical || api.Detail == "" {
+			t.Errorf("Error in ServeHTTP(): unexpected api subsystem %+v", api)
+		}
+		if capture := report.Subsystems["capture"]; !capture.Critical || capture.Metrics["failovers"] != 3 {
+			t.Errorf("Error in ServeHTTP(): unexpected capture subsystem %+v", capture)
+		}
+	}
+}
+
+func TestErrorCheck(t *testing.T) {
+	errors := new(expvar.Int)
+	check := errorCheck(map[string]expvar.Var{"errors": errors}, "errors", errors.Value)
+	if subsystem := check(); subsystem.State != healthOK {
+		t.Errorf("Error in errorCheck(): expected ok without errors, got %+v", subsystem)
+	}
+	errors.Add(2)
+	if subsystem := check(); subsystem.State != healthDegraded || subsystem.Detail != "2 errors since the previous check" {
+		t.Errorf("Error in errorCheck(): expected degraded after errors, got %+v", subsystem)
+	}
+	// The subsystem recovers once the errors stop
+	if subsystem := check(); subsystem.State != healthOK {
+		t.Errorf("Error in errorCheck(): expected ok once the errors stopped, got %+v", subsystem)
+	}
+}
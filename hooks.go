@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events which can trigger a hook
+const (
+	eventServiceDiscovered = "service_discovered"
+	eventDeviceFirstSeen   = "device_first_seen"
+	eventLoopDetected      = "loop_detected"
+	eventWatchdogTriggered = "watchdog_triggered"
+)
+
+const (
+	// Default minimal delay between two runs of a hook
+	defaultHookRateLimit = 10 * time.Second
+	// Maximal duration of a hook command, which is killed afterwards
+	hookTimeout = 30 * time.Second
+)
+
+// hookStats counts, for each event, the hook commands run, failed, and skipped by the rate limit
+var hookStats = expvar.NewMap("hooks")
+
+// hookConfig runs an external command when an event occurs. Arguments are templates, such as "{{.MAC}}".
+type hookConfig struct {
+	Event     string   `toml:"event"`
+	Command   []string `toml:"command"`
+	RateLimit duration `toml:"rate_limit"`
+}
+
+type hook struct {
+	event     string
+	args      []*template.Template
+	rateLimit time.Duration
+	lastRun   time.Time
+}
+
+// hookRunner executes the hooks of the events, without shell, in the background
+type hookRunner struct {
+	mutex sync.Mutex
+	hooks map[string][]*hook
+	// exec runs a command, replaced in tests
+	exec func(args []string) error
+}
+
+// newHookRunner parses the hooks of the configuration, and returns nil when there are none
+func newHookRunner(configs []hookConfig) (*hookRunner, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	runner := &hookRunner{hooks: make(map[string][]*hook), exec: runHookCommand}
+	for i, cfg := range configs {
+		switch cfg.Event {
+		case eventServiceDiscovered, eventDeviceFirstSeen, eventLoopDetected, eventWatchdogTriggered:
+		default:
+			return nil, fmt.Errorf("invalid event %q for hook %v", cfg.Event, i+1)
+		}
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("no command for hook %v", i+1)
+		}
+		h := &hook{event: cfg.Event, rateLimit: cfg.RateLimit.Duration}
+		if h.rateLimit == 0 {
+			h.rateLimit = defaultHookRateLimit
+		}
+		for _, arg := range cfg.Command {
+			tmpl, err := template.New(cfg.Event).Option("missingkey=error").Parse(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument %q for hook %v: %v", arg, i+1, err)
+			}
+			h.args = append(h.args, tmpl)
+		}
+		runner.hooks[cfg.Event] = append(runner.hooks[cfg.Event], h)
+	}
+	return runner, nil
+}
+
+// fire runs the hooks of event whose rate limit allows it, with their arguments rendered from vars
+func (runner *hookRunner) fire(event string, vars map[string]interface{}, now time.Time) {
+	if runner == nil {
+		return
+	}
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	for _, h := range runner.hooks[event] {
+		if !h.lastRun.IsZero() && now.Sub(h.lastRun) < h.rateLimit {
+			hookStats.Add(event+"_rate_limited", 1)
+			continue
+		}
+		args, err := h.render(vars)
+		if err != nil {
+			logger.errorf("Could not render the arguments of a %v hook: %v", event, err)
+			hookStats.Add(event+"_failed", 1)
+			continue
+		}
+		h.lastRun = now
+		hookStats.Add(event+"_run", 1)
+		go func(event string) {
+			if err := runner.exec(args); err != nil {
+				logger.warnf("Hook %v of event %v failed: %v", args[0], event, err)
+				hookStats.Add(event+"_failed", 1)
+			}
+		}(event)
+	}
+}
+
+func (h *hook) render(vars map[string]interface{}) ([]string, error) {
+	args := make([]string, len(h.args))
+	for i, tmpl := range h.args {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, err
+		}
+		args[i] = buf.String()
+	}
+	return args, nil
+}
+
+func runHookCommand(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHookRunner(t *testing.T) {
+	if runner, err := newHookRunner(nil); runner != nil || err != nil {
+		t.Errorf("Error in newHookRunner(): expected no runner without hooks, got %v (%v)", runner, err)
+	}
+	invalid := map[string]string{
+		"[[hooks]]\nevent = \"device_lost\"\ncommand = [\"true\"]":                 "invalid event",
+		"[[hooks]]\nevent = \"loop_detected\"":                                     "no command",
+		"[[hooks]]\nevent = \"loop_detected\"\ncommand = [\"echo\", \"{{.VLANs\"]": "invalid argument",
+	}
+	for content, expected := range invalid {
+		if _, err := parseConfig(content); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error in parseConfig(): expected %q for %q, got %v", expected, content, err)
+		}
+	}
+}
+
+func TestHookRunnerFire(t *testing.T) {
+	runner, err := newHookRunner([]hookConfig{
+		{Event: eventDeviceFirstSeen, Command: []string{"notify", "New device {{.MAC}} on VLAN {{.VLAN}}"}, RateLimit: duration{time.Minute}},
+		{Event: eventLoopDetected, Command: []string{"alert", "{{.Unknown}}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan []string, 10)
+	runner.exec = func(args []string) error {
+		commands <- args
+		return nil
+	}
+	now := time.Now()
+	vars := map[string]interface{}{"MAC": macAddress("AA:BB:CC:DD:EE:FF"), "VLAN": uint16(10)}
+
+	runner.fire(eventDeviceFirstSeen, vars, now)
+	expected := []string{"notify", "New device AA:BB:CC:DD:EE:FF on VLAN 10"}
+	select {
+	case args := <-commands:
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("Error in fire(): expected %v, got %v", expected, args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error in fire(): expected the hook to run")
+	}
+
+	// Rate limited, then allowed again
+	runner.fire(eventDeviceFirstSeen, vars, now.Add(30*time.Second))
+	runner.fire(eventDeviceFirstSeen, vars, now.Add(time.Minute))
+	// Rendering errors skip the hook
+	runner.fire(eventLoopDetected, vars, now)
+	// A nil runner does nothing
+	(*hookRunner)(nil).fire(eventDeviceFirstSeen, vars, now)
+
+	select {
+	case <-commands:
+	case <-time.After(time.Second):
+		t.Fatal("Error in fire(): expected the hook to run once its rate limit elapsed")
+	}
+	select {
+	case args := <-commands:
+		t.Errorf("Error in fire(): expected no other run, got %v", args)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeviceFirstSeenHook(t *testing.T) {
+	for _, mode := range []unknownDeviceMode{unknownDrop, unknownLogAndDrop, unknownQuarantine} {
+		cfg, err := parseConfig(fmt.Sprintf("unknown_device_mode = %q", mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := createMockReflector(cfg)
+		if r.hooks, err = newHookRunner([]hookConfig{{Event: eventDeviceFirstSeen, Command: []string{"notify", "{{.MAC}}"}}}); err != nil {
+			t.Fatal(err)
+		}
+		commands := make(chan []string, 10)
+		r.hooks.exec = func(args []string) error {
+			commands <- args
+			return nil
+		}
+
+		// The hook only runs the first time the device is seen
+		r.processBonjourPacket(createMockBonjourPacket(false))
+		r.processBonjourPacket(createMockBonjourPacket(false))
+		select {
+		case args := <-commands:
+			if args[1] != srcMACTest.String() {
+				t.Errorf("Error in handleUnknownDevice(): unexpected hook %v in mode %v", args, mode)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Error in handleUnknownDevice(): expected the hook to run in mode %v", mode)
+		}
+		select {
+		case args := <-commands:
+			t.Errorf("Error in handleUnknownDevice(): expected a single run in mode %v, got %v", mode, args)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
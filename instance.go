@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Default delay between two telemetry reports
+const defaultTelemetryInterval = 24 * time.Hour
+
+// telemetryConfig enables the anonymous usage reports, which are disabled by default.
+// No default endpoint exists: reports are only sent where the operator decides to.
+type telemetryConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Endpoint string   `toml:"endpoint"`
+	Interval duration `toml:"interval"`
+}
+
+// loadInstanceID returns the unique ID of this reflector installation, created at the first start.
+// Without path, a new ID is generated each time.
+func loadInstanceID(path string) (string, error) {
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(content)) != "" {
+			return strings.TrimSpace(string(content)), nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random)
+	if path == "" {
+		return id, nil
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmpPath, path)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Linux lists the VLAN subinterfaces and their parent interface in this file
+const linuxVLANConfigPath = "/proc/net/vlan/config"
+
+type vlanSubinterface struct {
+	Name string `json:"name"`
+	VLAN uint16 `json:"vlan"`
+}
+
+// interfaceInfo describes a network interface pcap can capture on
+type interfaceInfo struct {
+	Name          string             `json:"name"`
+	Description   string             `json:"description,omitempty"`
+	MAC           string             `json:"mac,omitempty"`
+	Addresses     []string           `json:"addresses,omitempty"`
+	Up            bool               `json:"up"`
+	Subinterfaces []vlanSubinterface `json:"vlan_subinterfaces,omitempty"`
+	// Capture tells whether the current privileges allow capturing and injecting packets on the interface
+	Capture      bool   `json:"capture"`
+	CaptureError string `json:"capture_error,omitempty"`
+}
+
+var interfacesCommand = &command{
+	name:    "interfaces",
+	summary: "List the network interfaces, and whether packets can be captured on them",
+	setup:   setupInterfacesCommand,
+}
+
+func setupInterfacesCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	return func(out *commandOutput, args []string) error {
+		devices, err := pcap.FindAllDevs()
+		if err != nil {
+			return fmt.Errorf("could not list network interfaces: %v", err)
+		}
+		// VLAN subinterfaces are only listed on Linux
+		subinterfaces := make(map[string][]vlanSubinterface)
+		if file, err := os.Open(linuxVLANConfigPath); err == nil {
+			subinterfaces = parseVLANConfig(file)
+			file.Close()
+		}
+
+		infos := make([]interfaceInfo, 0, len(devices))
+		for _, device := range devices {
+			info := interfaceInfo{Name: device.Name, Description: device.Description, Subinterfaces: subinterfaces[device.Name]}
+			for _, address := range device.Addresses {
+				info.Addresses = append(info.Addresses, address.IP.String())
+			}
+			// pcap names differ from the system names on Windows, where MACs and link states are not resolved
+			if intf, err := net.InterfaceByName(device.Name); err == nil {
+				info.MAC = intf.HardwareAddr.String()
+				info.Up = intf.Flags&net.FlagUp != 0
+			}
+			if err := probeCapture(device.Name); err != nil {
+				info.CaptureError = err.Error()
+			} else {
+				info.Capture = true
+			}
+			infos = append(infos, info)
+		}
+		return out.print(infos, func(w io.Writer) {
+			printInterfaces(w, infos)
+		})
+	}
+}
+
+// probeCapture opens a capture handle on the interface, which needs the same privileges as injecting packets
+func probeCapture(name string) error {
+	handle, err := pcap.OpenLive(name, 64, false, 100*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	handle.Close()
+	return nil
+}
+
+// parseVLANConfig reads the VLAN subinterfaces of each interface from the content of /proc/net/vlan/config:
+//
+//	VLAN Dev name    | VLAN ID
+//	Name-Type: VLAN_NAME_TYPE_RAW_PLUS_VID_NO_PAD
+//	eth0.10        | 10  | eth0
+func parseVLANConfig(r io.Reader) map[string][]vlanSubinterface {
+	subinterfaces := make(map[string][]vlanSubinterface)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 {
+			continue
+		}
+		vlan, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 12)
+		if err != nil {
+			continue
+		}
+		parent := strings.TrimSpace(fields[2])
+		subinterfaces[parent] = append(subinterfaces[parent], vlanSubinterface{Name: strings.TrimSpace(fields[0]), VLAN: uint16(vlan)})
+	}
+	for _, list := range subinterfaces {
+		sort.Slice(list, func(i, j int) bool { return list[i].VLAN < list[j].VLAN })
+	}
+	return subinterfaces
+}
+
+func printInterfaces(w io.Writer, infos []interfaceInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tMAC\tSTATE\tVLAN SUBINTERFACES\tCAPTURE")
+	for _, info := range infos {
+		state := "down"
+		if info.Up {
+			state = "up"
+		}
+		var vlans []string
+		for _, subinterface := range info.Subinterfaces {
+			vlans = append(vlans, strconv.Itoa(int(subinterface.VLAN)))
+		}
+		capture := "yes"
+		if !info.Capture {
+			capture = "no: " + info.CaptureError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Name, info.MAC, state, strings.Join(vlans, ","), capture)
+	}
+	tw.Flush()
+}
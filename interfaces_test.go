@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseVLANConfig(t *testing.T) {
+	content := `VLAN Dev name    | VLAN ID
+Name-Type: VLAN_NAME_TYPE_RAW_PLUS_VID_NO_PAD
+eth0.1234      | 1234  | eth0
+eth0.10        | 10  | eth0
+bond0.20       | 20  | bond0
+`
+	subinterfaces := parseVLANConfig(strings.NewReader(content))
+	eth0 := subinterfaces["eth0"]
+	if len(subinterfaces) != 2 || len(eth0) != 2 || eth0[0].VLAN != 10 || eth0[1].Name != "eth0.1234" {
+		t.Errorf("Error in parseVLANConfig(), got %+v", subinterfaces)
+	}
+}
+
+func TestPrintInterfaces(t *testing.T) {
+	var buffer bytes.Buffer
+	printInterfaces(&buffer, []interfaceInfo{
+		{Name: "eth0", MAC: "aa:bb:cc:dd:ee:ff", Up: true, Subinterfaces: []vlanSubinterface{{"eth0.10", 10}, {"eth0.20", 20}}, Capture: true},
+		{Name: "wlan0", CaptureError: "permission denied"},
+	})
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "up") || !strings.Contains(lines[1], "10,20") || !strings.Contains(lines[2], "no: permission denied") {
+		t.Errorf("Error in printInterfaces(), got:\n%v", buffer.String())
+	}
+}
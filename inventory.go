@@ -0,0 +1,268 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Minimal delay between two writes of the inventory file, unless a new device shows up
+const inventorySaveInterval = time.Minute
+
+// Number of unknown devices remembered outside of the quarantine mode, to tell when a device is seen for the first time
+const maxUnknownDevices = 4096
+
+// Default maximal number of devices of the inventory, the least recently seen being evicted beyond
+const defaultInventorySize = 4096
+
+// Devices evicted from the full inventory, exposed on /debug/vars
+var inventoryEvictions = expvar.NewInt("inventory_evictions")
+
+type inventoryEntry struct {
+	MAC       macAddress `json:"mac"`
+	VLAN      uint16     `json:"vlan"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	Packets   uint64     `json:"packets"`
+	Vendor    string     `json:"vendor,omitempty"`
+	Services  []string   `json:"services,omitempty"`
+}
+
+// inventory records the unknown devices seen on the network, so that they can be authorized later on
+type inventory struct {
+	mutex   sync.Mutex
+	path    string
+	size    int
+	entries map[macAddress]*list.Element
+	// order holds the entries, least recently seen first
+	order    *list.List
+	lastSave time.Time
+}
+
+// loadInventory restores the inventory saved at path, keeping its size most recently seen devices
+func loadInventory(path string, size int) (*inventory, error) {
+	inv := &inventory{
+		path:    path,
+		size:    size,
+		entries: make(map[macAddress]*list.Element),
+		order:   list.New(),
+	}
+	if path == "" {
+		return inv, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*inventoryEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].LastSeen.Before(entries[j].LastSeen) })
+	for _, entry := range entries {
+		inv.entries[entry.MAC] = inv.order.PushBack(entry)
+		inv.evict()
+	}
+	return inv, nil
+}
+
+// evict removes the least recently seen devices beyond the size of the inventory.
+// It must be called with the mutex held.
+func (inv *inventory) evict() {
+	for inv.order.Len() > inv.size {
+		oldest := inv.order.Remove(inv.order.Front()).(*inventoryEntry)
+		delete(inv.entries, oldest.MAC)
+		inventoryEvictions.Add(1)
+	}
+}
+
+// record adds a packet sent by the given device to the inventory, and returns true if the device was never seen before.
+// A new device evicts the least recently seen one from a full inventory.
+func (inv *inventory) record(mac macAddress, tag uint16, now time.Time) (isNew bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	element, ok := inv.entries[mac]
+	if ok {
+		inv.order.MoveToBack(element)
+	} else {
+		element = inv.order.PushBack(&inventoryEntry{MAC: mac, FirstSeen: now})
+		inv.entries[mac] = element
+		isNew = true
+		inv.evict()
+	}
+	entry := element.Value.(*inventoryEntry)
+	entry.VLAN = tag
+	entry.LastSeen = now
+	entry.Packets++
+	return
+}
+
+// annotate sets the vendor of a recorded device, adds the given services to the ones it announced,
+// and returns a copy of its entry
+func (inv *inventory) annotate(mac macAddress, vendor string, services []string) inventoryEntry {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	element, ok := inv.entries[mac]
+	if !ok {
+		return inventoryEntry{}
+	}
+	entry := element.Value.(*inventoryEntry)
+	if vendor != "" {
+		entry.Vendor = vendor
+	}
+	for _, service := range services {
+		if !containsString(entry.Services, service) {
+			entry.Services = append(entry.Services, service)
+		}
+	}
+	sort.Strings(entry.Services)
+	copied := *entry
+	copied.Services = append([]string(nil), entry.Services...)
+	return copied
+}
+
+// lookup returns a copy of the entry of a recorded device
+func (inv *inventory) lookup(mac macAddress) (inventoryEntry, bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	element, ok := inv.entries[mac]
+	if !ok {
+		return inventoryEntry{}, false
+	}
+	return *element.Value.(*inventoryEntry), true
+}
+
+// list returns a copy of the entries, oldest devices first
+func (inv *inventory) list() []inventoryEntry {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	list := make([]inventoryEntry, 0, inv.order.Len())
+	for element := inv.order.Front(); element != nil; element = element.Next() {
+		list = append(list, *element.Value.(*inventoryEntry))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].FirstSeen.Equal(list[j].FirstSeen) {
+			return list[i].FirstSeen.Before(list[j].FirstSeen)
+		}
+		return list[i].MAC < list[j].MAC
+	})
+	return list
+}
+
+// remove drops an approved device from the inventory, and writes the inventory to disk right away
+func (inv *inventory) remove(mac macAddress) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	inv.delete(mac)
+	if inv.path == "" {
+		return nil
+	}
+	inv.lastSave = time.Now()
+	return inv.save()
+}
+
+// forget removes the devices configured in devices, such as the ones approved into the configuration file
+// while the reflector was running, so that it does not write them back to the inventory file
+func (inv *inventory) forget(devices map[macAddress]bonjourDevice) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	forgotten := 0
+	for mac := range devices {
+		if inv.delete(mac) {
+			forgotten++
+		}
+	}
+	if forgotten == 0 || inv.path == "" {
+		return nil
+	}
+	inv.lastSave = time.Now()
+	return inv.save()
+}
+
+// delete removes a device, and tells whether it was recorded. It must be called with the mutex held.
+func (inv *inventory) delete(mac macAddress) bool {
+	element, ok := inv.entries[mac]
+	if ok {
+		inv.order.Remove(element)
+		delete(inv.entries, mac)
+	}
+	return ok
+}
+
+// saveIfNeeded writes the inventory to disk when a new device was added, or when the last write is too old
+func (inv *inventory) saveIfNeeded(force bool, now time.Time) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	if inv.path == "" || (!force && now.Sub(inv.lastSave) < inventorySaveInterval) {
+		return nil
+	}
+	inv.lastSave = now
+	return inv.save()
+}
+
+func (inv *inventory) save() error {
+	entries := make([]*inventoryEntry, 0, inv.order.Len())
+	for element := inv.order.Front(); element != nil; element = element.Next() {
+		entries = append(entries, element.Value.(*inventoryEntry))
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash never leaves a truncated inventory behind
+	tmpPath := inv.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, inv.path)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownDevices remembers the unknown devices recently seen outside of the quarantine mode, which are not recorded
+// in the inventory, in a small LRU cache
+type unknownDevices struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[macAddress]*list.Element
+	// order holds the devices, least recently seen first
+	order *list.List
+}
+
+func newUnknownDevices(size int) *unknownDevices {
+	return &unknownDevices{
+		size:    size,
+		entries: make(map[macAddress]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// record remembers the device, and returns true if it was not seen recently
+func (devices *unknownDevices) record(mac macAddress) bool {
+	devices.mutex.Lock()
+	defer devices.mutex.Unlock()
+	if element, ok := devices.entries[mac]; ok {
+		devices.order.MoveToBack(element)
+		return false
+	}
+	devices.entries[mac] = devices.order.PushBack(mac)
+	if devices.order.Len() > devices.size {
+		delete(devices.entries, devices.order.Remove(devices.order.Front()).(macAddress))
+	}
+	return true
+}
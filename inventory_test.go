@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInventoryRecord(t *testing.T) {
+	inv, _ := loadInventory("", defaultInventorySize)
+	now := time.Now()
+
+	if isNew := inv.record("00:14:22:01:23:45", 45, now); !isNew {
+		t.Error("Error in record(): device should be new")
+	}
+	if isNew := inv.record("00:14:22:01:23:45", 46, now.Add(time.Second)); isNew {
+		t.Error("Error in record(): device should already be known")
+	}
+
+	entry, _ := inv.lookup("00:14:22:01:23:45")
+	if entry.Packets != 2 || entry.VLAN != 46 || !entry.FirstSeen.Equal(now) || !entry.LastSeen.Equal(now.Add(time.Second)) {
+		t.Errorf("Error in record(): unexpected entry %+v", entry)
+	}
+}
+
+func TestInventorySaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+
+	inv, err := loadInventory(path, defaultInventorySize)
+	if err != nil {
+		t.Fatalf("Error in loadInventory() for a missing file: %v", err)
+	}
+	now := time.Now()
+	inv.record("00:14:22:01:23:45", 45, now)
+	if err := inv.saveIfNeeded(true, now); err != nil {
+		t.Fatalf("Error in saveIfNeeded(): %v", err)
+	}
+
+	loaded, err := loadInventory(path, defaultInventorySize)
+	if err != nil {
+		t.Fatalf("Error in loadInventory(): %v", err)
+	}
+	entry, ok := loaded.lookup("00:14:22:01:23:45")
+	if !ok || entry.VLAN != 45 || entry.Packets != 1 {
+		t.Error("Error in loadInventory(): saved device was not restored")
+	}
+}
+
+func TestInventoryEviction(t *testing.T) {
+	inv, _ := loadInventory("", 2)
+	now := time.Now()
+	evictions := inventoryEvictions.Value()
+
+	inv.record("00:14:22:01:23:45", 45, now)
+	inv.record("00:14:22:01:23:46", 45, now.Add(time.Second))
+	inv.record("00:14:22:01:23:45", 45, now.Add(2*time.Second))
+	if isNew := inv.record("00:14:22:01:23:47", 45, now.Add(3*time.Second)); !isNew {
+		t.Error("Error in record(): device should be new")
+	}
+
+	if _, ok := inv.lookup("00:14:22:01:23:46"); ok {
+		t.Error("Error in record(): the least recently seen device should have been evicted")
+	}
+	if _, ok := inv.lookup("00:14:22:01:23:45"); !ok {
+		t.Error("Error in record(): a device seen again should have been kept")
+	}
+	if len(inv.list()) != 2 {
+		t.Errorf("Error in record(): expected 2 devices, got %v", len(inv.list()))
+	}
+	if inventoryEvictions.Value() != evictions+1 {
+		t.Errorf("Error in record(): expected 1 eviction, got %v", inventoryEvictions.Value()-evictions)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Delay during which the known answers of a query are compared with the answers reflected to its VLAN,
+	// responders answering within 120ms, or 500ms for truncated queries (RFC 6762, sections 6 and 7.2)
+	knownAnswerWindow = time.Second
+	// Maximal number of names whose known answers are remembered
+	knownAnswerMaxNames = 4096
+)
+
+// Known answers stripped from the reflected queries, and answers not reflected to VLANs which listed them, exposed on /debug/vars
+var knownAnswerStats = expvar.NewMap("known_answers")
+
+// knownAnswersConfig makes the reflector aware of the known-answer lists of the queries (RFC 6762, section 7.1)
+type knownAnswersConfig struct {
+	MinTTL          uint32 `toml:"min_ttl"`
+	SuppressAnswers bool   `toml:"suppress_answers"`
+}
+
+// knownName identifies the known answers of a name listed by the queriers of a VLAN
+type knownName struct {
+	vlan uint16
+	name string
+}
+
+// knownRecords are the known answers of a name listed by the last query from a VLAN, and its continuations
+type knownRecords struct {
+	listed  time.Time
+	records []layers.DNSResourceRecord
+}
+
+// knownAnswers strips the known answers about to expire from the reflected queries, so that responders refresh them,
+// and remembers the other ones, so that answers the queriers of a VLAN already hold are not reflected there
+type knownAnswers struct {
+	mutex  sync.Mutex
+	minTTL uint32
+	// names is only filled when answers are suppressed
+	names map[knownName]*knownRecords
+}
+
+// newKnownAnswers returns the known-answer handling of the configuration, or nil when it is disabled
+func newKnownAnswers(cfg knownAnswersConfig) *knownAnswers {
+	if cfg.MinTTL == 0 && !cfg.SuppressAnswers {
+		return nil
+	}
+	known := &knownAnswers{minTTL: cfg.MinTTL}
+	if cfg.SuppressAnswers {
+		known.names = make(map[knownName]*knownRecords)
+	}
+	return known
+}
+
+// recordQuery remembers the known answers of a query from the VLAN tag, and strips the ones whose TTL is below min_ttl.
+// The known answers of the names asked replace the previous ones, while the continuations of truncated queries, without
+// questions, add theirs. It tells whether dns was modified.
+func (known *knownAnswers) recordQuery(dns *layers.DNS, tag uint16, now time.Time) (stripped bool) {
+	if known == nil || dns == nil {
+		return false
+	}
+	if known.names != nil {
+		known.mutex.Lock()
+		known.expire(now)
+		// A querier listing no known answer for a name holds none of them, whatever the queriers before it
+		for _, question := range dns.Questions {
+			delete(known.names, knownName{tag, strings.ToLower(string(question.Name))})
+		}
+		for _, record := range dns.Answers {
+			key := knownName{tag, strings.ToLower(string(record.Name))}
+			entry, ok := known.names[key]
+			if !ok {
+				if len(known.names) >= knownAnswerMaxNames {
+					continue
+				}
+				entry = &knownRecords{}
+				known.names[key] = entry
+			}
+			entry.listed = now
+			entry.records = append(entry.records, copyRecord(record))
+		}
+		known.mutex.Unlock()
+	}
+	if known.minTTL == 0 || len(dns.Answers) == 0 {
+		return false
+	}
+	kept := make([]layers.DNSResourceRecord, 0, len(dns.Answers))
+	for _, record := range dns.Answers {
+		if record.TTL >= known.minTTL {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == len(dns.Answers) {
+		return false
+	}
+	knownAnswerStats.Add("stripped", int64(len(dns.Answers)-len(kept)))
+	dns.Answers = kept
+	return true
+}
+
+// expire forgets the known answers listed before the window. It must be called with the mutex held.
+func (known *knownAnswers) expire(now time.Time) {
+	for key, entry := range known.names {
+		if now.Sub(entry.listed) > knownAnswerWindow {
+			delete(known.names, key)
+		}
+	}
+}
+
+// filterAnswer returns the VLANs of tags the answer dns is reflected to, without the ones whose queriers just listed
+// all of its answers with at least half of their TTL, which the responder would not have sent them (RFC 6762, section 7.1)
+func (known *knownAnswers) filterAnswer(dns *layers.DNS, tags []uint16, now time.Time) []uint16 {
+	if known == nil || known.names == nil || dns == nil || len(dns.Answers) == 0 || len(tags) == 0 {
+		return tags
+	}
+	known.mutex.Lock()
+	defer known.mutex.Unlock()
+	filtered := make([]uint16, 0, len(tags))
+	for _, tag := range tags {
+		if known.knowsAll(dns.Answers, tag, now) {
+			knownAnswerStats.Add("suppressed_answers", 1)
+			continue
+		}
+		filtered = append(filtered, tag)
+	}
+	return filtered
+}
+
+// knowsAll tells whether the queriers of the VLAN tag listed every record among their known answers.
+// It must be called with the mutex held.
+func (known *knownAnswers) knowsAll(records []layers.DNSResourceRecord, tag uint16, now time.Time) bool {
+	for i := range records {
+		record := &records[i]
+		// Goodbye records are always reflected
+		if record.TTL == 0 {
+			return false
+		}
+		entry, ok := known.names[knownName{tag, strings.ToLower(string(record.Name))}]
+		if !ok || now.Sub(entry.listed) > knownAnswerWindow {
+			return false
+		}
+		listed := false
+		for j := range entry.records {
+			if entry.records[j].Type == record.Type && sameData(&entry.records[j], record) && entry.records[j].TTL >= record.TTL/2 {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestKnownAnswerStripping(t *testing.T) {
+	if newKnownAnswers(knownAnswersConfig{}) != nil {
+		t.Error("Error in newKnownAnswers(): expected known answers to be ignored by default")
+	}
+	known := newKnownAnswers(knownAnswersConfig{MinTTL: 60})
+	ptr := func(instance string, ttl uint32) layers.DNSResourceRecord {
+		return layers.DNSResourceRecord{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl,
+			PTR: []byte(instance + "._ipp._tcp.local")}
+	}
+	dns := &layers.DNS{
+		Questions: []layers.DNSQuestion{{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}},
+		Answers:   []layers.DNSResourceRecord{ptr("Printer", 4500), ptr("Scanner", 10)},
+	}
+	if !known.recordQuery(dns, vlanIdentifierTest, time.Now()) || len(dns.Answers) != 1 || string(dns.Answers[0].PTR) != "Printer._ipp._tcp.local" {
+		t.Errorf("Error in recordQuery(): expected the known answer about to expire to be stripped, got %+v", dns.Answers)
+	}
+	if known.recordQuery(dns, vlanIdentifierTest, time.Now()) {
+		t.Error("Error in recordQuery(): no known answer should be stripped")
+	}
+	if tags := known.filterAnswer(&layers.DNS{Answers: []layers.DNSResourceRecord{ptr("Printer", 4500)}}, []uint16{vlanIdentifierTest}, time.Now()); len(tags) != 1 {
+		t.Error("Error in filterAnswer(): answers should only be suppressed with suppress_answers")
+	}
+}
+
+func TestKnownAnswerSuppression(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`reflection_jitter = "0s"
+		[known_answers]
+		suppress_answers = true
+		[devices.%q]
+		origin_pool = 42
+		shared_pools = [%v, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer := createMockReflector(cfg)
+	record := func(instance string, ttl uint32) layers.DNSResourceRecord {
+		return layers.DNSResourceRecord{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl,
+			PTR: []byte(instance + "._ipp._tcp.local")}
+	}
+	question := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	query := func(known ...layers.DNSResourceRecord) {
+		r.processBonjourPacket(createMockLegacyPacket(vlanIdentifierTest, net.IP{192, 168, 30, 5}, dstIPv4Test, 5353, 5353,
+			&layers.DNS{Questions: []layers.DNSQuestion{question}, Answers: known}))
+	}
+	answer := func(records ...layers.DNSResourceRecord) []uint16 {
+		writer.frames = nil
+		r.processBonjourPacket(createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, dstIPv4Test, 5353, 5353,
+			&layers.DNS{QR: true, AA: true, Answers: records}))
+		return writer.vlanTags()
+	}
+
+	// The queriers of VLAN 30 hold the printer, but not the scanner
+	query(record("Printer", 4500))
+	if tags := answer(record("Printer", 4500)); !equalVLANs(tags, []uint16{43}) {
+		t.Errorf("Error in processBonjourPacket(): expected the known answer not to be reflected back to VLAN %v, got %v", vlanIdentifierTest, tags)
+	}
+	if tags := answer(record("Printer", 4500), record("Scanner", 4500)); !equalVLANs(tags, []uint16{vlanIdentifierTest, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected an answer with unknown records to be reflected, got %v", tags)
+	}
+	// A known answer with less than half of the TTL of the answer does not suppress it, nor does a goodbye
+	query(record("Printer", 1000))
+	if tags := answer(record("Printer", 4500)); !equalVLANs(tags, []uint16{vlanIdentifierTest, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected an answer refreshing a known answer to be reflected, got %v", tags)
+	}
+	query(record("Printer", 4500))
+	if tags := answer(record("Printer", 0)); !equalVLANs(tags, []uint16{vlanIdentifierTest, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected a goodbye to be reflected, got %v", tags)
+	}
+	// Another querier asking without known answers needs the answer
+	query()
+	if tags := answer(record("Printer", 4500)); !equalVLANs(tags, []uint16{vlanIdentifierTest, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected the answer to be reflected to a querier without known answers, got %v", tags)
+	}
+	// Known answers are only remembered for a short while
+	query(record("Printer", 4500))
+	r.knownAnswers.names[knownName{vlanIdentifierTest, "_ipp._tcp.local"}].listed = time.Now().Add(-2 * knownAnswerWindow)
+	if tags := answer(record("Printer", 4500)); !equalVLANs(tags, []uint16{vlanIdentifierTest, 43}) {
+		t.Errorf("Error in processBonjourPacket(): expected old known answers to be ignored, got %v", tags)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"time"
+)
+
+// legacyQueryMode defines what happens to the one-shot queries of legacy resolvers,
+// which are not sent from port 5353 and expect a unicast response (RFC 6762, section 6.7)
+type legacyQueryMode string
+
+const (
+	legacyReflect legacyQueryMode = "reflect"
+	legacyRelay   legacyQueryMode = "relay"
+	legacyStrict  legacyQueryMode = "strict"
+)
+
+// Legacy queries dropped, and unicast responses relayed or unmatched, exposed on /debug/vars
+var legacyQueryStats = expvar.NewMap("legacy_queries")
+
+func (mode legacyQueryMode) isValid() bool {
+	switch mode {
+	case legacyReflect, legacyRelay, legacyStrict:
+		return true
+	}
+	return false
+}
+
+// legacyQueryMode returns the mode applying to the legacy queries sent on a VLAN.
+// Per-VLAN settings take precedence over the global one.
+func (cfg *brconfig) legacyQueryMode(tag uint16) legacyQueryMode {
+	if mode := cfg.vlans[tag].LegacyQueries; mode != "" {
+		return mode
+	}
+	return cfg.LegacyQueries
+}
+
+// relaysLegacyResponses tells whether the unicast responses to legacy queries have to be captured
+func (cfg *brconfig) relaysLegacyResponses() bool {
+	if cfg.LegacyQueries == legacyRelay {
+		return true
+	}
+	for _, vlan := range cfg.vlans {
+		if vlan.LegacyQueries == legacyRelay {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyQuery tells whether bonjourPacket is a one-shot query of a legacy resolver
+func isLegacyQuery(bonjourPacket *bonjourPacket) bool {
+	return bonjourPacket.isDNSQuery && bonjourPacket.srcPort != 5353
+}
+
+// acceptsQuery tells whether the query may be reflected: VLANs enforcing the port 5353 drop legacy queries
+func (cfg *brconfig) acceptsQuery(bonjourPacket *bonjourPacket) bool {
+	if isLegacyQuery(bonjourPacket) && cfg.legacyQueryMode(*bonjourPacket.vlanTag) == legacyStrict {
+		legacyQueryStats.Add("dropped_queries", 1)
+		return false
+	}
+	return true
+}
+
+// relaysLegacyQuery tells whether bonjourPacket is a legacy query of a VLAN relaying the unicast responses
+func (cfg *brconfig) relaysLegacyQuery(bonjourPacket *bonjourPacket) bool {
+	return isLegacyQuery(bonjourPacket) && cfg.legacyQueryMode(*bonjourPacket.vlanTag) == legacyRelay
+}
+
+// relayLegacyResponse sends a unicast response to a legacy query back to the querier, on its VLAN and port
+func (r *reflector) relayLegacyResponse(bonjourPacket *bonjourPacket) {
+	if bonjourPacket.dns == nil || !bonjourPacket.dns.QR {
+		return
+	}
+	dstPort, _ := parseUDPLayer(bonjourPacket.packet)
+	querier := r.unicastTable.lookup(bonjourPacket.dns.ID, responseNames(bonjourPacket.dns), *bonjourPacket.vlanTag, time.Now())
+	if querier == nil || !querier.Legacy || querier.Port != uint16(dstPort) || r.cfg.legacyQueryMode(querier.VLAN) != legacyRelay {
+		legacyQueryStats.Add("unmatched_responses", 1)
+		return
+	}
+	if !r.mayRelayResponse(bonjourPacket, querier) {
+		legacyQueryStats.Add("refused_responses", 1)
+		return
+	}
+	mac, err := net.ParseMAC(string(querier.MAC))
+	if err != nil {
+		return
+	}
+	// Serializing the response rewrites its source
+	source := macAddress(bonjourPacket.srcMAC.String())
+	defer translateAddresses(bonjourPacket, r.cfg.translations[querier.VLAN])()
+	defer r.setRelaySource(bonjourPacket, querier)()
+	data, err := serializeUnicastBonjourPacket(bonjourPacket, querier.VLAN, r.brMACAddress, mac, querier.IP)
+	if err != nil {
+		logger.warnf("Could not relay the legacy response to %v: %v", querier.IP, err)
+		return
+	}
+	if !r.budget.allow(protocolMDNS, querier.VLAN, len(data), time.Now()) {
+		return
+	}
+	legacyQueryStats.Add("relayed_responses", 1)
+	r.stats.reflected(source, 1, time.Now())
+	r.write(data)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockLegacyPacket(tag uint16, srcIP, dstIP net.IP, srcPort, dstPort layers.UDPPort, dns *layers.DNS) bonjourPacket {
+	ip := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP}
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: dstMACTest, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ip, udp, dns)
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true})
+	bonjourPacket, _ := parseBonjourPacket(packet, brMACTest)
+	return bonjourPacket
+}
+
+func TestLegacyQueryModes(t *testing.T) {
+	cfg := brconfig{
+		LegacyQueries: legacyReflect,
+		vlans:         map[uint16]vlanConfig{10: {LegacyQueries: legacyStrict}, 20: {LegacyQueries: legacyRelay}},
+	}
+	question := layers.DNSQuestion{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+
+	tests := []struct {
+		tag      uint16
+		srcPort  layers.UDPPort
+		accepted bool
+	}{
+		{10, 49152, false},
+		{10, 5353, true},
+		{20, 49152, true},
+		{30, 49152, true},
+	}
+	for _, test := range tests {
+		query := createMockQuery(1, test.srcPort, question)
+		*query.vlanTag = test.tag
+		if accepted := cfg.acceptsQuery(query); accepted != test.accepted {
+			t.Errorf("Error in acceptsQuery() for a query from port %v on VLAN %v: got %v, expected %v", test.srcPort, test.tag, accepted, test.accepted)
+		}
+	}
+	if !cfg.relaysLegacyResponses() {
+		t.Error("Error in relaysLegacyResponses(): expected VLAN 20 to relay legacy responses")
+	}
+}
+
+func TestRelayLegacyResponse(t *testing.T) {
+	cfg := brconfig{
+		LegacyQueries:  legacyRelay,
+		UnicastTimeout: duration{defaultUnicastTimeout},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42, SharedPools: []uint16{vlanIdentifierTest}},
+		},
+		addresses: map[uint16]vlanAddresses{42: {ipv4: net.IP{192, 168, 42, 2}}},
+	}
+	r, writer := createMockReflector(cfg)
+	question := layers.DNSQuestion{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+	querierIP := net.IP{192, 168, 30, 5}
+
+	// The legacy query is reflected from the address of the reflector on VLAN 42
+	r.processBonjourPacket(createMockLegacyPacket(vlanIdentifierTest, querierIP, dstIPv4Test, 49152, 5353,
+		&layers.DNS{ID: 1234, Questions: []layers.DNSQuestion{question}}))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Fatalf("Error in processBonjourPacket(): legacy query reflected to %v", tags)
+	}
+	reflected := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	if ip := reflected.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ip.SrcIP.Equal(net.IP{192, 168, 42, 2}) {
+		t.Errorf("Error in processBonjourPacket(): legacy query reflected from %v", ip.SrcIP)
+	}
+
+	// Its unicast response is relayed to the querier only
+	writer.frames = nil
+	answer := layers.DNSResourceRecord{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 10, IP: net.IP{192, 168, 42, 7}}
+	response := createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, net.IP{192, 168, 42, 2}, 5353, 49152,
+		&layers.DNS{ID: 1234, QR: true, AA: true, Questions: []layers.DNSQuestion{question}, Answers: []layers.DNSResourceRecord{answer}})
+	if !response.legacyResponse {
+		t.Fatal("Error in parseBonjourPacket(): unicast response not recognized")
+	}
+	r.processBonjourPacket(response)
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != vlanIdentifierTest {
+		t.Fatalf("Error in processBonjourPacket(): legacy response relayed to %v", tags)
+	}
+	relayed := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	ethernet := relayed.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := relayed.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := relayed.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if ethernet.DstMAC.String() != srcMACTest.String() || !ip.DstIP.Equal(querierIP) || udp.DstPort != 49152 {
+		t.Errorf("Error in processBonjourPacket(): legacy response relayed to %v, %v:%v", ethernet.DstMAC, ip.DstIP, udp.DstPort)
+	}
+
+	// Responses matching no query are not relayed
+	writer.frames = nil
+	r.processBonjourPacket(createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, net.IP{192, 168, 42, 2}, 5353, 49153,
+		&layers.DNS{ID: 1234, QR: true, Questions: []layers.DNSQuestion{question}, Answers: []layers.DNSResourceRecord{answer}}))
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): unmatched legacy response relayed to %v", tags)
+	}
+
+	// Responses from a VLAN the query was not reflected to are not relayed
+	r.processBonjourPacket(createMockLegacyPacket(43, net.IP{192, 168, 43, 7}, net.IP{192, 168, 42, 2}, 5353, 49152,
+		&layers.DNS{ID: 1234, QR: true, Questions: []layers.DNSQuestion{question}, Answers: []layers.DNSResourceRecord{answer}}))
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): legacy response from another VLAN relayed to %v", tags)
+	}
+
+	// Nor are the responses of devices not shared with the VLAN of the querier
+	r.cfg.Devices = map[macAddress]bonjourDevice{macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42}}
+	r.processBonjourPacket(response)
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): legacy response of an unshared device relayed to %v", tags)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// BPF filter capturing LLDP frames
+const lldpFilter = "ether proto 0x88cc"
+
+// lldpNeighbor is a switch port advertising itself on the trunk
+type lldpNeighbor struct {
+	ChassisID       string    `json:"chassis_id"`
+	PortID          string    `json:"port_id"`
+	PortDescription string    `json:"port_description,omitempty"`
+	SystemName      string    `json:"system_name,omitempty"`
+	VLANs           []uint16  `json:"vlans"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// lldpMonitor learns the VLANs carried by the trunk from the LLDP frames sent by the switch,
+// and warns when the configuration references VLANs which the switch does not advertise
+type lldpMonitor struct {
+	mutex      sync.Mutex
+	configured []uint16
+	neighbors  map[string]*lldpNeighbor
+}
+
+func newLLDPMonitor(configured []uint16) *lldpMonitor {
+	return &lldpMonitor{
+		configured: configured,
+		neighbors:  make(map[string]*lldpNeighbor),
+	}
+}
+
+// watch processes the LLDP frames read from source, until it is closed
+func (monitor *lldpMonitor) watch(source *gopacket.PacketSource) {
+	for packet := range source.Packets() {
+		monitor.handlePacket(packet, time.Now())
+	}
+}
+
+func (monitor *lldpMonitor) handlePacket(packet gopacket.Packet, now time.Time) {
+	parsedLLDP := packet.Layer(layers.LayerTypeLinkLayerDiscovery)
+	if parsedLLDP == nil {
+		return
+	}
+	lldp := parsedLLDP.(*layers.LinkLayerDiscovery)
+	neighbor := &lldpNeighbor{
+		ChassisID: formatLLDPID(lldp.ChassisID.ID, lldp.ChassisID.Subtype == layers.LLDPChassisIDSubTypeMACAddr),
+		PortID:    formatLLDPID(lldp.PortID.ID, lldp.PortID.Subtype == layers.LLDPPortIDSubtypeMACAddr),
+		LastSeen:  now,
+	}
+	if parsedInfo := packet.Layer(layers.LayerTypeLinkLayerDiscoveryInfo); parsedInfo != nil {
+		info := parsedInfo.(*layers.LinkLayerDiscoveryInfo)
+		neighbor.PortDescription = info.PortDescription
+		neighbor.SystemName = info.SysName
+		if info8021, err := info.Decode8021(); err == nil {
+			neighbor.VLANs = lldpVLANs(info8021)
+		}
+	}
+
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	key := neighbor.ChassisID + "/" + neighbor.PortID
+	previous, known := monitor.neighbors[key]
+	monitor.neighbors[key] = neighbor
+	if known && equalVLANs(previous.VLANs, neighbor.VLANs) {
+		return
+	}
+	logger.infof("LLDP: switch %v (port %v) carries VLANs %v on the trunk", neighbor.SystemName, neighbor.PortID, neighbor.VLANs)
+	if missing := monitor.missingVLANs(); len(missing) > 0 {
+		logger.warnf("LLDP: the configuration references VLANs %v, which are not advertised by the switch", missing)
+	}
+}
+
+// missingVLANs returns the configured VLANs which no neighbor advertises.
+// It must be called with the mutex held.
+func (monitor *lldpMonitor) missingVLANs() []uint16 {
+	advertised := make(map[uint16]bool)
+	for _, neighbor := range monitor.neighbors {
+		for _, vlan := range neighbor.VLANs {
+			advertised[vlan] = true
+		}
+	}
+	// Switches which do not advertise their VLANs tell nothing about missing ones
+	if len(advertised) == 0 {
+		return nil
+	}
+	missing := []uint16{}
+	for _, vlan := range monitor.configured {
+		if !advertised[vlan] {
+			missing = append(missing, vlan)
+		}
+	}
+	return missing
+}
+
+func (monitor *lldpMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	monitor.mutex.Lock()
+	state := struct {
+		Neighbors    []lldpNeighbor `json:"neighbors"`
+		MissingVLANs []uint16       `json:"missing_vlans"`
+	}{[]lldpNeighbor{}, monitor.missingVLANs()}
+	for _, neighbor := range monitor.neighbors {
+		state.Neighbors = append(state.Neighbors, *neighbor)
+	}
+	monitor.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// lldpVLANs returns the sorted VLANs advertised in the IEEE 802.1 TLVs of a switch port
+func lldpVLANs(info layers.LLDPInfo8021) []uint16 {
+	seen := make(map[uint16]bool)
+	if info.PVID != 0 {
+		seen[info.PVID] = true
+	}
+	for _, ppvid := range info.PPVIDs {
+		if ppvid.ID != 0 {
+			seen[ppvid.ID] = true
+		}
+	}
+	for _, vlan := range info.VLANNames {
+		seen[vlan.ID] = true
+	}
+	vlans := make([]uint16, 0, len(seen))
+	for vlan := range seen {
+		vlans = append(vlans, vlan)
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return vlans
+}
+
+func equalVLANs(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatLLDPID(id []byte, isMAC bool) string {
+	if isMAC && len(id) == 6 {
+		return net.HardwareAddr(id).String()
+	}
+	return string(id)
+}
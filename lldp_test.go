@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func lldpTLV(tlvType uint8, value []byte) []byte {
+	tlv := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(tlv, uint16(tlvType)<<9|uint16(len(value)))
+	return append(tlv, value...)
+}
+
+// createMockLLDPPacket returns an LLDP frame advertising a PVID and named VLANs
+func createMockLLDPPacket(pvid uint16, vlans ...uint16) gopacket.Packet {
+	frame := []byte{0x01, 0x80, 0xC2, 0x00, 0x00, 0x0E}
+	frame = append(frame, srcMACTest...)
+	frame = append(frame, 0x88, 0xCC)
+	frame = append(frame, lldpTLV(1, append([]byte{4}, srcMACTest...))...)
+	frame = append(frame, lldpTLV(2, append([]byte{5}, "Gi0/1"...))...)
+	frame = append(frame, lldpTLV(3, []byte{0x00, 0x78})...)
+	frame = append(frame, lldpTLV(5, []byte("switch1"))...)
+	frame = append(frame, lldpTLV(127, []byte{0x00, 0x80, 0xC2, 1, byte(pvid >> 8), byte(pvid)})...)
+	for _, vlan := range vlans {
+		name := []byte("vlan")
+		value := []byte{0x00, 0x80, 0xC2, 3, byte(vlan >> 8), byte(vlan), byte(len(name))}
+		frame = append(frame, lldpTLV(127, append(value, name...))...)
+	}
+	frame = append(frame, 0x00, 0x00)
+	return gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestLLDPMonitor(t *testing.T) {
+	monitor := newLLDPMonitor([]uint16{10, 20, 40})
+
+	if missing := monitor.missingVLANs(); missing != nil {
+		t.Errorf("Error in missingVLANs(): no VLAN can be missing before LLDP frames are received, got %v", missing)
+	}
+
+	monitor.handlePacket(createMockLLDPPacket(1, 30, 10, 20), time.Now())
+
+	neighbor, ok := monitor.neighbors[srcMACTest.String()+"/Gi0/1"]
+	if !ok {
+		t.Fatalf("Error in handlePacket(): neighbor not recorded, got %v", monitor.neighbors)
+	}
+	if neighbor.SystemName != "switch1" || !reflect.DeepEqual(neighbor.VLANs, []uint16{1, 10, 20, 30}) {
+		t.Errorf("Error in handlePacket(): unexpected neighbor %+v", neighbor)
+	}
+	if missing := monitor.missingVLANs(); !reflect.DeepEqual(missing, []uint16{40}) {
+		t.Errorf("Error in missingVLANs(): expected [40], got %v", missing)
+	}
+}
+
+func TestConfiguredVLANs(t *testing.T) {
+	cfg := brconfig{
+		DefaultPool: []uint16{5},
+		VLANs:       map[string]vlanConfig{"7": vlanConfig{DefaultPool: []uint16{8}}},
+		Devices:     devices,
+	}
+	cfg.parseVLANs()
+
+	expected := []uint16{5, 7, 8, 13, 42, 45, 46, 47, 148, 176, 1042, 1717}
+	if computed := cfg.configuredVLANs(); !reflect.DeepEqual(computed, expected) {
+		t.Errorf("Error in configuredVLANs(): expected %v, got %v", expected, computed)
+	}
+}
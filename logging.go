@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log entry
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (level logLevel) String() string {
+	for name, named := range logLevelNames {
+		if named == level {
+			return name
+		}
+	}
+	return strconv.Itoa(int(level))
+}
+
+// Formats of the log entries
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+type loggingConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+}
+
+func (cfg *loggingConfig) validate() error {
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+	if cfg.Format == "" {
+		cfg.Format = logFormatText
+	}
+	if _, ok := logLevelNames[cfg.Level]; !ok {
+		return fmt.Errorf("invalid logging level %q, expected debug, info, warn or error", cfg.Level)
+	}
+	if cfg.Format != logFormatText && cfg.Format != logFormatJSON && cfg.Format != logFormatLogfmt {
+		return fmt.Errorf("invalid logging format %q, expected %v, %v or %v", cfg.Format, logFormatText, logFormatJSON, logFormatLogfmt)
+	}
+	return nil
+}
+
+// leveledLogger writes the entries of at least its level, with their fields, as text, JSON objects or logfmt lines
+type leveledLogger struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	level  logLevel
+	format string
+	now    func() time.Time
+}
+
+// logger is the logger of the process, configured by the logging section
+var logger = newLeveledLogger(os.Stderr)
+
+func newLeveledLogger(w io.Writer) *leveledLogger {
+	return &leveledLogger{w: w, level: levelInfo, format: logFormatText, now: time.Now}
+}
+
+// setupLogging configures the logger of the process from the logging section, the --json flag of the commands
+// overriding its format. The entries written through the log package, such as the ones of the libraries,
+// are logged at info level.
+func setupLogging(cfg loggingConfig, jsonOutput bool) {
+	if jsonOutput {
+		cfg.Format = logFormatJSON
+	}
+	logger.configure(cfg)
+	log.SetFlags(0)
+	log.SetOutput(logWriter{logger})
+}
+
+// configure applies a logging section, keeping the current level or format when it is not set
+func (l *leveledLogger) configure(cfg loggingConfig) {
+	l.setLevel(cfg.Level)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if cfg.Format != "" {
+		l.format = cfg.Format
+	}
+}
+
+// setLevel changes the level of the logger, e.g. to debug reflections without restarting
+func (l *leveledLogger) setLevel(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if level, ok := logLevelNames[name]; ok {
+		l.level = level
+	}
+}
+
+// enabled tells whether entries of level are written, so that the fields of debug entries are only computed when needed
+func (l *leveledLogger) enabled(level logLevel) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return level >= l.level
+}
+
+// log writes an entry of level with the fields given as alternating keys and values
+func (l *leveledLogger) log(level logLevel, msg string, keyvals ...interface{}) {
+	if l.enabled(level) {
+		l.write(level, msg, keyvals...)
+	}
+}
+
+// write writes an entry whatever the level of the logger, e.g. for the packets traced through the API
+func (l *leveledLogger) write(level logLevel, msg string, keyvals ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var buf bytes.Buffer
+	now := l.now()
+	switch l.format {
+	case logFormatJSON:
+		writeJSONEntry(&buf, now, level, msg, keyvals)
+	case logFormatLogfmt:
+		fmt.Fprintf(&buf, "time=%v level=%v msg=%v", now.Format(time.RFC3339Nano), level, logfmtValue(msg))
+		writeLogfmtFields(&buf, keyvals)
+	default:
+		fmt.Fprintf(&buf, "%v %v %v", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+		writeLogfmtFields(&buf, keyvals)
+	}
+	buf.WriteByte('\n')
+	l.w.Write(buf.Bytes())
+}
+
+func (l *leveledLogger) infof(format string, args ...interface{}) {
+	l.log(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *leveledLogger) warnf(format string, args ...interface{}) {
+	l.log(levelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *leveledLogger) errorf(format string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(format, args...))
+}
+
+func writeJSONEntry(buf *bytes.Buffer, now time.Time, level logLevel, msg string, keyvals []interface{}) {
+	// The fields are written in order after the time, level and message, which encoding a map would not keep
+	fields := append([]interface{}{"time", now.Format(time.RFC3339Nano), "level", level.String(), "message", msg}, keyvals...)
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(fields[i+1])
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(buf, " %v=%v", keyvals[i], logfmtValue(formatLogValue(keyvals[i+1])))
+	}
+}
+
+// formatLogValue formats the lists as comma-separated values
+func formatLogValue(value interface{}) string {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return fmt.Sprint(value)
+	}
+	items := make([]string, v.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(items, ",")
+}
+
+// logfmtValue quotes value when it is empty or contains spaces, quotes or equal signs
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// logWriter logs the lines written by the log package at info level
+type logWriter struct {
+	logger *leveledLogger
+}
+
+func (writer logWriter) Write(p []byte) (int, error) {
+	writer.logger.log(levelInfo, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
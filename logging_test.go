@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs redirects the logger of the process to a buffer at the given level, until restore is called
+func captureLogs(level string) (buf *bytes.Buffer, restore func()) {
+	buf = &bytes.Buffer{}
+	logger.mutex.Lock()
+	w, previousLevel, format := logger.w, logger.level, logger.format
+	logger.w, logger.level, logger.format = buf, logLevelNames[level], logFormatText
+	logger.mutex.Unlock()
+	return buf, func() {
+		logger.mutex.Lock()
+		logger.w, logger.level, logger.format = w, previousLevel, format
+		logger.mutex.Unlock()
+	}
+}
+
+func TestLeveledLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLeveledLogger(&buf)
+	l.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	l.log(levelDebug, "hidden")
+	l.warnf("Capture on %v failed", "eth0")
+	if buf.String() != "2020/01/02 03:04:05 WARN Capture on eth0 failed\n" {
+		t.Errorf("Error in log(): expected the warning only, as text, got %q", buf.String())
+	}
+
+	buf.Reset()
+	l.configure(loggingConfig{Level: "debug", Format: logFormatLogfmt})
+	l.log(levelDebug, "Reflecting mDNS answer", "vlan", uint16(30), "targets", []uint16{20, 40}, "services", []string{})
+	expected := `time=2020-01-02T03:04:05Z level=debug msg="Reflecting mDNS answer" vlan=30 targets=20,40 services=""` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Error in log(): expected %q as logfmt, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	l.configure(loggingConfig{Format: logFormatJSON})
+	l.log(levelError, "Could not inject packet", "vlan", uint16(30), "targets", []uint16{20, 40})
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil || entry["level"] != "error" || entry["message"] != "Could not inject packet" ||
+		entry["vlan"] != float64(30) || len(entry["targets"].([]interface{})) != 2 {
+		t.Errorf("Error in log(): expected a JSON object with the fields, got %q (%v)", buf.String(), err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":"2020-01-02T03:04:05Z","level":"error","message"`) {
+		t.Errorf("Error in log(): the time, level and message should come first, got %q", buf.String())
+	}
+}
+
+func TestLoggingConfig(t *testing.T) {
+	cfg := loggingConfig{}
+	if err := cfg.validate(); err != nil || cfg.Level != "info" || cfg.Format != logFormatText {
+		t.Errorf("Error in validate(): expected info level and text format by default, got %+v (%v)", cfg, err)
+	}
+	for _, invalid := range []loggingConfig{{Level: "verbose"}, {Format: "xml"}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Error in validate(): %+v should be rejected", invalid)
+		}
+	}
+}
+
+func TestLogReflection(t *testing.T) {
+	buf, restore := captureLogs("debug")
+	defer restore()
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42, 43}},
+		},
+	}
+	r, _ := createMockReflector(cfg)
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if line := buf.String(); !strings.Contains(line, "Reflecting mDNS answer src_mac="+srcMACTest.String()) || !strings.Contains(line, "vlan=30") || !strings.Contains(line, "targets=42,43") {
+		t.Errorf("Error in processBonjourPacket(): expected the reflection to be logged at debug level, got %q", line)
+	}
+
+	buf.Reset()
+	logger.setLevel("info")
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if buf.Len() > 0 {
+		t.Errorf("Error in processBonjourPacket(): reflections should not be logged at info level, got %q", buf.String())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Default number of injected packets remembered to detect loops
+	defaultLoopCacheSize = 4096
+	// Default delay during which an injected packet seen again on the trunk is considered looped
+	defaultLoopWindow = 2 * time.Second
+)
+
+// Packets dropped because they looped back from the trunk, exposed on /debug/vars
+var loopedPackets = expvar.NewInt("looped_packets")
+
+type loopEntry struct {
+	hash   uint64
+	source macAddress
+	// srcIP is the source address of the injected packet, rewritten or not
+	srcIP net.IP
+	// vlans are the VLANs the packet was injected into
+	vlans []uint16
+	sent  time.Time
+}
+
+// loopGuard remembers the packets recently injected by the reflector in a small LRU cache, by the hash of their
+// UDP payload, the DNS message for mDNS, along with their source address and the VLANs they were injected into.
+// Another reflector serving the same VLANs, or a switch looping the trunk, would otherwise bounce them back and forth
+// between the VLANs. The packets injected by the reflector itself are already recognized by their source MAC address,
+// while the ones reflected again by another reflector carry its address instead.
+type loopGuard struct {
+	mutex   sync.Mutex
+	size    int
+	window  time.Duration
+	entries map[uint64]*list.Element
+	// order holds the entries, least recently injected first
+	order *list.List
+}
+
+func newLoopGuard(size int, window time.Duration) *loopGuard {
+	return &loopGuard{
+		size:    size,
+		window:  window,
+		entries: make(map[uint64]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// record remembers the frame data injected into the VLAN tag on behalf of the device source
+func (guard *loopGuard) record(source macAddress, tag uint16, data []byte, now time.Time) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	_, payload := parseUDPLayer(packet)
+	if payload == nil {
+		return
+	}
+	srcIP, _ := parseSourceAddress(packet)
+	entry := &loopEntry{
+		hash:   hashPayload(payload),
+		source: source,
+		srcIP:  append(net.IP(nil), srcIP...),
+		vlans:  []uint16{tag},
+		sent:   now,
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	if element, ok := guard.entries[entry.hash]; ok {
+		// The frames of a packet injected into several VLANs share its entry
+		previous := element.Value.(*loopEntry)
+		if now.Sub(previous.sent) <= guard.window && previous.srcIP.Equal(entry.srcIP) && !containsVLAN(previous.vlans, tag) {
+			entry.vlans = append(previous.vlans, tag)
+		}
+		element.Value = entry
+		guard.order.MoveToBack(element)
+		return
+	}
+	guard.entries[entry.hash] = guard.order.PushBack(entry)
+	if guard.order.Len() > guard.size {
+		oldest := guard.order.Remove(guard.order.Front()).(*loopEntry)
+		delete(guard.entries, oldest.hash)
+	}
+}
+
+// isLoop tells whether bonjourPacket is a packet injected by the reflector during the window, coming back on one of
+// the VLANs it was injected into with the source address it was injected with, and logs and counts it when it is.
+// Identical packets sent by other devices, such as the browse queries of hosts looking for the same services,
+// or by the original device on its own VLAN, are not loops.
+func (guard *loopGuard) isLoop(bonjourPacket *bonjourPacket, now time.Time) bool {
+	_, payload := parseUDPLayer(bonjourPacket.packet)
+	if payload == nil {
+		return false
+	}
+	hash := hashPayload(payload)
+
+	guard.mutex.Lock()
+	var entry loopEntry
+	element, ok := guard.entries[hash]
+	if ok {
+		entry = *element.Value.(*loopEntry)
+	}
+	guard.mutex.Unlock()
+	if !ok || now.Sub(entry.sent) > guard.window {
+		return false
+	}
+	if !containsVLAN(entry.vlans, *bonjourPacket.vlanTag) || !entry.srcIP.Equal(bonjourPacket.srcIP) {
+		return false
+	}
+	loopedPackets.Add(1)
+	if logger.enabled(levelDebug) {
+		logger.log(levelDebug, "Dropped looped packet", "source", entry.source, "injected_vlans", entry.vlans,
+			"looped_by", bonjourPacket.srcMAC.String(), "vlan", *bonjourPacket.vlanTag)
+	}
+	return true
+}
+
+func hashPayload(payload []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(payload)
+	return hasher.Sum64()
+}
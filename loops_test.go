@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestLoopGuard(t *testing.T) {
+	cfg := brconfig{
+		LoopCacheSize: defaultLoopCacheSize,
+		LoopWindow:    duration{defaultLoopWindow},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+	answer := createMockBonjourPacket(false)
+	r.processBonjourPacket(answer)
+	if len(writer.frames) != 1 {
+		t.Fatalf("Error in processBonjourPacket(): expected the answer to be reflected once, got %v frames", len(writer.frames))
+	}
+
+	// Another reflector, or a looping switch, bringing the answer back on VLAN 42
+	peerMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	looped := rewriteLinkLayer(writer.frames[0], 42, peerMAC, *answer.dstMAC)
+	loopedPacket, ok := parseBonjourPacket(gopacket.NewPacket(looped, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true}), brMACTest)
+	if !ok {
+		t.Fatal("Error in parseBonjourPacket(): looped frame was not parsed")
+	}
+	before := loopedPackets.Value()
+	r.processBonjourPacket(loopedPacket)
+	if len(writer.frames) != 1 {
+		t.Errorf("Error in processBonjourPacket(): looped answer reflected again")
+	}
+	if loopedPackets.Value() != before+1 {
+		t.Errorf("Error in processBonjourPacket(): looped answer not counted")
+	}
+
+	// The device repeating its answer is reflected again
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if len(writer.frames) != 2 {
+		t.Errorf("Error in processBonjourPacket(): repeated answer not reflected, got %v frames", len(writer.frames))
+	}
+}
+
+func TestLoopGuardIdenticalPackets(t *testing.T) {
+	guard := newLoopGuard(defaultLoopCacheSize, time.Second)
+	now := time.Now()
+	query := createMockBonjourPacket(true)
+	guard.record(macAddress(srcMACTest.String()), 42, query.packet.Data(), now)
+	guard.record(macAddress(srcMACTest.String()), 43, query.packet.Data(), now)
+
+	// The same browse query sent by another host of a VLAN the query was injected into
+	other := createMockBonjourPacket(true)
+	tag := uint16(42)
+	other.vlanTag, other.srcIP = &tag, net.IP{172, 16, 42, 9}
+	if guard.isLoop(&other, now) {
+		t.Error("Error in isLoop(): identical packet from another host detected as a loop")
+	}
+	// The injected query seen again on the VLANs it was injected into
+	for _, tag := range []uint16{42, 43} {
+		tag := tag
+		looped := createMockBonjourPacket(true)
+		looped.vlanTag = &tag
+		if !guard.isLoop(&looped, now) {
+			t.Errorf("Error in isLoop(): injected packet seen again on VLAN %v not detected as a loop", tag)
+		}
+	}
+	// But not on a VLAN it was not injected into
+	if guard.isLoop(&query, now) {
+		t.Error("Error in isLoop(): packet seen on its own VLAN detected as a loop")
+	}
+}
+
+func TestLoopGuardEviction(t *testing.T) {
+	guard := newLoopGuard(2, time.Second)
+	now := time.Now()
+	packets := []bonjourPacket{createMockBonjourPacket(true), createMockBonjourPacket(false)}
+	for _, bonjourPacket := range packets {
+		guard.record(macAddress(srcMACTest.String()), 42, bonjourPacket.packet.Data(), now)
+	}
+
+	loop := createMockBonjourPacket(true)
+	tag := uint16(42)
+	loop.srcMAC, loop.vlanTag = &net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}, &tag
+	if !guard.isLoop(&loop, now) {
+		t.Error("Error in isLoop(): recorded packet from another device not detected as a loop")
+	}
+	if guard.isLoop(&loop, now.Add(2*time.Second)) {
+		t.Error("Error in isLoop(): packet detected as a loop after the window")
+	}
+
+	// Recording a third packet evicts the least recently injected one, the query
+	third := append([]byte(nil), packets[1].packet.Data()...)
+	third[len(third)-1]++
+	guard.record(macAddress(srcMACTest.String()), 42, third, now)
+	if guard.isLoop(&loop, now) {
+		t.Error("Error in isLoop(): evicted packet still detected as a loop")
+	}
+	if len(guard.entries) != 2 || guard.order.Len() != 2 {
+		t.Errorf("Error in record(): expected 2 entries, got %v", len(guard.entries))
+	}
+}
@@ -3,86 +3,348 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
 func main() {
-	// Read config file and generate mDNS forwarding maps
-	configPath := flag.String("config", "", "Config file in TOML format")
-	debug := flag.Bool("debug", false, "Enable pprof server on /debug/pprof/")
-	flag.Parse()
+	os.Exit(runCommandLine(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+var runCommand = &command{
+	name:    "run",
+	summary: "Reflect Bonjour traffic across VLANs (default command)",
+	setup:   setupRunCommand,
+}
 
-	// Start debug server
-	if *debug {
-		go debugServer(6060)
+func setupRunCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	configPath := flags.String("config", "", "Config file in TOML, YAML or JSON format")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+	format := flags.String("format", "", "Format of the config file: toml, yaml or json (default from its extension)")
+	debug := flags.Bool("debug", false, "Enable pprof server on /debug/pprof/")
+	noRecover := flags.Bool("no-recover", false, "Let a panic while processing a packet crash the process, for debugging")
+	dryRun := flags.Bool("dry-run", false, "Capture and filter the traffic, but log what would be reflected instead of injecting frames")
+
+	return func(out *commandOutput, args []string) error {
+		setupLogging(loggingConfig{Level: "info"}, out.json)
+		// Start debug server
+		if *debug {
+			go debugServer(6060)
+		}
+		// Read config file
+		cfg, err := readProfileAs(*configPath, *profile, *format)
+		if err != nil {
+			return configError(fmt.Errorf("could not read configuration: %v", err))
+		}
+		setupLogging(cfg.Logging, out.json)
+		cfg.dryRun = *dryRun
+		return runReflector(cfg, !*noRecover)
 	}
+}
 
-	cfg, err := readConfig(*configPath)
+func runReflector(cfg brconfig, recoverPanics bool) error {
+	inv, err := loadInventory(cfg.InventoryFile, cfg.InventorySize)
 	if err != nil {
-		log.Fatalf("Could not read configuration: %v", err)
+		return fmt.Errorf("could not read inventory file: %v", err)
 	}
-	poolsMap := mapByPool(cfg.Devices)
 
-	// Get a handle on the network interface
-	rawTraffic, err := pcap.OpenLive(cfg.NetInterface, 65536, true, time.Second)
+	hits, err := loadRuleHits(cfg.RuleHitsFile, cfg.Devices)
 	if err != nil {
-		log.Fatalf("Could not find network interface: %v", cfg.NetInterface)
+		return fmt.Errorf("could not read rule hits file: %v", err)
 	}
+	http.Handle("/debug/rules", hits)
 
-	// Filter tagged bonjour traffic
-	err = rawTraffic.SetBPFFilter("vlan and udp dst port 5353")
+	instanceID, err := loadInstanceID(cfg.InstanceIDFile)
 	if err != nil {
-		log.Fatalf("Could not apply filter on network interface")
+		return fmt.Errorf("could not read instance ID file: %v", err)
+	}
+	startTelemetry(cfg, instanceID)
+
+	recovery, err := newPanicRecovery(recoverPanics, cfg.PanicCaptureFile)
+	if err != nil {
+		return fmt.Errorf("could not open panic capture file: %v", err)
+	}
+
+	// Get a handle on the first network interface which can be opened, or on every trunk interface,
+	// following the reloaded configuration when failing over
+	reloader := newConfigReloader(cfg)
+	rawTraffic, err := openTrunkCapture(&cfg, func(intf string) (captureHandle, error) {
+		intfCfg := reloader.config()
+		intfCfg.NetInterface = intf
+		return openCapture(&intfCfg)
+	})
+	if err != nil {
+		return err
+	}
+	// The other settings depending on the interface follow the one active at startup
+	cfg.NetInterface = rawTraffic.activeInterface()
+
+	duplicates, err := newBondDuplicateFilter(cfg.NetInterface)
+	if err != nil {
+		return err
+	}
+	if cfg.LLDPDiagnostics {
+		if err := startLLDPMonitor(cfg); err != nil {
+			return err
+		}
 	}
+
 	// Get the local MAC address, to filter out Bonjour packet generated locally
 	intf, err := net.InterfaceByName(cfg.NetInterface)
 	if err != nil {
-		log.Fatal(err)
+		return interfaceMissingError(fmt.Errorf("could not find network interface %v: %v", cfg.NetInterface, err))
 	}
 	brMACAddress := intf.HardwareAddr
+	checkAddresses(&cfg, cfg.NetInterface)
 
-	// Get a channel of Bonjour packets to process
+	// Get a channel of Bonjour packets to process, the watchdog following the progress of the capture
+	dog := newWatchdog(cfg.Watchdog, rawTraffic, time.Now())
 	decoder := gopacket.DecodersByLayerName["Ethernet"]
-	source := gopacket.NewPacketSource(rawTraffic, decoder)
-	bonjourPackets := filterBonjourPacketsLazily(source, brMACAddress)
+	source := gopacket.NewPacketSource(dog.watch(rawTraffic), decoder)
+	bonjourPackets := prioritizeBonjourPackets(filterBonjourPacketsLazily(source, brMACAddress, &cfg, recovery), cfg.PriorityQueue)
+
+	policy, err := loadPolicy(cfg.PolicyModule, cfg.PolicyTimeout.Duration)
+	if err != nil {
+		return err
+	}
+
+	// Inject the reflected frames through the trunk, or through the egress of their VLAN, unless running dry
+	var egress packetWriter = dryRunWriter{}
+	if cfg.dryRun {
+		logger.warnf("Dry run: no frame is injected, the packets which would be reflected are logged instead")
+	} else if egress, err = openEgress(&cfg, rawTraffic, openEgressInterface); err != nil {
+		return err
+	}
 
 	// Process Bonjours packets
+	reflector, err := setupReflector(cfg, inv, hits, egress, brMACAddress)
+	if err != nil {
+		return err
+	}
+	reflector.policy = policy
+	startMonitors(&cfg, reflector, instanceID, intf)
+	startReplication(&cfg, reflector)
+	registerHealthChecks(&cfg, rawTraffic)
+	watchReloads(reloader, rawTraffic, reflector)
+	dog.start(reflector.pipelines, reflector.hooks)
+	if cfg.servesAPI() {
+		startManagementAPI(&cfg, reflector)
+	}
+	// Every handle and listener needing root is open
+	if err := dropPrivileges(cfg.Privileges); err != nil {
+		return err
+	}
+	// The loop ends once the capture is stopped and the packets already captured are processed
+	go stopOnSignal(rawTraffic)
+	processBonjourPackets(bonjourPackets, reflector, duplicates, dog, recovery)
+	reflector.shutdown(rawTraffic, shutdownFlushTimeout)
+	return nil
+}
+
+// setupReflector returns the reflector of the configuration, with its pipelines, vendors, hooks, learned prefixes
+// and stats, and warns about the settings needing attention
+func setupReflector(cfg brconfig, inv *inventory, hits *ruleHits, egress packetWriter, brMACAddress net.HardwareAddr) (*reflector, error) {
+	var err error
+	reflector := newReflector(cfg, inv, hits, egress, brMACAddress)
+	reflector.pipelines = newReflectionPipelines(cfg.Pipelines, reflector.send)
+	if reflector.vendors, err = loadVendors(cfg.OUIFile); err != nil {
+		return nil, fmt.Errorf("could not read OUI file: %v", err)
+	}
+	if cfg.NATPMPReflection {
+		logger.warnf(natpmpWarning)
+	}
+	if warning := cfg.emptyDevicesWarning(); warning != "" {
+		logger.warnf("%v", warning)
+	}
+	if cfg.WarmUp.Duration > 0 {
+		logger.infof("Warming up for %v: traffic is observed, but not reflected yet", cfg.WarmUp.Duration)
+	}
+	if reflector.hooks, err = newHookRunner(cfg.Hooks); err != nil {
+		return nil, err
+	}
+	if err := startPrefixLearning(cfg, reflector.prefixes); err != nil {
+		return nil, err
+	}
+	if cfg.StatsFile != "" {
+		if reflector.stats, err = loadStats(cfg.StatsFile, time.Now()); err != nil {
+			return nil, fmt.Errorf("could not read stats file: %v", err)
+		}
+		go reflector.stats.run(statsSaveInterval)
+	}
+	return reflector, nil
+}
+
+// processBonjourPackets processes the captured packets until the capture is stopped,
+// skipping the frames duplicated by a bond
+func processBonjourPackets(bonjourPackets chan bonjourPacket, reflector *reflector, duplicates *duplicateFilter, dog *watchdog, recovery *panicRecovery) {
 	for bonjourPacket := range bonjourPackets {
-		fmt.Println(bonjourPacket.packet.String())
-		if bonjourPacket.vlanTag == nil {
+		if duplicates != nil && duplicates.isDuplicate(bonjourPacket.packet.Data(), time.Now()) {
 			continue
 		}
-		// Forward the mDNS query or response to appropriate VLANs
-		if bonjourPacket.isDNSQuery {
-			tags, ok := poolsMap[*bonjourPacket.vlanTag]
-			if !ok {
-				continue
-			}
-			for _, tag := range tags {
-				sendBonjourPacket(rawTraffic, &bonjourPacket, tag, brMACAddress)
-			}
-		} else {
-			device, ok := cfg.Devices[macAddress(bonjourPacket.srcMAC.String())]
-			if !ok {
-				continue
-			}
-			for _, tag := range device.SharedPools {
-				sendBonjourPacket(rawTraffic, &bonjourPacket, tag, brMACAddress)
-			}
+		dog.processing(time.Now())
+		recovery.run(bonjourPacket.packet, func() {
+			reflector.processBonjourPacket(bonjourPacket)
+		})
+		dog.processed()
+	}
+}
+
+// startMonitors starts the peer discovery, the beacon, the checks of the expected services, the noise report
+// and the watch of the wall clock, and exposes their state
+func startMonitors(cfg *brconfig, reflector *reflector, instanceID string, intf *net.Interface) {
+	go watchClock(clockCheckInterval)
+	if cfg.PeerDiscovery {
+		reflector.peers = newPeerTracker(instanceID, cfg.configuredVLANs(), cfg.PeerPartitioning, cfg.peerMACs)
+		reflector.peers.hooks = reflector.hooks
+		http.Handle("/debug/peers", reflector.peers)
+		go reflector.advertisePeer(interfaceIPv4(intf))
+	}
+	if len(cfg.Beacon.VLANs) > 0 {
+		go reflector.runBeacon(newBeacon(cfg.Beacon, instanceID, time.Now()), interfaceIPv4(intf))
+	}
+	http.Handle("/debug/unicast", reflector.unicastTable)
+	http.Handle("/debug/bandwidth", reflector.bandwidth)
+	http.Handle("/debug/service-usage", reflector.serviceUsage)
+	http.Handle("/debug/quirks", reflector.quirks)
+	noise := noiseReporter{reflector.serviceUsage}
+	http.Handle("/debug/noise", noise)
+	if cfg.NoiseReport.Duration > 0 {
+		go noise.run(cfg.NoiseReport.Duration)
+	}
+	http.Handle("/debug/compliance", complianceHandler{reflector})
+	http.Handle("/healthz", health)
+	if len(cfg.ExpectedServices) > 0 {
+		slo := newSLOMonitor(cfg.ExpectedServices, reflector.services)
+		http.Handle("/debug/slo", slo)
+		go slo.run(cfg.SLOCheckInterval.Duration)
+	}
+}
+
+// startManagementAPI serves the management API on api_listen and api_socket
+func startManagementAPI(cfg *brconfig, reflector *reflector) {
+	announcer := newAnnouncer(reflector.write, reflector.brMACAddress)
+	api := http.NewServeMux()
+	api.Handle("/api/announcements", announcer)
+	api.Handle("/api/announcements/", announcer)
+	devices := &deviceAPI{configPath: cfg.path, format: cfg.format, profile: cfg.profile, devicesPrefix: cfg.devicesPrefix, reflector: reflector, reloader: reflector.reloader}
+	api.Handle("/api/devices", devices)
+	api.Handle("/api/devices/", devices)
+	inventory := inventoryAPI{inventory: reflector.inventory, devices: devices, updates: reflector.deviceUpdates}
+	api.Handle("/api/inventory", inventory)
+	api.Handle("/api/inventory/", inventory)
+	api.Handle("/api/drains", drainAPI{reflector})
+	api.Handle("/api/drains/", drainAPI{reflector})
+	api.Handle("/api/vlans", vlansAPI{reflector})
+	api.Handle("/api/reload", reloadAPI{reflector.reloader})
+	api.Handle("/api/trace", traceAPI{reflector.tracer})
+	api.Handle("/api/explain", explainAPI{reflector})
+	api.Handle("/api/v1/services", servicesAPI{reflector.services})
+	api.Handle("/api/v1/openapi.json", servicesAPI{reflector.services})
+	api.Handle("/api/v1/replication", replicationAPI{reflector})
+	api.Handle("/healthz", health)
+	status := newSubsystemStatus()
+	health.register("api", false, status.check(nil))
+	apiServer(cfg, apiGuard{allowed: cfg.apiClients, handler: apiAuth{token: cfg.APIToken, handler: api}}, status)
+	go announcer.run(time.Second)
+}
+
+// openCapture returns the handle of the configured capture mode
+func openCapture(cfg *brconfig) (captureHandle, error) {
+	if cfg.CaptureMode == captureSocket {
+		handle, err := openSocketCapture(cfg)
+		return handle, captureError(cfg.NetInterface, err)
+	}
+	if cfg.CaptureMode == captureAFPacket {
+		rules := newCaptureRules(cfg)
+		handle, err := openAFPacketCapture(cfg.NetInterface, cfg.AFPacket, rules.program())
+		if err != nil {
+			return nil, captureError(cfg.NetInterface, err)
+		}
+		logger.infof("Capture filter installed: %v", rules.expression())
+		return handle, nil
+	}
+	handle, err := pcap.OpenLive(cfg.NetInterface, 65536, true, time.Second)
+	if err != nil {
+		return nil, captureError(cfg.NetInterface, fmt.Errorf("could not capture on network interface %v: %v", cfg.NetInterface, err))
+	}
+
+	// Filter tagged bonjour traffic
+	filter := &captureFilter{handle: handle}
+	if err := filter.update(cfg); err != nil {
+		return nil, captureError(cfg.NetInterface, fmt.Errorf("could not apply filter on network interface: %v", err))
+	}
+	return handle, nil
+}
+
+// interfaceIPv4 returns the first IPv4 address of intf, or 0.0.0.0 when the trunk has no address
+func interfaceIPv4(intf *net.Interface) net.IP {
+	addrs, _ := intf.Addrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4()
 		}
 	}
+	return net.IPv4zero.To4()
+}
+
+// newBondDuplicateFilter checks the bonding setup of the network interface,
+// and returns a filter of duplicated frames when it is a bond master
+func newBondDuplicateFilter(intf string) (*duplicateFilter, error) {
+	bond, err := detectBond("/sys/class/net", intf)
+	if err != nil || bond == nil {
+		return nil, err
+	}
+	logger.infof("Network interface %v is a bond (mode %v, slaves %v), dropping frames duplicated by its slaves", intf, bond.mode, bond.slaves)
+	return newDuplicateFilter(bondDuplicateWindow), nil
+}
+
+// startLLDPMonitor listens for LLDP frames on a dedicated handle, as they are excluded by the Bonjour filter
+func startLLDPMonitor(cfg brconfig) error {
+	handle, err := pcap.OpenLive(cfg.NetInterface, 1600, true, time.Second)
+	if err != nil {
+		return captureError(cfg.NetInterface, fmt.Errorf("could not open network interface %v for LLDP: %v", cfg.NetInterface, err))
+	}
+	if err := handle.SetBPFFilter(lldpFilter); err != nil {
+		return fmt.Errorf("could not apply LLDP filter on network interface: %v", err)
+	}
+	monitor := newLLDPMonitor(cfg.configuredVLANs())
+	http.Handle("/debug/lldp", monitor)
+	go monitor.watch(gopacket.NewPacketSource(handle, layers.LayerTypeEthernet))
+	return nil
+}
+
+// startPrefixLearning listens for IPv6 router advertisements on a dedicated handle, as they are excluded by the Bonjour filter.
+// Nothing is started when prefixes are not learned.
+func startPrefixLearning(cfg brconfig, learner *prefixLearner) error {
+	if learner == nil {
+		return nil
+	}
+	handle, err := pcap.OpenLive(cfg.NetInterface, 1600, true, time.Second)
+	if err != nil {
+		return captureError(cfg.NetInterface, fmt.Errorf("could not open network interface %v for router advertisements: %v", cfg.NetInterface, err))
+	}
+	if err := handle.SetBPFFilter(routerAdvertisementFilter); err != nil {
+		return fmt.Errorf("could not apply router advertisement filter on network interface: %v", err)
+	}
+	http.Handle("/debug/prefixes", learner)
+	go learner.watch(gopacket.NewPacketSource(handle, layers.LayerTypeEthernet))
+	return nil
 }
 
 func debugServer(port int) {
+	history := newCounterHistory()
+	http.Handle("/debug/counters", history)
+	go history.run()
 	err := http.ListenAndServe(fmt.Sprintf("localhost:%d", port), nil)
 	if err != nil {
-		log.Fatalf("The application was started with -debug flag but could not listen on port %v: \n %s", port, err)
+		logger.errorf("The application was started with -debug flag but could not listen on port %v: \n %s", port, err)
+		os.Exit(exitFailure)
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// Port the NAT-PMP and PCP clients listen on for the announcements of their gateway
+	natpmpClientPort = 5350
+	// Port the announcements are sent from
+	natpmpServerPort = 5351
+)
+
+// Multicast groups of the announcements of NAT-PMP gateways (RFC 6886, section 3.2.1)
+// and PCP servers (RFC 6887, section 14.1)
+var natpmpGroups = []passthroughGroup{
+	{ip: net.ParseIP("224.0.0.1"), port: natpmpClientPort},
+	{ip: net.ParseIP("ff02::1"), port: natpmpClientPort},
+}
+
+// NAT-PMP and PCP announcements seen and reflected, exposed on /debug/vars
+var natpmpStats = expvar.NewMap("natpmp")
+
+// Warning logged when the reflector starts, and by the check command, with natpmp_reflection
+const natpmpWarning = "natpmp_reflection is enabled: clients of the VLANs the announcements are reflected to take the " +
+	"gateway for their own, and may lose their port mappings or map ports on a gateway they cannot reach"
+
+func isNATPMPGroup(group passthroughGroup) bool {
+	for _, natpmpGroup := range natpmpGroups {
+		if natpmpGroup.ip.Equal(group.ip) && natpmpGroup.port == group.port {
+			return true
+		}
+	}
+	return false
+}
+
+// natpmpAnnouncement is the multicast announcement of a gateway, sent when it starts or its external address changes
+type natpmpAnnouncement struct {
+	// protocol is "nat-pmp" or "pcp"
+	protocol string
+	// epoch is the seconds since the start of the gateway, which the clients compare to detect that it lost its mappings
+	epoch uint32
+}
+
+// parseNATPMPAnnouncement parses a NAT-PMP public address announcement (version 0, opcode 128),
+// or a PCP ANNOUNCE response (version 2, opcode 0 with the response bit set)
+func parseNATPMPAnnouncement(payload []byte) (*natpmpAnnouncement, error) {
+	switch {
+	case len(payload) >= 12 && payload[0] == 0 && payload[1] == 128:
+		return &natpmpAnnouncement{protocol: "nat-pmp", epoch: binary.BigEndian.Uint32(payload[4:8])}, nil
+	case len(payload) >= 24 && payload[0] == 2 && payload[1] == 0x80:
+		return &natpmpAnnouncement{protocol: "pcp", epoch: binary.BigEndian.Uint32(payload[8:12])}, nil
+	}
+	return nil, fmt.Errorf("not an announcement")
+}
+
+// parseNATPMPPacket returns the NAT-PMP and PCP announcements sent to one of their groups
+func parseNATPMPPacket(packet gopacket.Packet, brMACAddress net.HardwareAddr) (bonjourPacket, bool) {
+	bonjourPacket, ok := parsePassthroughPacket(packet, brMACAddress, natpmpGroups)
+	if !ok {
+		return bonjourPacket, false
+	}
+	_, payload := parseUDPLayer(packet)
+	announcement, err := parseNATPMPAnnouncement(payload)
+	if err != nil || bonjourPacket.srcPort != natpmpServerPort {
+		natpmpStats.Add("invalid", 1)
+		return bonjourPacket, false
+	}
+	bonjourPacket.passthrough = false
+	bonjourPacket.natpmp = announcement
+	return bonjourPacket, true
+}
+
+// sendNATPMP reflects the announcement of a gateway to the shared pools of its device entry, like an answer,
+// only rewriting its VLAN tag and source MAC address. Gateways without device entry are handled according
+// to unknown_device_mode.
+func (r *reflector) sendNATPMP(bonjourPacket *bonjourPacket) {
+	if time.Now().Before(r.warmUpUntil) {
+		return
+	}
+	natpmpStats.Add("announcements", 1)
+	tags := r.discoveryTargets(bonjourPacket, false, false)
+	frames := r.sendLinkLayer(bonjourPacket, protocolNATPMP, tags)
+	natpmpStats.Add("reflected", int64(frames))
+	if frames > 0 && logger.enabled(levelDebug) {
+		logger.log(levelDebug, "Reflected gateway announcement", "protocol", bonjourPacket.natpmp.protocol,
+			"gateway", bonjourPacket.srcIP, "epoch", bonjourPacket.natpmp.epoch, "vlans", tags)
+	}
+}
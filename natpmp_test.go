@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// NAT-PMP announcement of the public address 203.0.113.7, 3600 seconds after the start of the gateway
+var natpmpAnnouncementTest = []byte{0, 128, 0, 0, 0, 0, 0x0E, 0x10, 203, 0, 113, 7}
+
+func createMockNATPMPPacket(tag uint16, srcPort layers.UDPPort, payload []byte) gopacket.Packet {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolUDP, SrcIP: srcIPv4Test, DstIP: []byte{224, 0, 0, 1}}
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: natpmpClientPort}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: []byte{0x01, 0x00, 0x5E, 0x00, 0x00, 0x01}, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, gopacket.Payload(payload))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestParseNATPMPAnnouncement(t *testing.T) {
+	announcement, err := parseNATPMPAnnouncement(natpmpAnnouncementTest)
+	if err != nil || announcement.protocol != "nat-pmp" || announcement.epoch != 3600 {
+		t.Errorf("Error in parseNATPMPAnnouncement(): got %+v (%v)", announcement, err)
+	}
+	pcp := make([]byte, 24)
+	pcp[0], pcp[1], pcp[11] = 2, 0x80, 42
+	announcement, err = parseNATPMPAnnouncement(pcp)
+	if err != nil || announcement.protocol != "pcp" || announcement.epoch != 42 {
+		t.Errorf("Error in parseNATPMPAnnouncement(): got %+v (%v)", announcement, err)
+	}
+	// Requests, mapping responses and truncated announcements are not announcements
+	for _, payload := range [][]byte{{0, 0}, {0, 129, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, natpmpAnnouncementTest[:8], {2, 0x81}, pcp[:12]} {
+		if _, err := parseNATPMPAnnouncement(payload); err == nil {
+			t.Errorf("Error in parseNATPMPAnnouncement(): expected an error for %v", payload)
+		}
+	}
+}
+
+func TestNATPMPReflection(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`natpmp_reflection = true
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter := buildCaptureFilter(&cfg); !strings.Contains(filter, "dst host 224.0.0.1 and udp dst port 5350") {
+		t.Errorf("Error in buildCaptureFilter(): expected the announcement groups to be captured, got %q", filter)
+	}
+	if _, ok := parseNATPMPPacket(createMockNATPMPPacket(vlanIdentifierTest, 40000, natpmpAnnouncementTest), brMACTest); ok {
+		t.Error("Error in parseNATPMPPacket(): announcements are only sent from port 5351")
+	}
+
+	bonjourPacket, ok := parseNATPMPPacket(createMockNATPMPPacket(vlanIdentifierTest, natpmpServerPort, natpmpAnnouncementTest), brMACTest)
+	if !ok || bonjourPacket.natpmp == nil || bonjourPacket.passthrough {
+		t.Fatal("Error in parseNATPMPPacket(): expected the announcement to be parsed")
+	}
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Fatalf("Error in processBonjourPacket(): expected the announcement to be reflected to the shared pools, got %v", tags)
+	}
+	reflected := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	if udp, ok := reflected.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.Payload, natpmpAnnouncementTest) {
+		t.Error("Error in processBonjourPacket(): expected the announcement to be reflected unmodified")
+	}
+
+	// Gateways without device entry are dropped by default
+	writer.frames = nil
+	r.cfg.Devices = nil
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): expected the announcement of an unknown gateway to be dropped, got %v", tags)
+	}
+
+	if _, err := parseConfig(`natpmp_reflection = true
+		passthrough = ["224.0.0.1:5350"]`); err == nil {
+		t.Error("Error in parseConfig(): NAT-PMP groups should not be passed through when reflected")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Share of the reflected traffic of a device going to VLANs which never queried for it, above which the device
+// is reported as a candidate for filtering
+const noiseCandidateShare = 0.5
+
+// Number of candidates logged by the periodic noise report
+const noiseReportSize = 10
+
+// noiseSource is the traffic reflected from a device, and the part of it reflected to VLANs which never queried
+// for its service types
+type noiseSource struct {
+	Device     macAddress `json:"device"`
+	Bytes      uint64     `json:"bytes"`
+	NoiseBytes uint64     `json:"noise_bytes"`
+	Share      float64    `json:"share"`
+	// Service types reflected to VLANs which never queried for them, noisiest first
+	Services  []string `json:"services"`
+	Candidate bool     `json:"candidate"`
+}
+
+type noiseReport struct {
+	Since   time.Time     `json:"since"`
+	Sources []noiseSource `json:"sources"`
+}
+
+// candidates returns the sources reported as candidates for filtering
+func (report noiseReport) candidates() (candidates []noiseSource) {
+	for _, source := range report.Sources {
+		if source.Candidate {
+			candidates = append(candidates, source)
+		}
+	}
+	return
+}
+
+// rankNoiseSources ranks the devices by the traffic they had reflected to VLANs which never queried for its
+// service types, noisiest first. The traffic of an answer is shared evenly between the VLANs it was reflected to.
+func rankNoiseSources(usage serviceUsageReport) noiseReport {
+	queried := make(map[serviceVLANKey]bool)
+	for _, query := range usage.Queries {
+		queried[serviceVLANKey{service: query.Service, vlan: query.VLAN}] = true
+	}
+	sources := make(map[macAddress]*noiseSource)
+	noise := make(map[serviceDeviceKey]uint64)
+	for _, answer := range usage.Answers {
+		source, ok := sources[answer.Device]
+		if !ok {
+			source = &noiseSource{Device: answer.Device, Services: []string{}}
+			sources[answer.Device] = source
+		}
+		source.Bytes += answer.Bytes
+		var unqueried uint64
+		for _, tag := range answer.VLANs {
+			if !queried[serviceVLANKey{service: answer.Service, vlan: tag}] {
+				unqueried++
+			}
+		}
+		if unqueried > 0 {
+			bytes := answer.Bytes * unqueried / uint64(len(answer.VLANs))
+			source.NoiseBytes += bytes
+			source.Services = append(source.Services, answer.Service)
+			noise[serviceDeviceKey{service: answer.Service, device: answer.Device}] = bytes
+		}
+	}
+
+	report := noiseReport{Since: usage.Since, Sources: make([]noiseSource, 0, len(sources))}
+	for _, source := range sources {
+		if source.Bytes > 0 {
+			source.Share = float64(source.NoiseBytes) / float64(source.Bytes)
+		}
+		source.Candidate = source.NoiseBytes > 0 && source.Share >= noiseCandidateShare
+		services := source.Services
+		sort.Slice(services, func(i, j int) bool {
+			noiseI := noise[serviceDeviceKey{service: services[i], device: source.Device}]
+			noiseJ := noise[serviceDeviceKey{service: services[j], device: source.Device}]
+			if noiseI != noiseJ {
+				return noiseI > noiseJ
+			}
+			return services[i] < services[j]
+		})
+		report.Sources = append(report.Sources, *source)
+	}
+	sort.Slice(report.Sources, func(i, j int) bool {
+		if report.Sources[i].NoiseBytes != report.Sources[j].NoiseBytes {
+			return report.Sources[i].NoiseBytes > report.Sources[j].NoiseBytes
+		}
+		return report.Sources[i].Device < report.Sources[j].Device
+	})
+	return report
+}
+
+// noiseReporter ranks the noise sources from the service usage, on /debug/noise and periodically in the logs
+type noiseReporter struct {
+	usage *serviceUsage
+}
+
+// run logs the candidates for filtering every interval
+func (reporter noiseReporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		reporter.log(rankNoiseSources(reporter.usage.report()))
+	}
+}
+
+func (reporter noiseReporter) log(report noiseReport) {
+	candidates := report.candidates()
+	logger.log(levelInfo, "Noise report", "devices", len(report.Sources), "candidates", len(candidates))
+	for i, source := range candidates {
+		if i == noiseReportSize {
+			break
+		}
+		logger.log(levelWarn, "Noise source", "device", source.Device, "noise_bytes", source.NoiseBytes,
+			"share", fmt.Sprintf("%.0f%%", source.Share*100), "services", source.Services)
+	}
+}
+
+func (reporter noiseReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rankNoiseSources(reporter.usage.report()))
+}
+
+var noiseCommand = &command{
+	name:    "noise",
+	summary: "Rank the devices of a running reflector by the traffic reflected for nobody",
+	setup:   setupNoiseCommand,
+}
+
+func setupNoiseCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:6060", "Address of the debug server of the running reflector")
+	top := flags.Int("top", noiseReportSize, "Number of devices shown, 0 for all")
+
+	return func(out *commandOutput, args []string) error {
+		var report noiseReport
+		if err := callAPI(*addr, "", http.MethodGet, "/debug/noise", nil, &report); err != nil {
+			return fmt.Errorf("could not read noise report, was the reflector started with -debug? %v", err)
+		}
+		if *top > 0 && len(report.Sources) > *top {
+			report.Sources = report.Sources[:*top]
+		}
+		return out.print(report, func(w io.Writer) { printNoiseReport(w, report) })
+	}
+}
+
+func printNoiseReport(w io.Writer, report noiseReport) {
+	fmt.Fprintf(w, "Based on %v of traffic.\n", time.Since(report.Since).Round(time.Minute))
+	if len(report.Sources) == 0 {
+		fmt.Fprintln(w, "No answer reflected yet")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tBYTES\tNOISE\tSHARE\tUNQUERIED SERVICES")
+	for _, source := range report.Sources {
+		services, mark := formatLogValue(source.Services), ""
+		if len(source.Services) == 0 {
+			services = "-"
+		}
+		if source.Candidate {
+			mark = " (candidate for filtering)"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.0f%%\t%v%v\n", source.Device, source.Bytes, source.NoiseBytes, source.Share*100, services, mark)
+	}
+	tw.Flush()
+}
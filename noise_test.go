@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestRankNoiseSources(t *testing.T) {
+	now := time.Now()
+	usage := newServiceUsage(now)
+	usage.recordQuery(&layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_googlecast._tcp.local"), Type: layers.DNSTypePTR}}}, 1234, now)
+	cast := createMockPTRAnswer("_googlecast._tcp.local", "TV._googlecast._tcp.local", 120)
+	usage.recordAnswer(cast, "aa:00:cc:00:ee:00", []uint16{1234}, 900)
+	usage.recordAnswer(cast, "aa:00:cc:00:ee:01", []uint16{1234}, 100)
+	spotify := createMockPTRAnswer("_spotify-connect._tcp.local", "TV._spotify-connect._tcp.local", 120)
+	usage.recordAnswer(spotify, "aa:00:cc:00:ee:00", []uint16{1234, 2483}, 100)
+	usage.recordAnswer(spotify, "aa:00:cc:00:ee:02", []uint16{2483}, 300)
+
+	report := rankNoiseSources(usage.report())
+	if len(report.Sources) != 3 {
+		t.Fatalf("Error in rankNoiseSources(): expected 3 devices, got %+v", report.Sources)
+	}
+	noisiest := report.Sources[0]
+	if noisiest.Device != "aa:00:cc:00:ee:02" || noisiest.NoiseBytes != 300 || noisiest.Share != 1 || !noisiest.Candidate {
+		t.Errorf("Error in rankNoiseSources(): expected the device only reflected for nobody first, got %+v", noisiest)
+	}
+	if source := report.Sources[1]; source.Device != "aa:00:cc:00:ee:00" || source.Bytes != 1100 || source.NoiseBytes != 200 ||
+		source.Candidate || !reflect.DeepEqual(source.Services, []string{"_spotify-connect._tcp.local"}) {
+		t.Errorf("Error in rankNoiseSources(): a device mostly reflected for its queriers is no candidate, got %+v", source)
+	}
+	if source := report.Sources[2]; source.NoiseBytes != 0 || source.Candidate || len(source.Services) != 0 {
+		t.Errorf("Error in rankNoiseSources(): expected a device without noise last, got %+v", source)
+	}
+
+	logs, restore := captureLogs("info")
+	defer restore()
+	noiseReporter{usage}.log(report)
+	if !strings.Contains(logs.String(), "devices=3 candidates=1") || strings.Count(logs.String(), "Noise source") != 1 ||
+		!strings.Contains(logs.String(), "device=aa:00:cc:00:ee:02") {
+		t.Errorf("Error in log(): expected the candidate to be logged, got %q", logs.String())
+	}
+}
@@ -1,23 +1,48 @@
 package main
 
 import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
 	"net"
+	"sync"
 
+	"github.com/L3Nerd/bonjour-reflector/transport"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 type bonjourPacket struct {
 	packet     gopacket.Packet
 	srcMAC     *net.HardwareAddr
 	dstMAC     *net.HardwareAddr
+	srcIP      net.IP
+	srcPort    layers.UDPPort
 	isIPv6     bool
 	vlanTag    *uint16
 	isDNSQuery bool
+	dns        *layers.DNS
+	// dnsRewritten is set when records of dns were modified, so that it gets serialized in place of the original payload
+	dnsRewritten bool
+	// sourceRewritten is set while the source address of the IP layer is replaced, so that checksums get recomputed
+	sourceRewritten bool
+	// passthrough is set for the packets of the passthrough groups, which are reflected without being parsed
+	passthrough bool
+	// ssdp is set for the SSDP messages, which are reflected unmodified
+	ssdp *ssdpMessage
+	// wsd is set for the WS-Discovery messages, which are reflected unmodified
+	wsd *wsdMessage
+	// natpmp is set for the NAT-PMP and PCP announcements, which are reflected unmodified
+	natpmp *natpmpAnnouncement
+	// legacyResponse is set for the unicast responses to legacy queries, which are only relayed to their querier
+	legacyResponse bool
+	// quResponse is set for the unicast responses to QU questions, sent to port 5353 of their querier
+	quResponse bool
+	// replay is set for the answers of devices waking up, whose frames are sent again by the quirks
+	replay bool
 }
 
-func filterBonjourPacketsLazily(source *gopacket.PacketSource, brMACAddress net.HardwareAddr) chan bonjourPacket {
+func filterBonjourPacketsLazily(source *gopacket.PacketSource, brMACAddress net.HardwareAddr, cfg *brconfig, recovery *panicRecovery) chan bonjourPacket {
 	// Process packets, and forward Bonjour traffic to the returned channel
 
 	// Set decoding to Lazy
@@ -25,43 +50,112 @@ func filterBonjourPacketsLazily(source *gopacket.PacketSource, brMACAddress net.
 
 	packetChan := make(chan bonjourPacket, 100)
 
+	// The packets are decoded and filtered by a pool of workers, the packets of a source always going
+	// to the same worker, so that they are passed on in order
+	workers := make([]chan gopacket.Packet, cfg.Pipelines.DecodeWorkers)
+	if len(workers) == 0 {
+		workers = make([]chan gopacket.Packet, defaultPipelineWorkers)
+	}
+	// packetChan is closed once the source is exhausted, e.g. when the capture is stopped
+	var filters sync.WaitGroup
+	filters.Add(len(workers))
+	for i := range workers {
+		workers[i] = make(chan gopacket.Packet, 100)
+		go func(packets <-chan gopacket.Packet) {
+			defer filters.Done()
+			filterBonjourPackets(packets, packetChan, brMACAddress, cfg, recovery)
+		}(workers[i])
+	}
 	go func() {
 		for packet := range source.Packets() {
-			tag := parseVLANTag(packet)
+			workers[sourceShard(frameSource(packet.Data()), len(workers))] <- packet
+		}
+		for _, packets := range workers {
+			close(packets)
+		}
+		filters.Wait()
+		close(packetChan)
+	}()
 
-			// Do not process packets generated by this daemon
-			srcMAC, dstMAC := parseEthernetLayer(packet)
-			if srcMAC.String() == brMACAddress.String() {
-				continue
-			}
+	return packetChan
+}
 
-			// Only process packets sent to one of the multicast IP addresses specified in RFC 6762
-			dstIP, isIPv6 := parseIPLayer(packet)
-			if dstIP.String() != "224.0.0.251" && dstIP.String() != "ff02::fb" {
-				continue
-			}
+// frameSource returns the source MAC address of an Ethernet frame without decoding it
+func frameSource(data []byte) net.HardwareAddr {
+	if len(data) < 12 {
+		return nil
+	}
+	return net.HardwareAddr(data[6:12])
+}
 
-			// Only process packets sent to the UDP port dedicated to mDNS
-			dstPort, payload := parseUDPLayer(packet)
-			if dstPort != 5353 {
-				continue
+// filterBonjourPackets decodes the packets, and forwards the ones to reflect to packetChan
+func filterBonjourPackets(packets <-chan gopacket.Packet, packetChan chan<- bonjourPacket, brMACAddress net.HardwareAddr, cfg *brconfig, recovery *panicRecovery) {
+	for packet := range packets {
+		recovery.run(packet, func() {
+			bonjourPacket, ok := parseBonjourPacket(packet, brMACAddress)
+			if !ok && cfg.SSDPReflection {
+				bonjourPacket, ok = parseSSDPPacket(packet, brMACAddress)
 			}
+			if !ok && cfg.WSDReflection {
+				bonjourPacket, ok = parseWSDPacket(packet, brMACAddress)
+			}
+			if !ok && cfg.NATPMPReflection {
+				bonjourPacket, ok = parseNATPMPPacket(packet, brMACAddress)
+			}
+			if !ok {
+				bonjourPacket, ok = parsePassthroughPacket(packet, brMACAddress, cfg.passthrough)
+			}
+			if ok {
+				// Pass on the packet for its next adventure
+				packetChan <- bonjourPacket
+			}
+		})
+	}
+}
 
-			isDNSQuery := parseDNSPayload(payload)
+func parseBonjourPacket(packet gopacket.Packet, brMACAddress net.HardwareAddr) (bonjourPacket, bool) {
+	tag := parseVLANTag(packet)
 
-			// Pass on the packet for its next adventure
-			packetChan <- bonjourPacket{
-				packet:     packet,
-				vlanTag:    tag,
-				srcMAC:     srcMAC,
-				dstMAC:     dstMAC,
-				isIPv6:     isIPv6,
-				isDNSQuery: isDNSQuery,
-			}
+	// Do not process packets generated by this daemon, nor frames too short for an Ethernet header
+	srcMAC, dstMAC := parseEthernetLayer(packet)
+	if srcMAC == nil || srcMAC.String() == brMACAddress.String() {
+		return bonjourPacket{}, false
+	}
+
+	dstIP, isIPv6 := parseIPLayer(packet)
+	dstPort, payload := parseUDPLayer(packet)
+	srcIP, srcPort := parseSourceAddress(packet)
+
+	// Unicast responses are sent from port 5353 to the port of the querier: the port of legacy queries,
+	// or 5353 for the questions with the QU bit set
+	unicastResponse := srcPort == 5353 && dstIP != nil && !dstIP.IsMulticast()
+	if !unicastResponse {
+		// Only process packets sent to one of the multicast IP addresses specified in RFC 6762
+		if dstIP.String() != "224.0.0.251" && dstIP.String() != "ff02::fb" {
+			return bonjourPacket{}, false
 		}
-	}()
 
-	return packetChan
+		// Only process packets sent to the UDP port dedicated to mDNS
+		if dstPort != 5353 {
+			return bonjourPacket{}, false
+		}
+	}
+
+	isDNSQuery, dns := parseDNSPayload(payload)
+
+	return bonjourPacket{
+		packet:         packet,
+		vlanTag:        tag,
+		srcMAC:         srcMAC,
+		dstMAC:         dstMAC,
+		srcIP:          srcIP,
+		srcPort:        srcPort,
+		isIPv6:         isIPv6,
+		isDNSQuery:     isDNSQuery,
+		dns:            dns,
+		legacyResponse: unicastResponse && dstPort != 5353,
+		quResponse:     unicastResponse && dstPort == 5353,
+	}, true
 }
 
 func parseEthernetLayer(packet gopacket.Packet) (srcMAC, dstMAC *net.HardwareAddr) {
@@ -99,15 +193,44 @@ func parseUDPLayer(packet gopacket.Packet) (dstPort layers.UDPPort, payload []by
 	return
 }
 
-func parseDNSPayload(payload []byte) (isDNSQuery bool) {
+// parseSourceAddress returns the IP address and UDP port the packet was sent from
+func parseSourceAddress(packet gopacket.Packet) (srcIP net.IP, srcPort layers.UDPPort) {
+	if parsedIP := packet.Layer(layers.LayerTypeIPv4); parsedIP != nil {
+		srcIP = parsedIP.(*layers.IPv4).SrcIP
+	}
+	if parsedIP := packet.Layer(layers.LayerTypeIPv6); parsedIP != nil {
+		srcIP = parsedIP.(*layers.IPv6).SrcIP
+	}
+	if parsedUDP := packet.Layer(layers.LayerTypeUDP); parsedUDP != nil {
+		srcPort = parsedUDP.(*layers.UDP).SrcPort
+	}
+	return
+}
+
+func parseDNSPayload(payload []byte) (isDNSQuery bool, dns *layers.DNS) {
 	packet := gopacket.NewPacket(payload, layers.LayerTypeDNS, gopacket.Default)
 	if parsedDNS := packet.Layer(layers.LayerTypeDNS); parsedDNS != nil {
-		isDNSQuery = !parsedDNS.(*layers.DNS).QR
+		dns = parsedDNS.(*layers.DNS)
+		isDNSQuery = !dns.QR
 	}
 	return
 }
 
-func sendBonjourPacket(handle *pcap.Handle, bonjourPacket *bonjourPacket, tag uint16, brMACAddress net.HardwareAddr) {
+// packetWriter injects raw frames on the network, as *pcap.Handle does
+type packetWriter = transport.Writer
+
+// Number of unmodified packets reflected with byte-preserving rewriting, exposed on /debug/vars
+var serializationFallbacks = expvar.NewInt("serialization_fallbacks")
+
+// Records removed from rewritten messages because they cannot be serialized back, exposed on /debug/vars
+var unserializableRecords = expvar.NewInt("unserializable_records")
+
+// Frames of rewritten packets which could not be serialized, and were not reflected, exposed on /debug/vars
+var unserializableFrames = expvar.NewInt("unserializable_frames")
+
+// serializeBonjourPacket returns the frame reflecting bonjourPacket on the VLAN tag,
+// or nil when bonjourPacket was rewritten and cannot be serialized back
+func serializeBonjourPacket(bonjourPacket *bonjourPacket, tag uint16, brMACAddress net.HardwareAddr) []byte {
 	*bonjourPacket.vlanTag = tag
 	*bonjourPacket.srcMAC = brMACAddress
 
@@ -119,7 +242,173 @@ func sendBonjourPacket(handle *pcap.Handle, bonjourPacket *bonjourPacket, tag ui
 		*bonjourPacket.dstMAC = net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}
 	}
 
+	if bonjourPacket.dnsRewritten || bonjourPacket.sourceRewritten {
+		// The original message would undo the rewriting, e.g. leak filtered records or the source address
+		payload, err := dnsPayload(bonjourPacket)
+		if err == nil {
+			var data []byte
+			if data, err = serializeRebuiltPacket(bonjourPacket, payload); err == nil {
+				return data
+			}
+		}
+		logger.warnf("Could not serialize rewritten packet from %v, not reflecting it: %v", bonjourPacket.srcIP, err)
+		unserializableFrames.Add(1)
+		return nil
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializePacket(buf, gopacket.SerializeOptions{}, bonjourPacket.packet)
+	// Lengths are not recomputed here, so a frame whose size changed would be corrupted
+	if err == nil && bonjourPacket.packet.ErrorLayer() == nil && len(buf.Bytes()) == len(bonjourPacket.packet.Data()) {
+		return buf.Bytes()
+	}
+
+	// Some records cannot be serialized back by gopacket (e.g. NSEC): as nothing was rewritten,
+	// reflect the original message, only rewriting its link layer
+	serializationFallbacks.Add(1)
+	return rewriteLinkLayer(bonjourPacket.packet.Data(), tag, *bonjourPacket.srcMAC, *bonjourPacket.dstMAC)
+}
+
+// dnsPayload returns the UDP payload of bonjourPacket: its rewritten DNS layer, or else the original payload.
+// The records of the rewritten DNS layer which cannot be serialized back are left out.
+func dnsPayload(bonjourPacket *bonjourPacket) ([]byte, error) {
+	if !bonjourPacket.dnsRewritten {
+		_, payload := parseUDPLayer(bonjourPacket.packet)
+		return payload, nil
+	}
+	if payload, err := serializeDNS(bonjourPacket.dns); err == nil {
+		return payload, nil
+	}
+	// The DNS layer is shared by the frames reflected on every VLAN, and restored by pointers into its records
+	serializable := *bonjourPacket.dns
+	serializable.Answers = serializableRecords(serializable.Answers)
+	serializable.Authorities = serializableRecords(serializable.Authorities)
+	serializable.Additionals = serializableRecords(serializable.Additionals)
+	return serializeDNS(&serializable)
+}
+
+// serializableRecords returns a copy of records without the ones which cannot be serialized back
+func serializableRecords(records []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	kept := make([]layers.DNSResourceRecord, 0, len(records))
+	for _, record := range records {
+		if !canSerialize(&layers.DNS{Answers: []layers.DNSResourceRecord{record}}) {
+			unserializableRecords.Add(1)
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept
+}
+
+// canSerialize tells whether dns can be serialized back, which fails for some records (e.g. NSEC)
+func canSerialize(dns *layers.DNS) bool {
+	_, err := serializeDNS(dns)
+	return err == nil
+}
+
+// serializeDNS returns the message dns, with its lengths fixed
+func serializeDNS(dns *layers.DNS) ([]byte, error) {
 	buf := gopacket.NewSerializeBuffer()
-	gopacket.SerializePacket(buf, gopacket.SerializeOptions{}, bonjourPacket.packet)
-	handle.WritePacketData(buf.Bytes())
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	// gopacket 1.1.14 reserves 2 bytes too many for each record, left as zeros after the message
+	message := buf.Bytes()
+	if size := dnsMessageSize(dns); size < len(message) {
+		message = message[:size]
+	}
+	return message, nil
+}
+
+// dnsMessageSize returns the size of dns serialized without name compression, once its lengths are fixed
+func dnsMessageSize(dns *layers.DNS) int {
+	// Header, then the name, type and class of the questions
+	size := 12
+	for _, question := range dns.Questions {
+		size += len(question.Name) + 2 + 4
+	}
+	// Name, type, class, TTL, length and data of the records
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for _, record := range records {
+			size += len(record.Name) + 2 + 10 + int(record.DataLength)
+		}
+	}
+	return size
+}
+
+// serializeRebuiltPacket returns the frame of bonjourPacket carrying payload over UDP,
+// with lengths and checksums recomputed
+func serializeRebuiltPacket(bonjourPacket *bonjourPacket, payload []byte) ([]byte, error) {
+	var serializableLayers []gopacket.SerializableLayer
+	var networkLayer gopacket.NetworkLayer
+	for _, layer := range bonjourPacket.packet.Layers() {
+		switch layer := layer.(type) {
+		case *layers.UDP:
+			if networkLayer == nil {
+				return nil, fmt.Errorf("no network layer before UDP layer")
+			}
+			layer.SetNetworkLayerForChecksum(networkLayer)
+			serializableLayers = append(serializableLayers, layer, gopacket.Payload(payload))
+
+			buf := gopacket.NewSerializeBuffer()
+			options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			err := gopacket.SerializeLayers(buf, options, serializableLayers...)
+			return buf.Bytes(), err
+		case gopacket.SerializableLayer:
+			if network, ok := layer.(gopacket.NetworkLayer); ok {
+				networkLayer = network
+			}
+			serializableLayers = append(serializableLayers, layer)
+		default:
+			return nil, fmt.Errorf("layer %v cannot be serialized", layer.LayerType())
+		}
+	}
+	return nil, fmt.Errorf("no UDP layer found")
+}
+
+// serializeUnicastBonjourPacket returns the frame delivering bonjourPacket to a single host of the VLAN tag,
+// instead of the mDNS multicast group
+func serializeUnicastBonjourPacket(bonjourPacket *bonjourPacket, tag uint16, brMACAddress, dstMAC net.HardwareAddr, dstIP net.IP) ([]byte, error) {
+	*bonjourPacket.vlanTag = tag
+	*bonjourPacket.srcMAC = brMACAddress
+	*bonjourPacket.dstMAC = dstMAC
+
+	payload, err := dnsPayload(bonjourPacket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The IP layer is shared by the frames reflected on every VLAN, restore its multicast destination afterwards
+	if parsedIP := bonjourPacket.packet.Layer(layers.LayerTypeIPv4); parsedIP != nil {
+		ip := parsedIP.(*layers.IPv4)
+		if dstIP.To4() == nil {
+			return nil, fmt.Errorf("cannot send an IPv4 packet to %v", dstIP)
+		}
+		defer func(multicastIP net.IP) { ip.DstIP = multicastIP }(ip.DstIP)
+		ip.DstIP = dstIP.To4()
+	} else if parsedIP := bonjourPacket.packet.Layer(layers.LayerTypeIPv6); parsedIP != nil {
+		ip := parsedIP.(*layers.IPv6)
+		if dstIP.To4() != nil {
+			return nil, fmt.Errorf("cannot send an IPv6 packet to %v", dstIP)
+		}
+		defer func(multicastIP net.IP) { ip.DstIP = multicastIP }(ip.DstIP)
+		ip.DstIP = dstIP
+	}
+	return serializeRebuiltPacket(bonjourPacket, payload)
+}
+
+// rewriteLinkLayer returns a copy of an 802.1Q frame with its MAC addresses and VLAN ID rewritten,
+// keeping every other byte (including the priority bits of the tag) untouched
+func rewriteLinkLayer(frame []byte, tag uint16, srcMAC, dstMAC net.HardwareAddr) []byte {
+	rewritten := make([]byte, len(frame))
+	copy(rewritten, frame)
+	if len(rewritten) < 18 {
+		return rewritten
+	}
+	copy(rewritten[0:6], dstMAC)
+	copy(rewritten[6:12], srcMAC)
+	if binary.BigEndian.Uint16(rewritten[12:14]) == uint16(layers.EthernetTypeDot1Q) {
+		tci := binary.BigEndian.Uint16(rewritten[14:16])
+		binary.BigEndian.PutUint16(rewritten[14:16], tci&0xF000|tag&0x0FFF)
+	}
+	return rewritten
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"reflect"
@@ -168,6 +169,18 @@ func TestParseUDPLayer(t *testing.T) {
 	}
 }
 
+func TestParseSourceAddress(t *testing.T) {
+	decoder := gopacket.DecodersByLayerName["Ethernet"]
+	options := gopacket.DecodeOptions{Lazy: true}
+
+	packet := gopacket.NewPacket(createMockmDNSPacket(true, true), decoder, options)
+
+	computedIP, computedPort := parseSourceAddress(packet)
+	if !reflect.DeepEqual(srcIPv4Test, computedIP) || computedPort != srcUDPPortTest {
+		t.Error("Error in parseSourceAddress()")
+	}
+}
+
 func TestParseDNSPayload(t *testing.T) {
 	decoder := gopacket.DecodersByLayerName["Ethernet"]
 	options := gopacket.DecodeOptions{Lazy: true}
@@ -177,7 +190,7 @@ func TestParseDNSPayload(t *testing.T) {
 	_, questionPacketPayload := parseUDPLayer(questionPacket)
 
 	questionExpectedResult := true
-	questionComputedResult := parseDNSPayload(questionPacketPayload)
+	questionComputedResult, _ := parseDNSPayload(questionPacketPayload)
 	if !reflect.DeepEqual(questionExpectedResult, questionComputedResult) {
 		t.Error("Error in parseDNSPayload() for DNS queries")
 	}
@@ -187,7 +200,7 @@ func TestParseDNSPayload(t *testing.T) {
 	_, answerPacketPayload := parseUDPLayer(answerPacket)
 
 	answerExpectedResult := false
-	answerComputedResult := parseDNSPayload(answerPacketPayload)
+	answerComputedResult, _ := parseDNSPayload(answerPacketPayload)
 	if !reflect.DeepEqual(answerExpectedResult, answerComputedResult) {
 		t.Error("Error in parseDNSPayload() for DNS answers")
 	}
@@ -239,7 +252,7 @@ func areBonjourPacketsEqual(a, b bonjourPacket) (areEqual bool) {
 
 func TestFilterBonjourPacketsLazily(t *testing.T) {
 	mockPacketSource, packet := createMockPacketSource()
-	packetChan := filterBonjourPacketsLazily(mockPacketSource, brMACTest)
+	packetChan := filterBonjourPacketsLazily(mockPacketSource, brMACTest, &brconfig{}, &panicRecovery{})
 
 	expectedResult := bonjourPacket{
 		packet:     packet,
@@ -252,4 +265,111 @@ func TestFilterBonjourPacketsLazily(t *testing.T) {
 	if !areBonjourPacketsEqual(expectedResult, computedResult) {
 		t.Error("Error in filterBonjourPacketsLazily()")
 	}
+	// The channel is closed once the source is exhausted
+	if _, ok := <-packetChan; ok {
+		t.Error("Error in filterBonjourPacketsLazily(): expected the channel to be closed after the last packet")
+	}
+}
+
+func TestRewriteLinkLayer(t *testing.T) {
+	frame := createMockmDNSPacket(true, false)
+	// Set the priority bits of the VLAN tag, which must be preserved
+	frame[14] |= 0xA0
+
+	rewritten := rewriteLinkLayer(frame, 42, brMACTest, dstMACTest)
+
+	packet := gopacket.NewPacket(rewritten, layers.LayerTypeEthernet, gopacket.Default)
+	srcMAC, dstMAC := parseEthernetLayer(packet)
+	dot1Q := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if srcMAC.String() != brMACTest.String() || dstMAC.String() != dstMACTest.String() || dot1Q.VLANIdentifier != 42 || dot1Q.Priority != 5 {
+		t.Error("Error in rewriteLinkLayer(): link layer was not rewritten")
+	}
+	if !reflect.DeepEqual(rewritten[18:], frame[18:]) {
+		t.Error("Error in rewriteLinkLayer(): upper layers should be left untouched")
+	}
+}
+
+func TestSerializeRewrittenDNS(t *testing.T) {
+	packet := gopacket.NewPacket(createMockmDNSPacket(true, false), gopacket.DecodersByLayerName["Ethernet"], gopacket.DecodeOptions{Lazy: true})
+	bonjourPacket, _ := parseBonjourPacket(packet, brMACTest)
+	bonjourPacket.dns.Answers[0].TTL = 60
+	bonjourPacket.dnsRewritten = true
+
+	serialized := serializeBonjourPacket(&bonjourPacket, 42, brMACTest)
+
+	reflected := gopacket.NewPacket(serialized, layers.LayerTypeEthernet, gopacket.Default)
+	_, payload := parseUDPLayer(reflected)
+	_, dns := parseDNSPayload(payload)
+	if dns == nil || len(dns.Answers) != 1 || dns.Answers[0].TTL != 60 {
+		t.Fatal("Error in serializeBonjourPacket(): rewritten DNS layer was not serialized")
+	}
+	// The message ends with the address of its only record
+	if !bytes.HasSuffix(payload, []byte{1, 2, 3, 4}) {
+		t.Errorf("Error in serializeBonjourPacket(): expected nothing after the DNS message, got %x", payload)
+	}
+	ipv4 := reflected.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if int(ipv4.Length) != len(serialized)-18 || *parseVLANTag(reflected) != 42 {
+		t.Error("Error in serializeBonjourPacket(): lengths or VLAN tag not updated")
+	}
+}
+
+func TestSerializeBonjourPacketFallback(t *testing.T) {
+	frame := createMockmDNSPacket(true, false)
+	packet := gopacket.NewPacket(frame, gopacket.DecodersByLayerName["Ethernet"], gopacket.DecodeOptions{Lazy: true})
+	bonjourPacket, _ := parseBonjourPacket(packet, brMACTest)
+	// gopacket cannot serialize NSEC records
+	bonjourPacket.dns.Answers = append(bonjourPacket.dns.Answers, layers.DNSResourceRecord{
+		Name:  []byte("example.com"),
+		Type:  layers.DNSType(47),
+		Class: layers.DNSClassIN,
+		Data:  []byte{0xC0, 0x0C, 0x00, 0x01, 0x40},
+	})
+
+	// Unmodified packets are reflected as they were captured
+	serialized := serializeBonjourPacket(&bonjourPacket, 42, brMACTest)
+	if len(serialized) != len(frame) || !reflect.DeepEqual(serialized[18:], frame[18:]) {
+		t.Error("Error in serializeBonjourPacket(): original message should be preserved")
+	}
+	if *parseVLANTag(gopacket.NewPacket(serialized, layers.LayerTypeEthernet, gopacket.Default)) != 42 {
+		t.Error("Error in serializeBonjourPacket(): VLAN tag should still be rewritten")
+	}
+
+	// Rewritten packets are never reflected as captured, their unserializable records are removed instead
+	bonjourPacket.dnsRewritten = true
+	recordsBefore := unserializableRecords.Value()
+	serialized = serializeBonjourPacket(&bonjourPacket, 43, brMACTest)
+	reflected, ok := parseBonjourPacket(gopacket.NewPacket(serialized, layers.LayerTypeEthernet, gopacket.Default), srcMACTest)
+	if !ok || unserializableRecords.Value() != recordsBefore+1 || len(reflected.dns.Answers) != len(bonjourPacket.dns.Answers)-1 {
+		t.Errorf("Error in serializeBonjourPacket(): expected the NSEC record to be removed, got %x", serialized)
+	}
+	if len(bonjourPacket.dns.Answers) != 2 {
+		t.Error("Error in serializeBonjourPacket(): the DNS layer shared by the reflections should not change")
+	}
+}
+
+func TestSerializeUnicastBonjourPacket(t *testing.T) {
+	packet := gopacket.NewPacket(createMockmDNSPacket(true, false), gopacket.DecodersByLayerName["Ethernet"], gopacket.DecodeOptions{Lazy: true})
+	bonjourPacket, _ := parseBonjourPacket(packet, brMACTest)
+	querierMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	querierIP := net.IP{192, 168, 1, 10}
+
+	serialized, err := serializeUnicastBonjourPacket(&bonjourPacket, 42, brMACTest, querierMAC, querierIP)
+	if err != nil {
+		t.Fatalf("Error in serializeUnicastBonjourPacket(): %v", err)
+	}
+	reflected := gopacket.NewPacket(serialized, layers.LayerTypeEthernet, gopacket.Default)
+	dstIP, _ := parseIPLayer(reflected)
+	_, dstMAC := parseEthernetLayer(reflected)
+	if !dstIP.Equal(querierIP) || dstMAC.String() != querierMAC.String() || *parseVLANTag(reflected) != 42 {
+		t.Error("Error in serializeUnicastBonjourPacket(): frame not addressed to the querier")
+	}
+	// The multicast destination of the original packet is left untouched
+	ipv4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ipv4.DstIP.Equal(dstIPv4Test) {
+		t.Error("Error in serializeUnicastBonjourPacket(): original packet modified")
+	}
+
+	if _, err := serializeUnicastBonjourPacket(&bonjourPacket, 42, brMACTest, querierMAC, srcIPv6Test); err == nil {
+		t.Error("Error in serializeUnicastBonjourPacket(): IPv6 querier of an IPv4 packet should be rejected")
+	}
 }
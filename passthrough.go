@@ -0,0 +1,124 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Number of frames reflected by the pass-through of multicast groups, exposed on /debug/vars
+var passthroughFrames = expvar.NewInt("passthrough_frames")
+
+// passthroughGroup is a multicast group and UDP port whose traffic is reflected without being parsed
+type passthroughGroup struct {
+	ip   net.IP
+	port layers.UDPPort
+}
+
+// parsePassthroughGroups parses the "group:port" entries of the passthrough setting,
+// such as "239.255.250.250:9131" or "[ff02::c]:1900"
+func parsePassthroughGroups(entries []string) ([]passthroughGroup, error) {
+	groups := make([]passthroughGroup, 0, len(entries))
+	for _, entry := range entries {
+		host, portString, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid passthrough group %q, expected group:port", entry)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsMulticast() {
+			return nil, fmt.Errorf("invalid passthrough group %q, %v is not a multicast address", entry, host)
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil || port == 0 || port == 5353 {
+			return nil, fmt.Errorf("invalid port in passthrough group %q", entry)
+		}
+		groups = append(groups, passthroughGroup{ip: ip, port: layers.UDPPort(port)})
+	}
+	return groups, nil
+}
+
+// passthroughFilter returns the BPF expression matching the traffic of the groups
+func passthroughFilter(groups []passthroughGroup) string {
+	filter := ""
+	for _, group := range groups {
+		filter += fmt.Sprintf(" or (dst host %v and udp dst port %d)", group.ip, group.port)
+	}
+	return filter
+}
+
+// parsePassthroughPacket returns the packets sent to one of the groups, with only the fields needed to reflect them
+func parsePassthroughPacket(packet gopacket.Packet, brMACAddress net.HardwareAddr, groups []passthroughGroup) (bonjourPacket, bool) {
+	if len(groups) == 0 {
+		return bonjourPacket{}, false
+	}
+	srcMAC, dstMAC := parseEthernetLayer(packet)
+	if srcMAC == nil || srcMAC.String() == brMACAddress.String() {
+		return bonjourPacket{}, false
+	}
+	dstIP, isIPv6 := parseIPLayer(packet)
+	dstPort, _ := parseUDPLayer(packet)
+	for _, group := range groups {
+		if group.ip.Equal(dstIP) && group.port == dstPort {
+			srcIP, srcPort := parseSourceAddress(packet)
+			return bonjourPacket{
+				packet:      packet,
+				vlanTag:     parseVLANTag(packet),
+				srcMAC:      srcMAC,
+				dstMAC:      dstMAC,
+				srcIP:       srcIP,
+				srcPort:     srcPort,
+				isIPv6:      isIPv6,
+				passthrough: true,
+			}, true
+		}
+	}
+	return bonjourPacket{}, false
+}
+
+// passthroughTargets returns the VLANs a pass-through packet is reflected to, following the device pools:
+// the shared pools of a known device sending from its origin VLAN, or else the origin VLANs of the devices
+// shared with the VLAN of the sender
+func (r *reflector) passthroughTargets(bonjourPacket *bonjourPacket) []uint16 {
+	srcVLAN := *bonjourPacket.vlanTag
+	if _, device, ok := r.cfg.device(macAddress(bonjourPacket.srcMAC.String())); ok && device.OriginPool == srcVLAN {
+		return device.SharedPools
+	}
+	return r.poolsMap[srcVLAN]
+}
+
+// sendPassthrough reflects a pass-through packet, only rewriting its VLAN tag and source MAC address
+func (r *reflector) sendPassthrough(bonjourPacket *bonjourPacket) {
+	if time.Now().Before(r.warmUpUntil) {
+		return
+	}
+	frames := r.sendLinkLayer(bonjourPacket, protocolPassthrough, r.passthroughTargets(bonjourPacket))
+	passthroughFrames.Add(int64(frames))
+}
+
+// sendLinkLayer reflects the unparsed frame of bonjourPacket on each of the given VLANs but its own,
+// within the injection budget of the protocol, and returns the number of frames written
+func (r *reflector) sendLinkLayer(bonjourPacket *bonjourPacket, protocol string, tags []uint16) (frames int) {
+	var reflected []uint16
+	for _, tag := range r.compliance.filter(&r.cfg, bonjourPacket, tags) {
+		if tag == *bonjourPacket.vlanTag || r.peers.yields(tag, time.Now()) {
+			continue
+		}
+		data := rewriteLinkLayer(bonjourPacket.packet.Data(), tag, r.brMACAddress, *bonjourPacket.dstMAC)
+		if !r.budget.allow(protocol, tag, len(data), time.Now()) {
+			continue
+		}
+		r.account(bonjourPacket, tag, data)
+		r.loops.record(macAddress(bonjourPacket.srcMAC.String()), tag, data, time.Now())
+		r.write(data)
+		reflected = append(reflected, tag)
+		frames++
+	}
+	r.logDryRun(bonjourPacket, protocol+" packet", nil, reflected)
+	r.stats.reflected(macAddress(bonjourPacket.srcMAC.String()), frames, time.Now())
+	return
+}
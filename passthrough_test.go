@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockPassthroughPacket(tag uint16, port layers.UDPPort) gopacket.Packet {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolUDP, SrcIP: srcIPv4Test, DstIP: []byte{239, 255, 250, 250}}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: port}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: []byte{0x01, 0x00, 0x5E, 0x7F, 0xFA, 0xFA}, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, gopacket.Payload("remote"))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestParsePassthroughGroups(t *testing.T) {
+	groups, err := parsePassthroughGroups([]string{"239.255.250.250:9131", "[ff02::c]:1900"})
+	if err != nil || len(groups) != 2 || groups[1].port != 1900 || !groups[1].ip.Equal([]byte{0xff, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xc}) {
+		t.Errorf("Error in parsePassthroughGroups(): got %v (%v)", groups, err)
+	}
+	for _, entry := range []string{"239.255.250.250", "192.168.1.1:9131", "239.255.250.250:5353", "239.255.250.250:port"} {
+		if _, err := parsePassthroughGroups([]string{entry}); err == nil {
+			t.Errorf("Error in parsePassthroughGroups(): expected an error for %q", entry)
+		}
+	}
+
+	cfg, err := parseConfig(`passthrough = ["239.255.250.250:9131"]
+		[devices."AA:BB:CC:DD:EE:FF"]
+		origin_pool = 1078
+		shared_pools = [1234]`)
+	expected := "(dst host ff02::fb and udp dst port 5353) or (dst host 239.255.250.250 and udp dst port 9131) or"
+	if filter := buildCaptureFilter(&cfg); err != nil || !strings.Contains(filter, expected) {
+		t.Errorf("Error in buildCaptureFilter(): expected the passthrough groups to be captured, got %q (%v)", filter, err)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`passthrough = ["239.255.250.250:9131"]
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsePassthroughPacket(createMockPassthroughPacket(vlanIdentifierTest, 9132), brMACTest, cfg.passthrough); ok {
+		t.Error("Error in parsePassthroughPacket(): expected packets of other ports to be ignored")
+	}
+	bonjourPacket, ok := parsePassthroughPacket(createMockPassthroughPacket(vlanIdentifierTest, 9131), brMACTest, cfg.passthrough)
+	if !ok || !bonjourPacket.passthrough {
+		t.Fatal("Error in parsePassthroughPacket(): expected a packet of the group to be parsed")
+	}
+
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[0] != 42 || tags[1] != 43 {
+		t.Fatalf("Error in processBonjourPacket(): expected the packet to be reflected to the shared pools, got %v", tags)
+	}
+	reflected := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	if udp, ok := reflected.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || string(udp.Payload) != "remote" || udp.SrcPort != 40000 {
+		t.Error("Error in processBonjourPacket(): expected the packet to be reflected unmodified")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Block types of the pcapng format read by the replays (draft-tuexen-opsawg-pcapng)
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngObsoletePacket  = 0x00000002
+	pcapngSimplePacket    = 0x00000003
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptionEnd       = 0
+	pcapngOptionIfName    = 2
+	pcapngOptionIfTSResol = 9
+	pcapngMaxBlockLength  = 16 * 1024 * 1024
+)
+
+// pcapngInterface is an interface described by a pcapng capture
+type pcapngInterface struct {
+	name     string
+	linkType layers.LinkType
+	snapLen  uint32
+	// unitsPerSecond is the resolution of the timestamps of its packets
+	unitsPerSecond uint64
+}
+
+// pcapngReader reads the frames of a pcapng capture, setting the InterfaceIndex of their CaptureInfo. The interfaces
+// of all its sections are numbered one after the other. Unlike pcapgo, which only reads pcapng files from gopacket
+// 1.1.15, it only handles what the replays need.
+type pcapngReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	// interfaces holds the interfaces of every section read so far, the ones of the current section from first
+	interfaces []pcapngInterface
+	first      int
+}
+
+// newPcapngReader reads the section header starting r
+func newPcapngReader(r io.Reader) (*pcapngReader, error) {
+	reader := &pcapngReader{r: r}
+	blockType, body, err := reader.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if blockType != pcapngSectionHeader {
+		return nil, fmt.Errorf("not a pcapng file")
+	}
+	return reader, reader.startSection(body)
+}
+
+// readBlock returns the type and the body of the next block
+func (reader *pcapngReader) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader.r, header[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("truncated pcapng block")
+		}
+		return 0, nil, err
+	}
+	blockType := binary.BigEndian.Uint32(header[:4])
+	if blockType == pcapngSectionHeader {
+		// The byte order of a section is given by its header, which reads the same in both orders
+		if _, err := io.ReadFull(reader.r, header[8:12]); err != nil {
+			return 0, nil, fmt.Errorf("truncated pcapng section header")
+		}
+		switch uint32(pcapngByteOrderMagic) {
+		case binary.BigEndian.Uint32(header[8:12]):
+			reader.order = binary.BigEndian
+		case binary.LittleEndian.Uint32(header[8:12]):
+			reader.order = binary.LittleEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte-order magic")
+		}
+	} else if reader.order == nil {
+		return 0, nil, fmt.Errorf("pcapng block before the section header")
+	} else {
+		blockType = reader.order.Uint32(header[:4])
+	}
+	length := reader.order.Uint32(header[4:8])
+	read := 8
+	if blockType == pcapngSectionHeader {
+		read = 12
+	}
+	if length%4 != 0 || length < uint32(read)+4 || length > pcapngMaxBlockLength {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %v", length)
+	}
+	block := make([]byte, int(length)-read)
+	if _, err := io.ReadFull(reader.r, block); err != nil {
+		return 0, nil, fmt.Errorf("truncated pcapng block")
+	}
+	// The body is followed by the length of the block again
+	return blockType, block[:len(block)-4], nil
+}
+
+// startSection numbers the interfaces of a new section after the ones of the previous sections
+func (reader *pcapngReader) startSection(body []byte) error {
+	if len(body) < 12 || reader.order.Uint16(body[:2]) != 1 {
+		return fmt.Errorf("unsupported pcapng version")
+	}
+	reader.first = len(reader.interfaces)
+	return nil
+}
+
+// options calls fn with the code and the value of each option of a block
+func (reader *pcapngReader) options(data []byte, fn func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code, length := reader.order.Uint16(data[:2]), int(reader.order.Uint16(data[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(data) {
+			return
+		}
+		fn(code, data[4:4+length])
+		data = data[4+(length+3)&^3:]
+	}
+}
+
+func (reader *pcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("truncated pcapng interface description")
+	}
+	intf := pcapngInterface{
+		linkType:       layers.LinkType(reader.order.Uint16(body[:2])),
+		snapLen:        reader.order.Uint32(body[4:8]),
+		unitsPerSecond: 1000000,
+	}
+	reader.options(body[8:], func(code uint16, value []byte) {
+		switch {
+		case code == pcapngOptionIfName:
+			intf.name = string(value)
+		case code == pcapngOptionIfTSResol && len(value) == 1:
+			// The most significant bit tells a negative power of 2 from a negative power of 10
+			exponent, units := value[0]&0x7f, uint64(1)
+			for i := byte(0); i < exponent && units < 1e18; i++ {
+				if value[0]&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+			intf.unitsPerSecond = units
+		}
+	})
+	reader.interfaces = append(reader.interfaces, intf)
+	return nil
+}
+
+// ReadPacketData returns the next frame of the capture, skipping the blocks other than packets
+func (reader *pcapngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		blockType, body, err := reader.readBlock()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		switch blockType {
+		case pcapngSectionHeader:
+			err = reader.startSection(body)
+		case pcapngInterfaceDesc:
+			err = reader.addInterface(body)
+		case pcapngEnhancedPacket, pcapngObsoletePacket, pcapngSimplePacket:
+			return reader.packet(blockType, body)
+		}
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+}
+
+// packet returns the frame of a packet block
+func (reader *pcapngReader) packet(blockType uint32, body []byte) (data []byte, info gopacket.CaptureInfo, err error) {
+	if blockType == pcapngSimplePacket {
+		if len(body) < 4 {
+			return nil, info, fmt.Errorf("truncated pcapng packet")
+		}
+		if info.InterfaceIndex, err = reader.interfaceIndex(0); err != nil {
+			return nil, info, err
+		}
+		// Simple packets are truncated to the snapshot length of the interface, without telling it
+		info.Length = int(reader.order.Uint32(body[:4]))
+		info.CaptureLength = info.Length
+		if snapLen := int(reader.interfaces[info.InterfaceIndex].snapLen); snapLen > 0 && snapLen < info.CaptureLength {
+			info.CaptureLength = snapLen
+		}
+		data = body[4:]
+	} else {
+		if len(body) < 20 {
+			return nil, info, fmt.Errorf("truncated pcapng packet")
+		}
+		index := int(reader.order.Uint32(body[:4]))
+		if blockType == pcapngObsoletePacket {
+			index = int(reader.order.Uint16(body[:2]))
+		}
+		if info.InterfaceIndex, err = reader.interfaceIndex(index); err != nil {
+			return nil, info, err
+		}
+		units := uint64(reader.order.Uint32(body[4:8]))<<32 | uint64(reader.order.Uint32(body[8:12]))
+		info.Timestamp = reader.timestamp(units, reader.interfaces[info.InterfaceIndex].unitsPerSecond)
+		info.CaptureLength = int(reader.order.Uint32(body[12:16]))
+		info.Length = int(reader.order.Uint32(body[16:20]))
+		data = body[20:]
+	}
+	if info.CaptureLength > len(data) {
+		return nil, info, fmt.Errorf("truncated pcapng packet")
+	}
+	return data[:info.CaptureLength], info, nil
+}
+
+// interfaceIndex returns the index among all the interfaces of the interface index of the current section
+func (reader *pcapngReader) interfaceIndex(index int) (int, error) {
+	if index < 0 || reader.first+index >= len(reader.interfaces) {
+		return 0, fmt.Errorf("pcapng packet of the undescribed interface %v", index)
+	}
+	intf := reader.interfaces[reader.first+index]
+	if intf.linkType != layers.LinkTypeEthernet {
+		return 0, fmt.Errorf("interface %v of the capture is not Ethernet (link type %v)", index, intf.linkType)
+	}
+	return reader.first + index, nil
+}
+
+func (reader *pcapngReader) timestamp(units, unitsPerSecond uint64) time.Time {
+	seconds, fraction := units/unitsPerSecond, units%unitsPerSecond
+	return time.Unix(int64(seconds), int64(fraction*uint64(time.Second)/unitsPerSecond)).UTC()
+}
+
+// names returns the names of the interfaces of the capture, numbering the unnamed ones
+func (reader *pcapngReader) names() []string {
+	names := make([]string, len(reader.interfaces))
+	for i, intf := range reader.interfaces {
+		names[i] = intf.name
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("interface %v", i)
+		}
+	}
+	return names
+}
+
+// writePcapng writes frames to w as a pcapng capture, with an Ethernet interface for each name. The InterfaceIndex
+// of their CaptureInfo selects their interface.
+func writePcapng(w io.Writer, names []string, frames []capturedFrame) error {
+	order := binary.LittleEndian
+	block := func(blockType uint32, body []byte) error {
+		padded := (len(body) + 3) &^ 3
+		data := make([]byte, 12+padded)
+		order.PutUint32(data[:4], blockType)
+		order.PutUint32(data[4:8], uint32(len(data)))
+		copy(data[8:], body)
+		order.PutUint32(data[len(data)-4:], uint32(len(data)))
+		_, err := w.Write(data)
+		return err
+	}
+	header := make([]byte, 16)
+	order.PutUint32(header[:4], pcapngByteOrderMagic)
+	order.PutUint16(header[4:6], 1)
+	// The length of the section is not given
+	order.PutUint64(header[8:16], ^uint64(0))
+	if err := block(pcapngSectionHeader, header); err != nil {
+		return err
+	}
+	for _, name := range names {
+		padded := (len(name) + 3) &^ 3
+		body := make([]byte, 8+4+padded+4)
+		order.PutUint16(body[:2], uint16(layers.LinkTypeEthernet))
+		order.PutUint32(body[4:8], 65536)
+		order.PutUint16(body[8:10], pcapngOptionIfName)
+		order.PutUint16(body[10:12], uint16(len(name)))
+		copy(body[12:], name)
+		if err := block(pcapngInterfaceDesc, body); err != nil {
+			return err
+		}
+	}
+	for _, frame := range frames {
+		body := make([]byte, 20+len(frame.data))
+		order.PutUint32(body[:4], uint32(frame.info.InterfaceIndex))
+		units := uint64(frame.info.Timestamp.UnixNano() / int64(time.Microsecond))
+		if frame.info.Timestamp.IsZero() {
+			units = 0
+		}
+		order.PutUint32(body[4:8], uint32(units>>32))
+		order.PutUint32(body[8:12], uint32(units))
+		order.PutUint32(body[12:16], uint32(len(frame.data)))
+		order.PutUint32(body[16:20], uint32(len(frame.data)))
+		copy(body[20:], frame.data)
+		if err := block(pcapngEnhancedPacket, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPcapngRoundTrip(t *testing.T) {
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	frames := []capturedFrame{{data: referenceFrame(20)}, {data: referenceFrame(30)}}
+	frames[0].info.Timestamp, frames[1].info.Timestamp, frames[1].info.InterfaceIndex = first, first.Add(time.Second), 1
+	var buf bytes.Buffer
+	if err := writePcapng(&buf, []string{"eth0", ""}, frames); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newPcapngReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		data, info, err := reader.ReadPacketData()
+		if err != nil || !bytes.Equal(data, frame.data) || info.InterfaceIndex != frame.info.InterfaceIndex || !info.Timestamp.Equal(frame.info.Timestamp) {
+			t.Errorf("Error in ReadPacketData(): unexpected frame %v on interface %v at %v (%v)", i, info.InterfaceIndex, info.Timestamp, err)
+		}
+	}
+	if _, _, err := reader.ReadPacketData(); err != io.EOF {
+		t.Errorf("Error in ReadPacketData(): expected the end of the capture, got %v", err)
+	}
+	if names := reader.names(); !reflect.DeepEqual(names, []string{"eth0", "interface 1"}) {
+		t.Errorf("Error in names(): expected the unnamed interface to be numbered, got %v", names)
+	}
+}
+
+func TestPcapngBigEndian(t *testing.T) {
+	// A big-endian capture of a simple packet on an interface with nanosecond timestamps, then a second section
+	// whose interface is not Ethernet
+	var buf bytes.Buffer
+	block := func(blockType uint32, body ...[]byte) {
+		data := bytes.Join(body, nil)
+		binary.Write(&buf, binary.BigEndian, []uint32{blockType, uint32(12 + len(data))})
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, uint32(12+len(data)))
+	}
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u32 := func(v uint32) []byte { return append(u16(uint16(v>>16)), u16(uint16(v))...) }
+	section := [][]byte{u32(pcapngByteOrderMagic), u16(1), u16(0), u32(0xffffffff), u32(0xffffffff)}
+	frame := referenceFrame(20)
+	block(pcapngSectionHeader, section...)
+	block(pcapngInterfaceDesc, u16(uint16(layers.LinkTypeEthernet)), u16(0), u32(0), u16(pcapngOptionIfTSResol), u16(1), []byte{9, 0, 0, 0}, u32(0))
+	block(0x0BAD, u32(42))
+	block(pcapngSimplePacket, u32(uint32(len(frame))), frame, make([]byte, (4-len(frame)%4)%4))
+	block(pcapngSectionHeader, section...)
+	block(pcapngInterfaceDesc, u16(uint16(layers.LinkTypeLinuxSLL)), u16(0), u32(0))
+	block(pcapngEnhancedPacket, u32(0), u32(0), u32(0), u32(4), u32(4), u32(0))
+
+	reader, err := newPcapngReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, info, err := reader.ReadPacketData(); err != nil || !bytes.Equal(data, frame) || info.InterfaceIndex != 0 {
+		t.Errorf("Error in ReadPacketData(): unexpected simple packet %x on interface %v (%v)", data, info.InterfaceIndex, err)
+	}
+	if reader.interfaces[0].unitsPerSecond != uint64(time.Second) {
+		t.Errorf("Error in ReadPacketData(): expected nanosecond timestamps, got %v units per second", reader.interfaces[0].unitsPerSecond)
+	}
+	if _, _, err := reader.ReadPacketData(); err == nil || len(reader.interfaces) != 2 {
+		t.Error("Error in ReadPacketData(): expected the packet of the interface of the second section, which is not Ethernet, to be refused")
+	}
+	if _, err := newPcapngReader(bytes.NewReader(frame)); err == nil {
+		t.Error("Error in newPcapngReader(): expected a frame not to be read as a pcapng capture")
+	}
+}
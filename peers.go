@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Service type advertised by the reflectors, so that they can detect each other
+	peerService = "_bonjour-reflector._tcp.local"
+	// Delay between two advertisements, peers not heard of for three intervals are forgotten
+	peerAdvertiseInterval = time.Minute
+)
+
+// Advertisements of the reflector which could not be serialized, exposed on /debug/vars
+var peerAdvertisementErrors = expvar.NewInt("peer_advertisement_errors")
+
+// reflectorPeer is another reflector seen on the trunk
+type reflectorPeer struct {
+	ID      string   `json:"id"`
+	MAC     string   `json:"mac"`
+	VLANs   []uint16 `json:"vlans"`
+	Overlap []uint16 `json:"overlap"`
+	// Trusted is set when MAC is one of the peer_macs, which partitioning only yields VLANs to
+	Trusted  bool      `json:"trusted"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// peerTracker advertises the reflector and detects the other reflectors of the network. Reflectors serving
+// the same VLANs duplicate packets, or even loop them. With partitioning, only the reflector with the lowest ID
+// keeps injecting into the VLANs served by several reflectors. As any device can advertise itself as a reflector,
+// only the advertisements sent from the configured peer MAC addresses are taken into account.
+type peerTracker struct {
+	mutex        sync.Mutex
+	id           string
+	vlans        []uint16
+	partitioning bool
+	trusted      map[macAddress]bool
+	peers        map[string]*reflectorPeer
+	hooks        *hookRunner
+}
+
+func newPeerTracker(id string, vlans []uint16, partitioning bool, trusted map[macAddress]bool) *peerTracker {
+	return &peerTracker{
+		id:           id,
+		vlans:        vlans,
+		partitioning: partitioning,
+		trusted:      trusted,
+		peers:        make(map[string]*reflectorPeer),
+	}
+}
+
+// parsePeerMACs parses the MAC addresses of the peers, which partitioning requires
+func parsePeerMACs(addresses []string, partitioning bool) (map[macAddress]bool, error) {
+	if partitioning && len(addresses) == 0 {
+		return nil, fmt.Errorf("peer_partitioning requires the MAC addresses of the peers in peer_macs")
+	}
+	peers := make(map[macAddress]bool)
+	for _, address := range addresses {
+		mac, err := net.ParseMAC(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q in peer_macs", address)
+		}
+		peers[macAddress(mac.String())] = true
+	}
+	return peers, nil
+}
+
+// records returns the PTR and TXT records advertising the reflector and the VLANs it serves
+func (tracker *peerTracker) records() []layers.DNSResourceRecord {
+	instance := "bonjour-reflector-" + strings.Replace(tracker.id, ":", "", -1) + "." + peerService
+	ttl := uint32(3 * peerAdvertiseInterval / time.Second)
+	return []layers.DNSResourceRecord{
+		{Name: []byte(peerService), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl, PTR: []byte(instance)},
+		{Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: ttl, TXTs: [][]byte{
+			[]byte("id=" + tracker.id),
+			[]byte("vlans=" + formatVLANList(tracker.vlans)),
+		}},
+	}
+}
+
+// observe looks for the advertisement of another reflector in an answer
+func (tracker *peerTracker) observe(bonjourPacket *bonjourPacket, now time.Time) {
+	if tracker == nil || bonjourPacket.dns == nil {
+		return
+	}
+	for _, record := range bonjourPacket.dns.Answers {
+		if record.Type != layers.DNSTypeTXT || !belongsToService(record.Name, peerService) {
+			continue
+		}
+		peer := &reflectorPeer{MAC: bonjourPacket.srcMAC.String(), LastSeen: now}
+		peer.Trusted = tracker.trusted[macAddress(peer.MAC)]
+		for _, txt := range record.TXTs {
+			entry := string(txt)
+			switch {
+			case strings.HasPrefix(entry, "id="):
+				peer.ID = strings.TrimPrefix(entry, "id=")
+			case strings.HasPrefix(entry, "vlans="):
+				peer.VLANs = parseVLANList(strings.TrimPrefix(entry, "vlans="))
+			}
+		}
+		// Our own advertisement may come back, reflected by a peer
+		if peer.ID != "" && peer.ID != tracker.id {
+			tracker.update(peer)
+		}
+	}
+}
+
+func (tracker *peerTracker) update(peer *reflectorPeer) {
+	peer.Overlap = intersectVLANs(tracker.vlans, peer.VLANs)
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	previous, known := tracker.peers[peer.ID]
+	tracker.peers[peer.ID] = peer
+	if len(peer.Overlap) == 0 || (known && equalVLANs(previous.Overlap, peer.Overlap)) {
+		return
+	}
+	resolution := "set peer_partitioning to share the VLANs"
+	if tracker.partitioning && !peer.Trusted {
+		resolution = "the peer is not listed in peer_macs, partitioning ignores it"
+	} else if tracker.partitioning && peer.ID < tracker.id {
+		resolution = "yielding these VLANs to the peer"
+	} else if tracker.partitioning {
+		resolution = "the peer yields these VLANs"
+	}
+	logger.warnf("reflector %v (%v) also serves VLANs %v, which duplicates or loops packets: %v", peer.ID, peer.MAC, peer.Overlap, resolution)
+	tracker.hooks.fire(eventLoopDetected, map[string]interface{}{
+		"PeerID":  peer.ID,
+		"PeerMAC": peer.MAC,
+		"VLANs":   formatVLANList(peer.Overlap),
+	}, peer.LastSeen)
+}
+
+// yields tells whether another reflector is responsible for injecting into the VLAN tag
+func (tracker *peerTracker) yields(tag uint16, now time.Time) bool {
+	if tracker == nil || !tracker.partitioning {
+		return false
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for _, peer := range tracker.peers {
+		if !peer.Trusted || peer.ID >= tracker.id || now.Sub(peer.LastSeen) > 3*peerAdvertiseInterval {
+			continue
+		}
+		for _, vlan := range peer.Overlap {
+			if vlan == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (tracker *peerTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tracker.mutex.Lock()
+	peers := make([]reflectorPeer, 0, len(tracker.peers))
+	for _, peer := range tracker.peers {
+		peers = append(peers, *peer)
+	}
+	tracker.mutex.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID    string          `json:"id"`
+		VLANs []uint16        `json:"vlans"`
+		Peers []reflectorPeer `json:"peers"`
+	}{tracker.id, tracker.vlans, peers})
+}
+
+// advertisePeer periodically advertises the reflector on each VLAN it serves
+func (r *reflector) advertisePeer(srcIP net.IP) {
+	for {
+		for _, tag := range r.peers.vlans {
+			data, err := serializeMDNSResponse(r.peers.records(), r.cfg.sourceIPv4(tag, srcIP), tag, r.brMACAddress)
+			if err != nil {
+				logger.errorf("Could not serialize reflector advertisement for VLAN %v: %v", tag, err)
+				peerAdvertisementErrors.Add(1)
+				continue
+			}
+			// Injection failures are logged and counted by the writer
+			r.write(data)
+		}
+		time.Sleep(peerAdvertiseInterval)
+	}
+}
+
+func formatVLANList(vlans []uint16) string {
+	items := make([]string, len(vlans))
+	for i, vlan := range vlans {
+		items[i] = fmt.Sprint(vlan)
+	}
+	return strings.Join(items, ",")
+}
+
+func parseVLANList(list string) (vlans []uint16) {
+	for _, item := range strings.Split(list, ",") {
+		if vlan, err := strconv.ParseUint(item, 10, 12); err == nil {
+			vlans = append(vlans, uint16(vlan))
+		}
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return
+}
+
+// intersectVLANs returns the sorted VLANs of both lists
+func intersectVLANs(a, b []uint16) []uint16 {
+	inA := make(map[uint16]bool)
+	for _, vlan := range a {
+		inA[vlan] = true
+	}
+	common := []uint16{}
+	for _, vlan := range b {
+		if inA[vlan] {
+			common = append(common, vlan)
+			inA[vlan] = false
+		}
+	}
+	sort.Slice(common, func(i, j int) bool { return common[i] < common[j] })
+	return common
+}
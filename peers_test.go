@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func createMockPeerAdvertisement(tracker *peerTracker) *bonjourPacket {
+	srcMAC := srcMACTest
+	return &bonjourPacket{srcMAC: &srcMAC, dns: &layers.DNS{QR: true, Answers: tracker.records()}}
+}
+
+func TestPeerTracker(t *testing.T) {
+	trusted := map[macAddress]bool{macAddress(srcMACTest.String()): true}
+	first := newPeerTracker("02:00:00:00:00:01", []uint16{10, 20, 30}, true, trusted)
+	second := newPeerTracker("02:00:00:00:00:02", []uint16{20, 30, 40}, true, trusted)
+	now := time.Now()
+
+	first.observe(createMockPeerAdvertisement(second), now)
+	second.observe(createMockPeerAdvertisement(first), now)
+	// Advertisements reflected back to their sender are ignored
+	first.observe(createMockPeerAdvertisement(first), now)
+
+	peer, ok := first.peers["02:00:00:00:00:02"]
+	if !ok || len(first.peers) != 1 || !equalVLANs(peer.VLANs, []uint16{20, 30, 40}) || !equalVLANs(peer.Overlap, []uint16{20, 30}) {
+		t.Fatalf("Error in observe(), got %+v", first.peers)
+	}
+
+	// The reflector with the lowest ID keeps the shared VLANs
+	tests := []struct {
+		tracker  *peerTracker
+		tag      uint16
+		at       time.Time
+		expected bool
+	}{
+		{first, 20, now, false},
+		{second, 20, now, true},
+		{second, 30, now, true},
+		{second, 40, now, false},
+		{second, 20, now.Add(4 * peerAdvertiseInterval), false},
+	}
+	for _, test := range tests {
+		if test.tracker.yields(test.tag, test.at) != test.expected {
+			t.Errorf("Error in yields() for reflector %v and VLAN %v", test.tracker.id, test.tag)
+		}
+	}
+
+	// Advertisements from other addresses are logged, but not trusted
+	untrusted := newPeerTracker("02:00:00:00:00:03", []uint16{20}, true, map[macAddress]bool{"02:00:00:00:00:01": true})
+	untrusted.observe(createMockPeerAdvertisement(first), now)
+	if peer, ok := untrusted.peers["02:00:00:00:00:01"]; !ok || peer.Trusted || untrusted.yields(20, now) {
+		t.Error("Error in yields(): VLANs should only be yielded to the configured peers")
+	}
+
+	second.partitioning = false
+	if second.yields(20, now) {
+		t.Error("Error in yields(): VLANs should only be yielded with partitioning")
+	}
+}
+
+func TestParsePeerMACs(t *testing.T) {
+	if _, err := parsePeerMACs(nil, true); err == nil {
+		t.Error("Error in parsePeerMACs(): partitioning without peer_macs should be rejected")
+	}
+	if _, err := parsePeerMACs([]string{"not a mac"}, false); err == nil {
+		t.Error("Error in parsePeerMACs(): invalid addresses should be rejected")
+	}
+	peers, err := parsePeerMACs([]string{"AA:BB:CC:DD:EE:FF"}, true)
+	if err != nil || !peers["aa:bb:cc:dd:ee:ff"] {
+		t.Errorf("Error in parsePeerMACs(): got %v (%v)", peers, err)
+	}
+}
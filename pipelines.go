@@ -0,0 +1,186 @@
+package main
+
+import (
+	"expvar"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPipelineWorkers  = 1
+	defaultPipelineCapacity = 256
+)
+
+// pipelineStats counts, for each address family, the reflections sent and dropped by its pipeline
+var pipelineStats = expvar.NewMap("pipelines")
+
+type pipelinesConfig struct {
+	DecodeWorkers int `toml:"decode_workers"`
+	IPv4Workers   int `toml:"ipv4_workers"`
+	IPv6Workers   int `toml:"ipv6_workers"`
+	Capacity      int `toml:"capacity"`
+}
+
+func (cfg *pipelinesConfig) setDefaults() {
+	if cfg.DecodeWorkers <= 0 {
+		cfg.DecodeWorkers = defaultPipelineWorkers
+	}
+	if cfg.IPv4Workers <= 0 {
+		cfg.IPv4Workers = defaultPipelineWorkers
+	}
+	if cfg.IPv6Workers <= 0 {
+		cfg.IPv6Workers = defaultPipelineWorkers
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = defaultPipelineCapacity
+	}
+}
+
+// reflection is a packet whose target VLANs were decided, waiting to be sent
+type reflection struct {
+	bonjourPacket *bonjourPacket
+	tags          []uint16
+}
+
+// sourceShard returns which of workers handles the packets of the source MAC address mac, so that the packets
+// of a source are always handled by the same worker, in order, while the sources are spread over the workers
+func sourceShard(mac net.HardwareAddr, workers int) int {
+	if workers <= 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write(mac)
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// familyPipeline serializes and injects the reflections of one address family with its own workers,
+// each with its own queue of capacity reflections
+type familyPipeline struct {
+	name   string
+	queues []chan reflection
+	// busy holds, for each worker, the time it started sending the current reflection in nanoseconds, 0 while it waits
+	busy []int64
+	// abandoned is set once the pipeline is replaced, its workers then dropping the reflections left
+	abandoned int32
+}
+
+func newFamilyPipeline(name string, workers, capacity int, send func(*bonjourPacket, []uint16), wg *sync.WaitGroup) *familyPipeline {
+	pipeline := &familyPipeline{name: name, queues: make([]chan reflection, workers), busy: make([]int64, workers)}
+	for i := range pipeline.queues {
+		reflections := make(chan reflection, capacity)
+		pipeline.queues[i] = reflections
+		wg.Add(1)
+		go func(busy *int64) {
+			defer wg.Done()
+			for reflection := range reflections {
+				if atomic.LoadInt32(&pipeline.abandoned) != 0 {
+					pipelineStats.Add(pipeline.name+"_dropped", 1)
+					continue
+				}
+				atomic.StoreInt64(busy, time.Now().UnixNano())
+				send(reflection.bonjourPacket, reflection.tags)
+				atomic.StoreInt64(busy, 0)
+				pipelineStats.Add(pipeline.name+"_sent", 1)
+			}
+		}(&pipeline.busy[i])
+	}
+	return pipeline
+}
+
+// stalled tells whether one of the workers has been sending the same reflection for longer than timeout
+func (pipeline *familyPipeline) stalled(now time.Time, timeout time.Duration) bool {
+	for i := range pipeline.busy {
+		if busy := atomic.LoadInt64(&pipeline.busy[i]); busy != 0 && now.Sub(time.Unix(0, busy)) > timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// reflectionPipelines split the sending of the reflections per address family. The targets of a packet
+// are decided once for both families by the reflector, then its IPv4 or IPv6 pipeline rewrites, serializes
+// and injects it, so that a backlog of one family never delays the other.
+type reflectionPipelines struct {
+	// mutex protects the pipelines replaced by restart
+	mutex      sync.RWMutex
+	ipv4, ipv6 *familyPipeline
+	wg         *sync.WaitGroup
+	cfg        pipelinesConfig
+	send       func(*bonjourPacket, []uint16)
+}
+
+func newReflectionPipelines(cfg pipelinesConfig, send func(*bonjourPacket, []uint16)) *reflectionPipelines {
+	cfg.setDefaults()
+	pipelines := &reflectionPipelines{cfg: cfg, send: send}
+	pipelines.start()
+	return pipelines
+}
+
+// start creates the workers of both families. It must be called with the mutex held, or before the pipelines are used.
+func (pipelines *reflectionPipelines) start() {
+	pipelines.wg = &sync.WaitGroup{}
+	pipelines.ipv4 = newFamilyPipeline("ipv4", pipelines.cfg.IPv4Workers, pipelines.cfg.Capacity, pipelines.send, pipelines.wg)
+	pipelines.ipv6 = newFamilyPipeline("ipv6", pipelines.cfg.IPv6Workers, pipelines.cfg.Capacity, pipelines.send, pipelines.wg)
+}
+
+// stalled returns the name of a family whose pipeline has been sending the same reflection for longer than timeout,
+// or an empty string
+func (pipelines *reflectionPipelines) stalled(now time.Time, timeout time.Duration) string {
+	pipelines.mutex.RLock()
+	defer pipelines.mutex.RUnlock()
+	for _, pipeline := range []*familyPipeline{pipelines.ipv4, pipelines.ipv6} {
+		if pipeline.stalled(now, timeout) {
+			return pipeline.name
+		}
+	}
+	return ""
+}
+
+// restart replaces the pipelines of both families with new workers. The reflections queued in the previous ones are
+// dropped, and their workers exit once their send returns, if ever.
+func (pipelines *reflectionPipelines) restart() {
+	pipelines.mutex.Lock()
+	defer pipelines.mutex.Unlock()
+	for _, pipeline := range []*familyPipeline{pipelines.ipv4, pipelines.ipv6} {
+		atomic.StoreInt32(&pipeline.abandoned, 1)
+		for _, reflections := range pipeline.queues {
+			close(reflections)
+		}
+	}
+	pipelines.start()
+}
+
+// dispatch queues the reflection of bonjourPacket in the pipeline of its address family, to the worker of its source
+// so that the reflections of a source are sent in order, dropping it when the queue of the worker is full
+func (pipelines *reflectionPipelines) dispatch(bonjourPacket *bonjourPacket, tags []uint16) {
+	pipelines.mutex.RLock()
+	defer pipelines.mutex.RUnlock()
+	pipeline := pipelines.ipv4
+	if bonjourPacket.isIPv6 {
+		pipeline = pipelines.ipv6
+	}
+	var srcMAC net.HardwareAddr
+	if bonjourPacket.srcMAC != nil {
+		srcMAC = *bonjourPacket.srcMAC
+	}
+	select {
+	case pipeline.queues[sourceShard(srcMAC, len(pipeline.queues))] <- reflection{bonjourPacket: bonjourPacket, tags: tags}:
+	default:
+		pipelineStats.Add(pipeline.name+"_dropped", 1)
+	}
+}
+
+// close stops the pipelines once their queued reflections are sent
+func (pipelines *reflectionPipelines) close() {
+	pipelines.mutex.Lock()
+	defer pipelines.mutex.Unlock()
+	for _, pipeline := range []*familyPipeline{pipelines.ipv4, pipelines.ipv6} {
+		for _, reflections := range pipeline.queues {
+			close(reflections)
+		}
+	}
+	pipelines.wg.Wait()
+}
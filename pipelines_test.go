@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReflectionPipelines(t *testing.T) {
+	blocked := make(chan struct{})
+	sent := make(chan bool, 4)
+	pipelines := newReflectionPipelines(pipelinesConfig{Capacity: 1}, func(bonjourPacket *bonjourPacket, tags []uint16) {
+		if !bonjourPacket.isIPv6 {
+			<-blocked
+		}
+		sent <- bonjourPacket.isIPv6
+	})
+	dropped := func() int64 { return expvarInt(pipelineStats.Get("ipv4_dropped")) }
+	before := dropped()
+
+	ipv4 := createMockBonjourPacket(true)
+	ipv6 := createMockBonjourPacket(true)
+	ipv6.isIPv6 = true
+	// The first reflection blocks the IPv4 worker, the second one fills its queue, the third one is dropped
+	for i := 0; i < 3; i++ {
+		pipelines.dispatch(&ipv4, []uint16{42})
+		time.Sleep(10 * time.Millisecond)
+	}
+	pipelines.dispatch(&ipv6, []uint16{42})
+
+	select {
+	case isIPv6 := <-sent:
+		if !isIPv6 {
+			t.Error("Error in dispatch(): the IPv4 reflections should still be blocked")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error in dispatch(): the IPv6 pipeline should not wait for the IPv4 one")
+	}
+	if dropped()-before != 1 {
+		t.Errorf("Error in dispatch(): expected 1 dropped IPv4 reflection, got %v", dropped()-before)
+	}
+
+	close(blocked)
+	pipelines.close()
+	if len(sent) != 2 {
+		t.Errorf("Error in close(): expected the 2 queued IPv4 reflections to be sent, got %v", len(sent))
+	}
+}
+
+func TestPipelinesSourceOrder(t *testing.T) {
+	var mutex sync.Mutex
+	sent := make(map[string][]uint16)
+	pipelines := newReflectionPipelines(pipelinesConfig{IPv4Workers: 4, Capacity: 64}, func(bonjourPacket *bonjourPacket, tags []uint16) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent[bonjourPacket.srcMAC.String()] = append(sent[bonjourPacket.srcMAC.String()], tags[0])
+	})
+	sources := []net.HardwareAddr{{0xaa, 0, 0, 0, 0, 1}, {0xaa, 0, 0, 0, 0, 2}, {0xaa, 0, 0, 0, 0, 3}}
+	// The sequence number of the reflections of each source is passed as their tag
+	for i := 0; i < 50; i++ {
+		for j := range sources {
+			bonjourPacket := createMockBonjourPacket(true)
+			bonjourPacket.srcMAC = &sources[j]
+			pipelines.dispatch(&bonjourPacket, []uint16{uint16(i)})
+		}
+	}
+	pipelines.close()
+
+	for _, source := range sources {
+		tags := sent[source.String()]
+		if len(tags) != 50 {
+			t.Fatalf("Error in dispatch(): expected 50 reflections of %v, got %v", source, len(tags))
+		}
+		for i, tag := range tags {
+			if tag != uint16(i) {
+				t.Errorf("Error in dispatch(): the reflections of %v were sent out of order: %v", source, tags)
+				break
+			}
+		}
+	}
+}
+
+func TestSourceShard(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	frame := append(append([]byte{1, 0, 0x5e, 0, 0, 0xfb}, mac...), 0x81, 0x00)
+	if frameSource(frame).String() != mac.String() || frameSource(frame[:8]) != nil {
+		t.Errorf("Error in frameSource(): got %v", frameSource(frame))
+	}
+	if sourceShard(mac, 1) != 0 || sourceShard(nil, 4) >= 4 || sourceShard(mac, 8) != sourceShard(frameSource(frame), 8) {
+		t.Error("Error in sourceShard(): the packets of a source should go to the same worker")
+	}
+}
+
+func TestPipelinesConfigDefaults(t *testing.T) {
+	cfg := pipelinesConfig{IPv6Workers: 4}
+	cfg.setDefaults()
+	if cfg != (pipelinesConfig{DecodeWorkers: 1, IPv4Workers: 1, IPv6Workers: 4, Capacity: 256}) {
+		t.Errorf("Error in setDefaults(): got %+v", cfg)
+	}
+}
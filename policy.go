@@ -0,0 +1,110 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Default delay after which the evaluation of a packet by the policy module is aborted
+const defaultPolicyTimeout = 10 * time.Millisecond
+
+var (
+	policyErrors = expvar.NewInt("policy_errors")
+	policyDrops  = expvar.NewInt("policy_drops")
+)
+
+// policy decides the fate of packets beyond the rules of the configuration file,
+// e.g. a WebAssembly module loaded from policy_module
+type policy interface {
+	evaluate(summary packetSummary) (policyVerdict, error)
+}
+
+// packetSummary is the description of a packet handed to the policy
+type packetSummary struct {
+	IsQuery   bool            `json:"is_query"`
+	SrcMAC    string          `json:"src_mac"`
+	SrcIP     string          `json:"src_ip"`
+	VLAN      uint16          `json:"vlan"`
+	Targets   []uint16        `json:"targets"`
+	Questions []recordSummary `json:"questions,omitempty"`
+	Answers   []recordSummary `json:"answers,omitempty"`
+}
+
+type recordSummary struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl,omitempty"`
+}
+
+// policyVerdict is the answer of the policy: an action, "accept" (default) or "drop", and optional mutations.
+// VLANs restricts the VLANs the packet is reflected to, and TTL replaces the TTL of its records.
+type policyVerdict struct {
+	Action string   `json:"action"`
+	VLANs  []uint16 `json:"vlans"`
+	TTL    *uint32  `json:"ttl"`
+}
+
+func summarizePacket(bonjourPacket *bonjourPacket, targets []uint16) packetSummary {
+	summary := packetSummary{
+		IsQuery: bonjourPacket.isDNSQuery,
+		SrcMAC:  bonjourPacket.srcMAC.String(),
+		SrcIP:   bonjourPacket.srcIP.String(),
+		VLAN:    *bonjourPacket.vlanTag,
+		Targets: targets,
+	}
+	if bonjourPacket.dns == nil {
+		return summary
+	}
+	for _, question := range bonjourPacket.dns.Questions {
+		summary.Questions = append(summary.Questions, recordSummary{Name: string(question.Name), Type: question.Type.String()})
+	}
+	for _, answer := range bonjourPacket.dns.Answers {
+		summary.Answers = append(summary.Answers, recordSummary{Name: string(answer.Name), Type: answer.Type.String(), TTL: answer.TTL})
+	}
+	return summary
+}
+
+// applyPolicy submits bonjourPacket to the policy, and returns the VLANs it should be reflected to.
+// The policy may only narrow down the VLANs allowed by the configuration. When it fails, the configuration applies.
+func (r *reflector) applyPolicy(bonjourPacket *bonjourPacket, tags []uint16) []uint16 {
+	if r.policy == nil || len(tags) == 0 {
+		return tags
+	}
+	verdict, err := r.policy.evaluate(summarizePacket(bonjourPacket, tags))
+	if err != nil {
+		policyErrors.Add(1)
+		logger.warnf("Policy module failed, applying the configuration: %v", err)
+		return tags
+	}
+	if verdict.Action == "drop" {
+		policyDrops.Add(1)
+		return nil
+	}
+	if verdict.VLANs != nil {
+		allowed := make(map[uint16]bool)
+		for _, tag := range verdict.VLANs {
+			allowed[tag] = true
+		}
+		var narrowed []uint16
+		for _, tag := range tags {
+			if allowed[tag] {
+				narrowed = append(narrowed, tag)
+			}
+		}
+		tags = narrowed
+	}
+	if verdict.TTL != nil && bonjourPacket.dns != nil {
+		for _, records := range [][]layers.DNSResourceRecord{bonjourPacket.dns.Answers, bonjourPacket.dns.Authorities, bonjourPacket.dns.Additionals} {
+			for i := range records {
+				// Goodbye packets must keep their TTL of 0
+				if records[i].TTL != 0 {
+					records[i].TTL = *verdict.TTL
+					bonjourPacket.dnsRewritten = true
+				}
+			}
+		}
+	}
+	return tags
+}
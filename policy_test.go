@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// mockPolicy returns a fixed verdict, and records the summaries it was given
+type mockPolicy struct {
+	verdict   policyVerdict
+	err       error
+	summaries []packetSummary
+}
+
+func (policy *mockPolicy) evaluate(summary packetSummary) (policyVerdict, error) {
+	policy.summaries = append(policy.summaries, summary)
+	return policy.verdict, policy.err
+}
+
+func TestApplyPolicy(t *testing.T) {
+	r, _ := createMockReflector(brconfig{})
+	ttl := uint32(60)
+	tests := []struct {
+		verdict  policyVerdict
+		err      error
+		expected []uint16
+	}{
+		{policyVerdict{}, nil, []uint16{42, 43}},
+		{policyVerdict{Action: "drop"}, nil, nil},
+		{policyVerdict{VLANs: []uint16{43, 44}}, nil, []uint16{43}},
+		{policyVerdict{Action: "drop"}, errors.New("trap"), []uint16{42, 43}},
+		{policyVerdict{TTL: &ttl}, nil, []uint16{42, 43}},
+	}
+	for _, test := range tests {
+		policy := &mockPolicy{verdict: test.verdict, err: test.err}
+		r.policy = policy
+		bonjourPacket := createMockBonjourPacket(false)
+		tags := r.applyPolicy(&bonjourPacket, []uint16{42, 43})
+		if len(tags) != len(test.expected) || (len(tags) > 0 && tags[0] != test.expected[0]) {
+			t.Errorf("Error in applyPolicy() for verdict %+v: got %v", test.verdict, tags)
+		}
+		if test.verdict.TTL != nil && (!bonjourPacket.dnsRewritten || bonjourPacket.dns.Answers[0].TTL != ttl) {
+			t.Error("Error in applyPolicy(): TTL not rewritten")
+		}
+	}
+
+	summary := r.policy.(*mockPolicy).summaries[0]
+	if summary.IsQuery || summary.VLAN != vlanIdentifierTest || len(summary.Answers) != 1 || summary.Answers[0].Name != "example.com" || summary.Answers[0].Type != "A" {
+		t.Errorf("Error in summarizePacket(), got %+v", summary)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// BPF filter capturing the tagged IPv6 router advertisements, which carry no extension header
+const routerAdvertisementFilter = "vlan and icmp6 and ip6[40] == 134"
+
+// Type of the prefix information option of router advertisements, and its flag telling that hosts may autoconfigure
+// an address in the prefix (RFC 4861)
+const (
+	prefixInformationOption = 3
+	prefixAutonomousFlag    = 0x40
+)
+
+// learnedPrefix is an IPv6 prefix advertised by a router on a VLAN. Infinite lifetimes (0xffffffff seconds)
+// end after 136 years.
+type learnedPrefix struct {
+	Prefix         string    `json:"prefix"`
+	Router         string    `json:"router"`
+	Autonomous     bool      `json:"autonomous"`
+	ValidUntil     time.Time `json:"valid_until"`
+	PreferredUntil time.Time `json:"preferred_until"`
+
+	network *net.IPNet
+}
+
+// prefixLearner learns the IPv6 prefixes of each VLAN from the router advertisements seen on the trunk,
+// so that they do not have to be configured in the subnets of the VLANs
+type prefixLearner struct {
+	mutex    sync.Mutex
+	prefixes map[uint16]map[string]*learnedPrefix
+}
+
+// newPrefixLearner returns a prefix learner, or nil when prefixes are not learned
+func newPrefixLearner(enabled bool) *prefixLearner {
+	if !enabled {
+		return nil
+	}
+	return &prefixLearner{prefixes: make(map[uint16]map[string]*learnedPrefix)}
+}
+
+// watch processes the router advertisements read from source, until it is closed
+func (learner *prefixLearner) watch(source *gopacket.PacketSource) {
+	for packet := range source.Packets() {
+		learner.handlePacket(packet, time.Now())
+	}
+}
+
+func (learner *prefixLearner) handlePacket(packet gopacket.Packet, now time.Time) {
+	dot1q, _ := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	ipv6, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	// Routers advertise from their link-local address, with a hop limit of 255 proving the advertisement
+	// was not forwarded from another link (RFC 4861, section 6.1.2)
+	if dot1q == nil || ipv6 == nil || !ipv6.SrcIP.IsLinkLocalUnicast() || ipv6.HopLimit != 255 {
+		return
+	}
+	for _, data := range prefixInformation(packet) {
+		// Prefix length, flags, valid and preferred lifetimes, reserved bytes, and prefix
+		if len(data) < 30 || data[0] > 128 {
+			continue
+		}
+		prefix := net.IP(data[14:30])
+		if prefix.IsLinkLocalUnicast() || prefix.IsMulticast() {
+			continue
+		}
+		network := &net.IPNet{IP: prefix.Mask(net.CIDRMask(int(data[0]), 128)), Mask: net.CIDRMask(int(data[0]), 128)}
+		valid := time.Duration(binary.BigEndian.Uint32(data[2:6])) * time.Second
+		preferred := time.Duration(binary.BigEndian.Uint32(data[6:10])) * time.Second
+		// Options preferred for longer than they are valid are invalid (RFC 4862, section 5.5.3)
+		if preferred > valid {
+			continue
+		}
+		learner.learn(dot1q.VLANIdentifier, &learnedPrefix{
+			Prefix:         network.String(),
+			Router:         ipv6.SrcIP.String(),
+			Autonomous:     data[1]&prefixAutonomousFlag != 0,
+			ValidUntil:     now.Add(valid),
+			PreferredUntil: now.Add(preferred),
+			network:        network,
+		}, now)
+	}
+}
+
+// prefixInformation returns the data of the prefix information options of the router advertisement carried by
+// packet, which gopacket does not decode
+func prefixInformation(packet gopacket.Packet) [][]byte {
+	icmp, _ := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	// The payload starts with the reachable time and the retransmission timer, followed by the options
+	if icmp == nil || icmp.TypeCode.Type() != layers.ICMPv6TypeRouterAdvertisement || len(icmp.Payload) < 8 {
+		return nil
+	}
+	var prefixes [][]byte
+	options := icmp.Payload[8:]
+	for len(options) >= 2 {
+		// The length of an option, counted in units of 8 bytes, includes its type and length
+		length := int(options[1]) * 8
+		if length == 0 || length > len(options) {
+			break
+		}
+		if options[0] == prefixInformationOption {
+			prefixes = append(prefixes, options[2:length])
+		}
+		options = options[length:]
+	}
+	return prefixes
+}
+
+// learn records a prefix advertised on the VLAN tag, or forgets it when it is not valid anymore,
+// along with the prefixes of the VLAN which expired
+func (learner *prefixLearner) learn(tag uint16, prefix *learnedPrefix, now time.Time) {
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+	if _, ok := learner.prefixes[tag]; !ok {
+		learner.prefixes[tag] = make(map[string]*learnedPrefix)
+	}
+	for key, learned := range learner.prefixes[tag] {
+		if !learned.ValidUntil.After(now) {
+			logger.infof("Prefix %v expired on VLAN %v", key, tag)
+			delete(learner.prefixes[tag], key)
+		}
+	}
+	_, known := learner.prefixes[tag][prefix.Prefix]
+	if !prefix.ValidUntil.After(now) {
+		if known {
+			logger.infof("Prefix %v withdrawn from VLAN %v by %v", prefix.Prefix, tag, prefix.Router)
+			delete(learner.prefixes[tag], prefix.Prefix)
+		}
+		return
+	}
+	if !known {
+		logger.infof("Learned prefix %v on VLAN %v from %v", prefix.Prefix, tag, prefix.Router)
+	}
+	learner.prefixes[tag][prefix.Prefix] = prefix
+}
+
+// valid returns the prefixes of the VLAN tag which did not expire, sorted.
+// It must be called with the mutex held.
+func (learner *prefixLearner) valid(tag uint16, now time.Time) []*learnedPrefix {
+	var prefixes []*learnedPrefix
+	for _, prefix := range learner.prefixes[tag] {
+		if prefix.ValidUntil.After(now) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix < prefixes[j].Prefix })
+	return prefixes
+}
+
+// subnets returns the prefixes currently advertised on the VLAN tag
+func (learner *prefixLearner) subnets(tag uint16, now time.Time) []*net.IPNet {
+	if learner == nil {
+		return nil
+	}
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+	var subnets []*net.IPNet
+	for _, prefix := range learner.valid(tag, now) {
+		subnets = append(subnets, prefix.network)
+	}
+	return subnets
+}
+
+// sourceAddress returns the address the interface mac would autoconfigure (modified EUI-64) in the first /64
+// autonomous prefix advertised on the VLAN tag which is still preferred, or nil when there is none
+func (learner *prefixLearner) sourceAddress(tag uint16, mac net.HardwareAddr, now time.Time) net.IP {
+	if learner == nil || len(mac) != 6 {
+		return nil
+	}
+	learner.mutex.Lock()
+	defer learner.mutex.Unlock()
+	for _, prefix := range learner.valid(tag, now) {
+		if ones, _ := prefix.network.Mask.Size(); ones != 64 || !prefix.Autonomous || !prefix.PreferredUntil.After(now) {
+			continue
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, prefix.network.IP)
+		copy(ip[8:], []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]})
+		return ip
+	}
+	return nil
+}
+
+func (learner *prefixLearner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	learner.mutex.Lock()
+	state := make(map[uint16][]*learnedPrefix)
+	for tag := range learner.prefixes {
+		if prefixes := learner.valid(tag, time.Now()); len(prefixes) > 0 {
+			state[tag] = prefixes
+		}
+	}
+	learner.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockRouterAdvertisement(tag uint16, prefix string, flags byte, valid uint32) gopacket.Packet {
+	return createMockRouterAdvertisementFrom("fe80::1", 255, tag, prefix, flags, valid, valid)
+}
+
+func createMockRouterAdvertisementFrom(router string, hopLimit uint8, tag uint16, prefix string, flags byte, valid, preferred uint32) gopacket.Packet {
+	_, network, _ := net.ParseCIDR(prefix)
+	ones, _ := network.Mask.Size()
+	info := make([]byte, 30)
+	info[0], info[1] = byte(ones), flags
+	binary.BigEndian.PutUint32(info[2:6], valid)
+	binary.BigEndian.PutUint32(info[6:10], preferred)
+	copy(info[14:], network.IP)
+
+	ipv6 := &layers.IPv6{Version: 6, HopLimit: hopLimit, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP(router), DstIP: net.ParseIP("ff02::1")}
+	// Hop limit, flags and router lifetime
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterAdvertisement, 0), TypeBytes: []byte{64, 0, 0x07, 0x08}}
+	icmp.SetNetworkLayerForChecksum(ipv6)
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: dstMACTest, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv6},
+		ipv6, icmp,
+		// Reachable time and retransmission timer, followed by the prefix information option
+		gopacket.Payload(append(append(make([]byte, 8), prefixInformationOption, 4), info...)))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestPrefixLearner(t *testing.T) {
+	if newPrefixLearner(false).subnets(42, time.Now()) != nil {
+		t.Error("Error in subnets(): a disabled learner should not learn anything")
+	}
+	learner := newPrefixLearner(true)
+	now := time.Now()
+	learner.handlePacket(createMockRouterAdvertisement(42, "2001:db8:42::/64", prefixAutonomousFlag, 3600), now)
+	learner.handlePacket(createMockRouterAdvertisement(43, "2001:db8:43::/48", 0, 3600), now)
+
+	subnets := learner.subnets(42, now)
+	if len(subnets) != 1 || subnets[0].String() != "2001:db8:42::/64" {
+		t.Fatalf("Error in handlePacket(): learned %v on VLAN 42", subnets)
+	}
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	if ip := learner.sourceAddress(42, mac, now); !ip.Equal(net.ParseIP("2001:db8:42::211:22ff:fe33:4455")) {
+		t.Errorf("Error in sourceAddress(): got %v", ip)
+	}
+	// Addresses are only autoconfigured in autonomous /64 prefixes
+	if ip := learner.sourceAddress(43, mac, now); ip != nil || len(learner.subnets(43, now)) != 1 {
+		t.Errorf("Error in sourceAddress(): got %v on VLAN 43", ip)
+	}
+
+	// Prefixes expire, or are withdrawn with a valid lifetime of 0
+	if subnets := learner.subnets(42, now.Add(2*time.Hour)); len(subnets) != 0 {
+		t.Errorf("Error in subnets(): expired prefixes %v", subnets)
+	}
+	learner.handlePacket(createMockRouterAdvertisement(43, "2001:db8:43::/48", 0, 0), now)
+	if subnets := learner.subnets(43, now); len(subnets) != 0 {
+		t.Errorf("Error in handlePacket(): withdrawn prefixes %v", subnets)
+	}
+	// Expired prefixes are forgotten when the VLAN advertises prefixes again
+	learner.handlePacket(createMockRouterAdvertisement(42, "2001:db8:4242::/64", 0, 3600), now.Add(2*time.Hour))
+	if _, ok := learner.prefixes[42]["2001:db8:42::/64"]; ok {
+		t.Error("Error in learn(): expired prefixes should be forgotten")
+	}
+}
+
+func TestPrefixLearnerLifetimes(t *testing.T) {
+	learner := newPrefixLearner(true)
+	now := time.Now()
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	// Only the advertisements of routers of the link are accepted
+	learner.handlePacket(createMockRouterAdvertisementFrom("2001:db8::1", 255, 42, "2001:db8:42::/64", prefixAutonomousFlag, 3600, 3600), now)
+	learner.handlePacket(createMockRouterAdvertisementFrom("fe80::1", 64, 42, "2001:db8:42::/64", prefixAutonomousFlag, 3600, 3600), now)
+	if subnets := learner.subnets(42, now); len(subnets) != 0 {
+		t.Errorf("Error in handlePacket(): learned %v from routers of another link", subnets)
+	}
+
+	// Options preferred for longer than they are valid are ignored
+	learner.handlePacket(createMockRouterAdvertisementFrom("fe80::1", 255, 42, "2001:db8:42::/64", prefixAutonomousFlag, 600, 3600), now)
+	if subnets := learner.subnets(42, now); len(subnets) != 0 {
+		t.Errorf("Error in handlePacket(): learned %v from an invalid option", subnets)
+	}
+
+	// Deprecated prefixes are still valid subnets, but addresses are not autoconfigured in them anymore
+	learner.handlePacket(createMockRouterAdvertisementFrom("fe80::1", 255, 42, "2001:db8:42::/64", prefixAutonomousFlag, 3600, 600), now)
+	later := now.Add(20 * time.Minute)
+	if ip := learner.sourceAddress(42, mac, now); ip == nil || len(learner.subnets(42, later)) != 1 || learner.sourceAddress(42, mac, later) != nil {
+		t.Errorf("Error in sourceAddress(): expected no address in a deprecated prefix, got %v", learner.sourceAddress(42, mac, later))
+	}
+}
+
+func TestLearnedPrefixValidation(t *testing.T) {
+	cfg, err := parseConfig(`address_validation = "drop"`)
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	learner := newPrefixLearner(true)
+	learner.handlePacket(createMockRouterAdvertisement(1547, "2001:db8:47::/64", prefixAutonomousFlag, 3600), time.Now())
+	validator := newAddressValidator(learner)
+
+	vlan := uint16(1547)
+	// Link-local addresses are not checked against the learned prefixes
+	packet := bonjourPacket{dns: createMockAddressAnswer("2001:db8:47::10", "fd00::10", "fe80::10"), vlanTag: &vlan, srcMAC: &srcMACTest}
+	if tags := validator.validate(&cfg, &packet, []uint16{1234}); len(tags) != 1 || len(packet.dns.Additionals) != 2 ||
+		!packet.dns.Additionals[0].IP.Equal(net.ParseIP("2001:db8:47::10")) || !packet.dns.Additionals[1].IP.Equal(net.ParseIP("fe80::10")) {
+		t.Errorf("Error in validate(): got %v and %v", tags, packet.dns.Additionals)
+	}
+}
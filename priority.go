@@ -0,0 +1,143 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Drop policies applied when the queue of a class of packets is full
+const (
+	dropNewest = "drop-newest"
+	dropOldest = "drop-oldest"
+)
+
+const (
+	defaultQueryQueueCapacity  = 256
+	defaultAnswerQueueCapacity = 1024
+)
+
+// priorityQueueStats counts, for each class of packets, the queued and dropped packets
+var priorityQueueStats = expvar.NewMap("priority_queue")
+
+type priorityQueueConfig struct {
+	QueryCapacity  int    `toml:"query_capacity"`
+	AnswerCapacity int    `toml:"answer_capacity"`
+	QueryDrop      string `toml:"query_drop"`
+	AnswerDrop     string `toml:"answer_drop"`
+}
+
+func (cfg *priorityQueueConfig) setDefaults() {
+	if cfg.QueryCapacity <= 0 {
+		cfg.QueryCapacity = defaultQueryQueueCapacity
+	}
+	if cfg.AnswerCapacity <= 0 {
+		cfg.AnswerCapacity = defaultAnswerQueueCapacity
+	}
+	if cfg.QueryDrop == "" {
+		cfg.QueryDrop = dropOldest
+	}
+	if cfg.AnswerDrop == "" {
+		cfg.AnswerDrop = dropNewest
+	}
+}
+
+func isValidDropPolicy(policy string) bool {
+	return policy == dropNewest || policy == dropOldest
+}
+
+// packetClass is a class of the priority queue, queries being processed before answers
+type packetClass struct {
+	name       string
+	capacity   int
+	dropOldest bool
+	packets    []bonjourPacket
+}
+
+// priorityQueue holds the packets waiting to be processed. Under overload, queries are processed before
+// the bulk of announcements, so that interactive discovery stays responsive.
+type priorityQueue struct {
+	mutex   sync.Mutex
+	ready   *sync.Cond
+	classes [2]*packetClass
+	closed  bool
+}
+
+func newPriorityQueue(cfg priorityQueueConfig) *priorityQueue {
+	queue := &priorityQueue{
+		classes: [2]*packetClass{
+			{name: "query", capacity: cfg.QueryCapacity, dropOldest: cfg.QueryDrop == dropOldest},
+			{name: "answer", capacity: cfg.AnswerCapacity, dropOldest: cfg.AnswerDrop == dropOldest},
+		},
+	}
+	queue.ready = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (queue *priorityQueue) push(bonjourPacket bonjourPacket) {
+	class := queue.classes[1]
+	if bonjourPacket.isDNSQuery {
+		class = queue.classes[0]
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if len(class.packets) >= class.capacity {
+		priorityQueueStats.Add(class.name+"_dropped", 1)
+		if !class.dropOldest {
+			return
+		}
+		class.packets = class.packets[1:]
+	}
+	class.packets = append(class.packets, bonjourPacket)
+	priorityQueueStats.Add(class.name+"_queued", 1)
+	queue.ready.Signal()
+}
+
+// pop waits for a packet, and returns false once the queue is closed and empty
+func (queue *priorityQueue) pop() (bonjourPacket, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for {
+		for _, class := range queue.classes {
+			if len(class.packets) > 0 {
+				bonjourPacket := class.packets[0]
+				class.packets = class.packets[1:]
+				return bonjourPacket, true
+			}
+		}
+		if queue.closed {
+			return bonjourPacket{}, false
+		}
+		queue.ready.Wait()
+	}
+}
+
+func (queue *priorityQueue) close() {
+	queue.mutex.Lock()
+	queue.closed = true
+	queue.mutex.Unlock()
+	queue.ready.Broadcast()
+}
+
+// prioritizeBonjourPackets reorders the packets of in, queries first, dropping packets when a class overflows
+func prioritizeBonjourPackets(in <-chan bonjourPacket, cfg priorityQueueConfig) chan bonjourPacket {
+	queue := newPriorityQueue(cfg)
+	go func() {
+		for bonjourPacket := range in {
+			queue.push(bonjourPacket)
+		}
+		queue.close()
+	}()
+
+	out := make(chan bonjourPacket)
+	go func() {
+		for {
+			bonjourPacket, ok := queue.pop()
+			if !ok {
+				close(out)
+				return
+			}
+			out <- bonjourPacket
+		}
+	}()
+	return out
+}
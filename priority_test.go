@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	queue := newPriorityQueue(priorityQueueConfig{QueryCapacity: 2, AnswerCapacity: 2, QueryDrop: dropOldest, AnswerDrop: dropNewest})
+	for i := 0; i < 3; i++ {
+		answer := createMockBonjourPacket(false)
+		answer.srcPort = 1000 + layers.UDPPort(i)
+		queue.push(answer)
+		query := createMockBonjourPacket(true)
+		query.srcPort = 2000 + layers.UDPPort(i)
+		queue.push(query)
+	}
+	queue.close()
+
+	// Queries come first, the oldest query and the newest answer being dropped
+	expected := []layers.UDPPort{2001, 2002, 1000, 1001}
+	for _, port := range expected {
+		bonjourPacket, ok := queue.pop()
+		if !ok || bonjourPacket.srcPort != port {
+			t.Fatalf("Error in pop(): got packet from port %v, expected %v", bonjourPacket.srcPort, port)
+		}
+	}
+	if _, ok := queue.pop(); ok {
+		t.Error("Error in pop(): closed queue should be empty")
+	}
+}
+
+func TestPrioritizeBonjourPackets(t *testing.T) {
+	in := make(chan bonjourPacket, 2)
+	in <- createMockBonjourPacket(false)
+	in <- createMockBonjourPacket(true)
+	close(in)
+
+	var received int
+	for range prioritizeBonjourPackets(in, priorityQueueConfig{QueryCapacity: 4, AnswerCapacity: 4}) {
+		received++
+	}
+	if received != 2 {
+		t.Errorf("Error in prioritizeBonjourPackets(): %v packets received, expected 2", received)
+	}
+}
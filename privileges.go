@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// privilegesConfig drops the root privileges of the reflector once its capture and injection handles are open:
+// the process switches to user and group, after confining itself to the chroot directory when set
+type privilegesConfig struct {
+	User   string `toml:"user"`
+	Group  string `toml:"group"`
+	Chroot string `toml:"chroot"`
+}
+
+// credentials are the user and group IDs the process switches to, -1 leaving the current one
+type credentials struct {
+	uid int
+	gid int
+}
+
+func (cfg privilegesConfig) enabled() bool {
+	return cfg.User != "" || cfg.Group != "" || cfg.Chroot != ""
+}
+
+func (cfg privilegesConfig) validate() error {
+	if cfg.Chroot != "" && !filepath.IsAbs(cfg.Chroot) {
+		return fmt.Errorf("chroot of the privileges section must be an absolute path, got %q", cfg.Chroot)
+	}
+	return nil
+}
+
+// resolve looks up the IDs of user and group, which may be names or numeric IDs.
+// Without group, the primary group of user is used.
+func (cfg privilegesConfig) resolve() (credentials, error) {
+	creds := credentials{uid: -1, gid: -1}
+	if cfg.User != "" {
+		u, err := lookupUser(cfg.User)
+		if err != nil {
+			return creds, fmt.Errorf("unknown user %q: %v", cfg.User, err)
+		}
+		if creds.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return creds, fmt.Errorf("user %q has no numeric ID", cfg.User)
+		}
+		if creds.gid, err = strconv.Atoi(u.Gid); err != nil {
+			return creds, fmt.Errorf("user %q has no numeric group ID", cfg.User)
+		}
+	}
+	if cfg.Group != "" {
+		g, err := lookupGroup(cfg.Group)
+		if err != nil {
+			return creds, fmt.Errorf("unknown group %q: %v", cfg.Group, err)
+		}
+		if creds.gid, err = strconv.Atoi(g.Gid); err != nil {
+			return creds, fmt.Errorf("group %q has no numeric ID", cfg.Group)
+		}
+	}
+	return creds, nil
+}
+
+// lookupUser returns the user named name, or whose ID is name. IDs missing from the user database are used as is.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err != nil {
+		return user.Lookup(name)
+	}
+	u, err := user.LookupId(name)
+	if _, ok := err.(user.UnknownUserIdError); ok {
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	return u, err
+}
+
+// lookupGroup returns the group named name, or whose ID is name. IDs missing from the group database are used as is.
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err != nil {
+		return user.LookupGroup(name)
+	}
+	g, err := user.LookupGroupId(name)
+	if _, ok := err.(user.UnknownGroupIdError); ok {
+		return &user.Group{Gid: name}, nil
+	}
+	return g, err
+}
+
+// dropPrivileges confines the process to the chroot directory and switches to the user and group of the
+// privileges section. The user and group are looked up first, as the user database may be outside the chroot.
+func dropPrivileges(cfg privilegesConfig) error {
+	if !cfg.enabled() {
+		return nil
+	}
+	creds, err := cfg.resolve()
+	if err != nil {
+		return configError(fmt.Errorf("could not drop privileges: %v", err))
+	}
+	if cfg.Chroot != "" {
+		if err := chroot(cfg.Chroot); err != nil {
+			return permissionError(fmt.Errorf("could not chroot to %v: %v", cfg.Chroot, err))
+		}
+		if err := os.Chdir("/"); err != nil {
+			return permissionError(fmt.Errorf("could not chroot to %v: %v", cfg.Chroot, err))
+		}
+		logger.infof("Confined to %v", cfg.Chroot)
+	}
+	if creds.uid == -1 && creds.gid == -1 {
+		return nil
+	}
+	if err := setCredentials(creds); err != nil {
+		return permissionError(fmt.Errorf("could not drop privileges: %v", err))
+	}
+	logger.infof("Dropped privileges, running as uid %v and gid %v", os.Getuid(), os.Getgid())
+	return nil
+}
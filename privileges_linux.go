@@ -0,0 +1,31 @@
+package main
+
+// #include <grp.h>
+// #include <unistd.h>
+import "C"
+
+import "syscall"
+
+func chroot(dir string) error {
+	return syscall.Chroot(dir)
+}
+
+// setCredentials switches the process to the group, without supplementary groups, then to the user of creds.
+// The C library applies them to every thread of the process, which syscall.Setuid does not do on Linux before Go 1.16.
+func setCredentials(creds credentials) error {
+	if creds.gid != -1 {
+		gid := C.gid_t(creds.gid)
+		if ret, err := C.setgroups(1, &gid); ret != 0 {
+			return err
+		}
+		if ret, err := C.setgid(gid); ret != 0 {
+			return err
+		}
+	}
+	if creds.uid != -1 {
+		if ret, err := C.setuid(C.uid_t(creds.uid)); ret != 0 {
+			return err
+		}
+	}
+	return nil
+}
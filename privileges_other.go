@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// chroot and setCredentials are only implemented on Linux
+func chroot(dir string) error {
+	return fmt.Errorf("chroot is only supported on Linux")
+}
+
+func setCredentials(creds credentials) error {
+	return fmt.Errorf("dropping privileges is only supported on Linux")
+}
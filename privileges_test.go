@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestResolvePrivileges(t *testing.T) {
+	creds, err := privilegesConfig{User: "root"}.resolve()
+	if err != nil || creds.uid != 0 || creds.gid != 0 {
+		t.Errorf("Error in resolve(): expected root to be uid 0 and gid 0, got %+v (%v)", creds, err)
+	}
+	// Numeric IDs do not need to exist in the user and group databases
+	creds, err = privilegesConfig{User: "64999", Group: "64998"}.resolve()
+	if err != nil || creds.uid != 64999 || creds.gid != 64998 {
+		t.Errorf("Error in resolve(): expected uid 64999 and gid 64998, got %+v (%v)", creds, err)
+	}
+	creds, err = privilegesConfig{Group: "64998"}.resolve()
+	if err != nil || creds.uid != -1 || creds.gid != 64998 {
+		t.Errorf("Error in resolve(): expected the user to be left unchanged, got %+v (%v)", creds, err)
+	}
+	if _, err := (privilegesConfig{User: "no-such-user-bonjour"}).resolve(); err == nil {
+		t.Error("Error in resolve(): expected an error for an unknown user")
+	}
+
+	if err := dropPrivileges(privilegesConfig{}); err != nil {
+		t.Errorf("Error in dropPrivileges(): expected nothing to be done without privileges section, got %v", err)
+	}
+	if _, err := parseConfig("[privileges]\nuser = \"nobody\"\nchroot = \"var/empty\""); err == nil {
+		t.Error("Error in parseConfig(): expected a relative chroot to be rejected")
+	}
+}
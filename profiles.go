@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyProfile overrides the settings of the configuration by the ones of the named profile of its profiles table,
+// e.g. [profiles.lab] with its own net_interface and [profiles.lab.devices."AA:BB:CC:DD:EE:FF"] entries.
+// The tables and arrays set by the profile, such as its devices, replace the common ones as a whole, while the keys
+// of the sections, such as proxy, are overridden one by one.
+func (cfg *brconfig) applyProfile(md toml.MetaData, name string) error {
+	profiles := cfg.Profiles
+	cfg.Profiles = nil
+	if name == "" {
+		return nil
+	}
+	profile, ok := profiles[name]
+	if !ok && len(profiles) == 0 {
+		return fmt.Errorf("unknown profile %q, the configuration has no profiles", name)
+	}
+	if !ok {
+		return fmt.Errorf("unknown profile %q, expected one of %v", name, profileNames(profiles))
+	}
+	if md.IsDefined("profiles", name, "profiles") {
+		return fmt.Errorf("profile %q cannot define other profiles", name)
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, key := v.Field(i), v.Type().Field(i).Tag.Get("toml")
+		if key != "" && (field.Kind() == reflect.Map || field.Kind() == reflect.Slice) && md.IsDefined("profiles", name, key) {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	if err := md.PrimitiveDecode(profile, cfg); err != nil {
+		return fmt.Errorf("invalid profile %q: %v", name, err)
+	}
+	cfg.profile = name
+	if md.IsDefined("profiles", name, "devices") {
+		// The device API then persists its changes to the devices of the profile
+		cfg.devicesPrefix = "profiles." + name + "."
+	}
+	return nil
+}
+
+func profileNames(profiles map[string]toml.Primitive) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
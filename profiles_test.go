@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const profilesConfigTest = `
+net_interface = "eth0"
+default_pool = [1]
+
+[proxy]
+enabled = false
+max_records = 10
+
+[devices."AA:00:CC:00:EE:00"]
+origin_pool = 1
+shared_pools = [2]
+
+[profiles.lab]
+net_interface = "eth1"
+
+[profiles.lab.proxy]
+enabled = true
+
+[profiles.lab.devices."AA:00:CC:00:EE:01"]
+origin_pool = 10
+shared_pools = [20]
+
+[profiles.home]
+default_pool = [3]
+`
+
+func TestParseProfile(t *testing.T) {
+	cfg, err := parseProfile(profilesConfigTest, "")
+	if err != nil || cfg.NetInterface != "eth0" || len(cfg.Devices) != 1 || cfg.Proxy.Enabled || cfg.Profiles != nil {
+		t.Errorf("Error in parseProfile(): expected the common settings without profile, got %+v (%v)", cfg, err)
+	}
+
+	cfg, err = parseProfile(profilesConfigTest, "lab")
+	if err != nil {
+		t.Fatalf("Error in parseProfile(): %v", err)
+	}
+	if cfg.NetInterface != "eth1" || !cfg.Proxy.Enabled || cfg.Proxy.MaxRecords != 10 || len(cfg.DefaultPool) != 1 {
+		t.Errorf("Error in parseProfile(): expected the profile over the common settings, got %+v", cfg)
+	}
+	if _, ok := cfg.Devices["aa:00:cc:00:ee:01"]; !ok || len(cfg.Devices) != 1 || cfg.devicesPrefix != "profiles.lab." {
+		t.Errorf("Error in parseProfile(): expected the devices of the profile only, got %+v", cfg.Devices)
+	}
+}
+
+func TestParseProfileCommonDevices(t *testing.T) {
+	cfg, err := parseProfile(profilesConfigTest, "home")
+	if err != nil || len(cfg.DefaultPool) != 1 || cfg.DefaultPool[0] != 3 || len(cfg.Devices) != 1 || cfg.devicesPrefix != "" {
+		t.Errorf("Error in parseProfile(): expected the common devices, got %+v (%v)", cfg, err)
+	}
+}
+
+func TestParseUnknownProfile(t *testing.T) {
+	if _, err := parseProfile(profilesConfigTest, "office"); err == nil || !strings.Contains(err.Error(), "[home lab]") {
+		t.Errorf("Error in parseProfile(): expected an error listing the profiles, got %v", err)
+	}
+	if _, err := parseProfile(`net_interface = "eth0"`, "lab"); err == nil {
+		t.Error("Error in parseProfile(): expected an error without profiles")
+	}
+}
+
+func TestDeviceAPIProfile(t *testing.T) {
+	path := writeTempConfig(t, profilesConfigTest)
+	defer os.Remove(path)
+	api := &deviceAPI{configPath: path, profile: "lab", devicesPrefix: "profiles.lab."}
+
+	recorder := httptest.NewRecorder()
+	body := `{"origin_pool": 10, "shared_pools": [30]}`
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/api/devices/aa:00:cc:00:ee:02", strings.NewReader(body)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Error in ServeHTTP(): got %v %v", recorder.Code, recorder.Body)
+	}
+	lab, err := readProfile(path, "lab")
+	if _, ok := lab.Devices["aa:00:cc:00:ee:02"]; err != nil || !ok || len(lab.Devices) != 2 {
+		t.Errorf("Error in ServeHTTP(): expected the device to be added to the profile, got %+v (%v)", lab.Devices, err)
+	}
+	if common, err := readConfig(path); err != nil || len(common.Devices) != 1 {
+		t.Errorf("Error in ServeHTTP(): the common devices should not change, got %+v (%v)", common.Devices, err)
+	}
+}
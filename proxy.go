@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Default maximal number of records held by the answer cache of the proxy mode
+const defaultProxyMaxRecords = 4096
+
+// Type of the questions asking for the records of every type of a name
+const dnsTypeANY = layers.DNSType(255)
+
+// Range of the random delay of the backfilled answers, the one of responders answering shared records (RFC 6762, section 6)
+const (
+	backfillMinDelay = 20 * time.Millisecond
+	backfillMaxDelay = 120 * time.Millisecond
+)
+
+// Queries answered from the cache, reflected or backfilled, and records served, exposed on /debug/vars
+var proxyStats = expvar.NewMap("proxy")
+
+// Records held by the answer cache, in total, by origin VLAN and by service type, and the share of the queries
+// answered from the cache, exposed on /debug/vars. A sudden growth of the records of a VLAN or a service type
+// may reveal a device flooding the cache with made-up instances.
+var (
+	proxyCacheStats    = expvar.NewMap("proxy_cache")
+	proxyCacheVLANs    = new(expvar.Map).Init()
+	proxyCacheServices = new(expvar.Map).Init()
+)
+
+func init() {
+	proxyCacheStats.Set("vlans", proxyCacheVLANs)
+	proxyCacheStats.Set("services", proxyCacheServices)
+	proxyCacheStats.Set("hit_ratio", expvar.Func(proxyHitRatio))
+}
+
+// proxyHitRatio returns the share of the queries answered from the cache, or 0 before any query
+func proxyHitRatio() interface{} {
+	var hits, misses int64
+	if answered, ok := proxyStats.Get("answered_queries").(*expvar.Int); ok {
+		hits = answered.Value()
+	}
+	if reflected, ok := proxyStats.Get("reflected_queries").(*expvar.Int); ok {
+		misses = reflected.Value()
+	}
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+type proxyConfig struct {
+	Enabled    bool     `toml:"enabled"`
+	MaxRecords int      `toml:"max_records"`
+	Backfill   duration `toml:"backfill"`
+}
+
+// cacheKey identifies the records of a name and a type, names being case-insensitive
+type cacheKey struct {
+	name   string
+	rrType layers.DNSType
+}
+
+// cachedRecord is a record seen in an answer from the VLAN origin, visible on the VLANs the answer was reflected to
+type cachedRecord struct {
+	record  layers.DNSResourceRecord
+	srcIP   net.IP
+	origin  uint16
+	vlans   []uint16
+	stored  time.Time
+	expires time.Time
+}
+
+// answerCache holds the records of the answers reflected by the reflector, so that it can answer the
+// queries asking for them itself instead of reflecting them into every VLAN, or backfill the answers
+// a querier may have missed. It is locked, as the records replicated from an active reflector are merged into it
+// while the packets are processed.
+type answerCache struct {
+	mutex      sync.Mutex
+	maxRecords int
+	size       int
+	records    map[cacheKey][]*cachedRecord
+	// answers is set in proxy mode, where the queries with cached answers are not reflected
+	answers bool
+	// backfill is how long the records reflected into a VLAN are backfilled to the repeated queries
+	backfill      time.Duration
+	backfillDelay func() time.Duration
+}
+
+// newAnswerCache returns the answer cache of the configuration, or nil when neither the proxy mode nor backfilling is enabled
+func newAnswerCache(cfg proxyConfig) *answerCache {
+	if !cfg.Enabled && cfg.Backfill.Duration <= 0 {
+		return nil
+	}
+	return &answerCache{
+		maxRecords:    cfg.MaxRecords,
+		records:       make(map[cacheKey][]*cachedRecord),
+		answers:       cfg.Enabled,
+		backfill:      cfg.Backfill.Duration,
+		backfillDelay: randomBackfillDelay,
+	}
+}
+
+func randomBackfillDelay() time.Duration {
+	return backfillMinDelay + time.Duration(rand.Int63n(int64(backfillMaxDelay-backfillMinDelay)+1))
+}
+
+// isCacheable tells whether the records of a type can be served again from the cache
+func isCacheable(rrType layers.DNSType) bool {
+	switch rrType {
+	case layers.DNSTypeA, layers.DNSTypeAAAA, layers.DNSTypePTR, layers.DNSTypeSRV, layers.DNSTypeTXT:
+		return true
+	}
+	return false
+}
+
+// sameData tells whether two records of the same name and type hold the same data
+func sameData(a, b *layers.DNSResourceRecord) bool {
+	switch a.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return a.IP.Equal(b.IP)
+	case layers.DNSTypePTR:
+		return strings.EqualFold(string(a.PTR), string(b.PTR))
+	case layers.DNSTypeSRV:
+		return a.SRV.Priority == b.SRV.Priority && a.SRV.Weight == b.SRV.Weight && a.SRV.Port == b.SRV.Port &&
+			strings.EqualFold(string(a.SRV.Name), string(b.SRV.Name))
+	case layers.DNSTypeTXT:
+		if len(a.TXTs) != len(b.TXTs) {
+			return false
+		}
+		for i := range a.TXTs {
+			if !bytes.Equal(a.TXTs[i], b.TXTs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// copyRecord returns a copy of a record which does not share the buffers of the packet it was decoded from
+func copyRecord(record layers.DNSResourceRecord) layers.DNSResourceRecord {
+	copied := layers.DNSResourceRecord{Name: append([]byte(nil), record.Name...), Type: record.Type, Class: record.Class, TTL: record.TTL}
+	switch record.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		copied.IP = append(net.IP(nil), record.IP...)
+	case layers.DNSTypePTR:
+		copied.PTR = append([]byte(nil), record.PTR...)
+	case layers.DNSTypeSRV:
+		copied.SRV = record.SRV
+		copied.SRV.Name = append([]byte(nil), record.SRV.Name...)
+	case layers.DNSTypeTXT:
+		for _, txt := range record.TXTs {
+			copied.TXTs = append(copied.TXTs, append([]byte(nil), txt...))
+		}
+	}
+	return copied
+}
+
+// store records the answers and additional records of an answer from the VLAN origin, reflected to tags.
+// Goodbye records (TTL 0) remove the cached ones.
+func (cache *answerCache) store(dns *layers.DNS, srcIP net.IP, origin uint16, tags []uint16, now time.Time) {
+	if cache == nil || dns == nil || len(tags) == 0 {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	records := append(append([]layers.DNSResourceRecord(nil), dns.Answers...), dns.Additionals...)
+	flushed := make(map[cacheKey]bool)
+	for i := range records {
+		record := &records[i]
+		if !isCacheable(record.Type) {
+			continue
+		}
+		key := cacheKey{name: strings.ToLower(string(record.Name)), rrType: record.Type}
+		// A unique record replaces the records of its name and type from the same VLAN, once per answer
+		if uint16(record.Class)&cacheFlushBit != 0 && !flushed[key] {
+			flushed[key] = true
+			cache.remove(key, func(cached *cachedRecord) bool { return cached.origin == origin })
+		}
+		cache.remove(key, func(cached *cachedRecord) bool { return cached.origin == origin && sameData(&cached.record, record) })
+		if record.TTL == 0 {
+			continue
+		}
+		if cache.size >= cache.maxRecords {
+			cache.prune(now)
+			if cache.size >= cache.maxRecords {
+				proxyStats.Add("cache_full", 1)
+				continue
+			}
+		}
+		cached := &cachedRecord{
+			record:  copyRecord(*record),
+			srcIP:   srcIP,
+			origin:  origin,
+			vlans:   append([]uint16(nil), tags...),
+			stored:  now,
+			expires: now.Add(time.Duration(record.TTL) * time.Second),
+		}
+		cache.records[key] = append(cache.records[key], cached)
+		cache.count(key, cached, 1)
+	}
+}
+
+// count adds delta to the size of the cache and to the gauges of the origin VLAN and service type of a record
+func (cache *answerCache) count(key cacheKey, cached *cachedRecord, delta int) {
+	cache.size += delta
+	proxyCacheStats.Add("records", int64(delta))
+	addGauge(proxyCacheVLANs, fmt.Sprint(cached.origin), delta)
+	service := serviceTypeOf(key.name)
+	if service == "" {
+		service = "other"
+	}
+	addGauge(proxyCacheServices, service, delta)
+}
+
+// addGauge adds delta to the gauge of a map, deleting it when it drops to zero so that the map does not keep
+// every VLAN and service type ever cached
+func addGauge(gauges *expvar.Map, key string, delta int) {
+	gauges.Add(key, int64(delta))
+	if gauge, ok := gauges.Get(key).(*expvar.Int); ok && gauge.Value() <= 0 {
+		gauges.Delete(key)
+	}
+}
+
+// remove deletes the records of a key matching the predicate
+func (cache *answerCache) remove(key cacheKey, matches func(*cachedRecord) bool) {
+	var kept []*cachedRecord
+	for _, cached := range cache.records[key] {
+		if matches(cached) {
+			cache.count(key, cached, -1)
+		} else {
+			kept = append(kept, cached)
+		}
+	}
+	if len(kept) == 0 {
+		delete(cache.records, key)
+	} else {
+		cache.records[key] = kept
+	}
+}
+
+// prune deletes the expired records
+func (cache *answerCache) prune(now time.Time) {
+	for key := range cache.records {
+		cache.remove(key, func(cached *cachedRecord) bool { return !now.Before(cached.expires) })
+	}
+}
+
+// flush empties the cache, e.g. when the devices or VLAN settings deciding where answers are visible change
+func (cache *answerCache) flush() {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key := range cache.records {
+		cache.remove(key, func(*cachedRecord) bool { return true })
+	}
+}
+
+// lookup returns the cached records answering a query from the VLAN tag, with their remaining TTL.
+// Only the records visible on tag and coming from the VLANs the query may be reflected to (origins) are served,
+// except the known answers of the query still valid for more than half of their TTL (RFC 6762, section 7.1).
+// complete is true when every question has cached answers, the query then needing no reflection.
+func (cache *answerCache) lookup(dns *layers.DNS, tag uint16, origins []uint16, now time.Time) (answers []*cachedRecord, complete bool) {
+	return cache.find(dns, tag, origins, time.Time{}, now)
+}
+
+// find looks the cached records up like lookup, only returning the records stored since the given time
+func (cache *answerCache) find(dns *layers.DNS, tag uint16, origins []uint16, since, now time.Time) (answers []*cachedRecord, complete bool) {
+	if cache == nil || dns == nil || len(dns.Questions) == 0 {
+		return nil, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	complete = true
+	served := make(map[*cachedRecord]bool)
+	for _, question := range dns.Questions {
+		name := strings.ToLower(string(question.Name))
+		types := []layers.DNSType{question.Type}
+		if question.Type == dnsTypeANY {
+			types = []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA, layers.DNSTypePTR, layers.DNSTypeSRV, layers.DNSTypeTXT}
+		}
+		found := false
+		for _, rrType := range types {
+			for _, cached := range cache.records[cacheKey{name: name, rrType: rrType}] {
+				if !now.Before(cached.expires) || cached.stored.Before(since) || !containsVLAN(cached.vlans, tag) || !containsVLAN(origins, cached.origin) {
+					continue
+				}
+				found = true
+				if !served[cached] && !isKnownAnswer(dns, cached, now) {
+					served[cached] = true
+					answers = append(answers, cached)
+				}
+			}
+		}
+		if !found {
+			complete = false
+		}
+	}
+	return answers, complete
+}
+
+// isKnownAnswer tells whether the query lists the cached record among its known answers with at least half of its remaining TTL
+func isKnownAnswer(dns *layers.DNS, cached *cachedRecord, now time.Time) bool {
+	remaining := uint32(cached.expires.Sub(now) / time.Second)
+	for i := range dns.Answers {
+		known := &dns.Answers[i]
+		if known.Type == cached.record.Type && strings.EqualFold(string(known.Name), string(cached.record.Name)) &&
+			sameData(known, &cached.record) && known.TTL >= remaining/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyQuery answers a query from the answer cache when it holds answers to all of its questions, and tells whether it did,
+// the query then not being reflected to tags. Responses are sent on the VLAN of the query from the address of each responder.
+// Other queries get the recently reflected answers backfilled.
+func (r *reflector) proxyQuery(bonjourPacket *bonjourPacket, tags []uint16) bool {
+	if r.proxy == nil || len(tags) == 0 {
+		return false
+	}
+	now := time.Now()
+	tag := *bonjourPacket.vlanTag
+	if !r.proxy.answers {
+		r.backfill(bonjourPacket, tags, now)
+		return false
+	}
+	answers, complete := r.proxy.lookup(bonjourPacket.dns, tag, tags, now)
+	if !complete {
+		proxyStats.Add("reflected_queries", 1)
+		r.backfill(bonjourPacket, tags, now)
+		return false
+	}
+	proxyStats.Add("answered_queries", 1)
+	if now.Before(r.warmUpUntil) {
+		return true
+	}
+	r.serveCached(answers, tag, 0, now)
+	return true
+}
+
+// backfill answers a query with the cached records reflected into its VLAN during the backfill window, after a random delay.
+// Responders do not multicast a record again within a second (RFC 6762, section 6), so a querier which missed
+// the reflected answer, e.g. on a lossy wireless VLAN, and asks again would otherwise wait for the next announcement.
+// The query is still reflected, the responders answering the questions the cache cannot.
+func (r *reflector) backfill(bonjourPacket *bonjourPacket, tags []uint16, now time.Time) {
+	if r.proxy.backfill <= 0 || now.Before(r.warmUpUntil) {
+		return
+	}
+	tag := *bonjourPacket.vlanTag
+	answers, _ := r.proxy.find(bonjourPacket.dns, tag, tags, now.Add(-r.proxy.backfill), now)
+	if len(answers) == 0 {
+		return
+	}
+	proxyStats.Add("backfilled_queries", 1)
+	r.serveCached(answers, tag, r.proxy.backfillDelay(), now)
+}
+
+// serveCached sends cached records on the VLAN tag after delay, from the address of each responder, with their remaining TTL
+func (r *reflector) serveCached(answers []*cachedRecord, tag uint16, delay time.Duration, now time.Time) {
+	var responders []string
+	byResponder := make(map[string][]layers.DNSResourceRecord)
+	for _, cached := range answers {
+		record := cached.record
+		record.TTL = uint32(cached.expires.Sub(now) / time.Second)
+		if record.TTL == 0 {
+			continue
+		}
+		translateRecord(&record, r.cfg.translations[tag])
+		responder := cached.srcIP.String()
+		if _, ok := byResponder[responder]; !ok {
+			responders = append(responders, responder)
+		}
+		byResponder[responder] = append(byResponder[responder], record)
+	}
+	for _, responder := range responders {
+		data, err := serializeMDNSResponse(byResponder[responder], net.ParseIP(responder), tag, r.brMACAddress)
+		if err != nil {
+			logger.errorf("Could not serialize cached answer: %v", err)
+			continue
+		}
+		if !r.budget.allow(protocolMDNS, tag, len(data), now) {
+			continue
+		}
+		proxyStats.Add("served_records", int64(len(byResponder[responder])))
+		if delay <= 0 {
+			r.write(data)
+			continue
+		}
+		r.after(delay, func() { r.write(data) })
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockAAnswer(name, ip string, ttl uint32) *layers.DNS {
+	return &layers.DNS{
+		QR: true,
+		Answers: []layers.DNSResourceRecord{layers.DNSResourceRecord{
+			Name:  []byte(name),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN | cacheFlushBit,
+			TTL:   ttl,
+			IP:    net.ParseIP(ip),
+		}},
+	}
+}
+
+func TestAnswerCache(t *testing.T) {
+	cache := newAnswerCache(proxyConfig{Enabled: true, MaxRecords: 3})
+	now := time.Now()
+
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, 10, []uint16{20}, now)
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Lab Printer._ipp._tcp.local", 120), srcIPv4Test, 30, []uint16{20}, now)
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_IPP._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}}}
+
+	tests := []struct {
+		tag     uint16
+		origins []uint16
+		answers int
+	}{
+		{20, []uint16{10, 30}, 2},
+		// Answers from VLANs the query may not be reflected to are not served
+		{20, []uint16{10}, 1},
+		// Nor answers which were not reflected to the VLAN of the query
+		{40, []uint16{10, 30}, 0},
+	}
+	for _, test := range tests {
+		answers, complete := cache.lookup(query, test.tag, test.origins, now.Add(time.Second))
+		if len(answers) != test.answers || complete != (test.answers > 0) {
+			t.Errorf("Error in lookup() on VLAN %v from %v: got %d answers (complete: %v), expected %d", test.tag, test.origins, len(answers), complete, test.answers)
+		}
+	}
+
+	// Known answers with more than half of their TTL left are not served again, but still answer the question
+	query.Answers = createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 100).Answers
+	if answers, complete := cache.lookup(query, 20, []uint16{10, 30}, now.Add(time.Second)); len(answers) != 1 || !complete {
+		t.Errorf("Error in lookup() with a known answer: got %d answers (complete: %v)", len(answers), complete)
+	}
+	query.Answers = nil
+
+	// Expired records are not served
+	if _, complete := cache.lookup(query, 20, []uint16{10, 30}, now.Add(121*time.Second)); complete {
+		t.Error("Error in lookup(): expired records were served")
+	}
+
+	// Goodbye records remove the cached ones
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Lab Printer._ipp._tcp.local", 0), srcIPv4Test, 30, []uint16{20}, now)
+	if answers, _ := cache.lookup(query, 20, []uint16{10, 30}, now); len(answers) != 1 || cache.size != 1 {
+		t.Errorf("Error in store(): goodbye record not applied, got %d answers and %d cached records", len(answers), cache.size)
+	}
+
+	// Unique records replace the records of their name and type from the same VLAN
+	cache.store(createMockAAnswer("printer.local", "10.0.0.1", 120), srcIPv4Test, 10, []uint16{20}, now)
+	cache.store(createMockAAnswer("printer.local", "10.0.0.2", 120), srcIPv4Test, 10, []uint16{20}, now)
+	addressQuery := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("printer.local"), Type: dnsTypeANY, Class: layers.DNSClassIN}}}
+	if answers, _ := cache.lookup(addressQuery, 20, []uint16{10}, now); len(answers) != 1 || !answers[0].record.IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Error in store(): cache-flush record not applied, got %d answers", len(answers))
+	}
+
+	// Records beyond the capacity of the cache are dropped, once the expired ones are pruned
+	cache.store(createMockAAnswer("scanner.local", "10.0.0.3", 120), srcIPv4Test, 10, []uint16{20}, now)
+	cache.store(createMockAAnswer("nas.local", "10.0.0.4", 120), srcIPv4Test, 10, []uint16{20}, now)
+	if cache.size != 3 {
+		t.Errorf("Error in store(): expected 3 cached records, got %d", cache.size)
+	}
+	cache.store(createMockAAnswer("nas.local", "10.0.0.4", 120), srcIPv4Test, 10, []uint16{20}, now.Add(200*time.Second))
+	if cache.size != 1 {
+		t.Errorf("Error in store(): expected the expired records to be pruned, got %d cached records", cache.size)
+	}
+}
+
+func TestProxyQuery(t *testing.T) {
+	cfg := brconfig{
+		Proxy: proxyConfig{Enabled: true, MaxRecords: defaultProxyMaxRecords},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42, SharedPools: []uint16{vlanIdentifierTest}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+
+	// Without cached answer, the query is reflected
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Fatalf("Error in processBonjourPacket(): query reflected to %v", tags)
+	}
+
+	// With a cached answer from VLAN 42, the reflector answers on the VLAN of the query
+	r.proxy.store(createMockAAnswer("example.com", "10.0.0.1", 120), srcIPv4Test, 42, []uint16{vlanIdentifierTest}, time.Now())
+	writer.frames = nil
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != vlanIdentifierTest {
+		t.Fatalf("Error in processBonjourPacket(): expected an answer on VLAN %v, got frames on %v", vlanIdentifierTest, tags)
+	}
+	packet := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(packet.Layer(layers.LayerTypeUDP).LayerPayload(), gopacket.NilDecodeFeedback); err != nil || !dns.QR || len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("10.0.0.1")) || dns.Answers[0].TTL > 120 {
+		t.Errorf("Error in processBonjourPacket(): invalid cached answer %v", packet)
+	}
+
+	// Once the cache is flushed, e.g. on reload, queries are reflected again
+	r.proxy.flush()
+	writer.frames = nil
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Errorf("Error in processBonjourPacket(): query reflected to %v after a flush", tags)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	cfg := brconfig{
+		Proxy: proxyConfig{MaxRecords: defaultProxyMaxRecords, Backfill: duration{time.Second}},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42, SharedPools: []uint16{vlanIdentifierTest}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+	r.proxy.backfillDelay = func() time.Duration { return 0 }
+
+	// A query repeated shortly after an answer was reflected gets it from the cache, and is still reflected
+	r.proxy.store(createMockAAnswer("example.com", "10.0.0.1", 120), srcIPv4Test, 42, []uint16{vlanIdentifierTest}, time.Now())
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[0] != vlanIdentifierTest || tags[1] != 42 {
+		t.Fatalf("Error in processBonjourPacket(): expected a backfilled answer on VLAN %v and the query on VLAN 42, got frames on %v", vlanIdentifierTest, tags)
+	}
+
+	// Answers reflected before the backfill window are left to the responders
+	r.proxy.flush()
+	r.proxy.store(createMockAAnswer("example.com", "10.0.0.1", 120), srcIPv4Test, 42, []uint16{vlanIdentifierTest}, time.Now().Add(-2*time.Second))
+	writer.frames = nil
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Errorf("Error in processBonjourPacket(): expected the query to be reflected only, got frames on %v", tags)
+	}
+
+	for i := 0; i < 10; i++ {
+		if delay := randomBackfillDelay(); delay < backfillMinDelay || delay > backfillMaxDelay {
+			t.Errorf("Error in randomBackfillDelay(): %v is out of range", delay)
+		}
+	}
+}
+
+func TestAnswerCacheGauges(t *testing.T) {
+	gauge := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	records, vlan, ipp, other := gauge(proxyCacheStats, "records"), gauge(proxyCacheVLANs, "1547"), gauge(proxyCacheServices, "_ipp._tcp.local"), gauge(proxyCacheServices, "other")
+
+	cache := newAnswerCache(proxyConfig{Enabled: true, MaxRecords: 10})
+	now := time.Now()
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, 1547, []uint16{20}, now)
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Lab Printer._ipp._tcp.local", 120), srcIPv4Test, 1547, []uint16{20}, now)
+	cache.store(createMockAAnswer("printer.local", "10.0.0.5", 120), srcIPv4Test, 1547, []uint16{20}, now)
+	if gauge(proxyCacheStats, "records")-records != 3 || gauge(proxyCacheVLANs, "1547")-vlan != 3 ||
+		gauge(proxyCacheServices, "_ipp._tcp.local")-ipp != 2 || gauge(proxyCacheServices, "other")-other != 1 {
+		t.Errorf("Error in store(): expected 3 records from VLAN 1547, 2 of them of _ipp._tcp.local, got %v", proxyCacheStats)
+	}
+
+	// Goodbyes and flushes lower the gauges
+	cache.store(createMockPTRAnswer("_ipp._tcp.local", "Lab Printer._ipp._tcp.local", 0), srcIPv4Test, 1547, []uint16{20}, now)
+	if gauge(proxyCacheServices, "_ipp._tcp.local")-ipp != 1 {
+		t.Errorf("Error in store(): a goodbye should remove its record from the gauges, got %v", proxyCacheServices)
+	}
+	cache.flush()
+	if gauge(proxyCacheStats, "records") != records || gauge(proxyCacheVLANs, "1547") != vlan {
+		t.Errorf("Error in flush(): expected the gauges to be back to their initial value, got %v", proxyCacheStats)
+	}
+	if vlan == 0 && proxyCacheVLANs.Get("1547") != nil {
+		t.Errorf("Error in flush(): expected the empty gauge of VLAN 1547 to be deleted, got %v", proxyCacheVLANs)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// How long a forwarded query is remembered after being sent, when nothing answered it
+	queryLatencyWindow = 5 * time.Second
+	// Maximal number of service names waiting for their first answer
+	queryLatencyMaxPending = 1024
+)
+
+// Upper bounds, in milliseconds, of the buckets of the answer latency histogram
+var answerLatencyBuckets = []int64{10, 50, 100, 250, 500, 1000, 5000}
+
+// queryAnswerStats counts the queries which could be answered from the service table, the forwarded ones,
+// and the latency of the first answer to forwarded queries
+var queryAnswerStats = expvar.NewMap("query_answers")
+
+// Queries reflected and answered per service type and VLAN pair since startup, exposed on /debug/vars
+// under keys such as "_ipp._tcp.local 20->10"
+var reflectionEffectiveness = expvar.NewMap("reflection_effectiveness")
+
+// Maximal number of service types and VLAN pairs whose queries are correlated with their answers
+const reflectionMaxPairs = 1024
+
+// reflectionPair is a service type asked for on the VLAN From, and reflected into the VLAN To
+type reflectionPair struct {
+	Service string `json:"service"`
+	From    uint16 `json:"from"`
+	To      uint16 `json:"to"`
+}
+
+func (pair reflectionPair) String() string {
+	return fmt.Sprintf("%v %v->%v", pair.Service, pair.From, pair.To)
+}
+
+// queryStats measures how queries for service types are answered, to quantify the benefit of answering them
+// from a cache, and to tune the TTLs of the reflected records
+type queryStats struct {
+	mutex       sync.Mutex
+	pending     map[string]time.Time
+	reflections map[reflectionPair]time.Time
+	counters    map[reflectionPair]*expvar.Map
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		pending:     make(map[string]time.Time),
+		reflections: make(map[reflectionPair]time.Time),
+		counters:    make(map[reflectionPair]*expvar.Map),
+	}
+}
+
+// recordQuery counts a query sent on vlan, and reflected to targets.
+// A query is cacheable when all the service types it asks for are already visible on its VLAN.
+func (stats *queryStats) recordQuery(dns *layers.DNS, vlan uint16, targets []uint16, services *serviceTable, now time.Time) {
+	names := ptrQuestions(dns)
+	if len(names) == 0 {
+		return
+	}
+	cacheable := true
+	for _, name := range names {
+		cacheable = cacheable && services.isVisible(name, "", vlan, now)
+	}
+	if cacheable {
+		queryAnswerStats.Add("cacheable", 1)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	queryAnswerStats.Add("forwarded", 1)
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.expire(now)
+	for _, name := range names {
+		if _, ok := stats.pending[name]; !ok && len(stats.pending) < queryLatencyMaxPending {
+			stats.pending[name] = now
+		}
+	}
+}
+
+// recordAnswer measures the latency of the first reflected answer to the pending queries
+func (stats *queryStats) recordAnswer(dns *layers.DNS, now time.Time) {
+	if dns == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	for _, record := range dns.Answers {
+		name := strings.ToLower(string(record.Name))
+		sent, ok := stats.pending[name]
+		if record.Type != layers.DNSTypePTR || !ok {
+			continue
+		}
+		delete(stats.pending, name)
+		queryAnswerStats.Add(latencyBucket(now.Sub(sent)), 1)
+	}
+}
+
+func (stats *queryStats) expire(now time.Time) {
+	for name, sent := range stats.pending {
+		if now.Sub(sent) > queryLatencyWindow {
+			delete(stats.pending, name)
+		}
+	}
+	for pair, sent := range stats.reflections {
+		if now.Sub(sent) > queryLatencyWindow {
+			delete(stats.reflections, pair)
+		}
+	}
+}
+
+// recordReflection counts, for each service type asked for by a query sent on vlan, its reflection into each
+// of targets, and returns the pairs counted. A query is answered when an answer for its service type comes back
+// from a target within the latency window; the retransmissions of a query still waiting for its answer are not counted.
+func (stats *queryStats) recordReflection(dns *layers.DNS, vlan uint16, targets []uint16, now time.Time) (counted []reflectionPair) {
+	names := ptrQuestions(dns)
+	if len(names) == 0 || len(targets) == 0 {
+		return nil
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.expire(now)
+	for _, name := range names {
+		for _, target := range targets {
+			pair := reflectionPair{Service: name, From: vlan, To: target}
+			if _, ok := stats.reflections[pair]; ok || len(stats.reflections) >= queryLatencyMaxPending {
+				continue
+			}
+			if counter := stats.counter(pair); counter != nil {
+				stats.reflections[pair] = now
+				counter.Add("queries", 1)
+				counted = append(counted, pair)
+			}
+		}
+	}
+	return counted
+}
+
+// recordReflectedAnswer counts the queries answered by an answer sent on vlan and reflected into targets,
+// and returns their pairs
+func (stats *queryStats) recordReflectedAnswer(dns *layers.DNS, vlan uint16, targets []uint16, now time.Time) (answered []reflectionPair) {
+	if dns == nil || len(targets) == 0 {
+		return nil
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.expire(now)
+	for _, record := range dns.Answers {
+		if record.Type != layers.DNSTypePTR {
+			continue
+		}
+		name := strings.ToLower(string(record.Name))
+		for _, target := range targets {
+			pair := reflectionPair{Service: name, From: target, To: vlan}
+			if _, ok := stats.reflections[pair]; !ok {
+				continue
+			}
+			delete(stats.reflections, pair)
+			stats.counters[pair].Add("answered", 1)
+			answered = append(answered, pair)
+		}
+	}
+	return answered
+}
+
+// counter returns the counters of pair on /debug/vars, or nil when too many pairs are counted already
+func (stats *queryStats) counter(pair reflectionPair) *expvar.Map {
+	if counter, ok := stats.counters[pair]; ok {
+		return counter
+	}
+	if len(stats.counters) >= reflectionMaxPairs {
+		queryAnswerStats.Add("untracked_reflections", 1)
+		return nil
+	}
+	counter := new(expvar.Map).Init()
+	counter.Set("queries", new(expvar.Int))
+	counter.Set("answered", new(expvar.Int))
+	counter.Set("answered_ratio", expvar.Func(func() interface{} {
+		return answeredRatio(counter.Get("queries").(*expvar.Int).Value(), counter.Get("answered").(*expvar.Int).Value())
+	}))
+	stats.counters[pair] = counter
+	reflectionEffectiveness.Set(pair.String(), counter)
+	return counter
+}
+
+// answeredRatio returns the share of the queries answered, or 0 before any query
+func answeredRatio(queries, answered int64) float64 {
+	if queries == 0 {
+		return 0
+	}
+	return float64(answered) / float64(queries)
+}
+
+// latencyBucket returns the name of the histogram bucket of latency, such as "latency_le_100ms"
+func latencyBucket(latency time.Duration) string {
+	ms := int64(latency / time.Millisecond)
+	for _, bound := range answerLatencyBuckets {
+		if ms <= bound {
+			return fmt.Sprintf("latency_le_%vms", bound)
+		}
+	}
+	return "latency_gt_5000ms"
+}
+
+func ptrQuestions(dns *layers.DNS) (names []string) {
+	if dns == nil {
+		return
+	}
+	for _, question := range dns.Questions {
+		if question.Type == layers.DNSTypePTR {
+			names = append(names, strings.ToLower(string(question.Name)))
+		}
+	}
+	return
+}
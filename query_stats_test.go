@@ -0,0 +1,107 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func queryAnswerCount(key string) int64 {
+	if counter, ok := queryAnswerStats.Get(key).(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+func TestQueryStats(t *testing.T) {
+	now := time.Now()
+	services := newServiceTable()
+	services.observe(&layers.DNS{Answers: []layers.DNSResourceRecord{
+		{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, TTL: 120, PTR: []byte("Printer._ipp._tcp.local")},
+	}}, nil, []uint16{10, 20}, now)
+	query := func(name string) *layers.DNS {
+		return &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypePTR}}}
+	}
+	stats := newQueryStats()
+	cacheable, forwarded := queryAnswerCount("cacheable"), queryAnswerCount("forwarded")
+
+	stats.recordQuery(query("_IPP._tcp.local"), 20, []uint16{10}, services, now)
+	stats.recordQuery(query("_airplay._tcp.local"), 20, nil, services, now)
+	stats.recordQuery(query("_airplay._tcp.local"), 30, []uint16{10}, services, now)
+	if queryAnswerCount("cacheable")-cacheable != 1 || queryAnswerCount("forwarded")-forwarded != 2 {
+		t.Errorf("Error in recordQuery(): expected 1 cacheable and 2 forwarded queries, got %v and %v",
+			queryAnswerCount("cacheable")-cacheable, queryAnswerCount("forwarded")-forwarded)
+	}
+
+	fast, slow := queryAnswerCount("latency_le_100ms"), queryAnswerCount("latency_gt_5000ms")
+	answer := &layers.DNS{Answers: []layers.DNSResourceRecord{
+		{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, PTR: []byte("Printer._ipp._tcp.local")},
+	}}
+	stats.recordAnswer(answer, now.Add(80*time.Millisecond))
+	// Only the first answer is measured
+	stats.recordAnswer(answer, now.Add(90*time.Millisecond))
+	if queryAnswerCount("latency_le_100ms")-fast != 1 {
+		t.Errorf("Error in recordAnswer(): expected one answer within 100ms, got %v", queryAnswerCount("latency_le_100ms")-fast)
+	}
+	// Pending queries expire after the latency window
+	stats.recordQuery(query("_ipp._tcp.local"), 30, []uint16{10}, services, now.Add(10*time.Second))
+	if _, ok := stats.pending["_airplay._tcp.local"]; ok {
+		t.Error("Error in recordQuery(): expected expired queries to be forgotten")
+	}
+	if queryAnswerCount("latency_gt_5000ms") != slow {
+		t.Error("Error in recordAnswer(): expected no latency measured for expired queries")
+	}
+}
+
+func TestReflectionEffectiveness(t *testing.T) {
+	now := time.Now()
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_Spotify-Connect._tcp.local"), Type: layers.DNSTypePTR}}}
+	answer := &layers.DNS{Answers: []layers.DNSResourceRecord{
+		{Name: []byte("_spotify-connect._tcp.local"), Type: layers.DNSTypePTR, PTR: []byte("Speaker._spotify-connect._tcp.local")},
+	}}
+	stats := newQueryStats()
+
+	counted := stats.recordReflection(query, 20, []uint16{10, 30}, now)
+	// Retransmissions waiting for their answer are counted once
+	stats.recordReflection(query, 20, []uint16{10}, now.Add(time.Second))
+	if len(counted) != 2 || counted[0] != (reflectionPair{"_spotify-connect._tcp.local", 20, 10}) {
+		t.Errorf("Error in recordReflection(): unexpected pairs %v", counted)
+	}
+	// Answers not reflected into the VLAN of the query do not answer it
+	if answered := stats.recordReflectedAnswer(answer, 10, []uint16{40}, now.Add(time.Second)); len(answered) != 0 {
+		t.Errorf("Error in recordReflectedAnswer(): unexpected pairs %v", answered)
+	}
+	answered := stats.recordReflectedAnswer(answer, 10, []uint16{20, 40}, now.Add(2*time.Second))
+	if len(answered) != 1 || answered[0] != counted[0] {
+		t.Errorf("Error in recordReflectedAnswer(): expected %v to be answered, got %v", counted[0], answered)
+	}
+	// The query reflected into VLAN 30 is not answered within the window
+	if answered := stats.recordReflectedAnswer(answer, 30, []uint16{20}, now.Add(10*time.Second)); len(answered) != 0 {
+		t.Errorf("Error in recordReflectedAnswer(): expected late answers to be ignored, got %v", answered)
+	}
+
+	counters, ok := reflectionEffectiveness.Get("_spotify-connect._tcp.local 20->10").(*expvar.Map)
+	if !ok || counters.Get("queries").String() != "1" || counters.Get("answered").String() != "1" || counters.Get("answered_ratio").String() != "1" {
+		t.Errorf("Error in recordReflectedAnswer(): unexpected counters %v", counters)
+	}
+	if counters := stats.counters[reflectionPair{"_spotify-connect._tcp.local", 20, 30}]; counters.Get("answered_ratio").String() != "0" {
+		t.Errorf("Error in recordReflectedAnswer(): unexpected counters %v", counters)
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                      "latency_le_10ms",
+		10 * time.Millisecond:  "latency_le_10ms",
+		11 * time.Millisecond:  "latency_le_50ms",
+		999 * time.Millisecond: "latency_le_1000ms",
+		6 * time.Second:        "latency_gt_5000ms",
+	}
+	for latency, expected := range tests {
+		if bucket := latencyBucket(latency); bucket != expected {
+			t.Errorf("Error in latencyBucket(%v): expected %v, got %v", latency, expected, bucket)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Workarounds the quirks apply to the answers of the devices they match
+const (
+	// The cache-flush bit of the records is cleared
+	quirkClearCacheFlush = "clear_cache_flush"
+	// The first answer after a silence is sent again, as devices waking up may only announce their services once
+	quirkReplayAfterWake = "replay_after_wake"
+)
+
+const (
+	// Silence of a device after which its next answer is taken for a wake-up
+	quirkWakeGap = 2 * time.Minute
+	// Maximal number of devices the quirks are remembered for
+	quirkMaxDevices = 4096
+)
+
+// Delays after which the answers of the devices waking up are sent again, the way hosts repeat their announcements
+// (RFC 6762, section 8.3)
+var quirkReplayDelays = []time.Duration{time.Second, 3 * time.Second}
+
+// Answers modified or replayed by each quirk, exposed on /debug/vars
+var quirkStats = expvar.NewMap("quirks")
+
+// quirk is a known workaround for the devices of some vendors or models. A device matches when its MAC address
+// starts with one of the OUIs, or when one of its TXT strings starts with one of the fingerprints, such as
+// "manufacturer=samsung", both compared in lowercase.
+type quirk struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Action       string   `json:"action"`
+	OUIs         []string `json:"ouis,omitempty"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// knownQuirks gathers the workarounds reported for devices misbehaving across VLANs. They apply unless disabled
+// in the quirks section.
+var knownQuirks = []quirk{
+	{
+		Name:        "sonos-wake-replay",
+		Description: "Sonos speakers announce their services once when they wake up, an announcement the controllers of other VLANs often miss",
+		Action:      quirkReplayAfterWake,
+		OUIs:        []string{"00:0e:58", "48:a6:b8", "5c:aa:fd", "78:28:ca", "94:9f:3e", "b8:e9:37"},
+	},
+	{
+		Name:         "samsung-tv-cache-flush",
+		Description:  "Samsung TVs set the cache-flush bit on records also announced on their other interfaces, which clients then flush",
+		Action:       quirkClearCacheFlush,
+		Fingerprints: []string{"manufacturer=samsung"},
+	},
+	{
+		Name:         "lg-tv-cache-flush",
+		Description:  "LG TVs set the cache-flush bit on records also announced on their other interfaces, which clients then flush",
+		Action:       quirkClearCacheFlush,
+		Fingerprints: []string{"manufacturer=lg"},
+	},
+}
+
+type quirksConfig struct {
+	Disabled []string `toml:"disabled"`
+}
+
+func (cfg *quirksConfig) validate() error {
+	for _, name := range cfg.Disabled {
+		if findQuirk(name) == nil {
+			return fmt.Errorf("unknown quirk %q in quirks section", name)
+		}
+	}
+	return nil
+}
+
+func findQuirk(name string) *quirk {
+	for i := range knownQuirks {
+		if knownQuirks[i].Name == name {
+			return &knownQuirks[i]
+		}
+	}
+	return nil
+}
+
+// quirkDevice holds the quirks matched by a device, and the time of its last answer
+type quirkDevice struct {
+	quirks     []*quirk
+	lastAnswer time.Time
+}
+
+// quirkEngine applies the enabled quirks to the answers of the devices they match
+type quirkEngine struct {
+	mutex    sync.Mutex
+	quirks   []*quirk
+	disabled map[string]bool
+	devices  map[macAddress]*quirkDevice
+}
+
+func newQuirkEngine(cfg quirksConfig) *quirkEngine {
+	engine := &quirkEngine{disabled: make(map[string]bool), devices: make(map[macAddress]*quirkDevice)}
+	for _, name := range cfg.Disabled {
+		engine.disabled[name] = true
+	}
+	for i := range knownQuirks {
+		if !engine.disabled[knownQuirks[i].Name] {
+			engine.quirks = append(engine.quirks, &knownQuirks[i])
+		}
+	}
+	return engine
+}
+
+// matches tells whether the device with the address mac, sending dns, matches q
+func (q *quirk) matches(mac net.HardwareAddr, dns *layers.DNS) bool {
+	address := strings.ToLower(mac.String())
+	for _, oui := range q.OUIs {
+		if strings.HasPrefix(address, oui) {
+			return true
+		}
+	}
+	if len(q.Fingerprints) == 0 || dns == nil {
+		return false
+	}
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Additionals} {
+		for _, record := range records {
+			for _, txt := range record.TXTs {
+				for _, fingerprint := range q.Fingerprints {
+					if strings.HasPrefix(strings.ToLower(string(txt)), fingerprint) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// device returns the device sending bonjourPacket along with the quirks it matches, remembering the quirks matched
+// by its fingerprints, which only some of its answers carry. It returns nil when the device matches no quirk.
+func (engine *quirkEngine) device(bonjourPacket *bonjourPacket) *quirkDevice {
+	mac := macAddress(bonjourPacket.srcMAC.String())
+	device, known := engine.devices[mac]
+	if !known {
+		device = &quirkDevice{}
+	}
+	for _, q := range engine.quirks {
+		if !device.has(q) && q.matches(*bonjourPacket.srcMAC, bonjourPacket.dns) {
+			device.quirks = append(device.quirks, q)
+		}
+	}
+	if !known && len(device.quirks) > 0 && len(engine.devices) < quirkMaxDevices {
+		engine.devices[mac] = device
+	}
+	if len(device.quirks) == 0 {
+		return nil
+	}
+	return device
+}
+
+func (device *quirkDevice) has(q *quirk) bool {
+	for _, matched := range device.quirks {
+		if matched == q {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies the quirks of the device sending the answer bonjourPacket, and tells whether its records were modified
+func (engine *quirkEngine) apply(bonjourPacket *bonjourPacket, now time.Time) (rewritten bool) {
+	if engine == nil || len(engine.quirks) == 0 || bonjourPacket.dns == nil {
+		return false
+	}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	device := engine.device(bonjourPacket)
+	if device == nil {
+		return false
+	}
+	woke := device.lastAnswer.IsZero() || now.Sub(device.lastAnswer) > quirkWakeGap
+	device.lastAnswer = now
+	for _, q := range device.quirks {
+		switch q.Action {
+		case quirkClearCacheFlush:
+			if clearCacheFlushBits(bonjourPacket.dns) > 0 {
+				rewritten = true
+				quirkStats.Add(q.Name, 1)
+			}
+		case quirkReplayAfterWake:
+			if woke {
+				bonjourPacket.replay = true
+				quirkStats.Add(q.Name, 1)
+			}
+		}
+	}
+	return rewritten
+}
+
+// replay writes again the frame of an answer sent by a device waking up
+func (r *reflector) replay(data []byte) {
+	for _, delay := range quirkReplayDelays {
+		r.after(delay, func() { r.write(data) })
+	}
+}
+
+// quirkStatus is a known quirk, whether it is enabled, and the devices it applied to
+type quirkStatus struct {
+	quirk
+	Enabled bool         `json:"enabled"`
+	Devices []macAddress `json:"devices,omitempty"`
+}
+
+// report returns the known quirks along with the devices they matched
+func (engine *quirkEngine) report() []quirkStatus {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	statuses := make([]quirkStatus, len(knownQuirks))
+	for i := range knownQuirks {
+		statuses[i] = quirkStatus{quirk: knownQuirks[i], Enabled: !engine.disabled[knownQuirks[i].Name]}
+		for mac, device := range engine.devices {
+			if device.has(&knownQuirks[i]) {
+				statuses[i].Devices = append(statuses[i].Devices, mac)
+			}
+		}
+		sort.Slice(statuses[i].Devices, func(a, b int) bool { return statuses[i].Devices[a] < statuses[i].Devices[b] })
+	}
+	return statuses
+}
+
+// ServeHTTP lists the known quirks on /debug/quirks
+func (engine *quirkEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(engine.report())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestQuirksConfig(t *testing.T) {
+	if _, err := parseConfig("[quirks]\ndisabled = [\"sonos-wake-replay\"]"); err != nil {
+		t.Errorf("Error in parseConfig(): unexpected error %v", err)
+	}
+	if _, err := parseConfig("[quirks]\ndisabled = [\"printer-fix\"]"); err == nil || !strings.Contains(err.Error(), "unknown quirk") {
+		t.Errorf("Error in parseConfig(): expected an unknown quirk to be refused, got %v", err)
+	}
+	names := make(map[string]bool)
+	for _, q := range knownQuirks {
+		if names[q.Name] || (q.Action != quirkClearCacheFlush && q.Action != quirkReplayAfterWake) || len(q.OUIs)+len(q.Fingerprints) == 0 {
+			t.Errorf("Error in knownQuirks: invalid quirk %+v", q)
+		}
+		names[q.Name] = true
+	}
+}
+
+func TestQuirkCacheFlush(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	answer := func(txt string) *bonjourPacket {
+		dns := &layers.DNS{QR: true, Answers: []layers.DNSResourceRecord{
+			{Name: []byte("TV._airplay._tcp.local"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN | cacheFlushBit, TXTs: [][]byte{[]byte(txt)}},
+		}}
+		return &bonjourPacket{srcMAC: &mac, dns: dns}
+	}
+
+	engine := newQuirkEngine(quirksConfig{})
+	if engine.apply(answer("manufacturer=Sony"), time.Now()) {
+		t.Error("Error in apply(): the records of other devices should be kept")
+	}
+	// The device is recognized by its fingerprint, then remembered for its answers without TXT strings
+	for _, txt := range []string{"manufacturer=Samsung", "deviceid=02:00:00:00:00:01"} {
+		packet := answer(txt)
+		if !engine.apply(packet, time.Now()) || packet.dns.Answers[0].Class != layers.DNSClassIN {
+			t.Errorf("Error in apply(): expected the cache-flush bit to be cleared after %q, got class %v", txt, packet.dns.Answers[0].Class)
+		}
+	}
+	statuses := engine.report()
+	for _, status := range statuses {
+		if status.Name == "samsung-tv-cache-flush" && (len(status.Devices) != 1 || status.Devices[0] != "02:00:00:00:00:01") {
+			t.Errorf("Error in report(): unexpected devices %v", status.Devices)
+		}
+	}
+
+	engine = newQuirkEngine(quirksConfig{Disabled: []string{"samsung-tv-cache-flush"}})
+	if engine.apply(answer("manufacturer=Samsung"), time.Now()) {
+		t.Error("Error in apply(): a disabled quirk should not apply")
+	}
+}
+
+func TestQuirkReplayAfterWake(t *testing.T) {
+	delays := quirkReplayDelays
+	quirkReplayDelays = []time.Duration{10 * time.Millisecond}
+	defer func() { quirkReplayDelays = delays }()
+
+	speaker := net.HardwareAddr{0x00, 0x0e, 0x58, 0x01, 0x02, 0x03}
+	cfg, err := parseConfig(fmt.Sprintf(`reflection_jitter = "0s"
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42]`, speaker, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer := createMockReflector(cfg)
+	announce := func() {
+		packet := createMockBonjourPacket(false)
+		srcMAC := append(net.HardwareAddr{}, speaker...)
+		packet.srcMAC = &srcMAC
+		r.processBonjourPacket(packet)
+		r.flush(time.Second)
+	}
+
+	// The first answer of the speaker is sent again
+	announce()
+	if len(writer.frames) != 2 {
+		t.Fatalf("Error in processBonjourPacket(): expected the answer of the waking speaker to be replayed, got %v frames", len(writer.frames))
+	}
+	// The next ones are not, until the speaker stays silent long enough to have slept
+	announce()
+	if len(writer.frames) != 3 {
+		t.Errorf("Error in processBonjourPacket(): expected the answer of an awake speaker not to be replayed, got %v frames", len(writer.frames))
+	}
+	r.quirks.devices[macAddress(speaker.String())].lastAnswer = time.Now().Add(-quirkWakeGap - time.Second)
+	announce()
+	if len(writer.frames) != 5 {
+		t.Errorf("Error in processBonjourPacket(): expected the answer after a silence to be replayed, got %v frames", len(writer.frames))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"runtime/debug"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Number of packets whose processing panicked, exposed on /debug/vars
+var recoveredPanics = expvar.NewInt("recovered_panics")
+
+// panicRecovery keeps a single malformed frame from taking down reflection for the whole network.
+// Offending packets are dumped to a capture file, to be analyzed later on.
+type panicRecovery struct {
+	enabled bool
+	mutex   sync.Mutex
+	writer  *pcapgo.Writer
+}
+
+func newPanicRecovery(enabled bool, capturePath string) (*panicRecovery, error) {
+	recovery := &panicRecovery{enabled: enabled}
+	if !enabled || capturePath == "" {
+		return recovery, nil
+	}
+	file, err := os.OpenFile(capturePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	recovery.writer = pcapgo.NewWriter(file)
+	// Only write the file header when creating a new capture, so that packets of several runs end up in the same file
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		if err := recovery.writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			return nil, err
+		}
+	}
+	return recovery, nil
+}
+
+// run calls process, and recovers from any panic it raises unless recovery is disabled
+func (recovery *panicRecovery) run(packet gopacket.Packet, process func()) {
+	if recovery == nil || !recovery.enabled {
+		process()
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			recoveredPanics.Add(1)
+			logger.errorf("Recovered from panic while processing a packet: %v\n%s", err, debug.Stack())
+			recovery.dump(packet)
+		}
+	}()
+	process()
+}
+
+func (recovery *panicRecovery) dump(packet gopacket.Packet) {
+	if recovery.writer == nil || packet == nil {
+		return
+	}
+	recovery.mutex.Lock()
+	defer recovery.mutex.Unlock()
+
+	data := packet.Data()
+	ci := packet.Metadata().CaptureInfo
+	ci.CaptureLength = len(data)
+	if ci.Length < ci.CaptureLength {
+		ci.Length = ci.CaptureLength
+	}
+	if err := recovery.writer.WritePacket(ci, data); err != nil {
+		logger.errorf("Could not write packet to panic capture file: %v", err)
+	}
+}
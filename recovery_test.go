@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPanicRecoveryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "panics.pcap")
+
+	recovery, err := newPanicRecovery(true, path)
+	if err != nil {
+		t.Fatalf("Error in newPanicRecovery(): %v", err)
+	}
+
+	data := createMockmDNSPacket(true, true)
+	packet := gopacket.NewPacket(data, gopacket.DecodersByLayerName["Ethernet"], gopacket.DecodeOptions{Lazy: true})
+	panicsBefore := recoveredPanics.Value()
+	recovery.run(packet, func() { panic("malformed frame") })
+
+	if recoveredPanics.Value() != panicsBefore+1 {
+		t.Error("Error in run(): recovered panics should be counted")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatalf("Error in run(): invalid panic capture file: %v", err)
+	}
+	dumped, _, err := reader.ReadPacketData()
+	if err != nil || string(dumped) != string(data) {
+		t.Error("Error in run(): offending packet was not dumped")
+	}
+}
+
+func TestPanicRecoveryDisabled(t *testing.T) {
+	recovery, _ := newPanicRecovery(false, "")
+	defer func() {
+		if recover() == nil {
+			t.Error("Error in run(): panics should not be recovered when recovery is disabled")
+		}
+	}()
+	recovery.run(nil, func() { panic("malformed frame") })
+}
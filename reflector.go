@@ -0,0 +1,472 @@
+package main
+
+import (
+	"expvar"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of reflections suppressed during the warm-up phase, exposed on /debug/vars
+var warmUpSuppressed = expvar.NewInt("warm_up_suppressed")
+
+// Frames which could not be injected, exposed on /debug/vars
+var injectionErrors = expvar.NewInt("injection_errors")
+
+// reflector holds the state needed to forward Bonjour packets across VLANs
+type reflector struct {
+	cfg brconfig
+	// configMutex guards the configuration, the pools and the solicitations replaced by reloads and approvals.
+	// They are only written by the packet loop, which reads them without locking, while the API reads them locked.
+	configMutex         sync.RWMutex
+	handle              packetWriter
+	writeMutex          sync.Mutex
+	brMACAddress        net.HardwareAddr
+	poolsMap            map[uint16]([]uint16)
+	querierRestrictions map[poolPair]map[macAddress]bool
+	solicitations       *solicitationTracker
+	inventory           *inventory
+	unknownDevices      *unknownDevices
+	ruleHits            *ruleHits
+	unicastTable        *unicastTable
+	relaySources        *relaySources
+	services            *serviceTable
+	unicastConverter    *unicastConverter
+	ttlFloors           ttlFloors
+	ttlCeilings         ttlCeilings
+	quirks              *quirkEngine
+	policy              policy
+	drained             *drainedVLANs
+	peers               *peerTracker
+	reverseLookups      *reverseLookups
+	queryStats          *queryStats
+	bandwidth           *bandwidthAccounting
+	budget              *injectionBudget
+	prefixes            *prefixLearner
+	sourceLimiter       *sourceRateLimiter
+	loops               *loopGuard
+	wireless            *wirelessPacer
+	proxy               *answerCache
+	knownAnswers        *knownAnswers
+	serviceUsage        *serviceUsage
+	addressValidator    *addressValidator
+	compliance          *complianceGuard
+	guests              *guestQueries
+	hooks               *hookRunner
+	pipelines           *reflectionPipelines
+	reloader            *configReloader
+	vendors             vendorTable
+	deviceUpdates       *deviceUpdates
+	tracer              *packetTracer
+	stats               *statsRecorder
+	warmUpUntil         time.Time
+	// closed is set once the handles are closed on shutdown, guarded by writeMutex
+	closed bool
+	// delayedWrites counts the frames waiting for a timer to be written
+	delayedWrites int32
+}
+
+func newReflector(cfg brconfig, inv *inventory, hits *ruleHits, handle packetWriter, brMACAddress net.HardwareAddr) *reflector {
+	unicastTable := newUnicastTable(cfg.UnicastTimeout.Duration, cfg.UnicastTableSize)
+	unicastTable.ignoreQU = !cfg.conformance.unicastResponses
+	solicitations := newSolicitationTracker(cfg.Devices, cfg.SolicitationWindow.Duration)
+	solicitations.subscriptionWindow = cfg.SubscriptionWindow.Duration
+	prefixes := newPrefixLearner(cfg.LearnPrefixes)
+	return &reflector{
+		cfg:                 cfg,
+		handle:              handle,
+		brMACAddress:        brMACAddress,
+		poolsMap:            mapByPool(cfg.Devices),
+		querierRestrictions: mapQuerierRestrictions(cfg.Devices),
+		solicitations:       solicitations,
+		inventory:           inv,
+		ruleHits:            hits,
+		unicastTable:        unicastTable,
+		relaySources:        newRelaySources(cfg.UnicastTimeout.Duration, cfg.UnicastTableSize),
+		services:            newServiceTable(),
+		unicastConverter:    newUnicastConverter(cfg.MulticastToUnicast),
+		ttlFloors:           newTTLFloors(cfg.TTLFloors),
+		ttlCeilings:         newTTLCeilings(cfg.MaxTTL, cfg.TTLCeilings),
+		quirks:              newQuirkEngine(cfg.Quirks),
+		drained:             newDrainedVLANs(),
+		reverseLookups:      newReverseLookups(&cfg),
+		queryStats:          newQueryStats(),
+		bandwidth:           newBandwidthAccounting(),
+		budget:              newInjectionBudget(cfg.InjectionBudget),
+		sourceLimiter:       newSourceRateLimiter(cfg.SourceRateLimit),
+		loops:               newLoopGuard(cfg.LoopCacheSize, cfg.LoopWindow.Duration),
+		wireless:            newWirelessPacer(cfg.Wireless, cfg.vlans),
+		proxy:               newAnswerCache(cfg.Proxy),
+		knownAnswers:        newKnownAnswers(cfg.KnownAnswers),
+		serviceUsage:        newServiceUsage(time.Now()),
+		prefixes:            prefixes,
+		addressValidator:    newAddressValidator(prefixes),
+		compliance:          newComplianceGuard(),
+		guests:              newGuestQueries(cfg.SolicitationWindow.Duration),
+		deviceUpdates:       newDeviceUpdates(),
+		unknownDevices:      newUnknownDevices(maxUnknownDevices),
+		tracer:              &packetTracer{},
+		// During the warm-up phase, traffic is observed but not reflected
+		warmUpUntil: time.Now().Add(cfg.WarmUp.Duration),
+	}
+}
+
+// processBonjourPacket forwards the mDNS query or response to appropriate VLANs
+func (r *reflector) processBonjourPacket(bonjourPacket bonjourPacket) {
+	r.applyConfigReload()
+	r.applyDeviceUpdates()
+	r.stats.seen(macAddress(bonjourPacket.srcMAC.String()), time.Now())
+	defer r.stats.processed()
+	if bonjourPacket.vlanTag == nil || r.loops.isLoop(&bonjourPacket, time.Now()) || !r.sourceLimiter.allow(macAddress(bonjourPacket.srcMAC.String()), time.Now()) {
+		return
+	}
+	if bonjourPacket.passthrough {
+		r.sendPassthrough(&bonjourPacket)
+		return
+	}
+	if bonjourPacket.ssdp != nil {
+		r.sendSSDP(&bonjourPacket)
+		return
+	}
+	if bonjourPacket.wsd != nil {
+		r.sendWSD(&bonjourPacket)
+		return
+	}
+	if bonjourPacket.natpmp != nil {
+		r.sendNATPMP(&bonjourPacket)
+		return
+	}
+	if bonjourPacket.legacyResponse {
+		r.relayLegacyResponse(&bonjourPacket)
+		return
+	}
+	if bonjourPacket.quResponse {
+		r.relayQUResponse(&bonjourPacket)
+		return
+	}
+	if !r.cfg.conformance.accepts(&bonjourPacket) || !r.cfg.acceptsQuery(&bonjourPacket) {
+		return
+	}
+	if bonjourPacket.isDNSQuery {
+		r.processQuery(&bonjourPacket)
+	} else {
+		r.processAnswer(&bonjourPacket)
+	}
+}
+
+// processQuery reflects an mDNS query to the VLANs it may reach, unless answered by the proxy
+func (r *reflector) processQuery(bonjourPacket *bonjourPacket) {
+	tags := r.applyPolicy(bonjourPacket, r.queryTargets(bonjourPacket))
+	tags = r.compliance.filter(&r.cfg, bonjourPacket, tags)
+	tags = r.guests.filterQuery(&r.cfg, *bonjourPacket.vlanTag, bonjourPacket.dns, tags, time.Now())
+	r.recordUnicastQuery(bonjourPacket, tags)
+	if r.knownAnswers.recordQuery(bonjourPacket.dns, *bonjourPacket.vlanTag, time.Now()) {
+		bonjourPacket.dnsRewritten = true
+	}
+	r.logReflection(bonjourPacket, tags)
+	r.queryStats.recordQuery(bonjourPacket.dns, *bonjourPacket.vlanTag, tags, r.services, time.Now())
+	r.serviceUsage.recordQuery(bonjourPacket.dns, *bonjourPacket.vlanTag, time.Now())
+	if r.proxyQuery(bonjourPacket, tags) {
+		return
+	}
+	r.stats.queried(r.queryStats.recordReflection(bonjourPacket.dns, *bonjourPacket.vlanTag, tags, time.Now()))
+	r.reflect(bonjourPacket, tags)
+}
+
+// processAnswer reflects an mDNS answer to the VLANs it may reach, and learns its services
+func (r *reflector) processAnswer(bonjourPacket *bonjourPacket) {
+	r.peers.observe(bonjourPacket, time.Now())
+	tags := r.applyPolicy(bonjourPacket, r.answerTargets(bonjourPacket))
+	tags = r.compliance.filter(&r.cfg, bonjourPacket, tags)
+	tags = r.guests.filterAnswer(&r.cfg, *bonjourPacket.vlanTag, bonjourPacket.dns, tags, time.Now())
+	tags = r.addressValidator.validate(&r.cfg, bonjourPacket, tags)
+	tags = r.knownAnswers.filterAnswer(bonjourPacket.dns, tags, time.Now())
+	r.logReflection(bonjourPacket, tags)
+	r.observeServices(bonjourPacket, tags)
+	r.serviceUsage.recordAnswer(bonjourPacket.dns, macAddress(bonjourPacket.srcMAC.String()), tags, len(bonjourPacket.packet.Data()))
+	if len(tags) > 0 {
+		r.queryStats.recordAnswer(bonjourPacket.dns, time.Now())
+		r.stats.answered(r.queryStats.recordReflectedAnswer(bonjourPacket.dns, *bonjourPacket.vlanTag, tags, time.Now()))
+		floored := r.ttlFloors.apply(bonjourPacket.dns)
+		capped := r.ttlCeilings.apply(bonjourPacket.dns)
+		quirked := r.quirks.apply(bonjourPacket, time.Now())
+		if r.cfg.conformance.rewrite(bonjourPacket.dns) || floored || capped || quirked {
+			bonjourPacket.dnsRewritten = true
+		}
+	}
+	r.proxy.store(bonjourPacket.dns, bonjourPacket.srcIP, *bonjourPacket.vlanTag, tags, time.Now())
+	r.reflect(bonjourPacket, tags)
+}
+
+// recordUnicastQuery remembers the questions of a query reflected to tags which expect a unicast response,
+// so that the responses from those VLANs are relayed back to the querier
+func (r *reflector) recordUnicastQuery(bonjourPacket *bonjourPacket, tags []uint16) {
+	querier, srcVLAN := macAddress(bonjourPacket.srcMAC.String()), *bonjourPacket.vlanTag
+	names := r.unicastTable.recordQuery(bonjourPacket, tags, time.Now())
+	if r.cfg.UnicastRelay.Source == relaySourceAuto && r.relaySources.retried(relaySourceKey{querier, srcVLAN}, names, time.Now()) {
+		logger.infof("%v on VLAN %v asked again for a relayed unicast response, switching the source of its responses", querier, srcVLAN)
+	}
+}
+
+// queryTargets returns the VLANs a query should be reflected to
+func (r *reflector) queryTargets(bonjourPacket *bonjourPacket) []uint16 {
+	srcVLAN := *bonjourPacket.vlanTag
+	if tags, ok := r.reverseLookups.queryTargets(bonjourPacket, time.Now()); ok {
+		return tags
+	}
+	tags, ok := r.poolsMap[srcVLAN]
+	if !ok {
+		return nil
+	}
+	querier := macAddress(bonjourPacket.srcMAC.String())
+	r.solicitations.record(querier, srcVLAN, time.Now())
+	r.solicitations.subscribe(querier, srcVLAN, bonjourPacket.dns, time.Now())
+	r.unicastConverter.recordQuery(bonjourPacket, time.Now())
+	var allowedTags []uint16
+	for _, tag := range tags {
+		if isQueryAllowed(r.querierRestrictions, poolPair{from: srcVLAN, to: tag}, querier) {
+			allowedTags = append(allowedTags, tag)
+		}
+	}
+	return allowedTags
+}
+
+// answerTargets returns the VLANs an answer should be reflected to. Answers to reverse lookups only reach
+// the VLANs which asked for them, among the VLANs the answering device is shared with.
+func (r *reflector) answerTargets(bonjourPacket *bonjourPacket) []uint16 {
+	reverseTags, reverse := r.reverseLookups.answerTargets(bonjourPacket, time.Now())
+	tags := r.deviceTargets(bonjourPacket)
+	if reverse {
+		return intersectVLANs(tags, reverseTags)
+	}
+	return tags
+}
+
+// deviceTargets returns the VLANs the device sending an answer is shared with
+func (r *reflector) deviceTargets(bonjourPacket *bonjourPacket) []uint16 {
+	entry, device, ok := r.cfg.device(macAddress(bonjourPacket.srcMAC.String()))
+	if !ok {
+		return r.handleUnknownDevice(bonjourPacket)
+	}
+	r.ruleHits.record(entry, time.Now())
+	// The records of the services the device may not advertise are removed before the answer is reflected anywhere
+	if !filterAllowedServices(bonjourPacket, &device) {
+		return nil
+	}
+	// Devices restricted to some queriers only answer the VLANs those queriers recently asked from,
+	// or subscribed from to the service types of the answer
+	if len(device.AllowedQueriers) > 0 {
+		pools := r.solicitations.solicitedPools(device, time.Now())
+		return r.solicitations.addSubscribedPools(pools, device, bonjourPacket.dns, time.Now())
+	}
+	return device.SharedPools
+}
+
+// logReflection logs at debug level the services of bonjourPacket and the VLANs it is reflected to,
+// so that one can tell why a service does not cross VLANs. Traced packets are logged with their decoded layers
+// whatever the logging level, and the reflections of a dry run at info level.
+func (r *reflector) logReflection(bonjourPacket *bonjourPacket, tags []uint16) {
+	traced := r.tracer.traces(bonjourPacket, time.Now())
+	if !traced && !r.cfg.dryRun && !logger.enabled(levelDebug) {
+		return
+	}
+	kind, services := "answer", announcedServices(bonjourPacket.dns)
+	if bonjourPacket.isDNSQuery {
+		kind, services = "query", ptrQuestions(bonjourPacket.dns)
+	}
+	r.logDryRun(bonjourPacket, "mDNS "+kind, services, tags)
+	if !traced && !logger.enabled(levelDebug) {
+		return
+	}
+	msg := "Reflecting mDNS " + kind
+	if len(tags) == 0 {
+		msg = "Not reflecting mDNS " + kind
+	}
+	fields := []interface{}{
+		"src_mac", macAddress(bonjourPacket.srcMAC.String()),
+		"src_ip", bonjourPacket.srcIP.String(),
+		"vlan", *bonjourPacket.vlanTag,
+		"services", append([]string{}, services...),
+		"targets", append([]uint16{}, tags...),
+	}
+	if traced {
+		logger.write(levelDebug, msg, append(fields, "packet", bonjourPacket.packet.String())...)
+		return
+	}
+	logger.log(levelDebug, msg, fields...)
+}
+
+// reflect hands bonjourPacket over to the pipeline of its address family, or sends it right away without pipelines
+func (r *reflector) reflect(bonjourPacket *bonjourPacket, tags []uint16) {
+	r.stats.reflected(macAddress(bonjourPacket.srcMAC.String()), len(tags), time.Now())
+	if r.pipelines == nil || len(tags) == 0 {
+		r.send(bonjourPacket, tags)
+		return
+	}
+	r.pipelines.dispatch(bonjourPacket, tags)
+}
+
+// send reflects bonjourPacket on each of the given VLANs.
+// Answers are delayed by a random jitter, so that devices responding simultaneously
+// do not cause synchronized multicast bursts (see RFC 6762, section 6).
+func (r *reflector) send(bonjourPacket *bonjourPacket, tags []uint16) {
+	if len(tags) > 0 && time.Now().Before(r.warmUpUntil) {
+		warmUpSuppressed.Add(1)
+		return
+	}
+	jitter := r.cfg.ReflectionJitter.Duration
+	// Serializing the frames rewrites the source of bonjourPacket
+	source := macAddress(bonjourPacket.srcMAC.String())
+	for _, tag := range tags {
+		if r.peers.yields(tag, time.Now()) {
+			continue
+		}
+		for _, data := range r.framesFor(bonjourPacket, tag) {
+			if !r.budget.allow(protocolMDNS, tag, len(data), time.Now()) {
+				continue
+			}
+			r.account(bonjourPacket, tag, data)
+			r.loops.record(source, tag, data, time.Now())
+			if bonjourPacket.replay {
+				r.replay(data)
+			}
+			if bonjourPacket.isDNSQuery || jitter <= 0 {
+				r.write(data)
+				continue
+			}
+			data := data
+			delay := time.Duration(rand.Int63n(int64(jitter) + 1))
+			r.after(delay, func() { r.write(data) })
+		}
+	}
+}
+
+// account records a frame reflected into the VLAN tag in the bandwidth usage of the source device of bonjourPacket.
+// Frames dropped because the VLAN is drained are not accounted.
+func (r *reflector) account(bonjourPacket *bonjourPacket, tag uint16, data []byte) {
+	if !r.drained.isDrained(tag) {
+		r.bandwidth.record(macAddress(bonjourPacket.srcMAC.String()), tag, len(data), time.Now())
+	}
+}
+
+// framesFor returns the frames reflecting bonjourPacket on the VLAN tag:
+// unicast copies for the recent queriers of converted services, or else a single multicast frame.
+// They are sent from the address of the reflector on tag when the source of bonjourPacket cannot be used there,
+// and their A and AAAA records are translated for the clients of tag.
+func (r *reflector) framesFor(bonjourPacket *bonjourPacket, tag uint16) [][]byte {
+	if srcIP := r.reflectedSource(bonjourPacket, tag); srcIP != nil {
+		defer setSourceIP(bonjourPacket, srcIP)()
+	}
+	defer translateAddresses(bonjourPacket, r.cfg.translations[tag])()
+	if !bonjourPacket.isDNSQuery {
+		if queriers := r.unicastConverter.queriersFor(bonjourPacket.dns, tag, r.wireless.conversionLimit(tag), time.Now()); len(queriers) > 0 {
+			frames := make([][]byte, 0, len(queriers))
+			for _, querier := range queriers {
+				data, err := serializeUnicastBonjourPacket(bonjourPacket, tag, r.brMACAddress, querier.mac, querier.ip)
+				if err != nil {
+					frames = nil
+					break
+				}
+				frames = append(frames, data)
+			}
+			if frames != nil {
+				return frames
+			}
+		}
+	}
+	if data := serializeBonjourPacket(bonjourPacket, tag, r.brMACAddress); data != nil {
+		return [][]byte{data}
+	}
+	return nil
+}
+
+// write injects a frame unless its VLAN is drained, delayed answers being written from timer goroutines.
+// Frames into wireless VLANs are paced, and written from timer goroutines too when delayed.
+func (r *reflector) write(data []byte) {
+	if tag, ok := frameVLAN(data); ok {
+		if r.drained.isDrained(tag) {
+			drainedFrames.Add(1)
+			return
+		}
+		delay, ok := r.wireless.delay(tag, time.Now())
+		if !ok {
+			return
+		}
+		if delay > 0 {
+			r.after(delay, func() { r.inject(data) })
+			return
+		}
+	}
+	r.inject(data)
+}
+
+func (r *reflector) inject(data []byte) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	// Frames generated after shutdown, e.g. by the announcements, are not injected anymore
+	if r.closed {
+		return
+	}
+	if err := r.handle.WritePacketData(data); err != nil {
+		logger.errorf("Could not inject packet: %v", err)
+		injectionErrors.Add(1)
+	}
+}
+
+// observeServices records the services announced by an answer reflected to tags, and fires the hooks of the new ones
+func (r *reflector) observeServices(bonjourPacket *bonjourPacket, tags []uint16) {
+	now := time.Now()
+	discovered := r.services.observe(bonjourPacket.dns, bonjourPacket.srcIP, append([]uint16{*bonjourPacket.vlanTag}, tags...), now)
+	for _, instance := range discovered {
+		r.hooks.fire(eventServiceDiscovered, map[string]interface{}{
+			"Service":  instance.Service,
+			"Instance": instance.Instance,
+			"VLAN":     instance.Origin,
+			"VLANs":    formatVLANList(tags),
+			"IP":       bonjourPacket.srcIP,
+			"MAC":      macAddress(bonjourPacket.srcMAC.String()),
+		}, now)
+	}
+}
+
+// handleUnknownDevice applies the configured policy to a response sent by an unknown device,
+// and returns the VLANs the response should be reflected to
+func (r *reflector) handleUnknownDevice(bonjourPacket *bonjourPacket) []uint16 {
+	srcMAC := macAddress(bonjourPacket.srcMAC.String())
+	mode, defaultPool := r.cfg.unknownDevicePolicy(*bonjourPacket.vlanTag)
+	now := time.Now()
+	var isNew bool
+	var entry inventoryEntry
+	if mode == unknownQuarantine {
+		isNew = r.inventory.record(srcMAC, *bonjourPacket.vlanTag, now)
+		entry = r.inventory.annotate(srcMAC, r.vendors.lookup(*bonjourPacket.srcMAC), announcedServices(bonjourPacket.dns))
+		if isNew {
+			logger.infof("Quarantined unknown device %v (%v) on VLAN %v, announcing %v", srcMAC, entry.Vendor, *bonjourPacket.vlanTag, entry.Services)
+		}
+	} else if isNew = r.unknownDevices.record(srcMAC); isNew {
+		entry = inventoryEntry{Vendor: r.vendors.lookup(*bonjourPacket.srcMAC), Services: announcedServices(bonjourPacket.dns)}
+	}
+	// The hook runs for every unknown device, whatever the mode handling it
+	if isNew {
+		r.hooks.fire(eventDeviceFirstSeen, map[string]interface{}{
+			"MAC":      srcMAC,
+			"VLAN":     *bonjourPacket.vlanTag,
+			"IP":       bonjourPacket.srcIP,
+			"Vendor":   entry.Vendor,
+			"Services": strings.Join(entry.Services, ","),
+		}, now)
+	}
+	switch mode {
+	case unknownLogAndDrop:
+		logger.infof("Dropping mDNS response from unknown device %v on VLAN %v", srcMAC, *bonjourPacket.vlanTag)
+	case unknownReflectToPool:
+		return defaultPool
+	case unknownQuarantine:
+		if err := r.inventory.saveIfNeeded(isNew, now); err != nil {
+			logger.errorf("Could not write inventory file: %v", err)
+		}
+	}
+	return nil
+}
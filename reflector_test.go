@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// mockWriter records the frames injected by the reflector
+type mockWriter struct {
+	mutex  sync.Mutex
+	frames [][]byte
+}
+
+func (writer *mockWriter) WritePacketData(data []byte) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.frames = append(writer.frames, data)
+	return nil
+}
+
+// vlanTags returns the VLAN tags of the injected frames
+func (writer *mockWriter) vlanTags() (tags []uint16) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	for _, frame := range writer.frames {
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		tags = append(tags, *parseVLANTag(packet))
+	}
+	return
+}
+
+func createMockBonjourPacket(isDNSQuery bool) bonjourPacket {
+	packet := gopacket.NewPacket(createMockmDNSPacket(true, isDNSQuery), gopacket.DecodersByLayerName["Ethernet"], gopacket.DecodeOptions{Lazy: true})
+	bonjourPacket, _ := parseBonjourPacket(packet, brMACTest)
+	return bonjourPacket
+}
+
+func createMockReflector(cfg brconfig) (*reflector, *mockWriter) {
+	inv, _ := loadInventory("", defaultInventorySize)
+	hits, _ := loadRuleHits("", cfg.Devices)
+	writer := &mockWriter{}
+	return newReflector(cfg, inv, hits, writer, brMACTest), writer
+}
+
+func TestProcessBonjourPacket(t *testing.T) {
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42, 43}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	tags := writer.vlanTags()
+	if len(tags) != 2 || tags[0] != 42 || tags[1] != 43 {
+		t.Errorf("Error in processBonjourPacket(): answer reflected to %v", tags)
+	}
+}
+
+func TestReflectionJitter(t *testing.T) {
+	cfg := brconfig{
+		ReflectionJitter: duration{20 * time.Millisecond},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42, SharedPools: []uint16{vlanIdentifierTest, 43}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+
+	// Queries are never delayed
+	r.processBonjourPacket(createMockBonjourPacket(true))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Fatalf("Error in processBonjourPacket(): query reflected to %v", tags)
+	}
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	time.Sleep(100 * time.Millisecond)
+	if tags := writer.vlanTags(); len(tags) != 3 {
+		t.Errorf("Error in processBonjourPacket(): delayed answers were not all injected, got %v", tags)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	cfg := brconfig{
+		WarmUp: duration{time.Minute},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): expected no reflection during the warm-up, got %v", tags)
+	}
+	r.warmUpUntil = time.Now()
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != 42 {
+		t.Errorf("Error in processBonjourPacket(): expected the answer to be reflected after the warm-up, got %v", tags)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// relaySourceMode defines the source address of the unicast responses relayed to QU and legacy queriers
+type relaySourceMode string
+
+const (
+	// The address and port of the responder are kept
+	relaySourcePreserve relaySourceMode = "preserve"
+	// The address of the reflector on the VLAN of the querier, and the port 5353, replace them
+	relaySourceReflector relaySourceMode = "reflector"
+	// Each querier starts with the address of the responder, and switches to the other source when it asks again
+	relaySourceAuto relaySourceMode = "auto"
+)
+
+// Unicast responses relayed per source, and fallbacks to the other source, exposed on /debug/vars
+var unicastRelaySources = expvar.NewMap("unicast_relay_sources")
+
+type unicastRelayConfig struct {
+	Source relaySourceMode `toml:"source"`
+}
+
+func (config *unicastRelayConfig) validate() error {
+	switch config.Source {
+	case "":
+		config.Source = relaySourcePreserve
+	case relaySourcePreserve, relaySourceReflector, relaySourceAuto:
+	default:
+		return fmt.Errorf("invalid source %q in unicast_relay, expected %q, %q or %q", config.Source, relaySourcePreserve, relaySourceReflector, relaySourceAuto)
+	}
+	return nil
+}
+
+// relaySourceKey identifies a querier on its VLAN
+type relaySourceKey struct {
+	mac  macAddress
+	vlan uint16
+}
+
+// relaySourceState is the source used for a querier, and the names relayed to it with this source
+type relaySourceState struct {
+	mode    relaySourceMode
+	relayed map[string]time.Time
+	last    time.Time
+}
+
+// relaySources chooses the source of the relayed unicast responses. A querier asking again for a name
+// within window after its response was relayed did not accept it, so that the auto mode switches
+// this querier to the other source.
+type relaySources struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	maxSize int
+	states  map[relaySourceKey]*relaySourceState
+}
+
+func newRelaySources(window time.Duration, maxSize int) *relaySources {
+	return &relaySources{window: window, maxSize: maxSize, states: make(map[relaySourceKey]*relaySourceState)}
+}
+
+// choose returns the source of a response relayed to key, falling back to the address of the responder
+// when the reflector has no address on the VLAN of the querier
+func (sources *relaySources) choose(mode relaySourceMode, key relaySourceKey, hasAddress bool) relaySourceMode {
+	if mode == relaySourceAuto {
+		mode = relaySourcePreserve
+		sources.mutex.Lock()
+		if state, ok := sources.states[key]; ok {
+			mode = state.mode
+		}
+		sources.mutex.Unlock()
+	}
+	if mode == relaySourceReflector && !hasAddress {
+		unicastRelaySources.Add("no_address", 1)
+	}
+	if mode != relaySourceReflector || !hasAddress {
+		mode = relaySourcePreserve
+	}
+	unicastRelaySources.Add(string(mode), 1)
+	return mode
+}
+
+// relayed remembers the names of a response relayed to key with the source mode
+func (sources *relaySources) relayed(key relaySourceKey, names []string, mode relaySourceMode, now time.Time) {
+	sources.mutex.Lock()
+	defer sources.mutex.Unlock()
+	state, ok := sources.states[key]
+	if !ok {
+		if len(sources.states) >= sources.maxSize {
+			sources.evict()
+		}
+		state = &relaySourceState{relayed: make(map[string]time.Time)}
+		sources.states[key] = state
+	}
+	state.mode, state.last = mode, now
+	for name, sent := range state.relayed {
+		if now.Sub(sent) > sources.window {
+			delete(state.relayed, name)
+		}
+	}
+	for _, name := range names {
+		state.relayed[strings.ToLower(name)] = now
+	}
+}
+
+// retried switches key to the other source when it asks again for a name relayed to it within the window,
+// and tells whether it did
+func (sources *relaySources) retried(key relaySourceKey, names []string, now time.Time) bool {
+	sources.mutex.Lock()
+	defer sources.mutex.Unlock()
+	state, ok := sources.states[key]
+	if !ok {
+		return false
+	}
+	for _, name := range names {
+		sent, ok := state.relayed[strings.ToLower(name)]
+		if !ok || now.Sub(sent) > sources.window {
+			continue
+		}
+		if state.mode == relaySourcePreserve {
+			state.mode = relaySourceReflector
+		} else {
+			state.mode = relaySourcePreserve
+		}
+		state.relayed = make(map[string]time.Time)
+		unicastRelaySources.Add("fallbacks", 1)
+		return true
+	}
+	return false
+}
+
+// evict removes the querier relayed to the least recently. It must be called with the mutex held.
+func (sources *relaySources) evict() {
+	var oldestKey relaySourceKey
+	var oldest *relaySourceState
+	for key, state := range sources.states {
+		if oldest == nil || state.last.Before(oldest.last) {
+			oldestKey, oldest = key, state
+		}
+	}
+	delete(sources.states, oldestKey)
+}
+
+// relayAddress returns the address of the reflector on the VLAN tag in the family of bonjourPacket, or nil without any.
+// Without a configured IPv6 address, the address the reflector would autoconfigure in the learned prefix is used.
+func (r *reflector) relayAddress(bonjourPacket *bonjourPacket, tag uint16) net.IP {
+	if !bonjourPacket.isIPv6 {
+		return r.cfg.addresses[tag].ipv4
+	}
+	if ip := r.cfg.addresses[tag].ipv6; ip != nil {
+		return ip
+	}
+	return r.prefixes.sourceAddress(tag, r.brMACAddress, time.Now())
+}
+
+// setRelaySource rewrites the source of a unicast response relayed to querier following the unicast_relay section,
+// until the returned function is called
+func (r *reflector) setRelaySource(bonjourPacket *bonjourPacket, querier *unicastQuerier) (restore func()) {
+	key := relaySourceKey{mac: querier.MAC, vlan: querier.VLAN}
+	srcIP := r.relayAddress(bonjourPacket, querier.VLAN)
+	mode := r.relaySources.choose(r.cfg.UnicastRelay.Source, key, srcIP != nil)
+	if r.cfg.UnicastRelay.Source == relaySourceAuto {
+		r.relaySources.relayed(key, responseNames(bonjourPacket.dns), mode, time.Now())
+	}
+	if mode != relaySourceReflector {
+		return func() {}
+	}
+	restoreIP := setSourceIP(bonjourPacket, srcIP)
+	udp, ok := bonjourPacket.packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return restoreIP
+	}
+	srcPort := udp.SrcPort
+	udp.SrcPort = 5353
+	return func() {
+		udp.SrcPort = srcPort
+		restoreIP()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestUnicastRelayConfig(t *testing.T) {
+	cfg, err := parseConfig("")
+	if err != nil || cfg.UnicastRelay.Source != relaySourcePreserve {
+		t.Errorf("Error in parseConfig(): expected the source of the relayed responses to be preserved by default, got %q (%v)", cfg.UnicastRelay.Source, err)
+	}
+	if _, err := parseConfig("[unicast_relay]\nsource = \"nat\""); err == nil {
+		t.Error("Error in parseConfig(): expected an invalid unicast_relay source to be refused")
+	}
+}
+
+func TestRelaySourceFallback(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`[unicast_relay]
+		source = "auto"
+		[addresses]
+		"%v" = ["192.168.30.1"]
+		[devices.%q]
+		origin_pool = 42
+		shared_pools = [%v]`, vlanIdentifierTest, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, writer := createMockReflector(cfg)
+	question := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN | unicastResponseBit}
+	answer := layers.DNSResourceRecord{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 10,
+		PTR: []byte("Printer._ipp._tcp.local")}
+	querierIP := net.IP{192, 168, 30, 5}
+	relay := func() (net.IP, layers.UDPPort) {
+		r.processBonjourPacket(createMockLegacyPacket(vlanIdentifierTest, querierIP, dstIPv4Test, 5353, 5353,
+			&layers.DNS{Questions: []layers.DNSQuestion{question}}))
+		writer.frames = nil
+		r.processBonjourPacket(createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, querierIP, 5353, 5353,
+			&layers.DNS{QR: true, AA: true, Answers: []layers.DNSResourceRecord{answer}}))
+		if len(writer.frames) != 1 {
+			t.Fatalf("Error in processBonjourPacket(): expected the QU response to be relayed, got %v frames", len(writer.frames))
+		}
+		relayed := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+		return relayed.Layer(layers.LayerTypeIPv4).(*layers.IPv4).SrcIP, relayed.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+	}
+
+	fallbacks := func() int64 {
+		if counter, ok := unicastRelaySources.Get("fallbacks").(*expvar.Int); ok {
+			return counter.Value()
+		}
+		return 0
+	}
+	before := fallbacks()
+	// The first response keeps the address of the responder
+	if srcIP, _ := relay(); !srcIP.Equal(net.IP{192, 168, 42, 7}) {
+		t.Errorf("Error in relayQUResponse(): expected the source of the responder, got %v", srcIP)
+	}
+	// The querier asks again, so the next response comes from the address of the reflector
+	if srcIP, srcPort := relay(); !srcIP.Equal(net.IP{192, 168, 30, 1}) || srcPort != 5353 {
+		t.Errorf("Error in relayQUResponse(): expected the source of the reflector, got %v:%v", srcIP, srcPort)
+	}
+	if fallbacks()-before != 1 {
+		t.Errorf("Error in retried(): expected the fallback to be counted, got %v", unicastRelaySources)
+	}
+
+	// Without an address on the VLAN of the querier, the source of the responder is kept
+	sources := newRelaySources(defaultUnicastTimeout, 2)
+	if mode := sources.choose(relaySourceReflector, relaySourceKey{"02:00:00:00:00:01", 10}, false); mode != relaySourcePreserve {
+		t.Errorf("Error in choose(): expected to fall back to %q, got %q", relaySourcePreserve, mode)
+	}
+}
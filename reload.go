@@ -0,0 +1,157 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// Number of successful configuration reloads, exposed on /debug/vars
+var configReloadCount = expvar.NewInt("config_reloads")
+
+// configReloader re-reads the configuration file on SIGHUP. The devices, the VLAN settings, unknown_device_mode,
+// default_pool and the compliance section are swapped into the reflector between two packets, and the logging level is applied.
+// The other settings need a restart.
+type configReloader struct {
+	mutex   sync.Mutex
+	current brconfig
+	pending *brconfig
+	// filter is the capture filter rebuilt from the reloaded configuration, when the capture supports filters
+	filter *captureFilter
+}
+
+func newConfigReloader(cfg brconfig) *configReloader {
+	return &configReloader{current: cfg}
+}
+
+// config returns the last loaded configuration
+func (reloader *configReloader) config() brconfig {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.current
+}
+
+// reload reads the configuration file again, and queues its reloadable settings for the reflector.
+// An invalid configuration is rejected as a whole, the current one staying in use.
+func (reloader *configReloader) reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if reloader.current.path == "" {
+		return fmt.Errorf("the configuration was not read from a file")
+	}
+	loaded, err := readProfileAs(reloader.current.path, reloader.current.profile, reloader.current.format)
+	if err != nil {
+		return err
+	}
+	// The interfaces cannot change at runtime, and may have been overridden by the environment
+	loaded.NetInterface, loaded.NetInterfaces = reloader.current.NetInterface, reloader.current.NetInterfaces
+	loaded.TrunkInterfaces = reloader.current.TrunkInterfaces
+
+	cfg := reloader.current
+	cfg.Devices, cfg.devicePrefixes = loaded.Devices, loaded.devicePrefixes
+	cfg.VLANs, cfg.vlans = loaded.VLANs, loaded.vlans
+	cfg.UnknownDeviceMode, cfg.DefaultPool = loaded.UnknownDeviceMode, loaded.DefaultPool
+	cfg.EmptyDevicesMode = loaded.EmptyDevicesMode
+	cfg.Compliance, cfg.flows = loaded.Compliance, loaded.flows
+	cfg.Logging.Level = loaded.Logging.Level
+	if !reflect.DeepEqual(cfg, loaded) {
+		logger.warnf("only the devices, the VLANs, unknown_device_mode, default_pool, empty_devices_mode, compliance and the logging level are reloaded, restart to apply the other changes")
+	}
+	if reloader.filter != nil {
+		if err := reloader.filter.update(&cfg); err != nil {
+			return fmt.Errorf("could not update the capture filter: %v", err)
+		}
+	}
+	reloader.current = cfg
+	reloader.pending = &cfg
+	logger.setLevel(cfg.Logging.Level)
+	configReloadCount.Add(1)
+	logger.infof("Configuration reloaded from %v: %d devices", cfg.path, len(cfg.Devices))
+	return nil
+}
+
+// take returns the configuration reloaded since the last call, if any
+func (reloader *configReloader) take() *brconfig {
+	if reloader == nil {
+		return nil
+	}
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	pending := reloader.pending
+	reloader.pending = nil
+	return pending
+}
+
+// watchReloads hands the configurations reloaded on SIGHUP over to reflector,
+// and rebuilds the kernel filter of a pcap or afpacket capture from them
+func watchReloads(reloader *configReloader, capture bpfSetter, reflector *reflector) {
+	if reloader.current.CaptureMode == capturePcap || reloader.current.CaptureMode == captureAFPacket {
+		reloader.filter = &captureFilter{handle: capture, current: buildCaptureFilter(&reloader.current)}
+	}
+	reflector.reloader = reloader
+	go reloader.watch()
+}
+
+// reloadAPI reloads the configuration file on POST /api/reload, like SIGHUP
+type reloadAPI struct {
+	reloader *configReloader
+}
+
+func (api reloadAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := api.reloader.reload(); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("could not reload the configuration, keeping the current one: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// watch reloads the configuration each time the process receives SIGHUP
+func (reloader *configReloader) watch() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloader.reload(); err != nil {
+			logger.errorf("Could not reload the configuration, keeping the current one: %v", err)
+		}
+	}
+}
+
+// applyConfigReload swaps the reloaded devices and VLAN settings into the reflector.
+// It runs between two packets, so that no packet sees half of a configuration.
+func (r *reflector) applyConfigReload() {
+	cfg := r.reloader.take()
+	if cfg == nil {
+		return
+	}
+	r.configMutex.Lock()
+	defer r.configMutex.Unlock()
+	// The maps read by the API and the debug endpoints are replaced rather than modified
+	r.cfg.Devices, r.cfg.devicePrefixes = cfg.Devices, cfg.devicePrefixes
+	r.cfg.VLANs, r.cfg.vlans = cfg.VLANs, cfg.vlans
+	r.cfg.UnknownDeviceMode, r.cfg.DefaultPool = cfg.UnknownDeviceMode, cfg.DefaultPool
+	r.cfg.EmptyDevicesMode = cfg.EmptyDevicesMode
+	r.cfg.Compliance, r.cfg.flows = cfg.Compliance, cfg.flows
+	r.poolsMap = mapByPool(cfg.Devices)
+	r.querierRestrictions = mapQuerierRestrictions(cfg.Devices)
+	r.solicitations.queriers = newSolicitationTracker(cfg.Devices, 0).queriers
+	r.reverseLookups = newReverseLookups(&r.cfg)
+	r.wireless.setVLANs(cfg.vlans)
+	// The cached answers were made visible by the previous devices and VLAN settings
+	r.proxy.flush()
+	for mac := range cfg.Devices {
+		r.ruleHits.add(mac)
+	}
+	// Devices approved into the configuration file without the API are still in the inventory of the reflector
+	if err := r.inventory.forget(cfg.Devices); err != nil {
+		logger.errorf("Could not write inventory file: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	content := `net_interface = "eth0"
+		[devices."00:14:22:01:23:45"]
+		origin_pool = 42
+		shared_pools = [1234]`
+	ioutil.WriteFile(file.Name(), []byte(content), 0644)
+	cfg, err := readConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloader := newConfigReloader(cfg)
+	setter := &mockBPFSetter{}
+	r, _ := createMockReflector(cfg)
+	watchReloads(reloader, setter, r)
+
+	ioutil.WriteFile(file.Name(), []byte(content+`
+		[devices."00:14:22:01:23:46"]
+		origin_pool = 43
+		shared_pools = [1234]
+		allowed_queriers = ["aa:aa:aa:aa:aa:aa"]`), 0644)
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("Error in reload(): %v", err)
+	}
+	if len(setter.filters) != 1 || !strings.Contains(setter.filters[0], "= 43") {
+		t.Errorf("Error in reload(): expected the capture filter to be rebuilt, got %v", setter.filters)
+	}
+
+	r.applyConfigReload()
+	tags := r.poolsMap[1234]
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	if !reflect.DeepEqual(tags, []uint16{42, 43}) {
+		t.Errorf("Error in applyConfigReload(): unexpected pools %v", r.poolsMap)
+	}
+	if !r.solicitations.queriers["aa:aa:aa:aa:aa:aa"] || len(r.cfg.Devices) != 2 {
+		t.Errorf("Error in applyConfigReload(): the new devices should be reflected, got %v", r.cfg.Devices)
+	}
+	if reloader.take() != nil {
+		t.Error("Error in take(): a reload should only be applied once")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(content+`
+		[devices."00:14:22:01:23:46"]
+		origin_pool = "invalid"`), 0644)
+	if err := reloader.reload(); err == nil || reloader.take() != nil || len(reloader.config().Devices) != 2 {
+		t.Error("Error in reload(): an invalid configuration should be rejected")
+	}
+}
+
+func TestConfigReloadConcurrentReads(t *testing.T) {
+	cfg, err := parseConfig(`
+		[devices."00:14:22:01:23:45"]
+		origin_pool = 42
+		shared_pools = [1234]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createMockReflector(cfg)
+	r.reloader = newConfigReloader(cfg)
+
+	// The packet loop applies reloads while the API reads the configuration, which the race detector checks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			reloaded := cfg
+			r.reloader.mutex.Lock()
+			r.reloader.pending = &reloaded
+			r.reloader.mutex.Unlock()
+			r.applyConfigReload()
+		}
+	}()
+	devices := &deviceAPI{reflector: r}
+	handlers := []http.Handler{vlansAPI{r}, complianceHandler{r}, explainAPI{r}}
+	for i := 0; i < 100; i++ {
+		devices.list(httptest.NewRecorder(), "")
+		for _, handler := range handlers {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device=00:14:22:01:23:45&vlan=42&service=_ipp._tcp", nil))
+		}
+	}
+	<-done
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var replayCommand = &command{
+	name:    "replay",
+	summary: "Replay a capture through the reflector, and compare the injected frames with a reference capture",
+	setup:   setupReplayCommand,
+}
+
+// frameCount is a normalized frame, injected count times
+type frameCount struct {
+	Signature string `json:"signature"`
+	Count     int    `json:"count"`
+}
+
+// trunkCount is the number of frames injected through a simulated trunk, the interface at Index of the input capture
+type trunkCount struct {
+	Index     int    `json:"index"`
+	Interface string `json:"interface"`
+	Frames    int    `json:"frames"`
+}
+
+// replayReport compares the frames injected by this reflector with the frames of a reference reflector, such as avahi.
+// Injected counts each injected frame once, whatever the number of trunks it was injected through.
+type replayReport struct {
+	Input         int          `json:"input"`
+	Injected      int          `json:"injected"`
+	Reference     int          `json:"reference"`
+	OnlyReflector []frameCount `json:"only_reflector"`
+	OnlyReference []frameCount `json:"only_reference"`
+	// Trunks counts the frames injected through each simulated trunk, when the input capture has several interfaces
+	Trunks []trunkCount `json:"trunks,omitempty"`
+}
+
+func setupReplayCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	configPath := flags.String("config", "", "Config file in TOML format")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+	referencePath := flags.String("reference", "", "Capture of the frames injected by the reference reflector")
+	outputPath := flags.String("output", "", "Write the frames injected by this reflector to this capture file")
+	speed := flags.Float64("speed", 0, "Replay at this multiple of the pace of the capture, e.g. 1 for its original timing, or as fast as possible with 0")
+	loops := flags.Int("loop", 1, "Replay the capture this many times, back to back")
+
+	return func(out *commandOutput, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: replay -config <path> [-reference <capture>] [-speed <multiplier>] [-loop <count>] <input capture>")
+		}
+		if *speed < 0 || *loops < 1 {
+			return fmt.Errorf("-speed cannot be negative, and -loop must be at least 1")
+		}
+		cfg, err := readProfile(*configPath, *profile)
+		if err != nil {
+			return fmt.Errorf("could not read configuration: %v", err)
+		}
+		input, interfaces, err := readTimedCaptureFile(args[0])
+		if err != nil {
+			return err
+		}
+		var reference [][]byte
+		if *referencePath != "" {
+			if reference, err = readCaptureFile(*referencePath); err != nil {
+				return err
+			}
+		}
+		trunks, err := replayCapture(cfg, input, interfaces, newReplayPacing(*speed, *loops))
+		if err != nil {
+			return err
+		}
+		injected := trunks.data()
+		if *outputPath != "" {
+			if err := trunks.writeCaptureFile(*outputPath); err != nil {
+				return err
+			}
+		}
+		report := replayReport{Injected: len(injected)}
+		if *referencePath != "" {
+			report = compareFrames(injected, reference)
+		}
+		report.Input = len(input) * *loops
+		report.Trunks = trunks.counts()
+		if err := out.print(report, func(w io.Writer) { printReplayReport(w, report, *referencePath != "") }); err != nil {
+			return err
+		}
+		if differences := len(report.OnlyReflector) + len(report.OnlyReference); differences > 0 {
+			return fmt.Errorf("%v frame signatures differ from the reference", differences)
+		}
+		return nil
+	}
+}
+
+// simulatedTrunks is the packetWriter of a replay keeping the injected frames. Each interface of the input capture
+// stands for a trunk of trunk_interfaces: like multiCapture, frames are injected through the trunk where the traffic
+// of their VLAN was last captured, or through every trunk when it was never seen.
+type simulatedTrunks struct {
+	// names holds the interface of each trunk, a single unnamed one for the captures of one interface
+	names []string
+	mutex sync.Mutex
+	vlans map[uint16]int
+	// injected are the frames written by the reflector, once each
+	injected [][]byte
+	// frames are the copies of the injected frames, whose InterfaceIndex is the trunk they were injected through
+	frames []capturedFrame
+}
+
+func newSimulatedTrunks(names []string) *simulatedTrunks {
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	return &simulatedTrunks{names: names, vlans: make(map[uint16]int)}
+}
+
+// trunk returns the trunk a frame of the input capture was captured on
+func (trunks *simulatedTrunks) trunk(frame capturedFrame) int {
+	if frame.info.InterfaceIndex < 0 || frame.info.InterfaceIndex >= len(trunks.names) {
+		return 0
+	}
+	return frame.info.InterfaceIndex
+}
+
+// capture learns the VLAN of a frame of the input capture on its trunk
+func (trunks *simulatedTrunks) capture(frame capturedFrame) {
+	if tag, ok := frameVLAN(frame.data); ok {
+		trunks.mutex.Lock()
+		trunks.vlans[tag] = trunks.trunk(frame)
+		trunks.mutex.Unlock()
+	}
+}
+
+func (trunks *simulatedTrunks) WritePacketData(data []byte) error {
+	trunks.mutex.Lock()
+	defer trunks.mutex.Unlock()
+	data = append([]byte{}, data...)
+	trunks.injected = append(trunks.injected, data)
+	tag, ok := frameVLAN(data)
+	if trunk, known := trunks.vlans[tag]; ok && known {
+		trunks.frames = append(trunks.frames, capturedFrame{data, gopacket.CaptureInfo{InterfaceIndex: trunk}})
+		return nil
+	}
+	for trunk := range trunks.names {
+		trunks.frames = append(trunks.frames, capturedFrame{data, gopacket.CaptureInfo{InterfaceIndex: trunk}})
+	}
+	return nil
+}
+
+// data returns the injected frames once each, whatever the trunks they were injected through
+func (trunks *simulatedTrunks) data() [][]byte {
+	return trunks.injected
+}
+
+// counts returns the number of frames injected through each trunk, by index as several interfaces may share
+// a name, or nil with a single trunk
+func (trunks *simulatedTrunks) counts() []trunkCount {
+	if len(trunks.names) < 2 {
+		return nil
+	}
+	counts := make([]trunkCount, len(trunks.names))
+	for i, name := range trunks.names {
+		counts[i] = trunkCount{Index: i, Interface: name}
+	}
+	for _, frame := range trunks.frames {
+		counts[frame.info.InterfaceIndex].Frames++
+	}
+	return counts
+}
+
+// writeCaptureFile writes the injected frames to a pcap file, or to a pcapng file with an interface per trunk
+// when there are several of them
+func (trunks *simulatedTrunks) writeCaptureFile(path string) error {
+	if len(trunks.names) < 2 {
+		return writeCaptureFile(path, trunks.data())
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writePcapng(file, trunks.names, trunks.frames)
+}
+
+// replayPacing is the pace at which the frames of a capture are replayed
+type replayPacing struct {
+	// speed multiplies the pace of the capture, or is 0 to replay it as fast as possible
+	speed float64
+	// loops is the number of times the capture is replayed, back to back
+	loops int
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newReplayPacing(speed float64, loops int) replayPacing {
+	return replayPacing{speed: speed, loops: loops, now: time.Now, sleep: time.Sleep}
+}
+
+// wait sleeps until offset, the time elapsed in the capture since its first frame, is reached at the pace of the
+// replay started at start. Deadlines are computed from the start, so that processing times do not add up.
+func (pacing replayPacing) wait(start time.Time, offset time.Duration) {
+	if pacing.speed == 0 {
+		return
+	}
+	deadline := start.Add(time.Duration(float64(offset) / pacing.speed))
+	if delay := deadline.Sub(pacing.now()); delay > 0 {
+		pacing.sleep(delay)
+	}
+}
+
+// replayFrames runs the frames of a capture through a reflector, and returns the frames it injected.
+// The capture is replayed once, as fast as possible: timing-dependent features see its packets as simultaneous.
+func replayFrames(cfg brconfig, frames [][]byte) ([][]byte, error) {
+	timed := make([]capturedFrame, len(frames))
+	for i, data := range frames {
+		timed[i].data = data
+	}
+	trunks, err := replayCapture(cfg, timed, nil, newReplayPacing(0, 1))
+	if err != nil {
+		return nil, err
+	}
+	return trunks.data(), nil
+}
+
+// replayCapture runs the frames of a capture through a reflector at the given pace, and returns the trunks holding
+// the frames it injected, one per name of interfaces. As the reflector reads the time of the system, paced replays
+// reproduce the timing of the capture for the caches, rate limits and duplicate filters.
+func replayCapture(cfg brconfig, frames []capturedFrame, interfaces []string, pacing replayPacing) (*simulatedTrunks, error) {
+	// Delayed answers would be injected after the end of the replay
+	cfg.ReflectionJitter.Duration, cfg.WarmUp.Duration = 0, 0
+	inv, err := loadInventory("", defaultInventorySize)
+	if err != nil {
+		return nil, err
+	}
+	hits, err := loadRuleHits("", cfg.Devices)
+	if err != nil {
+		return nil, err
+	}
+	trunks := newSimulatedTrunks(interfaces)
+	// The MAC address of the reflector is unknown, so that no input frame is mistaken for an injected one
+	reflector := newReflector(cfg, inv, hits, trunks, make(net.HardwareAddr, 6))
+	if len(frames) == 0 {
+		return trunks, nil
+	}
+	first := frames[0].info.Timestamp
+	// Each loop starts where the previous one ended
+	duration := frames[len(frames)-1].info.Timestamp.Sub(first)
+	start := pacing.now()
+	for loop := 0; loop < pacing.loops; loop++ {
+		for _, frame := range frames {
+			pacing.wait(start, time.Duration(loop)*duration+frame.info.Timestamp.Sub(first))
+			trunks.capture(frame)
+			packet := gopacket.NewPacket(frame.data, layers.LayerTypeEthernet, gopacket.Default)
+			if bonjourPacket, ok := parseBonjourPacket(packet, reflector.brMACAddress); ok {
+				reflector.processBonjourPacket(bonjourPacket)
+			}
+		}
+	}
+	return trunks, nil
+}
+
+// compareFrames lists the normalized frames injected more often by one reflector than by the other
+func compareFrames(injected, reference [][]byte) replayReport {
+	counts := make(map[string]int)
+	for _, data := range injected {
+		counts[frameSignature(data)]++
+	}
+	for _, data := range reference {
+		counts[frameSignature(data)]--
+	}
+	report := replayReport{Injected: len(injected), Reference: len(reference)}
+	for signature, count := range counts {
+		if count > 0 {
+			report.OnlyReflector = append(report.OnlyReflector, frameCount{signature, count})
+		} else if count < 0 {
+			report.OnlyReference = append(report.OnlyReference, frameCount{signature, -count})
+		}
+	}
+	for _, list := range [][]frameCount{report.OnlyReflector, report.OnlyReference} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Signature < list[j].Signature })
+	}
+	return report
+}
+
+// frameSignature describes what a frame delivers to the hosts of its VLAN: its destination, and the questions and
+// answers of its mDNS message. Link and IP sources, message IDs, TTLs, cache-flush bits and the authority and
+// additional sections differ between implementations, and are ignored.
+func frameSignature(data []byte) string {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	tag := parseVLANTag(packet)
+	dstIP, _ := parseIPLayer(packet)
+	dstPort, payload := parseUDPLayer(packet)
+	isQuery, dns := parseDNSPayload(payload)
+	if tag == nil || dns == nil {
+		return fmt.Sprintf("undecodable %v", hex.EncodeToString(data))
+	}
+	var entries []string
+	for _, question := range dns.Questions {
+		entries = append(entries, fmt.Sprintf("? %v %v", strings.ToLower(string(question.Name)), question.Type))
+	}
+	for _, answer := range dns.Answers {
+		entries = append(entries, fmt.Sprintf("%v %v %v", strings.ToLower(string(answer.Name)), answer.Type, recordData(&answer)))
+	}
+	sort.Strings(entries)
+	kind := "answer"
+	if isQuery {
+		kind = "query"
+	}
+	return fmt.Sprintf("vlan %v to %v:%v %v [%v]", *tag, dstIP, uint16(dstPort), kind, strings.Join(entries, "; "))
+}
+
+func recordData(record *layers.DNSResourceRecord) string {
+	switch record.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return record.IP.String()
+	case layers.DNSTypePTR:
+		return strings.ToLower(string(record.PTR))
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%v:%v", strings.ToLower(string(record.SRV.Name)), record.SRV.Port)
+	}
+	return hex.EncodeToString(record.Data)
+}
+
+func readCaptureFile(path string) ([][]byte, error) {
+	timed, _, err := readTimedCaptureFile(path)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, len(timed))
+	for i, frame := range timed {
+		frames[i] = frame.data
+	}
+	return frames, nil
+}
+
+// readTimedCaptureFile reads the frames of a pcap or pcapng capture with their capture time and the index of their
+// interface, and returns the names of the interfaces of a pcapng capture having several of them
+func readTimedCaptureFile(path string) ([]capturedFrame, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	buffered := bufio.NewReader(file)
+	var reader gopacket.PacketDataSource
+	var ngReader *pcapngReader
+	// The block type of pcapng section headers reads the same in both byte orders
+	if magic, _ := buffered.Peek(4); len(magic) == 4 && binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		ngReader, err = newPcapngReader(buffered)
+		reader = ngReader
+	} else {
+		reader, err = pcapgo.NewReader(buffered)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read capture %v: %v", path, err)
+	}
+	var frames []capturedFrame
+	for {
+		data, info, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read capture %v: %v", path, err)
+		}
+		frames = append(frames, capturedFrame{data, info})
+	}
+	if ngReader == nil || len(ngReader.interfaces) < 2 {
+		return frames, nil, nil
+	}
+	return frames, ngReader.names(), nil
+}
+
+func writeCaptureFile(path string, frames [][]byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+	for _, data := range frames {
+		info := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+		if err := writer.WritePacket(info, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printReplayReport(w io.Writer, report replayReport, compared bool) {
+	if !compared {
+		fmt.Fprintf(w, "%v input frames, %v injected\n", report.Input, report.Injected)
+	} else {
+		fmt.Fprintf(w, "%v input frames, %v injected, %v in the reference capture\n", report.Input, report.Injected, report.Reference)
+	}
+	for _, trunk := range report.Trunks {
+		fmt.Fprintf(w, "  %v through trunk %v (%v)\n", trunk.Frames, trunk.Index, trunk.Interface)
+	}
+	if !compared {
+		return
+	}
+	if len(report.OnlyReflector)+len(report.OnlyReference) == 0 {
+		fmt.Fprintln(w, "The injected frames match the reference.")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIDE\tCOUNT\tFRAME")
+	for _, frame := range report.OnlyReflector {
+		fmt.Fprintf(tw, "reflector\t%v\t%v\n", frame.Count, frame.Signature)
+	}
+	for _, frame := range report.OnlyReference {
+		fmt.Fprintf(tw, "reference\t%v\t%v\n", frame.Count, frame.Signature)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// referenceFrame returns the answer of the mock packet as another reflector would inject it on tag
+func referenceFrame(tag uint16) []byte {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: srcIPv4Test, DstIP: dstIPv4Test}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: dstMACTest, DstMAC: mDNSMulticastMAC, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp,
+		&layers.DNS{ID: 42, QR: true, Answers: []layers.DNSResourceRecord{{
+			Name: []byte("EXAMPLE.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN | cacheFlushBit, TTL: 120, IP: net.IP{1, 2, 3, 4},
+		}}})
+	return buf.Bytes()
+}
+
+func TestReplayFrames(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf("[devices.%q]\norigin_pool = %v\nshared_pools = [20, 30]", srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected, err := replayFrames(cfg, [][]byte{createMockmDNSPacket(true, false)})
+	if err != nil || len(injected) != 2 {
+		t.Fatalf("Error in replayFrames(): expected 2 injected frames, got %v (%v)", len(injected), err)
+	}
+
+	report := compareFrames(injected, [][]byte{referenceFrame(20), referenceFrame(30)})
+	if len(report.OnlyReflector) != 0 || len(report.OnlyReference) != 0 {
+		t.Errorf("Error in compareFrames(): expected frames equivalent to the reference, got %+v", report)
+	}
+	report = compareFrames(injected, [][]byte{referenceFrame(20), referenceFrame(40)})
+	if len(report.OnlyReflector) != 1 || !strings.HasPrefix(report.OnlyReflector[0].Signature, "vlan 30 ") ||
+		len(report.OnlyReference) != 1 || !strings.HasPrefix(report.OnlyReference[0].Signature, "vlan 40 ") {
+		t.Errorf("Error in compareFrames(): expected VLAN 30 and 40 to differ, got %+v", report)
+	}
+}
+
+func TestCaptureFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frames.pcap")
+	frames := [][]byte{referenceFrame(20), createMockmDNSPacket(true, true)}
+
+	if err := writeCaptureFile(path, frames); err != nil {
+		t.Fatalf("Error in writeCaptureFile(): %v", err)
+	}
+	read, err := readCaptureFile(path)
+	if err != nil || !reflect.DeepEqual(read, frames) {
+		t.Errorf("Error in readCaptureFile(): expected the written frames, got %v frames (%v)", len(read), err)
+	}
+}
+
+func TestReplayPacing(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf("[devices.%q]\norigin_pool = %v\nshared_pools = [20]", srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	frames := []capturedFrame{
+		{createMockmDNSPacket(true, false), gopacket.CaptureInfo{Timestamp: first}},
+		{createMockmDNSPacket(true, false), gopacket.CaptureInfo{Timestamp: first.Add(time.Second)}},
+		{createMockmDNSPacket(true, false), gopacket.CaptureInfo{Timestamp: first.Add(3 * time.Second)}},
+	}
+	clock := time.Now()
+	var sleeps []time.Duration
+	pacing := replayPacing{speed: 2, loops: 2, now: func() time.Time { return clock }, sleep: func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		clock = clock.Add(d)
+	}}
+	injected, err := replayCapture(cfg, frames, nil, pacing)
+	if err != nil || len(injected.frames) != 6 {
+		t.Errorf("Error in replayCapture(): expected every frame to be reflected on each loop, got %v frames (%v)", len(injected.frames), err)
+	}
+	expected := []time.Duration{500 * time.Millisecond, time.Second, 500 * time.Millisecond, time.Second}
+	if !reflect.DeepEqual(sleeps, expected) {
+		t.Errorf("Error in replayCapture(): expected the gaps of the capture at twice its pace, got %v", sleeps)
+	}
+
+	sleeps = nil
+	pacing.speed = 0
+	if _, err := replayCapture(cfg, frames, nil, pacing); err != nil || len(sleeps) != 0 {
+		t.Errorf("Error in replayCapture(): expected no wait as fast as possible, got %v (%v)", sleeps, err)
+	}
+}
+
+func TestReplayTrunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, err := parseConfig(fmt.Sprintf("[devices.%q]\norigin_pool = %v\nshared_pools = [20, 40]", srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The traffic of VLAN 20 is captured on the second interface, the device on the first one
+	path := filepath.Join(dir, "trunks.pcapng")
+	writeTestPcapng(t, path, []string{"eth0", "eth1"}, []capturedFrame{
+		{referenceFrame(20), gopacket.CaptureInfo{InterfaceIndex: 1}},
+		{createMockmDNSPacket(true, false), gopacket.CaptureInfo{InterfaceIndex: 0}},
+	})
+
+	frames, interfaces, err := readTimedCaptureFile(path)
+	if err != nil || len(frames) != 2 || !reflect.DeepEqual(interfaces, []string{"eth0", "eth1"}) {
+		t.Fatalf("Error in readTimedCaptureFile(): expected 2 frames on eth0 and eth1, got %v frames on %v (%v)", len(frames), interfaces, err)
+	}
+	trunks, err := replayCapture(cfg, frames, interfaces, newReplayPacing(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := make(map[uint16][]int)
+	for _, frame := range trunks.frames {
+		if tag, ok := frameVLAN(frame.data); ok {
+			injected[tag] = append(injected[tag], frame.info.InterfaceIndex)
+		}
+	}
+	// Frames are injected through the trunk of their VLAN, or through every trunk when it was not captured
+	if !reflect.DeepEqual(injected[20], []int{1}) || !reflect.DeepEqual(injected[40], []int{0, 1}) {
+		t.Errorf("Error in replayCapture(): expected VLAN 20 on eth1 and VLAN 40 on both trunks, got %v", injected)
+	}
+	// The frames injected through both trunks are compared once, and counted on each trunk
+	if len(trunks.data()) != 2 {
+		t.Errorf("Error in data(): expected 2 injected frames, got %v", len(trunks.data()))
+	}
+	if counts := trunks.counts(); !reflect.DeepEqual(counts, []trunkCount{{0, "eth0", 1}, {1, "eth1", 2}}) {
+		t.Errorf("Error in counts(): unexpected counts %v", counts)
+	}
+	// Interfaces sharing a name are counted apart
+	shared := newSimulatedTrunks([]string{"any", "any"})
+	shared.capture(capturedFrame{referenceFrame(20), gopacket.CaptureInfo{InterfaceIndex: 1}})
+	shared.WritePacketData(referenceFrame(20))
+	if counts := shared.counts(); !reflect.DeepEqual(counts, []trunkCount{{0, "any", 0}, {1, "any", 1}}) {
+		t.Errorf("Error in counts(): unexpected counts %v for interfaces sharing a name", counts)
+	}
+	checkTrunksCapture(t, trunks, filepath.Join(dir, "output.pcapng"))
+}
+
+func writeTestPcapng(t *testing.T, path string, interfaces []string, frames []capturedFrame) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := writePcapng(file, interfaces, frames); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTrunksCapture checks the injected frames keep their trunk in the output capture
+func checkTrunksCapture(t *testing.T, trunks *simulatedTrunks, output string) {
+	if err := trunks.writeCaptureFile(output); err != nil {
+		t.Fatalf("Error in writeCaptureFile(): %v", err)
+	}
+	read, interfaces, err := readTimedCaptureFile(output)
+	if err != nil || len(read) != len(trunks.frames) || !reflect.DeepEqual(interfaces, []string{"eth0", "eth1"}) {
+		t.Fatalf("Error in writeCaptureFile(): expected the injected frames on eth0 and eth1, got %v frames on %v (%v)", len(read), interfaces, err)
+	}
+	for i, frame := range read {
+		if frame.info.InterfaceIndex != trunks.frames[i].info.InterfaceIndex {
+			t.Errorf("Error in writeCaptureFile(): expected frame %v on trunk %v, got %v", i, trunks.frames[i].info.InterfaceIndex, frame.info.InterfaceIndex)
+		}
+	}
+}
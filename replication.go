@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Default delay between two pulls of the state of the active reflector by the standby
+const defaultReplicationInterval = 10 * time.Second
+
+// Pulls, failures and entries merged by the standby, exposed on /debug/vars
+var replicationStats = expvar.NewMap("replication")
+
+// replicationConfig is set on the standby reflector of a pair, pulling the state of the active one through its
+// management API, authenticated by the API token of the active reflector
+type replicationConfig struct {
+	Active   string   `toml:"active"`
+	Token    string   `toml:"token"`
+	Interval duration `toml:"interval"`
+}
+
+// replicatedInstance is a service instance of the service table, with the address of its device
+type replicatedInstance struct {
+	serviceInstance
+	SrcIP net.IP `json:"src_ip"`
+}
+
+// replicatedRecord is a record of the answer cache
+type replicatedRecord struct {
+	Name    string          `json:"name"`
+	Type    layers.DNSType  `json:"type"`
+	Class   layers.DNSClass `json:"class"`
+	TTL     uint32          `json:"ttl"`
+	IP      net.IP          `json:"ip,omitempty"`
+	PTR     string          `json:"ptr,omitempty"`
+	SRV     *layers.DNSSRV  `json:"srv,omitempty"`
+	TXTs    [][]byte        `json:"txts,omitempty"`
+	SrcIP   net.IP          `json:"src_ip"`
+	Origin  uint16          `json:"origin"`
+	VLANs   []uint16        `json:"vlans"`
+	Stored  time.Time       `json:"stored"`
+	Expires time.Time       `json:"expires"`
+}
+
+// replicationState is the state learned from the network by the active reflector, which the standby would
+// otherwise have to relearn after a failover: the service table, the queries waiting for a unicast response
+// and the answer cache
+type replicationState struct {
+	Time     time.Time            `json:"time"`
+	Services []replicatedInstance `json:"services"`
+	Queriers []unicastQuerier     `json:"queriers"`
+	Records  []replicatedRecord   `json:"records"`
+}
+
+// rebase moves the times of the state from the clock of the active reflector to the one of the standby, as
+// offsets from now. Unlike the decoded times, they carry the monotonic clock reading of now, so that their expiry
+// is not affected by the steps of the wall clock of the standby.
+func (state *replicationState) rebase(now time.Time) {
+	rebase := func(t time.Time) time.Time {
+		return now.Add(t.Sub(state.Time))
+	}
+	for i := range state.Services {
+		vlans := make(map[uint16]time.Time, len(state.Services[i].VLANs))
+		for vlan, expiry := range state.Services[i].VLANs {
+			vlans[vlan] = rebase(expiry)
+		}
+		state.Services[i].VLANs = vlans
+	}
+	for i := range state.Queriers {
+		state.Queriers[i].Expires = rebase(state.Queriers[i].Expires)
+	}
+	for i := range state.Records {
+		state.Records[i].Stored = rebase(state.Records[i].Stored)
+		state.Records[i].Expires = rebase(state.Records[i].Expires)
+	}
+	state.Time = now
+}
+
+// snapshot returns the instances still visible on a VLAN
+func (table *serviceTable) snapshot(now time.Time) []replicatedInstance {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	instances := []replicatedInstance{}
+	for _, instance := range table.instances {
+		vlans := make(map[uint16]time.Time)
+		for vlan, expiry := range instance.VLANs {
+			if expiry.After(now) {
+				vlans[vlan] = expiry
+			}
+		}
+		if len(vlans) > 0 {
+			replicated := replicatedInstance{serviceInstance: *instance, SrcIP: instance.srcIP}
+			replicated.VLANs = vlans
+			instances = append(instances, replicated)
+		}
+	}
+	return instances
+}
+
+// merge adds the replicated instances to the table, keeping the latest expiry of the instances known on a VLAN
+func (table *serviceTable) merge(instances []replicatedInstance, now time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, replicated := range instances {
+		key := strings.ToLower(replicated.Instance)
+		instance, ok := table.instances[key]
+		if !ok {
+			instance = &serviceInstance{
+				Service:  replicated.Service,
+				Instance: replicated.Instance,
+				Origin:   replicated.Origin,
+				VLANs:    make(map[uint16]time.Time),
+				srcIP:    replicated.SrcIP,
+			}
+			table.add(key, instance, now)
+		}
+		for vlan, expiry := range replicated.VLANs {
+			if expiry.After(instance.VLANs[vlan]) {
+				instance.VLANs[vlan] = expiry
+			}
+		}
+	}
+}
+
+// snapshot returns the queries still waiting for a unicast response
+func (table *unicastTable) snapshot(now time.Time) []unicastQuerier {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	queriers := []unicastQuerier{}
+	for _, querier := range table.entries {
+		if !now.After(querier.Expires) {
+			queriers = append(queriers, *querier)
+		}
+	}
+	return queriers
+}
+
+// merge adds the replicated queries unknown to the table
+func (table *unicastTable) merge(queriers []unicastQuerier, now time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, querier := range queriers {
+		key := unicastKey{id: querier.ID, name: querier.Name}
+		if _, ok := table.entries[key]; ok || now.After(querier.Expires) {
+			continue
+		}
+		if len(table.entries) >= table.maxSize {
+			table.evict(now)
+		}
+		querier := querier
+		table.entries[key] = &querier
+	}
+}
+
+// snapshot returns the records of the cache which did not expire, none when the cache is disabled
+func (cache *answerCache) snapshot(now time.Time) []replicatedRecord {
+	records := []replicatedRecord{}
+	if cache == nil {
+		return records
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, cachedRecords := range cache.records {
+		for _, cached := range cachedRecords {
+			if !now.Before(cached.expires) {
+				continue
+			}
+			record := replicatedRecord{
+				Name:    string(cached.record.Name),
+				Type:    cached.record.Type,
+				Class:   cached.record.Class,
+				TTL:     cached.record.TTL,
+				IP:      cached.record.IP,
+				PTR:     string(cached.record.PTR),
+				TXTs:    cached.record.TXTs,
+				SrcIP:   cached.srcIP,
+				Origin:  cached.origin,
+				VLANs:   cached.vlans,
+				Stored:  cached.stored,
+				Expires: cached.expires,
+			}
+			if cached.record.Type == layers.DNSTypeSRV {
+				srv := cached.record.SRV
+				record.SRV = &srv
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// merge adds the replicated records unknown to the cache, as long as it is not full
+func (cache *answerCache) merge(records []replicatedRecord, now time.Time) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, replicated := range records {
+		if !isCacheable(replicated.Type) || !now.Before(replicated.Expires) {
+			continue
+		}
+		record := layers.DNSResourceRecord{
+			Name:  []byte(replicated.Name),
+			Type:  replicated.Type,
+			Class: replicated.Class,
+			TTL:   replicated.TTL,
+			IP:    replicated.IP,
+			PTR:   []byte(replicated.PTR),
+			TXTs:  replicated.TXTs,
+		}
+		if replicated.SRV != nil {
+			record.SRV = *replicated.SRV
+		}
+		key := cacheKey{name: strings.ToLower(replicated.Name), rrType: replicated.Type}
+		known := false
+		for _, cached := range cache.records[key] {
+			if cached.origin == replicated.Origin && sameData(&cached.record, &record) {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+		if cache.size >= cache.maxRecords {
+			cache.prune(now)
+			if cache.size >= cache.maxRecords {
+				proxyStats.Add("cache_full", 1)
+				return
+			}
+		}
+		cached := &cachedRecord{
+			record:  record,
+			srcIP:   replicated.SrcIP,
+			origin:  replicated.Origin,
+			vlans:   replicated.VLANs,
+			stored:  replicated.Stored,
+			expires: replicated.Expires,
+		}
+		cache.records[key] = append(cache.records[key], cached)
+		cache.count(key, cached, 1)
+	}
+}
+
+// replicationAPI serves the state of the reflector on /api/v1/replication, for its standby
+type replicationAPI struct {
+	reflector *reflector
+}
+
+func (api replicationAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	now := time.Now()
+	state := replicationState{
+		Time:     now,
+		Services: api.reflector.services.snapshot(now),
+		Queriers: api.reflector.unicastTable.snapshot(now),
+		Records:  api.reflector.proxy.snapshot(now),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// replicator keeps a standby reflector warm, by periodically merging the state of the active reflector into its own.
+// The standby learns from the trunk as well, merging only adds what it missed, e.g. while it was restarting.
+type replicator struct {
+	cfg       replicationConfig
+	reflector *reflector
+	// status is degraded while the active reflector cannot be reached
+	status  *subsystemStatus
+	failing bool
+}
+
+func newReplicator(cfg replicationConfig, reflector *reflector) *replicator {
+	return &replicator{cfg: cfg, reflector: reflector, status: newSubsystemStatus()}
+}
+
+// run pulls the state of the active reflector every interval
+func (rep *replicator) run() {
+	rep.pull(time.Now())
+	for now := range time.Tick(rep.cfg.Interval.Duration) {
+		rep.pull(now)
+	}
+}
+
+// pull merges the state of the active reflector, logging when it stops or starts again being reachable,
+// such as when it fails and the standby takes over
+func (rep *replicator) pull(now time.Time) {
+	var state replicationState
+	if err := callAPI(rep.cfg.Active, rep.cfg.Token, http.MethodGet, "/api/v1/replication", nil, &state); err != nil {
+		replicationStats.Add("failures", 1)
+		if !rep.failing {
+			logger.warnf("Could not replicate the state of the active reflector %v: %v", rep.cfg.Active, err)
+		}
+		rep.status.set(healthDegraded, fmt.Sprintf("active reflector %v unreachable: %v", rep.cfg.Active, err))
+		rep.failing = true
+		return
+	}
+	if rep.failing {
+		logger.infof("Replicating the state of the active reflector %v again", rep.cfg.Active)
+	}
+	rep.status.set(healthOK, "")
+	rep.failing = false
+	rep.merge(state, now)
+}
+
+// merge merges a state pulled at now into the state of the standby
+func (rep *replicator) merge(state replicationState, now time.Time) {
+	state.rebase(now)
+	rep.reflector.services.merge(state.Services, now)
+	rep.reflector.unicastTable.merge(state.Queriers, now)
+	rep.reflector.proxy.merge(state.Records, now)
+	replicationStats.Add("pulls", 1)
+	replicationStats.Add("services", int64(len(state.Services)))
+	replicationStats.Add("queriers", int64(len(state.Queriers)))
+	replicationStats.Add("records", int64(len(state.Records)))
+}
+
+// startReplication keeps the reflector warm as the standby of the active reflector of the configuration, if any
+func startReplication(cfg *brconfig, reflector *reflector) {
+	if cfg.Replication.Active == "" {
+		return
+	}
+	rep := newReplicator(cfg.Replication, reflector)
+	health.register("replication", false, rep.status.check(map[string]expvar.Var{"replication": replicationStats}))
+	go rep.run()
+}
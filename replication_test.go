@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestReplication(t *testing.T) {
+	cfg := brconfig{Proxy: proxyConfig{Enabled: true, MaxRecords: 16}, UnicastTimeout: duration{5 * time.Second}, UnicastTableSize: 16}
+	active, _ := createMockReflector(cfg)
+	standby, _ := createMockReflector(cfg)
+	now := time.Now()
+
+	answer := createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120)
+	active.services.observe(answer, srcIPv4Test, []uint16{10, 20}, now)
+	active.proxy.store(answer, srcIPv4Test, 10, []uint16{20}, now)
+	question := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	active.unicastTable.recordQuery(createMockQuery(1234, 49152, question), []uint16{42}, now)
+
+	server := httptest.NewServer(apiAuth{token: "secret", handler: replicationAPI{active}})
+	defer server.Close()
+	rep := newReplicator(replicationConfig{Active: strings.TrimPrefix(server.URL, "http://"), Token: "secret"}, standby)
+	rep.pull(time.Now())
+	if rep.failing {
+		t.Fatal("Error in pull(): could not pull the state of the active reflector")
+	}
+
+	later := time.Now().Add(time.Second)
+	if !standby.services.isVisible("_ipp._tcp", "Office Printer", 20, later) {
+		t.Error("Error in pull(): service instance not replicated")
+	}
+	if querier := standby.unicastTable.lookup(1234, []string{"_ipp._tcp.local"}, 42, later); querier == nil || querier.VLAN != vlanIdentifierTest {
+		t.Errorf("Error in pull(): unicast query not replicated, got %+v", querier)
+	}
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}}}
+	if answers, complete := standby.proxy.lookup(query, 20, []uint16{10}, later); len(answers) != 1 || !complete {
+		t.Errorf("Error in pull(): cached answer not replicated, got %d answers", len(answers))
+	}
+
+	// Records already known are not duplicated
+	rep.pull(time.Now())
+	if answers, _ := standby.proxy.lookup(query, 20, []uint16{10}, later); len(answers) != 1 {
+		t.Errorf("Error in pull(): cached answer replicated twice, got %d answers", len(answers))
+	}
+
+	rep.cfg.Token = "wrong"
+	rep.pull(time.Now())
+	if !rep.failing || rep.status.check(nil)().State != healthDegraded {
+		t.Error("Error in pull(): rejected pull not reported")
+	}
+}
+
+func TestReplicationRebase(t *testing.T) {
+	active := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	state := replicationState{
+		Time:     active,
+		Services: []replicatedInstance{{serviceInstance: serviceInstance{VLANs: map[uint16]time.Time{20: active.Add(time.Minute)}}}},
+		Queriers: []unicastQuerier{{Expires: active.Add(5 * time.Second)}},
+		Records:  []replicatedRecord{{Stored: active, Expires: active.Add(time.Hour)}},
+	}
+	// The clock of the standby is years ahead
+	now := time.Now()
+	state.rebase(now)
+	if state.Services[0].VLANs[20].Sub(now) != time.Minute || state.Queriers[0].Expires.Sub(now) != 5*time.Second ||
+		state.Records[0].Stored.Sub(now) != 0 || state.Records[0].Expires.Sub(now) != time.Hour {
+		t.Errorf("Error in rebase(): times not moved to the clock of the standby, got %+v", state)
+	}
+	// The rebased times keep the monotonic clock reading of now
+	if !strings.Contains(state.Records[0].Expires.String(), "m=") {
+		t.Errorf("Error in rebase(): expected a monotonic clock reading, got %v", state.Records[0].Expires)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// reverseLookups reflects reverse lookups (PTR queries for in-addr.arpa and ip6.arpa names) to the VLAN
+// whose subnets contain the address, and their answers back to the VLANs which asked for them,
+// as long as the device rules share the answering host with these VLANs.
+type reverseLookups struct {
+	window  time.Duration
+	subnets map[uint16][]*net.IPNet
+	// pending maps the reverse names recently asked for to the VLANs of the queriers
+	pending map[string]map[uint16]time.Time
+}
+
+// newReverseLookups returns nil when no VLAN lists its subnets
+func newReverseLookups(cfg *brconfig) *reverseLookups {
+	lookups := &reverseLookups{
+		window:  cfg.SolicitationWindow.Duration,
+		subnets: make(map[uint16][]*net.IPNet),
+		pending: make(map[string]map[uint16]time.Time),
+	}
+	for tag, vlan := range cfg.vlans {
+		if len(vlan.subnets) > 0 {
+			lookups.subnets[tag] = vlan.subnets
+		}
+	}
+	if len(lookups.subnets) == 0 {
+		return nil
+	}
+	return lookups
+}
+
+// parseReverseName returns the address of a reverse lookup name, such as "4.3.2.1.in-addr.arpa" for 1.2.3.4
+func parseReverseName(name string) (net.IP, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	var labels []string
+	var ip net.IP
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels = strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil, false
+		}
+		ip = make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels = strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil, false
+		}
+		ip = make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil {
+				return nil, false
+			}
+			// Labels list the nibbles of the address from the last one
+			position := 2*net.IPv6len - 1 - i
+			ip[position/2] |= byte(nibble) << uint(4*(1-position%2))
+		}
+	default:
+		return nil, false
+	}
+	return ip, true
+}
+
+// vlanOf returns the VLAN whose subnets contain ip
+func (lookups *reverseLookups) vlanOf(ip net.IP) (uint16, bool) {
+	for tag, subnets := range lookups.subnets {
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				return tag, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// queryTargets returns the VLANs of the addresses asked for by a query made of reverse lookups only,
+// and false for other queries
+func (lookups *reverseLookups) queryTargets(bonjourPacket *bonjourPacket, now time.Time) ([]uint16, bool) {
+	if lookups == nil || bonjourPacket.dns == nil || len(bonjourPacket.dns.Questions) == 0 {
+		return nil, false
+	}
+	lookups.expire(now)
+	srcVLAN := *bonjourPacket.vlanTag
+	targets := make(map[uint16]bool)
+	for _, question := range bonjourPacket.dns.Questions {
+		ip, ok := parseReverseName(string(question.Name))
+		if !ok || question.Type != layers.DNSTypePTR {
+			return nil, false
+		}
+		tag, ok := lookups.vlanOf(ip)
+		if !ok || tag == srcVLAN {
+			continue
+		}
+		targets[tag] = true
+		name := strings.ToLower(string(question.Name))
+		if lookups.pending[name] == nil {
+			lookups.pending[name] = make(map[uint16]time.Time)
+		}
+		lookups.pending[name][srcVLAN] = now
+	}
+	return sortedVLANs(targets), true
+}
+
+// answerTargets returns the VLANs which recently asked for the reverse lookups answered by a packet,
+// and false for other answers. Answers about addresses outside of the subnets of their VLAN are not reflected.
+// The caller intersects these VLANs with the ones allowed by the device rules.
+func (lookups *reverseLookups) answerTargets(bonjourPacket *bonjourPacket, now time.Time) ([]uint16, bool) {
+	if lookups == nil || bonjourPacket.dns == nil || len(bonjourPacket.dns.Answers) == 0 {
+		return nil, false
+	}
+	srcVLAN := *bonjourPacket.vlanTag
+	targets := make(map[uint16]bool)
+	for _, answer := range bonjourPacket.dns.Answers {
+		ip, ok := parseReverseName(string(answer.Name))
+		if !ok || answer.Type != layers.DNSTypePTR {
+			return nil, false
+		}
+		if tag, ok := lookups.vlanOf(ip); !ok || tag != srcVLAN {
+			continue
+		}
+		for tag, asked := range lookups.pending[strings.ToLower(string(answer.Name))] {
+			if now.Sub(asked) <= lookups.window {
+				targets[tag] = true
+			}
+		}
+	}
+	return sortedVLANs(targets), true
+}
+
+// expire forgets the reverse lookups which were not answered in time
+func (lookups *reverseLookups) expire(now time.Time) {
+	for name, queriers := range lookups.pending {
+		for tag, asked := range queriers {
+			if now.Sub(asked) > lookups.window {
+				delete(queriers, tag)
+			}
+		}
+		if len(queriers) == 0 {
+			delete(lookups.pending, name)
+		}
+	}
+}
+
+func sortedVLANs(set map[uint16]bool) []uint16 {
+	vlans := make([]uint16, 0, len(set))
+	for vlan := range set {
+		vlans = append(vlans, vlan)
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return vlans
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected net.IP
+	}{
+		{"10.1.168.192.in-addr.arpa", net.IP{192, 168, 1, 10}},
+		{"10.1.168.192.IN-ADDR.ARPA.", net.IP{192, 168, 1, 10}},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa", net.ParseIP("4321:0:1:2:3:4:567:89ab")},
+		{"1.168.192.in-addr.arpa", nil},
+		{"300.1.168.192.in-addr.arpa", nil},
+		{"_ipp._tcp.local", nil},
+	}
+	for _, test := range tests {
+		ip, ok := parseReverseName(test.name)
+		if ok != (test.expected != nil) || (ok && !ip.Equal(test.expected)) {
+			t.Errorf("Error in parseReverseName(%q): got %v", test.name, ip)
+		}
+	}
+}
+
+func TestReverseLookups(t *testing.T) {
+	cfg, err := parseConfig(`
+		[vlans."30"]
+		subnets = ["192.168.30.0/24"]
+		[vlans."42"]
+		subnets = ["192.168.42.0/24", "fd00:42::/64"]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookups := newReverseLookups(&cfg)
+	now := time.Now()
+	question := layers.DNSQuestion{Name: []byte("7.42.168.192.in-addr.arpa"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+
+	// Queries are reflected to the VLAN of the address only
+	targets, ok := lookups.queryTargets(createMockQuery(0, 5353, question), now)
+	if !ok || len(targets) != 1 || targets[0] != 42 {
+		t.Errorf("Error in queryTargets(): got %v %v", targets, ok)
+	}
+	other := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	if _, ok := lookups.queryTargets(createMockQuery(0, 5353, question, other), now); ok {
+		t.Error("Error in queryTargets(): queries mixing other questions should follow the pools")
+	}
+
+	// Answers flow back to the VLAN of the querier, only from the VLAN of the address
+	answer := createMockBonjourPacket(false)
+	answer.dns = &layers.DNS{QR: true, Answers: []layers.DNSResourceRecord{
+		{Name: question.Name, Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 120, PTR: []byte("printer.local")},
+	}}
+	tag := uint16(42)
+	answer.vlanTag = &tag
+	if targets, ok := lookups.answerTargets(&answer, now.Add(time.Second)); !ok || len(targets) != 1 || targets[0] != vlanIdentifierTest {
+		t.Errorf("Error in answerTargets(): got %v %v", targets, ok)
+	}
+	if targets, _ := lookups.answerTargets(&answer, now.Add(time.Minute)); len(targets) != 0 {
+		t.Errorf("Error in answerTargets(): expired lookups should not be answered, got %v", targets)
+	}
+	spoofedTag := uint16(30)
+	answer.vlanTag = &spoofedTag
+	if targets, _ := lookups.answerTargets(&answer, now.Add(time.Second)); len(targets) != 0 {
+		t.Errorf("Error in answerTargets(): answers from another VLAN should not be reflected, got %v", targets)
+	}
+}
+
+func TestReverseLookupsFollowDevices(t *testing.T) {
+	cfg, err := parseConfig(`
+		[vlans."42"]
+		subnets = ["192.168.42.0/24"]
+		[devices."ff:aa:fa:aa:ff:aa"]
+		origin_pool = 42
+		shared_pools = [30]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createMockReflector(cfg)
+	question := layers.DNSQuestion{Name: []byte("7.42.168.192.in-addr.arpa"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	for _, tag := range []uint16{30, 50} {
+		query := createMockQuery(0, 5353, question)
+		query.vlanTag = &tag
+		r.reverseLookups.queryTargets(query, time.Now())
+	}
+
+	// Both VLANs asked, but the answering device is only shared with VLAN 30
+	answer := createMockBonjourPacket(false)
+	answer.dns = &layers.DNS{QR: true, Answers: []layers.DNSResourceRecord{
+		{Name: question.Name, Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 120, PTR: []byte("printer.local")},
+	}}
+	tag := uint16(42)
+	answer.vlanTag = &tag
+	if targets := r.answerTargets(&answer); !equalVLANs(targets, []uint16{30}) {
+		t.Errorf("Error in answerTargets(): expected the answer to follow the device rules, got %v", targets)
+	}
+}
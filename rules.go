@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Minimal delay between two writes of the rule hits file
+const ruleHitsSaveInterval = time.Minute
+
+type ruleHit struct {
+	MAC       macAddress `json:"mac"`
+	Matches   uint64     `json:"matches"`
+	LastMatch time.Time  `json:"last_match"`
+}
+
+// ruleHits counts how many times each device entry of the configuration matched a packet,
+// so that entries which no longer match anything can be pruned
+type ruleHits struct {
+	mutex    sync.Mutex
+	path     string
+	hits     map[macAddress]*ruleHit
+	lastSave time.Time
+}
+
+// loadRuleHits restores the counters saved at path, and adds an empty counter for every configured device
+func loadRuleHits(path string, devices map[macAddress]bonjourDevice) (*ruleHits, error) {
+	hits := &ruleHits{
+		path: path,
+		hits: make(map[macAddress]*ruleHit),
+	}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var saved []*ruleHit
+			if err := json.Unmarshal(content, &saved); err != nil {
+				return nil, err
+			}
+			for _, hit := range saved {
+				if _, ok := devices[hit.MAC]; ok {
+					hits.hits[hit.MAC] = hit
+				}
+			}
+		}
+	}
+	for mac := range devices {
+		if _, ok := hits.hits[mac]; !ok {
+			hits.hits[mac] = &ruleHit{MAC: mac}
+		}
+	}
+	return hits, nil
+}
+
+// add starts counting the matches of a device added at runtime
+func (hits *ruleHits) add(mac macAddress) {
+	hits.mutex.Lock()
+	defer hits.mutex.Unlock()
+	if _, ok := hits.hits[mac]; !ok {
+		hits.hits[mac] = &ruleHit{MAC: mac}
+	}
+}
+
+func (hits *ruleHits) record(mac macAddress, now time.Time) {
+	hits.mutex.Lock()
+	defer hits.mutex.Unlock()
+
+	hit, ok := hits.hits[mac]
+	if !ok {
+		return
+	}
+	hit.Matches++
+	hit.LastMatch = now
+
+	if hits.path != "" && now.Sub(hits.lastSave) >= ruleHitsSaveInterval {
+		hits.lastSave = now
+		if err := hits.save(); err != nil {
+			logger.errorf("Could not write rule hits file: %v", err)
+		}
+	}
+}
+
+// snapshot returns a copy of the counters, least recently matched entries first
+func (hits *ruleHits) snapshot() []ruleHit {
+	hits.mutex.Lock()
+	defer hits.mutex.Unlock()
+
+	snapshot := make([]ruleHit, 0, len(hits.hits))
+	for _, hit := range hits.hits {
+		snapshot = append(snapshot, *hit)
+	}
+	sortRuleHits(snapshot)
+	return snapshot
+}
+
+func sortRuleHits(hits []ruleHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if !hits[i].LastMatch.Equal(hits[j].LastMatch) {
+			return hits[i].LastMatch.Before(hits[j].LastMatch)
+		}
+		return hits[i].MAC < hits[j].MAC
+	})
+}
+
+// save must be called with the mutex held
+func (hits *ruleHits) save() error {
+	snapshot := make([]*ruleHit, 0, len(hits.hits))
+	for _, hit := range hits.hits {
+		snapshot = append(snapshot, hit)
+	}
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := hits.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, hits.path)
+}
+
+func (hits *ruleHits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hits.snapshot())
+}
+
+var rulesCommand = &command{
+	name:    "rules",
+	summary: "Print the match counters of the device entries of a running reflector",
+	setup:   setupRulesCommand,
+}
+
+// setupRulesCommand prints the rule hits of a running reflector, least recently matched entries first
+func setupRulesCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:6060", "Address of the debug server of the running reflector")
+	unusedFor := flags.Duration("unused-for", 0, "Only list entries which did not match anything for this long (e.g. 2160h)")
+
+	return func(out *commandOutput, args []string) error {
+		var hits []ruleHit
+		if err := callAPI(*addr, "", http.MethodGet, "/debug/rules", nil, &hits); err != nil {
+			return fmt.Errorf("could not read rule hits, was the reflector started with -debug? %v", err)
+		}
+		sortRuleHits(hits)
+		hits = filterUnusedRuleHits(hits, *unusedFor, time.Now())
+
+		return out.print(hits, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "DEVICE\tMATCHES\tLAST MATCH")
+			for _, hit := range hits {
+				lastMatch := "never"
+				if !hit.LastMatch.IsZero() {
+					lastMatch = hit.LastMatch.Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%s\n", hit.MAC, hit.Matches, lastMatch)
+			}
+			tw.Flush()
+		})
+	}
+}
+
+// filterUnusedRuleHits keeps the entries which did not match anything during the given duration
+func filterUnusedRuleHits(hits []ruleHit, unusedFor time.Duration, now time.Time) []ruleHit {
+	unused := []ruleHit{}
+	for _, hit := range hits {
+		if now.Sub(hit.LastMatch) >= unusedFor {
+			unused = append(unused, hit)
+		}
+	}
+	return unused
+}
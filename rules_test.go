@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleHitsRecord(t *testing.T) {
+	hits, _ := loadRuleHits("", devices)
+	now := time.Now()
+
+	hits.record("00:14:22:01:23:45", now.Add(-time.Hour))
+	hits.record("00:14:22:01:23:45", now)
+	hits.record("00:14:22:01:23:47", now.Add(-time.Minute))
+	hits.record("00:14:22:01:23:99", now)
+
+	snapshot := hits.snapshot()
+	if len(snapshot) != len(devices) {
+		t.Fatalf("Error in snapshot(): expected %v entries, got %v", len(devices), len(snapshot))
+	}
+	expectedOrder := []macAddress{"00:14:22:01:23:46", "00:14:22:01:23:47", "00:14:22:01:23:45"}
+	for i, mac := range expectedOrder {
+		if snapshot[i].MAC != mac {
+			t.Errorf("Error in snapshot(): expected %v at position %v, got %v", mac, i, snapshot[i].MAC)
+		}
+	}
+	if snapshot[2].Matches != 2 || !snapshot[2].LastMatch.Equal(now) {
+		t.Errorf("Error in record(): unexpected counter %+v", snapshot[2])
+	}
+}
+
+func TestRuleHitsSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+
+	hits, err := loadRuleHits(path, devices)
+	if err != nil {
+		t.Fatalf("Error in loadRuleHits() for a missing file: %v", err)
+	}
+	hits.record("00:14:22:01:23:45", time.Now())
+
+	loaded, err := loadRuleHits(path, devices)
+	if err != nil {
+		t.Fatalf("Error in loadRuleHits(): %v", err)
+	}
+	if loaded.hits["00:14:22:01:23:45"].Matches != 1 {
+		t.Error("Error in loadRuleHits(): saved counters were not restored")
+	}
+}
+
+func TestFilterUnusedRuleHits(t *testing.T) {
+	now := time.Now()
+	hits := []ruleHit{
+		ruleHit{MAC: "00:14:22:01:23:45"},
+		ruleHit{MAC: "00:14:22:01:23:46", LastMatch: now.Add(-100 * 24 * time.Hour)},
+		ruleHit{MAC: "00:14:22:01:23:47", LastMatch: now.Add(-time.Hour)},
+	}
+	unused := filterUnusedRuleHits(hits, 90*24*time.Hour, now)
+	if len(unused) != 2 || unused[0].MAC != "00:14:22:01:23:45" || unused[1].MAC != "00:14:22:01:23:46" {
+		t.Errorf("Error in filterUnusedRuleHits(): got %+v", unused)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"expvar"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Records removed from the answers of devices because their service type is not allowed, exposed on /debug/vars
+var filteredServiceRecords = expvar.NewInt("filtered_service_records")
+
+// allowsService tells whether the device may advertise a service type, such as "_airplay._tcp.local".
+// Devices without allowed_services may advertise any of them.
+func (device *bonjourDevice) allowsService(service string) bool {
+	if len(device.AllowedServices) == 0 {
+		return true
+	}
+	for _, allowed := range device.AllowedServices {
+		if fullServiceName(allowed) == service {
+			return true
+		}
+	}
+	return false
+}
+
+// recordServiceType returns the service type a record is about: the type of its name or, for the records
+// enumerating the service types on _services._dns-sd._udp.local, the type they point to.
+// Records about no service, such as the addresses of hosts, return "".
+func recordServiceType(record *layers.DNSResourceRecord) string {
+	service := serviceTypeOf(string(record.Name))
+	if service == "_dns-sd._udp.local" && record.Type == layers.DNSTypePTR {
+		return serviceTypeOf(string(record.PTR))
+	}
+	return service
+}
+
+// filterServiceRecords removes the records about the service types device does not allow from records
+func filterServiceRecords(records []layers.DNSResourceRecord, device *bonjourDevice) []layers.DNSResourceRecord {
+	kept := records[:0]
+	for _, record := range records {
+		if service := recordServiceType(&record); service != "" && !device.allowsService(service) {
+			filteredServiceRecords.Add(1)
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept
+}
+
+// filterAllowedServices removes from an answer of device the records about the service types it does not allow,
+// and tells whether there are answers left to reflect
+func filterAllowedServices(bonjourPacket *bonjourPacket, device *bonjourDevice) bool {
+	dns := bonjourPacket.dns
+	if len(device.AllowedServices) == 0 || dns == nil {
+		return true
+	}
+	answers, additionals := len(dns.Answers), len(dns.Additionals)
+	dns.Answers = filterServiceRecords(dns.Answers, device)
+	dns.Additionals = filterServiceRecords(dns.Additionals, device)
+	if len(dns.Answers) != answers || len(dns.Additionals) != additionals {
+		bonjourPacket.dnsRewritten = true
+	}
+	return len(dns.Answers) > 0
+}
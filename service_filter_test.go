@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestFilterServices(t *testing.T) {
+	device := &bonjourDevice{AllowedServices: []string{"_airplay._tcp"}}
+	dns := &layers.DNS{
+		QR: true,
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("_airplay._tcp.local"), Type: layers.DNSTypePTR, PTR: []byte("TV._airplay._tcp.local")},
+			{Name: []byte("_ssh._tcp.local"), Type: layers.DNSTypePTR, PTR: []byte("TV._ssh._tcp.local")},
+			{Name: []byte("_services._dns-sd._udp.local"), Type: layers.DNSTypePTR, PTR: []byte("_ssh._tcp.local")},
+		},
+		Additionals: []layers.DNSResourceRecord{
+			{Name: []byte("TV._AirPlay._tcp.local"), Type: layers.DNSTypeSRV, SRV: layers.DNSSRV{Port: 7000, Name: []byte("tv.local")}},
+			{Name: []byte("TV._ssh._tcp.local"), Type: layers.DNSTypeSRV, SRV: layers.DNSSRV{Port: 22, Name: []byte("tv.local")}},
+			{Name: []byte("tv.local"), Type: layers.DNSTypeA, IP: net.IP{10, 0, 0, 1}},
+		},
+	}
+	answer := &bonjourPacket{dns: dns}
+
+	if !filterAllowedServices(answer, device) || !answer.dnsRewritten {
+		t.Fatal("Error in filterAllowedServices(): expected the answer to be rewritten and reflected")
+	}
+	if len(dns.Answers) != 1 || string(dns.Answers[0].Name) != "_airplay._tcp.local" {
+		t.Errorf("Error in filterAllowedServices(): unexpected answers %v", dns.Answers)
+	}
+	if len(dns.Additionals) != 2 || dns.Additionals[0].SRV.Port != 7000 || dns.Additionals[1].Type != layers.DNSTypeA {
+		t.Errorf("Error in filterAllowedServices(): unexpected additional records %v", dns.Additionals)
+	}
+
+	// Answers left without records are not reflected
+	dns.Answers = dns.Answers[:0]
+	dns.Answers = append(dns.Answers, layers.DNSResourceRecord{Name: []byte("_ssh._tcp.local"), Type: layers.DNSTypePTR, PTR: []byte("TV._ssh._tcp.local")})
+	if filterAllowedServices(answer, device) {
+		t.Error("Error in filterAllowedServices(): expected an answer without allowed services not to be reflected")
+	}
+
+	// Devices without allowed_services advertise every service
+	answer = &bonjourPacket{dns: &layers.DNS{Answers: []layers.DNSResourceRecord{{Name: []byte("_ssh._tcp.local"), Type: layers.DNSTypePTR}}}}
+	if !filterAllowedServices(answer, &bonjourDevice{}) || answer.dnsRewritten {
+		t.Error("Error in filterAllowedServices(): a device without allowed_services was filtered")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Share of the reflected traffic above which a service type is reported by the suggest command
+const defaultSuggestShare = 0.5
+
+// Statistics covering less than this duration are reported as premature
+const suggestMinObservation = 24 * time.Hour
+
+// Maximum number of services of devices, and of services of VLANs, accounted: beyond it, the least recently
+// seen ones are forgotten
+const maxServiceUsageEntries = 4096
+
+// serviceAnswerUsage is the traffic of the answers of a device about a service type
+type serviceAnswerUsage struct {
+	Service string     `json:"service"`
+	Device  macAddress `json:"device"`
+	Answers uint64     `json:"answers"`
+	Bytes   uint64     `json:"bytes"`
+	// VLANs the answers were reflected to
+	VLANs []uint16 `json:"vlans"`
+
+	vlans map[uint16]bool
+}
+
+// serviceQueryUsage counts the queries for a service type sent on a VLAN
+type serviceQueryUsage struct {
+	Service   string    `json:"service"`
+	VLAN      uint16    `json:"vlan"`
+	Queries   uint64    `json:"queries"`
+	LastQuery time.Time `json:"last_query"`
+}
+
+type serviceUsageReport struct {
+	Since   time.Time            `json:"since"`
+	Answers []serviceAnswerUsage `json:"answers"`
+	Queries []serviceQueryUsage  `json:"queries"`
+}
+
+type serviceDeviceKey struct {
+	service string
+	device  macAddress
+}
+
+type serviceVLANKey struct {
+	service string
+	vlan    uint16
+}
+
+// serviceUsage gathers, per service type, the reflected answers and the queries of each VLAN,
+// from which the suggest command finds the services which are heavy or useless to reflect
+type serviceUsage struct {
+	mutex   sync.Mutex
+	since   time.Time
+	answers map[serviceDeviceKey]*list.Element
+	queries map[serviceVLANKey]*list.Element
+	// answerOrder and queryOrder hold the answers and queries, least recently seen first
+	answerOrder *list.List
+	queryOrder  *list.List
+}
+
+func newServiceUsage(now time.Time) *serviceUsage {
+	return &serviceUsage{
+		since:       now,
+		answers:     make(map[serviceDeviceKey]*list.Element),
+		queries:     make(map[serviceVLANKey]*list.Element),
+		answerOrder: list.New(),
+		queryOrder:  list.New(),
+	}
+}
+
+// serviceTypeOf returns the service type of a record name, such as "_ipp._tcp.local"
+// for "Office._ipp._tcp.local" or "_printer._sub._ipp._tcp.local", or an empty string
+func serviceTypeOf(name string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i := 0; i+1 < len(labels); i++ {
+		if strings.HasPrefix(labels[i], "_") && labels[i] != "_sub" && (labels[i+1] == "_tcp" || labels[i+1] == "_udp") {
+			return strings.Join(labels[i:], ".")
+		}
+	}
+	return ""
+}
+
+// answerServiceTypes returns the service types of the records of the answer and additional sections of dns
+func answerServiceTypes(dns *layers.DNS) (services []string) {
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Additionals} {
+		for _, record := range records {
+			service := serviceTypeOf(string(record.Name))
+			if service != "" && service != "_dns-sd._udp.local" && !containsString(services, service) {
+				services = append(services, service)
+			}
+		}
+	}
+	return
+}
+
+// recordQuery counts the service types asked for by a query sent on vlan
+func (usage *serviceUsage) recordQuery(dns *layers.DNS, vlan uint16, now time.Time) {
+	if dns == nil {
+		return
+	}
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	for _, question := range dns.Questions {
+		service := serviceTypeOf(string(question.Name))
+		if service == "" || service == "_dns-sd._udp.local" {
+			continue
+		}
+		key := serviceVLANKey{service: service, vlan: vlan}
+		element, ok := usage.queries[key]
+		if ok {
+			usage.queryOrder.MoveToBack(element)
+		} else {
+			element = usage.queryOrder.PushBack(&serviceQueryUsage{Service: service, VLAN: vlan})
+			usage.queries[key] = element
+			if usage.queryOrder.Len() > maxServiceUsageEntries {
+				oldest := usage.queryOrder.Remove(usage.queryOrder.Front()).(*serviceQueryUsage)
+				delete(usage.queries, serviceVLANKey{service: oldest.Service, vlan: oldest.VLAN})
+			}
+		}
+		query := element.Value.(*serviceQueryUsage)
+		query.Queries++
+		query.LastQuery = now
+	}
+}
+
+// recordAnswer accounts an answer of device of size bytes reflected to tags.
+// The traffic of answers about several service types is shared between them.
+func (usage *serviceUsage) recordAnswer(dns *layers.DNS, device macAddress, tags []uint16, size int) {
+	if dns == nil || len(tags) == 0 {
+		return
+	}
+	services := answerServiceTypes(dns)
+	if len(services) == 0 {
+		return
+	}
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	for _, service := range services {
+		key := serviceDeviceKey{service: service, device: device}
+		element, ok := usage.answers[key]
+		if ok {
+			usage.answerOrder.MoveToBack(element)
+		} else {
+			element = usage.answerOrder.PushBack(&serviceAnswerUsage{Service: service, Device: device, vlans: make(map[uint16]bool)})
+			usage.answers[key] = element
+			if usage.answerOrder.Len() > maxServiceUsageEntries {
+				oldest := usage.answerOrder.Remove(usage.answerOrder.Front()).(*serviceAnswerUsage)
+				delete(usage.answers, serviceDeviceKey{service: oldest.Service, device: oldest.Device})
+			}
+		}
+		answer := element.Value.(*serviceAnswerUsage)
+		answer.Answers++
+		answer.Bytes += uint64(size * len(tags) / len(services))
+		for _, tag := range tags {
+			answer.vlans[tag] = true
+		}
+	}
+}
+
+// report returns a copy of the statistics
+func (usage *serviceUsage) report() serviceUsageReport {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	report := serviceUsageReport{Since: usage.since, Answers: []serviceAnswerUsage{}, Queries: []serviceQueryUsage{}}
+	for _, element := range usage.answers {
+		answer := element.Value.(*serviceAnswerUsage)
+		copied := *answer
+		copied.VLANs = make([]uint16, 0, len(answer.vlans))
+		for tag := range answer.vlans {
+			copied.VLANs = append(copied.VLANs, tag)
+		}
+		sort.Slice(copied.VLANs, func(i, j int) bool { return copied.VLANs[i] < copied.VLANs[j] })
+		report.Answers = append(report.Answers, copied)
+	}
+	for _, element := range usage.queries {
+		report.Queries = append(report.Queries, *element.Value.(*serviceQueryUsage))
+	}
+	sort.Slice(report.Answers, func(i, j int) bool {
+		if report.Answers[i].Service != report.Answers[j].Service {
+			return report.Answers[i].Service < report.Answers[j].Service
+		}
+		return report.Answers[i].Device < report.Answers[j].Device
+	})
+	sort.Slice(report.Queries, func(i, j int) bool {
+		if report.Queries[i].Service != report.Queries[j].Service {
+			return report.Queries[i].Service < report.Queries[j].Service
+		}
+		return report.Queries[i].VLAN < report.Queries[j].VLAN
+	})
+	return report
+}
+
+func (usage *serviceUsage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage.report())
+}
+
+// filterSuggestion is a change of the configuration suggested by the service usage
+type filterSuggestion struct {
+	Service string     `json:"service"`
+	Device  macAddress `json:"device"`
+	VLANs   []uint16   `json:"vlans,omitempty"`
+	Message string     `json:"message"`
+}
+
+// suggestFilters reports the service types carrying more than minShare of the reflected traffic,
+// and the answers reflected to VLANs which never queried for their service type
+func suggestFilters(report serviceUsageReport, minShare float64) []filterSuggestion {
+	suggestions := []filterSuggestion{}
+	var total uint64
+	byService := make(map[string]uint64)
+	heaviest := make(map[string]serviceAnswerUsage)
+	for _, answer := range report.Answers {
+		total += answer.Bytes
+		byService[answer.Service] += answer.Bytes
+		if answer.Bytes > heaviest[answer.Service].Bytes {
+			heaviest[answer.Service] = answer
+		}
+	}
+	queried := make(map[serviceVLANKey]bool)
+	for _, query := range report.Queries {
+		queried[serviceVLANKey{service: query.Service, vlan: query.VLAN}] = true
+	}
+
+	services := make([]string, 0, len(byService))
+	for service := range byService {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if byService[services[i]] != byService[services[j]] {
+			return byService[services[i]] > byService[services[j]]
+		}
+		return services[i] < services[j]
+	})
+	for _, service := range services {
+		share := float64(byService[service]) / float64(total)
+		if total == 0 || share < minShare {
+			break
+		}
+		device := heaviest[service]
+		suggestions = append(suggestions, filterSuggestion{
+			Service: service,
+			Device:  device.Device,
+			Message: fmt.Sprintf("%.0f%% of the reflected traffic is %v, %.0f%% of it from %v: consider a TTL floor for it, or narrowing the shared pools of the device",
+				share*100, service, float64(device.Bytes)/float64(byService[service])*100, device.Device),
+		})
+	}
+
+	for _, answer := range report.Answers {
+		var unqueried []uint16
+		for _, tag := range answer.VLANs {
+			if !queried[serviceVLANKey{service: answer.Service, vlan: tag}] {
+				unqueried = append(unqueried, tag)
+			}
+		}
+		if len(unqueried) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("%v of %v is reflected to VLANs %v, where it was never queried: consider removing them from the shared pools of the device",
+			answer.Service, answer.Device, formatVLANList(unqueried))
+		if len(unqueried) == len(answer.VLANs) {
+			message = fmt.Sprintf("%v of %v was never queried by any VLAN it is reflected to: consider dropping it with a policy module, or not sharing the device",
+				answer.Service, answer.Device)
+		}
+		suggestions = append(suggestions, filterSuggestion{Service: answer.Service, Device: answer.Device, VLANs: unqueried, Message: message})
+	}
+	return suggestions
+}
+
+var suggestCommand = &command{
+	name:    "suggest",
+	summary: "Suggest configuration changes from the service usage of a running reflector",
+	setup:   setupSuggestCommand,
+}
+
+func setupSuggestCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:6060", "Address of the debug server of the running reflector")
+	share := flags.Float64("share", defaultSuggestShare, "Share of the reflected traffic above which a service type is reported")
+
+	return func(out *commandOutput, args []string) error {
+		var report serviceUsageReport
+		if err := callAPI(*addr, "", http.MethodGet, "/debug/service-usage", nil, &report); err != nil {
+			return fmt.Errorf("could not read service usage, was the reflector started with -debug? %v", err)
+		}
+		suggestions := suggestFilters(report, *share)
+		return out.print(suggestions, func(w io.Writer) {
+			printSuggestions(w, report.Since, suggestions)
+		})
+	}
+}
+
+func printSuggestions(w io.Writer, since time.Time, suggestions []filterSuggestion) {
+	observed := time.Since(since).Round(time.Minute)
+	fmt.Fprintf(w, "Based on %v of traffic.\n", observed)
+	if observed < suggestMinObservation {
+		fmt.Fprintf(w, "Services used less often than every %v may not have been seen yet, check again later.\n", observed)
+	}
+	if len(suggestions) == 0 {
+		fmt.Fprintln(w, "Nothing to suggest")
+		return
+	}
+	for _, suggestion := range suggestions {
+		fmt.Fprintf(w, "- %v\n", suggestion.Message)
+	}
+}
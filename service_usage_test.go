@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestServiceTypeOf(t *testing.T) {
+	tests := map[string]string{
+		"_googlecast._tcp.local":           "_googlecast._tcp.local",
+		"Living Room._airplay._tcp.local.": "_airplay._tcp.local",
+		"_printer._sub._ipp._tcp.local":    "_ipp._tcp.local",
+		"chromecast.local":                 "",
+		"4.3.2.1.in-addr.arpa":             "",
+	}
+	for name, expected := range tests {
+		if service := serviceTypeOf(name); service != expected {
+			t.Errorf("Error in serviceTypeOf(%q): got %q", name, service)
+		}
+	}
+}
+
+func TestServiceUsageLimit(t *testing.T) {
+	now := time.Now()
+	usage := newServiceUsage(now)
+	cast := createMockPTRAnswer("_googlecast._tcp.local", "TV._googlecast._tcp.local", 120)
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_googlecast._tcp.local"), Type: layers.DNSTypePTR}}}
+	for i := 0; i <= maxServiceUsageEntries; i++ {
+		usage.recordAnswer(cast, macAddress(fmt.Sprintf("aa:00:cc:00:%02x:%02x", i>>8, i&0xff)), []uint16{1234}, 100)
+		usage.recordQuery(query, uint16(i), now)
+	}
+	report := usage.report()
+	if len(report.Answers) != maxServiceUsageEntries || len(report.Queries) != maxServiceUsageEntries {
+		t.Errorf("Error in serviceUsage: expected %v answers and queries, got %v and %v", maxServiceUsageEntries, len(report.Answers), len(report.Queries))
+	}
+	if report.Answers[0].Device != "aa:00:cc:00:00:01" || report.Queries[0].VLAN != 1 {
+		t.Errorf("Error in serviceUsage: expected the least recently seen entries to be forgotten, got %+v and %+v", report.Answers[0], report.Queries[0])
+	}
+}
+
+func TestServiceUsage(t *testing.T) {
+	now := time.Now()
+	usage := newServiceUsage(now)
+	usage.recordQuery(&layers.DNS{Questions: []layers.DNSQuestion{
+		{Name: []byte("_googlecast._tcp.local"), Type: layers.DNSTypePTR},
+		{Name: []byte("_services._dns-sd._udp.local"), Type: layers.DNSTypePTR},
+	}}, 1234, now)
+	cast := createMockPTRAnswer("_googlecast._tcp.local", "TV._googlecast._tcp.local", 120)
+	usage.recordAnswer(cast, "aa:00:cc:00:ee:00", []uint16{1234}, 900)
+	usage.recordAnswer(cast, "aa:00:cc:00:ee:01", []uint16{1234}, 100)
+	spotify := createMockPTRAnswer("_spotify-connect._tcp.local", "TV._spotify-connect._tcp.local", 120)
+	usage.recordAnswer(spotify, "aa:00:cc:00:ee:00", []uint16{1234, 2483}, 100)
+	usage.recordAnswer(spotify, "aa:00:cc:00:ee:00", nil, 100)
+
+	report := usage.report()
+	if len(report.Queries) != 1 || report.Queries[0].Service != "_googlecast._tcp.local" || report.Queries[0].VLAN != 1234 {
+		t.Errorf("Error in recordQuery(): unexpected queries %+v", report.Queries)
+	}
+	if len(report.Answers) != 3 || report.Answers[2].Bytes != 200 || !reflect.DeepEqual(report.Answers[2].VLANs, []uint16{1234, 2483}) {
+		t.Errorf("Error in recordAnswer(): unexpected answers %+v", report.Answers)
+	}
+
+	suggestions := suggestFilters(report, 0.5)
+	if len(suggestions) != 2 {
+		t.Fatalf("Error in suggestFilters(): got %+v", suggestions)
+	}
+	if suggestions[0].Service != "_googlecast._tcp.local" || suggestions[0].Device != "aa:00:cc:00:ee:00" || !strings.HasPrefix(suggestions[0].Message, "83% of the reflected traffic") {
+		t.Errorf("Error in suggestFilters(): unexpected heavy service %+v", suggestions[0])
+	}
+	if suggestions[1].Service != "_spotify-connect._tcp.local" || !reflect.DeepEqual(suggestions[1].VLANs, []uint16{1234, 2483}) || !strings.Contains(suggestions[1].Message, "never queried by any VLAN") {
+		t.Errorf("Error in suggestFilters(): unexpected unqueried service %+v", suggestions[1])
+	}
+	if suggestions := suggestFilters(serviceUsageReport{}, 0.5); len(suggestions) != 0 {
+		t.Errorf("Error in suggestFilters(): nothing should be suggested without traffic, got %+v", suggestions)
+	}
+}
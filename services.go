@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// serviceInstance is a service instance announced by a device, such as "Office Printer._ipp._tcp.local"
+type serviceInstance struct {
+	Service  string `json:"service"`
+	Instance string `json:"instance"`
+	// Origin is the VLAN of the device announcing the instance
+	Origin uint16 `json:"origin"`
+	// VLANs maps the VLANs where the instance is visible to the expiry of its PTR record
+	VLANs map[uint16]time.Time `json:"vlans"`
+
+	// srcIP is the address of the device announcing the instance
+	srcIP net.IP
+}
+
+// Maximum number of service instances tracked: beyond it, the expired instances are forgotten, then the ones
+// expiring first
+const maxServiceInstances = 4096
+
+// serviceTable tracks which service instances are visible on each VLAN,
+// from the PTR records of the answers seen on their origin VLAN and reflected to other VLANs
+type serviceTable struct {
+	mutex     sync.Mutex
+	instances map[string]*serviceInstance
+}
+
+func newServiceTable() *serviceTable {
+	return &serviceTable{instances: make(map[string]*serviceInstance)}
+}
+
+// observe records the PTR records of an answer sent by srcIP, visible on the given VLANs, the first one being its origin,
+// and returns the instances discovered by this answer
+func (table *serviceTable) observe(dns *layers.DNS, srcIP net.IP, vlans []uint16, now time.Time) (discovered []serviceInstance) {
+	if dns == nil || len(vlans) == 0 {
+		return
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	records := append(append([]layers.DNSResourceRecord{}, dns.Answers...), dns.Additionals...)
+	for _, record := range records {
+		if record.Type != layers.DNSTypePTR || len(record.PTR) == 0 {
+			continue
+		}
+		key := strings.ToLower(string(record.PTR))
+		instance, ok := table.instances[key]
+		if !ok {
+			instance = &serviceInstance{
+				Service:  strings.ToLower(string(record.Name)),
+				Instance: string(record.PTR),
+				VLANs:    make(map[uint16]time.Time),
+			}
+			table.add(key, instance, now)
+		}
+		instance.Origin, instance.srcIP = vlans[0], srcIP
+		// A TTL of 0 is a goodbye packet, the instance is withdrawn right away
+		expiry := now.Add(time.Duration(record.TTL) * time.Second)
+		for _, vlan := range vlans {
+			instance.VLANs[vlan] = expiry
+		}
+		if !ok && record.TTL > 0 {
+			discovered = append(discovered, *instance)
+		}
+	}
+	return
+}
+
+// add stores a new instance, making room for it when the table is full.
+// It must be called with the mutex held.
+func (table *serviceTable) add(key string, instance *serviceInstance, now time.Time) {
+	if len(table.instances) >= maxServiceInstances {
+		var live []string
+		for key, instance := range table.instances {
+			if now.Before(instance.expiry()) {
+				live = append(live, key)
+			} else {
+				delete(table.instances, key)
+			}
+		}
+		// Forget a quarter of the table at once, so that a flood of announcements is not sorted for each instance
+		if len(live) >= maxServiceInstances {
+			sort.Slice(live, func(i, j int) bool {
+				return table.instances[live[i]].expiry().Before(table.instances[live[j]].expiry())
+			})
+			for _, key := range live[:len(live)-maxServiceInstances*3/4] {
+				delete(table.instances, key)
+			}
+		}
+	}
+	table.instances[key] = instance
+}
+
+// expiry returns when the instance stops being visible on all its VLANs
+func (instance *serviceInstance) expiry() (expiry time.Time) {
+	for _, vlanExpiry := range instance.VLANs {
+		if vlanExpiry.After(expiry) {
+			expiry = vlanExpiry
+		}
+	}
+	return
+}
+
+// isVisible tells whether an instance of service is visible on vlan.
+// An empty instance name matches any instance of the service.
+func (table *serviceTable) isVisible(service, instance string, vlan uint16, now time.Time) bool {
+	service = fullServiceName(service)
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	if instance != "" {
+		found, ok := table.instances[strings.ToLower(instance)+"."+service]
+		return ok && now.Before(found.VLANs[vlan])
+	}
+	for _, found := range table.instances {
+		if found.Service == service && now.Before(found.VLANs[vlan]) {
+			return true
+		}
+	}
+	return false
+}
+
+// withdraw removes the instances reflected to vlan, e.g. when it is drained, and returns them
+func (table *serviceTable) withdraw(vlan uint16, now time.Time) (withdrawn []serviceInstance) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, instance := range table.instances {
+		if instance.Origin != vlan && now.Before(instance.VLANs[vlan]) {
+			delete(instance.VLANs, vlan)
+			withdrawn = append(withdrawn, *instance)
+		}
+	}
+	return
+}
+
+// fullServiceName turns a service type such as "_ipp._tcp" into the name used in PTR records
+func fullServiceName(service string) string {
+	service = strings.TrimSuffix(strings.ToLower(service), ".")
+	if !strings.HasSuffix(service, ".local") {
+		service += ".local"
+	}
+	return service
+}
+
+// belongsToService tells whether a record name is the full name of service, such as "_airplay._tcp.local",
+// or the name of one of its instances, such as "Living Room._airplay._tcp.local"
+func belongsToService(name []byte, service string) bool {
+	lowerName := strings.ToLower(string(name))
+	return lowerName == service || strings.HasSuffix(lowerName, "."+service)
+}
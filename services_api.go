@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the JSON representation of the services, bumped on incompatible changes only
+const servicesAPIVersion = 1
+
+// apiServiceVisibility tells until when a service instance is visible on a VLAN
+type apiServiceVisibility struct {
+	VLAN    uint16    `json:"vlan"`
+	Expires time.Time `json:"expires"`
+}
+
+// apiService is the stable JSON representation of a service instance, documented by servicesOpenAPISpec
+type apiService struct {
+	Service    string                 `json:"service"`
+	Instance   string                 `json:"instance"`
+	OriginVLAN uint16                 `json:"origin_vlan"`
+	Address    string                 `json:"address,omitempty"`
+	VLANs      []apiServiceVisibility `json:"vlans"`
+}
+
+type apiServiceList struct {
+	Version  int          `json:"version"`
+	Services []apiService `json:"services"`
+}
+
+// list returns the instances visible on at least one VLAN, sorted by service and instance name
+func (table *serviceTable) list(now time.Time) []apiService {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	services := []apiService{}
+	for _, instance := range table.instances {
+		service := apiService{Service: instance.Service, Instance: instance.Instance, OriginVLAN: instance.Origin, VLANs: []apiServiceVisibility{}}
+		if instance.srcIP != nil {
+			service.Address = instance.srcIP.String()
+		}
+		for vlan, expires := range instance.VLANs {
+			if now.Before(expires) {
+				service.VLANs = append(service.VLANs, apiServiceVisibility{VLAN: vlan, Expires: expires})
+			}
+		}
+		if len(service.VLANs) == 0 {
+			continue
+		}
+		sort.Slice(service.VLANs, func(i, j int) bool { return service.VLANs[i].VLAN < service.VLANs[j].VLAN })
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Service != services[j].Service {
+			return services[i].Service < services[j].Service
+		}
+		return services[i].Instance < services[j].Instance
+	})
+	return services
+}
+
+// servicesAPI serves the services visible on each VLAN on /api/v1/services, optionally filtered
+// by ?service=_ipp._tcp and ?vlan=20, and its OpenAPI description on /api/v1/openapi.json
+type servicesAPI struct {
+	services *serviceTable
+}
+
+func (api servicesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Path == "/api/v1/openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(servicesOpenAPISpec))
+		return
+	}
+	services := api.services.list(time.Now())
+	if service := r.URL.Query().Get("service"); service != "" {
+		services = filterServices(services, func(s *apiService) bool { return s.Service == fullServiceName(service) })
+	}
+	if param := r.URL.Query().Get("vlan"); param != "" {
+		vlan, err := strconv.ParseUint(param, 10, 12)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid VLAN tag")
+			return
+		}
+		services = filterServices(services, func(s *apiService) bool {
+			for _, visibility := range s.VLANs {
+				if visibility.VLAN == uint16(vlan) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiServiceList{Version: servicesAPIVersion, Services: services})
+}
+
+func filterServices(services []apiService, keep func(*apiService) bool) []apiService {
+	filtered := []apiService{}
+	for i := range services {
+		if keep(&services[i]) {
+			filtered = append(filtered, services[i])
+		}
+	}
+	return filtered
+}
+
+// servicesOpenAPISpec describes the services API. Fields may be added within a version, never removed or changed.
+var servicesOpenAPISpec = strings.TrimSpace(`
+{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "bonjour-reflector services API",
+    "description": "Service instances seen by the reflector, and the VLANs where they are visible.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearerAuth": []}],
+  "paths": {
+    "/services": {
+      "get": {
+        "summary": "List the service instances visible on at least one VLAN",
+        "operationId": "listServices",
+        "parameters": [
+          {"name": "service", "in": "query", "description": "Only list the instances of this service type, such as _ipp._tcp", "schema": {"type": "string"}},
+          {"name": "vlan", "in": "query", "description": "Only list the instances visible on this VLAN", "schema": {"type": "integer", "minimum": 0, "maximum": 4095}}
+        ],
+        "responses": {
+          "200": {"description": "Service instances, sorted by service type and instance name", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceList"}}}},
+          "400": {"description": "Invalid parameter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"description": "Missing or invalid API token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer", "description": "The api_token of the configuration"}
+    },
+    "schemas": {
+      "ServiceList": {
+        "type": "object",
+        "required": ["version", "services"],
+        "properties": {
+          "version": {"type": "integer", "description": "Version of the representation, 1"},
+          "services": {"type": "array", "items": {"$ref": "#/components/schemas/Service"}}
+        }
+      },
+      "Service": {
+        "type": "object",
+        "required": ["service", "instance", "origin_vlan", "vlans"],
+        "properties": {
+          "service": {"type": "string", "description": "Full service type, such as _ipp._tcp.local"},
+          "instance": {"type": "string", "description": "Full instance name, such as Office Printer._ipp._tcp.local"},
+          "origin_vlan": {"type": "integer", "description": "VLAN of the device announcing the instance"},
+          "address": {"type": "string", "description": "IP address of the device announcing the instance"},
+          "vlans": {"type": "array", "items": {"$ref": "#/components/schemas/Visibility"}}
+        }
+      },
+      "Visibility": {
+        "type": "object",
+        "required": ["vlan", "expires"],
+        "properties": {
+          "vlan": {"type": "integer", "description": "VLAN where the instance is visible"},
+          "expires": {"type": "string", "format": "date-time", "description": "Expiry of the PTR record of the instance on this VLAN"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {"type": "string"}
+        }
+      }
+    }
+  }
+}`)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServicesAPI(t *testing.T) {
+	now := time.Now()
+	table := newServiceTable()
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, []uint16{10, 20}, now)
+	table.observe(createMockPTRAnswer("_airplay._tcp.local", "Living Room._airplay._tcp.local", 120), srcIPv4Test, []uint16{30}, now)
+	table.observe(createMockPTRAnswer("_airplay._tcp.local", "Gone._airplay._tcp.local", 0), srcIPv4Test, []uint16{30}, now)
+	api := servicesAPI{table}
+
+	tests := map[string][]string{
+		"/api/v1/services":                   {"Living Room._airplay._tcp.local", "Office Printer._ipp._tcp.local"},
+		"/api/v1/services?service=_ipp._tcp": {"Office Printer._ipp._tcp.local"},
+		"/api/v1/services?vlan=30":           {"Living Room._airplay._tcp.local"},
+		"/api/v1/services?vlan=40":           {},
+	}
+	for url, expected := range tests {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		var list apiServiceList
+		if err := json.NewDecoder(recorder.Body).Decode(&list); err != nil || list.Version != servicesAPIVersion {
+			t.Fatalf("Error in ServeHTTP(%v): expected a version %v list, got %+v (%v)", url, servicesAPIVersion, list, err)
+		}
+		instances := []string{}
+		for _, service := range list.Services {
+			instances = append(instances, service.Instance)
+		}
+		if !reflect.DeepEqual(instances, expected) {
+			t.Errorf("Error in ServeHTTP(%v): expected %v, got %v", url, expected, instances)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/services?vlan=abc", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Error in ServeHTTP(): expected 400 for an invalid VLAN, got %v", recorder.Code)
+	}
+}
+
+// jsonFields returns the JSON names of the fields of a struct type
+func jsonFields(v interface{}) (fields []string) {
+	structType := reflect.TypeOf(v)
+	for i := 0; i < structType.NumField(); i++ {
+		fields = append(fields, strings.Split(structType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(fields)
+	return
+}
+
+func TestServicesOpenAPISpec(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal([]byte(servicesOpenAPISpec), &spec); err != nil {
+		t.Fatalf("Error in servicesOpenAPISpec: invalid JSON: %v", err)
+	}
+	// The documented schemas must match the JSON representation
+	for name, v := range map[string]interface{}{"ServiceList": apiServiceList{}, "Service": apiService{}, "Visibility": apiServiceVisibility{}} {
+		var properties []string
+		for property := range spec.Components.Schemas[name].Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		if expected := jsonFields(v); !reflect.DeepEqual(properties, expected) {
+			t.Errorf("Error in servicesOpenAPISpec: expected properties %v for %v, got %v", expected, name, properties)
+		}
+	}
+}
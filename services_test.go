@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func createMockPTRAnswer(service, instance string, ttl uint32) *layers.DNS {
+	return &layers.DNS{
+		QR: true,
+		Answers: []layers.DNSResourceRecord{layers.DNSResourceRecord{
+			Name:  []byte(service),
+			Type:  layers.DNSTypePTR,
+			Class: layers.DNSClassIN,
+			TTL:   ttl,
+			PTR:   []byte(instance),
+		}},
+	}
+}
+
+func TestServiceTable(t *testing.T) {
+	table := newServiceTable()
+	now := time.Now()
+
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, []uint16{10, 20}, now)
+
+	tests := []struct {
+		service, instance string
+		vlan              uint16
+		at                time.Time
+		expected          bool
+	}{
+		{"_ipp._tcp", "Office Printer", 10, now, true},
+		{"_ipp._tcp", "office printer", 20, now, true},
+		{"_ipp._tcp.local.", "", 20, now, true},
+		{"_ipp._tcp", "Office Printer", 30, now, false},
+		{"_ipp._tcp", "Lobby Printer", 10, now, false},
+		{"_airplay._tcp", "", 10, now, false},
+		{"_ipp._tcp", "Office Printer", 10, now.Add(3 * time.Minute), false},
+	}
+	for _, test := range tests {
+		if table.isVisible(test.service, test.instance, test.vlan, test.at) != test.expected {
+			t.Errorf("Error in isVisible() for %+v", test)
+		}
+	}
+
+	// Goodbye packets withdraw the instance
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 0), srcIPv4Test, []uint16{10}, now)
+	if table.isVisible("_ipp._tcp", "Office Printer", 10, now) {
+		t.Error("Error in observe(): goodbye packets should withdraw the instance")
+	}
+}
+
+func TestServiceTableLimit(t *testing.T) {
+	table := newServiceTable()
+	now := time.Now()
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Expired._ipp._tcp.local", 60), srcIPv4Test, []uint16{10}, now.Add(-time.Hour))
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Long-lived._ipp._tcp.local", 7200), srcIPv4Test, []uint16{10}, now)
+	for i := 2; i < maxServiceInstances; i++ {
+		instance := fmt.Sprintf("Printer %v._ipp._tcp.local", i)
+		table.observe(createMockPTRAnswer("_ipp._tcp.local", instance, 120), srcIPv4Test, []uint16{10}, now)
+	}
+	// The expired instance makes room for the next one, then a quarter of the table expiring first is forgotten
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "New._ipp._tcp.local", 120), srcIPv4Test, []uint16{10}, now)
+	if len(table.instances) != maxServiceInstances || table.isVisible("_ipp._tcp", "Expired", 10, now.Add(-time.Hour)) {
+		t.Errorf("Error in observe(): expected the expired instance to be forgotten, got %v instances", len(table.instances))
+	}
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Newer._ipp._tcp.local", 120), srcIPv4Test, []uint16{10}, now)
+	if len(table.instances) != maxServiceInstances*3/4+1 {
+		t.Errorf("Error in observe(): expected %v instances, got %v", maxServiceInstances*3/4+1, len(table.instances))
+	}
+	if !table.isVisible("_ipp._tcp", "Long-lived", 10, now) || !table.isVisible("_ipp._tcp", "Newer", 10, now) {
+		t.Error("Error in observe(): the instances expiring last should be kept")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Delay given on shutdown to the frames delayed by the reflection jitter or the pacing of wireless VLANs
+const shutdownFlushTimeout = 2 * time.Second
+
+// stopOnSignal stops the capture on SIGINT or SIGTERM, so that the packets already captured are reflected
+// before exiting. A second signal kills the process.
+func stopOnSignal(capture trunkCapture) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	logger.infof("Stopping on %v, reflecting the packets already captured", sig)
+	capture.stop()
+}
+
+// after writes a frame after delay, from a timer goroutine. The frames waiting for their timer are flushed on shutdown.
+func (r *reflector) after(delay time.Duration, write func()) {
+	atomic.AddInt32(&r.delayedWrites, 1)
+	time.AfterFunc(delay, func() {
+		defer atomic.AddInt32(&r.delayedWrites, -1)
+		write()
+	})
+}
+
+// flush waits for the delayed frames to be written, for timeout at most, and returns the number of frames still waiting
+func (r *reflector) flush(timeout time.Duration) int32 {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := atomic.LoadInt32(&r.delayedWrites)
+		if pending == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shutdown reflects the packets queued in the pipelines and the delayed frames once the capture is stopped,
+// closes the handles of the capture and of the egress interfaces, and logs the traffic reflected since startup
+func (r *reflector) shutdown(capture trunkCapture, timeout time.Duration) {
+	if r.pipelines != nil {
+		r.pipelines.close()
+	}
+	if pending := r.flush(timeout); pending > 0 {
+		logger.warnf("%v delayed frames were not written before shutdown", pending)
+	}
+
+	r.writeMutex.Lock()
+	r.closed = true
+	if egress, ok := r.handle.(*egressWriter); ok {
+		egress.Close()
+	}
+	capture.Close()
+	r.writeMutex.Unlock()
+
+	var frames, bytes uint64
+	vlans := make(map[uint16]bool)
+	for _, usage := range r.bandwidth.snapshot("", 0) {
+		frames, bytes = frames+usage.Frames, bytes+usage.Bytes
+		vlans[usage.VLAN] = true
+	}
+	logger.infof("Stopped after reflecting %v frames (%v bytes) into %v VLANs", frames, bytes, len(vlans))
+	r.stats.exit(time.Now())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	handle := &mockCapture{}
+	capture, err := newFailoverCapture([]string{"eth0"}, func(string) (captureHandle, error) { return handle, nil })
+	if err != nil {
+		t.Fatalf("Error in newFailoverCapture(): %v", err)
+	}
+	capture.stop()
+	if _, _, err := capture.ReadPacketData(); err != io.EOF {
+		t.Errorf("Error in stop(): expected the reads to return io.EOF, got %v", err)
+	}
+
+	// The delayed frames are flushed before the handle is closed
+	inv, _ := loadInventory("", defaultInventorySize)
+	hits, _ := loadRuleHits("", nil)
+	r := newReflector(brconfig{}, inv, hits, capture, brMACTest)
+	r.after(20*time.Millisecond, func() { r.write(createMockTaggedFrame(vlanIdentifierTest)) })
+	r.shutdown(capture, time.Second)
+	if len(handle.frames) != 1 || !handle.closed {
+		t.Errorf("Error in shutdown(): expected the delayed frame to be injected and the handle closed, got %v frames", len(handle.frames))
+	}
+	r.write(createMockTaggedFrame(vlanIdentifierTest))
+	if len(handle.frames) != 1 {
+		t.Error("Error in write(): frames should not be injected after shutdown")
+	}
+}
+
+func TestMultiCaptureStop(t *testing.T) {
+	handles := []*mockCapture{{}, {}}
+	var opened int
+	capture, err := newMultiCapture([]string{"eth0", "eth1"}, func(string) (captureHandle, error) {
+		opened++
+		return handles[opened-1], nil
+	})
+	if err != nil {
+		t.Fatalf("Error in newMultiCapture(): %v", err)
+	}
+	capture.stop()
+	// The frames already captured are read before io.EOF
+	for i := 0; ; i++ {
+		if _, _, err := capture.ReadPacketData(); err == io.EOF {
+			break
+		}
+		if i > trunkFramesCapacity+len(handles) {
+			t.Fatal("Error in stop(): the reads should return io.EOF once the captured frames are read")
+		}
+	}
+	capture.Close()
+	if !handles[0].closed || !handles[1].closed {
+		t.Error("Error in Close(): every trunk should be closed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default delay between two checks of the expected services
+const defaultSLOCheckInterval = 30 * time.Second
+
+var (
+	// Current state of each expected service, 1 when it is not visible, exposed on /debug/vars
+	sloViolations = expvar.NewMap("slo_violations")
+	// Number of times an expected service stopped being visible
+	sloViolationEvents = expvar.NewInt("slo_violation_events")
+)
+
+// serviceExpectation declares a service which must be visible on a VLAN
+type serviceExpectation struct {
+	Service  string `toml:"service" json:"service"`
+	Instance string `toml:"instance" json:"instance,omitempty"`
+	VLAN     uint16 `toml:"vlan" json:"vlan"`
+}
+
+func (expectation serviceExpectation) String() string {
+	if expectation.Instance == "" {
+		return fmt.Sprintf("%v@%v", expectation.Service, expectation.VLAN)
+	}
+	return fmt.Sprintf("%v.%v@%v", expectation.Instance, expectation.Service, expectation.VLAN)
+}
+
+type sloStatus struct {
+	serviceExpectation
+	Visible    bool      `json:"visible"`
+	Since      time.Time `json:"since"`
+	Violations uint64    `json:"violations"`
+}
+
+// sloMonitor continuously verifies that the expected services are visible on their VLANs
+type sloMonitor struct {
+	mutex    sync.Mutex
+	services *serviceTable
+	statuses []*sloStatus
+}
+
+func newSLOMonitor(expectations []serviceExpectation, services *serviceTable) *sloMonitor {
+	monitor := &sloMonitor{services: services}
+	for _, expectation := range expectations {
+		monitor.statuses = append(monitor.statuses, &sloStatus{serviceExpectation: expectation, Visible: true})
+	}
+	return monitor
+}
+
+// run checks the expected services every interval.
+// The first check only happens after one interval, leaving time for the services to be announced.
+func (monitor *sloMonitor) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		monitor.check(now)
+	}
+}
+
+func (monitor *sloMonitor) check(now time.Time) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	for _, status := range monitor.statuses {
+		visible := monitor.services.isVisible(status.Service, status.Instance, status.VLAN, now)
+		if visible == status.Visible && !status.Since.IsZero() {
+			continue
+		}
+		if !visible {
+			status.Violations++
+			sloViolationEvents.Add(1)
+			logger.warnf("SLO violation: %v is not visible", status.serviceExpectation)
+		} else if !status.Since.IsZero() {
+			logger.infof("SLO restored: %v is visible again", status.serviceExpectation)
+		}
+		status.Visible, status.Since = visible, now
+
+		violated := new(expvar.Int)
+		if !visible {
+			violated.Set(1)
+		}
+		sloViolations.Set(status.serviceExpectation.String(), violated)
+	}
+}
+
+func (monitor *sloMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	monitor.mutex.Lock()
+	statuses := make([]sloStatus, 0, len(monitor.statuses))
+	for _, status := range monitor.statuses {
+		statuses = append(statuses, *status)
+	}
+	monitor.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLOMonitorCheck(t *testing.T) {
+	table := newServiceTable()
+	expectation := serviceExpectation{Service: "_ipp._tcp", Instance: "Office Printer", VLAN: 10}
+	monitor := newSLOMonitor([]serviceExpectation{expectation}, table)
+	now := time.Now()
+	eventsBefore := sloViolationEvents.Value()
+
+	monitor.check(now)
+	if monitor.statuses[0].Visible || monitor.statuses[0].Violations != 1 || sloViolationEvents.Value() != eventsBefore+1 {
+		t.Errorf("Error in check(): missing service should be a violation, got %+v", monitor.statuses[0])
+	}
+	if sloViolations.Get(expectation.String()).String() != "1" {
+		t.Error("Error in check(): violation should be exposed")
+	}
+
+	// A violation lasting several checks is only counted once
+	monitor.check(now.Add(time.Second))
+	if monitor.statuses[0].Violations != 1 {
+		t.Errorf("Error in check(): ongoing violation counted again, got %+v", monitor.statuses[0])
+	}
+
+	table.observe(createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), srcIPv4Test, []uint16{10}, now)
+	monitor.check(now.Add(2 * time.Second))
+	if !monitor.statuses[0].Visible || sloViolations.Get(expectation.String()).String() != "0" {
+		t.Errorf("Error in check(): visible service should restore the SLO, got %+v", monitor.statuses[0])
+	}
+}
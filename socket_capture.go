@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/L3Nerd/bonjour-reflector/transport"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Capture modes: raw capture of the VLAN trunk, or UDP multicast sockets bound to its VLAN subinterfaces
+const (
+	capturePcap   = "pcap"
+	captureSocket = "socket"
+)
+
+// Linux lists the neighbours of the host, with their MAC address, in this file
+const linuxARPTablePath = "/proc/net/arp"
+
+// Minimal delay between two reads of the ARP table, when the MAC address of a sender is unknown
+const arpRefreshInterval = time.Second
+
+// Delay before reading again from a failing socket, doubled after each failure up to captureRetryDelay
+const socketRetryDelay = 100 * time.Millisecond
+
+// captureHandle reads the frames of the VLAN trunk, and injects frames into it
+type captureHandle = transport.Handle
+
+// receivedDatagram is an mDNS datagram received on the subinterface of a VLAN
+type receivedDatagram struct {
+	tag     uint16
+	src     *net.UDPAddr
+	payload []byte
+	time    time.Time
+}
+
+// socketCapture is a captureHandle for the environments where promiscuous capture is impossible.
+// Datagrams received by the multicast socket of each VLAN subinterface are turned into tagged frames,
+// and the frames written by the reflector are sent as datagrams through the socket of their VLAN.
+// Only IPv4 is supported, and the IP TTL of the received packets is unknown.
+type socketCapture struct {
+	conns     map[uint16]net.PacketConn
+	localIPs  map[string]bool
+	datagrams chan receivedDatagram
+	arp       *arpTable
+	// done is closed on shutdown, interrupting the reads
+	done  chan struct{}
+	mutex sync.Mutex
+	// failures holds the last read error of the VLANs whose socket fails, until it can be read from again
+	failures map[uint16]error
+}
+
+// openSocketCapture opens a multicast socket on the subinterface of each VLAN of the configuration
+func openSocketCapture(cfg *brconfig) (*socketCapture, error) {
+	file, err := os.Open(linuxVLANConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the VLAN subinterfaces: %v", err)
+	}
+	subinterfaces := parseVLANConfig(file)[cfg.NetInterface]
+	file.Close()
+
+	capture := &socketCapture{
+		conns:     make(map[uint16]net.PacketConn),
+		localIPs:  make(map[string]bool),
+		datagrams: make(chan receivedDatagram, 100),
+		arp:       &arpTable{path: linuxARPTablePath},
+		done:      make(chan struct{}),
+		failures:  make(map[uint16]error),
+	}
+	byVLAN := make(map[uint16]string)
+	for _, sub := range subinterfaces {
+		byVLAN[sub.VLAN] = sub.Name
+	}
+	for _, tag := range cfg.configuredVLANs() {
+		name, ok := byVLAN[tag]
+		if !ok {
+			logger.warnf("no subinterface of %v for VLAN %v, its traffic is not reflected", cfg.NetInterface, tag)
+			continue
+		}
+		intf, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := listenMulticast(intf)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen for mDNS on %v: %v", name, err)
+		}
+		ips, _ := interfaceIPs(name)
+		for _, ip := range ips {
+			capture.localIPs[ip.String()] = true
+		}
+		capture.conns[tag] = conn
+		go capture.receive(tag, conn)
+	}
+	if len(capture.conns) == 0 {
+		return nil, fmt.Errorf("no VLAN subinterface of %v to listen on", cfg.NetInterface)
+	}
+	return capture, nil
+}
+
+// receive reads the datagrams of the socket of a VLAN until shutdown. Reads failing otherwise are retried after a
+// growing delay, the capture being reported as degraded meanwhile.
+func (capture *socketCapture) receive(tag uint16, conn net.PacketConn) {
+	delay, failing := socketRetryDelay, false
+	for {
+		buf := make([]byte, 9000)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if capture.isStopped() {
+				return
+			}
+			if !failing {
+				logger.warnf("Could not read from the socket of VLAN %v, retrying: %v", tag, err)
+			}
+			failing = true
+			capture.setFailure(tag, err)
+			select {
+			case <-capture.done:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > captureRetryDelay {
+				delay = captureRetryDelay
+			}
+			continue
+		}
+		if failing {
+			logger.infof("Reading from the socket of VLAN %v again", tag)
+			delay, failing = socketRetryDelay, false
+			capture.setFailure(tag, nil)
+		}
+		src, ok := addr.(*net.UDPAddr)
+		// Packets sent by this host, including the reflected ones, are skipped
+		if !ok || capture.localIPs[src.IP.String()] {
+			continue
+		}
+		capture.datagrams <- receivedDatagram{tag: tag, src: src, payload: buf[:n], time: time.Now()}
+	}
+}
+
+// ReadPacketData returns the next received datagram, as the tagged frame a raw capture would have seen
+func (capture *socketCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var datagram receivedDatagram
+	select {
+	case datagram = <-capture.datagrams:
+	case <-capture.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	srcMAC := capture.arp.lookup(datagram.src.IP, datagram.time)
+	data, err := socketFrame(datagram.tag, srcMAC, datagram.src, datagram.payload)
+	info := gopacket.CaptureInfo{Timestamp: datagram.time, CaptureLength: len(data), Length: len(data)}
+	return data, info, err
+}
+
+// setFailure records the read error of the socket of a VLAN, or clears it when err is nil
+func (capture *socketCapture) setFailure(tag uint16, err error) {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	if err == nil {
+		delete(capture.failures, tag)
+	} else {
+		capture.failures[tag] = err
+	}
+}
+
+// degraded describes the sockets which cannot be read from, or returns an empty string when there are none
+func (capture *socketCapture) degraded() string {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	var failures []string
+	for tag, err := range capture.failures {
+		failures = append(failures, fmt.Sprintf("VLAN %v: %v", tag, err))
+	}
+	sort.Strings(failures)
+	return strings.Join(failures, "; ")
+}
+
+func (capture *socketCapture) isStopped() bool {
+	select {
+	case <-capture.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop interrupts the reads, the sockets being kept open for the frames still to be injected
+func (capture *socketCapture) Stop() {
+	close(capture.done)
+}
+
+// Close closes the socket of every VLAN
+func (capture *socketCapture) Close() {
+	for _, conn := range capture.conns {
+		conn.Close()
+	}
+}
+
+// socketFrame builds the frame carrying payload, sent by src on the VLAN tag to the mDNS multicast group
+func socketFrame(tag uint16, srcMAC net.HardwareAddr, src *net.UDPAddr, payload []byte) ([]byte, error) {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: src.IP.To4(), DstIP: net.IP{224, 0, 0, 251}}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMAC, DstMAC: mDNSMulticastMAC, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, gopacket.Payload(payload))
+	return buf.Bytes(), err
+}
+
+// WritePacketData sends the UDP payload of a frame through the socket of its VLAN, to its destination address
+func (capture *socketCapture) WritePacketData(data []byte) error {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok {
+		return fmt.Errorf("frame without VLAN tag")
+	}
+	ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return fmt.Errorf("only IPv4 frames can be sent in %v capture mode", captureSocket)
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return fmt.Errorf("frame without UDP layer")
+	}
+	conn, ok := capture.conns[dot1q.VLANIdentifier]
+	if !ok {
+		return fmt.Errorf("no socket for VLAN %v", dot1q.VLANIdentifier)
+	}
+	_, err := conn.WriteTo(udp.Payload, &net.UDPAddr{IP: ipv4.DstIP, Port: int(udp.DstPort)})
+	return err
+}
+
+// arpTable resolves the MAC address of the senders, which sockets do not expose
+type arpTable struct {
+	mutex    sync.Mutex
+	path     string
+	entries  map[string]net.HardwareAddr
+	lastRead time.Time
+}
+
+// lookup returns the MAC address of ip, or an all-zero address when it is unknown
+func (table *arpTable) lookup(ip net.IP, now time.Time) net.HardwareAddr {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if mac, ok := table.entries[ip.String()]; ok {
+		return mac
+	}
+	if now.Sub(table.lastRead) >= arpRefreshInterval {
+		table.lastRead = now
+		if file, err := os.Open(table.path); err == nil {
+			table.entries = parseARPTable(file)
+			file.Close()
+		}
+	}
+	if mac, ok := table.entries[ip.String()]; ok {
+		return mac
+	}
+	return make(net.HardwareAddr, 6)
+}
+
+// parseARPTable reads the MAC address of each neighbour from the content of /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.10.7     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0.10
+func parseARPTable(r io.Reader) map[string]net.HardwareAddr {
+	entries := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		entries[fields[0]] = mac
+	}
+	return entries
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenMulticast returns a socket receiving the mDNS traffic of intf only, and sending to it with a TTL of 255.
+// Looped back multicast is disabled, so that the reflector does not receive its own packets.
+func listenMulticast(intf *net.Interface) (net.PacketConn, error) {
+	config := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return controlSocket(c, func(fd int) error {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return err
+			}
+			return syscall.BindToDevice(fd, intf.Name)
+		})
+	}}
+	conn, err := config.ListenPacket(context.Background(), "udp4", "224.0.0.251:5353")
+	if err != nil {
+		return nil, err
+	}
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err == nil {
+		err = controlSocket(raw, func(fd int) error {
+			mreq := &syscall.IPMreqn{Multiaddr: [4]byte{224, 0, 0, 251}, Ifindex: int32(intf.Index)}
+			if err := syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq); err != nil {
+				return err
+			}
+			if err := syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(intf.Index)}); err != nil {
+				return err
+			}
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255); err != nil {
+				return err
+			}
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0)
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// controlSocket runs fn on the file descriptor of c, and returns the first error
+func controlSocket(c syscall.RawConn, fn func(fd int) error) error {
+	var fnErr error
+	if err := c.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenMulticast is only implemented on Linux, where sockets can be bound to a VLAN subinterface
+func listenMulticast(intf *net.Interface) (net.PacketConn, error) {
+	return nil, fmt.Errorf("%v capture mode is only supported on Linux", captureSocket)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSocketFrame(t *testing.T) {
+	payload := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 4, 'h', 'o', 's', 't', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0, 1}
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.10.7"), Port: 5353}
+	data, err := socketFrame(10, srcMACTest, src, payload)
+	if err != nil {
+		t.Fatalf("Error in socketFrame(): %v", err)
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	bonjourPacket, ok := parseBonjourPacket(packet, brMACTest)
+	if !ok || *bonjourPacket.vlanTag != 10 || bonjourPacket.srcMAC.String() != srcMACTest.String() ||
+		!bonjourPacket.srcIP.Equal(src.IP) || bonjourPacket.srcPort != 5353 || !bonjourPacket.isDNSQuery {
+		t.Errorf("Error in socketFrame(): expected a query of 192.168.10.7 on VLAN 10, got %+v", bonjourPacket)
+	}
+}
+
+func TestSocketCaptureWrite(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receiver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	capture := &socketCapture{conns: map[uint16]net.PacketConn{20: conn}}
+
+	dst := receiver.LocalAddr().(*net.UDPAddr)
+	ipv4 := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 20, 2}, DstIP: dst.IP}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: layers.UDPPort(dst.Port)}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	frame := func(tag uint16) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{SrcMAC: brMACTest, DstMAC: dstMACTest, EthernetType: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+			ipv4, udp, gopacket.Payload("mdns"))
+		return buf.Bytes()
+	}
+
+	if err := capture.WritePacketData(frame(20)); err != nil {
+		t.Fatalf("Error in WritePacketData(): %v", err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "mdns" {
+		t.Errorf("Error in WritePacketData(): expected the UDP payload to be sent, got %q (%v)", buf[:n], err)
+	}
+	if err := capture.WritePacketData(frame(30)); err == nil || !strings.Contains(err.Error(), "VLAN 30") {
+		t.Errorf("Error in WritePacketData(): expected an error for a VLAN without socket, got %v", err)
+	}
+}
+
+// flakyConn fails its first reads, then returns a datagram and blocks until closed
+type flakyConn struct {
+	net.PacketConn
+	failures int
+	reads    int
+	closed   chan struct{}
+}
+
+func (conn *flakyConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	if conn.reads++; conn.reads <= conn.failures {
+		return 0, nil, errors.New("no buffer space available")
+	}
+	if conn.reads == conn.failures+1 {
+		return copy(buf, "mdns"), &net.UDPAddr{IP: net.IP{192, 168, 20, 7}, Port: 5353}, nil
+	}
+	<-conn.closed
+	return 0, nil, errors.New("use of closed network connection")
+}
+
+func TestSocketCaptureReadErrors(t *testing.T) {
+	conn := &flakyConn{failures: 2, closed: make(chan struct{})}
+	capture := &socketCapture{
+		datagrams: make(chan receivedDatagram, 1),
+		arp:       &arpTable{},
+		done:      make(chan struct{}),
+		failures:  make(map[uint16]error),
+	}
+	failover := &failoverCapture{interfaces: []string{"eth0"}, handle: capture, status: newSubsystemStatus()}
+	capture.setFailure(20, errors.New("no buffer space available"))
+	if report := failover.healthCheck()(); report.State != healthDegraded || report.Detail != "VLAN 20: no buffer space available" {
+		t.Errorf("Error in healthCheck(): expected a failing socket to degrade the capture, got %+v", report)
+	}
+	capture.setFailure(20, nil)
+
+	go capture.receive(20, conn)
+	select {
+	case datagram := <-capture.datagrams:
+		if string(datagram.payload) != "mdns" || datagram.tag != 20 {
+			t.Errorf("Error in receive(): unexpected datagram %+v", datagram)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Error in receive(): the socket should be read again after its errors")
+	}
+	if report := failover.healthCheck()(); report.State != healthOK {
+		t.Errorf("Error in healthCheck(): expected the capture to recover, got %+v", report)
+	}
+	capture.Stop()
+	close(conn.closed)
+}
+
+func TestParseARPTable(t *testing.T) {
+	content := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.10.7     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0.10
+192.168.10.8     0x1         0x0         00:00:00:00:00:00     *        eth0.10
+`
+	entries := parseARPTable(strings.NewReader(content))
+	if len(entries) != 1 || entries["192.168.10.7"].String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Error in parseARPTable(): expected the complete entry only, got %v", entries)
+	}
+
+	table := &arpTable{path: "/nonexistent", entries: entries}
+	if mac := table.lookup(net.ParseIP("192.168.10.7"), time.Now()); mac.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Error in lookup(): expected aa:bb:cc:dd:ee:ff, got %v", mac)
+	}
+	if mac := table.lookup(net.ParseIP("192.168.10.9"), time.Now()); mac.String() != "00:00:00:00:00:00" {
+		t.Errorf("Error in lookup(): expected an all-zero address for an unknown neighbour, got %v", mac)
+	}
+}
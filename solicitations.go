@@ -0,0 +1,136 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Maximal number of subscriptions kept before the expired ones are pruned
+const maxSubscriptions = 1024
+
+// Answers reflected to a VLAN only because of a subscription, exposed on /debug/vars
+var subscribedReflections = expvar.NewInt("subscribed_reflections")
+
+type solicitation struct {
+	vlanTag uint16
+	time    time.Time
+}
+
+// subscription identifies the queries of an allowed querier for a service type on a VLAN
+type subscription struct {
+	querier macAddress
+	vlanTag uint16
+	service string
+}
+
+// solicitationTracker remembers the last query of each allowed querier, so that the responses of devices
+// restricted to some queriers only flow back to the VLANs of the queriers who asked for them
+type solicitationTracker struct {
+	window   time.Duration
+	queriers map[macAddress]bool
+	last     map[macAddress]solicitation
+	// subscriptionWindow is how long the query of an allowed querier for a service type keeps
+	// the answers about this service type flowing to its VLAN, 0 disabling subscriptions
+	subscriptionWindow time.Duration
+	subscriptions      map[subscription]time.Time
+}
+
+func newSolicitationTracker(devices map[macAddress]bonjourDevice, window time.Duration) *solicitationTracker {
+	tracker := &solicitationTracker{
+		window:   window,
+		queriers: make(map[macAddress]bool),
+		last:     make(map[macAddress]solicitation),
+
+		subscriptions: make(map[subscription]time.Time),
+	}
+	for _, device := range devices {
+		for _, querier := range device.AllowedQueriers {
+			tracker.queriers[querier] = true
+		}
+	}
+	return tracker
+}
+
+// record stores a query sent by querier on the given VLAN.
+// Only queriers listed in the configuration are tracked, which bounds the memory used by the tracker.
+func (tracker *solicitationTracker) record(querier macAddress, tag uint16, now time.Time) {
+	if tracker.queriers[querier] {
+		tracker.last[querier] = solicitation{vlanTag: tag, time: now}
+	}
+}
+
+// solicitedPools returns the shared pools of device in which an allowed querier recently sent a query
+func (tracker *solicitationTracker) solicitedPools(device bonjourDevice, now time.Time) (pools []uint16) {
+	for _, pool := range device.SharedPools {
+		for _, querier := range device.AllowedQueriers {
+			last, ok := tracker.last[querier]
+			if ok && last.vlanTag == pool && now.Sub(last.time) <= tracker.window {
+				pools = append(pools, pool)
+				break
+			}
+		}
+	}
+	return
+}
+
+// subscribe records the service types asked for by a query of querier on the given VLAN
+func (tracker *solicitationTracker) subscribe(querier macAddress, tag uint16, dns *layers.DNS, now time.Time) {
+	if tracker.subscriptionWindow <= 0 || !tracker.queriers[querier] || dns == nil {
+		return
+	}
+	if len(tracker.subscriptions) >= maxSubscriptions {
+		for key, last := range tracker.subscriptions {
+			if now.Sub(last) > tracker.subscriptionWindow {
+				delete(tracker.subscriptions, key)
+			}
+		}
+	}
+	for _, question := range dns.Questions {
+		if service := serviceTypeOf(string(question.Name)); service != "" {
+			tracker.subscriptions[subscription{querier: querier, vlanTag: tag, service: service}] = now
+		}
+	}
+}
+
+// addSubscribedPools adds to pools the shared pools of device in which an allowed querier subscribed
+// to one of the service types of the answer dns, emulating the continuous browsing of the querier
+func (tracker *solicitationTracker) addSubscribedPools(pools []uint16, device bonjourDevice, dns *layers.DNS, now time.Time) []uint16 {
+	if len(tracker.subscriptions) == 0 || dns == nil {
+		return pools
+	}
+	services := answerServiceTypes(dns)
+	for _, pool := range device.SharedPools {
+		if containsVLAN(pools, pool) {
+			continue
+		}
+		if tracker.isSubscribed(pool, device.AllowedQueriers, services, now) {
+			pools = append(pools, pool)
+			subscribedReflections.Add(1)
+		}
+	}
+	return pools
+}
+
+// isSubscribed tells whether one of queriers subscribed to one of services on the given VLAN
+func (tracker *solicitationTracker) isSubscribed(tag uint16, queriers []macAddress, services []string, now time.Time) bool {
+	for _, querier := range queriers {
+		for _, service := range services {
+			last, ok := tracker.subscriptions[subscription{querier: querier, vlanTag: tag, service: service}]
+			if ok && now.Sub(last) <= tracker.subscriptionWindow {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsVLAN(tags []uint16, tag uint16) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSolicitedPools(t *testing.T) {
+	device := bonjourDevice{OriginPool: 45, SharedPools: []uint16{42, 46, 47}, AllowedQueriers: []macAddress{"aa:aa:aa:aa:aa:aa", "bb:bb:bb:bb:bb:bb"}}
+	devices := map[macAddress]bonjourDevice{"00:14:22:01:23:45": device}
+	tracker := newSolicitationTracker(devices, 3*time.Second)
+	now := time.Now()
+
+	tracker.record("aa:aa:aa:aa:aa:aa", 42, now)
+	tracker.record("bb:bb:bb:bb:bb:bb", 46, now.Add(-time.Minute))
+	tracker.record("cc:cc:cc:cc:cc:cc", 47, now)
+
+	if _, ok := tracker.last["cc:cc:cc:cc:cc:cc"]; ok {
+		t.Error("Error in record(): queriers absent from the configuration should not be tracked")
+	}
+
+	expectedResult := []uint16{42}
+	computedResult := tracker.solicitedPools(device, now.Add(time.Second))
+	if !reflect.DeepEqual(expectedResult, computedResult) {
+		t.Errorf("Error in solicitedPools(): expected %v, got %v", expectedResult, computedResult)
+	}
+
+	if computedResult := tracker.solicitedPools(device, now.Add(time.Minute)); len(computedResult) != 0 {
+		t.Errorf("Error in solicitedPools(): solicitations should have expired, got %v", computedResult)
+	}
+}
+
+func TestSubscribedPools(t *testing.T) {
+	device := bonjourDevice{OriginPool: 45, SharedPools: []uint16{42, 46, 47}, AllowedQueriers: []macAddress{"aa:aa:aa:aa:aa:aa"}}
+	devices := map[macAddress]bonjourDevice{"00:14:22:01:23:45": device}
+	tracker := newSolicitationTracker(devices, 3*time.Second)
+	now := time.Now()
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR}}}
+	ipp := createMockPTRAnswer("_ipp._tcp.local", "Office._ipp._tcp.local", 120)
+	airplay := createMockPTRAnswer("_airplay._tcp.local", "Office._airplay._tcp.local", 120)
+
+	tracker.subscribe("aa:aa:aa:aa:aa:aa", 42, query, now)
+	if len(tracker.subscriptions) != 0 {
+		t.Error("Error in subscribe(): subscriptions should be disabled by default")
+	}
+
+	tracker.subscriptionWindow = 10 * time.Minute
+	tracker.subscribe("aa:aa:aa:aa:aa:aa", 42, query, now)
+	tracker.subscribe("aa:aa:aa:aa:aa:aa", 46, query, now.Add(-time.Hour))
+	tracker.subscribe("cc:cc:cc:cc:cc:cc", 47, query, now)
+	tracker.record("aa:aa:aa:aa:aa:aa", 47, now)
+
+	computedResult := tracker.addSubscribedPools(nil, device, ipp, now.Add(time.Minute))
+	if !reflect.DeepEqual(computedResult, []uint16{42}) {
+		t.Errorf("Error in addSubscribedPools(): expected [42], got %v", computedResult)
+	}
+	computedResult = tracker.addSubscribedPools(tracker.solicitedPools(device, now.Add(time.Second)), device, ipp, now.Add(time.Second))
+	if !reflect.DeepEqual(computedResult, []uint16{47, 42}) {
+		t.Errorf("Error in addSubscribedPools(): expected [47 42], got %v", computedResult)
+	}
+	if computedResult := tracker.addSubscribedPools(nil, device, airplay, now.Add(time.Minute)); len(computedResult) != 0 {
+		t.Errorf("Error in addSubscribedPools(): other service types should not be reflected, got %v", computedResult)
+	}
+	if computedResult := tracker.addSubscribedPools(nil, device, ipp, now.Add(time.Hour)); len(computedResult) != 0 {
+		t.Errorf("Error in addSubscribedPools(): subscriptions should have expired, got %v", computedResult)
+	}
+}
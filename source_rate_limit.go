@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Interval between two removals of the buckets of the sources which went quiet
+const sourceRateLimitPruneInterval = time.Minute
+
+// Packets dropped because their source exceeded its rate, exposed on /debug/vars
+var sourceRateLimited = expvar.NewInt("source_rate_limited")
+
+type sourceRateLimitConfig struct {
+	PacketsPerSecond int `toml:"packets_per_second"`
+	Burst            int `toml:"burst"`
+}
+
+func (cfg *sourceRateLimitConfig) validate() error {
+	if cfg.PacketsPerSecond < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("invalid source_rate_limit, packets_per_second and burst cannot be negative")
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = cfg.PacketsPerSecond
+	}
+	return nil
+}
+
+// sourceBucket is the token bucket of a source MAC address
+type sourceBucket struct {
+	bucket tokenBucket
+	// limited is set while the source exceeds its rate, so that it is only logged once per burst
+	limited bool
+}
+
+// sourceRateLimiter caps the packets each source MAC address may have reflected, before any other processing,
+// so that a single chatty device cannot flood every target VLAN
+type sourceRateLimiter struct {
+	mutex     sync.Mutex
+	cfg       sourceRateLimitConfig
+	sources   map[macAddress]*sourceBucket
+	lastPrune time.Time
+}
+
+// newSourceRateLimiter returns the rate limiter of the configuration, or nil when sources are not limited
+func newSourceRateLimiter(cfg sourceRateLimitConfig) *sourceRateLimiter {
+	if cfg.PacketsPerSecond == 0 {
+		return nil
+	}
+	return &sourceRateLimiter{cfg: cfg, sources: make(map[macAddress]*sourceBucket)}
+}
+
+// allow tells whether a packet of the source mac may be processed, and spends a token of its bucket
+func (limiter *sourceRateLimiter) allow(mac macAddress, now time.Time) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.prune(now)
+	source, ok := limiter.sources[mac]
+	if !ok {
+		capacity := float64(limiter.cfg.Burst)
+		source = &sourceBucket{bucket: tokenBucket{tokens: capacity, capacity: capacity, rate: float64(limiter.cfg.PacketsPerSecond), last: now}}
+		limiter.sources[mac] = source
+	}
+	if !source.bucket.refill(1, now) {
+		if !source.limited {
+			logger.warnf("Rate limiting %v, which sends more than %v packets per second", mac, limiter.cfg.PacketsPerSecond)
+			source.limited = true
+		}
+		sourceRateLimited.Add(1)
+		return false
+	}
+	source.bucket.tokens--
+	source.limited = false
+	return true
+}
+
+// prune forgets the sources whose bucket is full again, as they are no different from a new source.
+// It must be called with the mutex held.
+func (limiter *sourceRateLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < sourceRateLimitPruneInterval {
+		return
+	}
+	limiter.lastPrune = now
+	for mac, source := range limiter.sources {
+		if source.bucket.refill(source.bucket.capacity, now) {
+			delete(limiter.sources, mac)
+		}
+	}
+}
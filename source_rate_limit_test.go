@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceRateLimiter(t *testing.T) {
+	if !newSourceRateLimiter(sourceRateLimitConfig{}).allow("aa:bb:cc:dd:ee:ff", time.Now()) {
+		t.Error("Error in allow(): sources should not be limited without packets_per_second")
+	}
+
+	cfg := sourceRateLimitConfig{PacketsPerSecond: 2}
+	if err := cfg.validate(); err != nil || cfg.Burst != 2 {
+		t.Fatalf("Error in validate(): got burst %v, error %v", cfg.Burst, err)
+	}
+	limiter := newSourceRateLimiter(cfg)
+	now := time.Now()
+	chatty, quiet := macAddress("aa:bb:cc:dd:ee:ff"), macAddress("aa:00:cc:00:ee:00")
+
+	if !limiter.allow(chatty, now) || !limiter.allow(chatty, now) {
+		t.Error("Error in allow(): a burst of packets within the limit should be allowed")
+	}
+	if limiter.allow(chatty, now) {
+		t.Error("Error in allow(): packets over the limit should be dropped")
+	}
+	if !limiter.allow(quiet, now) {
+		t.Error("Error in allow(): each source should have its own bucket")
+	}
+	if !limiter.allow(chatty, now.Add(500*time.Millisecond)) || limiter.allow(chatty, now.Add(500*time.Millisecond)) {
+		t.Error("Error in allow(): the bucket should be refilled at packets_per_second")
+	}
+
+	// Sources which went quiet are forgotten
+	limiter.allow(chatty, now.Add(time.Hour))
+	if _, ok := limiter.sources[quiet]; ok || len(limiter.sources) != 1 {
+		t.Errorf("Error in prune(): unexpected sources %v", limiter.sources)
+	}
+
+	cfg = sourceRateLimitConfig{PacketsPerSecond: -1}
+	if err := cfg.validate(); err == nil {
+		t.Error("Error in validate(): expected an error for a negative rate")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const ssdpPort = 1900
+
+// Multicast groups of SSDP, the discovery protocol of UPnP (UPnP Device Architecture 2.0, section 1)
+var ssdpGroups = []passthroughGroup{
+	{ip: net.ParseIP("239.255.255.250"), port: ssdpPort},
+	{ip: net.ParseIP("ff02::c"), port: ssdpPort},
+	{ip: net.ParseIP("ff05::c"), port: ssdpPort},
+}
+
+// SSDP messages seen and reflected, exposed on /debug/vars
+var ssdpStats = expvar.NewMap("ssdp")
+
+func isSSDPGroup(group passthroughGroup) bool {
+	for _, ssdpGroup := range ssdpGroups {
+		if ssdpGroup.ip.Equal(group.ip) && ssdpGroup.port == group.port {
+			return true
+		}
+	}
+	return false
+}
+
+// ssdpMessage is a multicast SSDP message: a search (M-SEARCH) or a notification (NOTIFY)
+type ssdpMessage struct {
+	method string
+	// target is the search target (ST) of searches, or the notification type (NT) of notifications
+	target string
+	// nts is the notification subtype, "ssdp:alive" or "ssdp:byebye"
+	nts string
+}
+
+func (message *ssdpMessage) isSearch() bool {
+	return message.method == "M-SEARCH"
+}
+
+// parseSSDPMessage parses the request line and headers of an SSDP message, which are those of HTTP over UDP
+func parseSSDPMessage(payload []byte) (*ssdpMessage, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty message")
+	}
+	requestLine := strings.Fields(scanner.Text())
+	if len(requestLine) != 3 || requestLine[1] != "*" || !strings.HasPrefix(requestLine[2], "HTTP/") {
+		return nil, fmt.Errorf("invalid request line %q", scanner.Text())
+	}
+	message := &ssdpMessage{method: strings.ToUpper(requestLine[0])}
+	if message.method != "M-SEARCH" && message.method != "NOTIFY" {
+		return nil, fmt.Errorf("unexpected method %v", requestLine[0])
+	}
+	for scanner.Scan() && scanner.Text() != "" {
+		separator := strings.IndexByte(scanner.Text(), ':')
+		if separator < 0 {
+			continue
+		}
+		value := strings.TrimSpace(scanner.Text()[separator+1:])
+		switch strings.ToUpper(strings.TrimSpace(scanner.Text()[:separator])) {
+		case "ST", "NT":
+			message.target = value
+		case "NTS":
+			message.nts = value
+		}
+	}
+	return message, nil
+}
+
+// parseSSDPPacket returns the SSDP messages sent to one of the SSDP groups
+func parseSSDPPacket(packet gopacket.Packet, brMACAddress net.HardwareAddr) (bonjourPacket, bool) {
+	bonjourPacket, ok := parsePassthroughPacket(packet, brMACAddress, ssdpGroups)
+	if !ok {
+		return bonjourPacket, false
+	}
+	_, payload := parseUDPLayer(packet)
+	message, err := parseSSDPMessage(payload)
+	if err != nil {
+		ssdpStats.Add("invalid", 1)
+		return bonjourPacket, false
+	}
+	bonjourPacket.passthrough = false
+	bonjourPacket.ssdp = message
+	return bonjourPacket, true
+}
+
+// ssdpTargets returns the VLANs an SSDP message is reflected to: searches are reflected like queries,
+// and the notifications of a device like its answers
+func (r *reflector) ssdpTargets(bonjourPacket *bonjourPacket) []uint16 {
+	if bonjourPacket.ssdp.isSearch() {
+		ssdpStats.Add("searches", 1)
+	} else {
+		ssdpStats.Add("notifications", 1)
+	}
+	return r.discoveryTargets(bonjourPacket, bonjourPacket.ssdp.isSearch(), bonjourPacket.ssdp.nts == "ssdp:byebye")
+}
+
+// discoveryTargets returns the VLANs a search or an announcement of a discovery protocol other than mDNS is
+// reflected to, following the device pools like mDNS: searches go to the origin pools of the devices shared with
+// the VLAN of the searcher, and the announcements of a device to its shared pools
+func (r *reflector) discoveryTargets(bonjourPacket *bonjourPacket, search bool, leaving bool) []uint16 {
+	srcVLAN := *bonjourPacket.vlanTag
+	srcMAC := macAddress(bonjourPacket.srcMAC.String())
+	if search {
+		r.solicitations.record(srcMAC, srcVLAN, time.Now())
+		var allowedTags []uint16
+		for _, tag := range r.poolsMap[srcVLAN] {
+			if isQueryAllowed(r.querierRestrictions, poolPair{from: srcVLAN, to: tag}, srcMAC) {
+				allowedTags = append(allowedTags, tag)
+			}
+		}
+		return allowedTags
+	}
+	entry, device, ok := r.cfg.device(srcMAC)
+	if !ok && leaving {
+		// Unknown devices leaving the network are not worth quarantining
+		return nil
+	}
+	if !ok {
+		return r.handleUnknownDevice(bonjourPacket)
+	}
+	r.ruleHits.record(entry, time.Now())
+	if len(device.AllowedQueriers) > 0 {
+		return r.solicitations.solicitedPools(device, time.Now())
+	}
+	return device.SharedPools
+}
+
+// sendSSDP reflects an SSDP message, only rewriting its VLAN tag and source MAC address
+func (r *reflector) sendSSDP(bonjourPacket *bonjourPacket) {
+	if time.Now().Before(r.warmUpUntil) {
+		return
+	}
+	frames := r.sendLinkLayer(bonjourPacket, protocolSSDP, r.ssdpTargets(bonjourPacket))
+	ssdpStats.Add("reflected", int64(frames))
+}
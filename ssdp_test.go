@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const ssdpSearchTest = "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: urn:schemas-upnp-org:device:ZonePlayer:1\r\n\r\n"
+
+const ssdpNotifyTest = "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nCACHE-CONTROL: max-age = 1800\r\nLOCATION: http://192.168.1.20:1400/xml/device_description.xml\r\n" +
+	"NT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:RINCON_000E58000000::upnp:rootdevice\r\n\r\n"
+
+func createMockSSDPPacket(tag uint16, payload string) gopacket.Packet {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 2, Protocol: layers.IPProtocolUDP, SrcIP: srcIPv4Test, DstIP: []byte{239, 255, 255, 250}}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: ssdpPort}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: []byte{0x01, 0x00, 0x5E, 0x7F, 0xFF, 0xFA}, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, gopacket.Payload(payload))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestParseSSDPMessage(t *testing.T) {
+	message, err := parseSSDPMessage([]byte(ssdpNotifyTest))
+	if err != nil || message.isSearch() || message.target != "upnp:rootdevice" || message.nts != "ssdp:alive" {
+		t.Errorf("Error in parseSSDPMessage(): got %+v (%v)", message, err)
+	}
+	message, err = parseSSDPMessage([]byte(ssdpSearchTest))
+	if err != nil || !message.isSearch() || message.target != "urn:schemas-upnp-org:device:ZonePlayer:1" {
+		t.Errorf("Error in parseSSDPMessage(): got %+v (%v)", message, err)
+	}
+	for _, payload := range []string{"", "HTTP/1.1 200 OK\r\n\r\n", "GET / HTTP/1.1\r\n\r\n", "NOTIFY *\r\n"} {
+		if _, err := parseSSDPMessage([]byte(payload)); err == nil {
+			t.Errorf("Error in parseSSDPMessage(): expected an error for %q", payload)
+		}
+	}
+}
+
+func TestSSDPReflection(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`ssdp_reflection = true
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter := buildCaptureFilter(&cfg); !strings.Contains(filter, "dst host ff02::c and udp dst port 1900") {
+		t.Errorf("Error in buildCaptureFilter(): expected the SSDP groups to be captured, got %q", filter)
+	}
+
+	bonjourPacket, ok := parseSSDPPacket(createMockSSDPPacket(vlanIdentifierTest, ssdpNotifyTest), brMACTest)
+	if !ok || bonjourPacket.ssdp == nil || bonjourPacket.passthrough {
+		t.Fatal("Error in parseSSDPPacket(): expected the notification to be parsed")
+	}
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[0] != 42 || tags[1] != 43 {
+		t.Fatalf("Error in processBonjourPacket(): expected the notification to be reflected to the shared pools, got %v", tags)
+	}
+	reflected := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	if udp, ok := reflected.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || string(udp.Payload) != ssdpNotifyTest {
+		t.Error("Error in processBonjourPacket(): expected the notification to be reflected unmodified")
+	}
+
+	// Searches from a VLAN sharing the device are reflected to its origin pool
+	writer.frames = nil
+	bonjourPacket, _ = parseSSDPPacket(createMockSSDPPacket(42, ssdpSearchTest), brMACTest)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != vlanIdentifierTest {
+		t.Errorf("Error in processBonjourPacket(): expected the search to be reflected to the origin pool, got %v", tags)
+	}
+
+	if _, err := parseConfig(`ssdp_reflection = true
+		passthrough = ["[ff02::c]:1900"]`); err == nil {
+		t.Error("Error in parseConfig(): SSDP groups should not be passed through when reflected")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Delay between two writes of the stats file
+	statsSaveInterval = 5 * time.Minute
+	// Number of devices whose activity is kept, the least recently seen being forgotten beyond
+	statsMaxDevices = 10000
+)
+
+// reflectionOutcome counts the queries for a service type reflected from a VLAN into another one,
+// and the ones which got an answer back from that VLAN within the latency window
+type reflectionOutcome struct {
+	reflectionPair
+	Queries       uint64  `json:"queries"`
+	Answered      uint64  `json:"answered"`
+	AnsweredRatio float64 `json:"answered_ratio"`
+}
+
+// deviceActivity is the traffic of a source device: the packets it sent, and the VLANs they were reflected into
+type deviceActivity struct {
+	MAC           macAddress `json:"mac"`
+	Packets       uint64     `json:"packets"`
+	Reflections   uint64     `json:"reflections"`
+	FirstSeen     time.Time  `json:"first_seen"`
+	LastSeen      time.Time  `json:"last_seen"`
+	LastReflected time.Time  `json:"last_reflected"`
+}
+
+// statsSummary holds the counters accumulated since the stats file was created, over the restarts
+// of the reflector. The dropped packets are the ones reflected to no VLAN.
+type statsSummary struct {
+	Since            time.Time           `json:"since"`
+	Updated          time.Time           `json:"updated"`
+	Runs             int                 `json:"runs"`
+	PacketsSeen      uint64              `json:"packets_seen"`
+	PacketsReflected uint64              `json:"packets_reflected"`
+	PacketsDropped   uint64              `json:"packets_dropped"`
+	Devices          []deviceActivity    `json:"devices"`
+	Reflections      []reflectionOutcome `json:"reflections"`
+}
+
+// statsRecorder accumulates the statistics persisted in the stats file, so that the devices actually reflected
+// can be told over weeks. A nil recorder records nothing.
+type statsRecorder struct {
+	mutex   sync.Mutex
+	path    string
+	summary statsSummary
+	devices map[macAddress]*list.Element
+	// order holds the activity of the devices, least recently seen first
+	order       *list.List
+	reflections map[reflectionPair]*reflectionOutcome
+	// pending is set while the packet seen last was not reflected
+	pending bool
+}
+
+// loadStats restores the summary saved at path, counting a new run, or starts a new one when there is none
+func loadStats(path string, now time.Time) (*statsRecorder, error) {
+	summary, err := readStatsFile(path)
+	if os.IsNotExist(err) {
+		summary, err = statsSummary{Since: now}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats := &statsRecorder{path: path, summary: summary, devices: make(map[macAddress]*list.Element),
+		order: list.New(), reflections: make(map[reflectionPair]*reflectionOutcome)}
+	sort.SliceStable(summary.Devices, func(i, j int) bool { return summary.Devices[i].LastSeen.Before(summary.Devices[j].LastSeen) })
+	for i := range summary.Devices {
+		stats.devices[summary.Devices[i].MAC] = stats.order.PushBack(&summary.Devices[i])
+	}
+	for i := range summary.Reflections {
+		stats.reflections[summary.Reflections[i].reflectionPair] = &summary.Reflections[i]
+	}
+	stats.summary.Devices, stats.summary.Reflections = nil, nil
+	stats.summary.Runs++
+	return stats, nil
+}
+
+func readStatsFile(path string) (statsSummary, error) {
+	var summary statsSummary
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return summary, err
+	}
+	if err := json.Unmarshal(content, &summary); err != nil {
+		return summary, fmt.Errorf("invalid stats file %v: %v", path, err)
+	}
+	return summary, nil
+}
+
+// seen counts a packet received from mac, which processed counts as dropped unless it gets reflected
+func (stats *statsRecorder) seen(mac macAddress, now time.Time) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.summary.PacketsSeen++
+	stats.pending = true
+	element, ok := stats.devices[mac]
+	if !ok {
+		if stats.order.Len() >= statsMaxDevices {
+			oldest := stats.order.Remove(stats.order.Front()).(*deviceActivity)
+			delete(stats.devices, oldest.MAC)
+		}
+		element = stats.order.PushBack(&deviceActivity{MAC: mac, FirstSeen: now})
+		stats.devices[mac] = element
+	}
+	stats.order.MoveToBack(element)
+	device := element.Value.(*deviceActivity)
+	device.Packets++
+	device.LastSeen = now
+}
+
+// processed counts the packet seen last as dropped when it was reflected to no VLAN
+func (stats *statsRecorder) processed() {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if stats.pending {
+		stats.summary.PacketsDropped++
+		stats.pending = false
+	}
+}
+
+// reflected counts a packet of mac reflected into vlans VLANs
+func (stats *statsRecorder) reflected(mac macAddress, vlans int, now time.Time) {
+	if stats == nil || vlans == 0 {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.summary.PacketsReflected++
+	stats.pending = false
+	if element, ok := stats.devices[mac]; ok {
+		device := element.Value.(*deviceActivity)
+		device.Reflections += uint64(vlans)
+		device.LastReflected = now
+	}
+}
+
+// queried counts the queries reflected for each of pairs
+func (stats *statsRecorder) queried(pairs []reflectionPair) {
+	if stats == nil || len(pairs) == 0 {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	for _, pair := range pairs {
+		outcome, ok := stats.reflections[pair]
+		if !ok {
+			if len(stats.reflections) >= reflectionMaxPairs {
+				continue
+			}
+			outcome = &reflectionOutcome{reflectionPair: pair}
+			stats.reflections[pair] = outcome
+		}
+		outcome.Queries++
+	}
+}
+
+// answered counts the reflected queries of pairs which got an answer
+func (stats *statsRecorder) answered(pairs []reflectionPair) {
+	if stats == nil || len(pairs) == 0 {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	for _, pair := range pairs {
+		if outcome, ok := stats.reflections[pair]; ok {
+			outcome.Answered++
+		}
+	}
+}
+
+// snapshot returns a copy of the summary, the devices reflected the most first
+func (stats *statsRecorder) snapshot(now time.Time) statsSummary {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	summary := stats.summary
+	summary.Updated = now
+	summary.Devices = make([]deviceActivity, 0, stats.order.Len())
+	for element := stats.order.Front(); element != nil; element = element.Next() {
+		summary.Devices = append(summary.Devices, *element.Value.(*deviceActivity))
+	}
+	sortDeviceActivity(summary.Devices)
+	summary.Reflections = make([]reflectionOutcome, 0, len(stats.reflections))
+	for _, outcome := range stats.reflections {
+		outcome.AnsweredRatio = answeredRatio(int64(outcome.Queries), int64(outcome.Answered))
+		summary.Reflections = append(summary.Reflections, *outcome)
+	}
+	sortReflectionOutcomes(summary.Reflections)
+	return summary
+}
+
+// sortReflectionOutcomes sorts the outcomes by service type, then by VLAN pair
+func sortReflectionOutcomes(outcomes []reflectionOutcome) {
+	sort.Slice(outcomes, func(i, j int) bool {
+		if outcomes[i].Service != outcomes[j].Service {
+			return outcomes[i].Service < outcomes[j].Service
+		}
+		if outcomes[i].From != outcomes[j].From {
+			return outcomes[i].From < outcomes[j].From
+		}
+		return outcomes[i].To < outcomes[j].To
+	})
+}
+
+func sortDeviceActivity(devices []deviceActivity) {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Reflections != devices[j].Reflections {
+			return devices[i].Reflections > devices[j].Reflections
+		}
+		return devices[i].MAC < devices[j].MAC
+	})
+}
+
+// save writes the summary to the stats file
+func (stats *statsRecorder) save(now time.Time) error {
+	if stats == nil {
+		return nil
+	}
+	content, err := json.MarshalIndent(stats.snapshot(now), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := stats.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, stats.path)
+}
+
+// run saves the summary every interval, the reflector saving it as well on shutdown
+func (stats *statsRecorder) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := stats.save(now); err != nil {
+			logger.errorf("Could not write stats file: %v", err)
+		}
+	}
+}
+
+// exit saves the summary on shutdown, and logs its totals
+func (stats *statsRecorder) exit(now time.Time) {
+	if stats == nil {
+		return
+	}
+	if err := stats.save(now); err != nil {
+		logger.errorf("Could not write stats file: %v", err)
+	}
+	summary := stats.snapshot(now)
+	logger.infof("Since %v: %v packets seen, %v reflected, %v dropped, from %v devices",
+		summary.Since.Format(time.RFC3339), summary.PacketsSeen, summary.PacketsReflected, summary.PacketsDropped, len(summary.Devices))
+}
+
+var statsCommand = &command{
+	name:    "stats",
+	summary: "Print the statistics saved in the stats file",
+	setup:   setupStatsCommand,
+}
+
+// setupStatsCommand prints the last summary written to the stats file, the devices reflected the most first
+func setupStatsCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	file := flags.String("file", "", "Stats file, stats_file of the configuration by default")
+	configPath := flags.String("config", "", "Config file in TOML format")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+
+	return func(out *commandOutput, args []string) error {
+		path := *file
+		if path == "" {
+			cfg, err := readProfile(*configPath, *profile)
+			if err != nil {
+				return configError(fmt.Errorf("could not read configuration: %v", err))
+			}
+			if path = cfg.StatsFile; path == "" {
+				return fmt.Errorf("stats_file is not set, pass the stats file with -file")
+			}
+		}
+		summary, err := readStatsFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read stats file: %v", err)
+		}
+		sortDeviceActivity(summary.Devices)
+		sortReflectionOutcomes(summary.Reflections)
+
+		return out.print(summary, func(w io.Writer) {
+			fmt.Fprintf(w, "Since %v (%v runs, updated %v):\n", summary.Since.Format(time.RFC3339), summary.Runs, summary.Updated.Format(time.RFC3339))
+			fmt.Fprintf(w, "%v packets seen, %v reflected, %v dropped\n\n", summary.PacketsSeen, summary.PacketsReflected, summary.PacketsDropped)
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "DEVICE\tPACKETS\tREFLECTIONS\tFIRST SEEN\tLAST SEEN\tLAST REFLECTED")
+			for _, device := range summary.Devices {
+				lastReflected := "never"
+				if !device.LastReflected.IsZero() {
+					lastReflected = device.LastReflected.Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", device.MAC, device.Packets, device.Reflections,
+					device.FirstSeen.Format(time.RFC3339), device.LastSeen.Format(time.RFC3339), lastReflected)
+			}
+			tw.Flush()
+			if len(summary.Reflections) == 0 {
+				return
+			}
+			fmt.Fprintln(w)
+			tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SERVICE\tFROM\tTO\tQUERIES\tANSWERED\tRATIO")
+			for _, outcome := range summary.Reflections {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.0f%%\n", outcome.Service, outcome.From, outcome.To,
+					outcome.Queries, outcome.Answered, 100*outcome.AnsweredRatio)
+			}
+			tw.Flush()
+		})
+	}
+}
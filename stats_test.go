@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	now := time.Now()
+	stats, err := loadStats(path, now)
+	if err != nil {
+		t.Fatalf("Error in loadStats(): %v", err)
+	}
+	stats.seen("00:14:22:01:23:45", now)
+	stats.reflected("00:14:22:01:23:45", 2, now)
+	stats.processed()
+	stats.seen("00:14:22:01:23:46", now)
+	stats.processed()
+	stats.seen("00:14:22:01:23:46", now.Add(time.Second))
+	stats.processed()
+	ipp := reflectionPair{Service: "_ipp._tcp.local", From: 20, To: 10}
+	stats.queried([]reflectionPair{ipp, {Service: "_ipp._tcp.local", From: 20, To: 30}})
+	stats.answered([]reflectionPair{ipp})
+	if err := stats.save(now); err != nil {
+		t.Fatalf("Error in save(): %v", err)
+	}
+
+	// The counters accumulate over the runs
+	stats, err = loadStats(path, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error in loadStats(): %v", err)
+	}
+	stats.seen("00:14:22:01:23:45", now.Add(time.Hour))
+	stats.processed()
+	stats.queried([]reflectionPair{ipp})
+	checkStatsSummary(t, stats.snapshot(now.Add(time.Hour)), ipp, now)
+	checkStatsOutput(t, path)
+}
+
+// checkStatsSummary checks the totals, devices and reflections of the two runs of TestStatsRecorder
+func checkStatsSummary(t *testing.T, summary statsSummary, ipp reflectionPair, now time.Time) {
+	if summary.Runs != 2 || summary.PacketsSeen != 4 || summary.PacketsReflected != 1 || summary.PacketsDropped != 3 || !summary.Since.Equal(now) {
+		t.Errorf("Error in loadStats(): unexpected totals %+v", summary)
+	}
+	if len(summary.Devices) != 2 || summary.Devices[0].MAC != "00:14:22:01:23:45" || summary.Devices[0].Packets != 2 ||
+		summary.Devices[0].Reflections != 2 || !summary.Devices[0].FirstSeen.Equal(now) || summary.Devices[1].Packets != 2 {
+		t.Errorf("Error in snapshot(): unexpected devices %+v", summary.Devices)
+	}
+	if len(summary.Reflections) != 2 || summary.Reflections[0].reflectionPair != ipp || summary.Reflections[0].Queries != 2 ||
+		summary.Reflections[0].AnsweredRatio != 0.5 || summary.Reflections[1].Answered != 0 {
+		t.Errorf("Error in snapshot(): unexpected reflections %+v", summary.Reflections)
+	}
+}
+
+// checkStatsOutput checks the stats command prints the stats saved at path
+func checkStatsOutput(t *testing.T, path string) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommandLine([]string{"stats", "-file", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Error in runCommandLine(): stats exited with code %v: %v", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "3 packets seen, 1 reflected, 2 dropped") || !strings.Contains(stdout.String(), "00:14:22:01:23:46") ||
+		!strings.Contains(stdout.String(), "_ipp._tcp.local  20    10  1        1         100%") {
+		t.Errorf("Error in runCommandLine(): unexpected stats output %q", stdout.String())
+	}
+}
+
+func TestStatsReflection(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`[devices.%q]
+		origin_pool = %v
+		shared_pools = [42]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := createMockReflector(cfg)
+	r.stats = &statsRecorder{devices: make(map[macAddress]*list.Element), order: list.New(), reflections: make(map[reflectionPair]*reflectionOutcome)}
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	// Answers of unknown devices are dropped
+	r.cfg.Devices = nil
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	summary := r.stats.snapshot(time.Now())
+	if summary.PacketsSeen != 2 || summary.PacketsReflected != 1 || summary.PacketsDropped != 1 {
+		t.Errorf("Error in processBonjourPacket(): unexpected totals %+v", summary)
+	}
+	if device := summary.Devices[0]; device.MAC != macAddress(srcMACTest.String()) || device.Reflections != 1 || device.Packets != 2 {
+		t.Errorf("Error in processBonjourPacket(): unexpected activity %+v", device)
+	}
+}
+
+func TestStatsDeviceEviction(t *testing.T) {
+	stats := &statsRecorder{devices: make(map[macAddress]*list.Element), order: list.New()}
+	now := time.Now()
+	for i := 0; i <= statsMaxDevices; i++ {
+		stats.seen(macAddress(fmt.Sprintf("00:14:22:%02x:%02x:%02x", i>>16, (i>>8)&0xff, i&0xff)), now.Add(time.Duration(i)))
+		// The first device keeps being seen
+		stats.seen("00:14:22:00:00:00", now.Add(time.Duration(i)))
+	}
+	if len(stats.devices) != statsMaxDevices || stats.order.Len() != statsMaxDevices {
+		t.Fatalf("Error in seen(): expected %v devices, got %v", statsMaxDevices, len(stats.devices))
+	}
+	if _, ok := stats.devices["00:14:22:00:00:01"]; ok {
+		t.Error("Error in seen(): the least recently seen device should have been forgotten")
+	}
+	if _, ok := stats.devices["00:14:22:00:00:00"]; !ok {
+		t.Error("Error in seen(): a recently seen device was forgotten")
+	}
+}
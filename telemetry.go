@@ -0,0 +1,185 @@
+//go:build !notelemetry
+// +build !notelemetry
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// telemetryReport holds the anonymous aggregate statistics sent by the reflector.
+// It contains no MAC address, IP address, VLAN tag nor service name.
+type telemetryReport struct {
+	InstanceID       string   `json:"instance_id"`
+	Platform         string   `json:"platform"`
+	GoVersion        string   `json:"go_version"`
+	UptimeHours      int64    `json:"uptime_hours"`
+	QueriesPerMinute float64  `json:"queries_per_minute"`
+	AnswersPerMinute float64  `json:"answers_per_minute"`
+	Devices          int      `json:"devices"`
+	VLANs            int      `json:"vlans"`
+	Features         []string `json:"features"`
+}
+
+// telemetryReporter builds the reports, and sends them when telemetry is enabled
+type telemetryReporter struct {
+	mutex      sync.Mutex
+	cfg        brconfig
+	instanceID string
+	start      time.Time
+	// Packet counters at the time of the previous report, to compute the rates
+	lastReport  time.Time
+	lastQueries int64
+	lastAnswers int64
+	// Cumulative packet counters, replaced in tests
+	queries, answers func() int64
+	client           *http.Client
+	// status is degraded while the reports cannot be sent
+	status *subsystemStatus
+}
+
+func newTelemetryReporter(cfg brconfig, instanceID string, start time.Time) *telemetryReporter {
+	return &telemetryReporter{
+		cfg:        cfg,
+		instanceID: instanceID,
+		start:      start,
+		lastReport: start,
+		queries:    func() int64 { return expvarInt(priorityQueueStats.Get("query_queued")) },
+		answers:    func() int64 { return expvarInt(priorityQueueStats.Get("answer_queued")) },
+		client:     &http.Client{Timeout: 30 * time.Second},
+		status:     newSubsystemStatus(),
+	}
+}
+
+// usedFeatures lists the optional features enabled by the configuration
+func usedFeatures(cfg *brconfig) []string {
+	features := []string{"unknown_device_mode=" + string(cfg.UnknownDeviceMode)}
+	enabled := map[string]bool{
+		"allowed_queriers":     len(mapQuerierRestrictions(cfg.Devices)) > 0,
+		"api":                  cfg.servesAPI(),
+		"expected_services":    len(cfg.ExpectedServices) > 0,
+		"lldp_diagnostics":     cfg.LLDPDiagnostics,
+		"multicast_to_unicast": len(cfg.MulticastToUnicast.Services) > 0,
+		"peer_discovery":       cfg.PeerDiscovery,
+		"policy_module":        cfg.PolicyModule != "",
+		"reflection_jitter":    cfg.ReflectionJitter.Duration > 0,
+		"ttl_floors":           len(cfg.TTLFloors) > 0,
+		"ttl_ceilings":         cfg.MaxTTL > 0 || len(cfg.TTLCeilings) > 0,
+	}
+	for _, name := range []string{"allowed_queriers", "api", "expected_services", "lldp_diagnostics", "multicast_to_unicast",
+		"peer_discovery", "policy_module", "reflection_jitter", "ttl_floors", "ttl_ceilings"} {
+		if enabled[name] {
+			features = append(features, name)
+		}
+	}
+	return features
+}
+
+// report builds the report for the period since the previous one. With commit, the period is closed.
+func (reporter *telemetryReporter) report(now time.Time, commit bool) telemetryReport {
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	queries, answers := reporter.queries(), reporter.answers()
+	minutes := now.Sub(reporter.lastReport).Minutes()
+	report := telemetryReport{
+		InstanceID:  reporter.instanceID,
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		GoVersion:   runtime.Version(),
+		UptimeHours: int64(now.Sub(reporter.start).Hours()),
+		Devices:     len(reporter.cfg.Devices),
+		VLANs:       len(reporter.cfg.configuredVLANs()),
+		Features:    usedFeatures(&reporter.cfg),
+	}
+	if minutes > 0 {
+		report.QueriesPerMinute = float64(queries-reporter.lastQueries) / minutes
+		report.AnswersPerMinute = float64(answers-reporter.lastAnswers) / minutes
+	}
+	if commit {
+		reporter.lastReport, reporter.lastQueries, reporter.lastAnswers = now, queries, answers
+	}
+	return report
+}
+
+func (reporter *telemetryReporter) send(report telemetryReport) error {
+	content, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := reporter.client.Post(reporter.cfg.Telemetry.Endpoint, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry endpoint answered %v", resp.Status)
+	}
+	return nil
+}
+
+func (reporter *telemetryReporter) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := reporter.send(reporter.report(now, true)); err != nil {
+			logger.warnf("Could not send telemetry report: %v", err)
+			reporter.status.set(healthDegraded, err.Error())
+		} else {
+			reporter.status.set(healthOK, "")
+		}
+	}
+}
+
+// ServeHTTP previews the next report, exactly as it would be sent
+func (reporter *telemetryReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reporter.report(time.Now(), false))
+}
+
+// startTelemetry registers the preview of the reports on /debug/telemetry, and sends them when enabled
+func startTelemetry(cfg brconfig, instanceID string) {
+	reporter := newTelemetryReporter(cfg, instanceID, time.Now())
+	http.Handle("/debug/telemetry", reporter)
+	if cfg.Telemetry.Enabled {
+		logger.infof("Anonymous telemetry enabled, reports are sent to %v every %v", cfg.Telemetry.Endpoint, cfg.Telemetry.Interval.Duration)
+		health.register("telemetry", false, reporter.status.check(nil))
+		go reporter.run(cfg.Telemetry.Interval.Duration)
+	}
+}
+
+var telemetryCommand = &command{
+	name:    "telemetry",
+	summary: "Preview the anonymous telemetry report of a configuration",
+	setup:   setupTelemetryCommand,
+}
+
+func setupTelemetryCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	configPath := flags.String("config", "", "Config file in TOML format")
+	profile := flags.String("profile", "", "Profile of the config file applied over its common settings")
+
+	return func(out *commandOutput, args []string) error {
+		cfg, err := readProfile(*configPath, *profile)
+		if err != nil {
+			return fmt.Errorf("could not read configuration: %v", err)
+		}
+		instanceID, err := loadInstanceID(cfg.InstanceIDFile)
+		if err != nil {
+			return fmt.Errorf("could not read instance ID: %v", err)
+		}
+		report := newTelemetryReporter(cfg, instanceID, time.Now()).report(time.Now(), false)
+		return out.print(report, func(w io.Writer) {
+			if !cfg.Telemetry.Enabled {
+				fmt.Fprintln(w, "Telemetry is disabled, nothing is sent. If enabled, reports would look like:")
+			}
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(report)
+			fmt.Fprintln(w, "Packet rates are measured by the running reflector, see /debug/telemetry on its debug server.")
+		})
+	}
+}
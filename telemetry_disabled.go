@@ -0,0 +1,26 @@
+//go:build notelemetry
+// +build notelemetry
+
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// startTelemetry does nothing, telemetry being compiled out by the notelemetry build tag
+func startTelemetry(cfg brconfig, instanceID string) {
+	if cfg.Telemetry.Enabled {
+		logger.warnf("Telemetry is enabled in the configuration, but was compiled out of this build")
+	}
+}
+
+var telemetryCommand = &command{
+	name:    "telemetry",
+	summary: "Preview the anonymous telemetry report of a configuration",
+	setup: func(flags *flag.FlagSet) func(*commandOutput, []string) error {
+		return func(out *commandOutput, args []string) error {
+			return errors.New("telemetry was compiled out of this build")
+		}
+	},
+}
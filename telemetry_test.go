@@ -0,0 +1,94 @@
+//go:build !notelemetry
+// +build !notelemetry
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadInstanceID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instance_id")
+
+	id, err := loadInstanceID(path)
+	if err != nil || len(id) != 32 {
+		t.Errorf("Error in loadInstanceID(): expected a new 32 characters ID, got %q (%v)", id, err)
+	}
+	again, err := loadInstanceID(path)
+	if err != nil || again != id {
+		t.Errorf("Error in loadInstanceID(): expected the persisted ID %q, got %q (%v)", id, again, err)
+	}
+	ephemeral, err := loadInstanceID("")
+	if err != nil || ephemeral == id || len(ephemeral) != 32 {
+		t.Errorf("Error in loadInstanceID(): expected a new ID without file, got %q (%v)", ephemeral, err)
+	}
+}
+
+func TestTelemetryReport(t *testing.T) {
+	cfg, err := parseConfig(`
+		net_interface = "eth0"
+		api_listen = "127.0.0.1:8053"
+		api_token = "secret"
+		[ttl_floors]
+		"_googlecast._tcp" = 120
+		[ttl_ceilings]
+		"_airplay._tcp" = 600
+		[devices."AA:BB:CC:DD:EE:FF"]
+		origin_pool = 10
+		shared_pools = [20, 30]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(0, 0)
+	var queries, answers int64
+	reporter := newTelemetryReporter(cfg, "0123", start)
+	reporter.queries = func() int64 { return queries }
+	reporter.answers = func() int64 { return answers }
+
+	queries, answers = 120, 60
+	report := reporter.report(start.Add(time.Hour), true)
+	expected := telemetryReport{
+		InstanceID:       "0123",
+		Platform:         report.Platform,
+		GoVersion:        report.GoVersion,
+		UptimeHours:      1,
+		QueriesPerMinute: 2,
+		AnswersPerMinute: 1,
+		Devices:          1,
+		VLANs:            3,
+		Features:         []string{"unknown_device_mode=drop", "api", "ttl_floors", "ttl_ceilings"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Error in report(): expected %+v, got %+v", expected, report)
+	}
+
+	// Rates only cover the period since the last committed report
+	queries = 180
+	report = reporter.report(start.Add(2*time.Hour), false)
+	if report.QueriesPerMinute != 1 || report.AnswersPerMinute != 0 {
+		t.Errorf("Error in report(): expected rates of the last hour, got %+v", report)
+	}
+}
+
+func TestTelemetryConfig(t *testing.T) {
+	cfg, err := parseConfig(`net_interface = "eth0"`)
+	if err != nil || cfg.Telemetry.Enabled || cfg.Telemetry.Interval.Duration != defaultTelemetryInterval {
+		t.Errorf("Error in parseConfig(): expected telemetry disabled by default, got %+v (%v)", cfg.Telemetry, err)
+	}
+	_, err = parseConfig("[telemetry]\nenabled = true")
+	if err == nil || !strings.Contains(err.Error(), "endpoint") {
+		t.Errorf("Error in parseConfig(): expected an error for telemetry without endpoint, got %v", err)
+	}
+}
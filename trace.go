@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Duration of a trace started without duration, and longest duration a trace may run for
+const (
+	defaultTraceDuration = 10 * time.Minute
+	maxTraceDuration     = time.Hour
+)
+
+// packetTrace is a tracing of the packets running until a deadline, optionally restricted to a VLAN or a device
+type packetTrace struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+	VLAN   uint16     `json:"vlan,omitempty"`
+	Device macAddress `json:"device,omitempty"`
+}
+
+// packetTracer selects the packets logged with their decoded layers, whatever the logging level, for a bounded
+// duration after which it stops by itself, so that a forgotten trace cannot leave its overhead on a production router
+type packetTracer struct {
+	mutex sync.Mutex
+	trace packetTrace
+	timer *time.Timer
+}
+
+// start replaces the running trace, if any, by a trace running for duration
+func (tracer *packetTracer) start(trace packetTrace, duration time.Duration, now time.Time) packetTrace {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.timer != nil {
+		tracer.timer.Stop()
+	}
+	until := now.Add(duration)
+	trace.Active, trace.Until = true, &until
+	tracer.trace = trace
+	tracer.timer = time.AfterFunc(duration, func() { tracer.expire(trace) })
+	logger.log(levelInfo, "Packet tracing started", "duration", duration.String(), "vlan", trace.VLAN, "device", trace.Device)
+	return trace
+}
+
+// expire stops trace if it is still running
+func (tracer *packetTracer) expire(trace packetTrace) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.trace == trace {
+		tracer.trace = packetTrace{}
+		logger.infof("Packet tracing expired")
+	}
+}
+
+// stop stops the running trace, and tells whether there was one
+func (tracer *packetTracer) stop() bool {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if !tracer.trace.Active {
+		return false
+	}
+	tracer.timer.Stop()
+	tracer.trace = packetTrace{}
+	logger.infof("Packet tracing stopped")
+	return true
+}
+
+// current returns the running trace, which is inactive when there is none
+func (tracer *packetTracer) current(now time.Time) packetTrace {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	if tracer.trace.Active && !now.Before(*tracer.trace.Until) {
+		return packetTrace{}
+	}
+	return tracer.trace
+}
+
+// traces tells whether bonjourPacket is traced
+func (tracer *packetTracer) traces(bonjourPacket *bonjourPacket, now time.Time) bool {
+	if tracer == nil {
+		return false
+	}
+	trace := tracer.current(now)
+	if !trace.Active {
+		return false
+	}
+	if trace.VLAN != 0 && (bonjourPacket.vlanTag == nil || *bonjourPacket.vlanTag != trace.VLAN) {
+		return false
+	}
+	return trace.Device == "" || bonjourPacket.srcMAC.String() == string(trace.Device)
+}
+
+// traceAPI shows the running trace on GET /api/trace, starts one on PUT /api/trace[?duration=10m&vlan=<tag>&device=<mac>],
+// and stops it on DELETE /api/trace
+type traceAPI struct {
+	tracer *packetTracer
+}
+
+func (api traceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.tracer.current(time.Now()))
+	case http.MethodPut:
+		trace, duration, err := parseTraceRequest(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.tracer.start(trace, duration, time.Now()))
+	case http.MethodDelete:
+		if !api.tracer.stop() {
+			writeAPIError(w, http.StatusNotFound, "no trace running")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func parseTraceRequest(query url.Values) (trace packetTrace, duration time.Duration, err error) {
+	duration = defaultTraceDuration
+	if value := query.Get("duration"); value != "" {
+		if duration, err = time.ParseDuration(value); err != nil || duration <= 0 || duration > maxTraceDuration {
+			return trace, 0, fmt.Errorf("duration must be positive and at most %v", maxTraceDuration)
+		}
+	}
+	if value := query.Get("vlan"); value != "" {
+		tag, err := strconv.ParseUint(value, 10, 12)
+		if err != nil {
+			return trace, 0, errors.New("invalid VLAN tag")
+		}
+		trace.VLAN = uint16(tag)
+	}
+	if value := query.Get("device"); value != "" {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return trace, 0, errors.New("invalid device MAC address")
+		}
+		trace.Device = macAddress(mac.String())
+	}
+	return trace, duration, nil
+}
+
+var traceCommand = &command{
+	name:    "trace",
+	summary: "Log each packet of a running reflector for a while, or stop tracing",
+	setup:   setupTraceCommand,
+}
+
+// setupTraceCommand starts a trace through the API, stops it, or shows the running trace without flags
+func setupTraceCommand(flags *flag.FlagSet) func(*commandOutput, []string) error {
+	addr := flags.String("addr", "localhost:8053", "Address of the API of the running reflector, or unix:<path> of its socket")
+	token := flags.String("token", os.Getenv(envAPIToken), "API token (default from "+envAPIToken+")")
+	duration := flags.Duration("for", 0, "Trace the packets for this duration (at most 1h)")
+	vlan := flags.Uint("vlan", 0, "Only trace the packets of this VLAN")
+	device := flags.String("device", "", "Only trace the packets sent by this MAC address")
+	stop := flags.Bool("stop", false, "Stop tracing")
+
+	return func(out *commandOutput, args []string) error {
+		var trace packetTrace
+		var err error
+		switch {
+		case *stop:
+			err = callAPI(*addr, *token, http.MethodDelete, "/api/trace", nil, nil)
+		case *duration > 0:
+			query := url.Values{"duration": {duration.String()}}
+			if *vlan != 0 {
+				query.Set("vlan", fmt.Sprint(*vlan))
+			}
+			if *device != "" {
+				query.Set("device", *device)
+			}
+			err = callAPI(*addr, *token, http.MethodPut, "/api/trace?"+query.Encode(), nil, &trace)
+		default:
+			err = callAPI(*addr, *token, http.MethodGet, "/api/trace", nil, &trace)
+		}
+		if err != nil {
+			return err
+		}
+		return out.print(trace, func(w io.Writer) { printTrace(w, trace) })
+	}
+}
+
+func printTrace(w io.Writer, trace packetTrace) {
+	if !trace.Active {
+		fmt.Fprintln(w, "No trace running")
+		return
+	}
+	fmt.Fprintf(w, "Tracing until %v", trace.Until.Format(time.RFC3339))
+	if trace.VLAN != 0 {
+		fmt.Fprintf(w, ", VLAN %v", trace.VLAN)
+	}
+	if trace.Device != "" {
+		fmt.Fprintf(w, ", device %v", trace.Device)
+	}
+	fmt.Fprintln(w)
+}
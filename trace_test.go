@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketTracer(t *testing.T) {
+	tracer := &packetTracer{}
+	packet := createMockBonjourPacket(false)
+	now := time.Now()
+	if tracer.traces(&packet, now) {
+		t.Error("Error in traces(): no packet should be traced before a trace is started")
+	}
+
+	tracer.start(packetTrace{VLAN: vlanIdentifierTest}, time.Minute, now)
+	if !tracer.traces(&packet, now) {
+		t.Error("Error in traces(): the packets of the traced VLAN should be traced")
+	}
+	if tracer.traces(&packet, now.Add(time.Minute)) {
+		t.Error("Error in traces(): the trace should expire after its duration")
+	}
+	tracer.start(packetTrace{Device: "00:11:22:33:44:55"}, time.Minute, now)
+	if tracer.traces(&packet, now) {
+		t.Error("Error in traces(): the packets of other devices should not be traced")
+	}
+	if !tracer.stop() || tracer.stop() || tracer.current(now).Active {
+		t.Error("Error in stop(): the trace should be stopped once")
+	}
+
+	// The trace stops by itself, even without packets
+	tracer.start(packetTrace{}, 10*time.Millisecond, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	tracer.mutex.Lock()
+	active := tracer.trace.Active
+	tracer.mutex.Unlock()
+	if active {
+		t.Error("Error in start(): the trace should have expired")
+	}
+}
+
+func TestTraceAPI(t *testing.T) {
+	api := traceAPI{&packetTracer{}}
+	tests := []struct {
+		method, url string
+		status      int
+	}{
+		{http.MethodDelete, "/api/trace", http.StatusNotFound},
+		{http.MethodPut, "/api/trace?duration=2h", http.StatusBadRequest},
+		{http.MethodPut, "/api/trace?vlan=5000", http.StatusBadRequest},
+		{http.MethodPut, "/api/trace?duration=5m&vlan=30&device=FF-AA-FA-AA-FF-AA", http.StatusOK},
+		{http.MethodGet, "/api/trace", http.StatusOK},
+		{http.MethodDelete, "/api/trace", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("Error in traceAPI: %v %v answered %v, expected %v", test.method, test.url, w.Code, test.status)
+		}
+		if test.method == http.MethodGet && !strings.Contains(w.Body.String(), `"device":"ff:aa:fa:aa:ff:aa"`) {
+			t.Errorf("Error in traceAPI: expected the running trace, got %v", w.Body.String())
+		}
+	}
+}
+
+func TestTracedReflection(t *testing.T) {
+	buf, restore := captureLogs("error")
+	defer restore()
+	cfg := brconfig{
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: vlanIdentifierTest, SharedPools: []uint16{42}},
+		},
+	}
+	r, _ := createMockReflector(cfg)
+	r.tracer.start(packetTrace{}, time.Minute, time.Now())
+	defer r.tracer.stop()
+	buf.Reset()
+
+	r.processBonjourPacket(createMockBonjourPacket(false))
+	if line := buf.String(); !strings.Contains(line, "Reflecting mDNS answer") || !strings.Contains(line, "packet=") {
+		t.Errorf("Error in processBonjourPacket(): traced packets should be logged with their layers whatever the level, got %q", line)
+	}
+}
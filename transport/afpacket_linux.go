@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// Socket option and status flag of linux/if_packet.h, missing from the syscall package
+const (
+	packetAuxdata     = 8
+	tpStatusVLANValid = 0x10
+)
+
+// packetMreq is struct packet_mreq of linux/if_packet.h
+type packetMreq struct {
+	ifindex int32
+	mrType  uint16
+	alen    uint16
+	address [8]byte
+}
+
+// tpacketAuxdata is struct tpacket_auxdata of linux/if_packet.h, received with each frame
+type tpacketAuxdata struct {
+	status   uint32
+	len      uint32
+	snaplen  uint32
+	mac      uint16
+	net      uint16
+	vlanTCI  uint16
+	vlanTPID uint16
+}
+
+// afpacketCapture reads the frames of the trunk from an AF_PACKET socket. Unlike pcap, it receives the VLAN tag
+// stripped by the NIC as auxiliary data, which it reinserts in the frame.
+type afpacketCapture struct {
+	fd  int
+	buf []byte
+	oob []byte
+}
+
+// OpenAFPacket opens an AF_PACKET socket capturing the frames of the interface kept by program in promiscuous mode,
+// read frame by frame, or through a TPACKET_V3 ring buffer when ring has blocks
+func OpenAFPacket(name string, ring RingConfig, program []Instruction) (Handle, error) {
+	fd, err := openPacketSocket(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := attachBPFProgram(fd, program); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not apply filter on %v: %v", name, err)
+	}
+	if ring.Blocks > 0 {
+		handle, err := openTPacketRing(fd, ring)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("could not map the capture ring of %v: %v", name, err)
+		}
+		return handle, nil
+	}
+	timeout := syscall.NsecToTimeval(int64(time.Second))
+	err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetAuxdata, 1)
+	if err == nil {
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not capture on %v: %v", name, err)
+	}
+	return &afpacketCapture{fd: fd, buf: make([]byte, 65536), oob: make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(tpacketAuxdata{}))))}, nil
+}
+
+// openPacketSocket opens an AF_PACKET socket bound to the interface, in promiscuous mode
+func openPacketSocket(name string) (int, error) {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("could not find network interface %v: %v", name, err)
+	}
+	protocol := int(htons(syscall.ETH_P_ALL))
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, protocol)
+	if err != nil {
+		return 0, fmt.Errorf("could not open AF_PACKET socket: %v", err)
+	}
+	mreq := packetMreq{ifindex: int32(intf.Index), mrType: syscall.PACKET_MR_PROMISC}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: uint16(protocol), Ifindex: intf.Index})
+	if err == nil {
+		err = syscall.SetsockoptString(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string((*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))[:]))
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return 0, fmt.Errorf("could not capture on %v: %v", name, err)
+	}
+	return fd, nil
+}
+
+// attachBPFProgram replaces the filter of the AF_PACKET socket fd by program, atomically
+func attachBPFProgram(fd int, program []Instruction) error {
+	filter := make([]syscall.SockFilter, len(program))
+	for i, instruction := range program {
+		filter[i] = syscall.SockFilter{Code: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+	return syscall.AttachLsf(fd, filter)
+}
+
+// SetBPFProgram replaces the filter of the socket by program
+func (capture *afpacketCapture) SetBPFProgram(program []Instruction) error {
+	return attachBPFProgram(capture.fd, program)
+}
+
+// SetBPFProgram replaces the filter of the socket by program
+func (ring *tpacketRing) SetBPFProgram(program []Instruction) error {
+	return attachBPFProgram(ring.fd, program)
+}
+
+// htons converts a short from host to network byte order
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
+
+// ReadPacketData returns the next frame received by the interface, skipping the frames it sent
+func (capture *afpacketCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		n, oobn, _, from, err := syscall.Recvmsg(capture.fd, capture.buf, capture.oob, syscall.MSG_TRUNC)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+		}
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if addr, ok := from.(*syscall.SockaddrLinklayer); ok && addr.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		// With MSG_TRUNC, n is the length of the frame, which may exceed the buffer
+		length := n
+		if n > len(capture.buf) {
+			n = len(capture.buf)
+		}
+		data := make([]byte, n)
+		copy(data, capture.buf)
+		info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: n, Length: length}
+		if tci, ok := parseAuxdata(capture.oob[:oobn]); ok {
+			data = restoreVLANTag(data, &info, tci)
+		}
+		return data, info, nil
+	}
+}
+
+// parseAuxdata returns the VLAN tag reported by the auxiliary data of a frame
+func parseAuxdata(oob []byte) (uint16, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, message := range messages {
+		if message.Header.Level != syscall.SOL_PACKET || message.Header.Type != packetAuxdata || uintptr(len(message.Data)) < unsafe.Sizeof(tpacketAuxdata{}) {
+			continue
+		}
+		auxdata := (*tpacketAuxdata)(unsafe.Pointer(&message.Data[0]))
+		if auxdata.status&tpStatusVLANValid != 0 {
+			return auxdata.vlanTCI, true
+		}
+	}
+	return 0, false
+}
+
+// WritePacketData injects a frame through the socket, the NIC inserting the VLAN tag of tagged frames when offloading
+func (capture *afpacketCapture) WritePacketData(data []byte) error {
+	_, err := syscall.Write(capture.fd, data)
+	return err
+}
+
+// Close closes the socket
+func (capture *afpacketCapture) Close() {
+	syscall.Close(capture.fd)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import "errors"
+
+// OpenAFPacket is only implemented on Linux, where AF_PACKET sockets report the stripped VLAN tags
+func OpenAFPacket(name string, ring RingConfig, program []Instruction) (Handle, error) {
+	return nil, errors.New("AF_PACKET sockets are only supported on Linux")
+}
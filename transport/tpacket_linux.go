@@ -0,0 +1,239 @@
+package transport
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// Socket options, version and status flags of linux/if_packet.h, missing from the syscall package
+const (
+	packetRxRing   = 5
+	packetVersion  = 10
+	tpacketV3      = 2
+	tpStatusKernel = 0
+	tpStatusUser   = 0x1
+	tpStatusLosing = 0x4
+)
+
+// Events of poll.h
+const (
+	pollIn  = 0x1
+	pollErr = 0x8
+)
+
+// Nominal size of the frames of the ring, which the frames of TPACKET_V3 may exceed, and delay after which
+// the kernel passes a block which is not full, so that the frames of a quiet trunk are not held back
+const (
+	tpacketFrameSize    = 2048
+	tpacketBlockTimeout = 10 * time.Millisecond
+)
+
+// Blocks of the ring read, and blocks reporting that the kernel dropped frames since the previous one because
+// the ring was full, exposed on /debug/vars
+var tpacketStats = expvar.NewMap("afpacket_ring")
+
+// tpacketReq3 is struct tpacket_req3 of linux/if_packet.h
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// tpacketBlockDesc is struct tpacket_block_desc of linux/if_packet.h, with its struct tpacket_hdr_v1
+type tpacketBlockDesc struct {
+	version          uint32
+	offsetToPriv     uint32
+	blockStatus      uint32
+	numPkts          uint32
+	offsetToFirstPkt uint32
+	blkLen           uint32
+	seqNum           uint64
+	tsFirstPkt       [2]uint32
+	tsLastPkt        [2]uint32
+}
+
+// tpacket3Hdr is struct tpacket3_hdr of linux/if_packet.h, followed in the ring by the struct sockaddr_ll of the frame
+type tpacket3Hdr struct {
+	nextOffset uint32
+	sec        uint32
+	nsec       uint32
+	snaplen    uint32
+	len        uint32
+	status     uint32
+	mac        uint16
+	net        uint16
+	rxhash     uint32
+	vlanTCI    uint32
+	vlanTPID   uint16
+	padding    [10]uint8
+}
+
+// pollFd is struct pollfd of poll.h
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// tpacketRing reads the frames of the trunk from a TPACKET_V3 ring buffer mapped from the kernel, the blocks of which
+// are passed back and forth between the kernel, filling them with frames, and the reflector, reading them.
+// Like afpacketCapture, it reinserts the VLAN tags stripped by the NIC in the frames.
+type tpacketRing struct {
+	// mutex is held by the reads, so that the ring is only unmapped once the reader has left it
+	mutex sync.Mutex
+	// stopped is set by Stop, atomically as the reader holds the mutex
+	stopped   uint32
+	fd        int
+	ring      []byte
+	blockSize int
+	blocks    int
+	// current is the block being read, next the offset of its next frame, and remaining the number of frames left
+	current   int
+	next      int
+	remaining uint32
+	reading   bool
+}
+
+// openTPacketRing maps the ring buffer of the configuration on the AF_PACKET socket fd
+func openTPacketRing(fd int, cfg RingConfig) (*tpacketRing, error) {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return nil, err
+	}
+	req := tpacketReq3{
+		blockSize:    uint32(cfg.BlockSize),
+		blockNr:      uint32(cfg.Blocks),
+		frameSize:    tpacketFrameSize,
+		frameNr:      uint32(cfg.BlockSize / tpacketFrameSize * cfg.Blocks),
+		retireBlkTov: uint32(tpacketBlockTimeout / time.Millisecond),
+	}
+	if err := syscall.SetsockoptString(fd, syscall.SOL_PACKET, packetRxRing, string((*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:])); err != nil {
+		return nil, err
+	}
+	ring, err := syscall.Mmap(fd, 0, cfg.BlockSize*cfg.Blocks, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &tpacketRing{fd: fd, ring: ring, blockSize: cfg.BlockSize, blocks: cfg.Blocks}, nil
+}
+
+func (ring *tpacketRing) block() *tpacketBlockDesc {
+	return (*tpacketBlockDesc)(unsafe.Pointer(&ring.ring[ring.current*ring.blockSize]))
+}
+
+// ReadPacketData returns the next frame received by the interface, skipping the frames it sent.
+// Once the ring is stopped, it returns io.EOF.
+func (ring *tpacketRing) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	for {
+		if atomic.LoadUint32(&ring.stopped) != 0 {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		if ring.reading && ring.remaining == 0 {
+			ring.release()
+		}
+		if !ring.reading {
+			if err := ring.acquire(); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			continue
+		}
+		block := ring.ring[ring.current*ring.blockSize : (ring.current+1)*ring.blockSize]
+		data, info, outgoing := readTPacketFrame(block, &ring.next)
+		ring.remaining--
+		if !outgoing {
+			return data, info, nil
+		}
+	}
+}
+
+// acquire waits up to a second for the kernel to pass the current block
+func (ring *tpacketRing) acquire() error {
+	block := ring.block()
+	if atomic.LoadUint32(&block.blockStatus)&tpStatusUser == 0 {
+		if err := ring.poll(time.Second); err != nil {
+			return err
+		}
+		if atomic.LoadUint32(&block.blockStatus)&tpStatusUser == 0 {
+			return pcap.NextErrorTimeoutExpired
+		}
+	}
+	tpacketStats.Add("blocks", 1)
+	if atomic.LoadUint32(&block.blockStatus)&tpStatusLosing != 0 {
+		tpacketStats.Add("losing_blocks", 1)
+	}
+	ring.reading, ring.remaining, ring.next = true, block.numPkts, int(block.offsetToFirstPkt)
+	return nil
+}
+
+// release passes the current block back to the kernel, and moves on to the next one
+func (ring *tpacketRing) release() {
+	atomic.StoreUint32(&ring.block().blockStatus, tpStatusKernel)
+	ring.current = (ring.current + 1) % ring.blocks
+	ring.reading = false
+}
+
+func (ring *tpacketRing) poll(timeout time.Duration) error {
+	fds := pollFd{fd: int32(ring.fd), events: pollIn | pollErr}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return errno
+	}
+	return nil
+}
+
+// readTPacketFrame returns a copy of the frame at offset next of a block, and moves next to the following frame.
+// outgoing is set for the frames sent by the interface.
+func readTPacketFrame(block []byte, next *int) (data []byte, info gopacket.CaptureInfo, outgoing bool) {
+	offset := *next
+	hdr := (*tpacket3Hdr)(unsafe.Pointer(&block[offset]))
+	*next = offset + int(hdr.nextOffset)
+	addr := (*syscall.RawSockaddrLinklayer)(unsafe.Pointer(&block[offset+int(unsafe.Sizeof(tpacket3Hdr{}))]))
+	if addr.Pkttype == syscall.PACKET_OUTGOING {
+		return nil, info, true
+	}
+	start := offset + int(hdr.mac)
+	data = append([]byte(nil), block[start:start+int(hdr.snaplen)]...)
+	info = gopacket.CaptureInfo{Timestamp: time.Unix(int64(hdr.sec), int64(hdr.nsec)), CaptureLength: int(hdr.snaplen), Length: int(hdr.len)}
+	if hdr.status&tpStatusVLANValid != 0 {
+		data = restoreVLANTag(data, &info, uint16(hdr.vlanTCI))
+	}
+	return data, info, false
+}
+
+// WritePacketData injects a frame through the socket, the NIC inserting the VLAN tag of tagged frames when offloading
+func (ring *tpacketRing) WritePacketData(data []byte) error {
+	_, err := syscall.Write(ring.fd, data)
+	return err
+}
+
+// Stop makes the reads return io.EOF, the read in progress returning once its poll times out
+func (ring *tpacketRing) Stop() {
+	atomic.StoreUint32(&ring.stopped, 1)
+}
+
+// Close stops the ring, and unmaps it and closes the socket once the reader has left it
+func (ring *tpacketRing) Close() {
+	ring.Stop()
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	if ring.ring == nil {
+		return
+	}
+	syscall.Munmap(ring.ring)
+	syscall.Close(ring.fd)
+	ring.ring = nil
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestTPacketRing(t *testing.T) {
+	frame := createMockTaggedFrame()
+	stripped := append(append([]byte{}, frame[:12]...), frame[16:]...)
+	block := make([]byte, 4096)
+	desc := (*tpacketBlockDesc)(unsafe.Pointer(&block[0]))
+	desc.blockStatus, desc.numPkts, desc.offsetToFirstPkt = tpStatusUser|tpStatusLosing, 2, 48
+
+	// A frame sent by the interface, followed by a received frame whose tag was stripped by the NIC
+	addFrame := func(offset, next int, pktType uint8, status uint32) {
+		hdr := (*tpacket3Hdr)(unsafe.Pointer(&block[offset]))
+		hdr.nextOffset, hdr.mac, hdr.snaplen, hdr.len, hdr.status, hdr.vlanTCI = uint32(next), 80, uint32(len(stripped)), uint32(len(stripped)), status, uint32(vlanIdentifierTest)
+		(*syscall.RawSockaddrLinklayer)(unsafe.Pointer(&block[offset+48])).Pkttype = pktType
+		copy(block[offset+80:], stripped)
+	}
+	addFrame(48, 1024, syscall.PACKET_OUTGOING, 0)
+	addFrame(1072, 0, syscall.PACKET_HOST, tpStatusVLANValid)
+
+	ring := &tpacketRing{ring: block, blockSize: len(block), blocks: 1}
+	data, info, err := ring.ReadPacketData()
+	if err != nil || !bytes.Equal(data, frame) || info.CaptureLength != len(frame) || info.Length != len(frame) {
+		t.Fatalf("Error in ReadPacketData(): expected the received frame with its stripped tag, got %x (%v)", data, err)
+	}
+	if ring.remaining != 0 {
+		t.Errorf("Error in ReadPacketData(): expected the block to be read, %v frames remaining", ring.remaining)
+	}
+	ring.release()
+	if desc.blockStatus != tpStatusKernel || ring.current != 0 || ring.reading {
+		t.Error("Error in release(): expected the block to be passed back to the kernel")
+	}
+}
+
+func TestTPacketRingClose(t *testing.T) {
+	// A ring whose block is never passed by the kernel, the read waiting in poll for a socket without data
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	block, err := syscall.Mmap(-1, 0, os.Getpagesize(), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := &tpacketRing{fd: fds[0], ring: block, blockSize: len(block), blocks: 1}
+
+	returned := make(chan error, 1)
+	go func() {
+		_, _, err := ring.ReadPacketData()
+		returned <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// As on a restart of the capture, the ring is stopped and closed while the read is blocked: unmapping the ring
+	// before the read leaves poll would make it fault on the status of the block
+	ring.Stop()
+	ring.Close()
+	select {
+	case err := <-returned:
+		if err != pcap.NextErrorTimeoutExpired && err != io.EOF {
+			t.Errorf("Error in ReadPacketData(): expected the interrupted read to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Error in ReadPacketData(): the read should return once its poll times out")
+	}
+	if _, _, err := ring.ReadPacketData(); err != io.EOF {
+		t.Errorf("Error in ReadPacketData(): expected io.EOF once the ring is closed, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package transport reads the frames of the VLAN trunk and injects frames into it, independently of the protocols
+// the reflector handles. It defines the interfaces of the capture handles, which *pcap.Handle implements, and the
+// AF_PACKET handles, which report the VLAN tags stripped by the NIC and are filtered by classic BPF programs.
+package transport
+
+import (
+	"github.com/google/gopacket"
+)
+
+// Writer injects raw frames on the network, as *pcap.Handle does
+type Writer interface {
+	WritePacketData(data []byte) error
+}
+
+// Handle reads the frames of the VLAN trunk, and injects frames into it
+type Handle interface {
+	gopacket.PacketDataSource
+	Writer
+}
+
+// Instruction is an instruction of a classic BPF program, like struct sock_filter of linux/filter.h
+type Instruction struct {
+	Code   uint16
+	Jt, Jf uint8
+	K      uint32
+}
+
+// ProgramSetter is implemented by the AF_PACKET handles, filtered by a BPF program rather than by an expression
+// compiled by libpcap, which ignores the VLAN tags stripped by the NIC
+type ProgramSetter interface {
+	SetBPFProgram(program []Instruction) error
+}
+
+// Stopper is implemented by the handles whose reads can be interrupted before the handle is closed, such as the
+// reads of a ring buffer which may only be unmapped once they return
+type Stopper interface {
+	Stop()
+}
+
+// RingConfig sizes the TPACKET_V3 ring buffer of an AF_PACKET handle: Blocks blocks of BlockSize bytes, a multiple of
+// the page size. Without blocks, the frames are read one by one.
+type RingConfig struct {
+	Blocks    int
+	BlockSize int
+}
@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"encoding/binary"
+	"expvar"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Number of frames whose VLAN tag was restored from the metadata reported by the kernel, exposed on /debug/vars
+var restoredVLANTags = expvar.NewInt("restored_vlan_tags")
+
+// restoreVLANTag returns the frame read by a capture with the 802.1Q header carrying tci reinserted, when the NIC
+// stripped it (VLAN offload) and the kernel reported it, so that the stripped frames are parsed and reflected like
+// tagged ones. The lengths of info are updated to match.
+func restoreVLANTag(frame []byte, info *gopacket.CaptureInfo, tci uint16) []byte {
+	if len(frame) < 14 || layers.EthernetType(binary.BigEndian.Uint16(frame[12:14])) == layers.EthernetTypeDot1Q {
+		return frame
+	}
+	info.CaptureLength += 4
+	info.Length += 4
+	restoredVLANTags.Add(1)
+	return insertVLANTag(frame, tci)
+}
+
+// insertVLANTag returns a copy of the untagged frame, with an 802.1Q header carrying tci
+func insertVLANTag(frame []byte, tci uint16) []byte {
+	tagged := make([]byte, len(frame)+4)
+	copy(tagged, frame[:12])
+	binary.BigEndian.PutUint16(tagged[12:14], uint16(layers.EthernetTypeDot1Q))
+	binary.BigEndian.PutUint16(tagged[14:16], tci)
+	copy(tagged[16:], frame[12:])
+	return tagged
+}
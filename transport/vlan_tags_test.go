@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const vlanIdentifierTest = 30
+
+// createMockTaggedFrame returns an mDNS query sent on the VLAN vlanIdentifierTest
+func createMockTaggedFrame() []byte {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 255, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{127, 0, 0, 1}, DstIP: net.IP{224, 0, 0, 251}}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5353}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0xFF, 0xAA, 0xFA, 0xAA, 0xFF, 0xAA},
+			DstMAC:       net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB},
+			EthernetType: layers.EthernetTypeDot1Q,
+		},
+		&layers.Dot1Q{VLANIdentifier: vlanIdentifierTest, Type: layers.EthernetTypeIPv4},
+		ipv4, udp,
+		&layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}})
+	return buf.Bytes()
+}
+
+func TestRestoreVLANTag(t *testing.T) {
+	tagged := createMockTaggedFrame()
+	// The NIC strips the 802.1Q header, and the kernel reports the tag as auxiliary data
+	stripped := append(append([]byte{}, tagged[:12]...), tagged[16:]...)
+	info := gopacket.CaptureInfo{CaptureLength: len(stripped), Length: len(stripped)}
+	restored := restoreVLANTag(stripped, &info, vlanIdentifierTest)
+	if !bytes.Equal(restored, tagged) || info.CaptureLength != len(tagged) || info.Length != len(tagged) {
+		t.Errorf("Error in restoreVLANTag(): expected the original frame, got %x", restored)
+	}
+	packet := gopacket.NewPacket(restored, layers.LayerTypeEthernet, gopacket.Default)
+	dot1q, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok || dot1q.VLANIdentifier != vlanIdentifierTest || packet.Layer(layers.LayerTypeUDP) == nil {
+		t.Error("Error in restoreVLANTag(): expected the restored frame to be parsed with its tag")
+	}
+
+	info = gopacket.CaptureInfo{CaptureLength: len(tagged), Length: len(tagged)}
+	if restored := restoreVLANTag(tagged, &info, 42); !bytes.Equal(restored, tagged) || info.CaptureLength != len(tagged) {
+		t.Error("Error in restoreVLANTag(): tagged frames should be left as is")
+	}
+}
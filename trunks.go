@@ -0,0 +1,268 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// Frames read from all the trunks and waiting to be parsed
+const trunkFramesCapacity = 1024
+
+// Delay before reading again from a trunk whose read failed
+const trunkReadErrorDelay = 5 * time.Millisecond
+
+// trunkCapture captures the trunk of the reflector, either on one interface at a time (failing over between the
+// interfaces of net_interfaces), or on all the trunk_interfaces at once
+type trunkCapture interface {
+	captureHandle
+	bpfSetter
+	// activeInterface returns the interface providing the MAC address of the reflector
+	activeInterface() string
+	// healthCheck reports the state of the capture
+	healthCheck() healthCheck
+	// restart reopens the handles of the capture, when the watchdog finds it stalled
+	restart() error
+	// stop makes the reads return io.EOF, on shutdown
+	stop()
+	// Close closes the handles, once the reflected frames are injected
+	Close()
+}
+
+// openTrunkCapture opens the capture of the configured interfaces, using open to get their handles
+func openTrunkCapture(cfg *brconfig, open func(intf string) (captureHandle, error)) (trunkCapture, error) {
+	if len(cfg.TrunkInterfaces) == 0 {
+		return newFailoverCapture(cfg.captureInterfaces(), open)
+	}
+	return newMultiCapture(cfg.TrunkInterfaces, open)
+}
+
+// healthCheck reports the capture as failed while no interface can be captured on, and as degraded while the
+// handle reports a partial failure, such as the socket of a VLAN which cannot be read from
+func (capture *failoverCapture) healthCheck() healthCheck {
+	check := capture.status.check(map[string]expvar.Var{
+		"interface": captureInterface,
+		"failovers": captureFailovers,
+	})
+	return func() subsystemHealth {
+		report := check()
+		capture.mutex.RLock()
+		handle := capture.handle
+		capture.mutex.RUnlock()
+		if reporter, ok := handle.(interface{ degraded() string }); ok && report.State == healthOK {
+			if detail := reporter.degraded(); detail != "" {
+				report.State, report.Detail = healthDegraded, detail
+			}
+		}
+		return report
+	}
+}
+
+// capturedFrame is a frame read from one of the trunks
+type capturedFrame struct {
+	data []byte
+	info gopacket.CaptureInfo
+}
+
+// multiCapture captures on several trunk interfaces at once, such as trunk ports spread over two NICs, and merges
+// their frames. Frames are injected through the trunk where the traffic of their VLAN was last captured, or through
+// every trunk when it was never seen. Each trunk is reopened when it keeps failing, like a lone failover interface.
+type multiCapture struct {
+	trunks []*failoverCapture
+	// frames is closed once every trunk is stopped
+	frames  chan capturedFrame
+	readers sync.WaitGroup
+	mutex   sync.RWMutex
+	// vlans holds the trunk where the traffic of each VLAN was last captured
+	vlans map[uint16]*failoverCapture
+}
+
+func newMultiCapture(interfaces []string, open func(intf string) (captureHandle, error)) (*multiCapture, error) {
+	capture := &multiCapture{frames: make(chan capturedFrame, trunkFramesCapacity), vlans: make(map[uint16]*failoverCapture)}
+	for _, intf := range interfaces {
+		trunk, err := newFailoverCapture([]string{intf}, open)
+		if err != nil {
+			return nil, err
+		}
+		// The interfaces of the trunks are reported together
+		trunk.shared = true
+		capture.trunks = append(capture.trunks, trunk)
+	}
+	captureInterface.Set(strings.Join(interfaces, ","))
+	capture.readers.Add(len(capture.trunks))
+	for _, trunk := range capture.trunks {
+		go capture.read(trunk)
+	}
+	go func() {
+		capture.readers.Wait()
+		close(capture.frames)
+	}()
+	return capture, nil
+}
+
+// read forwards the frames captured on trunk, learning the VLANs it carries
+func (capture *multiCapture) read(trunk *failoverCapture) {
+	defer capture.readers.Done()
+	for {
+		data, info, err := trunk.ReadPacketData()
+		if err == io.EOF {
+			return
+		}
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			time.Sleep(trunkReadErrorDelay)
+			continue
+		}
+		if tag, ok := frameVLAN(data); ok {
+			capture.learn(tag, trunk)
+		}
+		capture.frames <- capturedFrame{data, info}
+	}
+}
+
+func (capture *multiCapture) learn(tag uint16, trunk *failoverCapture) {
+	capture.mutex.RLock()
+	known := capture.vlans[tag] == trunk
+	capture.mutex.RUnlock()
+	if !known {
+		capture.mutex.Lock()
+		capture.vlans[tag] = trunk
+		capture.mutex.Unlock()
+	}
+}
+
+// ReadPacketData returns the next frame captured on any of the trunks
+func (capture *multiCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	frame, ok := <-capture.frames
+	if !ok {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return frame.data, frame.info, nil
+}
+
+// WritePacketData injects data through the trunk carrying its VLAN, or through every trunk when it is unknown
+func (capture *multiCapture) WritePacketData(data []byte) error {
+	tag, ok := frameVLAN(data)
+	capture.mutex.RLock()
+	trunk := capture.vlans[tag]
+	capture.mutex.RUnlock()
+	if ok && trunk != nil {
+		return trunk.WritePacketData(data)
+	}
+	var failures []string
+	for _, trunk := range capture.trunks {
+		if err := trunk.WritePacketData(data); err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", trunk.activeInterface(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("could not inject on %v", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// SetBPFFilter installs filter on every trunk
+func (capture *multiCapture) SetBPFFilter(filter string) error {
+	for _, trunk := range capture.trunks {
+		if err := trunk.SetBPFFilter(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBPFProgram installs program on every trunk
+func (capture *multiCapture) setBPFProgram(program []bpfInstruction) error {
+	for _, trunk := range capture.trunks {
+		if err := trunk.setBPFProgram(program); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restart reopens the handles of every trunk
+func (capture *multiCapture) restart() error {
+	var failures []string
+	for _, trunk := range capture.trunks {
+		if err := trunk.restart(); err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", trunk.activeInterface(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("could not reopen the trunks: %v", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// stop stops every trunk, the reads returning io.EOF once the frames already captured are read
+func (capture *multiCapture) stop() {
+	for _, trunk := range capture.trunks {
+		trunk.stop()
+	}
+}
+
+// Close closes the handles of every trunk
+func (capture *multiCapture) Close() {
+	for _, trunk := range capture.trunks {
+		trunk.Close()
+	}
+}
+
+// activeInterface returns the first trunk interface, which provides the MAC address of the reflector
+func (capture *multiCapture) activeInterface() string {
+	return capture.trunks[0].activeInterface()
+}
+
+// trunkVLANs returns the VLANs learned on each trunk interface
+func (capture *multiCapture) trunkVLANs() map[string][]uint16 {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	vlans := make(map[string][]uint16)
+	for tag, trunk := range capture.vlans {
+		intf := trunk.activeInterface()
+		vlans[intf] = append(vlans[intf], tag)
+	}
+	for _, tags := range vlans {
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	}
+	return vlans
+}
+
+// healthCheck reports the capture as failed when no trunk can be captured on, and degraded when some of them fail
+func (capture *multiCapture) healthCheck() healthCheck {
+	checks := make([]healthCheck, len(capture.trunks))
+	for i, trunk := range capture.trunks {
+		checks[i] = trunk.status.check(nil)
+	}
+	return func() subsystemHealth {
+		report := subsystemHealth{State: healthOK, Metrics: expvarMetrics(map[string]expvar.Var{
+			"interface": captureInterface,
+			"failovers": captureFailovers,
+		})}
+		report.Metrics["vlans"] = capture.trunkVLANs()
+		var failed []string
+		for i, check := range checks {
+			if trunk := check(); trunk.State != healthOK {
+				failed = append(failed, fmt.Sprintf("%v: %v", capture.trunks[i].activeInterface(), trunk.Detail))
+			}
+		}
+		switch {
+		case len(failed) == len(checks):
+			report.State = healthFailed
+		case len(failed) > 0:
+			report.State = healthDegraded
+		}
+		report.Detail = strings.Join(failed, "; ")
+		return report
+	}
+}
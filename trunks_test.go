@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// trunkMock returns the frames sent to its channel, and records the injected frames
+type trunkMock struct {
+	received chan []byte
+	injected chan []byte
+}
+
+func newTrunkMock() *trunkMock {
+	return &trunkMock{received: make(chan []byte), injected: make(chan []byte, 10)}
+}
+
+func (trunk *trunkMock) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return <-trunk.received, gopacket.CaptureInfo{}, nil
+}
+
+func (trunk *trunkMock) WritePacketData(data []byte) error {
+	trunk.injected <- data
+	return nil
+}
+
+func createMockTaggedFrame(tag uint16) []byte {
+	frame := make([]byte, 18)
+	frame[12], frame[13] = 0x81, 0x00
+	frame[14], frame[15] = byte(tag>>8), byte(tag)
+	return frame
+}
+
+func TestMultiCapture(t *testing.T) {
+	trunks := map[string]*trunkMock{"eth0": newTrunkMock(), "eth1": newTrunkMock()}
+	capture, err := newMultiCapture([]string{"eth0", "eth1"}, func(intf string) (captureHandle, error) {
+		return trunks[intf], nil
+	})
+	if err != nil || capture.activeInterface() != "eth0" {
+		t.Fatalf("Error in newMultiCapture(): %v", err)
+	}
+
+	// Frames of both trunks are merged
+	trunks["eth0"].received <- createMockTaggedFrame(10)
+	trunks["eth1"].received <- createMockTaggedFrame(20)
+	for i := 0; i < 2; i++ {
+		if data, _, err := capture.ReadPacketData(); err != nil || len(data) != 18 {
+			t.Fatalf("Error in ReadPacketData(): got %v, %v", data, err)
+		}
+	}
+
+	// Frames are injected through the trunk carrying their VLAN, or every trunk when it was never seen
+	tests := []struct {
+		tag        uint16
+		eth0, eth1 int
+	}{
+		{10, 1, 0},
+		{20, 0, 1},
+		{30, 1, 1},
+	}
+	for _, test := range tests {
+		if err := capture.WritePacketData(createMockTaggedFrame(test.tag)); err != nil {
+			t.Fatalf("Error in WritePacketData(): %v", err)
+		}
+		if len(trunks["eth0"].injected) != test.eth0 || len(trunks["eth1"].injected) != test.eth1 {
+			t.Errorf("Error in WritePacketData() for VLAN %v: injected %v frames on eth0 and %v on eth1", test.tag, len(trunks["eth0"].injected), len(trunks["eth1"].injected))
+		}
+		for _, trunk := range trunks {
+			for len(trunk.injected) > 0 {
+				<-trunk.injected
+			}
+		}
+	}
+
+	if vlans := capture.trunkVLANs(); len(vlans["eth0"]) != 1 || vlans["eth0"][0] != 10 || len(vlans["eth1"]) != 1 || vlans["eth1"][0] != 20 {
+		t.Errorf("Error in trunkVLANs(): got %v", vlans)
+	}
+	if report := capture.healthCheck()(); report.State != healthOK {
+		t.Errorf("Error in healthCheck(): got %+v", report)
+	}
+	capture.trunks[1].status.set(healthFailed, "no such device")
+	if report := capture.healthCheck()(); report.State != healthDegraded || report.Detail != "eth1: no such device" {
+		t.Errorf("Error in healthCheck(): got %+v", report)
+	}
+}
+
+func TestTrunkInterfacesConfig(t *testing.T) {
+	cfg, err := parseConfig(`trunk_interfaces = ["eth0", "eth1"]`)
+	if err != nil || cfg.NetInterface != "eth0" {
+		t.Errorf("Error in parseConfig(): the first trunk should provide the MAC address, got %v, %v", cfg.NetInterface, err)
+	}
+	for _, content := range []string{
+		"net_interface = \"eth0\"\ntrunk_interfaces = [\"eth1\"]",
+		"capture_mode = \"socket\"\ntrunk_interfaces = [\"eth0\", \"eth1\"]",
+	} {
+		if _, err := parseConfig(content); err == nil {
+			t.Errorf("Error in parseConfig(): expected an error for %q", content)
+		}
+	}
+}
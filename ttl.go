@@ -0,0 +1,106 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+var ttlFloorRewrites = expvar.NewInt("ttl_floor_rewrites")
+
+// ttlFloors maps service types to the minimal TTL of their records. Devices advertising very short TTLs
+// make the caches of the target VLANs expire constantly, and the reflector relay the resulting re-announcements.
+type ttlFloors map[string]uint32
+
+func newTTLFloors(floors map[string]uint32) ttlFloors {
+	byName := make(ttlFloors)
+	for service, floor := range floors {
+		byName[fullServiceName(service)] = floor
+	}
+	return byName
+}
+
+// apply raises the TTL of the records of the services with a floor, and tells whether dns was modified
+func (floors ttlFloors) apply(dns *layers.DNS) (rewritten bool) {
+	if dns == nil || len(floors) == 0 {
+		return false
+	}
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for i := range records {
+			// Goodbye packets must keep their TTL of 0
+			if records[i].TTL == 0 {
+				continue
+			}
+			for service, floor := range floors {
+				if records[i].TTL < floor && belongsToService(records[i].Name, service) {
+					records[i].TTL = floor
+					rewritten = true
+					ttlFloorRewrites.Add(1)
+				}
+			}
+		}
+	}
+	return
+}
+
+var ttlCeilingRewrites = expvar.NewInt("ttl_ceiling_rewrites")
+
+// ttlCeilings caps the TTL of the reflected records, for every record (max_ttl) or for the records of some
+// service types. Clients of the target VLANs keep the records for their whole TTL, so devices which move to
+// another VLAN or leave would otherwise stay listed, e.g. as stale AirPlay targets.
+type ttlCeilings struct {
+	max       uint32
+	byService map[string]uint32
+}
+
+func newTTLCeilings(maxTTL uint32, ceilings map[string]uint32) ttlCeilings {
+	byName := make(map[string]uint32)
+	for service, ceiling := range ceilings {
+		byName[fullServiceName(service)] = ceiling
+	}
+	return ttlCeilings{max: maxTTL, byService: byName}
+}
+
+// ceiling returns the maximal TTL of a record, the ceiling of its service type taking precedence over max_ttl,
+// or 0 when it is not capped
+func (ceilings ttlCeilings) ceiling(name []byte) uint32 {
+	for service, ceiling := range ceilings.byService {
+		if belongsToService(name, service) {
+			return ceiling
+		}
+	}
+	return ceilings.max
+}
+
+// apply lowers the TTL of the records above their ceiling, and tells whether dns was modified
+func (ceilings ttlCeilings) apply(dns *layers.DNS) (rewritten bool) {
+	if dns == nil || (ceilings.max == 0 && len(ceilings.byService) == 0) {
+		return false
+	}
+	for _, records := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for i := range records {
+			if ceiling := ceilings.ceiling(records[i].Name); ceiling > 0 && records[i].TTL > ceiling {
+				records[i].TTL = ceiling
+				rewritten = true
+				ttlCeilingRewrites.Add(1)
+			}
+		}
+	}
+	return
+}
+
+// validateTTLLimits checks that no ceiling is below the floor of a service type, which would rewrite its records back and forth
+func validateTTLLimits(floors map[string]uint32, maxTTL uint32, ceilings map[string]uint32) error {
+	capped := newTTLCeilings(maxTTL, ceilings)
+	for service, floor := range newTTLFloors(floors) {
+		ceiling, ok := capped.byService[service]
+		if !ok {
+			ceiling = maxTTL
+		}
+		if ceiling > 0 && ceiling < floor {
+			return fmt.Errorf("invalid TTL limits for %v, its ceiling %v is below its floor %v", service, ceiling, floor)
+		}
+	}
+	return nil
+}
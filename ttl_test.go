@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestTTLFloors(t *testing.T) {
+	floors := newTTLFloors(map[string]uint32{"_googlecast._tcp": 120})
+	dns := createMockPTRAnswer("_googlecast._tcp.local", "TV._googlecast._tcp.local", 10)
+	dns.Additionals = []layers.DNSResourceRecord{
+		{Name: []byte("TV._googlecast._tcp.local"), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: 300},
+		{Name: []byte("TV._googlecast._tcp.local"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: 5},
+		{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 5},
+	}
+
+	if !floors.apply(dns) {
+		t.Fatal("Error in apply(): records should be rewritten")
+	}
+	ttls := []uint32{dns.Answers[0].TTL, dns.Additionals[0].TTL, dns.Additionals[1].TTL, dns.Additionals[2].TTL}
+	expected := []uint32{120, 300, 120, 5}
+	for i := range ttls {
+		if ttls[i] != expected[i] {
+			t.Errorf("Error in apply(): got TTLs %v, expected %v", ttls, expected)
+			break
+		}
+	}
+
+	// Goodbye packets are left untouched
+	if floors.apply(createMockPTRAnswer("_googlecast._tcp.local", "TV._googlecast._tcp.local", 0)) {
+		t.Error("Error in apply(): goodbye packets should not be rewritten")
+	}
+}
+
+func TestTTLCeilings(t *testing.T) {
+	ceilings := newTTLCeilings(120, map[string]uint32{"_airplay._tcp": 60})
+	dns := createMockPTRAnswer("_airplay._tcp.local", "TV._airplay._tcp.local", 4500)
+	dns.Additionals = []layers.DNSResourceRecord{
+		{Name: []byte("TV._airplay._tcp.local"), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: 30},
+		{Name: []byte("tv.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 4500},
+		{Name: []byte("tv.local"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 0},
+	}
+
+	if !ceilings.apply(dns) {
+		t.Fatal("Error in apply(): records should be rewritten")
+	}
+	ttls := []uint32{dns.Answers[0].TTL, dns.Additionals[0].TTL, dns.Additionals[1].TTL, dns.Additionals[2].TTL}
+	expected := []uint32{60, 30, 120, 0}
+	for i := range ttls {
+		if ttls[i] != expected[i] {
+			t.Errorf("Error in apply(): got TTLs %v, expected %v", ttls, expected)
+			break
+		}
+	}
+	if newTTLCeilings(0, nil).apply(createMockPTRAnswer("_airplay._tcp.local", "TV._airplay._tcp.local", 4500)) {
+		t.Error("Error in apply(): records should not be rewritten without ceilings")
+	}
+
+	if err := validateTTLLimits(map[string]uint32{"_googlecast._tcp": 120}, 60, nil); err == nil {
+		t.Error("Error in validateTTLLimits(): max_ttl below a floor should be rejected")
+	}
+	if err := validateTTLLimits(map[string]uint32{"_googlecast._tcp": 120}, 60, map[string]uint32{"_googlecast._tcp.local": 300}); err != nil {
+		t.Errorf("Error in validateTTLLimits(): the ceiling of the service should take precedence over max_ttl, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Default lifetime of a unicast query in the correlation table
+	defaultUnicastTimeout = 5 * time.Second
+	// Default maximal number of entries in the correlation table
+	defaultUnicastTableSize = 1024
+	// Number of lookups kept to explain why unicast answers were or were not relayed
+	unicastDecisionsKept = 64
+	// Top bit of the class of a question, asking for a unicast response (RFC 6762, section 5.4)
+	unicastResponseBit = 0x8000
+)
+
+// Unicast responses to QU questions relayed or unmatched, exposed on /debug/vars
+var unicastResponseStats = expvar.NewMap("unicast_responses")
+
+// unicastKey identifies the answers to a unicast query.
+// Legacy unicast responses repeat the ID of the query, while QU responses use an ID of 0.
+type unicastKey struct {
+	id   uint16
+	name string
+}
+
+type unicastQuerier struct {
+	ID     uint16     `json:"id"`
+	Name   string     `json:"name"`
+	MAC    macAddress `json:"mac"`
+	VLAN   uint16     `json:"vlan"`
+	IP     net.IP     `json:"ip"`
+	Port   uint16     `json:"port"`
+	Legacy bool       `json:"legacy"`
+	// Targets are the VLANs the query was reflected to, which the response must come from
+	Targets []uint16  `json:"targets"`
+	Expires time.Time `json:"expires"`
+}
+
+type unicastDecision struct {
+	Time    time.Time       `json:"time"`
+	ID      uint16          `json:"id"`
+	Names   []string        `json:"names"`
+	Querier *unicastQuerier `json:"querier,omitempty"`
+	Reason  string          `json:"reason"`
+}
+
+// unicastTable correlates unicast answers with the queries which asked for them,
+// so that they can be relayed back to the VLAN and address of the querier
+type unicastTable struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	maxSize int
+	// ignoreQU treats questions with the QU bit set as multicast questions
+	ignoreQU  bool
+	entries   map[unicastKey]*unicastQuerier
+	decisions []unicastDecision
+}
+
+func newUnicastTable(timeout time.Duration, maxSize int) *unicastTable {
+	return &unicastTable{
+		timeout: timeout,
+		maxSize: maxSize,
+		entries: make(map[unicastKey]*unicastQuerier),
+	}
+}
+
+// recordQuery stores the questions of bonjourPacket which expect a unicast response:
+// questions with the QU bit set, and every question of legacy queries not sent from port 5353.
+// Queries reflected nowhere cannot be answered from another VLAN, and are not stored.
+// It returns the names of the questions stored.
+func (table *unicastTable) recordQuery(bonjourPacket *bonjourPacket, targets []uint16, now time.Time) (names []string) {
+	if bonjourPacket.dns == nil || bonjourPacket.vlanTag == nil || len(targets) == 0 {
+		return nil
+	}
+	legacy := bonjourPacket.srcPort != 5353
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	for _, question := range bonjourPacket.dns.Questions {
+		if !legacy && (table.ignoreQU || uint16(question.Class)&unicastResponseBit == 0) {
+			continue
+		}
+		key := unicastKey{name: strings.ToLower(string(question.Name))}
+		if legacy {
+			key.id = bonjourPacket.dns.ID
+		}
+		if _, ok := table.entries[key]; !ok && len(table.entries) >= table.maxSize {
+			table.evict(now)
+		}
+		table.entries[key] = &unicastQuerier{
+			ID:      key.id,
+			Name:    key.name,
+			MAC:     macAddress(bonjourPacket.srcMAC.String()),
+			VLAN:    *bonjourPacket.vlanTag,
+			IP:      bonjourPacket.srcIP,
+			Port:    uint16(bonjourPacket.srcPort),
+			Legacy:  legacy,
+			Targets: append([]uint16{}, targets...),
+			Expires: now.Add(table.timeout),
+		}
+		names = append(names, key.name)
+	}
+	return names
+}
+
+// evict removes expired entries, or the entry closest to expiry when none expired.
+// It must be called with the mutex held.
+func (table *unicastTable) evict(now time.Time) {
+	var oldestKey unicastKey
+	var oldest *unicastQuerier
+	for key, querier := range table.entries {
+		if now.After(querier.Expires) {
+			delete(table.entries, key)
+			continue
+		}
+		if oldest == nil || querier.Expires.Before(oldest.Expires) {
+			oldestKey, oldest = key, querier
+		}
+	}
+	if len(table.entries) >= table.maxSize && oldest != nil {
+		delete(table.entries, oldestKey)
+	}
+}
+
+// lookup returns the querier which asked for an answer with the given ID and record names, from a VLAN
+// the query was reflected to, and records the decision so that it can be explained on the debug server
+func (table *unicastTable) lookup(id uint16, names []string, vlan uint16, now time.Time) *unicastQuerier {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	decision := unicastDecision{Time: now, ID: id, Names: names, Reason: "no matching query"}
+	for _, name := range names {
+		querier, ok := table.entries[unicastKey{id: id, name: strings.ToLower(name)}]
+		if !ok {
+			continue
+		}
+		if now.After(querier.Expires) {
+			decision.Reason = "matching query expired"
+			continue
+		}
+		if !containsVLAN(querier.Targets, vlan) {
+			decision.Reason = "matching query not reflected to the VLAN of the response"
+			continue
+		}
+		found := *querier
+		decision.Querier, decision.Reason = &found, "relayed"
+		break
+	}
+
+	table.decisions = append(table.decisions, decision)
+	if len(table.decisions) > unicastDecisionsKept {
+		table.decisions = table.decisions[len(table.decisions)-unicastDecisionsKept:]
+	}
+	return decision.Querier
+}
+
+func (table *unicastTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	table.mutex.Lock()
+	state := struct {
+		Entries   []unicastQuerier  `json:"entries"`
+		Decisions []unicastDecision `json:"decisions"`
+	}{[]unicastQuerier{}, append([]unicastDecision{}, table.decisions...)}
+	for _, querier := range table.entries {
+		state.Entries = append(state.Entries, *querier)
+	}
+	table.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// responseNames returns the names a unicast response may be matched with: legacy responses repeat the questions
+// of the query, and the answers are named after the questions
+func responseNames(dns *layers.DNS) []string {
+	var names []string
+	for _, question := range dns.Questions {
+		names = append(names, string(question.Name))
+	}
+	for _, answer := range dns.Answers {
+		names = append(names, string(answer.Name))
+	}
+	return names
+}
+
+// mayRelayResponse tells whether a unicast response may be relayed to the VLAN of querier: the responder has to be
+// shared with it, and the flow between their domains allowed, as for the answers reflected there
+func (r *reflector) mayRelayResponse(bonjourPacket *bonjourPacket, querier *unicastQuerier) bool {
+	tags := intersectVLANs(r.deviceTargets(bonjourPacket), []uint16{querier.VLAN})
+	return len(r.compliance.filter(&r.cfg, bonjourPacket, tags)) > 0
+}
+
+// relayQUResponse sends a unicast response to a QU question back to the querier, on its VLAN. The responder sends it
+// to the address of the querier, which is on another VLAN, so that it would only arrive when the VLANs are routed.
+func (r *reflector) relayQUResponse(bonjourPacket *bonjourPacket) {
+	if bonjourPacket.dns == nil || !bonjourPacket.dns.QR {
+		return
+	}
+	// The ID of QU responses is ignored (RFC 6762, section 18.1), they are recorded with an ID of 0
+	dstIP, _ := parseIPLayer(bonjourPacket.packet)
+	querier := r.unicastTable.lookup(0, responseNames(bonjourPacket.dns), *bonjourPacket.vlanTag, time.Now())
+	if querier == nil || querier.Legacy || !querier.IP.Equal(dstIP) {
+		unicastResponseStats.Add("unmatched", 1)
+		return
+	}
+	if querier.VLAN == *bonjourPacket.vlanTag {
+		// The querier received it on its own VLAN
+		return
+	}
+	if !r.mayRelayResponse(bonjourPacket, querier) {
+		unicastResponseStats.Add("refused", 1)
+		return
+	}
+	mac, err := net.ParseMAC(string(querier.MAC))
+	if err != nil {
+		return
+	}
+	// Serializing the response rewrites its source
+	source := macAddress(bonjourPacket.srcMAC.String())
+	defer translateAddresses(bonjourPacket, r.cfg.translations[querier.VLAN])()
+	defer r.setRelaySource(bonjourPacket, querier)()
+	data, err := serializeUnicastBonjourPacket(bonjourPacket, querier.VLAN, r.brMACAddress, mac, querier.IP)
+	if err != nil {
+		logger.warnf("Could not relay the unicast response to %v: %v", querier.IP, err)
+		return
+	}
+	if !r.budget.allow(protocolMDNS, querier.VLAN, len(data), time.Now()) {
+		return
+	}
+	unicastResponseStats.Add("relayed", 1)
+	r.stats.reflected(source, 1, time.Now())
+	r.write(data)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Default delay during which a querier is considered interested in the answers for a service
+	defaultConversionWindow = 10 * time.Second
+	// Default number of queriers above which multicast costs less airtime than unicast copies
+	defaultConversionMaxQueriers = 4
+)
+
+type multicastToUnicastConfig struct {
+	Services    []string `toml:"services"`
+	Window      duration `toml:"window"`
+	MaxQueriers int      `toml:"max_queriers"`
+}
+
+type recentQuerier struct {
+	mac  net.HardwareAddr
+	ip   net.IP
+	time time.Time
+}
+
+// unicastConverter delivers answers for some service types as unicast copies to the hosts which recently
+// queried for them, instead of multicasting them on the target VLAN, saving airtime on dense Wi-Fi VLANs.
+// Answers nobody asked for, such as announcements, are still multicast, which preserves discovery.
+type unicastConverter struct {
+	mutex       sync.Mutex
+	services    []string
+	window      time.Duration
+	maxQueriers int
+	// queriers maps each VLAN and service to the hosts which recently queried for it
+	queriers map[uint16]map[string]map[macAddress]recentQuerier
+}
+
+func newUnicastConverter(cfg multicastToUnicastConfig) *unicastConverter {
+	converter := &unicastConverter{
+		window:      cfg.Window.Duration,
+		maxQueriers: cfg.MaxQueriers,
+		queriers:    make(map[uint16]map[string]map[macAddress]recentQuerier),
+	}
+	if converter.window == 0 {
+		converter.window = defaultConversionWindow
+	}
+	if converter.maxQueriers <= 0 {
+		converter.maxQueriers = defaultConversionMaxQueriers
+	}
+	for _, service := range cfg.Services {
+		converter.services = append(converter.services, fullServiceName(service))
+	}
+	return converter
+}
+
+// matchService returns the configured service a record name belongs to, e.g. "_airplay._tcp.local"
+// for "_airplay._tcp.local" or "Living Room._airplay._tcp.local"
+func (converter *unicastConverter) matchService(name []byte) (string, bool) {
+	for _, service := range converter.services {
+		if belongsToService(name, service) {
+			return service, true
+		}
+	}
+	return "", false
+}
+
+// recordQuery remembers the querier of bonjourPacket for each configured service it asks for
+func (converter *unicastConverter) recordQuery(bonjourPacket *bonjourPacket, now time.Time) {
+	if bonjourPacket.dns == nil || bonjourPacket.vlanTag == nil {
+		return
+	}
+	converter.mutex.Lock()
+	defer converter.mutex.Unlock()
+
+	for _, question := range bonjourPacket.dns.Questions {
+		service, ok := converter.matchService(question.Name)
+		if !ok {
+			continue
+		}
+		byService, ok := converter.queriers[*bonjourPacket.vlanTag]
+		if !ok {
+			byService = make(map[string]map[macAddress]recentQuerier)
+			converter.queriers[*bonjourPacket.vlanTag] = byService
+		}
+		queriers, ok := byService[service]
+		if !ok {
+			queriers = make(map[macAddress]recentQuerier)
+			byService[service] = queriers
+		}
+		for mac, querier := range queriers {
+			if now.Sub(querier.time) > converter.window {
+				delete(queriers, mac)
+			}
+		}
+		srcMAC := append(net.HardwareAddr{}, (*bonjourPacket.srcMAC)...)
+		queriers[macAddress(srcMAC.String())] = recentQuerier{mac: srcMAC, ip: bonjourPacket.srcIP, time: now}
+	}
+}
+
+// queriersFor returns the hosts of the VLAN tag which should receive the answer as unicast copies,
+// or nil when the answer must be multicast. maxQueriers overrides the configured limit when positive.
+func (converter *unicastConverter) queriersFor(dns *layers.DNS, tag uint16, maxQueriers int, now time.Time) []recentQuerier {
+	if dns == nil {
+		return nil
+	}
+	converter.mutex.Lock()
+	defer converter.mutex.Unlock()
+
+	services := make(map[string]bool)
+	for _, record := range dns.Answers {
+		if record.Type != layers.DNSTypePTR {
+			continue
+		}
+		service, ok := converter.matchService(record.Name)
+		if !ok {
+			// Hosts browsing for other services need the multicast answer
+			return nil
+		}
+		services[service] = true
+	}
+
+	seen := make(map[macAddress]bool)
+	var queriers []recentQuerier
+	for service := range services {
+		for mac, querier := range converter.queriers[tag][service] {
+			if !seen[mac] && now.Sub(querier.time) <= converter.window {
+				seen[mac] = true
+				queriers = append(queriers, querier)
+			}
+		}
+	}
+	if maxQueriers <= 0 {
+		maxQueriers = converter.maxQueriers
+	}
+	if len(queriers) > maxQueriers {
+		return nil
+	}
+	return queriers
+}
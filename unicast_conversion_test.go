@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestUnicastConverter(t *testing.T) {
+	converter := newUnicastConverter(multicastToUnicastConfig{
+		Services:    []string{"_airplay._tcp"},
+		Window:      duration{10 * time.Second},
+		MaxQueriers: 2,
+	})
+	now := time.Now()
+	question := layers.DNSQuestion{Name: []byte("_airplay._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	converter.recordQuery(createMockQuery(0, 5353, question), now)
+
+	answer := createMockPTRAnswer("_airplay._tcp.local", "Living Room._airplay._tcp.local", 120)
+	queriers := converter.queriersFor(answer, vlanIdentifierTest, 0, now.Add(time.Second))
+	if len(queriers) != 1 || queriers[0].mac.String() != srcMACTest.String() || !queriers[0].ip.Equal(srcIPv4Test) {
+		t.Errorf("Error in queriersFor(), got %+v", queriers)
+	}
+
+	tests := []struct {
+		description string
+		dns         *layers.DNS
+		tag         uint16
+		at          time.Time
+	}{
+		{"other VLAN", answer, 42, now},
+		{"expired query", answer, vlanIdentifierTest, now.Add(time.Minute)},
+		{"service not converted", createMockPTRAnswer("_ipp._tcp.local", "Office Printer._ipp._tcp.local", 120), vlanIdentifierTest, now},
+	}
+	for _, test := range tests {
+		if queriers := converter.queriersFor(test.dns, test.tag, 0, test.at); len(queriers) != 0 {
+			t.Errorf("Error in queriersFor() for %v: answer should be multicast, got %+v", test.description, queriers)
+		}
+	}
+
+	// Too many queriers are cheaper to reach with a single multicast answer
+	for i := byte(1); i <= 2; i++ {
+		query := createMockQuery(0, 5353, question)
+		mac := net.HardwareAddr{0x02, 0, 0, 0, 0, i}
+		query.srcMAC = &mac
+		converter.recordQuery(query, now)
+	}
+	if queriers := converter.queriersFor(answer, vlanIdentifierTest, 0, now); queriers != nil {
+		t.Errorf("Error in queriersFor(): answer should be multicast above max_queriers, got %+v", queriers)
+	}
+	// Wireless VLANs raise the limit
+	if queriers := converter.queriersFor(answer, vlanIdentifierTest, 4, now); len(queriers) != 3 {
+		t.Errorf("Error in queriersFor(): expected unicast copies to 3 queriers below the given limit, got %+v", queriers)
+	}
+}
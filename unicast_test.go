@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createMockQuery(id uint16, srcPort layers.UDPPort, questions ...layers.DNSQuestion) *bonjourPacket {
+	tag := vlanIdentifierTest
+	srcMAC := srcMACTest
+	return &bonjourPacket{
+		srcMAC:     &srcMAC,
+		srcIP:      srcIPv4Test,
+		srcPort:    srcPort,
+		vlanTag:    &tag,
+		isDNSQuery: true,
+		dns:        &layers.DNS{ID: id, Questions: questions},
+	}
+}
+
+func TestUnicastTableLookup(t *testing.T) {
+	table := newUnicastTable(5*time.Second, 16)
+	now := time.Now()
+
+	qu := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN | unicastResponseBit}
+	qm := layers.DNSQuestion{Name: []byte("_airplay._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}
+	table.recordQuery(createMockQuery(0, 5353, qu, qm), []uint16{42}, now)
+	table.recordQuery(createMockQuery(1234, 49152, qm), []uint16{42}, now)
+
+	// QU responses use an ID of 0
+	querier := table.lookup(0, []string{"_IPP._tcp.local"}, 42, now.Add(time.Second))
+	if querier == nil || querier.VLAN != vlanIdentifierTest || querier.Port != 5353 || querier.Legacy {
+		t.Errorf("Error in lookup() for a QU question, got %+v", querier)
+	}
+	// Multicast questions of a regular query do not expect unicast answers
+	if querier := table.lookup(0, []string{"_airplay._tcp.local"}, 42, now); querier != nil {
+		t.Errorf("Error in lookup(): QM question should not be recorded, got %+v", querier)
+	}
+	// Legacy unicast responses repeat the ID of the query
+	querier = table.lookup(1234, []string{"_airplay._tcp.local"}, 42, now)
+	if querier == nil || querier.Port != 49152 || !querier.Legacy {
+		t.Errorf("Error in lookup() for a legacy query, got %+v", querier)
+	}
+
+	if querier := table.lookup(0, []string{"_ipp._tcp.local"}, 42, now.Add(time.Minute)); querier != nil {
+		t.Error("Error in lookup(): expired queries should not match")
+	}
+	// Responses only match the queries reflected to their VLAN
+	if querier := table.lookup(0, []string{"_ipp._tcp.local"}, 43, now); querier != nil {
+		t.Errorf("Error in lookup(): query not reflected to the VLAN of the response should not match, got %+v", querier)
+	}
+	expectedReasons := []string{"relayed", "no matching query", "relayed", "matching query expired",
+		"matching query not reflected to the VLAN of the response"}
+	for i, reason := range expectedReasons {
+		if table.decisions[i].Reason != reason {
+			t.Errorf("Error in lookup(): decision %v should be %q, got %q", i, reason, table.decisions[i].Reason)
+		}
+	}
+}
+
+func TestUnicastTableEviction(t *testing.T) {
+	table := newUnicastTable(5*time.Second, 2)
+	now := time.Now()
+
+	for i, name := range []string{"a.local", "b.local", "c.local"} {
+		question := layers.DNSQuestion{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+		table.recordQuery(createMockQuery(uint16(i+1), 49152, question), []uint16{42}, now.Add(time.Duration(i)*time.Second))
+	}
+
+	if len(table.entries) != 2 {
+		t.Fatalf("Error in recordQuery(): table should be limited to 2 entries, got %v", len(table.entries))
+	}
+	if _, ok := table.entries[unicastKey{id: 1, name: "a.local"}]; ok {
+		t.Error("Error in recordQuery(): the oldest entry should have been evicted")
+	}
+}
+
+func TestRelayQUResponse(t *testing.T) {
+	cfg := brconfig{
+		UnicastTimeout:   duration{defaultUnicastTimeout},
+		UnicastTableSize: defaultUnicastTableSize,
+		conformance:      conformance{unicastResponses: true},
+		Devices: map[macAddress]bonjourDevice{
+			macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42, SharedPools: []uint16{vlanIdentifierTest}},
+		},
+	}
+	r, writer := createMockReflector(cfg)
+	question := layers.DNSQuestion{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN | unicastResponseBit}
+	querierIP := net.IP{192, 168, 30, 5}
+	r.processBonjourPacket(createMockLegacyPacket(vlanIdentifierTest, querierIP, dstIPv4Test, 5353, 5353,
+		&layers.DNS{Questions: []layers.DNSQuestion{question}}))
+
+	// The unicast response sent to the querier is relayed on its VLAN
+	writer.frames = nil
+	answer := layers.DNSResourceRecord{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 10,
+		PTR: []byte("Printer._ipp._tcp.local")}
+	response := createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, querierIP, 5353, 5353,
+		&layers.DNS{QR: true, AA: true, Answers: []layers.DNSResourceRecord{answer}})
+	if !response.quResponse || response.legacyResponse {
+		t.Fatal("Error in parseBonjourPacket(): QU response not recognized")
+	}
+	r.processBonjourPacket(response)
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != vlanIdentifierTest {
+		t.Fatalf("Error in processBonjourPacket(): QU response relayed to %v", tags)
+	}
+	relayed := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	ethernet := relayed.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := relayed.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := relayed.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if ethernet.DstMAC.String() != srcMACTest.String() || !ip.DstIP.Equal(querierIP) || udp.DstPort != 5353 {
+		t.Errorf("Error in processBonjourPacket(): QU response relayed to %v, %v:%v", ethernet.DstMAC, ip.DstIP, udp.DstPort)
+	}
+
+	// Responses sent to another host are not relayed
+	writer.frames = nil
+	r.processBonjourPacket(createMockLegacyPacket(42, net.IP{192, 168, 42, 7}, net.IP{192, 168, 30, 6}, 5353, 5353,
+		&layers.DNS{QR: true, AA: true, Answers: []layers.DNSResourceRecord{answer}}))
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): unmatched QU response relayed to %v", tags)
+	}
+
+	// Responses from a VLAN the query was not reflected to are not relayed
+	r.processBonjourPacket(createMockLegacyPacket(43, net.IP{192, 168, 43, 7}, querierIP, 5353, 5353,
+		&layers.DNS{QR: true, AA: true, Answers: []layers.DNSResourceRecord{answer}}))
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): QU response from another VLAN relayed to %v", tags)
+	}
+
+	// Nor are the responses of devices not shared with the VLAN of the querier
+	r.cfg.Devices = map[macAddress]bonjourDevice{macAddress(srcMACTest.String()): bonjourDevice{OriginPool: 42}}
+	r.processBonjourPacket(response)
+	if tags := writer.vlanTags(); len(tags) != 0 {
+		t.Errorf("Error in processBonjourPacket(): QU response of an unshared device relayed to %v", tags)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/L3Nerd/bonjour-reflector/transport"
+)
+
+// Capture mode reading the trunk through an AF_PACKET socket, which reports the VLAN tags stripped by the NIC
+const captureAFPacket = "afpacket"
+
+// Default size of the blocks of the TPACKET_V3 ring buffer of the afpacket capture mode
+const defaultRingBlockSize = 1 << 20
+
+// afpacketConfig configures the afpacket capture mode. With ring_blocks, the frames are read from a TPACKET_V3
+// ring buffer of ring_blocks blocks of block_size bytes shared with the kernel, which fills each block with many frames,
+// instead of being copied one by one by a system call: this saves CPU time, and absorbs the bursts of busy trunks.
+type afpacketConfig struct {
+	RingBlocks int `toml:"ring_blocks"`
+	BlockSize  int `toml:"block_size"`
+}
+
+func (cfg *afpacketConfig) validate() error {
+	if cfg.RingBlocks < 0 || cfg.BlockSize < 0 {
+		return fmt.Errorf("invalid afpacket section, ring_blocks and block_size cannot be negative")
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultRingBlockSize
+	}
+	if cfg.BlockSize%os.Getpagesize() != 0 {
+		return fmt.Errorf("invalid block_size %v in afpacket, expected a multiple of the page size (%v bytes)", cfg.BlockSize, os.Getpagesize())
+	}
+	return nil
+}
+
+// openAFPacketCapture opens the AF_PACKET capture of the interface, filtered by program
+func openAFPacketCapture(name string, cfg afpacketConfig, program []bpfInstruction) (captureHandle, error) {
+	return transport.OpenAFPacket(name, transport.RingConfig{Blocks: cfg.RingBlocks, BlockSize: cfg.BlockSize}, program)
+}
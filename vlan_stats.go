@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// vlanStats is the live state of a VLAN: the devices configured in it or shared with it,
+// the services visible on it, and the traffic reflected into it
+type vlanStats struct {
+	VLAN            uint16     `json:"vlan"`
+	Domain          string     `json:"domain,omitempty"`
+	Drained         bool       `json:"drained"`
+	OriginDevices   int        `json:"origin_devices"`
+	SharedDevices   int        `json:"shared_devices"`
+	VisibleServices int        `json:"visible_services"`
+	ReflectedFrames uint64     `json:"reflected_frames"`
+	ReflectedBytes  uint64     `json:"reflected_bytes"`
+	LastReflection  *time.Time `json:"last_reflection,omitempty"`
+}
+
+// vlanStats returns the state of the VLANs referenced by the configuration, or into which traffic was reflected,
+// sorted by tag
+func (r *reflector) vlanStats(now time.Time) []vlanStats {
+	stats := make(map[uint16]*vlanStats)
+	get := func(tag uint16) *vlanStats {
+		if _, ok := stats[tag]; !ok {
+			stats[tag] = &vlanStats{VLAN: tag, Domain: r.cfg.vlans[tag].Domain, Drained: r.drained.isDrained(tag)}
+		}
+		return stats[tag]
+	}
+	for _, tag := range r.cfg.configuredVLANs() {
+		get(tag)
+	}
+	for _, device := range r.cfg.Devices {
+		get(device.OriginPool).OriginDevices++
+		for _, pool := range device.SharedPools {
+			get(pool).SharedDevices++
+		}
+	}
+	for _, service := range r.services.list(now) {
+		for _, visibility := range service.VLANs {
+			get(visibility.VLAN).VisibleServices++
+		}
+	}
+	for _, usage := range r.bandwidth.snapshot("", 0) {
+		vlan := get(usage.VLAN)
+		vlan.ReflectedFrames += usage.Frames
+		vlan.ReflectedBytes += usage.Bytes
+		if last := usage.LastReflection; vlan.LastReflection == nil || last.After(*vlan.LastReflection) {
+			vlan.LastReflection = &last
+		}
+	}
+
+	list := make([]vlanStats, 0, len(stats))
+	for _, vlan := range stats {
+		list = append(list, *vlan)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VLAN < list[j].VLAN })
+	return list
+}
+
+// vlansAPI serves the live state of the VLANs on GET /api/vlans
+type vlansAPI struct {
+	reflector *reflector
+}
+
+func (api vlansAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	api.reflector.configMutex.RLock()
+	stats := api.reflector.vlanStats(time.Now())
+	api.reflector.configMutex.RUnlock()
+	json.NewEncoder(w).Encode(stats)
+}
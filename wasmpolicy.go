@@ -0,0 +1,121 @@
+//go:build wasmpolicy
+// +build wasmpolicy
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Maximal memory of the policy module, in 64 KiB pages
+const policyMemoryPages = 256
+
+// wasmPolicy runs a WebAssembly policy module in a sandbox: the module has no access to the filesystem
+// or the network, its memory is bounded, and each evaluation is aborted after a timeout.
+//
+// The module must export its memory, an "alloc" function returning the address of a buffer of the given size,
+// and an "evaluate" function receiving the address and length of the JSON packet summary, and returning
+// the address and length of the JSON verdict packed as (address << 32 | length).
+type wasmPolicy struct {
+	mutex    sync.Mutex
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	// module is the running instance, nil after a failure so that a fresh instance takes over
+	module       api.Module
+	alloc        api.Function
+	evaluateFunc api.Function
+}
+
+func loadPolicy(path string, timeout time.Duration) (policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy module: %v", err)
+	}
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().WithMemoryLimitPages(policyMemoryPages).WithCloseOnContextDone(true)
+	policy := &wasmPolicy{timeout: timeout, runtime: wazero.NewRuntimeWithConfig(ctx, config)}
+	// Modules built by TinyGo or Rust import WASI, which is provided without any preopened directory
+	wasi_snapshot_preview1.MustInstantiate(ctx, policy.runtime)
+	if policy.compiled, err = policy.runtime.CompileModule(ctx, code); err != nil {
+		return nil, fmt.Errorf("could not compile policy module: %v", err)
+	}
+	if err := policy.instantiate(ctx); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (policy *wasmPolicy) instantiate(ctx context.Context) error {
+	module, err := policy.runtime.InstantiateModule(ctx, policy.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return fmt.Errorf("could not instantiate policy module: %v", err)
+	}
+	policy.alloc = module.ExportedFunction("alloc")
+	policy.evaluateFunc = module.ExportedFunction("evaluate")
+	if policy.alloc == nil || policy.evaluateFunc == nil || module.Memory() == nil {
+		module.Close(ctx)
+		return errors.New("policy module must export memory, alloc and evaluate")
+	}
+	policy.module = module
+	return nil
+}
+
+func (policy *wasmPolicy) evaluate(summary packetSummary) (verdict policyVerdict, err error) {
+	input, err := json.Marshal(summary)
+	if err != nil {
+		return verdict, err
+	}
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), policy.timeout)
+	defer cancel()
+
+	if policy.module == nil {
+		if err := policy.instantiate(ctx); err != nil {
+			return verdict, err
+		}
+	}
+	output, err := policy.call(ctx, input)
+	if err != nil {
+		// The instance may be closed, e.g. after a timeout, or left in an inconsistent state
+		policy.module.Close(context.Background())
+		policy.module = nil
+		return verdict, err
+	}
+	err = json.Unmarshal(output, &verdict)
+	return verdict, err
+}
+
+func (policy *wasmPolicy) call(ctx context.Context, input []byte) ([]byte, error) {
+	results, err := policy.alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	address := uint32(results[0])
+	if !policy.module.Memory().Write(address, input) {
+		return nil, errors.New("alloc returned a buffer out of memory bounds")
+	}
+	results, err = policy.evaluateFunc.Call(ctx, uint64(address), uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	output, ok := policy.module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, errors.New("evaluate returned a verdict out of memory bounds")
+	}
+	return output, nil
+}
@@ -0,0 +1,17 @@
+//go:build !wasmpolicy
+// +build !wasmpolicy
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// loadPolicy fails when a policy module is configured, as WebAssembly support is only built with the wasmpolicy tag
+func loadPolicy(path string, timeout time.Duration) (policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return nil, errors.New("policy_module is set, but the reflector was built without WebAssembly support: build it with -tags wasmpolicy")
+}
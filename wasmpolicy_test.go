@@ -0,0 +1,61 @@
+//go:build wasmpolicy
+// +build wasmpolicy
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// dropPolicyModule is a minimal policy module, returning the verdict stored at the start of its memory:
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 0) "{\"action\":\"drop\"}")
+//	  (func (export "alloc") (param i32) (result i32) i32.const 1024)
+//	  (func (export "evaluate") (param i32 i32) (result i64) i64.const 17))
+var dropPolicyModule = append([]byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e,
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1d, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+	0x08, 'e', 'v', 'a', 'l', 'u', 'a', 't', 'e', 0x00, 0x01,
+	0x0a, 0x0c, 0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x04, 0x00, 0x42, 0x11, 0x0b,
+	0x0b, 0x17, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x11,
+}, []byte(`{"action":"drop"}`)...)
+
+func writePolicyModule(t *testing.T, code []byte) string {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(code)
+	file.Close()
+	return file.Name()
+}
+
+func TestWASMPolicy(t *testing.T) {
+	path := writePolicyModule(t, dropPolicyModule)
+	defer os.Remove(path)
+
+	policy, err := loadPolicy(path, time.Second)
+	if err != nil {
+		t.Fatalf("Error in loadPolicy(): %v", err)
+	}
+	verdict, err := policy.evaluate(packetSummary{VLAN: 42})
+	if err != nil || verdict.Action != "drop" {
+		t.Errorf("Error in evaluate(): got %+v %v", verdict, err)
+	}
+
+	emptyPath := writePolicyModule(t, dropPolicyModule[:8])
+	defer os.Remove(emptyPath)
+	if _, err := loadPolicy(emptyPath, time.Second); err == nil {
+		t.Error("Error in loadPolicy(): modules without the expected exports should be rejected")
+	}
+}
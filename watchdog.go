@@ -0,0 +1,198 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Checks of the watchdog during its shortest timeout
+const watchdogChecksPerTimeout = 4
+
+// Shortest timeout of the watchdog, so that a quiet trunk does not restart the capture over and over
+const minWatchdogTimeout = 10 * time.Second
+
+// Stalls found and restarts made by the watchdog, exposed on /debug/vars
+var watchdogStats = expvar.NewMap("watchdog")
+
+type watchdogConfig struct {
+	CaptureTimeout  duration `toml:"capture_timeout"`
+	PipelineTimeout duration `toml:"pipeline_timeout"`
+}
+
+func (cfg *watchdogConfig) validate() error {
+	if timeout := cfg.CaptureTimeout.Duration; timeout != 0 && timeout < minWatchdogTimeout {
+		return fmt.Errorf("invalid capture_timeout %v in watchdog section, expected at least %v", timeout, minWatchdogTimeout)
+	}
+	if timeout := cfg.PipelineTimeout.Duration; timeout != 0 && timeout < minWatchdogTimeout {
+		return fmt.Errorf("invalid pipeline_timeout %v in watchdog section, expected at least %v", timeout, minWatchdogTimeout)
+	}
+	return nil
+}
+
+func (cfg watchdogConfig) enabled() bool {
+	return cfg.CaptureTimeout.Duration > 0 || cfg.PipelineTimeout.Duration > 0
+}
+
+// watchdog rebuilds the parts of the packet loop which stop making progress: the capture, when no frame is read
+// for capture_timeout although the link of the trunk is up, and the reflection pipelines, when sending a reflection
+// takes longer than pipeline_timeout. A packet processed for longer than pipeline_timeout is reported, but the loop
+// processing it holds the state of the reflector, and cannot be replaced.
+type watchdog struct {
+	cfg       watchdogConfig
+	capture   trunkCapture
+	pipelines *reflectionPipelines
+	hooks     *hookRunner
+	status    *subsystemStatus
+	// linkUp tells whether the link of an interface is up, replaced in tests
+	linkUp func(intf string) bool
+	// captured is the time the last frame was read, and busy the time the loop started processing the current
+	// packet, 0 while it waits for the next one, both in nanoseconds and updated by the packet loop
+	captured int64
+	busy     int64
+	// reported is the busy time of the stuck packet already reported, only used by the watchdog goroutine
+	reported int64
+}
+
+// newWatchdog returns the watchdog of the configuration, or nil when it is disabled
+func newWatchdog(cfg watchdogConfig, capture trunkCapture, now time.Time) *watchdog {
+	if !cfg.enabled() {
+		return nil
+	}
+	return &watchdog{cfg: cfg, capture: capture, status: newSubsystemStatus(), linkUp: interfaceLinkUp, captured: now.UnixNano()}
+}
+
+// start watches the reflection pipelines along with the capture, and reports the stalls to hooks
+func (dog *watchdog) start(pipelines *reflectionPipelines, hooks *hookRunner) {
+	if dog == nil {
+		return
+	}
+	dog.pipelines, dog.hooks = pipelines, hooks
+	health.register("watchdog", false, dog.healthCheck())
+	go dog.run()
+}
+
+// watch returns the source of the frames of capture, recording the progress of the capture
+func (dog *watchdog) watch(capture trunkCapture) gopacket.PacketDataSource {
+	if dog == nil {
+		return capture
+	}
+	return watchedCapture{capture, dog}
+}
+
+// processing records that the packet loop started processing a packet
+func (dog *watchdog) processing(now time.Time) {
+	if dog != nil {
+		atomic.StoreInt64(&dog.busy, now.UnixNano())
+	}
+}
+
+// processed records that the packet loop waits for the next packet
+func (dog *watchdog) processed() {
+	if dog != nil {
+		atomic.StoreInt64(&dog.busy, 0)
+	}
+}
+
+// run checks the progress of the packet loop until the process exits
+func (dog *watchdog) run() {
+	interval := dog.cfg.CaptureTimeout.Duration
+	if timeout := dog.cfg.PipelineTimeout.Duration; interval == 0 || (timeout > 0 && timeout < interval) {
+		interval = timeout
+	}
+	for now := range time.Tick(interval / watchdogChecksPerTimeout) {
+		dog.check(now)
+	}
+}
+
+func (dog *watchdog) check(now time.Time) {
+	if timeout := dog.cfg.PipelineTimeout.Duration; timeout > 0 {
+		busy := atomic.LoadInt64(&dog.busy)
+		if busy != 0 && now.Sub(time.Unix(0, busy)) > timeout {
+			// While the loop is stuck, nothing is read from the capture, which must not be restarted
+			if busy != dog.reported {
+				dog.reported = busy
+				dog.trigger("packet_loop", fmt.Sprintf("a packet has been processed for more than %v", timeout), false, now)
+				dog.status.set(healthFailed, "the packet loop is stuck")
+			}
+			return
+		}
+		if dog.reported != 0 {
+			dog.reported = 0
+			logger.infof("Watchdog: the packet loop processes packets again")
+			dog.status.set(healthOK, "")
+		}
+		if family := dog.pipelines.stalled(now, timeout); family != "" {
+			dog.pipelines.restart()
+			dog.trigger(family+"_pipeline", fmt.Sprintf("a reflection has been sent for more than %v", timeout), true, now)
+		}
+	}
+	if timeout := dog.cfg.CaptureTimeout.Duration; timeout > 0 {
+		captured := atomic.LoadInt64(&dog.captured)
+		intf := dog.capture.activeInterface()
+		if now.Sub(time.Unix(0, captured)) <= timeout || !dog.linkUp(intf) {
+			return
+		}
+		// The capture gets another timeout before being restarted again
+		atomic.CompareAndSwapInt64(&dog.captured, captured, now.UnixNano())
+		if err := dog.capture.restart(); err != nil {
+			watchdogStats.Add("capture_restart_failures", 1)
+			logger.errorf("Watchdog: could not restart the capture on %v: %v", intf, err)
+			return
+		}
+		dog.trigger("capture", fmt.Sprintf("no frame was captured on %v for %v while its link is up", intf, timeout), true, now)
+	}
+}
+
+// trigger reports that component stalled, and whether it was restarted
+func (dog *watchdog) trigger(component, reason string, restarted bool, now time.Time) {
+	watchdogStats.Add(component+"_stalls", 1)
+	if restarted {
+		watchdogStats.Add(component+"_restarts", 1)
+		logger.warnf("Watchdog: %v, restarted the %v", reason, strings.Replace(component, "_", " ", -1))
+	} else {
+		logger.errorf("Watchdog: %v, the %v cannot be restarted", reason, strings.Replace(component, "_", " ", -1))
+	}
+	dog.hooks.fire(eventWatchdogTriggered, map[string]interface{}{
+		"Component": component,
+		"Reason":    reason,
+		"Restarted": restarted,
+	}, now)
+}
+
+func (dog *watchdog) healthCheck() healthCheck {
+	return dog.status.check(map[string]expvar.Var{"watchdog": watchdogStats})
+}
+
+// watchedCapture records the time of the frames read from a capture
+type watchedCapture struct {
+	trunkCapture
+	dog *watchdog
+}
+
+func (capture watchedCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, info, err := capture.trunkCapture.ReadPacketData()
+	if err == nil {
+		atomic.StoreInt64(&capture.dog.captured, time.Now().UnixNano())
+	}
+	return data, info, err
+}
+
+// interfaceLinkUp tells whether the interface name is up and, when the system reports it, has a carrier
+func interfaceLinkUp(name string) bool {
+	intf, err := net.InterfaceByName(name)
+	if err != nil || intf.Flags&net.FlagUp == 0 {
+		return false
+	}
+	if carrier, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "carrier")); err == nil {
+		return strings.TrimSpace(string(carrier)) == "1"
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogConfig(t *testing.T) {
+	cfg, err := parseConfig("")
+	if err != nil || cfg.Watchdog.enabled() {
+		t.Errorf("Error in parseConfig(): the watchdog should be disabled by default (%v)", err)
+	}
+	if newWatchdog(cfg.Watchdog, nil, time.Now()) != nil {
+		t.Error("Error in newWatchdog(): expected no watchdog when it is disabled")
+	}
+	if _, err := parseConfig("[watchdog]\ncapture_timeout = \"1s\""); err == nil || !strings.Contains(err.Error(), "capture_timeout") {
+		t.Errorf("Error in parseConfig(): expected a too short capture_timeout to be refused, got %v", err)
+	}
+	if _, err := parseConfig("[watchdog]\ncapture_timeout = \"10m\"\n[privileges]\nuser = \"nobody\""); err == nil || !strings.Contains(err.Error(), "privileges") {
+		t.Errorf("Error in parseConfig(): expected capture_timeout to be refused once the privileges are dropped, got %v", err)
+	}
+	if _, err := parseConfig("[watchdog]\npipeline_timeout = \"30s\"\n[privileges]\nuser = \"nobody\""); err != nil {
+		t.Errorf("Error in parseConfig(): expected pipeline_timeout to be accepted along with the privileges section, got %v", err)
+	}
+}
+
+func TestWatchdogCapture(t *testing.T) {
+	handles := []*mockCapture{}
+	capture, err := newFailoverCapture([]string{"eth0"}, func(string) (captureHandle, error) {
+		handles = append(handles, &mockCapture{})
+		return handles[len(handles)-1], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	dog := newWatchdog(watchdogConfig{CaptureTimeout: duration{time.Minute}}, capture, start)
+	linkUp := false
+	dog.linkUp = func(string) bool { return linkUp }
+	restarts := func() int64 { return expvarInt(watchdogStats.Get("capture_restarts")) }
+	before := restarts()
+
+	// Frames read keep the capture alive
+	dog.watch(capture).ReadPacketData()
+	dog.check(time.Now().Add(30 * time.Second))
+	// Without link, nothing is captured on purpose
+	dog.check(time.Now().Add(2 * time.Minute))
+	if len(handles) != 1 || restarts() != before {
+		t.Fatalf("Error in check(): the capture should not be restarted, got %v handles", len(handles))
+	}
+
+	linkUp = true
+	dog.check(time.Now().Add(2 * time.Minute))
+	if len(handles) != 2 || restarts()-before != 1 {
+		t.Fatalf("Error in check(): expected the stalled capture to be reopened, got %v handles", len(handles))
+	}
+	frame := createMockTaggedFrame(vlanIdentifierTest)
+	capture.WritePacketData(frame)
+	if len(handles[1].frames) != 1 {
+		t.Error("Error in restart(): the frames should be injected through the new handle")
+	}
+	// The restarted capture gets another timeout
+	dog.check(time.Now().Add(2*time.Minute + time.Second))
+	if len(handles) != 2 {
+		t.Errorf("Error in check(): the capture should not be restarted again before the timeout, got %v handles", len(handles))
+	}
+}
+
+func TestWatchdogPipelines(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	sent := make(chan bool, 4)
+	pipelines := newReflectionPipelines(pipelinesConfig{Capacity: 4}, func(bonjourPacket *bonjourPacket, tags []uint16) {
+		if tags[0] == 1 {
+			<-blocked
+		}
+		sent <- true
+	})
+	dog := newWatchdog(watchdogConfig{PipelineTimeout: duration{time.Minute}}, nil, time.Now())
+	dog.pipelines = pipelines
+	restarts := func() int64 { return expvarInt(watchdogStats.Get("ipv4_pipeline_restarts")) }
+	before := restarts()
+
+	ipv4 := createMockBonjourPacket(true)
+	pipelines.dispatch(&ipv4, []uint16{1})
+	pipelines.dispatch(&ipv4, []uint16{2})
+	time.Sleep(10 * time.Millisecond)
+	dog.check(time.Now().Add(30 * time.Second))
+	if restarts() != before {
+		t.Fatal("Error in check(): the pipeline should not be restarted before the timeout")
+	}
+	dog.check(time.Now().Add(2 * time.Minute))
+	if restarts()-before != 1 {
+		t.Fatal("Error in check(): expected the stalled pipeline to be restarted")
+	}
+	// The reflection queued behind the stuck one is dropped, and the new workers send the next ones
+	pipelines.dispatch(&ipv4, []uint16{3})
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Error in restart(): the reflections should be sent by the new pipeline")
+	}
+	pipelines.close()
+
+	// A packet stuck in the packet loop is reported once, and fails the health check
+	dog.processing(time.Now())
+	dog.check(time.Now().Add(2 * time.Minute))
+	dog.check(time.Now().Add(3 * time.Minute))
+	if stalls := expvarInt(watchdogStats.Get("packet_loop_stalls")); stalls < 1 || dog.healthCheck()().State != healthFailed {
+		t.Errorf("Error in check(): expected the stuck packet loop to be reported, got %v", watchdogStats)
+	}
+	dog.processed()
+	dog.check(time.Now())
+	if dog.healthCheck()().State != healthOK {
+		t.Error("Error in check(): the health check should recover once the packet loop processes packets again")
+	}
+}
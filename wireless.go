@@ -0,0 +1,132 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of frames injected back to back into a wireless VLAN
+	defaultWirelessBurst = 2
+	// Default delay between two frames injected into a wireless VLAN once its burst is spent
+	defaultWirelessGap = 20 * time.Millisecond
+	// Default delay above which a frame waiting for a wireless VLAN is dropped rather than queued
+	defaultWirelessMaxDelay = time.Second
+	// Default number of queriers up to which answers are sent as unicast copies on a wireless VLAN,
+	// unicast frames being sent at higher rates than multicast ones
+	defaultWirelessMaxQueriers = 8
+)
+
+// Frames delayed and dropped by the pacing of the wireless VLANs, exposed on /debug/vars
+var wirelessStats = expvar.NewMap("wireless")
+
+// wirelessConfig paces the frames injected into the VLANs marked wireless in the vlans section, as Wi-Fi
+// access points send multicast at their lowest rate, and lose it when too much arrives at once
+type wirelessConfig struct {
+	Burst       int      `toml:"burst"`
+	Gap         duration `toml:"gap"`
+	MaxDelay    duration `toml:"max_delay"`
+	MaxQueriers int      `toml:"max_queriers"`
+}
+
+func (cfg wirelessConfig) validate() error {
+	if cfg.Burst < 0 || cfg.Gap.Duration < 0 || cfg.MaxDelay.Duration < 0 || cfg.MaxQueriers < 0 {
+		return fmt.Errorf("invalid wireless section, values cannot be negative")
+	}
+	return nil
+}
+
+// wirelessPacer spaces out the frames injected into each wireless VLAN: burst frames may be sent at once,
+// the following ones gap apart
+type wirelessPacer struct {
+	mutex       sync.Mutex
+	burst       int
+	gap         time.Duration
+	maxDelay    time.Duration
+	maxQueriers int
+	vlans       map[uint16]bool
+	// next is, for each wireless VLAN, when its next frame could be sent if the burst was spent
+	next map[uint16]time.Time
+}
+
+func newWirelessPacer(cfg wirelessConfig, vlans map[uint16]vlanConfig) *wirelessPacer {
+	pacer := &wirelessPacer{
+		burst:       cfg.Burst,
+		gap:         cfg.Gap.Duration,
+		maxDelay:    cfg.MaxDelay.Duration,
+		maxQueriers: cfg.MaxQueriers,
+		next:        make(map[uint16]time.Time),
+	}
+	if pacer.burst == 0 {
+		pacer.burst = defaultWirelessBurst
+	}
+	if pacer.gap == 0 {
+		pacer.gap = defaultWirelessGap
+	}
+	if pacer.maxDelay == 0 {
+		pacer.maxDelay = defaultWirelessMaxDelay
+	}
+	if pacer.maxQueriers == 0 {
+		pacer.maxQueriers = defaultWirelessMaxQueriers
+	}
+	pacer.setVLANs(vlans)
+	return pacer
+}
+
+// setVLANs applies the wireless settings of the vlans section, on startup and on reload
+func (pacer *wirelessPacer) setVLANs(vlans map[uint16]vlanConfig) {
+	wireless := make(map[uint16]bool)
+	for tag, vlan := range vlans {
+		if vlan.Wireless {
+			wireless[tag] = true
+		}
+	}
+	pacer.mutex.Lock()
+	defer pacer.mutex.Unlock()
+	pacer.vlans = wireless
+	for tag := range pacer.next {
+		if !wireless[tag] {
+			delete(pacer.next, tag)
+		}
+	}
+}
+
+// conversionLimit returns the number of queriers up to which answers are converted to unicast copies
+// on the VLAN tag, or 0 for the limit of the multicast_to_unicast section
+func (pacer *wirelessPacer) conversionLimit(tag uint16) int {
+	pacer.mutex.Lock()
+	defer pacer.mutex.Unlock()
+	if !pacer.vlans[tag] {
+		return 0
+	}
+	return pacer.maxQueriers
+}
+
+// delay returns how long a frame injected into the VLAN tag at now must wait, and false when it would wait
+// longer than max_delay and must be dropped
+func (pacer *wirelessPacer) delay(tag uint16, now time.Time) (time.Duration, bool) {
+	pacer.mutex.Lock()
+	defer pacer.mutex.Unlock()
+	if !pacer.vlans[tag] {
+		return 0, true
+	}
+	next := pacer.next[tag]
+	if next.Before(now) {
+		next = now
+	}
+	delay := next.Sub(now) - time.Duration(pacer.burst-1)*pacer.gap
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > pacer.maxDelay {
+		wirelessStats.Add("dropped", 1)
+		return 0, false
+	}
+	pacer.next[tag] = next.Add(pacer.gap)
+	if delay > 0 {
+		wirelessStats.Add("delayed", 1)
+	}
+	return delay, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWirelessPacer(t *testing.T) {
+	pacer := newWirelessPacer(wirelessConfig{Burst: 2, Gap: duration{10 * time.Millisecond}, MaxDelay: duration{25 * time.Millisecond}},
+		map[uint16]vlanConfig{42: {Wireless: true}, 43: {}})
+	now := time.Now()
+	for i, expected := range []time.Duration{0, 0, 10 * time.Millisecond, 20 * time.Millisecond} {
+		if delay, ok := pacer.delay(42, now); !ok || delay != expected {
+			t.Errorf("Error in delay(): expected frame %v to wait %v, got %v (%v)", i, expected, delay, ok)
+		}
+	}
+	if _, ok := pacer.delay(42, now); ok {
+		t.Error("Error in delay(): expected the frame to be dropped above max_delay")
+	}
+	// The burst is available again once the VLAN was quiet
+	if delay, ok := pacer.delay(42, now.Add(time.Second)); !ok || delay != 0 {
+		t.Errorf("Error in delay(): expected the frame to be sent at once after a quiet period, got %v", delay)
+	}
+	if delay, ok := pacer.delay(43, now); !ok || delay != 0 || pacer.conversionLimit(43) != 0 {
+		t.Error("Error in delay(): wired VLANs are not paced")
+	}
+	if pacer.conversionLimit(42) != defaultWirelessMaxQueriers {
+		t.Errorf("Error in conversionLimit(): expected %v on a wireless VLAN, got %v", defaultWirelessMaxQueriers, pacer.conversionLimit(42))
+	}
+
+	pacer.setVLANs(nil)
+	if delay, ok := pacer.delay(42, now); !ok || delay != 0 {
+		t.Error("Error in setVLANs(): VLAN still paced after its wireless setting was removed")
+	}
+}
+
+func TestWirelessInjection(t *testing.T) {
+	cfg, err := parseConfig("[wireless]\nburst = 1\ngap = \"20ms\"\n\n[vlans.42]\nwireless = true")
+	if err != nil {
+		t.Fatalf("Error in parseConfig(): %v", err)
+	}
+	r, writer := createMockReflector(cfg)
+	r.write(createMockTaggedFrame(42))
+	r.write(createMockTaggedFrame(42))
+	r.write(createMockTaggedFrame(10))
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[0] != 42 || tags[1] != 10 {
+		t.Errorf("Error in write(): expected the second frame into the wireless VLAN to be delayed, got %v", tags)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tags := writer.vlanTags(); len(tags) != 3 || tags[2] != 42 {
+		t.Errorf("Error in write(): expected the delayed frame to be sent, got %v", tags)
+	}
+
+	if _, err := parseConfig("[wireless]\ngap = \"-1s\""); err == nil {
+		t.Error("Error in parseConfig(): expected a negative gap to be rejected")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"expvar"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const wsdPort = 3702
+
+// Multicast groups of WS-Discovery, used by Windows to find network printers and scanners, and by ONVIF cameras
+// (WS-Discovery 1.1, section 2.4)
+var wsdGroups = []passthroughGroup{
+	{ip: net.ParseIP("239.255.255.250"), port: wsdPort},
+	{ip: net.ParseIP("ff02::c"), port: wsdPort},
+}
+
+// WS-Discovery messages seen and reflected, exposed on /debug/vars
+var wsdStats = expvar.NewMap("wsd")
+
+func isWSDGroup(group passthroughGroup) bool {
+	for _, wsdGroup := range wsdGroups {
+		if wsdGroup.ip.Equal(group.ip) && wsdGroup.port == group.port {
+			return true
+		}
+	}
+	return false
+}
+
+// wsdMessage is a multicast WS-Discovery message: a search (Probe or Resolve) or an announcement (Hello or Bye)
+type wsdMessage struct {
+	// action is the last segment of the WS-Addressing action, which differs between the versions of the protocol
+	action string
+	// types are the types a Probe searches for, or a Hello announces
+	types string
+}
+
+func (message *wsdMessage) isSearch() bool {
+	return message.action == "Probe" || message.action == "Resolve"
+}
+
+// wsdEnvelope holds the parts of the SOAP envelope of a WS-Discovery message the reflector looks at.
+// Elements are matched whatever their namespace, so that both the 2005 draft and the OASIS standard are understood.
+type wsdEnvelope struct {
+	XMLName    xml.Name `xml:"Envelope"`
+	Action     string   `xml:"Header>Action"`
+	ProbeTypes string   `xml:"Body>Probe>Types"`
+	HelloTypes string   `xml:"Body>Hello>Types"`
+}
+
+// parseWSDMessage parses the SOAP envelope of a WS-Discovery message
+func parseWSDMessage(payload []byte) (*wsdMessage, error) {
+	var envelope wsdEnvelope
+	if err := xml.NewDecoder(bytes.NewReader(payload)).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	message := &wsdMessage{action: path.Base(envelope.Action), types: envelope.ProbeTypes + envelope.HelloTypes}
+	switch message.action {
+	case "Probe", "Resolve", "Hello", "Bye":
+		return message, nil
+	}
+	return nil, fmt.Errorf("unexpected action %q", envelope.Action)
+}
+
+// parseWSDPacket returns the WS-Discovery messages sent to one of the WS-Discovery groups
+func parseWSDPacket(packet gopacket.Packet, brMACAddress net.HardwareAddr) (bonjourPacket, bool) {
+	bonjourPacket, ok := parsePassthroughPacket(packet, brMACAddress, wsdGroups)
+	if !ok {
+		return bonjourPacket, false
+	}
+	_, payload := parseUDPLayer(packet)
+	message, err := parseWSDMessage(payload)
+	if err != nil {
+		wsdStats.Add("invalid", 1)
+		return bonjourPacket, false
+	}
+	bonjourPacket.passthrough = false
+	bonjourPacket.wsd = message
+	return bonjourPacket, true
+}
+
+// wsdTargets returns the VLANs a WS-Discovery message is reflected to: searches are reflected like queries,
+// and the announcements of a device like its answers
+func (r *reflector) wsdTargets(bonjourPacket *bonjourPacket) []uint16 {
+	if bonjourPacket.wsd.isSearch() {
+		wsdStats.Add("searches", 1)
+	} else {
+		wsdStats.Add("announcements", 1)
+	}
+	return r.discoveryTargets(bonjourPacket, bonjourPacket.wsd.isSearch(), bonjourPacket.wsd.action == "Bye")
+}
+
+// sendWSD reflects a WS-Discovery message, only rewriting its VLAN tag and source MAC address
+func (r *reflector) sendWSD(bonjourPacket *bonjourPacket) {
+	if time.Now().Before(r.warmUpUntil) {
+		return
+	}
+	frames := r.sendLinkLayer(bonjourPacket, protocolWSD, r.wsdTargets(bonjourPacket))
+	wsdStats.Add("reflected", int64(frames))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const wsdProbeTest = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing"
+  xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof">
+<soap:Header>
+<wsa:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</wsa:To>
+<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</wsa:Action>
+<wsa:MessageID>urn:uuid:0a6dc791-2be6-4991-9af1-454778a1917a</wsa:MessageID>
+</soap:Header>
+<soap:Body><wsd:Probe><wsd:Types>wsdp:Device</wsd:Types></wsd:Probe></soap:Body>
+</soap:Envelope>`
+
+const wsdHelloTest = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing"
+  xmlns:d="http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<s:Header>
+<a:Action>http://docs.oasis-open.org/ws-dd/ns/discovery/2009/01/Hello</a:Action>
+<a:MessageID>urn:uuid:3b4a5e32-7d4c-4d0e-9e5a-8f1c2d3e4f50</a:MessageID>
+</s:Header>
+<s:Body><d:Hello><a:EndpointReference><a:Address>urn:uuid:5f5a69c2-e0ae-504f-829b-00387a0c3b5f</a:Address></a:EndpointReference>
+<d:Types>dn:NetworkVideoTransmitter</d:Types><d:XAddrs>http://192.168.1.20/onvif/device_service</d:XAddrs>
+<d:MetadataVersion>1</d:MetadataVersion></d:Hello></s:Body>
+</s:Envelope>`
+
+func createMockWSDPacket(tag uint16, payload string) gopacket.Packet {
+	ipv4 := &layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolUDP, SrcIP: srcIPv4Test, DstIP: []byte{239, 255, 255, 250}}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: wsdPort}
+	udp.SetNetworkLayerForChecksum(ipv4)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: srcMACTest, DstMAC: []byte{0x01, 0x00, 0x5E, 0x7F, 0xFF, 0xFA}, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: tag, Type: layers.EthernetTypeIPv4},
+		ipv4, udp, gopacket.Payload(payload))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestParseWSDMessage(t *testing.T) {
+	message, err := parseWSDMessage([]byte(wsdProbeTest))
+	if err != nil || !message.isSearch() || message.action != "Probe" || message.types != "wsdp:Device" {
+		t.Errorf("Error in parseWSDMessage(): got %+v (%v)", message, err)
+	}
+	message, err = parseWSDMessage([]byte(wsdHelloTest))
+	if err != nil || message.isSearch() || message.action != "Hello" || message.types != "dn:NetworkVideoTransmitter" {
+		t.Errorf("Error in parseWSDMessage(): got %+v (%v)", message, err)
+	}
+	probeMatches := strings.Replace(wsdProbeTest, "discovery/Probe<", "discovery/ProbeMatches<", 1)
+	for _, payload := range []string{"", "M-SEARCH * HTTP/1.1\r\n\r\n", "<Envelope><Header></Header></Envelope>", probeMatches} {
+		if _, err := parseWSDMessage([]byte(payload)); err == nil {
+			t.Errorf("Error in parseWSDMessage(): expected an error for %q", payload)
+		}
+	}
+}
+
+func TestWSDReflection(t *testing.T) {
+	cfg, err := parseConfig(fmt.Sprintf(`wsd_reflection = true
+		[devices.%q]
+		origin_pool = %v
+		shared_pools = [42, 43]`, srcMACTest, vlanIdentifierTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter := buildCaptureFilter(&cfg); !strings.Contains(filter, "dst host 239.255.255.250 and udp dst port 3702") {
+		t.Errorf("Error in buildCaptureFilter(): expected the WS-Discovery groups to be captured, got %q", filter)
+	}
+
+	bonjourPacket, ok := parseWSDPacket(createMockWSDPacket(vlanIdentifierTest, wsdHelloTest), brMACTest)
+	if !ok || bonjourPacket.wsd == nil || bonjourPacket.passthrough {
+		t.Fatal("Error in parseWSDPacket(): expected the announcement to be parsed")
+	}
+	r, writer := createMockReflector(cfg)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 2 || tags[0] != 42 || tags[1] != 43 {
+		t.Fatalf("Error in processBonjourPacket(): expected the announcement to be reflected to the shared pools, got %v", tags)
+	}
+	reflected := gopacket.NewPacket(writer.frames[0], layers.LayerTypeEthernet, gopacket.Default)
+	if udp, ok := reflected.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || string(udp.Payload) != wsdHelloTest {
+		t.Error("Error in processBonjourPacket(): expected the announcement to be reflected unmodified")
+	}
+
+	// Probes from a VLAN sharing the device are reflected to its origin pool
+	writer.frames = nil
+	bonjourPacket, _ = parseWSDPacket(createMockWSDPacket(42, wsdProbeTest), brMACTest)
+	r.processBonjourPacket(bonjourPacket)
+	if tags := writer.vlanTags(); len(tags) != 1 || tags[0] != vlanIdentifierTest {
+		t.Errorf("Error in processBonjourPacket(): expected the probe to be reflected to the origin pool, got %v", tags)
+	}
+
+	if _, err := parseConfig(`wsd_reflection = true
+		passthrough = ["239.255.255.250:3702"]`); err == nil {
+		t.Error("Error in parseConfig(): WS-Discovery groups should not be passed through when reflected")
+	}
+}